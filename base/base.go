@@ -17,14 +17,20 @@ package base
 
 import (
 	"container/heap"
+	"crypto/sha256"
 	"flag"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"log"
+	"math"
+	"math/rand"
 	"net/http"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -37,16 +43,101 @@ import (
 var VerboseLogging = flag.Int("v", -1, "log many verbose logs")
 
 // V provides verbose logging which can be turned on/off with the -v flag.
-func V(level int, fmt string, args ...interface{}) {
+// Messages go to the current Logger (see SetLogger) with no module or fields;
+// new code should prefer a ModuleLogger from Module.
+func V(level int, format string, args ...interface{}) {
 	if *VerboseLogging >= level {
-		log.Printf(fmt, args...)
+		currentLogger().Log(level, "", fmt.Sprintf(format, args...))
 	}
 }
 
+// baseLog logs for this package.
+var baseLog = Module("base")
+
 // Packet is a single packet with its metadata.
 type Packet struct {
-	Data                 []byte // The actual bytes that make up the packet
-	gopacket.CaptureInfo        // Metadata about when/how the packet was captured
+	Data                 []byte            // The actual bytes that make up the packet
+	gopacket.CaptureInfo                   // Metadata about when/how the packet was captured
+	Meta                 PacketMetadata    // Capture details beyond CaptureInfo, if known
+	Tags                 map[string]string // Annotations added by enrichment stages, may be nil
+
+	info layerInfo // Lazily decoded header information, see layers()
+	// Set for packets from GetPacket and NewPooledPacket, see Release.
+	fromPool, pooledData bool
+}
+
+// PacketMetadata carries capture details that gopacket.CaptureInfo has no
+// room for.  Its zero value means nothing is known.  The packet's original
+// length on the wire versus its captured length is already in CaptureInfo as
+// Length and CaptureLength; see Packet.Truncated.
+type PacketMetadata struct {
+	Interface string `json:"interface,omitempty"` // Capturing interface, "" if unknown
+	Thread    int    `json:"thread"`              // Capturing stenotype thread, if Interface is set
+	// VLAN is the 802.1Q tag control information the kernel stripped from the
+	// packet and reported in PACKET_AUXDATA.  It's only meaningful if
+	// VLANValid is set.  VLANTPID is the tag's protocol ID, or 0 if the
+	// kernel didn't report one.
+	VLAN      uint16 `json:"vlan,omitempty"`
+	VLANTPID  uint16 `json:"vlan_tpid,omitempty"`
+	VLANValid bool   `json:"vlan_valid,omitempty"`
+	// Provenance, if known, is where the packet's blockfile says it was
+	// captured.  It's shared by every packet from the same file.
+	Provenance *Provenance `json:"provenance,omitempty"`
+}
+
+// Provenance records where and how packets were captured, for evidence
+// handling.  Blockfiles in format v2 record it in their headers.
+type Provenance struct {
+	Host      string `json:"host,omitempty"`
+	Interface string `json:"interface,omitempty"`
+	Version   string `json:"version,omitempty"` // Of the capturing software
+	Filter    string `json:"filter,omitempty"`  // Compiled BPF capture filter, hex-encoded
+}
+
+// Truncated returns true if the packet was captured (or later truncated)
+// shorter than its original length on the wire.
+func (p *Packet) Truncated() bool {
+	return p.CaptureLength < p.Length
+}
+
+// Truncate shortens the packet's data to at most snaplen bytes.  It never
+// grows the data: CaptureLength is always set to min(snaplen, len(Data)),
+// while Length, the packet's original size on the wire, is left untouched.
+func (p *Packet) Truncate(snaplen int) {
+	if snaplen < 0 {
+		snaplen = 0
+	}
+	if snaplen < len(p.Data) {
+		p.Data = p.Data[:snaplen]
+		p.info = layerInfo{} // headers may have been cut off
+	}
+	p.CaptureLength = len(p.Data)
+}
+
+// ToUTC converts the packet's timestamp to UTC.  Ordering packets (as
+// MergePacketChans does) compares instants, so it works regardless of time
+// zone, but anything displaying or serializing timestamps should see UTC, so
+// local time zones never leak into output.  Readers producing packets call
+// this on ingest.
+func (p *Packet) ToUTC() {
+	p.Timestamp = p.Timestamp.UTC()
+}
+
+// Hash returns a fast, non-cryptographic (FNV-1a) hash of the packet's data.
+// It's meant for in-memory structures like dedup windows, where speed matters
+// and collisions are merely a nuisance.
+func (p *Packet) Hash() uint64 {
+	h := fnv.New64a()
+	h.Write(p.Data)
+	return h.Sum64()
+}
+
+// BytesHash returns the SHA-256 digest of the packet's data.  It's several
+// times slower than Hash, but collision-resistant, so it's suitable for keying
+// content-addressed stores that dedup packets across files, or for integrity
+// checks.  Use Hash for anything that stays in memory.
+func (p *Packet) BytesHash() [32]byte {
+	return sha256.Sum256(p.Data)
 }
 
 // PacketChan provides an async method for passing multiple ordered packets
@@ -56,26 +147,164 @@ type PacketChan struct {
 	c  chan *Packet
 	// C can be used to send packets on this channel in a select.  Do NOT
 	// call 'close' on it... instead call the Close function.
-	C    chan<- *Packet
-	err  error
-	done chan struct{}
+	C      chan<- *Packet
+	err    error
+	done   chan struct{}
+	closed bool // protected by mu
+	// cancel is closed by Cancel, to tell the producer to stop.
+	cancel     chan struct{}
+	cancelOnce sync.Once
+	// sending is read-locked by Send, and write-locked by Close while it
+	// closes c, so a Close racing with a Send can't cause a panic.
+	sending sync.RWMutex
+	// telemetry holds a *ChanTelemetry once Instrument has been called.
+	telemetry atomic.Value
 }
 
 // Receive provides the channel from which to read packets.  It always
 // returns the same channel.
 func (p *PacketChan) Receive() <-chan *Packet { return p.c }
 
-// Send sends a single packet on the channel to the receiver.
-func (p *PacketChan) Send(pkt *Packet) { p.c <- pkt }
+// Send sends a single packet on the channel to the receiver.  If the channel
+// is closed or canceled before (or while) the packet is sent, the packet is
+// dropped.
+func (p *PacketChan) Send(pkt *Packet) {
+	p.sending.RLock()
+	defer p.sending.RUnlock()
+	select {
+	case <-p.done:
+		return
+	case <-p.cancel:
+		return
+	default:
+	}
+	p.send(pkt, p.telemetryOrNil())
+}
+
+// send sends pkt, returning false if the channel was closed or canceled
+// first.  The caller must hold p.sending's read lock.
+func (p *PacketChan) send(pkt *Packet, t *ChanTelemetry) bool {
+	if t == nil {
+		select {
+		case p.c <- pkt:
+			return true
+		case <-p.done:
+		case <-p.cancel:
+		}
+		return false
+	}
+	select {
+	case p.c <- pkt:
+		t.sent(pkt)
+		return true
+	default:
+	}
+	start := time.Now()
+	defer t.blockedSince(start)
+	select {
+	case p.c <- pkt:
+		t.sent(pkt)
+		return true
+	case <-p.done:
+	case <-p.cancel:
+	}
+	return false
+}
+
+// SendBatch sends packets on the channel in order, returning how many were
+// sent before the channel was closed or canceled; the rest are dropped.  It
+// takes the channel's locks once for the whole batch, rather than once per
+// packet as calling Send repeatedly would.
+func (p *PacketChan) SendBatch(pkts []*Packet) int {
+	p.sending.RLock()
+	defer p.sending.RUnlock()
+	select {
+	case <-p.done:
+		return 0
+	default:
+	}
+	t := p.telemetryOrNil()
+	for i, pkt := range pkts {
+		if !p.send(pkt, t) {
+			return i
+		}
+	}
+	return len(pkts)
+}
+
+// ReceiveBatch blocks until at least one packet is available, then appends it
+// and any further packets which can be received without blocking to buf, up
+// to cap(buf).  It returns the extended buffer, and false once the channel is
+// closed and drained.  Receiving whatever's already buffered in one go means
+// the receiver wakes up once per batch instead of once per packet.
+func (p *PacketChan) ReceiveBatch(buf []*Packet) ([]*Packet, bool) {
+	pkt, ok := <-p.c
+	if !ok {
+		return buf, false
+	}
+	return p.receiveBuffered(append(buf, pkt)), true
+}
+
+// receiveBuffered appends packets to buf up to cap(buf), stopping as soon as
+// receiving would block or the channel is closed.
+func (p *PacketChan) receiveBuffered(buf []*Packet) []*Packet {
+	for len(buf) < cap(buf) {
+		select {
+		case pkt, ok := <-p.c:
+			if !ok {
+				return buf
+			}
+			buf = append(buf, pkt)
+		default:
+			return buf
+		}
+	}
+	return buf
+}
+
+// Cancel tells the channel's producer that no more packets are wanted.  It
+// doesn't close the channel: producers should watch Canceled, stop generating
+// packets, and Close the channel themselves.  Sends after Cancel drop their
+// packets rather than blocking.  Cancel may be called multiple times.
+func (p *PacketChan) Cancel() {
+	p.cancelOnce.Do(func() { close(p.cancel) })
+}
+
+// Canceled returns a channel that is closed once Cancel has been called.
+// Producers doing expensive work to generate packets should select on it.
+func (p *PacketChan) Canceled() <-chan struct{} {
+	return p.cancel
+}
+
+// canceled returns true if Cancel has been called.
+func (p *PacketChan) canceled() bool {
+	select {
+	case <-p.cancel:
+		return true
+	default:
+		return false
+	}
+}
 
 // Close closes the sending channel and sets the PacketChan's error based
-// in its input.
+// in its input.  Only the first call to Close has any effect.
 func (p *PacketChan) Close(err error) {
 	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	p.closed = true
 	p.err = err
+	t := p.telemetryOrNil()
 	p.mu.Unlock()
+	close(p.done) // unblocks any pending Send calls
+	p.sending.Lock()
+	if t != nil {
+		t.publish() // No sends remain in flight, so the counts are final.
+	}
 	close(p.c)
-	close(p.done)
+	p.sending.Unlock()
 }
 
 // Done returns a channel that is closed when this packet channel is complete.
@@ -86,28 +315,98 @@ func (p *PacketChan) Done() <-chan struct{} {
 // NewPacketChan returns a new PacketChan channel for passing packets around.
 func NewPacketChan(buffer int) *PacketChan {
 	pc := &PacketChan{
-		c:    make(chan *Packet, buffer),
-		done: make(chan struct{}),
+		c:      make(chan *Packet, buffer),
+		done:   make(chan struct{}),
+		cancel: make(chan struct{}),
 	}
 	pc.C = pc.c
 	return pc
 }
 
+// NewPacketChanContext returns a new PacketChan which is canceled (see
+// Cancel) when ctx is done, so its producer stops once the consumer no longer
+// cares about its packets, for example because a client disconnected.
+func NewPacketChanContext(ctx context.Context, buffer int) *PacketChan {
+	pc := NewPacketChan(buffer)
+	go func() {
+		select {
+		case <-ctx.Done():
+			pc.Cancel()
+		case <-pc.done:
+		}
+	}()
+	return pc
+}
+
 // Discard discards all remaining packets on the receiving end.  If you stop
 // using the channel before reading all packets, you must call this function.
-// It's a good idea to defer this regardless.
+// It's a good idea to defer this regardless.  Discard also cancels the
+// channel, so producers watching Canceled stop early.
 func (p *PacketChan) Discard() {
+	p.Cancel()
 	go func() {
 		discarded := 0
 		for _ = range p.c {
 			discarded++
 		}
 		if discarded > 0 {
-			V(2, "discarded %v", discarded)
+			baseLog.V(2, "discarded packets", "count", discarded)
 		}
 	}()
 }
 
+// DrainTimeout synchronously discards packets for up to d, returning how many
+// it discarded and whether the channel finished (closed) within that time.
+// This bounds how long cleanup takes while giving visibility into how much
+// was left.  If d passes before the channel finishes, the remainder is
+// discarded in the background as with Discard, so the producer still
+// unblocks eventually.
+func (p *PacketChan) DrainTimeout(d time.Duration) (int, bool) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	discarded := 0
+	for {
+		select {
+		case _, ok := <-p.c:
+			if !ok {
+				return discarded, true
+			}
+			discarded++
+		case <-timer.C:
+			baseLog.V(2, "drain timed out", "timeout", d, "discarded", discarded)
+			p.Discard()
+			return discarded, false
+		}
+	}
+}
+
+// CollectSorted reads up to max packets from the channel and returns them
+// sorted by timestamp.  This is handy for small result sets from unordered
+// sources, which need time order for display.  If max packets are read, the
+// rest of the channel is discarded; otherwise the channel's error, if any, is
+// returned along with the packets read before it closed.
+func (p *PacketChan) CollectSorted(max int) ([]*Packet, error) {
+	var out []*Packet
+	for len(out) < max {
+		pkt, ok := <-p.Receive()
+		if !ok {
+			break
+		}
+		out = append(out, pkt)
+	}
+	if len(out) >= max {
+		p.Discard()
+	}
+	sort.Stable(packetsByTimestamp(out))
+	return out, p.Err()
+}
+
+type packetsByTimestamp []*Packet
+
+func (a packetsByTimestamp) Len() int           { return len(a) }
+func (a packetsByTimestamp) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a packetsByTimestamp) Less(i, j int) bool { return a[i].Timestamp.Before(a[j].Timestamp) }
+
 // Err gets the current error for the channel, if any exists.  This may be
 // called during Next(), but if an error occurs it may only be set after Next()
 // returns false the first time.
@@ -124,18 +423,77 @@ type indexedPacket struct {
 }
 
 // packetHeap is used internally by MergePacketChans.
-type packetHeap []indexedPacket
+type packetHeap struct {
+	pkts []indexedPacket
+	less func(a, b *indexedPacket) bool
+	// weights, if set, breaks ties between packets with equal timestamps
+	// randomly, favoring each stream in proportion to its weight.  See next.
+	weights []float64
+	rng     *rand.Rand
+	// stats, if set, counts the packets output from each stream.
+	stats *MergeStats
+	// errs, if set, makes the merge tolerant: errors from input streams are
+	// recorded here, and merging continues without them.
+	errs *MergeErrors
+}
 
-func (p packetHeap) Len() int            { return len(p) }
-func (p packetHeap) Swap(i, j int)       { p[i], p[j] = p[j], p[i] }
-func (p packetHeap) Less(i, j int) bool  { return p[i].Timestamp.Before(p[j].Timestamp) }
-func (p *packetHeap) Push(x interface{}) { *p = append(*p, x.(indexedPacket)) }
+// inputErr returns the error, if any, which should stop the merge after a
+// receive from in[i].  'exhausted' reports whether that receive found the
+// input closed.  Tolerant merges record an input's error once it's
+// exhausted, keeping any packets it sent first, and never stop.
+func (p *packetHeap) inputErr(in []*PacketChan, i int, exhausted bool) error {
+	err := in[i].Err()
+	if err == nil || p.errs == nil {
+		return err
+	}
+	if exhausted {
+		p.errs.add(i, err)
+	}
+	return nil
+}
+
+func (p *packetHeap) Len() int           { return len(p.pkts) }
+func (p *packetHeap) Swap(i, j int)      { p.pkts[i], p.pkts[j] = p.pkts[j], p.pkts[i] }
+func (p *packetHeap) Less(i, j int) bool { return p.less(&p.pkts[i], &p.pkts[j]) }
+func (p *packetHeap) Push(x interface{}) { p.pkts = append(p.pkts, x.(indexedPacket)) }
 func (p *packetHeap) Pop() (x interface{}) {
-	index := len(*p) - 1
-	*p, x = (*p)[:index], (*p)[index]
+	index := len(p.pkts) - 1
+	p.pkts, x = p.pkts[:index], p.pkts[index]
 	return
 }
 
+// next removes and returns the next packet to output.
+func (p *packetHeap) next() indexedPacket {
+	pkt := heap.Pop(p).(indexedPacket)
+	if p.weights == nil || p.Len() == 0 || !p.pkts[0].Timestamp.Equal(pkt.Timestamp) {
+		return pkt
+	}
+	ties := []indexedPacket{pkt}
+	total := p.weights[pkt.i]
+	for p.Len() > 0 && p.pkts[0].Timestamp.Equal(pkt.Timestamp) {
+		tie := heap.Pop(p).(indexedPacket)
+		ties = append(ties, tie)
+		total += p.weights[tie.i]
+	}
+	choice := len(ties) - 1
+	r := p.rng.Float64() * total
+	for i, tie := range ties {
+		if r -= p.weights[tie.i]; r < 0 {
+			choice = i
+			break
+		}
+	}
+	for i, tie := range ties {
+		if i != choice {
+			heap.Push(p, tie)
+		}
+	}
+	return ties[choice]
+}
+
+// byTimestamp orders packets by their capture time.
+func byTimestamp(a, b *indexedPacket) bool { return a.Timestamp.Before(b.Timestamp) }
+
 // ConcatPacketChans concatenates packet chans in order.
 func ConcatPacketChans(ctx context.Context, in <-chan *PacketChan) *PacketChan {
 	out := NewPacketChan(100)
@@ -167,46 +525,296 @@ func ConcatPacketChans(ctx context.Context, in <-chan *PacketChan) *PacketChan {
 }
 
 // MergePacketChans merges an incoming set of packet chans, each sorted by
-// time, returning a new single packet chan that's also sorted by time.
+// time, returning a new single packet chan that's also sorted by time.  Once
+// ctx is done or the output is canceled, the merge stops and cancels all of
+// its inputs, so cancellation propagates upstream to their producers.
 func MergePacketChans(ctx context.Context, in []*PacketChan) *PacketChan {
-	out := NewPacketChan(100)
-	go func() {
-		count := 0
-		defer func() {
-			V(1, "merged %d streams for %d total packets", len(in), count)
-		}()
-		var h packetHeap
-		for i := range in {
-			defer in[i].Discard()
-		}
-		for i, c := range in {
-			select {
-			case pkt := <-c.Receive():
-				if pkt != nil {
-					heap.Push(&h, indexedPacket{Packet: pkt, i: i})
-				}
-				if err := c.Err(); err != nil {
+	return mergePacketChans(ctx, in, packetHeap{less: byTimestamp})
+}
+
+// MergePacketChansEpsilon acts like MergePacketChans, but treats packets whose
+// timestamps are within epsilon of each other as simultaneous, breaking such
+// ties by stream index.  Use this when merging captures from hosts whose
+// clocks are skewed by a few microseconds, to avoid spurious interleaving
+// caused purely by that skew.  Note that within an epsilon window, relative
+// ordering is by stream, NOT by time.
+func MergePacketChansEpsilon(ctx context.Context, in []*PacketChan, epsilon time.Duration) *PacketChan {
+	return mergePacketChans(ctx, in, packetHeap{less: func(a, b *indexedPacket) bool {
+		if d := a.Timestamp.Sub(b.Timestamp); d < -epsilon || d > epsilon {
+			return d < 0
+		}
+		return a.i < b.i
+	}})
+}
+
+// MergePacketChansWeighted acts like MergePacketChans, but breaks ties
+// between packets with identical timestamps randomly, favoring each stream in
+// proportion to its weight.  This is useful when blending a high-rate source
+// with a low-rate one, where the high-rate source should dominate the
+// interleaving without strictly preempting the other.  Random numbers come
+// from rng, or from a fixed seed if rng is nil, so results are reproducible.
+// weights must have one positive entry per input, or the returned channel is
+// closed with an error.
+func MergePacketChansWeighted(ctx context.Context, in []*PacketChan, weights []float64, rng *rand.Rand) *PacketChan {
+	if err := validateWeights(len(in), weights); err != nil {
+		out := NewPacketChan(0)
+		out.Close(err)
+		for _, c := range in {
+			c.Discard()
+		}
+		return out
+	}
+	if rng == nil {
+		rng = rand.New(rand.NewSource(1))
+	}
+	return mergePacketChans(ctx, in, packetHeap{less: byTimestamp, weights: weights, rng: rng})
+}
+
+func validateWeights(streams int, weights []float64) error {
+	if len(weights) != streams {
+		return fmt.Errorf("got %d weights for %d streams", len(weights), streams)
+	}
+	for i, w := range weights {
+		if !(w > 0) || math.IsInf(w, 1) {
+			return fmt.Errorf("weight %d is %v, must be positive and finite", i, w)
+		}
+	}
+	return nil
+}
+
+// forwardPacketChan copies packets from in to out until in is exhausted or
+// ctx is done, then closes out.  It has the same error and Discard semantics
+// as merging a single stream through the heap.
+func forwardPacketChan(ctx context.Context, in, out *PacketChan, h packetHeap) {
+	count := 0
+	defer func() {
+		baseLog.V(1, "merged streams", "streams", 1, "packets", count)
+	}()
+	defer in.Discard()
+	for {
+		select {
+		case pkt, ok := <-in.Receive():
+			if !ok {
+				if err := h.inputErr([]*PacketChan{in}, 0, true); err != nil {
 					out.Close(err)
-					return
+				} else {
+					out.Close(ctx.Err())
 				}
+				return
+			}
+			select {
+			case out.c <- pkt:
+				count++
+				h.stats.add(0)
 			case <-ctx.Done():
 				out.Close(ctx.Err())
 				return
+			case <-out.cancel:
+				out.Close(nil)
+				return
 			}
+		case <-ctx.Done():
+			out.Close(ctx.Err())
+			return
+		case <-out.cancel:
+			out.Close(nil)
+			return
 		}
-		for h.Len() > 0 && !ContextDone(ctx) {
-			p := heap.Pop(&h).(indexedPacket)
-			count++
-			if pkt := <-in[p.i].Receive(); pkt != nil {
-				heap.Push(&h, indexedPacket{Packet: pkt, i: p.i})
+	}
+}
+
+// mergeBatchSize is the largest batch of packets mergePacketChans sends at
+// once.
+const mergeBatchSize = 64
+
+// mergePacketChans merges packet chans, picking the next packet to output
+// based on the ordering of the given (empty) heap.  Unless the heap breaks
+// ties by weight, the merge itself runs on a loser tree; see mergeLoserTree.
+func mergePacketChans(ctx context.Context, in []*PacketChan, h packetHeap) *PacketChan {
+	out := NewPacketChan(100)
+	if len(in) == 0 {
+		// Queries may match no blockfiles at all; don't bother starting a
+		// goroutine just to close an empty stream.
+		out.Close(nil)
+		return out
+	} else if len(in) == 1 {
+		// Many queries hit exactly one blockfile, in which case there's
+		// nothing to order and merging is pure overhead.
+		go forwardPacketChan(ctx, in[0], out, h)
+		return out
+	}
+	if h.weights == nil {
+		go mergeLoserTree(ctx, in, out, h)
+	} else {
+		go mergeHeap(ctx, in, out, h)
+	}
+	return out
+}
+
+// mergeHeap merges 'in' to 'out' using a heap.  It's slower than
+// mergeLoserTree, but supports weighted tie-breaking.
+func mergeHeap(ctx context.Context, in []*PacketChan, out *PacketChan, h packetHeap) {
+	count := 0
+	defer func() {
+		baseLog.V(1, "merged streams", "streams", len(in), "packets", count)
+	}()
+	for i := range in {
+		defer in[i].Discard()
+	}
+	for i, c := range in {
+		select {
+		case pkt := <-c.Receive():
+			if pkt != nil {
+				heap.Push(&h, indexedPacket{Packet: pkt, i: i})
 			}
-			out.c <- p.Packet
-			if err := in[p.i].Err(); err != nil {
+			if err := h.inputErr(in, i, pkt == nil); err != nil {
 				out.Close(err)
 				return
 			}
+		case <-ctx.Done():
+			out.Close(ctx.Err())
+			return
+		}
+	}
+	// Output packets are sent in batches, flushed whenever waiting on an
+	// input would otherwise delay them.
+	batch := make([]*Packet, 0, mergeBatchSize)
+	flush := func() {
+		out.SendBatch(batch)
+		batch = batch[:0]
+	}
+	for h.Len() > 0 && !ContextDone(ctx) && !out.canceled() {
+		p := h.next()
+		count++
+		h.stats.add(p.i)
+		if batch = append(batch, p.Packet); len(batch) == cap(batch) {
+			flush()
+		}
+		var pkt *Packet
+		select {
+		case pkt = <-in[p.i].Receive():
+		default:
+			flush()
+			pkt = <-in[p.i].Receive()
+		}
+		if pkt != nil {
+			heap.Push(&h, indexedPacket{Packet: pkt, i: p.i})
+		}
+		if err := h.inputErr(in, p.i, pkt == nil); err != nil {
+			flush()
+			out.Close(err)
+			return
+		}
+	}
+	flush()
+	out.Close(ctx.Err())
+}
+
+// MergeStats reports how many packets each input stream of a merge
+// contributed to its output, which helps explain why a query's results skew
+// toward one blockfile.
+type MergeStats struct {
+	counts []int64
+}
+
+// add counts a packet output from stream i.  It's a no-op on a nil
+// *MergeStats.
+func (m *MergeStats) add(i int) {
+	if m != nil {
+		atomic.AddInt64(&m.counts[i], 1)
+	}
+}
+
+// Counts returns the number of packets output from each input stream, indexed
+// identically to the merge's inputs.  Counts are only final once the merged
+// output has closed.
+func (m *MergeStats) Counts() []int64 {
+	out := make([]int64, len(m.counts))
+	for i := range m.counts {
+		out[i] = atomic.LoadInt64(&m.counts[i])
+	}
+	return out
+}
+
+// MergePacketChansWithStats acts like MergePacketChans, but also returns
+// per-stream counts of merged packets.
+func MergePacketChansWithStats(ctx context.Context, in []*PacketChan) (*PacketChan, *MergeStats) {
+	stats := &MergeStats{counts: make([]int64, len(in))}
+	return mergePacketChans(ctx, in, packetHeap{less: byTimestamp, stats: stats}), stats
+}
+
+// MergeErrors records the errors from input streams of a tolerant merge.
+type MergeErrors struct {
+	mu      sync.Mutex
+	streams int
+	errs    map[int]error
+}
+
+func (m *MergeErrors) add(i int, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.errs[i] = err
+}
+
+// Errors returns the error from each failed input stream, keyed by its index
+// in the merge's inputs.  It's only final once the merged output has closed.
+func (m *MergeErrors) Errors() map[int]error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make(map[int]error, len(m.errs))
+	for i, err := range m.errs {
+		out[i] = err
+	}
+	return out
+}
+
+// Err returns nil if no input stream failed, or else a single error
+// describing every failure.
+func (m *MergeErrors) Err() error {
+	errs := m.Errors()
+	if len(errs) == 0 {
+		return nil
+	}
+	var streams []int
+	for i := range errs {
+		streams = append(streams, i)
+	}
+	sort.Ints(streams)
+	msgs := make([]string, len(streams))
+	for j, i := range streams {
+		msgs[j] = fmt.Sprintf("stream %d: %v", i, errs[i])
+	}
+	return fmt.Errorf("%d of %d merged streams failed: %s", len(errs), m.streams, strings.Join(msgs, "; "))
+}
+
+// MergePacketChansTolerant acts like MergePacketChans, except that an error on
+// one input doesn't stop the merge.  The failed input's packets up to its
+// error are kept, the remaining inputs are merged as usual, and the error is
+// recorded in the returned MergeErrors.  The merged output itself only fails
+// if ctx does.  Callers wanting completeness should check MergeErrors.Err once
+// the output has closed; callers wanting availability can just report it.
+func MergePacketChansTolerant(ctx context.Context, in []*PacketChan) (*PacketChan, *MergeErrors) {
+	errs := &MergeErrors{streams: len(in), errs: map[int]error{}}
+	return mergePacketChans(ctx, in, packetHeap{less: byTimestamp, errs: errs}), errs
+}
+
+// MergeClosers acts like MergePacketChans, but also takes ownership of a set
+// of resources (open files, network connections) backing the inputs.  Each
+// closer is closed exactly once, after the merged output has finished, whether
+// it finished by exhausting its inputs, by hitting an error, or by having its
+// context canceled.
+func MergeClosers(ctx context.Context, in []*PacketChan, closers []io.Closer) *PacketChan {
+	out := MergePacketChans(ctx, in)
+	go func() {
+		<-out.Done()
+		for _, c := range closers {
+			if c == nil {
+				continue
+			}
+			if err := c.Close(); err != nil {
+				baseLog.V(1, "error closing merge input", "error", err)
+			}
 		}
-		out.Close(ctx.Err())
 	}()
 	return out
 }
@@ -294,6 +902,250 @@ func (a Positions) Intersect(b Positions) (out Positions) {
 	return out
 }
 
+// SubtractMany returns the positions in a which appear in none of 'others'.
+// This is equivalent to subtracting the union of 'others' from a, but is done
+// in a single pass over all inputs without building that union.  All inputs
+// must be sorted in advance.  Returned slice will be sorted.
+// a may be returned by SubtractMany, but no input will be modified.
+//
+// We have no way to represent "all positions except these", so if a is
+// AllPositions it's returned unchanged.
+func (a Positions) SubtractMany(others ...Positions) Positions {
+	if a.IsAllPositions() || len(a) == 0 {
+		return a
+	}
+	var active []Positions
+	for _, b := range others {
+		if b.IsAllPositions() {
+			return NoPositions
+		}
+		if len(b) > 0 {
+			active = append(active, b)
+		}
+	}
+	if len(active) == 0 {
+		return a
+	}
+	out := make(Positions, 0, len(a))
+	cursors := make([]int, len(active))
+	for _, pos := range a {
+		found := false
+		for i, b := range active {
+			ib := cursors[i]
+			for ib < len(b) && b[ib] < pos {
+				ib++
+			}
+			cursors[i] = ib
+			if ib < len(b) && b[ib] == pos {
+				found = true
+			}
+		}
+		if !found {
+			out = append(out, pos)
+		}
+	}
+	return out
+}
+
+// Difference returns the positions in a which are not in b.  a and b must be
+// sorted in advance.  Returned slice will be sorted.
+// a may be returned by Difference, but neither a nor b will be modified.
+// As with SubtractMany, if a is AllPositions it's returned unchanged.
+func (a Positions) Difference(b Positions) Positions {
+	return a.SubtractMany(b)
+}
+
+// SymmetricDifference returns the positions in exactly one of a or b.  a and
+// b must be sorted in advance.  Returned slice will be sorted.
+// a or b may be returned by SymmetricDifference, but neither will be modified.
+// We can't represent "all positions except these", so if either input is
+// AllPositions, AllPositions is returned.
+func (a Positions) SymmetricDifference(b Positions) (out Positions) {
+	switch {
+	case a.IsAllPositions() || b.IsAllPositions():
+		return AllPositions
+	case len(a) == 0:
+		return b
+	case len(b) == 0:
+		return a
+	}
+	out = make(Positions, 0, len(a)+len(b))
+	ib := 0
+	for _, pos := range a {
+		for ib < len(b) && b[ib] < pos {
+			out = append(out, b[ib])
+			ib++
+		}
+		if ib < len(b) && b[ib] == pos {
+			ib++
+			continue
+		}
+		out = append(out, pos)
+	}
+	out = append(out, b[ib:]...)
+	return out
+}
+
+// IntersectCount returns the size of the intersection of a and b, without
+// building it.  a and b must be sorted in advance.  -1 (unknown) is returned
+// if both are AllPositions.
+func (a Positions) IntersectCount(b Positions) int {
+	switch {
+	case a.IsAllPositions() && b.IsAllPositions():
+		return -1
+	case a.IsAllPositions():
+		return len(b)
+	case b.IsAllPositions():
+		return len(a)
+	}
+	count, ib := 0, 0
+	for _, pos := range a {
+		for ib < len(b) && b[ib] < pos {
+			ib++
+		}
+		if ib < len(b) && b[ib] == pos {
+			count++
+			ib++
+		}
+	}
+	return count
+}
+
+// DifferenceCount returns the number of positions in a which are not in b,
+// without building them, so NOT queries can be costed before deciding
+// whether to materialize them.  a and b must be sorted in advance.  -1
+// (unknown) is returned if a is AllPositions, mirroring SubtractMany.
+func (a Positions) DifferenceCount(b Positions) int {
+	switch {
+	case a.IsAllPositions():
+		return -1
+	case b.IsAllPositions():
+		return 0
+	}
+	return len(a) - a.IntersectCount(b)
+}
+
+// intersectEstimateSamples is the number of positions EstimateIntersect
+// probes for.
+const intersectEstimateSamples = 64
+
+// EstimateIntersect returns a cheap estimate of the size of the intersection
+// of a and b, for query planning on sets so large that even IntersectCount is
+// too costly.  a and b must be sorted in advance.
+//
+// The estimate finds the range of values the two sets share via binary
+// search, then probes for a fixed number of evenly spaced samples from the
+// smaller set's part of that range in the larger set, scaling up the hit
+// rate.  It costs O(log(n+m)) regardless of input size.  It's exact when the
+// overlapping part of the smaller set has no more elements than we sample,
+// and in BenchmarkEstimateIntersect on uniformly random sets with 1M
+// elements it's about 1000x faster than IntersectCount, with a mean error of
+// around 20% of the true value.  Clustered sets (a
+// busy flow's packets all arriving at once) estimate less well, since evenly
+// spaced samples may miss clusters entirely.  Use IntersectCount when an
+// exact value is needed.
+func (a Positions) EstimateIntersect(b Positions) int {
+	switch {
+	case a.IsAllPositions() || b.IsAllPositions():
+		return a.IntersectCount(b)
+	case len(a) == 0 || len(b) == 0:
+		return 0
+	}
+	lo, hi := a[0], a[len(a)-1]
+	if b[0] > lo {
+		lo = b[0]
+	}
+	if b[len(b)-1] < hi {
+		hi = b[len(b)-1]
+	}
+	if lo > hi {
+		return 0
+	}
+	// overlap returns the part of p within [lo, hi].
+	overlap := func(p Positions) Positions {
+		start := sort.Search(len(p), func(i int) bool { return p[i] >= lo })
+		end := sort.Search(len(p), func(i int) bool { return p[i] > hi })
+		return p[start:end]
+	}
+	small, large := overlap(a), overlap(b)
+	if len(small) > len(large) {
+		small, large = large, small
+	}
+	samples := intersectEstimateSamples
+	if len(small) < samples {
+		samples = len(small)
+	}
+	hits := 0
+	for i := 0; i < samples; i++ {
+		pos := small[i*len(small)/samples]
+		if j := sort.Search(len(large), func(j int) bool { return large[j] >= pos }); j < len(large) && large[j] == pos {
+			hits++
+		}
+	}
+	return hits * len(small) / samples
+}
+
+// The following provide bitmap-style names for the set operations above, for
+// those more used to thinking of positions as sets of bits.
+
+// And is an alias for Intersect.
+func (a Positions) And(b Positions) Positions { return a.Intersect(b) }
+
+// Or is an alias for Union.
+func (a Positions) Or(b Positions) Positions { return a.Union(b) }
+
+// AndNot is an alias for Difference.
+func (a Positions) AndNot(b Positions) Positions { return a.Difference(b) }
+
+// Xor is an alias for SymmetricDifference.
+func (a Positions) Xor(b Positions) Positions { return a.SymmetricDifference(b) }
+
+// PositionRange is an inclusive range of positions, [Start, End].
+type PositionRange struct {
+	Start, End int64
+}
+
+// Contains returns true if pos is within the range.
+func (r PositionRange) Contains(pos int64) bool {
+	return pos >= r.Start && pos <= r.End
+}
+
+// Len returns the number of positions in the range.
+func (r PositionRange) Len() int64 {
+	return r.End - r.Start + 1
+}
+
+// RunLengthEncode collapses runs of consecutive positions in a into ranges.
+// Results for a single busy flow tend to be nearly contiguous, so this is
+// usually far more compact than the positions themselves.  a must be sorted.
+func (a Positions) RunLengthEncode() []PositionRange {
+	var out []PositionRange
+	for _, pos := range a {
+		if n := len(out); n > 0 && out[n-1].End+1 == pos {
+			out[n-1].End = pos
+		} else {
+			out = append(out, PositionRange{pos, pos})
+		}
+	}
+	return out
+}
+
+// ExpandRanges is the inverse of RunLengthEncode, returning every position
+// covered by the given ranges.
+func ExpandRanges(ranges []PositionRange) Positions {
+	total := int64(0)
+	for _, r := range ranges {
+		total += r.Len()
+	}
+	out := make(Positions, 0, total)
+	for _, r := range ranges {
+		for pos := r.Start; pos <= r.End; pos++ {
+			out = append(out, pos)
+		}
+	}
+	return out
+}
+
 func PathDiskFreePercentage(path string) (int, error) {
 	var stat syscall.Statfs_t
 	if err := syscall.Statfs(path, &stat); err != nil {
@@ -306,14 +1158,28 @@ func PathDiskFreePercentage(path string) (int, error) {
 const snapLen = 65536
 
 // PacketsToFile writes all packets from 'in' to 'out', writing out all packets
-// in a valid PCAP file format.
+// in a valid PCAP file format.  Packets are released (see Packet.Release)
+// once written, so the caller must not hold on to them.  Classic PCAP files
+// store timestamps in microseconds, so sub-microsecond precision is lost; see
+// PacketsToFileNanos.
 func PacketsToFile(in *PacketChan, out io.Writer, limit Limit) error {
-	w := pcapgo.NewWriter(out)
+	return packetsToFile(in, pcapgo.NewWriter(out), limit)
+}
+
+// PacketsToFileNanos acts like PacketsToFile, but writes a PCAP file with
+// nanosecond timestamps, marked by the 0xa1b23c4d magic number.  Blockfiles
+// already store nanosecond timestamps, so this keeps their full precision.
+// Most modern tools read these files, but some older ones don't.
+func PacketsToFileNanos(in *PacketChan, out io.Writer, limit Limit) error {
+	return packetsToFile(in, pcapgo.NewWriterNanos(out), limit)
+}
+
+func packetsToFile(in *PacketChan, w *pcapgo.Writer, limit Limit) error {
 	w.WriteFileHeader(snapLen, layers.LinkTypeEthernet)
 	count := 0
 	defer in.Discard()
 	defer func() {
-		V(1, "wrote %d packets of %d input packets", count, len(in.C))
+		baseLog.V(1, "wrote packets", "packets", count, "buffered", len(in.C))
 	}()
 	const pcapHeaderSize = 16 // same for file header and per-packet header
 	// If someone REALLY wants an empty pcap file, we'll give it to them :P
@@ -321,9 +1187,7 @@ func PacketsToFile(in *PacketChan, out io.Writer, limit Limit) error {
 		return nil
 	}
 	for p := range in.Receive() {
-		if len(p.Data) > snapLen {
-			p.Data = p.Data[:snapLen]
-		}
+		p.Truncate(snapLen)
 		if err := w.WritePacket(p.CaptureInfo, p.Data); err != nil {
 			// This can happen if our pipe is broken, and we don't want to blow stack
 			// traces all over our users when that happens, so Error/Exit instead of
@@ -331,7 +1195,9 @@ func PacketsToFile(in *PacketChan, out io.Writer, limit Limit) error {
 			return fmt.Errorf("error writing packet: %v", err)
 		}
 		count++
-		if limit.ShouldStopAfter(Limit{Bytes: int64(len(p.Data) + pcapHeaderSize), Packets: 1}) {
+		size := len(p.Data)
+		p.Release()
+		if limit.ShouldStopAfter(Limit{Bytes: int64(size + pcapHeaderSize), Packets: 1}) {
 			return nil
 		}
 	}
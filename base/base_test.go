@@ -16,7 +16,15 @@ package base
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
 	"reflect"
+	"sort"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -33,9 +41,9 @@ func testPacketData(t *testing.T) []*Packet {
 		{Timestamp: time.Unix(789, 789), CaptureLength: 3, Length: 3},
 	}
 
-	out := []*Packet{&Packet{[]byte{1, 2, 3}, ci[0]},
-		&Packet{[]byte{4, 5, 6}, ci[1]},
-		&Packet{[]byte{7, 8, 9}, ci[2]}}
+	out := []*Packet{&Packet{Data: []byte{1, 2, 3}, CaptureInfo: ci[0]},
+		&Packet{Data: []byte{4, 5, 6}, CaptureInfo: ci[1]},
+		&Packet{Data: []byte{7, 8, 9}, CaptureInfo: ci[2]}}
 	return out
 }
 
@@ -92,6 +100,395 @@ func TestMergePacketChans(t *testing.T) {
 	comparePacketChans(t, want, got)
 }
 
+type countingCloser struct{ closed int32 }
+
+func (c *countingCloser) Close() error {
+	atomic.AddInt32(&c.closed, 1)
+	return nil
+}
+
+func TestMergeClosers(t *testing.T) {
+	packets := testPacketData(t)
+	one := NewPacketChan(100)
+	two := NewPacketChan(100)
+	one.Send(packets[0])
+	two.Send(packets[1])
+	one.Close(nil)
+	two.Close(errors.New("corrupt blockfile"))
+	closers := []*countingCloser{{}, {}}
+	got := MergeClosers(ctx, []*PacketChan{one, two}, []io.Closer{closers[0], nil, closers[1]})
+	for _ = range got.Receive() {
+	}
+	if got.Err() == nil {
+		t.Error("expected merge error")
+	}
+	for i := 0; i < 100 && atomic.LoadInt32(&closers[1].closed) == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	for i, c := range closers {
+		if n := atomic.LoadInt32(&c.closed); n != 1 {
+			t.Errorf("closer %d closed %d times, want 1", i, n)
+		}
+	}
+}
+
+func TestMergePacketChansEmpty(t *testing.T) {
+	for _, in := range [][]*PacketChan{nil, {}} {
+		out := MergePacketChans(context.Background(), in)
+		select {
+		case p, ok := <-out.Receive():
+			if ok {
+				t.Errorf("got packet %v from empty merge", p)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("empty merge not closed")
+		}
+		if err := out.Err(); err != nil {
+			t.Errorf("empty merge error: %v", err)
+		}
+	}
+}
+
+func TestMergePacketChansSingle(t *testing.T) {
+	want := errors.New("stream failed")
+	in := packetChanOf(want, testPacketData(t)...)
+	out := MergePacketChans(context.Background(), []*PacketChan{in})
+	count := 0
+	for _ = range out.Receive() {
+		count++
+	}
+	if count != 3 {
+		t.Errorf("wrong packet count: want 3 got %d", count)
+	}
+	if err := out.Err(); err != want {
+		t.Errorf("wrong error: want %v got %v", want, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	in = NewPacketChan(0)
+	out = MergePacketChans(ctx, []*PacketChan{in})
+	cancel()
+	for _ = range out.Receive() {
+	}
+	if err := out.Err(); err != context.Canceled {
+		t.Errorf("wrong error after cancel: want %v got %v", context.Canceled, err)
+	}
+	// The input must be drained, so its sender doesn't block forever.
+	in.Send(benchmarkPacket)
+	in.Close(nil)
+}
+
+func TestMergePacketChansWeighted(t *testing.T) {
+	const n = 1000
+	ts := time.Unix(1, 0)
+	streams := func() []*PacketChan {
+		var in []*PacketChan
+		for s := 0; s < 2; s++ {
+			var packets []*Packet
+			for i := 0; i < n; i++ {
+				packets = append(packets, &Packet{Data: []byte{byte(s)}, CaptureInfo: gopacket.CaptureInfo{Timestamp: ts}})
+			}
+			in = append(in, packetChanOf(nil, packets...))
+		}
+		return in
+	}
+	order := func() (out []byte) {
+		for p := range MergePacketChansWeighted(context.Background(), streams(), []float64{3, 1}, nil).Receive() {
+			out = append(out, p.Data[0])
+		}
+		return out
+	}
+	got := order()
+	if len(got) != 2*n {
+		t.Fatalf("wrong packet count: want %d got %d", 2*n, len(got))
+	}
+	// While both streams still have packets, stream 0 should win about 3/4 of
+	// the ties.
+	first := 0
+	for _, s := range got[:n] {
+		if s == 0 {
+			first++
+		}
+	}
+	if frac := float64(first) / n; frac < 0.7 || frac > 0.8 {
+		t.Errorf("stream 0 won %v of ties, want about 0.75", frac)
+	}
+	if again := order(); !bytes.Equal(got, again) {
+		t.Error("merge with default seed is not reproducible")
+	}
+
+	for _, weights := range [][]float64{{1}, {1, 0}, {1, -1}, {1, math.NaN()}} {
+		out := MergePacketChansWeighted(context.Background(), streams(), weights, nil)
+		for _ = range out.Receive() {
+			t.Fatalf("weights %v: got packet", weights)
+		}
+		if out.Err() == nil {
+			t.Errorf("weights %v: no error", weights)
+		}
+	}
+}
+
+func TestMergePacketChansWithStats(t *testing.T) {
+	packets := testPacketData(t)
+	for _, test := range []struct {
+		in   []*PacketChan
+		want []int64
+	}{
+		{[]*PacketChan{packetChanOf(nil, packets[0], packets[2]), packetChanOf(nil), packetChanOf(nil, packets[1])}, []int64{2, 0, 1}},
+		{[]*PacketChan{packetChanOf(nil, packets...)}, []int64{3}},
+	} {
+		out, stats := MergePacketChansWithStats(context.Background(), test.in)
+		for _ = range out.Receive() {
+		}
+		if got := stats.Counts(); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("wrong counts: want %v got %v", test.want, got)
+		}
+	}
+}
+
+func TestPacketChanContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := NewPacketChanContext(ctx, 0)
+	stopped := make(chan int)
+	go func() {
+		// A producer which would run forever if not canceled.
+		sent := 0
+		for {
+			select {
+			case <-c.Canceled():
+				c.Close(nil)
+				stopped <- sent
+				return
+			default:
+			}
+			c.Send(benchmarkPacket)
+			sent++
+		}
+	}()
+	<-c.Receive()
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("producer not canceled")
+	}
+}
+
+func TestMergePacketChansCancelsInputs(t *testing.T) {
+	in := []*PacketChan{NewPacketChan(0), NewPacketChan(0)}
+	for _, c := range in {
+		c := c
+		go func() {
+			ts := time.Unix(0, 0)
+			for {
+				select {
+				case <-c.Canceled():
+					c.Close(nil)
+					return
+				default:
+				}
+				ts = ts.Add(time.Second)
+				c.Send(&Packet{CaptureInfo: gopacket.CaptureInfo{Timestamp: ts}})
+			}
+		}()
+	}
+	out := MergePacketChans(context.Background(), in)
+	<-out.Receive()
+	out.Discard()
+	for i, c := range in {
+		select {
+		case <-c.Done():
+		case <-time.After(time.Second):
+			t.Fatalf("input %d not canceled", i)
+		}
+	}
+}
+
+func TestMergePacketChansMany(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for _, streams := range []int{2, 3, 7, 16, 33} {
+		var in []*PacketChan
+		var all []int64
+		for i := 0; i < streams; i++ {
+			// Some streams are empty, some span several input batches.
+			var secs []int64
+			for j, n := int64(0), r.Intn(3*mergeInputBatch); j < int64(n); j++ {
+				secs = append(secs, r.Int63n(1000))
+			}
+			sort.Slice(secs, func(a, b int) bool { return secs[a] < secs[b] })
+			all = append(all, secs...)
+			in = append(in, packetChanOf(nil, packetsAt(secs...)...))
+		}
+		sort.Slice(all, func(a, b int) bool { return all[a] < all[b] })
+		got := secondsOf(MergePacketChans(context.Background(), in))
+		if !reflect.DeepEqual(got, all) {
+			t.Errorf("%d streams: merged %d packets out of order or lost (want %d)", streams, len(got), len(all))
+		}
+	}
+}
+
+func TestMergePacketChansTolerant(t *testing.T) {
+	broken := errors.New("corrupt blockfile")
+	out, errs := MergePacketChansTolerant(ctx, []*PacketChan{
+		packetChanOf(nil, packetsAt(1, 3, 5)...),
+		packetChanOf(broken, packetsAt(2, 4)...),
+		packetChanOf(nil, packetsAt(6)...),
+	})
+	if got, want := secondsOf(out), []int64{1, 2, 3, 4, 5, 6}; !reflect.DeepEqual(got, want) {
+		t.Errorf("want %v got %v", want, got)
+	}
+	if err := out.Err(); err != nil {
+		t.Errorf("tolerant merge failed: %v", err)
+	}
+	if got := errs.Errors(); len(got) != 1 || got[1] != broken {
+		t.Errorf("want stream 1 to report failure, got %v", got)
+	}
+	if err := errs.Err(); err == nil || !strings.Contains(err.Error(), "1 of 3 merged streams failed: stream 1: corrupt blockfile") {
+		t.Errorf("unexpected aggregate error: %v", err)
+	}
+
+	// A single input is forwarded rather than merged, but is just as tolerant.
+	out, errs = MergePacketChansTolerant(ctx, []*PacketChan{packetChanOf(broken, packetsAt(1)...)})
+	if got := secondsOf(out); !reflect.DeepEqual(got, []int64{1}) || out.Err() != nil || errs.Err() == nil {
+		t.Errorf("single stream: got %v, %v, %v", got, out.Err(), errs.Err())
+	}
+
+	// Without tolerance, the same failure fails the whole merge.
+	out = MergePacketChans(ctx, []*PacketChan{
+		packetChanOf(nil, packetsAt(1, 3, 5)...),
+		packetChanOf(broken, packetsAt(2, 4)...),
+	})
+	secondsOf(out)
+	if err := out.Err(); err != broken {
+		t.Errorf("want %v, got %v", broken, err)
+	}
+}
+
+func TestMergePacketChansEpsilon(t *testing.T) {
+	start := time.Unix(100, 0)
+	at := func(d time.Duration) *Packet {
+		return &Packet{CaptureInfo: gopacket.CaptureInfo{Timestamp: start.Add(d)}}
+	}
+	// Stream one's clock runs a few microseconds ahead of stream two's.
+	a1, a2 := at(3*time.Microsecond), at(time.Second)
+	b1, b2 := at(0), at(time.Second-2*time.Microsecond)
+	got := MergePacketChansEpsilon(ctx, []*PacketChan{
+		packetChanOf(nil, a1, a2),
+		packetChanOf(nil, b1, b2),
+	}, 5*time.Microsecond)
+	comparePacketChans(t, packetChanOf(nil, a1, b1, a2, b2), got)
+
+	// Without epsilon, we interleave purely on time.
+	got = MergePacketChans(ctx, []*PacketChan{
+		packetChanOf(nil, a1, a2),
+		packetChanOf(nil, b1, b2),
+	})
+	comparePacketChans(t, packetChanOf(nil, b1, a1, b2, a2), got)
+}
+
+func TestPacketHashes(t *testing.T) {
+	a := &Packet{Data: []byte{1, 2, 3}}
+	b := &Packet{Data: []byte{1, 2, 3}}
+	c := &Packet{Data: []byte{1, 2, 4}}
+	if a.Hash() != b.Hash() || a.BytesHash() != b.BytesHash() {
+		t.Error("identical packets hashed differently")
+	}
+	if a.Hash() == c.Hash() || a.BytesHash() == c.BytesHash() {
+		t.Error("different packets hashed identically")
+	}
+	// SHA-256 of the bytes 01 02 03.
+	const want = "039058c6f2c0cb492c533b0a4d14ef77cc0f78abccced5287d84a1a2011cfb81"
+	if got := a.BytesHash(); fmt.Sprintf("%x", got[:]) != want {
+		t.Errorf("wrong digest: want %s got %x", want, got)
+	}
+}
+
+func TestCollectSorted(t *testing.T) {
+	packets := testPacketData(t)
+	want := errors.New("stream failed")
+	got, err := packetChanOf(want, packets[2], packets[0], packets[1]).CollectSorted(10)
+	if !reflect.DeepEqual(got, packets) {
+		t.Errorf("wrong packets:\nwant %v\ngot  %v", packets, got)
+	}
+	if err != want {
+		t.Errorf("wrong error: want %v got %v", want, err)
+	}
+	got, _ = packetChanOf(nil, packets[2], packets[0], packets[1]).CollectSorted(2)
+	if !reflect.DeepEqual(got, []*Packet{packets[0], packets[2]}) {
+		t.Errorf("wrong packets with max 2: %v", got)
+	}
+}
+
+func TestToUTC(t *testing.T) {
+	zone := time.FixedZone("test", 3*60*60)
+	local := time.Date(2015, 1, 1, 13, 14, 15, 0, zone)
+	p := &Packet{CaptureInfo: gopacket.CaptureInfo{Timestamp: local}}
+	p.ToUTC()
+	if p.Timestamp.Location() != time.UTC {
+		t.Errorf("timestamp not in UTC: %v", p.Timestamp)
+	}
+	if !p.Timestamp.Equal(local) {
+		t.Errorf("timestamp changed instant: want %v got %v", local, p.Timestamp)
+	}
+}
+
+func TestDrainTimeout(t *testing.T) {
+	packets := testPacketData(t)
+	if n, done := packetChanOf(nil, packets...).DrainTimeout(time.Second); n != len(packets) || !done {
+		t.Errorf("closed chan: got (%d, %v) want (%d, true)", n, done, len(packets))
+	}
+	c := NewPacketChan(0)
+	sent := make(chan struct{})
+	go func() {
+		c.Send(packets[0])
+		time.Sleep(50 * time.Millisecond)
+		// This must not block forever, even though DrainTimeout has returned.
+		c.Send(packets[1])
+		c.Close(nil)
+		close(sent)
+	}()
+	if n, done := c.DrainTimeout(10 * time.Millisecond); n != 1 || done {
+		t.Errorf("slow chan: got (%d, %v) want (1, false)", n, done)
+	}
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+		t.Fatal("producer blocked after drain timeout")
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	for _, test := range []struct {
+		snaplen, wantLen int
+	}{
+		{5, 3},
+		{3, 3},
+		{2, 2},
+		{0, 0},
+	} {
+		p := &Packet{Data: []byte{1, 2, 3}}
+		p.CaptureLength = 3
+		p.Length = 100
+		p.Truncate(test.snaplen)
+		if len(p.Data) != test.wantLen || p.CaptureLength != test.wantLen {
+			t.Errorf("snaplen %d: got data len %d caplen %d, want %d", test.snaplen, len(p.Data), p.CaptureLength, test.wantLen)
+		}
+		if p.Length != 100 {
+			t.Errorf("snaplen %d: length changed to %d", test.snaplen, p.Length)
+		}
+		if !p.Truncated() {
+			t.Errorf("snaplen %d: not reported as truncated", test.snaplen)
+		}
+	}
+	// A bogus capture length larger than the data is fixed, not preserved.
+	p := &Packet{Data: []byte{1, 2, 3}}
+	p.CaptureLength = 10
+	p.Truncate(20)
+	if p.CaptureLength != 3 {
+		t.Errorf("caplen above data length: got %d want 3", p.CaptureLength)
+	}
+}
+
 func TestUnion(t *testing.T) {
 	for _, test := range []struct {
 		a, b, want Positions
@@ -151,6 +548,256 @@ func TestIntersect(t *testing.T) {
 	}
 }
 
+// randomPositions returns a sorted, deduplicated set of up to n positions
+// below max.
+func randomPositions(r *rand.Rand, n int, max int64) Positions {
+	seen := map[int64]bool{}
+	for i := 0; i < n; i++ {
+		seen[r.Int63n(max)] = true
+	}
+	out := Positions{}
+	for pos := range seen {
+		out = append(out, pos)
+	}
+	out.Sort()
+	return out
+}
+
+// naiveSubtract removes everything in 'others' from a using a map.
+func naiveSubtract(a Positions, others ...Positions) Positions {
+	remove := map[int64]bool{}
+	for _, b := range others {
+		for _, pos := range b {
+			remove[pos] = true
+		}
+	}
+	out := Positions{}
+	for _, pos := range a {
+		if !remove[pos] {
+			out = append(out, pos)
+		}
+	}
+	return out
+}
+
+func TestSubtractMany(t *testing.T) {
+	for _, test := range []struct {
+		a      Positions
+		others []Positions
+		want   Positions
+	}{
+		{
+			Positions{1, 2, 3, 4, 5, 6},
+			[]Positions{{2, 4}, {5, 6, 7}},
+			Positions{1, 3},
+		},
+		{
+			Positions{1, 2, 3},
+			nil,
+			Positions{1, 2, 3},
+		},
+		{
+			Positions{1, 2, 3},
+			[]Positions{{}, {4, 5}},
+			Positions{1, 2, 3},
+		},
+		{
+			Positions{1, 2, 3},
+			[]Positions{{1}, AllPositions},
+			NoPositions,
+		},
+		{
+			Positions{1, 2, 3},
+			[]Positions{{0, 1, 2, 3}},
+			Positions{},
+		},
+	} {
+		got := test.a.SubtractMany(test.others...)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("nope:\n   a: %v\n   others: %v\n got: %v\nwant: %v", test.a, test.others, got, test.want)
+		}
+	}
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 100; i++ {
+		a := randomPositions(r, 200, 1000)
+		others := make([]Positions, r.Intn(5))
+		for j := range others {
+			others[j] = randomPositions(r, 100, 1000)
+		}
+		got, want := a.SubtractMany(others...), naiveSubtract(a, others...)
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("nope:\n   a: %v\n   others: %v\n got: %v\nwant: %v", a, others, got, want)
+		}
+	}
+}
+
+func TestDifference(t *testing.T) {
+	for _, test := range []struct {
+		a, b, diff, symDiff Positions
+	}{
+		{Positions{1, 2, 3, 4}, Positions{3, 4, 5}, Positions{1, 2}, Positions{1, 2, 5}},
+		{Positions{1, 2, 3}, Positions{1, 2, 3}, Positions{}, Positions{}},
+		{Positions{1, 2, 3}, Positions{}, Positions{1, 2, 3}, Positions{1, 2, 3}},
+		{Positions{}, Positions{1, 2}, Positions{}, Positions{1, 2}},
+		{Positions{}, Positions{}, Positions{}, Positions{}},
+		{Positions{2, 4}, Positions{1, 3, 5}, Positions{2, 4}, Positions{1, 2, 3, 4, 5}},
+		{Positions{1, 2}, AllPositions, NoPositions, AllPositions},
+		{AllPositions, Positions{1, 2}, AllPositions, AllPositions},
+	} {
+		if got := test.a.Difference(test.b); !reflect.DeepEqual(got, test.diff) {
+			t.Errorf("%v.Difference(%v): want %v got %v", test.a, test.b, test.diff, got)
+		}
+		if got := test.a.SymmetricDifference(test.b); !reflect.DeepEqual(got, test.symDiff) {
+			t.Errorf("%v.SymmetricDifference(%v): want %v got %v", test.a, test.b, test.symDiff, got)
+		}
+	}
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 100; i++ {
+		a := randomPositions(r, 100, 300)
+		b := randomPositions(r, 100, 300)
+		want := naiveSubtract(a, b).Union(naiveSubtract(b, a))
+		if got := a.SymmetricDifference(b); !reflect.DeepEqual(got, want) {
+			t.Fatalf("%v.SymmetricDifference(%v):\nwant %v\ngot  %v", a, b, want, got)
+		}
+	}
+}
+
+func TestBitwiseAliases(t *testing.T) {
+	a := Positions{1, 2, 3, 4}
+	b := Positions{3, 4, 5}
+	for _, test := range []struct {
+		name      string
+		got, want Positions
+	}{
+		{"And", a.And(b), Positions{3, 4}},
+		{"Or", a.Or(b), Positions{1, 2, 3, 4, 5}},
+		{"AndNot", a.AndNot(b), Positions{1, 2}},
+		{"Xor", a.Xor(b), Positions{1, 2, 5}},
+	} {
+		if !reflect.DeepEqual(test.got, test.want) {
+			t.Errorf("%s: got %v want %v", test.name, test.got, test.want)
+		}
+	}
+}
+
+func TestRunLengthEncode(t *testing.T) {
+	in := Positions{1, 2, 3, 5, 7, 8, 100}
+	want := []PositionRange{{1, 3}, {5, 5}, {7, 8}, {100, 100}}
+	got := in.RunLengthEncode()
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("wrong ranges: want %v got %v", want, got)
+	}
+	if back := ExpandRanges(got); !reflect.DeepEqual(back, in) {
+		t.Errorf("round trip failed: want %v got %v", in, back)
+	}
+	if r := got[0]; r.Len() != 3 || !r.Contains(1) || !r.Contains(3) || r.Contains(4) {
+		t.Errorf("bad range helpers for %v", r)
+	}
+	if got := NoPositions.RunLengthEncode(); len(got) != 0 {
+		t.Errorf("empty positions encoded to %v", got)
+	}
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 20; i++ {
+		a := randomPositions(r, 1000, 3000)
+		if back := ExpandRanges(a.RunLengthEncode()); !reflect.DeepEqual(back, a) {
+			t.Fatalf("random round trip failed for %v", a)
+		}
+	}
+}
+
+func TestIntersectCount(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 100; i++ {
+		a := randomPositions(r, 200, 1000)
+		b := randomPositions(r, 200, 1000)
+		if got, want := a.IntersectCount(b), len(a.Intersect(b)); got != want {
+			t.Fatalf("wrong count for\n   a: %v\n   b: %v\n got: %v\nwant: %v", a, b, got, want)
+		}
+	}
+	if got := AllPositions.IntersectCount(Positions{1, 2}); got != 2 {
+		t.Errorf("AllPositions intersect count: got %d want 2", got)
+	}
+}
+
+func TestDifferenceCount(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 100; i++ {
+		a := randomPositions(r, 200, 1000)
+		b := randomPositions(r, 200, 1000)
+		if got, want := a.DifferenceCount(b), len(a.SubtractMany(b)); got != want {
+			t.Fatalf("wrong count for\n   a: %v\n   b: %v\n got: %v\nwant: %v", a, b, got, want)
+		}
+	}
+	if got := (Positions{1, 2}).DifferenceCount(AllPositions); got != 0 {
+		t.Errorf("difference count with AllPositions: got %d want 0", got)
+	}
+	if got := AllPositions.DifferenceCount(Positions{1, 2}); got != -1 {
+		t.Errorf("AllPositions difference count: got %d want -1", got)
+	}
+	a, b := randomPositions(r, 1000, 3000), randomPositions(r, 1000, 3000)
+	if allocs := testing.AllocsPerRun(10, func() { a.DifferenceCount(b) }); allocs != 0 {
+		t.Errorf("DifferenceCount allocated %v times", allocs)
+	}
+}
+
+func TestEstimateIntersect(t *testing.T) {
+	for _, test := range []struct {
+		a, b Positions
+		want int
+	}{
+		{Positions{1, 2, 3}, Positions{4, 5, 6}, 0},
+		{Positions{1, 2, 3}, Positions{}, 0},
+		{Positions{1, 2, 3, 4}, Positions{0, 2, 4, 5}, 2},
+		{AllPositions, Positions{4, 5, 6}, 3},
+	} {
+		if got := test.a.EstimateIntersect(test.b); got != test.want {
+			t.Errorf("estimate of %v and %v: got %d want %d", test.a, test.b, got, test.want)
+		}
+	}
+	// Large uniform sets should get a reasonably close estimate.
+	r := rand.New(rand.NewSource(1))
+	a := randomPositions(r, 100000, 1000000)
+	b := randomPositions(r, 100000, 1000000)
+	want := a.IntersectCount(b)
+	if got := a.EstimateIntersect(b); got < want/2 || got > want*2 {
+		t.Errorf("estimate too far off: got %d want %d", got, want)
+	}
+}
+
+// BenchmarkEstimateIntersect reports the estimate's mean error on large
+// uniformly random sets alongside its speed.
+func BenchmarkEstimateIntersect(b *testing.B) {
+	r := rand.New(rand.NewSource(1))
+	type pair struct {
+		a, b  Positions
+		exact int
+	}
+	var pairs []pair
+	for i := 0; i < 10; i++ {
+		x := randomPositions(r, 1000000, 4000000)
+		y := randomPositions(r, 1000000, 4000000)
+		pairs = append(pairs, pair{x, y, x.IntersectCount(y)})
+	}
+	b.ResetTimer()
+	var errSum float64
+	for i := 0; i < b.N; i++ {
+		p := pairs[i%len(pairs)]
+		got := p.a.EstimateIntersect(p.b)
+		errSum += math.Abs(float64(got-p.exact)) / float64(p.exact)
+	}
+	b.ReportMetric(100*errSum/float64(b.N), "%err")
+}
+
+func BenchmarkIntersectCount(b *testing.B) {
+	r := rand.New(rand.NewSource(1))
+	x := randomPositions(r, 1000000, 4000000)
+	y := randomPositions(r, 1000000, 4000000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		x.IntersectCount(y)
+	}
+}
+
 func TestPacketsToFile(t *testing.T) {
 	var out bytes.Buffer
 	packets := testPacketData(t)
@@ -171,6 +818,26 @@ func TestPacketsToFile(t *testing.T) {
 	}
 }
 
+func TestPacketsToFileNanos(t *testing.T) {
+	var out bytes.Buffer
+	packets := testPacketData(t)
+	pc := NewPacketChan(100)
+	pc.Send(packets[0])
+	pc.Close(nil)
+	want := []byte{
+		0x4d, 0x3c, 0xb2, 0xa1, 0x02, 0x00, 0x04, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x01, 0x00, 0x01, 0x00, 0x00, 0x00,
+		0x7b, 0x00, 0x00, 0x00, 0x7b, 0x00, 0x00, 0x00,
+		0x03, 0x00, 0x00, 0x00, 0x03, 0x00, 0x00, 0x00,
+		0x01, 0x02, 0x03,
+	}
+	PacketsToFileNanos(pc, &out, Limit{})
+	if got := out.Bytes(); !bytes.Equal(want, got) {
+		t.Errorf("wrong packets:\nwant: %+v\ngot:  %+v", want, got)
+	}
+}
+
 func TestContextDone(t *testing.T) {
 	ctx := NewContext(0)
 	if ContextDone(ctx) {
@@ -186,3 +853,65 @@ func TestContextDone(t *testing.T) {
 		t.Fatal("should have timed out by now")
 	}
 }
+
+func benchmarkMergePacketChans(b *testing.B, streams int) {
+	in := make([]*PacketChan, streams)
+	for i := range in {
+		c := NewPacketChan(100)
+		in[i] = c
+		go func() {
+			for j := 0; j < b.N/streams; j++ {
+				c.Send(benchmarkPacket)
+			}
+			c.Close(nil)
+		}()
+	}
+	for _ = range MergePacketChans(context.Background(), in).Receive() {
+	}
+}
+
+func BenchmarkMergePacketChansSingle(b *testing.B) { benchmarkMergePacketChans(b, 1) }
+func BenchmarkMergePacketChansTwo(b *testing.B)    { benchmarkMergePacketChans(b, 2) }
+
+// benchmarkMergeInterleaved merges streams whose packets interleave in time,
+// fed in batches so the producers cost as little as possible, using either the
+// loser tree or the heap.
+func benchmarkMergeInterleaved(b *testing.B, streams int, useHeap bool) {
+	start := time.Unix(0, 0)
+	in := make([]*PacketChan, streams)
+	for i := range in {
+		c := NewPacketChan(mergeInputBatch * 2)
+		in[i] = c
+		pkts := make([]*Packet, b.N/streams)
+		for j := range pkts {
+			pkts[j] = &Packet{CaptureInfo: gopacket.CaptureInfo{Timestamp: start.Add(time.Duration(j*streams + i))}}
+		}
+		go func() {
+			for len(pkts) > 0 {
+				n := len(pkts)
+				if n > mergeInputBatch {
+					n = mergeInputBatch
+				}
+				c.SendBatch(pkts[:n])
+				pkts = pkts[n:]
+			}
+			c.Close(nil)
+		}()
+	}
+	b.ResetTimer()
+	out := NewPacketChan(100)
+	if useHeap {
+		go mergeHeap(context.Background(), in, out, packetHeap{less: byTimestamp})
+	} else {
+		go mergeLoserTree(context.Background(), in, out, packetHeap{less: byTimestamp})
+	}
+	buf := make([]*Packet, 0, 256)
+	for ok := true; ok; buf = buf[:0] {
+		buf, ok = out.ReceiveBatch(buf)
+	}
+}
+
+func BenchmarkMergeLoserTree16(b *testing.B) { benchmarkMergeInterleaved(b, 16, false) }
+func BenchmarkMergeHeap16(b *testing.B)      { benchmarkMergeInterleaved(b, 16, true) }
+func BenchmarkMergeLoserTree64(b *testing.B) { benchmarkMergeInterleaved(b, 64, false) }
+func BenchmarkMergeHeap64(b *testing.B)      { benchmarkMergeInterleaved(b, 64, true) }
@@ -0,0 +1,140 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"sync"
+)
+
+// BatchPacketChan is like PacketChan, but passes slices of packets between
+// goroutines instead of single packets.  At high packet rates the cost of a
+// channel operation per packet dominates, and batching amortizes it.
+type BatchPacketChan struct {
+	mu   sync.Mutex
+	c    chan []*Packet
+	err  error
+	done chan struct{}
+	// BatchSize is a hint to senders about how many packets they should try to
+	// put in each batch.
+	BatchSize int
+}
+
+// NewBatchPacketChan returns a new BatchPacketChan, buffering up to 'buffer'
+// batches, with the given batch size hint.
+func NewBatchPacketChan(buffer, batchSize int) *BatchPacketChan {
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	return &BatchPacketChan{
+		c:         make(chan []*Packet, buffer),
+		done:      make(chan struct{}),
+		BatchSize: batchSize,
+	}
+}
+
+// Receive provides the channel from which to read batches.  It always returns
+// the same channel.  Batches are never empty.
+func (p *BatchPacketChan) Receive() <-chan []*Packet { return p.c }
+
+// Send sends a batch of packets to the receiver.  Ownership of the slice
+// passes to the receiver, so senders must not reuse it.  Empty batches are
+// dropped.
+func (p *BatchPacketChan) Send(batch []*Packet) {
+	if len(batch) > 0 {
+		p.c <- batch
+	}
+}
+
+// Close closes the sending channel and sets the BatchPacketChan's error based
+// on its input.
+func (p *BatchPacketChan) Close(err error) {
+	p.mu.Lock()
+	p.err = err
+	p.mu.Unlock()
+	close(p.c)
+	close(p.done)
+}
+
+// Done returns a channel that is closed when this channel is complete.
+func (p *BatchPacketChan) Done() <-chan struct{} {
+	return p.done
+}
+
+// Err gets the current error for the channel, if any exists.
+func (p *BatchPacketChan) Err() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+// Discard discards all remaining batches on the receiving end.  If you stop
+// using the channel before reading all batches, you must call this function.
+func (p *BatchPacketChan) Discard() {
+	go func() {
+		discarded := 0
+		for batch := range p.c {
+			discarded += len(batch)
+		}
+		if discarded > 0 {
+			baseLog.V(2, "discarded batched packets", "count", discarded)
+		}
+	}()
+}
+
+// Batch groups packets from 'in' into batches of up to 'size' packets.  A
+// batch is sent as soon as it's full, or as soon as 'in' has no more packets
+// immediately available, so batching never adds latency waiting for packets
+// that haven't arrived yet.
+func Batch(in *PacketChan, size int) *BatchPacketChan {
+	out := NewBatchPacketChan(10, size)
+	go func() {
+		defer in.Discard()
+		for pkt := range in.Receive() {
+			batch := make([]*Packet, 1, out.BatchSize)
+			batch[0] = pkt
+		fill:
+			for len(batch) < out.BatchSize {
+				select {
+				case pkt, ok := <-in.Receive():
+					if !ok {
+						break fill
+					}
+					batch = append(batch, pkt)
+				default:
+					break fill
+				}
+			}
+			out.Send(batch)
+		}
+		out.Close(in.Err())
+	}()
+	return out
+}
+
+// Unbatch splits the batches of 'in' back out into a PacketChan of single
+// packets, for consumers which don't speak batches.
+func Unbatch(in *BatchPacketChan) *PacketChan {
+	out := NewPacketChan(100)
+	go func() {
+		defer in.Discard()
+		for batch := range in.Receive() {
+			for _, pkt := range batch {
+				out.Send(pkt)
+			}
+		}
+		out.Close(in.Err())
+	}()
+	return out
+}
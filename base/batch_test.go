@@ -0,0 +1,141 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestBatchUnbatch(t *testing.T) {
+	packets := testPacketData(t)
+	in := NewPacketChan(100)
+	for i := 0; i < 10; i++ {
+		in.Send(packets[i%len(packets)])
+	}
+	wantErr := errors.New("oops")
+	in.Close(wantErr)
+	batched := Batch(in, 4)
+	got := Unbatch(batched)
+	want := NewPacketChan(100)
+	for i := 0; i < 10; i++ {
+		want.Send(packets[i%len(packets)])
+	}
+	want.Close(nil)
+	comparePacketChans(t, want, got)
+	if err := got.Err(); err != wantErr {
+		t.Errorf("wrong error: want %v got %v", wantErr, err)
+	}
+}
+
+func TestBatchSize(t *testing.T) {
+	packets := testPacketData(t)
+	in := NewPacketChan(100)
+	for i := 0; i < 10; i++ {
+		in.Send(packets[0])
+	}
+	in.Close(nil)
+	total := 0
+	for batch := range Batch(in, 4).Receive() {
+		if len(batch) == 0 || len(batch) > 4 {
+			t.Errorf("bad batch size %d", len(batch))
+		}
+		total += len(batch)
+	}
+	if total != 10 {
+		t.Errorf("wrong packet count: want 10 got %d", total)
+	}
+}
+
+// benchmarkPacket is a realistically sized (MTU) packet for benchmarks.
+var benchmarkPacket = &Packet{Data: make([]byte, 1500)}
+
+func BenchmarkPacketChan(b *testing.B) {
+	c := NewPacketChan(100)
+	go func() {
+		for i := 0; i < b.N; i++ {
+			c.Send(benchmarkPacket)
+		}
+		c.Close(nil)
+	}()
+	for _ = range c.Receive() {
+	}
+}
+
+func BenchmarkBatchPacketChan(b *testing.B) {
+	const size = 64
+	c := NewBatchPacketChan(10, size)
+	go func() {
+		batch := make([]*Packet, 0, size)
+		for i := 0; i < b.N; i++ {
+			batch = append(batch, benchmarkPacket)
+			if len(batch) == size {
+				c.Send(batch)
+				batch = make([]*Packet, 0, size)
+			}
+		}
+		c.Send(batch)
+		c.Close(nil)
+	}()
+	for batch := range c.Receive() {
+		for _ = range batch {
+		}
+	}
+}
+
+func TestSendReceiveBatch(t *testing.T) {
+	c := NewPacketChan(10)
+	packets := make([]*Packet, 5)
+	for i := range packets {
+		packets[i] = &Packet{Data: []byte{byte(i)}}
+	}
+	if n := c.SendBatch(packets); n != len(packets) {
+		t.Fatalf("sent %d of %d packets", n, len(packets))
+	}
+	got, ok := c.ReceiveBatch(make([]*Packet, 0, 3))
+	if !ok || len(got) != 3 || got[0] != packets[0] {
+		t.Errorf("first batch: got %v, %v", got, ok)
+	}
+	c.Close(nil)
+	got, ok = c.ReceiveBatch(got[:0])
+	if !ok || len(got) != 2 || got[1] != packets[4] {
+		t.Errorf("second batch: got %v, %v", got, ok)
+	}
+	if got, ok = c.ReceiveBatch(got[:0]); ok || len(got) != 0 {
+		t.Errorf("closed channel: got %v, %v", got, ok)
+	}
+	if n := c.SendBatch(packets); n != 0 {
+		t.Errorf("sent %d packets after close", n)
+	}
+}
+
+func BenchmarkPacketChanSendReceiveBatch(b *testing.B) {
+	const size = 64
+	c := NewPacketChan(100)
+	go func() {
+		batch := make([]*Packet, size)
+		for i := range batch {
+			batch[i] = benchmarkPacket
+		}
+		for i := 0; i < b.N; i += size {
+			c.SendBatch(batch)
+		}
+		c.Close(nil)
+	}()
+	buf := make([]*Packet, 0, size)
+	for ok := true; ok; {
+		buf, ok = c.ReceiveBatch(buf[:0])
+	}
+}
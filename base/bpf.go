@@ -0,0 +1,130 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/url"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"golang.org/x/net/bpf"
+)
+
+// ParseBPF parses a compiled BPF program in the hex format stenotype's
+// --filter flag takes (and stenotype/compile_bpf.sh produces): 16 hex digits
+// per instruction, giving its 16-bit opcode, 8-bit jump-if-true and
+// jump-if-false offsets, and 32-bit constant.
+func ParseBPF(hex string) ([]bpf.RawInstruction, error) {
+	hex = strings.TrimSpace(hex)
+	if len(hex) == 0 || len(hex)%16 != 0 {
+		return nil, fmt.Errorf("compiled BPF length %d is not a positive multiple of 16", len(hex))
+	}
+	var out []bpf.RawInstruction
+	for i := 0; i < len(hex); i += 16 {
+		ins, err := strconv.ParseUint(hex[i:i+16], 16, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid BPF instruction %d: %v", i/16, err)
+		}
+		out = append(out, bpf.RawInstruction{
+			Op: uint16(ins >> 48),
+			Jt: uint8(ins >> 40),
+			Jf: uint8(ins >> 32),
+			K:  uint32(ins),
+		})
+	}
+	return out, nil
+}
+
+// CompileBPF compiles a tcpdump filter expression ("tcp[13]&2!=0", say) for
+// ethernet packets.  Like compile_bpf.sh, it uses tcpdump to do the work, but
+// compiles against an empty PCAP file rather than a live interface, so it
+// needs no special privileges.  Expressions starting with '-' are rejected,
+// and the expression follows "--", so it can't pass tcpdump options.
+func CompileBPF(expr string) ([]bpf.RawInstruction, error) {
+	if strings.HasPrefix(strings.TrimSpace(expr), "-") {
+		return nil, fmt.Errorf("invalid BPF expression %q: starts with '-'", expr)
+	}
+	var header bytes.Buffer
+	if err := pcapgo.NewWriter(&header).WriteFileHeader(snapLen, layers.LinkTypeEthernet); err != nil {
+		return nil, err
+	}
+	var stderr bytes.Buffer
+	cmd := exec.Command("tcpdump", "-r", "-", "-ddd", "--", expr)
+	cmd.Stdin = &header
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("could not compile BPF %q: %v: %s", expr, err, strings.TrimSpace(stderr.String()))
+	}
+	// -ddd prints the instruction count, then one "code jt jf k" line per
+	// instruction, all in decimal.
+	lines := bufio.NewScanner(bytes.NewReader(output))
+	var out []bpf.RawInstruction
+	for first := true; lines.Scan(); first = false {
+		if first {
+			continue
+		}
+		var ins bpf.RawInstruction
+		if _, err := fmt.Sscan(lines.Text(), &ins.Op, &ins.Jt, &ins.Jf, &ins.K); err != nil {
+			return nil, fmt.Errorf("could not parse tcpdump output line %q: %v", lines.Text(), err)
+		}
+		out = append(out, ins)
+	}
+	return out, nil
+}
+
+// BPFFromValues returns the BPF program requested by the URL query parameters
+// "bpf", a program compiled as by ParseBPF, or "filter", a tcpdump expression
+// for CompileBPF.  It returns nil if neither is given.
+func BPFFromValues(v url.Values) ([]bpf.RawInstruction, error) {
+	hex, expr := v.Get("bpf"), v.Get("filter")
+	switch {
+	case hex != "" && expr != "":
+		return nil, fmt.Errorf("only one of bpf and filter may be given")
+	case hex != "":
+		return ParseBPF(hex)
+	case expr != "":
+		return CompileBPF(expr)
+	}
+	return nil, nil
+}
+
+// BPFFilterChan passes through only those packets from 'in' which the given
+// BPF program accepts, running it in a pure-Go BPF virtual machine.  This
+// lets queries use the index for coarse selection, then filter precisely on
+// things the index doesn't cover, like TCP flags.  Packets are filtered as
+// captured: a program which needs bytes beyond a truncated packet's captured
+// data rejects it.  An invalid program returns an error, and 'in' is left
+// untouched.
+func BPFFilterChan(in *PacketChan, prog []bpf.RawInstruction) (*PacketChan, error) {
+	insts, ok := bpf.Disassemble(prog)
+	if !ok {
+		return nil, fmt.Errorf("BPF program contains unknown instructions")
+	}
+	vm, err := bpf.NewVM(insts)
+	if err != nil {
+		return nil, fmt.Errorf("invalid BPF program: %v", err)
+	}
+	return filterChan(in, func(p *Packet) bool {
+		n, err := vm.Run(p.Data)
+		return err == nil && n > 0
+	}), nil
+}
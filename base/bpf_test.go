@@ -0,0 +1,116 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"net/url"
+	"os/exec"
+	"reflect"
+	"testing"
+
+	"github.com/google/gopacket/layers"
+)
+
+// udpBPF is "ip and udp", compiled as by stenotype/compile_bpf.sh.
+const udpBPF = "002800000000000c" + // ldh [12]
+	"0015000300000800" + // jeq #0x800, else drop
+	"0030000000000017" + // ldb [23]
+	"0015000100000011" + // jeq #17, else drop
+	"0006000000040000" + // ret #262144
+	"0006000000000000" // ret #0
+
+func TestParseBPF(t *testing.T) {
+	prog, err := ParseBPF(udpBPF + "\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(prog) != 6 {
+		t.Fatalf("want 6 instructions, got %d", len(prog))
+	}
+	if got := prog[1]; got.Op != 0x15 || got.Jt != 0 || got.Jf != 3 || got.K != 0x800 {
+		t.Errorf("instruction 1 misparsed: %+v", got)
+	}
+	for _, bad := range []string{"", "0028", udpBPF + "00", "zz28000000000000"} {
+		if _, err := ParseBPF(bad); err == nil {
+			t.Errorf("%q: want error", bad)
+		}
+	}
+}
+
+func TestBPFFilterChan(t *testing.T) {
+	prog, err := ParseBPF(udpBPF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcp := testIPPacket(t, layers.IPProtocolTCP, "10.0.0.1", "10.0.0.2", 1234, 80)
+	udp := testIPPacket(t, layers.IPProtocolUDP, "10.0.0.1", "10.0.0.2", 1234, 53)
+	short := testIPPacket(t, layers.IPProtocolUDP, "10.0.0.1", "10.0.0.2", 1234, 53)
+	short.Truncate(20) // Cuts off the IP protocol byte.
+	out, err := BPFFilterChan(packetChanOf(nil, tcp, udp, short, tcp), prog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []*Packet
+	for p := range out.Receive() {
+		got = append(got, p)
+	}
+	if err := out.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, []*Packet{udp}) {
+		t.Errorf("want only the UDP packet, got %d packets", len(got))
+	}
+
+	// Jumps past the end of the program are rejected up front.
+	bad, _ := ParseBPF("0015000900000800" + "0006000000000000")
+	if _, err := BPFFilterChan(packetChanOf(nil), bad); err == nil {
+		t.Error("want error for invalid program")
+	}
+}
+
+func TestBPFFromValues(t *testing.T) {
+	if prog, err := BPFFromValues(url.Values{}); prog != nil || err != nil {
+		t.Errorf("no params: want nil, nil got %v, %v", prog, err)
+	}
+	if prog, err := BPFFromValues(url.Values{"bpf": {udpBPF}}); len(prog) != 6 || err != nil {
+		t.Errorf("bpf param: got %v, %v", prog, err)
+	}
+	if _, err := BPFFromValues(url.Values{"bpf": {udpBPF}, "filter": {"udp"}}); err == nil {
+		t.Error("both params: want error")
+	}
+}
+
+func TestCompileBPF(t *testing.T) {
+	// Options are rejected before tcpdump is run.
+	for _, expr := range []string{"-w /tmp/x", " --version"} {
+		if _, err := CompileBPF(expr); err == nil {
+			t.Errorf("%q: want error for an option", expr)
+		}
+	}
+	if _, err := exec.LookPath("tcpdump"); err != nil {
+		t.Skip("tcpdump not installed")
+	}
+	prog, err := CompileBPF("ip and udp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := ParseBPF(udpBPF)
+	if !reflect.DeepEqual(prog, want) {
+		t.Errorf("want %v got %v", want, prog)
+	}
+	if _, err := CompileBPF("not a ( filter"); err == nil {
+		t.Error("want error for invalid expression")
+	}
+}
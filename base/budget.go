@@ -0,0 +1,142 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/google/stenographer/stats"
+	"golang.org/x/net/context"
+)
+
+var (
+	budgetReservedBytes = stats.S.Get("query_budget_reserved_bytes")
+	budgetExceeded      = stats.S.Get("query_budget_exceeded")
+)
+
+// MemoryBudget caps the memory a query may spend holding packet positions.
+// Budgets nest: a query's budget has the process-wide budget as its parent,
+// and each blockfile lookup takes a child of its query's budget, released
+// once the lookup's done, so reservations only count while they're in use.
+// A reservation must fit in every budget up the chain, so a single broad
+// query and many moderate ones running at once are both stopped before
+// memory runs out.  Reservations are made before the memory's allocated, and
+// a lookup refused one falls back to reading its file a slice at a time (see
+// blockfile.BlockFile.Lookup).  A nil *MemoryBudget is unlimited.
+type MemoryBudget struct {
+	parent *MemoryBudget
+	limit  int64 // Bytes, or 0 for no limit of its own
+	shared bool
+	mu     sync.Mutex
+	used   int64
+}
+
+// NewMemoryBudget returns a budget of 'limit' bytes (0 for no limit of its
+// own) drawing on 'parent', which may be nil.
+func NewMemoryBudget(limit int64, parent *MemoryBudget) *MemoryBudget {
+	return &MemoryBudget{parent: parent, limit: limit}
+}
+
+// NewSharedMemoryBudget returns a top-level budget of 'limit' bytes shared by
+// all queries, whose errors say so.
+func NewSharedMemoryBudget(limit int64) *MemoryBudget {
+	return &MemoryBudget{limit: limit, shared: true}
+}
+
+// BudgetError is returned when a reservation doesn't fit in a budget.
+type BudgetError struct {
+	Limit, Used, Wanted int64
+	// Shared is true if the budget is shared by all queries, in which case
+	// the query may succeed once others finish.
+	Shared bool
+}
+
+func (e *BudgetError) Error() string {
+	if e.Shared {
+		return fmt.Sprintf("query too broad while others are running: queries already hold %d of %d MB of packet positions; retry later or narrow it", e.Used>>20, e.Limit>>20)
+	}
+	return fmt.Sprintf("query too broad: its packet positions need over %d MB; narrow it by time or with more terms", e.Limit>>20)
+}
+
+// Reserve reserves n bytes, returning a *BudgetError if they don't fit.
+func (m *MemoryBudget) Reserve(n int64) error {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	if m.limit > 0 && m.used+n > m.limit {
+		err := &BudgetError{Limit: m.limit, Used: m.used, Wanted: n, Shared: m.shared}
+		m.mu.Unlock()
+		budgetExceeded.Increment()
+		return err
+	}
+	m.used += n
+	m.mu.Unlock()
+	if err := m.parent.Reserve(n); err != nil {
+		m.mu.Lock()
+		m.used -= n
+		m.mu.Unlock()
+		return err
+	}
+	if m.parent == nil {
+		budgetReservedBytes.IncrementBy(n)
+	}
+	return nil
+}
+
+// Release returns n reserved bytes to the budget.
+func (m *MemoryBudget) Release(n int64) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.used -= n
+	m.mu.Unlock()
+	m.parent.Release(n)
+	if m.parent == nil {
+		budgetReservedBytes.IncrementBy(-n)
+	}
+}
+
+// ReleaseAll returns everything reserved from this budget.
+func (m *MemoryBudget) ReleaseAll() {
+	m.Release(m.Used())
+}
+
+// Used returns the bytes currently reserved from this budget.
+func (m *MemoryBudget) Used() int64 {
+	if m == nil {
+		return 0
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.used
+}
+
+type budgetKey struct{}
+
+// WithMemoryBudget returns a context carrying budget to the index reads made
+// for it.
+func WithMemoryBudget(ctx context.Context, budget *MemoryBudget) context.Context {
+	return context.WithValue(ctx, budgetKey{}, budget)
+}
+
+// MemoryBudgetFromContext returns the budget carried by ctx, or nil (an
+// unlimited budget) if there is none.
+func MemoryBudgetFromContext(ctx context.Context) *MemoryBudget {
+	b, _ := ctx.Value(budgetKey{}).(*MemoryBudget)
+	return b
+}
@@ -0,0 +1,63 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestMemoryBudget(t *testing.T) {
+	shared := NewSharedMemoryBudget(100)
+	q1 := NewMemoryBudget(60, shared)
+	q2 := NewMemoryBudget(60, shared)
+	if err := q1.Reserve(50); err != nil {
+		t.Fatal(err)
+	}
+	// Too much for the query's own budget.
+	if err, ok := q1.Reserve(20).(*BudgetError); !ok || err.Shared {
+		t.Errorf("want per-query BudgetError, got %v", err)
+	} else if !strings.HasPrefix(err.Error(), "query too broad") {
+		t.Errorf("unclear error %q", err)
+	}
+	// Fits the query's budget, but not what's left of the shared one.
+	if err, ok := q2.Reserve(55).(*BudgetError); !ok || !err.Shared {
+		t.Errorf("want shared BudgetError, got %v", err)
+	}
+	if got := q2.Used(); got != 0 {
+		t.Errorf("failed reservation left %d bytes used", got)
+	}
+	q1.ReleaseAll()
+	if err := q2.Reserve(55); err != nil {
+		t.Errorf("shared budget not released: %v", err)
+	}
+	if got := shared.Used(); got != 55 {
+		t.Errorf("shared budget has %d used, want 55", got)
+	}
+
+	// Nil budgets, as from contexts without one, are unlimited.
+	var none *MemoryBudget
+	if err := none.Reserve(1 << 40); err != nil {
+		t.Error(err)
+	}
+	if b := MemoryBudgetFromContext(context.Background()); b != nil {
+		t.Errorf("got budget %v from empty context", b)
+	}
+	if b := MemoryBudgetFromContext(WithMemoryBudget(context.Background(), q1)); b != q1 {
+		t.Errorf("got budget %v, want %v", b, q1)
+	}
+}
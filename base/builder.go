@@ -0,0 +1,84 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"runtime"
+	"sync"
+)
+
+// positionsShard is a single lock-protected buffer of a
+// ConcurrentPositionsBuilder, padded so neighbouring shards don't share a
+// cache line.
+type positionsShard struct {
+	mu  sync.Mutex
+	buf Positions
+	_   [40]byte
+}
+
+// ConcurrentPositionsBuilder accumulates positions from many goroutines at
+// once, as when scanning index shards in parallel.  Adds are spread over
+// several independently locked buffers to avoid contention, and only merged
+// in Finish.
+type ConcurrentPositionsBuilder struct {
+	shards []positionsShard
+}
+
+// NewConcurrentPositionsBuilder returns a builder with one shard per CPU.
+func NewConcurrentPositionsBuilder() *ConcurrentPositionsBuilder {
+	return &ConcurrentPositionsBuilder{shards: make([]positionsShard, runtime.GOMAXPROCS(0))}
+}
+
+// Add adds a position.  It's safe for concurrent use.
+func (b *ConcurrentPositionsBuilder) Add(pos int64) {
+	// Pick a starting shard by hashing the position, rather than from any
+	// shared counter which would itself be contended, then take the first
+	// shard we can lock without waiting.
+	n := uint64(len(b.shards))
+	start := (uint64(pos) * 0x9E3779B97F4A7C15) % n
+	for i := uint64(0); i < n; i++ {
+		if s := &b.shards[(start+i)%n]; s.mu.TryLock() {
+			s.buf = append(s.buf, pos)
+			s.mu.Unlock()
+			return
+		}
+	}
+	s := &b.shards[start]
+	s.mu.Lock()
+	s.buf = append(s.buf, pos)
+	s.mu.Unlock()
+}
+
+// Finish returns all added positions, sorted and deduplicated.  It must not be
+// called concurrently with Add, and the builder shouldn't be used afterwards.
+func (b *ConcurrentPositionsBuilder) Finish() Positions {
+	total := 0
+	for i := range b.shards {
+		total += len(b.shards[i].buf)
+	}
+	out := make(Positions, 0, total)
+	for i := range b.shards {
+		out = append(out, b.shards[i].buf...)
+		b.shards[i].buf = nil
+	}
+	out.Sort()
+	uniq := out[:0]
+	for i, pos := range out {
+		if i == 0 || pos != out[i-1] {
+			uniq = append(uniq, pos)
+		}
+	}
+	return uniq
+}
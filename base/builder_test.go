@@ -0,0 +1,71 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestConcurrentPositionsBuilder(t *testing.T) {
+	b := NewConcurrentPositionsBuilder()
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			// Every goroutine adds the even positions, plus some of its own.
+			for i := int64(0); i < 1000; i += 2 {
+				b.Add(i)
+			}
+			b.Add(int64(1001 + 2*g))
+		}(g)
+	}
+	wg.Wait()
+	var want Positions
+	for i := int64(0); i < 1000; i += 2 {
+		want = append(want, i)
+	}
+	for g := 0; g < 8; g++ {
+		want = append(want, int64(1001+2*g))
+	}
+	if got := b.Finish(); !reflect.DeepEqual(got, want) {
+		t.Errorf("wrong positions:\nwant %v\ngot  %v", want, got)
+	}
+}
+
+func BenchmarkConcurrentPositionsBuilder(b *testing.B) {
+	builder := NewConcurrentPositionsBuilder()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := int64(0); pb.Next(); i++ {
+			builder.Add(i)
+		}
+	})
+	builder.Finish()
+}
+
+func BenchmarkMutexPositionsAppend(b *testing.B) {
+	var mu sync.Mutex
+	var out Positions
+	b.RunParallel(func(pb *testing.PB) {
+		for i := int64(0); pb.Next(); i++ {
+			mu.Lock()
+			out = append(out, i)
+			mu.Unlock()
+		}
+	})
+	out.Sort()
+}
@@ -0,0 +1,148 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"sort"
+)
+
+// Thresholds used by CompactPositions.MaybeCompact.
+const (
+	// compactMinPositions is the smallest set worth compacting.  Below this,
+	// the set is small enough that its representation doesn't matter.
+	compactMinPositions = 1024
+	// compactMaxRunFraction is the largest fraction of positions which may
+	// start a new run for the set to be compacted.  A PositionRange takes
+	// twice the space of a position, so 1/4 halves memory use.
+	compactMaxRunFraction = 4
+)
+
+// CompactPositions is a set of positions which picks its own representation:
+// a plain sorted Positions list, or run-length encoded PositionRanges when
+// the positions are clustered enough for that to be smaller.  Index results
+// for busy flows tend to be nearly contiguous, while others are sparse, so
+// letting each set choose cuts peak memory when many sets are live at once.
+// Call MaybeCompact after building or modifying the set to let it switch.
+type CompactPositions struct {
+	list   Positions       // Used if ranges is nil
+	ranges []PositionRange // If non-nil, the set's contents
+	count  int             // Number of positions in ranges
+}
+
+// NewCompactPositions returns a set containing p, which must be sorted.  It
+// takes ownership of p.
+func NewCompactPositions(p Positions) *CompactPositions {
+	c := &CompactPositions{list: p}
+	c.MaybeCompact()
+	return c
+}
+
+// countRuns returns the number of runs of consecutive positions in p.
+func countRuns(p Positions) int {
+	runs := 0
+	for i, pos := range p {
+		if i == 0 || p[i-1]+1 != pos {
+			runs++
+		}
+	}
+	return runs
+}
+
+// MaybeCompact switches to run-length encoding if the set has at least
+// compactMinPositions positions and fewer than 1/compactMaxRunFraction of
+// them start a new run, and switches back to a plain list once the encoding
+// stops paying for itself: when the set shrinks below half the minimum, or
+// when ranges get larger than the plain list would be.  The gap between those
+// thresholds keeps sets near the boundary from flipping back and forth.
+func (c *CompactPositions) MaybeCompact() {
+	if c.ranges != nil {
+		if c.count < compactMinPositions/2 || len(c.ranges)*2 > c.count {
+			c.list, c.ranges, c.count = ExpandRanges(c.ranges), nil, 0
+		}
+		return
+	}
+	if len(c.list) < compactMinPositions || c.list.IsAllPositions() {
+		return
+	}
+	// Every run after the first is preceded by at least one missing position
+	// within the set's span, so a dense enough span bounds the number of runs
+	// without having to count them.
+	n := len(c.list)
+	missing := int(c.list[n-1]-c.list[0]+1) - n
+	if (missing+1)*compactMaxRunFraction < n || countRuns(c.list)*compactMaxRunFraction < n {
+		c.ranges, c.count, c.list = c.list.RunLengthEncode(), n, nil
+	}
+}
+
+// IsCompact returns true if the set is currently run-length encoded.
+func (c *CompactPositions) IsCompact() bool { return c.ranges != nil }
+
+// Len returns the number of positions in the set.
+func (c *CompactPositions) Len() int {
+	if c.ranges != nil {
+		return c.count
+	}
+	return len(c.list)
+}
+
+// Contains returns true if pos is in the set.
+func (c *CompactPositions) Contains(pos int64) bool {
+	if c.ranges != nil {
+		i := sort.Search(len(c.ranges), func(i int) bool { return c.ranges[i].End >= pos })
+		return i < len(c.ranges) && c.ranges[i].Contains(pos)
+	}
+	i := sort.Search(len(c.list), func(i int) bool { return c.list[i] >= pos })
+	return i < len(c.list) && c.list[i] == pos
+}
+
+// Positions returns the set as a sorted Positions list.  If the set isn't
+// compacted, its internal list is returned, and must not be modified.
+func (c *CompactPositions) Positions() Positions {
+	if c.ranges != nil {
+		return ExpandRanges(c.ranges)
+	}
+	return c.list
+}
+
+// Union replaces the set's contents with their union with p.  Like Intersect,
+// it works on the plain list form, so is no cheaper for compacted sets.
+func (c *CompactPositions) Union(p Positions) {
+	c.set(c.Positions().Union(p))
+}
+
+// Intersect replaces the set's contents with their intersection with p.
+func (c *CompactPositions) Intersect(p Positions) {
+	c.set(c.Positions().Intersect(p))
+}
+
+// set replaces the set's contents with p, then lets it pick a representation.
+// A compacted set stays compacted unless MaybeCompact's thresholds for
+// switching back are met.
+func (c *CompactPositions) set(p Positions) {
+	wasCompact := c.ranges != nil
+	c.list, c.ranges, c.count = p, nil, 0
+	if wasCompact && len(p) > 0 && !p.IsAllPositions() {
+		c.ranges, c.count, c.list = p.RunLengthEncode(), len(p), nil
+	}
+	c.MaybeCompact()
+}
+
+// memoryBytes returns the approximate heap memory used by the set's contents.
+func (c *CompactPositions) memoryBytes() int {
+	if c.ranges != nil {
+		return cap(c.ranges) * 16
+	}
+	return cap(c.list) * 8
+}
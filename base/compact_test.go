@@ -0,0 +1,89 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+// clusteredPositions returns n positions in runs of the given length.
+func clusteredPositions(n, run int) Positions {
+	out := make(Positions, 0, n)
+	for pos := int64(0); len(out) < n; pos++ {
+		if pos%int64(run+1) != int64(run) {
+			out = append(out, pos)
+		}
+	}
+	return out
+}
+
+func TestCompactPositions(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for _, test := range []struct {
+		name string
+		in   Positions
+		want bool
+	}{
+		{"small clustered", clusteredPositions(100, 50), false},
+		{"large clustered", clusteredPositions(10000, 50), true},
+		{"large contiguous", clusteredPositions(10000, 100000), true},
+		{"large sparse", randomPositions(r, 10000, 1000000), false},
+		{"large short runs", clusteredPositions(10000, 2), false},
+		{"all", AllPositions, false},
+	} {
+		want := append(Positions(nil), test.in...)
+		c := NewCompactPositions(test.in)
+		if c.IsCompact() != test.want {
+			t.Errorf("%s: compact is %v, want %v", test.name, c.IsCompact(), test.want)
+		}
+		if c.Len() != len(want) {
+			t.Errorf("%s: wrong length: want %d got %d", test.name, len(want), c.Len())
+		}
+		if got := c.Positions(); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: contents changed", test.name)
+		}
+		if len(want) > 1 && !want.IsAllPositions() {
+			if !c.Contains(want[len(want)/2]) || c.Contains(want[len(want)-1]+1) {
+				t.Errorf("%s: Contains is wrong", test.name)
+			}
+		}
+	}
+
+	// Shrinking a compacted set converts it back.
+	c := NewCompactPositions(clusteredPositions(10000, 50))
+	c.Intersect(clusteredPositions(compactMinPositions*3/4, 50))
+	if !c.IsCompact() {
+		t.Error("set above the switch-back threshold was expanded")
+	}
+	c.Intersect(clusteredPositions(compactMinPositions/4, 50))
+	if c.IsCompact() || c.Len() != compactMinPositions/4 {
+		t.Errorf("shrunk set not expanded: compact %v, len %d", c.IsCompact(), c.Len())
+	}
+	c.Union(clusteredPositions(10000, 50))
+	if !c.IsCompact() || c.Len() != 10000 {
+		t.Errorf("grown set not compacted: compact %v, len %d", c.IsCompact(), c.Len())
+	}
+}
+
+func BenchmarkCompactPositionsMemory(b *testing.B) {
+	in := clusteredPositions(100000, 200)
+	b.ReportMetric(float64(cap(in)*8), "B/list")
+	for i := 0; i < b.N; i++ {
+		c := NewCompactPositions(append(Positions(nil), in...))
+		b.ReportMetric(float64(c.memoryBytes()), "B/compact")
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"sync"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// layerInfo caches the header fields Packet's accessors need, so a packet is
+// decoded at most once no matter how many accessors are called on it.
+type layerInfo struct {
+	decoded                  bool
+	network, transport       gopacket.Flow
+	hasNetwork, hasTransport bool
+	transportType            gopacket.LayerType
+}
+
+// decoder decodes packets into preallocated layers.  Decoders are expensive
+// to set up, so they're pooled and reused across packets.
+type decoder struct {
+	eth     layers.Ethernet
+	dot1q   layers.Dot1Q
+	ip4     layers.IPv4
+	ip6     layers.IPv6
+	tcp     layers.TCP
+	udp     layers.UDP
+	payload gopacket.Payload
+	parser  *gopacket.DecodingLayerParser
+	decoded []gopacket.LayerType
+}
+
+var decoderPool = sync.Pool{
+	New: func() interface{} {
+		d := &decoder{decoded: make([]gopacket.LayerType, 0, 8)}
+		d.parser = gopacket.NewDecodingLayerParser(layers.LayerTypeEthernet,
+			&d.eth, &d.dot1q, &d.ip4, &d.ip6, &d.tcp, &d.udp, &d.payload)
+		d.parser.IgnoreUnsupported = true
+		return d
+	},
+}
+
+// decode fills in 'info' from the headers in 'data'.  Truncated or
+// unsupported headers aren't an error; we just keep whatever layers we were
+// able to decode before hitting them.
+func (d *decoder) decode(data []byte, info *layerInfo) {
+	*info = layerInfo{decoded: true}
+	d.parser.DecodeLayers(data, &d.decoded)
+	for _, typ := range d.decoded {
+		switch typ {
+		case layers.LayerTypeIPv4:
+			info.network, info.hasNetwork = d.ip4.NetworkFlow(), true
+		case layers.LayerTypeIPv6:
+			info.network, info.hasNetwork = d.ip6.NetworkFlow(), true
+		case layers.LayerTypeTCP:
+			info.transport, info.hasTransport = d.tcp.TransportFlow(), true
+			info.transportType = typ
+		case layers.LayerTypeUDP:
+			info.transport, info.hasTransport = d.udp.TransportFlow(), true
+			info.transportType = typ
+		}
+	}
+}
+
+// layers returns the packet's decoded header information, decoding the
+// packet's data as an ethernet frame the first time it's called.  Since it
+// caches its result on the packet, it must not be called concurrently on the
+// same packet from multiple goroutines.
+func (p *Packet) layers() *layerInfo {
+	if !p.info.decoded {
+		d := decoderPool.Get().(*decoder)
+		d.decode(p.Data, &p.info)
+		decoderPool.Put(d)
+	}
+	return &p.info
+}
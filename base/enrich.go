@@ -0,0 +1,86 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"net"
+)
+
+// Tag keys set by GeoEnrichChan and ReverseDNSChan.
+const (
+	TagSrcCountry = "src_country"
+	TagDstCountry = "dst_country"
+	TagSrcHost    = "src_host"
+	TagDstHost    = "dst_host"
+)
+
+// SetTag sets the given tag on the packet, allocating Tags if necessary.
+func (p *Packet) SetTag(key, value string) {
+	if p.Tags == nil {
+		p.Tags = map[string]string{}
+	}
+	p.Tags[key] = value
+}
+
+// IPs returns the packet's source and destination IP addresses.  ok is false
+// for non-IP packets.
+func (p *Packet) IPs() (src, dst net.IP, ok bool) {
+	info := p.layers()
+	if !info.hasNetwork {
+		return nil, nil, false
+	}
+	s, d := info.network.Endpoints()
+	return net.IP(s.Raw()), net.IP(d.Raw()), true
+}
+
+// tagIPsChan passes packets from 'in' to the returned PacketChan, tagging each
+// IP packet's source and destination with the results of lookup.  Addresses
+// for which lookup returns ok=false are left untagged.
+func tagIPsChan(in *PacketChan, srcKey, dstKey string, lookup func(net.IP) (string, bool)) *PacketChan {
+	out := NewPacketChan(100)
+	go func() {
+		defer in.Discard()
+		for pkt := range in.Receive() {
+			if src, dst, ok := pkt.IPs(); ok {
+				if v, ok := lookup(src); ok {
+					pkt.SetTag(srcKey, v)
+				}
+				if v, ok := lookup(dst); ok {
+					pkt.SetTag(dstKey, v)
+				}
+			}
+			out.Send(pkt)
+		}
+		out.Close(in.Err())
+	}()
+	return out
+}
+
+// GeoEnrichChan tags each IP packet from 'in' with the countries of its
+// source and destination addresses (TagSrcCountry and TagDstCountry), as
+// returned by lookup.  base doesn't depend on any GeoIP database; the caller
+// picks one by supplying lookup.  Non-IP packets pass through untagged.
+func GeoEnrichChan(in *PacketChan, lookup func(net.IP) (country string, ok bool)) *PacketChan {
+	return tagIPsChan(in, TagSrcCountry, TagDstCountry, lookup)
+}
+
+// ReverseDNSChan tags each IP packet from 'in' with the hostnames of its
+// source and destination addresses (TagSrcHost and TagDstHost), as returned by
+// resolve.  resolve is called inline for every packet, so it should answer
+// from a cache and never block on the network; returning ok=false (on a cache
+// miss, say) forwards the packet immediately with the tag absent.
+func ReverseDNSChan(in *PacketChan, resolve func(net.IP) (host string, ok bool)) *PacketChan {
+	return tagIPsChan(in, TagSrcHost, TagDstHost, resolve)
+}
@@ -0,0 +1,65 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/gopacket/layers"
+)
+
+func TestGeoEnrichChan(t *testing.T) {
+	ip := testIPPacket(t, layers.IPProtocolTCP, "10.0.0.1", "192.168.0.1", 1234, 80)
+	garbage := &Packet{Data: []byte{1, 2, 3}}
+	countries := map[string]string{"10.0.0.1": "US"}
+	out := GeoEnrichChan(packetChanOf(nil, ip, garbage), func(addr net.IP) (string, bool) {
+		c, ok := countries[addr.String()]
+		return c, ok
+	})
+	var got []*Packet
+	for p := range out.Receive() {
+		got = append(got, p)
+	}
+	if len(got) != 2 {
+		t.Fatalf("wrong packet count: want 2 got %d", len(got))
+	}
+	if c := got[0].Tags[TagSrcCountry]; c != "US" {
+		t.Errorf("wrong source country: want US got %q", c)
+	}
+	if _, ok := got[0].Tags[TagDstCountry]; ok {
+		t.Error("unknown destination was tagged")
+	}
+	if got[1].Tags != nil {
+		t.Errorf("non-IP packet tagged: %v", got[1].Tags)
+	}
+}
+
+func TestReverseDNSChan(t *testing.T) {
+	ip := testIPPacket(t, layers.IPProtocolUDP, "10.0.0.1", "10.0.0.2", 53, 53)
+	out := ReverseDNSChan(packetChanOf(nil, ip), func(addr net.IP) (string, bool) {
+		if addr.Equal(net.ParseIP("10.0.0.2")) {
+			return "ns.example.com", true
+		}
+		return "", false
+	})
+	p := <-out.Receive()
+	if _, ok := p.Tags[TagSrcHost]; ok {
+		t.Error("unresolved source was tagged")
+	}
+	if h := p.Tags[TagDstHost]; h != "ns.example.com" {
+		t.Errorf("wrong destination host: want ns.example.com got %q", h)
+	}
+}
@@ -0,0 +1,57 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// FlowKey identifies a conversation by its network and transport flows.  Keys
+// returned by Packet methods are normalized, so both directions of a single
+// conversation share the same key.  FlowKey may be used as a map key.
+type FlowKey struct {
+	Network, Transport gopacket.Flow
+}
+
+// Reverse returns the key for the opposite direction of this flow.
+func (k FlowKey) Reverse() FlowKey {
+	return FlowKey{Network: k.Network.Reverse(), Transport: k.Transport.Reverse()}
+}
+
+// normalize returns the canonical version of k, along with +1 if k was
+// already canonical or -1 if it had to be reversed.
+func (k FlowKey) normalize() (FlowKey, int) {
+	nsrc, ndst := k.Network.Endpoints()
+	tsrc, tdst := k.Transport.Endpoints()
+	if ndst.LessThan(nsrc) || (nsrc == ndst && tdst.LessThan(tsrc)) {
+		return k.Reverse(), -1
+	}
+	return k, 1
+}
+
+// TCPStreamKey returns the normalized flow key for a TCP packet, along with
+// the direction of this packet relative to that key: +1 if the packet travels
+// from the key's source to its destination, -1 if it travels the reverse way.
+// This allows reassembly to assign each segment to the correct half-stream.
+// ok is false if the packet is not TCP.
+func (p *Packet) TCPStreamKey() (key FlowKey, dir int, ok bool) {
+	info := p.layers()
+	if !info.hasNetwork || info.transportType != layers.LayerTypeTCP {
+		return FlowKey{}, 0, false
+	}
+	key, dir = FlowKey{Network: info.network, Transport: info.transport}.normalize()
+	return key, dir, true
+}
@@ -0,0 +1,120 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// testIPPacket builds an ethernet/IPv4 packet carrying a TCP or UDP header.
+func testIPPacket(t testing.TB, proto layers.IPProtocol, src, dst string, sport, dport uint16) *Packet {
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 5},
+		DstMAC:       net.HardwareAddr{6, 7, 8, 9, 10, 11},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: proto,
+		SrcIP:    net.ParseIP(src).To4(),
+		DstIP:    net.ParseIP(dst).To4(),
+	}
+	var transport gopacket.SerializableLayer
+	switch proto {
+	case layers.IPProtocolTCP:
+		tcp := &layers.TCP{SrcPort: layers.TCPPort(sport), DstPort: layers.TCPPort(dport), SYN: true}
+		tcp.SetNetworkLayerForChecksum(ip)
+		transport = tcp
+	case layers.IPProtocolUDP:
+		udp := &layers.UDP{SrcPort: layers.UDPPort(sport), DstPort: layers.UDPPort(dport)}
+		udp.SetNetworkLayerForChecksum(ip)
+		transport = udp
+	default:
+		t.Fatalf("unsupported protocol %v", proto)
+	}
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, eth, ip, transport, gopacket.Payload("hello")); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	p := &Packet{Data: data}
+	p.CaptureLength = len(data)
+	p.Length = len(data)
+	return p
+}
+
+func TestTCPStreamKey(t *testing.T) {
+	fwd := testIPPacket(t, layers.IPProtocolTCP, "10.0.0.1", "10.0.0.2", 1234, 80)
+	rev := testIPPacket(t, layers.IPProtocolTCP, "10.0.0.2", "10.0.0.1", 80, 1234)
+	fwdKey, fwdDir, ok := fwd.TCPStreamKey()
+	if !ok {
+		t.Fatal("forward packet not recognized as TCP")
+	}
+	revKey, revDir, ok := rev.TCPStreamKey()
+	if !ok {
+		t.Fatal("reverse packet not recognized as TCP")
+	}
+	if fwdKey != revKey {
+		t.Errorf("keys differ:\nfwd: %v\nrev: %v", fwdKey, revKey)
+	}
+	if fwdDir != 1 || revDir != -1 {
+		t.Errorf("wrong directions: fwd %d rev %d", fwdDir, revDir)
+	}
+
+	// Same hosts, so direction must be decided by port.
+	a := testIPPacket(t, layers.IPProtocolTCP, "10.0.0.1", "10.0.0.1", 1234, 80)
+	b := testIPPacket(t, layers.IPProtocolTCP, "10.0.0.1", "10.0.0.1", 80, 1234)
+	aKey, aDir, _ := a.TCPStreamKey()
+	bKey, bDir, _ := b.TCPStreamKey()
+	if aKey != bKey || aDir == bDir {
+		t.Errorf("loopback flows not normalized: %v/%d vs %v/%d", aKey, aDir, bKey, bDir)
+	}
+
+	udp := testIPPacket(t, layers.IPProtocolUDP, "10.0.0.1", "10.0.0.2", 53, 53)
+	if _, _, ok := udp.TCPStreamKey(); ok {
+		t.Error("UDP packet returned a TCP stream key")
+	}
+	if _, _, ok := (&Packet{Data: []byte{1, 2, 3}}).TCPStreamKey(); ok {
+		t.Error("garbage packet returned a TCP stream key")
+	}
+}
+
+func BenchmarkDecodeNewPacket(b *testing.B) {
+	p := testIPPacket(b, layers.IPProtocolTCP, "10.0.0.1", "10.0.0.2", 1234, 80)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		pkt := gopacket.NewPacket(p.Data, layers.LayerTypeEthernet, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+		if pkt.NetworkLayer() == nil || pkt.TransportLayer() == nil {
+			b.Fatal("decode failed")
+		}
+	}
+}
+
+func BenchmarkDecodeLayerParser(b *testing.B) {
+	p := testIPPacket(b, layers.IPProtocolTCP, "10.0.0.1", "10.0.0.2", 1234, 80)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		p.info = layerInfo{}
+		if info := p.layers(); !info.hasNetwork || !info.hasTransport {
+			b.Fatal("decode failed")
+		}
+	}
+}
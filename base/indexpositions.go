@@ -0,0 +1,85 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Index files written by stenotype store the positions for each key as a
+// packed array of 4-byte big-endian blockfile offsets, sorted and without
+// duplicates.  ReadIndexPositions and WriteIndexPositions convert between that
+// format and Positions.
+
+// ReadIndexPositions reads positions stored in stenotype's on-disk index
+// format from r until EOF.
+func ReadIndexPositions(r io.Reader) (Positions, error) {
+	out := Positions{}
+	if l, ok := r.(interface {
+		Len() int
+	}); ok {
+		out = make(Positions, 0, l.Len()/4)
+	}
+	var buf [4096]byte
+	leftover := 0
+	for {
+		n, err := r.Read(buf[leftover:])
+		n += leftover
+		whole := n - n%4
+		for i := 0; i < whole; i += 4 {
+			out = append(out, int64(binary.BigEndian.Uint32(buf[i:i+4])))
+		}
+		leftover = copy(buf[:], buf[whole:n])
+		if err == io.EOF {
+			if leftover != 0 {
+				return nil, fmt.Errorf("index positions truncated: %d trailing bytes", leftover)
+			}
+			return out, nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// WriteIndexPositions writes positions to w in stenotype's on-disk index
+// format.  Positions must be sorted, unique, and fit in 32 bits.
+func WriteIndexPositions(w io.Writer, positions Positions) error {
+	if positions.IsAllPositions() {
+		return fmt.Errorf("cannot write AllPositions to an index")
+	}
+	var buf [4096]byte
+	n := 0
+	last := int64(-1)
+	for _, pos := range positions {
+		if pos <= last {
+			return fmt.Errorf("index positions not sorted and unique at %d", pos)
+		} else if pos > math.MaxUint32 {
+			return fmt.Errorf("index position %d too large", pos)
+		}
+		last = pos
+		binary.BigEndian.PutUint32(buf[n:], uint32(pos))
+		if n += 4; n == len(buf) {
+			if _, err := w.Write(buf[:n]); err != nil {
+				return err
+			}
+			n = 0
+		}
+	}
+	_, err := w.Write(buf[:n])
+	return err
+}
@@ -0,0 +1,59 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"bytes"
+	"math/rand"
+	"reflect"
+	"testing"
+	"testing/iotest"
+)
+
+func TestIndexPositionsRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for _, want := range []Positions{
+		{},
+		{0, 1, 1 << 31, 1<<32 - 1},
+		randomPositions(r, 5000, 1<<32),
+	} {
+		var buf bytes.Buffer
+		if err := WriteIndexPositions(&buf, want); err != nil {
+			t.Fatal(err)
+		}
+		if buf.Len() != 4*len(want) {
+			t.Errorf("wrote %d bytes for %d positions", buf.Len(), len(want))
+		}
+		// OneByteReader exercises reads which split a position.
+		got, err := ReadIndexPositions(iotest.OneByteReader(bytes.NewReader(buf.Bytes())))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("round trip failed:\nwant: %v\n got: %v", want, got)
+		}
+	}
+}
+
+func TestIndexPositionsErrors(t *testing.T) {
+	if _, err := ReadIndexPositions(bytes.NewReader([]byte{0, 0, 0, 1, 0, 0})); err == nil {
+		t.Error("read of truncated positions succeeded")
+	}
+	for _, bad := range []Positions{AllPositions, {2, 1}, {1, 1}, {1 << 32}} {
+		if err := WriteIndexPositions(&bytes.Buffer{}, bad); err == nil {
+			t.Errorf("write of invalid positions %v succeeded", bad)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var verboseModules = flag.String("vmodule", "", "comma-separated module=level pairs overriding -v for specific modules")
+
+// Logger writes out structured log messages.  kv holds alternating keys and
+// values giving additional fields for the message.  Loggers need not filter
+// by level; that's done by ModuleLogger before they're called.
+type Logger interface {
+	Log(level int, module, msg string, kv ...interface{})
+}
+
+var (
+	loggerMu sync.RWMutex
+	logger   Logger = StdLogger{}
+)
+
+// SetLogger replaces the Logger all messages are written to, StdLogger by
+// default.
+func SetLogger(l Logger) {
+	loggerMu.Lock()
+	defer loggerMu.Unlock()
+	logger = l
+}
+
+func currentLogger() Logger {
+	loggerMu.RLock()
+	defer loggerMu.RUnlock()
+	return logger
+}
+
+// ModuleLogger logs messages on behalf of a single module, whose verbosity
+// may be set separately from others' using the -vmodule flag.
+type ModuleLogger struct {
+	name string
+}
+
+// Module returns a ModuleLogger for the named module.
+func Module(name string) *ModuleLogger {
+	return &ModuleLogger{name: name}
+}
+
+// Enabled returns true if messages at the given level are logged for this
+// module, so callers can skip expensive work building them.
+func (m *ModuleLogger) Enabled(level int) bool {
+	if l, ok := moduleLevels()[m.name]; ok {
+		return l >= level
+	}
+	return *VerboseLogging >= level
+}
+
+// V logs msg with the given key/value fields, if level is enabled.
+func (m *ModuleLogger) V(level int, msg string, kv ...interface{}) {
+	if m.Enabled(level) {
+		currentLogger().Log(level, m.name, msg, kv...)
+	}
+}
+
+// parsedModuleLevels are the per-module levels parsed from a -vmodule value.
+type parsedModuleLevels struct {
+	vmodule string
+	levels  map[string]int
+}
+
+// cachedModuleLevels holds the last *parsedModuleLevels parsed.  Enabled is
+// called for every message, logged or not, so it's read without locking.
+var cachedModuleLevels atomic.Value
+
+// moduleLevels returns the per-module levels given by -vmodule, reparsing
+// them only when the flag changes.  Callers racing to reparse them parse the
+// same levels, so whichever stores them last wins harmlessly.
+func moduleLevels() map[string]int {
+	vmodule := *verboseModules
+	if p, _ := cachedModuleLevels.Load().(*parsedModuleLevels); p != nil && p.vmodule == vmodule {
+		return p.levels
+	}
+	levels := map[string]int{}
+	for _, pair := range strings.Split(vmodule, ",") {
+		if i := strings.LastIndex(pair, "="); i > 0 {
+			if level, err := strconv.Atoi(pair[i+1:]); err == nil {
+				levels[pair[:i]] = level
+			}
+		}
+	}
+	cachedModuleLevels.Store(&parsedModuleLevels{vmodule, levels})
+	return levels
+}
+
+// StdLogger writes messages with the standard library's log package, as
+// "module: msg key=value ...".
+type StdLogger struct{}
+
+func (StdLogger) Log(level int, module, msg string, kv ...interface{}) {
+	var buf bytes.Buffer
+	if module != "" {
+		buf.WriteString(module)
+		buf.WriteString(": ")
+	}
+	buf.WriteString(msg)
+	for i := 0; i < len(kv); i += 2 {
+		fmt.Fprintf(&buf, " %v=%v", kv[i], kvValue(kv, i))
+	}
+	log.Print(buf.String())
+}
+
+// JSONLogger writes each message to W as a single-line JSON object, for
+// shipping logs to an aggregation pipeline.  Objects have "time", "level",
+// "module" and "msg" keys, plus one per field.
+type JSONLogger struct {
+	mu sync.Mutex
+	W  io.Writer
+}
+
+func (j *JSONLogger) Log(level int, module, msg string, kv ...interface{}) {
+	obj := map[string]interface{}{
+		"time":  time.Now().UTC().Format(time.RFC3339Nano),
+		"level": level,
+		"msg":   msg,
+	}
+	if module != "" {
+		obj["module"] = module
+	}
+	for i := 0; i < len(kv); i += 2 {
+		v := kvValue(kv, i)
+		if err, ok := v.(error); ok {
+			v = err.Error()
+		}
+		obj[fmt.Sprint(kv[i])] = v
+	}
+	data, err := json.Marshal(obj)
+	if err != nil {
+		data, _ = json.Marshal(map[string]interface{}{"msg": msg, "log_error": err.Error()})
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.W.Write(append(data, '\n'))
+}
+
+// kvValue returns the value for the key at kv[i], tolerating a missing one.
+func kvValue(kv []interface{}, i int) interface{} {
+	if i+1 < len(kv) {
+		return kv[i+1]
+	}
+	return "MISSING"
+}
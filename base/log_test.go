@@ -0,0 +1,87 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+// withLogFlags sets -v and -vmodule for the duration of a test.
+func withLogFlags(t *testing.T, v int, vmodule string) {
+	oldV, oldModules := *VerboseLogging, *verboseModules
+	*VerboseLogging, *verboseModules = v, vmodule
+	t.Cleanup(func() { *VerboseLogging, *verboseModules = oldV, oldModules })
+}
+
+func TestModuleLoggerLevels(t *testing.T) {
+	withLogFlags(t, 1, "noisy=3,quiet=-1")
+	for _, test := range []struct {
+		module string
+		level  int
+		want   bool
+	}{
+		{"other", 1, true},
+		{"other", 2, false},
+		{"noisy", 3, true},
+		{"quiet", 0, false},
+	} {
+		if got := Module(test.module).Enabled(test.level); got != test.want {
+			t.Errorf("%s at level %d: enabled %v, want %v", test.module, test.level, got, test.want)
+		}
+	}
+}
+
+func TestJSONLogger(t *testing.T) {
+	withLogFlags(t, 2, "")
+	var buf bytes.Buffer
+	SetLogger(&JSONLogger{W: &buf})
+	defer SetLogger(StdLogger{})
+	m := Module("test")
+	m.V(1, "hello", "count", 3, "error", errors.New("oops"))
+	m.V(3, "too verbose")
+	V(1, "legacy %d", 7)
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("want 2 lines, got %q", buf.String())
+	}
+	var got map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &got); err != nil {
+		t.Fatal(err)
+	}
+	for k, want := range map[string]interface{}{"module": "test", "msg": "hello", "level": 1.0, "count": 3.0, "error": "oops"} {
+		if got[k] != want {
+			t.Errorf("field %q: want %v got %v", k, want, got[k])
+		}
+	}
+	if !strings.Contains(lines[1], `"msg":"legacy 7"`) {
+		t.Errorf("legacy V message not logged: %s", lines[1])
+	}
+}
+
+func TestStdLogger(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	StdLogger{}.Log(1, "test", "hello", "count", 3, "dangling")
+	if got, want := buf.String(), "test: hello count=3 dangling=MISSING\n"; !strings.HasSuffix(got, want) {
+		t.Errorf("want suffix %q, got %q", want, got)
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"golang.org/x/net/context"
+)
+
+// mergeInputBatch is the largest batch of packets mergeLoserTree pulls from
+// an input at once.
+const mergeInputBatch = 64
+
+// loserTree is a tournament tree over k sorted inputs.  Each internal node
+// holds the loser of the match played there, and tree[0] holds the overall
+// winner, so replacing the winner's head replays only the log2(k) matches on
+// its path to the root, with one comparison each.  A heap's sift-down needs
+// up to two comparisons per level, plus interface calls for container/heap.
+type loserTree struct {
+	tree  []int           // tree[0] is the winner, tree[1:] losers
+	heads []indexedPacket // Current packet of each input, nil once exhausted
+	less  func(a, b *indexedPacket) bool
+}
+
+// beats returns true if input a's head should be output before input b's.
+// Exhausted inputs lose to everything, and ties go to the lower index.
+func (t *loserTree) beats(a, b int) bool {
+	ha, hb := &t.heads[a], &t.heads[b]
+	switch {
+	case ha.Packet == nil:
+		return false
+	case hb.Packet == nil:
+		return true
+	case t.less(ha, hb):
+		return true
+	case t.less(hb, ha):
+		return false
+	}
+	return a < b
+}
+
+// init plays the full tournament.  Input i is the leaf at index len(heads)+i.
+func (t *loserTree) init() {
+	k := len(t.heads)
+	t.tree = make([]int, k)
+	winners := make([]int, 2*k)
+	for i := 0; i < k; i++ {
+		winners[k+i] = i
+	}
+	for n := k - 1; n > 0; n-- {
+		l, r := winners[2*n], winners[2*n+1]
+		if t.beats(l, r) {
+			winners[n], t.tree[n] = l, r
+		} else {
+			winners[n], t.tree[n] = r, l
+		}
+	}
+	t.tree[0] = winners[1]
+}
+
+// replay updates the tree after input i's head has changed.  i must be the
+// current winner.
+func (t *loserTree) replay(i int) {
+	for n := (len(t.heads) + i) / 2; n > 0; n /= 2 {
+		if t.beats(t.tree[n], i) {
+			t.tree[n], i = i, t.tree[n]
+		}
+	}
+	t.tree[0] = i
+}
+
+// mergeLoserTree merges 'in' to 'out', ordering packets by 'less'.  It pulls
+// packets from each input in batches, so it touches each input's channel
+// once per batch rather than once per packet, and picks packets with a loser
+// tree.  Output is written in batches, flushed whenever waiting on an input
+// would otherwise delay them.  ctx and cancellation of 'out' are checked after
+// each flush.  Only h's ordering, stats and error handling are used; its heap
+// is not.
+func mergeLoserTree(ctx context.Context, in []*PacketChan, out *PacketChan, h packetHeap) {
+	count := 0
+	defer func() {
+		baseLog.V(1, "merged streams", "streams", len(in), "packets", count)
+	}()
+	for i := range in {
+		defer in[i].Discard()
+	}
+	t := &loserTree{heads: make([]indexedPacket, len(in)), less: h.less}
+	bufs := make([][]*Packet, len(in))
+	pos := make([]int, len(in))
+	for i := range bufs {
+		bufs[i] = make([]*Packet, 0, mergeInputBatch)
+	}
+	batch := make([]*Packet, 0, mergeBatchSize)
+	flush := func() {
+		out.SendBatch(batch)
+		batch = batch[:0]
+	}
+	// pull refills input i's buffer and sets its head, returning an error if
+	// the merge should stop.
+	pull := func(i int) error {
+		var pkt *Packet
+		var ok bool
+		select {
+		case pkt, ok = <-in[i].Receive():
+		default:
+			flush()
+			select {
+			case pkt, ok = <-in[i].Receive():
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		if err := h.inputErr(in, i, !ok); err != nil {
+			return err
+		}
+		if !ok {
+			t.heads[i] = indexedPacket{i: i}
+			return nil
+		}
+		bufs[i] = in[i].receiveBuffered(append(bufs[i][:0], pkt))
+		pos[i] = 0
+		t.heads[i] = indexedPacket{Packet: pkt, i: i}
+		return nil
+	}
+	for i := range in {
+		if err := pull(i); err != nil {
+			out.Close(err)
+			return
+		}
+	}
+	t.init()
+	for {
+		w := t.tree[0]
+		head := t.heads[w].Packet
+		if head == nil {
+			break // All inputs are exhausted.
+		}
+		if len(batch) == 0 && (ContextDone(ctx) || out.canceled()) {
+			break
+		}
+		count++
+		h.stats.add(w)
+		if batch = append(batch, head); len(batch) == cap(batch) {
+			flush()
+		}
+		if pos[w]++; pos[w] < len(bufs[w]) {
+			t.heads[w].Packet = bufs[w][pos[w]]
+		} else if err := pull(w); err != nil {
+			flush()
+			out.Close(err)
+			return
+		}
+		t.replay(w)
+	}
+	flush()
+	out.Close(ctx.Err())
+}
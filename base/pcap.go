@@ -0,0 +1,280 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// PacketReader exposes a PacketChan as an io.Reader, producing a PCAP byte
+// stream on demand.  Only a single record is buffered at a time, so memory use
+// stays bounded no matter how large the underlying stream is.
+type PacketReader struct {
+	in  *PacketChan
+	buf bytes.Buffer
+	w   *pcapgo.Writer
+	err error
+}
+
+// PacketChanReader returns a PacketReader which reads from 'in', writing out
+// packets in PCAP format with the given link type.  The file header is
+// emitted on the first Read.  Callers which stop reading before EOF must
+// Discard 'in' themselves.
+func PacketChanReader(in *PacketChan, linkType layers.LinkType) *PacketReader {
+	r := &PacketReader{in: in}
+	r.w = pcapgo.NewWriter(&r.buf)
+	if err := r.w.WriteFileHeader(snapLen, linkType); err != nil {
+		r.err = fmt.Errorf("error writing file header: %v", err)
+	}
+	return r
+}
+
+// Read implements io.Reader.  It returns io.EOF once the underlying
+// PacketChan has closed cleanly, or the PacketChan's error if it closed with
+// one.
+func (r *PacketReader) Read(p []byte) (int, error) {
+	for r.buf.Len() == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		pkt, ok := <-r.in.Receive()
+		if !ok {
+			r.err = r.in.Err()
+			if r.err == nil {
+				r.err = io.EOF
+			}
+			continue
+		}
+		if err := r.w.WritePacket(pkt.CaptureInfo, pkt.Data); err != nil {
+			r.err = fmt.Errorf("error writing packet: %v", err)
+			r.in.Discard()
+		}
+	}
+	return r.buf.Read(p)
+}
+
+// Err returns the error which terminated the stream, if any.  A stream which
+// ended cleanly, or which has not yet ended, returns nil.
+func (r *PacketReader) Err() error {
+	if r.err == io.EOF {
+		return nil
+	}
+	return r.err
+}
+
+// PacketChanFromReader parses a PCAP or pcapng byte stream from 'r'
+// incrementally, sending each packet on the returned PacketChan.  The format
+// is detected from the stream's magic number.  For pcapng, each packet's
+// Meta.Interface is set from its interface description.  Reading from 'r'
+// only happens as fast as the consumer pulls packets, so a slow consumer
+// naturally applies backpressure to the underlying reader, and canceling the
+// returned channel stops reading.  The returned channel is closed with a
+// descriptive error if the stream is malformed or truncated.
+func PacketChanFromReader(r io.Reader) *PacketChan {
+	out := NewPacketChan(100)
+	go func() {
+		br := bufio.NewReader(r)
+		var next func() (*Packet, error)
+		magic, err := br.Peek(4)
+		if err == nil && binary.LittleEndian.Uint32(magic) == pcapngSectionHeader {
+			next, err = pcapngPackets(br)
+		} else {
+			next, err = pcapPackets(br)
+		}
+		if err != nil {
+			out.Close(fmt.Errorf("invalid pcap file header: %v", err))
+			return
+		}
+		count := 0
+		for !out.canceled() {
+			pkt, err := next()
+			switch {
+			case err == io.EOF:
+				baseLog.V(2, "read pcap stream", "packets", count)
+				out.Close(nil)
+				return
+			case err == io.ErrUnexpectedEOF:
+				out.Close(fmt.Errorf("pcap stream truncated after %d packets", count))
+				return
+			case err != nil:
+				out.Close(fmt.Errorf("error reading packet %d from pcap stream: %v", count, err))
+				return
+			}
+			count++
+			pkt.ToUTC()
+			out.Send(pkt)
+		}
+		out.Close(nil)
+	}()
+	return out
+}
+
+// pcapPackets returns a function reading successive packets from a classic
+// PCAP stream.
+func pcapPackets(r io.Reader) (func() (*Packet, error), error) {
+	pr, err := pcapgo.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return func() (*Packet, error) {
+		data, ci, err := pr.ReadPacketData()
+		if err != nil {
+			return nil, err
+		}
+		return &Packet{Data: data, CaptureInfo: ci}, nil
+	}, nil
+}
+
+// pcapngPackets returns a function reading successive packets from a pcapng
+// stream.  A stream with no interface descriptions, as PcapngWriter produces
+// for an empty result, returns io.EOF.
+func pcapngPackets(r io.Reader) (func() (*Packet, error), error) {
+	nr, err := pcapgo.NewNgReader(r, pcapgo.DefaultNgReaderOptions)
+	if err == io.EOF {
+		return func() (*Packet, error) { return nil, io.EOF }, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var names []string
+	return func() (*Packet, error) {
+		data, ci, err := nr.ReadPacketData()
+		if err != nil {
+			return nil, err
+		}
+		pkt := &Packet{Data: data, CaptureInfo: ci}
+		for i := len(names); i < nr.NInterfaces(); i++ {
+			iface, _ := nr.Interface(i)
+			names = append(names, iface.Name)
+		}
+		if ci.InterfaceIndex < len(names) {
+			pkt.Meta.Interface = names[ci.InterfaceIndex]
+		}
+		return pkt, nil
+	}, nil
+}
+
+// ReadPcap returns a PacketChan of all packets in the PCAP or pcapng file at
+// 'path', as PacketChanFromReader does.  The file is closed once the stream
+// ends or is canceled.
+func ReadPcap(path string) *PacketChan {
+	f, err := os.Open(path)
+	if err != nil {
+		out := NewPacketChan(0)
+		out.Close(err)
+		return out
+	}
+	in := PacketChanFromReader(f)
+	out := NewPacketChan(100)
+	go func() {
+		defer f.Close()
+		defer in.Discard()
+		for p := range in.Receive() {
+			out.Send(p)
+			if out.canceled() {
+				break
+			}
+		}
+		out.Close(in.Err())
+	}()
+	return out
+}
+
+// WritePCAPSnap writes all packets from 'in' to 'w' in PCAP format with the
+// given link type, storing at most snaplen bytes of each packet.  Truncated
+// records keep the packet's original length, so header-only exports can be
+// produced without modifying the packets themselves.  The file header
+// records snaplen; a snaplen of 0 means full packets, recorded as our usual
+// maximum.  It returns the first write error, or else in.Err().
+func WritePCAPSnap(w io.Writer, in *PacketChan, linkType layers.LinkType, snaplen int) error {
+	defer in.Discard()
+	headerSnap := uint32(snapLen)
+	if snaplen > 0 {
+		headerSnap = uint32(snaplen)
+	}
+	pw := pcapgo.NewWriter(w)
+	if err := pw.WriteFileHeader(headerSnap, linkType); err != nil {
+		return fmt.Errorf("error writing file header: %v", err)
+	}
+	for p := range in.Receive() {
+		data, ci := p.Data, p.CaptureInfo
+		if snaplen > 0 && len(data) > snaplen {
+			data = data[:snaplen]
+		}
+		ci.CaptureLength = len(data)
+		if err := pw.WritePacket(ci, data); err != nil {
+			return fmt.Errorf("error writing packet: %v", err)
+		}
+	}
+	return in.Err()
+}
+
+// SplitByTime writes packets from 'in' into a separate PCAP file per time
+// bucket (one per hour, say), based on each packet's timestamp.  newSink is
+// called with the start of each bucket as the first packet in that bucket
+// arrives, and each sink is closed as soon as a packet from a later bucket
+// arrives, or when the stream ends.  Packets are expected in time order; a
+// packet from an earlier bucket than the current one is written to the current
+// sink.  The first error creating, writing, or closing a sink is returned,
+// otherwise in.Err().
+func SplitByTime(in *PacketChan, bucket time.Duration, newSink func(start time.Time) (io.WriteCloser, error)) (err error) {
+	defer in.Discard()
+	if bucket <= 0 {
+		return fmt.Errorf("invalid bucket size %v", bucket)
+	}
+	var sink io.WriteCloser
+	var w *pcapgo.Writer
+	var end time.Time
+	defer func() {
+		if sink != nil {
+			if cerr := sink.Close(); err == nil && cerr != nil {
+				err = fmt.Errorf("error closing sink: %v", cerr)
+			}
+		}
+	}()
+	for p := range in.Receive() {
+		if sink == nil || !p.Timestamp.Before(end) {
+			if sink != nil {
+				s := sink
+				sink = nil
+				if err := s.Close(); err != nil {
+					return fmt.Errorf("error closing sink: %v", err)
+				}
+			}
+			start := p.Timestamp.Truncate(bucket)
+			if sink, err = newSink(start); err != nil {
+				sink = nil
+				return fmt.Errorf("error creating sink for %v: %v", start, err)
+			}
+			end = start.Add(bucket)
+			w = pcapgo.NewWriter(sink)
+			if err := w.WriteFileHeader(snapLen, layers.LinkTypeEthernet); err != nil {
+				return fmt.Errorf("error writing file header: %v", err)
+			}
+		}
+		if err := w.WritePacket(p.CaptureInfo, p.Data); err != nil {
+			return fmt.Errorf("error writing packet: %v", err)
+		}
+	}
+	return in.Err()
+}
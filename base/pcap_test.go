@@ -0,0 +1,211 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+func TestPacketChanReader(t *testing.T) {
+	packets := testPacketData(t)
+	want := NewPacketChan(100)
+	got := NewPacketChan(100)
+	for _, p := range packets {
+		want.Send(p)
+		got.Send(p)
+	}
+	want.Close(nil)
+	got.Close(nil)
+	var wantBuf bytes.Buffer
+	if err := PacketsToFile(want, &wantBuf, Limit{}); err != nil {
+		t.Fatal(err)
+	}
+	r := PacketChanReader(got, layers.LinkTypeEthernet)
+	gotBytes, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(wantBuf.Bytes(), gotBytes) {
+		t.Errorf("wrong pcap stream:\nwant: %v\ngot:  %v", wantBuf.Bytes(), gotBytes)
+	}
+	if err := r.Err(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestPacketChanReaderError(t *testing.T) {
+	pc := NewPacketChan(1)
+	wantErr := errors.New("bad blockfile")
+	pc.Close(wantErr)
+	r := PacketChanReader(pc, layers.LinkTypeEthernet)
+	if _, err := ioutil.ReadAll(r); err != wantErr {
+		t.Errorf("wrong read error: want %v got %v", wantErr, err)
+	}
+	if err := r.Err(); err != wantErr {
+		t.Errorf("wrong Err(): want %v got %v", wantErr, err)
+	}
+}
+
+func TestPacketChanFromReader(t *testing.T) {
+	packets := testPacketData(t)
+	in := NewPacketChan(100)
+	for _, p := range packets {
+		in.Send(p)
+	}
+	in.Close(nil)
+	data, err := ioutil.ReadAll(PacketChanReader(in, layers.LinkTypeEthernet))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := PacketChanFromReader(bytes.NewReader(data))
+	i := 0
+	for p := range out.Receive() {
+		if i >= len(packets) {
+			t.Fatalf("too many packets: %v", p)
+		}
+		want := packets[i]
+		// PCAP only stores microsecond timestamps.
+		wantTS := want.Timestamp.Truncate(time.Microsecond)
+		if !bytes.Equal(p.Data, want.Data) || !p.Timestamp.Equal(wantTS) || p.Length != want.Length {
+			t.Errorf("wrong packet %d:\nwant: %v\ngot:  %v", i, want, p)
+		}
+		i++
+	}
+	if i != len(packets) {
+		t.Errorf("wrong packet count: want %d got %d", len(packets), i)
+	}
+	if err := out.Err(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	for _, size := range []int{10, len(data) - 1} {
+		out := PacketChanFromReader(bytes.NewReader(data[:size]))
+		for _ = range out.Receive() {
+		}
+		if out.Err() == nil {
+			t.Errorf("expected error reading %d of %d bytes", size, len(data))
+		}
+	}
+}
+
+func TestWritePCAPSnap(t *testing.T) {
+	packets := testPacketData(t)
+	for _, snaplen := range []int{0, 2, 3, 10} {
+		var buf bytes.Buffer
+		if err := WritePCAPSnap(&buf, packetChanOf(nil, packets...), layers.LinkTypeEthernet, snaplen); err != nil {
+			t.Fatalf("snaplen %d: %v", snaplen, err)
+		}
+		r, err := pcapgo.NewReader(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("snaplen %d: %v", snaplen, err)
+		}
+		if want := uint32(snaplen); snaplen > 0 && r.Snaplen() != want {
+			t.Errorf("snaplen %d: header snaplen %d", snaplen, r.Snaplen())
+		}
+		for i, want := range packets {
+			data, ci, err := r.ReadPacketData()
+			if err != nil {
+				t.Fatalf("snaplen %d packet %d: %v", snaplen, i, err)
+			}
+			wantData := want.Data
+			if snaplen > 0 && len(wantData) > snaplen {
+				wantData = wantData[:snaplen]
+			}
+			if !bytes.Equal(data, wantData) || ci.CaptureLength != len(wantData) || ci.Length != want.Length {
+				t.Errorf("snaplen %d packet %d: got %v %+v", snaplen, i, data, ci)
+			}
+		}
+		if len(packets[0].Data) != 3 {
+			t.Fatalf("snaplen %d: input packet modified", snaplen)
+		}
+	}
+	wantErr := errors.New("bad blockfile")
+	if err := WritePCAPSnap(ioutil.Discard, packetChanOf(wantErr), layers.LinkTypeEthernet, 0); err != wantErr {
+		t.Errorf("wrong error: want %v got %v", wantErr, err)
+	}
+}
+
+type closeBuffer struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (c *closeBuffer) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestSplitByTime(t *testing.T) {
+	var packets []*Packet
+	for _, secs := range []int64{3600, 3700, 7199, 7200, 18000} {
+		p := &Packet{Data: []byte{1, 2, 3}}
+		p.Timestamp = time.Unix(secs, 0).UTC()
+		p.CaptureLength, p.Length = 3, 3
+		packets = append(packets, p)
+	}
+	var starts []time.Time
+	var sinks []*closeBuffer
+	err := SplitByTime(packetChanOf(nil, packets...), time.Hour, func(start time.Time) (io.WriteCloser, error) {
+		for _, s := range sinks {
+			if !s.closed {
+				t.Errorf("sink for %v opened before previous sink closed", start)
+			}
+		}
+		starts = append(starts, start)
+		sinks = append(sinks, &closeBuffer{})
+		return sinks[len(sinks)-1], nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantStarts := []time.Time{time.Unix(3600, 0), time.Unix(7200, 0), time.Unix(18000, 0)}
+	if len(starts) != len(wantStarts) {
+		t.Fatalf("wrong buckets: want %v got %v", wantStarts, starts)
+	}
+	for i, want := range []int{3, 1, 1} {
+		if !starts[i].Equal(wantStarts[i]) {
+			t.Errorf("bucket %d: wrong start: want %v got %v", i, wantStarts[i], starts[i])
+		}
+		if !sinks[i].closed {
+			t.Errorf("bucket %d: sink not closed", i)
+		}
+		got := 0
+		for p := range PacketChanFromReader(&sinks[i].Buffer).Receive() {
+			if p.Timestamp.Before(starts[i]) || !p.Timestamp.Before(starts[i].Add(time.Hour)) {
+				t.Errorf("bucket %d: packet at %v", i, p.Timestamp)
+			}
+			got++
+		}
+		if got != want {
+			t.Errorf("bucket %d: wrong packet count: want %d got %d", i, want, got)
+		}
+	}
+
+	wantErr := errors.New("disk full")
+	err = SplitByTime(packetChanOf(nil, packets...), time.Hour, func(time.Time) (io.WriteCloser, error) {
+		return nil, wantErr
+	})
+	if err == nil {
+		t.Error("sink creation error not returned")
+	}
+}
@@ -0,0 +1,220 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"runtime"
+
+	"github.com/google/gopacket/layers"
+)
+
+// Version is stenographer's version, recorded in pcapng section headers.  Set
+// it at build time with
+//
+//	-ldflags "-X github.com/google/stenographer/base.Version=1.2.3"
+var Version = "unknown"
+
+// Pcapng block types and option codes we use.  See
+// https://www.ietf.org/archive/id/draft-tuexen-opsawg-pcapng-05.html
+const (
+	pcapngSectionHeader        = 0x0a0d0d0a
+	pcapngInterfaceDescription = 0x00000001
+	pcapngEnhancedPacket       = 0x00000006
+	pcapngByteOrderMagic       = 0x1a2b3c4d
+
+	pcapngOptEnd      = 0
+	pcapngOptComment  = 1
+	pcapngOptOS       = 3 // Section header shb_os
+	pcapngOptUserAppl = 4 // Section header shb_userappl
+	pcapngOptIfName   = 2 // Interface description if_name
+	pcapngOptTSResol  = 9 // Interface description if_tsresol
+)
+
+// PcapngSection describes where a pcapng file's packets came from.  It's
+// recorded in the file's section header block.
+type PcapngSection struct {
+	Hostname    string // Host which captured the packets, if known
+	Application string // Capturing application, defaults to "stenographer <Version>"
+}
+
+// PcapngWriter writes packets in pcapng format.  Unlike classic PCAP, pcapng
+// records which interface captured each packet: the writer emits an interface
+// description block for each distinct Packet.Meta.Interface (and
+// Packet.Meta.Provenance) the first time it sees one, and tags each packet
+// with that interface's ID.  Provenance is written as comments on the
+// interface.  Timestamps are written with nanosecond resolution.
+type PcapngWriter struct {
+	w      io.Writer
+	ifaces map[pcapngInterface]uint32
+	buf    []byte
+	n      int // Bytes written so far
+}
+
+// pcapngInterface is what distinguishes the interfaces of a pcapng file.
+type pcapngInterface struct {
+	name string
+	prov Provenance
+}
+
+// NewPcapngWriter returns a PcapngWriter writing to w, having written the
+// section header block.
+func NewPcapngWriter(w io.Writer, section PcapngSection) (*PcapngWriter, error) {
+	p := &PcapngWriter{w: w, ifaces: map[pcapngInterface]uint32{}}
+	if section.Application == "" {
+		section.Application = "stenographer " + Version
+	}
+	b := p.start(pcapngSectionHeader)
+	b = appendUint32(b, pcapngByteOrderMagic)
+	b = appendUint16(b, 1) // Major version
+	b = appendUint16(b, 0) // Minor version
+	b = appendUint32(b, 0xffffffff)
+	b = appendUint32(b, 0xffffffff) // Section length unknown
+	if section.Hostname != "" {
+		b = appendPcapngOption(b, pcapngOptComment, []byte("captured on host "+section.Hostname))
+	}
+	b = appendPcapngOption(b, pcapngOptOS, []byte(runtime.GOOS))
+	b = appendPcapngOption(b, pcapngOptUserAppl, []byte(section.Application))
+	b = appendPcapngOption(b, pcapngOptEnd, nil)
+	if err := p.finish(b); err != nil {
+		return nil, fmt.Errorf("error writing section header: %v", err)
+	}
+	return p, nil
+}
+
+// start begins a new block of the given type in p.buf, leaving room for its
+// length.
+func (p *PcapngWriter) start(blockType uint32) []byte {
+	b := appendUint32(p.buf[:0], blockType)
+	return appendUint32(b, 0)
+}
+
+// finish fills in the length of the block in b and writes it out.
+func (p *PcapngWriter) finish(b []byte) error {
+	size := uint32(len(b) + 4)
+	binary.LittleEndian.PutUint32(b[4:], size)
+	b = appendUint32(b, size)
+	p.buf = b
+	n, err := p.w.Write(b)
+	p.n += n
+	return err
+}
+
+// iface returns the ID of the interface a packet with the given metadata
+// came from, writing its description block if it's new.
+func (p *PcapngWriter) iface(meta PacketMetadata) (uint32, error) {
+	key := pcapngInterface{name: meta.Interface}
+	if meta.Provenance != nil {
+		key.prov = *meta.Provenance
+	}
+	if id, ok := p.ifaces[key]; ok {
+		return id, nil
+	}
+	id := uint32(len(p.ifaces))
+	b := p.start(pcapngInterfaceDescription)
+	b = appendUint16(b, uint16(layers.LinkTypeEthernet))
+	b = appendUint16(b, 0) // Reserved
+	b = appendUint32(b, snapLen)
+	if key.name != "" {
+		b = appendPcapngOption(b, pcapngOptIfName, []byte(key.name))
+	}
+	for _, c := range []struct{ label, value string }{
+		{"captured on host ", key.prov.Host},
+		{"captured on interface ", key.prov.Interface},
+		{"captured by ", key.prov.Version},
+		{"capture filter (compiled BPF) ", key.prov.Filter},
+	} {
+		if c.value != "" {
+			b = appendPcapngOption(b, pcapngOptComment, []byte(c.label+c.value))
+		}
+	}
+	b = appendPcapngOption(b, pcapngOptTSResol, []byte{9}) // Nanoseconds
+	b = appendPcapngOption(b, pcapngOptEnd, nil)
+	if err := p.finish(b); err != nil {
+		return 0, fmt.Errorf("error writing interface description: %v", err)
+	}
+	p.ifaces[key] = id
+	return id, nil
+}
+
+// WritePacket writes a single packet, returning the number of bytes written,
+// including any new interface description.
+func (p *PcapngWriter) WritePacket(pkt *Packet) (int, error) {
+	start := p.n
+	id, err := p.iface(pkt.Meta)
+	if err != nil {
+		return 0, err
+	}
+	ts := uint64(pkt.Timestamp.UnixNano())
+	b := p.start(pcapngEnhancedPacket)
+	b = appendUint32(b, id)
+	b = appendUint32(b, uint32(ts>>32))
+	b = appendUint32(b, uint32(ts))
+	b = appendUint32(b, uint32(len(pkt.Data)))
+	b = appendUint32(b, uint32(pkt.Length))
+	b = append(b, pkt.Data...)
+	b = append(b, pcapngPadding[:pad4(len(pkt.Data))]...)
+	if err := p.finish(b); err != nil {
+		return 0, fmt.Errorf("error writing packet: %v", err)
+	}
+	return p.n - start, nil
+}
+
+// PacketsToPcapng acts like PacketsToFile, but writes pcapng with the given
+// section information.
+func PacketsToPcapng(in *PacketChan, out io.Writer, limit Limit, section PcapngSection) error {
+	defer in.Discard()
+	w, err := NewPcapngWriter(out, section)
+	if err != nil {
+		return err
+	}
+	if limit.ShouldStopAfter(Limit{Bytes: int64(w.n)}) {
+		return nil
+	}
+	for p := range in.Receive() {
+		p.Truncate(snapLen)
+		n, err := w.WritePacket(p)
+		if err != nil {
+			return err
+		}
+		p.Release()
+		if limit.ShouldStopAfter(Limit{Bytes: int64(n), Packets: 1}) {
+			return nil
+		}
+	}
+	return in.Err()
+}
+
+// pcapngPadding pads block contents to a multiple of 4 bytes.
+var pcapngPadding [3]byte
+
+func pad4(n int) int { return (4 - n%4) % 4 }
+
+func appendUint16(b []byte, x uint16) []byte {
+	return append(b, byte(x), byte(x>>8))
+}
+
+func appendUint32(b []byte, x uint32) []byte {
+	return append(b, byte(x), byte(x>>8), byte(x>>16), byte(x>>24))
+}
+
+func appendPcapngOption(b []byte, code uint16, value []byte) []byte {
+	b = appendUint16(b, code)
+	b = appendUint16(b, uint16(len(value)))
+	b = append(b, value...)
+	return append(b, pcapngPadding[:pad4(len(value))]...)
+}
@@ -0,0 +1,149 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/pcapgo"
+)
+
+func TestPacketsToPcapng(t *testing.T) {
+	mk := func(iface string, nanos int64, data ...byte) *Packet {
+		p := &Packet{Data: data, Meta: PacketMetadata{Interface: iface}}
+		p.CaptureInfo = gopacket.CaptureInfo{Timestamp: time.Unix(1000, nanos), CaptureLength: len(data), Length: 100}
+		return p
+	}
+	packets := []*Packet{mk("eth0", 1, 1, 2, 3), mk("eth1", 2, 4), mk("eth0", 3, 5, 6, 7, 8, 9)}
+	var buf bytes.Buffer
+	if err := PacketsToPcapng(packetChanOf(nil, packets...), &buf, Limit{}, PcapngSection{Hostname: "steno1"}); err != nil {
+		t.Fatal(err)
+	}
+	r, err := pcapgo.NewNgReader(&buf, pcapgo.DefaultNgReaderOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info := r.SectionInfo(); info.Application != "stenographer "+Version || info.Comment != "captured on host steno1" {
+		t.Errorf("wrong section info %+v", info)
+	}
+	wantIfaces := []string{"eth0", "eth1", "eth0"}
+	for i, want := range packets {
+		data, ci, err := r.ReadPacketData()
+		if err != nil {
+			t.Fatalf("packet %d: %v", i, err)
+		}
+		if !bytes.Equal(data, want.Data) || !ci.Timestamp.Equal(want.Timestamp) || ci.Length != 100 {
+			t.Errorf("packet %d: got %v %+v", i, data, ci)
+		}
+		if iface, err := r.Interface(ci.InterfaceIndex); err != nil || iface.Name != wantIfaces[i] {
+			t.Errorf("packet %d: wrong interface %+v, %v", i, iface, err)
+		}
+	}
+	if _, _, err := r.ReadPacketData(); err != io.EOF {
+		t.Errorf("expected EOF, got %v", err)
+	}
+}
+
+func TestPcapngProvenance(t *testing.T) {
+	prov := &Provenance{Host: "sensor1", Interface: "eth3", Version: "stenographer 1.2.3", Filter: "0123abcd"}
+	var packets []*Packet
+	for i, p := range []*Provenance{prov, nil, {Host: "sensor1", Interface: "eth3", Version: "stenographer 1.2.3", Filter: "0123abcd"}} {
+		pkt := &Packet{Data: []byte{byte(i)}, Meta: PacketMetadata{Interface: "eth0", Provenance: p}}
+		pkt.CaptureInfo = gopacket.CaptureInfo{Timestamp: time.Unix(1000, int64(i)), CaptureLength: 1, Length: 1}
+		packets = append(packets, pkt)
+	}
+	var buf bytes.Buffer
+	if err := PacketsToPcapng(packetChanOf(nil, packets...), &buf, Limit{}, PcapngSection{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"captured on host sensor1", "captured on interface eth3", "captured by stenographer 1.2.3", "capture filter (compiled BPF) 0123abcd"} {
+		if n := bytes.Count(buf.Bytes(), []byte(want)); n != 1 {
+			t.Errorf("got %d comments %q, want 1", n, want)
+		}
+	}
+	r, err := pcapgo.NewNgReader(&buf, pcapgo.DefaultNgReaderOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Packets with the same provenance share an interface.
+	for i, want := range []int{0, 1, 0} {
+		if _, ci, err := r.ReadPacketData(); err != nil || ci.InterfaceIndex != want {
+			t.Errorf("packet %d: got interface %d, %v, want %d", i, ci.InterfaceIndex, err, want)
+		}
+	}
+}
+
+func TestReadPcap(t *testing.T) {
+	dir := t.TempDir()
+	packets := testPacketData(t)
+	for i, p := range packets {
+		p.Meta.Interface = []string{"eth0", "eth1"}[i%2]
+	}
+	for _, test := range []struct {
+		name   string
+		write  func(*PacketChan, io.Writer) error
+		ifaces bool
+	}{
+		{"pcap", func(in *PacketChan, w io.Writer) error { return PacketsToFileNanos(in, w, Limit{}) }, false},
+		{"pcapng", func(in *PacketChan, w io.Writer) error {
+			return PacketsToPcapng(in, w, Limit{}, PcapngSection{})
+		}, true},
+	} {
+		for _, n := range []int{0, len(packets)} {
+			var buf bytes.Buffer
+			// Copy packets, since writing releases them.
+			var in []*Packet
+			for _, p := range packets[:n] {
+				c := *p
+				in = append(in, &c)
+			}
+			if err := test.write(packetChanOf(nil, in...), &buf); err != nil {
+				t.Fatal(err)
+			}
+			path := filepath.Join(dir, test.name)
+			if err := ioutil.WriteFile(path, buf.Bytes(), 0600); err != nil {
+				t.Fatal(err)
+			}
+			out := ReadPcap(path)
+			i := 0
+			for p := range out.Receive() {
+				want := packets[i]
+				if !bytes.Equal(p.Data, want.Data) || !p.Timestamp.Equal(want.Timestamp) {
+					t.Errorf("%s packet %d: want %v got %v", test.name, i, want, p)
+				}
+				if test.ifaces && p.Meta.Interface != want.Meta.Interface {
+					t.Errorf("%s packet %d: wrong interface %q", test.name, i, p.Meta.Interface)
+				}
+				i++
+			}
+			if i != n || out.Err() != nil {
+				t.Errorf("%s: read %d of %d packets, error %v", test.name, i, n, out.Err())
+			}
+		}
+	}
+
+	out := ReadPcap(filepath.Join(dir, "missing"))
+	for _ = range out.Receive() {
+	}
+	if out.Err() == nil {
+		t.Error("expected error reading missing file")
+	}
+}
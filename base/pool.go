@@ -0,0 +1,115 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"math/bits"
+	"sync"
+	"sync/atomic"
+
+	"github.com/google/gopacket"
+)
+
+// Counters for PoolStats.
+var poolGets, poolPuts, poolMisses uint64
+
+var packetPool = sync.Pool{
+	New: func() interface{} {
+		atomic.AddUint64(&poolMisses, 1)
+		return &Packet{}
+	},
+}
+
+// GetPacket returns an empty Packet from a shared pool, allocating one only if
+// the pool is empty.  Packets from GetPacket should be given back with
+// Release once nothing references them anymore.
+func GetPacket() *Packet {
+	atomic.AddUint64(&poolGets, 1)
+	p := packetPool.Get().(*Packet)
+	p.fromPool = true
+	return p
+}
+
+// NewPooledPacket returns a packet from GetPacket holding the given data and
+// capture info.  data must come from GetBuffer, and will be returned to the
+// buffer pool by Release.
+func NewPooledPacket(data []byte, ci gopacket.CaptureInfo) *Packet {
+	p := GetPacket()
+	p.Data, p.CaptureInfo, p.pooledData = data, ci, true
+	return p
+}
+
+// Release resets the packet and returns it to the pool used by GetPacket,
+// along with its Data if it came from NewPooledPacket.  Neither the packet nor
+// its Data may be used after calling Release.  Release does nothing for
+// packets which didn't come from the pool, since their Data often points into
+// a larger buffer the packet doesn't own.
+func (p *Packet) Release() {
+	if !p.fromPool {
+		return
+	}
+	atomic.AddUint64(&poolPuts, 1)
+	if p.pooledData {
+		PutBuffer(p.Data)
+	}
+	*p = Packet{}
+	packetPool.Put(p)
+}
+
+// Buffers from GetBuffer come in power-of-two size classes, up to
+// 1<<maxBufferClass bytes.  That's large enough for any packet we capture.
+const maxBufferClass = 17
+
+var bufferPools [maxBufferClass + 1]sync.Pool
+
+// bufferClass returns the size class for a buffer of the given size.
+func bufferClass(size int) int {
+	if size <= 1 {
+		return 0
+	}
+	return bits.Len(uint(size - 1))
+}
+
+// GetBuffer returns a byte slice of the given length, reusing one returned by
+// PutBuffer if possible.  Its contents are undefined.
+func GetBuffer(size int) []byte {
+	class := bufferClass(size)
+	if class > maxBufferClass {
+		return make([]byte, size)
+	}
+	if b, ok := bufferPools[class].Get().(*[]byte); ok {
+		return (*b)[:size]
+	}
+	return make([]byte, size, 1<<uint(class))
+}
+
+// PutBuffer returns a buffer from GetBuffer to the pool.  The buffer must not
+// be used afterwards.  Buffers which didn't come from GetBuffer are ignored.
+func PutBuffer(b []byte) {
+	class := bufferClass(cap(b))
+	if class > maxBufferClass || cap(b) != 1<<uint(class) {
+		return
+	}
+	b = b[:0]
+	bufferPools[class].Put(&b)
+}
+
+// PoolStats returns the number of GetPacket calls, Release calls, and gets
+// which had to allocate a new packet because the pool was empty.  A high miss
+// ratio means pooling isn't helping, usually because packets aren't being
+// released.
+func PoolStats() (gets, puts, misses uint64) {
+	return atomic.LoadUint64(&poolGets), atomic.LoadUint64(&poolPuts), atomic.LoadUint64(&poolMisses)
+}
@@ -0,0 +1,75 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+)
+
+func TestPacketPool(t *testing.T) {
+	gets, puts, misses := PoolStats()
+	p := GetPacket()
+	p.Data = append(p.Data, 1, 2, 3)
+	p.Timestamp = time.Unix(1, 0)
+	p.SetTag("k", "v")
+	p.Release()
+	if p.Data != nil || !p.Timestamp.IsZero() || p.Tags != nil {
+		t.Errorf("released packet not reset: %+v", p)
+	}
+	GetPacket().Release()
+	g, u, m := PoolStats()
+	if g-gets != 2 || u-puts != 2 {
+		t.Errorf("wrong counts: %d gets, %d puts", g-gets, u-puts)
+	}
+	if m-misses > 2 {
+		t.Errorf("too many misses: %d", m-misses)
+	}
+}
+
+func TestBufferPool(t *testing.T) {
+	for _, size := range []int{0, 1, 3, 64, 1500, 65536, 1 << 20} {
+		b := GetBuffer(size)
+		if len(b) != size {
+			t.Errorf("GetBuffer(%d) returned %d bytes", size, len(b))
+		}
+		PutBuffer(b)
+	}
+	PutBuffer(make([]byte, 100)) // not from GetBuffer, must be ignored
+	if b := GetBuffer(100); len(b) != 100 || cap(b) != 128 {
+		t.Errorf("wrong buffer: len %d cap %d", len(b), cap(b))
+	}
+
+	p := NewPooledPacket(GetBuffer(10), gopacket.CaptureInfo{CaptureLength: 10, Length: 10})
+	p.Release()
+	if p.Data != nil || p.fromPool || p.pooledData {
+		t.Errorf("released packet not reset: %+v", p)
+	}
+	// Releasing packets which aren't from the pool must leave them alone.
+	q := &Packet{Data: []byte{1, 2, 3}}
+	q.Release()
+	if len(q.Data) != 3 {
+		t.Error("non-pooled packet was released")
+	}
+}
+
+func BenchmarkPooledPacket(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		NewPooledPacket(GetBuffer(1500), gopacket.CaptureInfo{}).Release()
+	}
+}
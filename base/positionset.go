@@ -0,0 +1,392 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"math/bits"
+	"sort"
+)
+
+// PositionSet is a compressed set of positions, using the same layout as
+// roaring bitmaps: positions are grouped by their high bits into chunks of
+// 65536, and each chunk is stored as either a sorted array of its low 16 bits
+// or, once it holds more than arrayMaxSize positions, as a bitmap.  Broad
+// queries match millions of positions, and combining PositionSets modifies
+// them in place chunk by chunk instead of building a new Positions slice for
+// each Union or Intersect.
+//
+// The zero value is an empty set.  Like Positions, a PositionSet may instead
+// represent all positions; see IsAll.
+type PositionSet struct {
+	all        bool
+	keys       []int64 // High bits of each chunk, sorted
+	containers []*posContainer
+}
+
+// arrayMaxSize is the largest number of positions in an array container.  At
+// this size, the array uses as much memory as a bitmap.
+const arrayMaxSize = 4096
+
+// posContainer holds the low 16 bits of all positions in a single chunk.
+type posContainer struct {
+	array  []uint16 // Sorted, used if bitmap is nil
+	bitmap []uint64 // 1024 words, if non-nil
+	n      int      // Number of positions
+}
+
+// NewPositionSet returns a PositionSet containing the given positions, which
+// must be sorted.  AllPositions produces a set with IsAll true.
+func NewPositionSet(p Positions) *PositionSet {
+	s := &PositionSet{}
+	if p.IsAllPositions() {
+		s.all = true
+		return s
+	}
+	for _, pos := range p {
+		key := pos >> 16
+		if n := len(s.keys); n == 0 || s.keys[n-1] != key {
+			s.keys = append(s.keys, key)
+			s.containers = append(s.containers, &posContainer{})
+		}
+		c := s.containers[len(s.containers)-1]
+		if c.bitmap == nil && c.n == arrayMaxSize {
+			c.toBitmap()
+		}
+		if c.bitmap != nil {
+			c.bitmap[uint16(pos)>>6] |= 1 << (pos & 63)
+		} else {
+			c.array = append(c.array, uint16(pos))
+		}
+		c.n++
+	}
+	return s
+}
+
+// IsAll returns true if the set represents all positions.
+func (s *PositionSet) IsAll() bool { return s.all }
+
+// Len returns the number of positions in the set, or -1 if IsAll.
+func (s *PositionSet) Len() int {
+	if s.all {
+		return -1
+	}
+	n := 0
+	for _, c := range s.containers {
+		n += c.n
+	}
+	return n
+}
+
+// find returns the index of the chunk with the given key, and whether it
+// exists.  If it doesn't, the index is where it would be inserted.
+func (s *PositionSet) find(key int64) (int, bool) {
+	i := sort.Search(len(s.keys), func(i int) bool { return s.keys[i] >= key })
+	return i, i < len(s.keys) && s.keys[i] == key
+}
+
+// Contains returns true if pos is in the set.
+func (s *PositionSet) Contains(pos int64) bool {
+	if s.all {
+		return true
+	}
+	i, ok := s.find(pos >> 16)
+	return ok && s.containers[i].contains(uint16(pos))
+}
+
+// Add adds pos to the set.
+func (s *PositionSet) Add(pos int64) {
+	if s.all {
+		return
+	}
+	i, ok := s.find(pos >> 16)
+	if !ok {
+		s.keys = append(s.keys, 0)
+		copy(s.keys[i+1:], s.keys[i:])
+		s.keys[i] = pos >> 16
+		s.containers = append(s.containers, nil)
+		copy(s.containers[i+1:], s.containers[i:])
+		s.containers[i] = &posContainer{}
+	}
+	s.containers[i].add(uint16(pos))
+}
+
+// Union adds all positions in o to s.  o is not modified.
+func (s *PositionSet) Union(o *PositionSet) {
+	switch {
+	case s.all:
+		return
+	case o.all:
+		*s = PositionSet{all: true}
+		return
+	}
+	keys := make([]int64, 0, len(s.keys)+len(o.keys))
+	containers := make([]*posContainer, 0, cap(keys))
+	i, j := 0, 0
+	for i < len(s.keys) || j < len(o.keys) {
+		switch {
+		case j == len(o.keys) || i < len(s.keys) && s.keys[i] < o.keys[j]:
+			keys, containers = append(keys, s.keys[i]), append(containers, s.containers[i])
+			i++
+		case i == len(s.keys) || o.keys[j] < s.keys[i]:
+			keys, containers = append(keys, o.keys[j]), append(containers, o.containers[j].clone())
+			j++
+		default:
+			s.containers[i].union(o.containers[j])
+			keys, containers = append(keys, s.keys[i]), append(containers, s.containers[i])
+			i++
+			j++
+		}
+	}
+	s.keys, s.containers = keys, containers
+}
+
+// Intersect removes all positions from s which aren't in o.  o is not
+// modified.
+func (s *PositionSet) Intersect(o *PositionSet) {
+	switch {
+	case o.all:
+		return
+	case s.all:
+		*s = PositionSet{}
+		s.Union(o)
+		return
+	}
+	keys, containers := s.keys[:0], s.containers[:0]
+	for i, key := range s.keys {
+		j, ok := o.find(key)
+		if !ok {
+			continue
+		}
+		c := s.containers[i]
+		if c.intersect(o.containers[j]); c.n > 0 {
+			keys, containers = append(keys, key), append(containers, c)
+		}
+	}
+	s.keys, s.containers = keys, containers
+}
+
+// Difference removes all positions in o from s.  o is not modified.  As with
+// Positions.SubtractMany, we can't represent "all positions except these", so
+// if s IsAll it's left unchanged.
+func (s *PositionSet) Difference(o *PositionSet) {
+	switch {
+	case s.all:
+		return
+	case o.all:
+		*s = PositionSet{}
+		return
+	}
+	keys, containers := s.keys[:0], s.containers[:0]
+	for i, key := range s.keys {
+		c := s.containers[i]
+		if j, ok := o.find(key); ok {
+			c.difference(o.containers[j])
+		}
+		if c.n > 0 {
+			keys, containers = append(keys, key), append(containers, c)
+		}
+	}
+	s.keys, s.containers = keys, containers
+}
+
+// Positions returns the set's contents as sorted Positions.
+func (s *PositionSet) Positions() Positions {
+	if s.all {
+		return AllPositions
+	}
+	out := make(Positions, 0, s.Len())
+	for i, c := range s.containers {
+		out = c.appendTo(out, s.keys[i]<<16)
+	}
+	return out
+}
+
+func (c *posContainer) contains(x uint16) bool {
+	if c.bitmap != nil {
+		return c.bitmap[x>>6]&(1<<(x&63)) != 0
+	}
+	i := sort.Search(len(c.array), func(i int) bool { return c.array[i] >= x })
+	return i < len(c.array) && c.array[i] == x
+}
+
+func (c *posContainer) add(x uint16) {
+	if c.bitmap != nil {
+		if word, bit := &c.bitmap[x>>6], uint64(1)<<(x&63); *word&bit == 0 {
+			*word |= bit
+			c.n++
+		}
+		return
+	}
+	i := sort.Search(len(c.array), func(i int) bool { return c.array[i] >= x })
+	if i < len(c.array) && c.array[i] == x {
+		return
+	}
+	if c.n == arrayMaxSize {
+		c.toBitmap()
+		c.add(x)
+		return
+	}
+	c.array = append(c.array, 0)
+	copy(c.array[i+1:], c.array[i:])
+	c.array[i] = x
+	c.n++
+}
+
+func (c *posContainer) clone() *posContainer {
+	return &posContainer{
+		array:  append([]uint16(nil), c.array...),
+		bitmap: append([]uint64(nil), c.bitmap...),
+		n:      c.n,
+	}
+}
+
+func (c *posContainer) toBitmap() {
+	if c.bitmap != nil {
+		return
+	}
+	c.bitmap = make([]uint64, 1024)
+	for _, x := range c.array {
+		c.bitmap[x>>6] |= 1 << (x & 63)
+	}
+	c.array = nil
+}
+
+// recount updates n from the bitmap, switching to an array if it's become
+// small enough.
+func (c *posContainer) recount() {
+	c.n = 0
+	for _, w := range c.bitmap {
+		c.n += bits.OnesCount64(w)
+	}
+	if c.n <= arrayMaxSize {
+		c.array = c.appendLow(make([]uint16, 0, c.n))
+		c.bitmap = nil
+	}
+}
+
+// appendLow appends the low bits of each of the container's positions to out.
+func (c *posContainer) appendLow(out []uint16) []uint16 {
+	if c.bitmap == nil {
+		return append(out, c.array...)
+	}
+	for i, w := range c.bitmap {
+		for w != 0 {
+			out = append(out, uint16(i<<6+bits.TrailingZeros64(w)))
+			w &= w - 1
+		}
+	}
+	return out
+}
+
+// appendTo appends each of the container's positions, offset by high, to out.
+func (c *posContainer) appendTo(out Positions, high int64) Positions {
+	if c.bitmap == nil {
+		for _, x := range c.array {
+			out = append(out, high|int64(x))
+		}
+		return out
+	}
+	for i, w := range c.bitmap {
+		for w != 0 {
+			out = append(out, high|int64(i<<6+bits.TrailingZeros64(w)))
+			w &= w - 1
+		}
+	}
+	return out
+}
+
+func lessUint16(x, y uint16) bool { return x < y }
+
+func (c *posContainer) union(o *posContainer) {
+	if c.bitmap == nil && o.bitmap == nil {
+		if c.n+o.n > arrayMaxSize {
+			c.toBitmap()
+		} else {
+			c.array = UnionBy(c.array, append([]uint16(nil), o.array...), lessUint16)
+			c.n = len(c.array)
+			return
+		}
+	}
+	c.toBitmap()
+	if o.bitmap != nil {
+		for i, w := range o.bitmap {
+			c.bitmap[i] |= w
+		}
+	} else {
+		for _, x := range o.array {
+			c.bitmap[x>>6] |= 1 << (x & 63)
+		}
+	}
+	c.recount()
+}
+
+func (c *posContainer) intersect(o *posContainer) {
+	switch {
+	case c.bitmap == nil && o.bitmap == nil:
+		if len(o.array) == 0 {
+			c.array = nil
+		} else {
+			c.array = IntersectBy(c.array, o.array, lessUint16)
+		}
+		c.n = len(c.array)
+	case c.bitmap == nil:
+		c.filter(o, true)
+	case o.bitmap == nil:
+		c.array = nil
+		for _, x := range o.array {
+			if c.contains(x) {
+				c.array = append(c.array, x)
+			}
+		}
+		c.bitmap, c.n = nil, len(c.array)
+	default:
+		for i, w := range o.bitmap {
+			c.bitmap[i] &= w
+		}
+		c.recount()
+	}
+}
+
+func (c *posContainer) difference(o *posContainer) {
+	switch {
+	case c.bitmap == nil && o.bitmap == nil:
+		c.array = DifferenceBy(c.array, o.array, lessUint16)
+		c.n = len(c.array)
+	case c.bitmap == nil:
+		c.filter(o, false)
+	case o.bitmap == nil:
+		for _, x := range o.array {
+			c.bitmap[x>>6] &^= 1 << (x & 63)
+		}
+		c.recount()
+	default:
+		for i, w := range o.bitmap {
+			c.bitmap[i] &^= w
+		}
+		c.recount()
+	}
+}
+
+// filter keeps only those positions in c's array for which o.contains
+// returns keep.
+func (c *posContainer) filter(o *posContainer, keep bool) {
+	out := c.array[:0]
+	for _, x := range c.array {
+		if o.contains(x) == keep {
+			out = append(out, x)
+		}
+	}
+	c.array, c.n = out, len(out)
+}
@@ -0,0 +1,158 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func samePositions(a, b Positions) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestPositionSetRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for _, p := range []Positions{
+		{},
+		{0, 1, 65535, 65536, 1 << 40},
+		randomPositions(r, 1000, 1<<20),
+		randomPositions(r, 50000, 1<<17), // Dense enough for bitmaps
+	} {
+		s := NewPositionSet(p)
+		if got := s.Positions(); !samePositions(got, p) {
+			t.Errorf("round trip of %d positions returned %d", len(p), len(got))
+		}
+		if s.Len() != len(p) {
+			t.Errorf("wrong Len: want %d got %d", len(p), s.Len())
+		}
+		for _, pos := range p {
+			if !s.Contains(pos) {
+				t.Fatalf("missing %d", pos)
+			}
+		}
+	}
+	if !NewPositionSet(AllPositions).Positions().IsAllPositions() {
+		t.Error("AllPositions didn't round trip")
+	}
+}
+
+func TestPositionSetAdd(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	want := randomPositions(r, 20000, 1<<18)
+	s := &PositionSet{}
+	for _, i := range r.Perm(len(want)) {
+		s.Add(want[i])
+		s.Add(want[i])
+	}
+	if got := s.Positions(); !samePositions(got, want) {
+		t.Errorf("added %d positions, got %d back", len(want), len(got))
+	}
+}
+
+func TestPositionSetOps(t *testing.T) {
+	r := rand.New(rand.NewSource(3))
+	for i := 0; i < 50; i++ {
+		// Mix sparse and dense inputs, so every pairing of array and bitmap
+		// containers gets exercised.
+		a := randomPositions(r, r.Intn(30000), 1<<17)
+		b := randomPositions(r, r.Intn(30000), 1<<17)
+		for _, test := range []struct {
+			name string
+			op   func(s, o *PositionSet)
+			want Positions
+		}{
+			{"union", (*PositionSet).Union, a.Union(b)},
+			{"intersect", (*PositionSet).Intersect, a.Intersect(b)},
+			{"difference", (*PositionSet).Difference, naiveSubtract(a, b)},
+		} {
+			s, o := NewPositionSet(a), NewPositionSet(b)
+			test.op(s, o)
+			if got := s.Positions(); !samePositions(got, test.want) {
+				t.Fatalf("%s of %d and %d: want %d positions, got %d", test.name, len(a), len(b), len(test.want), len(got))
+			}
+			if got := o.Positions(); !samePositions(got, b) {
+				t.Fatalf("%s modified its argument", test.name)
+			}
+		}
+	}
+}
+
+func TestPositionSetAll(t *testing.T) {
+	some := Positions{1, 2, 3}
+	for _, test := range []struct {
+		name string
+		op   func(s, o *PositionSet)
+		a, b Positions
+		want Positions
+	}{
+		{"union all", (*PositionSet).Union, some, AllPositions, AllPositions},
+		{"all union", (*PositionSet).Union, AllPositions, some, AllPositions},
+		{"intersect all", (*PositionSet).Intersect, some, AllPositions, some},
+		{"all intersect", (*PositionSet).Intersect, AllPositions, some, some},
+		{"difference all", (*PositionSet).Difference, some, AllPositions, Positions{}},
+		{"all difference", (*PositionSet).Difference, AllPositions, some, AllPositions},
+	} {
+		s := NewPositionSet(test.a)
+		test.op(s, NewPositionSet(test.b))
+		if got := s.Positions(); !samePositions(got, test.want) {
+			t.Errorf("%s: want %v got %v", test.name, test.want, got)
+		}
+	}
+}
+
+// BenchmarkUnionManyPositions and BenchmarkUnionManyPositionSet compare
+// accumulating a broad union, as a multi-key index lookup does.
+func unionInputs() []Positions {
+	r := rand.New(rand.NewSource(4))
+	var out []Positions
+	for i := 0; i < 200; i++ {
+		out = append(out, randomPositions(r, 5000, 1<<22))
+	}
+	return out
+}
+
+func BenchmarkUnionManyPositions(b *testing.B) {
+	in := unionInputs()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var out Positions
+		for _, p := range in {
+			out = out.Union(p)
+		}
+	}
+}
+
+func BenchmarkUnionManyPositionSet(b *testing.B) {
+	in := unionInputs()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s := &PositionSet{}
+		for _, p := range in {
+			s.Union(NewPositionSet(p))
+		}
+		s.Positions()
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/google/stenographer/stats"
+)
+
+var rateLimitWaitNanos = stats.S.Get("rate_limit_wait_nanos")
+
+// Rate caps packet throughput.  Zero fields are ignored.
+type Rate struct {
+	BytesPerSec, PacketsPerSec int64
+}
+
+// RateFromValues returns a Rate based on the URL query parameters
+// "rate_bytes" and "rate_packets", giving bytes and packets per second.
+func RateFromValues(v url.Values) (r Rate, err error) {
+	if rateStr := v.Get("rate_bytes"); rateStr != "" {
+		if r.BytesPerSec, err = strconv.ParseInt(rateStr, 0, 64); err != nil {
+			return
+		}
+	}
+	if rateStr := v.Get("rate_packets"); rateStr != "" {
+		if r.PacketsPerSec, err = strconv.ParseInt(rateStr, 0, 64); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// tokenBucket holds up to one second's worth of tokens, refilled
+// continuously at 'rate' per second.  Taking more tokens than are available
+// puts the bucket into debt, which the caller pays off by waiting.
+type tokenBucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int64, now time.Time) *tokenBucket {
+	return &tokenBucket{rate: float64(rate), tokens: float64(rate), last: now}
+}
+
+// take removes n tokens, returning how long the caller must wait before the
+// bucket is out of debt.
+func (b *tokenBucket) take(n int64, now time.Time) time.Duration {
+	b.tokens += b.rate * now.Sub(b.last).Seconds()
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// RateLimitChan passes packets from 'in' through to the returned PacketChan
+// at no more than the given rate, allowing bursts of up to one second's
+// worth.  Packets are counted by their captured data length.  Serving a huge
+// query flat out can saturate disk and network, starving ongoing capture;
+// this lets operators cap extraction throughput per request.  If rate has no
+// nonzero fields, 'in' is returned unchanged.
+func RateLimitChan(in *PacketChan, rate Rate) *PacketChan {
+	if rate.BytesPerSec <= 0 && rate.PacketsPerSec <= 0 {
+		return in
+	}
+	out := NewPacketChan(100)
+	go func() {
+		defer in.Discard()
+		now := time.Now()
+		var buckets [2]*tokenBucket
+		if rate.BytesPerSec > 0 {
+			buckets[0] = newTokenBucket(rate.BytesPerSec, now)
+		}
+		if rate.PacketsPerSec > 0 {
+			buckets[1] = newTokenBucket(rate.PacketsPerSec, now)
+		}
+		for pkt := range in.Receive() {
+			now := time.Now()
+			var wait time.Duration
+			for i, cost := range [2]int64{int64(len(pkt.Data)), 1} {
+				if b := buckets[i]; b != nil {
+					if d := b.take(cost, now); d > wait {
+						wait = d
+					}
+				}
+			}
+			if wait > 0 {
+				rateLimitWaitNanos.IncrementBy(int64(wait))
+				select {
+				case <-time.After(wait):
+				case <-out.Canceled():
+					out.Close(nil)
+					return
+				}
+			}
+			out.Send(pkt)
+		}
+		out.Close(in.Err())
+	}()
+	return out
+}
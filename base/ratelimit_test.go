@@ -0,0 +1,79 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestRateFromValues(t *testing.T) {
+	r, err := RateFromValues(url.Values{"rate_bytes": {"1000"}, "rate_packets": {"0x10"}})
+	if err != nil || r != (Rate{BytesPerSec: 1000, PacketsPerSec: 16}) {
+		t.Errorf("got %+v, %v", r, err)
+	}
+	if _, err := RateFromValues(url.Values{"rate_packets": {"lots"}}); err == nil {
+		t.Error("expected error for bad rate")
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Unix(0, 0)
+	b := newTokenBucket(100, now)
+	if d := b.take(100, now); d != 0 {
+		t.Errorf("initial burst waited %v", d)
+	}
+	if d := b.take(50, now); d != 500*time.Millisecond {
+		t.Errorf("debt of 50 at 100/s: want 500ms got %v", d)
+	}
+	// Long idle periods don't bank more than a second's worth.
+	now = now.Add(time.Hour)
+	if d := b.take(150, now); d != 500*time.Millisecond {
+		t.Errorf("after idle: want 500ms got %v", d)
+	}
+}
+
+func TestRateLimitChan(t *testing.T) {
+	in := packetChanOf(nil)
+	if out := RateLimitChan(in, Rate{}); out != in {
+		t.Error("zero rate should return input unchanged")
+	}
+
+	var packets []*Packet
+	for i := 0; i < 120; i++ {
+		packets = append(packets, &Packet{Data: make([]byte, 10)})
+	}
+	want := errors.New("input failed")
+	start := time.Now()
+	// 100 packets/s with a burst of 100: the last 20 take about 200ms.
+	out := RateLimitChan(packetChanOf(want, packets...), Rate{PacketsPerSec: 100})
+	count := 0
+	for _ = range out.Receive() {
+		count++
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("packets not limited: took %v", elapsed)
+	}
+	if count != len(packets) || out.Err() != want {
+		t.Errorf("got %d packets, error %v", count, out.Err())
+	}
+
+	// Discarding the output while waiting stops the stage.
+	out = RateLimitChan(packetChanOf(nil, packets...), Rate{BytesPerSec: 10})
+	<-out.Receive()
+	out.Discard()
+}
@@ -0,0 +1,129 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"container/heap"
+	"time"
+
+	"github.com/google/stenographer/stats"
+	"golang.org/x/net/context"
+)
+
+var unfixableMisorders = stats.S.Get("reorder_unfixable_packets")
+
+// ReorderWindow bounds how far ReorderChan looks ahead to fix misordered
+// packets.  A packet is held until more than Packets later packets have
+// arrived, or until a packet more than Delay newer than it has arrived,
+// whichever comes first.  Zero fields are ignored; if both are zero, packets
+// aren't held at all.
+type ReorderWindow struct {
+	Packets int
+	Delay   time.Duration
+}
+
+// full returns true if a buffer holding the given number of packets, the
+// oldest of which is 'age' older than the newest, must release a packet.
+func (w ReorderWindow) full(packets int, age time.Duration) bool {
+	switch {
+	case w.Packets <= 0 && w.Delay <= 0:
+		return true
+	case w.Packets > 0 && packets > w.Packets:
+		return true
+	case w.Delay > 0 && age > w.Delay:
+		return true
+	}
+	return false
+}
+
+// reorderHeap orders packets by timestamp, then by arrival.
+type reorderHeap []indexedPacket
+
+func (h reorderHeap) Len() int      { return len(h) }
+func (h reorderHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h reorderHeap) Less(i, j int) bool {
+	if !h[i].Timestamp.Equal(h[j].Timestamp) {
+		return h[i].Timestamp.Before(h[j].Timestamp)
+	}
+	return h[i].i < h[j].i
+}
+func (h *reorderHeap) Push(x interface{}) { *h = append(*h, x.(indexedPacket)) }
+func (h *reorderHeap) Pop() (x interface{}) {
+	index := len(*h) - 1
+	*h, x = (*h)[:index], (*h)[index]
+	return
+}
+
+// ReorderChan passes packets from 'in' to the returned PacketChan, fixing the
+// order of packets which are slightly out of time order, as stenotype
+// occasionally produces across block boundaries.  Packets are buffered within
+// the given window and released in timestamp order.  A packet which arrives
+// after a later packet has already been released is too far out of order to
+// fix; it's passed on immediately and counted in the
+// reorder_unfixable_packets stat.
+func ReorderChan(in *PacketChan, window ReorderWindow) *PacketChan {
+	out := NewPacketChan(100)
+	go func() {
+		defer in.Discard()
+		var h reorderHeap
+		var newest, released time.Time
+		unfixable := 0
+		defer func() {
+			if unfixable > 0 {
+				baseLog.V(1, "packets too far out of order to fix", "packets", unfixable)
+			}
+		}()
+		release := func() {
+			p := heap.Pop(&h).(indexedPacket)
+			released = p.Timestamp
+			out.Send(p.Packet)
+		}
+		for i := 0; ; i++ {
+			pkt, ok := <-in.Receive()
+			if !ok {
+				break
+			}
+			if i > 0 && pkt.Timestamp.Before(released) {
+				unfixable++
+				unfixableMisorders.Increment()
+				out.Send(pkt)
+				continue
+			}
+			heap.Push(&h, indexedPacket{Packet: pkt, i: i})
+			if pkt.Timestamp.After(newest) {
+				newest = pkt.Timestamp
+			}
+			for h.Len() > 0 && window.full(h.Len(), newest.Sub(h[0].Timestamp)) {
+				release()
+			}
+		}
+		for h.Len() > 0 {
+			release()
+		}
+		out.Close(in.Err())
+	}()
+	return out
+}
+
+// MergePacketChansReorder acts like MergePacketChans, but first passes each
+// input through ReorderChan with the given window, so inputs which are only
+// nearly time-sorted still produce sorted output.
+func MergePacketChansReorder(ctx context.Context, in []*PacketChan, window ReorderWindow) *PacketChan {
+	reordered := make([]*PacketChan, len(in))
+	for i, c := range in {
+		reordered[i] = ReorderChan(c, window)
+	}
+	return MergePacketChans(ctx, reordered)
+}
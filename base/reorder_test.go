@@ -0,0 +1,69 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"golang.org/x/net/context"
+)
+
+// packetsAt returns packets with the given timestamps, in seconds.
+func packetsAt(secs ...int64) (out []*Packet) {
+	for _, s := range secs {
+		out = append(out, &Packet{CaptureInfo: gopacket.CaptureInfo{Timestamp: time.Unix(s, 0)}})
+	}
+	return out
+}
+
+func secondsOf(c *PacketChan) (out []int64) {
+	for p := range c.Receive() {
+		out = append(out, p.Timestamp.Unix())
+	}
+	return out
+}
+
+func TestReorderChan(t *testing.T) {
+	for _, test := range []struct {
+		window ReorderWindow
+		in     []int64
+		want   []int64
+	}{
+		{ReorderWindow{Packets: 2}, []int64{1, 3, 2, 4, 6, 5}, []int64{1, 2, 3, 4, 5, 6}},
+		// 1 is released before 0 arrives, so 0 can't be fixed.
+		{ReorderWindow{Packets: 2}, []int64{1, 2, 3, 4, 0, 5}, []int64{1, 2, 0, 3, 4, 5}},
+		{ReorderWindow{Delay: 2 * time.Second}, []int64{1, 3, 2, 10, 8, 9}, []int64{1, 2, 3, 8, 9, 10}},
+		{ReorderWindow{}, []int64{2, 1}, []int64{2, 1}},
+	} {
+		got := secondsOf(ReorderChan(packetChanOf(nil, packetsAt(test.in...)...), test.window))
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%+v reordering %v: want %v got %v", test.window, test.in, test.want, got)
+		}
+	}
+}
+
+func TestMergePacketChansReorder(t *testing.T) {
+	in := []*PacketChan{
+		packetChanOf(nil, packetsAt(1, 4, 3, 6)...),
+		packetChanOf(nil, packetsAt(2, 5)...),
+	}
+	got := secondsOf(MergePacketChansReorder(context.Background(), in, ReorderWindow{Packets: 1}))
+	if want := []int64{1, 2, 3, 4, 5, 6}; !reflect.DeepEqual(got, want) {
+		t.Errorf("want %v got %v", want, got)
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+// The functions in this file implement the same merge-based set algebra as
+// Positions, but over any sorted slice, given a comparator.  Inputs must be
+// sorted by less and contain no duplicates (x and y are duplicates if neither
+// less(x, y) nor less(y, x)).  Outputs are sorted the same way.  Inputs are
+// never modified, but may be returned.
+//
+// Positions keeps its own implementations: they're measurably faster than
+// calling through a comparator (see BenchmarkIntersectBy), and they handle
+// AllPositions.
+
+// IntersectBy returns the elements present in both a and b.
+func IntersectBy[T any](a, b []T, less func(x, y T) bool) []T {
+	if len(a) == 0 {
+		return a
+	} else if len(b) == 0 {
+		return b
+	}
+	out := make([]T, 0, len(a)/2)
+	ib := 0
+	for _, x := range a {
+		for ib < len(b) && less(b[ib], x) {
+			ib++
+		}
+		if ib < len(b) && !less(x, b[ib]) {
+			out = append(out, x)
+			ib++
+		}
+	}
+	return out
+}
+
+// UnionBy returns the elements present in either a or b.
+func UnionBy[T any](a, b []T, less func(x, y T) bool) []T {
+	if len(a) == 0 {
+		return b
+	} else if len(b) == 0 {
+		return a
+	}
+	out := make([]T, 0, len(a)+len(b)/2)
+	ib := 0
+	for _, x := range a {
+		for ib < len(b) && less(b[ib], x) {
+			out = append(out, b[ib])
+			ib++
+		}
+		if ib < len(b) && !less(x, b[ib]) {
+			ib++
+		}
+		out = append(out, x)
+	}
+	return append(out, b[ib:]...)
+}
+
+// DifferenceBy returns the elements present in a but not in b.
+func DifferenceBy[T any](a, b []T, less func(x, y T) bool) []T {
+	if len(a) == 0 || len(b) == 0 {
+		return a
+	}
+	out := make([]T, 0, len(a))
+	ib := 0
+	for _, x := range a {
+		for ib < len(b) && less(b[ib], x) {
+			ib++
+		}
+		if ib < len(b) && !less(x, b[ib]) {
+			continue
+		}
+		out = append(out, x)
+	}
+	return out
+}
@@ -0,0 +1,82 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func lessInt64(x, y int64) bool { return x < y }
+
+func TestSetOpsByMatchPositions(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 100; i++ {
+		a := randomPositions(r, r.Intn(100), 200)
+		b := randomPositions(r, r.Intn(100), 200)
+		if want, got := a.Intersect(b), IntersectBy(a, b, lessInt64); !reflect.DeepEqual([]int64(want), got) {
+			t.Fatalf("IntersectBy(%v, %v):\nwant %v\ngot  %v", a, b, want, got)
+		}
+		if want, got := a.Union(b), UnionBy(a, b, lessInt64); !reflect.DeepEqual([]int64(want), got) {
+			t.Fatalf("UnionBy(%v, %v):\nwant %v\ngot  %v", a, b, want, got)
+		}
+		if want, got := a.SubtractMany(b), DifferenceBy(a, b, lessInt64); !reflect.DeepEqual([]int64(want), got) {
+			t.Fatalf("DifferenceBy(%v, %v):\nwant %v\ngot  %v", a, b, want, got)
+		}
+	}
+}
+
+func TestSetOpsByTimestamps(t *testing.T) {
+	ts := func(secs ...int64) (out []time.Time) {
+		for _, s := range secs {
+			out = append(out, time.Unix(s, 0))
+		}
+		return out
+	}
+	before := func(x, y time.Time) bool { return x.Before(y) }
+	a, b := ts(1, 2, 4, 5), ts(2, 3, 5)
+	if got, want := IntersectBy(a, b, before), ts(2, 5); !reflect.DeepEqual(got, want) {
+		t.Errorf("IntersectBy: want %v got %v", want, got)
+	}
+	if got, want := UnionBy(a, b, before), ts(1, 2, 3, 4, 5); !reflect.DeepEqual(got, want) {
+		t.Errorf("UnionBy: want %v got %v", want, got)
+	}
+	if got, want := DifferenceBy(a, b, before), ts(1, 4); !reflect.DeepEqual(got, want) {
+		t.Errorf("DifferenceBy: want %v got %v", want, got)
+	}
+}
+
+func benchmarkSetOpInputs() (Positions, Positions) {
+	r := rand.New(rand.NewSource(1))
+	return randomPositions(r, 100000, 1000000), randomPositions(r, 100000, 1000000)
+}
+
+func BenchmarkIntersect(b *testing.B) {
+	x, y := benchmarkSetOpInputs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		x.Intersect(y)
+	}
+}
+
+func BenchmarkIntersectBy(b *testing.B) {
+	x, y := benchmarkSetOpInputs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		IntersectBy(x, y, lessInt64)
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"sync"
+)
+
+// ShutdownGroup tears down a pipeline of PacketChans in an orderly fashion.
+// Each stage of the pipeline registers its output channel with the group,
+// and a single call to Shutdown closes them all, so callers don't need to
+// wire up Close calls across every stage by hand.
+//
+// The zero value is ready to use.  Producers writing to registered channels
+// must use Send rather than sending on C directly, since C is not safe to use
+// concurrently with Close.
+type ShutdownGroup struct {
+	mu    sync.Mutex
+	chans []*PacketChan
+}
+
+// Register adds a channel to the group.  Channels are closed by Shutdown in
+// the order they're registered, so callers should register sources before the
+// stages which consume them.  A channel which closes on its own is
+// automatically removed from the group.
+func (g *ShutdownGroup) Register(c *PacketChan) {
+	g.mu.Lock()
+	g.chans = append(g.chans, c)
+	g.mu.Unlock()
+	go func() {
+		<-c.Done()
+		g.remove(c)
+	}()
+}
+
+func (g *ShutdownGroup) remove(c *PacketChan) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for i, registered := range g.chans {
+		if registered == c {
+			g.chans = append(g.chans[:i], g.chans[i+1:]...)
+			return
+		}
+	}
+}
+
+// Shutdown closes all registered channels with the given error, sources
+// first, so each stage sees its input end and drains cleanly.  Any packets
+// still being sent on a registered channel are dropped.
+func (g *ShutdownGroup) Shutdown(err error) {
+	g.mu.Lock()
+	chans := g.chans
+	g.chans = nil
+	g.mu.Unlock()
+	baseLog.V(1, "shutting down packet chans", "chans", len(chans), "error", err)
+	for _, c := range chans {
+		c.Close(err)
+	}
+}
+
+// Len returns the number of channels currently registered.
+func (g *ShutdownGroup) Len() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return len(g.chans)
+}
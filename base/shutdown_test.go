@@ -0,0 +1,84 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// forward copies all packets from in to out.
+func forward(in, out *PacketChan) {
+	defer in.Discard()
+	for pkt := range in.Receive() {
+		out.Send(pkt)
+	}
+	out.Close(in.Err())
+}
+
+func TestShutdownGroup(t *testing.T) {
+	var g ShutdownGroup
+	packets := testPacketData(t)
+	source := NewPacketChan(0)
+	stage := NewPacketChan(0)
+	sink := NewPacketChan(0)
+	g.Register(source)
+	g.Register(stage)
+	g.Register(sink)
+	go func() {
+		// An endless source, which would block forever without Shutdown.
+		for {
+			select {
+			case <-source.Done():
+				return
+			default:
+				source.Send(packets[0])
+			}
+		}
+	}()
+	go forward(source, stage)
+	go forward(stage, sink)
+	<-sink.Receive()
+	wantErr := errors.New("shutting down")
+	g.Shutdown(wantErr)
+	for _ = range sink.Receive() {
+	}
+	for i, c := range []*PacketChan{source, stage, sink} {
+		if err := c.Err(); err != wantErr {
+			t.Errorf("chan %d: want error %v got %v", i, wantErr, err)
+		}
+	}
+	if n := g.Len(); n != 0 {
+		t.Errorf("group still has %d chans after shutdown", n)
+	}
+}
+
+func TestShutdownGroupDeregisters(t *testing.T) {
+	var g ShutdownGroup
+	c := NewPacketChan(1)
+	g.Register(c)
+	c.Close(nil)
+	for i := 0; i < 100 && g.Len() > 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if n := g.Len(); n != 0 {
+		t.Fatalf("closed chan not deregistered, %d remain", n)
+	}
+	g.Shutdown(errors.New("unused"))
+	if err := c.Err(); err != nil {
+		t.Errorf("shutdown overwrote error of already-closed chan: %v", err)
+	}
+}
@@ -0,0 +1,453 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/stenographer/stats"
+)
+
+// latencySamples is the number of latencies LatencyChan keeps around.
+const latencySamples = 1024
+
+// latencyReservoir keeps a uniform random sample of all latencies added to
+// it, using a fixed amount of memory.
+type latencyReservoir struct {
+	mu      sync.Mutex
+	rand    *rand.Rand
+	seen    int64
+	samples []time.Duration
+}
+
+func (l *latencyReservoir) add(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.seen++
+	if len(l.samples) < latencySamples {
+		l.samples = append(l.samples, d)
+	} else if i := l.rand.Int63n(l.seen); i < latencySamples {
+		l.samples[i] = d
+	}
+}
+
+func (l *latencyReservoir) snapshot() []time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]time.Duration(nil), l.samples...)
+}
+
+// LatencyChan passes packets from 'in' through to the returned PacketChan,
+// recording for each the time between its capture timestamp and when it was
+// sent onward.  The returned function returns a snapshot of a uniform random
+// sample of those latencies, which makes it easy to spot pipeline stages where
+// packets sit in buffers for too long.  Sampling uses a fixed-size reservoir,
+// so recording stays cheap regardless of stream size.
+func LatencyChan(in *PacketChan) (*PacketChan, func() []time.Duration) {
+	out := NewPacketChan(100)
+	res := &latencyReservoir{rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+	go func() {
+		defer in.Discard()
+		for pkt := range in.Receive() {
+			res.add(time.Since(pkt.Timestamp))
+			out.Send(pkt)
+		}
+		out.Close(in.Err())
+	}()
+	return out, res.snapshot
+}
+
+// MapChanErr passes each packet from 'in' through fn, sending the packets it
+// returns to the returned PacketChan.  If fn returns (nil, nil), the packet is
+// dropped without error.  If fn returns an error, the output is closed with
+// that error and the rest of 'in' is discarded, so per-packet failures (in
+// decryption or decapsulation, say) abort the stream rather than silently
+// losing packets.
+func MapChanErr(in *PacketChan, fn func(*Packet) (*Packet, error)) *PacketChan {
+	return Pipe(in, fn)
+}
+
+// PacketTransform is a single stage of a Pipe.  It may modify or annotate
+// (see SetTag) the packet it's given and return it, return a different
+// packet, return nil to drop the packet, or return an error to abort the
+// stream.
+type PacketTransform func(*Packet) (*Packet, error)
+
+// Pipe passes each packet from 'in' through each of the given stages in
+// order, sending whatever comes out of the last one to the returned
+// PacketChan.  Once a stage drops a packet, later stages don't see it.  If a
+// stage returns an error, the output is closed with it and the rest of 'in'
+// is discarded; otherwise, the output is closed with in's error.  All stages
+// run in a single goroutine, so a chain of cheap stages costs one channel hop
+// rather than one per stage.
+func Pipe(in *PacketChan, stages ...PacketTransform) *PacketChan {
+	out := NewPacketChan(100)
+	go func() {
+		defer in.Discard()
+	packets:
+		for pkt := range in.Receive() {
+			for _, stage := range stages {
+				var err error
+				if pkt, err = stage(pkt); err != nil {
+					out.Close(err)
+					return
+				} else if pkt == nil {
+					continue packets
+				}
+			}
+			out.Send(pkt)
+		}
+		out.Close(in.Err())
+	}()
+	return out
+}
+
+// TruncateTransform returns a PacketTransform which truncates each packet to
+// at most snaplen bytes using Packet.Truncate.
+func TruncateTransform(snaplen int) PacketTransform {
+	return func(p *Packet) (*Packet, error) {
+		p.Truncate(snaplen)
+		return p, nil
+	}
+}
+
+// DedupAdjacentChan passes packets from 'in' through to the returned
+// PacketChan, dropping any packet whose data is byte-identical to the packet
+// immediately before it.  This catches exact back-to-back duplicates, as
+// delivered by some mirror configurations, using constant memory.
+func DedupAdjacentChan(in *PacketChan) *PacketChan {
+	out := NewPacketChan(100)
+	go func() {
+		dropped := 0
+		defer func() {
+			baseLog.V(2, "adjacent dedup suppressed packets", "packets", dropped)
+		}()
+		defer in.Discard()
+		// Keep a copy of the last packet's data, since downstream stages may
+		// release the packet itself.
+		var last []byte
+		first := true
+		for pkt := range in.Receive() {
+			if !first && bytes.Equal(last, pkt.Data) {
+				dropped++
+				continue
+			}
+			first = false
+			last = append(last[:0], pkt.Data...)
+			out.Send(pkt)
+		}
+		out.Close(in.Err())
+	}()
+	return out
+}
+
+var dedupSuppressed = stats.S.Get("dedup_suppressed_packets")
+
+// DedupStats counts the packets a DedupWindowChan dropped.
+type DedupStats struct {
+	suppressed int64
+}
+
+// Suppressed returns the number of duplicate packets dropped so far.  It's
+// only final once the deduped output has closed.
+func (d *DedupStats) Suppressed() int64 {
+	return atomic.LoadInt64(&d.suppressed)
+}
+
+// dedupEntry records when a packet hash was first seen.
+type dedupEntry struct {
+	hash uint64
+	ts   time.Time
+}
+
+// DedupWindowChan passes packets from 'in' through to the returned
+// PacketChan, dropping any packet whose data hashes identically to a packet
+// seen no more than 'window' earlier.  This is meant to follow
+// MergePacketChans when the same traffic was captured on several interfaces
+// (both sides of a tap, say), so each copy lands in a different blockfile but
+// with nearly the same timestamp.  'in' must be ordered by timestamp, and
+// memory use grows with the number of packets within a window, so keep it
+// small (milliseconds).  Packets are compared by Packet.Hash, so a hash
+// collision within a window drops a distinct packet.
+func DedupWindowChan(in *PacketChan, window time.Duration) (*PacketChan, *DedupStats) {
+	out := NewPacketChan(100)
+	ds := &DedupStats{}
+	go func() {
+		defer in.Discard()
+		seen := map[uint64]time.Time{}
+		var queue []dedupEntry
+		for pkt := range in.Receive() {
+			// Expire everything which has fallen out of the window.
+			cutoff := pkt.Timestamp.Add(-window)
+			for len(queue) > 0 && queue[0].ts.Before(cutoff) {
+				if seen[queue[0].hash].Equal(queue[0].ts) {
+					delete(seen, queue[0].hash)
+				}
+				queue = queue[1:]
+			}
+			h := pkt.Hash()
+			if _, ok := seen[h]; ok {
+				atomic.AddInt64(&ds.suppressed, 1)
+				dedupSuppressed.Increment()
+				continue
+			}
+			seen[h] = pkt.Timestamp
+			queue = append(queue, dedupEntry{h, pkt.Timestamp})
+			out.Send(pkt)
+		}
+		out.Close(in.Err())
+	}()
+	return out, ds
+}
+
+// TapChan passes packets from 'in' through to the returned PacketChan,
+// calling sink on each one first.  Unlike a full tee there's no second
+// channel: sink runs inline, so it must be fast or it will slow the whole
+// stream.  sink receives the same packet pointer that's passed downstream, so
+// it must not modify the packet, or hold on to it expecting it to stay
+// unchanged.
+func TapChan(in *PacketChan, sink func(*Packet)) *PacketChan {
+	out := NewPacketChan(100)
+	go func() {
+		defer in.Discard()
+		for pkt := range in.Receive() {
+			sink(pkt)
+			out.Send(pkt)
+		}
+		out.Close(in.Err())
+	}()
+	return out
+}
+
+// VerifyOrdered passes packets from 'in' through to the returned PacketChan,
+// checking that each packet's timestamp is no earlier than the one before
+// it.  On the first violation, the output is closed with an error giving both
+// timestamps and the rest of 'in' is discarded.  Wrapping individual pipeline
+// stages with this pins down which one introduces misordering.
+func VerifyOrdered(in *PacketChan) *PacketChan {
+	out := NewPacketChan(100)
+	go func() {
+		defer in.Discard()
+		var last time.Time
+		for i := 0; ; i++ {
+			pkt, ok := <-in.Receive()
+			if !ok {
+				break
+			}
+			if i > 0 && pkt.Timestamp.Before(last) {
+				out.Close(fmt.Errorf("packet %d out of order: timestamp %v is before previous packet's %v", i, pkt.Timestamp, last))
+				return
+			}
+			last = pkt.Timestamp
+			out.Send(pkt)
+		}
+		out.Close(in.Err())
+	}()
+	return out
+}
+
+// filterChan passes through only those packets from 'in' for which keep
+// returns true.
+func filterChan(in *PacketChan, keep func(*Packet) bool) *PacketChan {
+	out := NewPacketChan(100)
+	go func() {
+		defer in.Discard()
+		for pkt := range in.Receive() {
+			if keep(pkt) {
+				out.Send(pkt)
+			}
+		}
+		out.Close(in.Err())
+	}()
+	return out
+}
+
+// TimeRangeChan passes through only those packets from 'in' whose timestamps
+// fall within [start, end).  A zero start or end leaves that side of the
+// range open.  Index lookups select whole blockfiles by time, so this trims
+// the packets at either end which are outside a query's actual bounds.
+func TimeRangeChan(in *PacketChan, start, end time.Time) *PacketChan {
+	if start.IsZero() && end.IsZero() {
+		return in
+	}
+	return filterChan(in, func(p *Packet) bool {
+		return (start.IsZero() || !p.Timestamp.Before(start)) &&
+			(end.IsZero() || p.Timestamp.Before(end))
+	})
+}
+
+// LengthRangeChan passes through only those packets from 'in' whose lengths
+// on the wire fall within [min, max].  A zero max leaves the range unbounded
+// above.  Index lookups select packets by buckets of lengths, so this trims
+// those in the buckets at the edges of a query's actual bounds.
+func LengthRangeChan(in *PacketChan, min, max int) *PacketChan {
+	if min <= 0 && max == 0 {
+		return in
+	}
+	return filterChan(in, func(p *Packet) bool {
+		return p.Length >= min && (max == 0 || p.Length <= max)
+	})
+}
+
+// FilterChainAND passes through only those packets from 'in' for which every
+// predicate returns true, checking predicates in order and stopping at the
+// first false.  This composes several conditions with a single goroutine and
+// channel, rather than one per condition.  With no predicates, all packets
+// pass.
+func FilterChainAND(in *PacketChan, preds ...func(*Packet) bool) *PacketChan {
+	return filterChan(in, func(p *Packet) bool {
+		for _, pred := range preds {
+			if !pred(p) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// FilterChainOR passes through only those packets from 'in' for which at
+// least one predicate returns true, checking predicates in order and stopping
+// at the first true.  With no predicates, no packets pass.
+func FilterChainOR(in *PacketChan, preds ...func(*Packet) bool) *PacketChan {
+	return filterChan(in, func(p *Packet) bool {
+		for _, pred := range preds {
+			if pred(p) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// maxRetryBackoff caps RetrySource's wait between sources.
+const maxRetryBackoff = time.Minute
+
+// RetrySource returns a PacketChan fed by the source newSource creates.  When
+// that source fails (newSource returns an error, or the source's channel
+// closes with one), RetrySource waits, then creates a new source and
+// continues from it.  The wait starts at backoff and doubles with each
+// failure, up to maxRetryBackoff.  After maxRetries retries in a row without
+// a source sending packets, the output is closed with the last error; it's
+// closed cleanly as soon as any source ends without error, or the output is
+// canceled, which discards the current source.  Packets within each source
+// keep their order, but any packets the underlying capture saw during the gap
+// between sources are lost.
+func RetrySource(newSource func() (*PacketChan, error), maxRetries int, backoff time.Duration) *PacketChan {
+	out := NewPacketChan(100)
+	go func() {
+		wait := backoff
+		for retries := 0; ; retries++ {
+			src, err := newSource()
+			if err == nil {
+				sent := false
+			receive:
+				for {
+					select {
+					case pkt, ok := <-src.Receive():
+						if !ok {
+							break receive
+						}
+						sent = true
+						out.Send(pkt)
+					case <-out.Canceled():
+						src.Discard()
+						out.Close(nil)
+						return
+					}
+				}
+				if err = src.Err(); err == nil {
+					out.Close(nil)
+					return
+				} else if sent {
+					// Only failures in a row count against maxRetries.
+					retries, wait = 0, backoff
+				}
+			}
+			if retries >= maxRetries {
+				out.Close(err)
+				return
+			}
+			baseLog.V(1, "source failed, retrying", "backoff", wait, "error", err)
+			select {
+			case <-time.After(wait):
+			case <-out.Canceled():
+				out.Close(nil)
+				return
+			}
+			if wait *= 2; wait > maxRetryBackoff {
+				wait = maxRetryBackoff
+			}
+		}
+	}()
+	return out
+}
+
+// TeePacketChan duplicates the packets from 'in' onto n output PacketChans,
+// each of which is closed with in's error once 'in' is exhausted.  Each output
+// has its own buffer, and an output which is discarded or canceled no longer
+// holds up the others; 'in' is only canceled once all outputs are.  While
+// every output is still active, the stream moves as fast as the slowest one.
+//
+// Outputs share the same packet pointers, so consumers must not modify
+// packets.  Shared packets are detached from the packet pool, so Release is
+// a no-op for them.
+func TeePacketChan(in *PacketChan, n int) []*PacketChan {
+	outs := make([]*PacketChan, n)
+	for i := range outs {
+		outs[i] = NewPacketChan(100)
+	}
+	finished := make(chan struct{})
+	allCanceled := make(chan struct{})
+	go func() {
+		for _, out := range outs {
+			select {
+			case <-out.Canceled():
+			case <-finished:
+				return
+			}
+		}
+		close(allCanceled)
+	}()
+	go func() {
+		defer close(finished)
+		defer in.Discard()
+		for {
+			select {
+			case pkt, ok := <-in.Receive():
+				if !ok {
+					for _, out := range outs {
+						out.Close(in.Err())
+					}
+					return
+				}
+				pkt.fromPool = false
+				for _, out := range outs {
+					out.Send(pkt)
+				}
+			case <-allCanceled:
+				for _, out := range outs {
+					out.Close(nil)
+				}
+				return
+			}
+		}
+	}()
+	return outs
+}
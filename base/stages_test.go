@@ -0,0 +1,470 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+)
+
+// packetChanOf returns a closed PacketChan containing the given packets.
+func packetChanOf(err error, packets ...*Packet) *PacketChan {
+	c := NewPacketChan(len(packets))
+	for _, p := range packets {
+		c.Send(p)
+	}
+	c.Close(err)
+	return c
+}
+
+func TestLatencyChan(t *testing.T) {
+	var packets []*Packet
+	now := time.Now()
+	for i := 0; i < latencySamples*2; i++ {
+		packets = append(packets, &Packet{CaptureInfo: gopacket.CaptureInfo{Timestamp: now.Add(-time.Hour)}})
+	}
+	out, latencies := LatencyChan(packetChanOf(nil, packets...))
+	count := 0
+	for _ = range out.Receive() {
+		count++
+	}
+	if count != len(packets) {
+		t.Errorf("wrong packet count: want %d got %d", len(packets), count)
+	}
+	got := latencies()
+	if len(got) != latencySamples {
+		t.Fatalf("wrong sample count: want %d got %d", latencySamples, len(got))
+	}
+	for _, d := range got {
+		if d < time.Hour {
+			t.Fatalf("latency too small: %v", d)
+		}
+	}
+}
+
+func TestMapChanErr(t *testing.T) {
+	var packets []*Packet
+	for i := 0; i < 5; i++ {
+		packets = append(packets, &Packet{Data: []byte{byte(i)}})
+	}
+	fail := errors.New("bad packet")
+	out := MapChanErr(packetChanOf(nil, packets...), func(p *Packet) (*Packet, error) {
+		switch p.Data[0] {
+		case 1:
+			return nil, nil
+		case 3:
+			return nil, fail
+		}
+		return p, nil
+	})
+	var got []byte
+	for p := range out.Receive() {
+		got = append(got, p.Data[0])
+	}
+	if !bytes.Equal(got, []byte{0, 2}) {
+		t.Errorf("wrong packets: want [0 2] got %v", got)
+	}
+	if err := out.Err(); err != fail {
+		t.Errorf("wrong error: want %v got %v", fail, err)
+	}
+
+	want := errors.New("input failed")
+	out = MapChanErr(packetChanOf(want, packets...), func(p *Packet) (*Packet, error) { return p, nil })
+	count := 0
+	for _ = range out.Receive() {
+		count++
+	}
+	if count != len(packets) || out.Err() != want {
+		t.Errorf("passthrough: got %d packets, error %v", count, out.Err())
+	}
+}
+
+func TestDedupAdjacentChan(t *testing.T) {
+	var packets []*Packet
+	for _, b := range []byte{1, 1, 2, 1, 3, 3, 3} {
+		packets = append(packets, &Packet{Data: []byte{b}})
+	}
+	want := errors.New("input failed")
+	out := DedupAdjacentChan(packetChanOf(want, packets...))
+	var got []byte
+	for p := range out.Receive() {
+		got = append(got, p.Data[0])
+	}
+	if !bytes.Equal(got, []byte{1, 2, 1, 3}) {
+		t.Errorf("wrong packets: want [1 2 1 3] got %v", got)
+	}
+	if err := out.Err(); err != want {
+		t.Errorf("wrong error: want %v got %v", want, err)
+	}
+}
+
+func TestTapChan(t *testing.T) {
+	packets := []*Packet{{Data: []byte{1}}, {Data: []byte{2}}, {Data: []byte{3}}}
+	var tapped []*Packet
+	want := errors.New("input failed")
+	out := TapChan(packetChanOf(want, packets...), func(p *Packet) {
+		tapped = append(tapped, p)
+	})
+	var got []*Packet
+	for p := range out.Receive() {
+		got = append(got, p)
+	}
+	if !reflect.DeepEqual(got, packets) || !reflect.DeepEqual(tapped, packets) {
+		t.Errorf("wrong packets: got %v tapped %v", got, tapped)
+	}
+	if err := out.Err(); err != want {
+		t.Errorf("wrong error: want %v got %v", want, err)
+	}
+}
+
+func TestVerifyOrdered(t *testing.T) {
+	mk := func(secs ...int64) (out []*Packet) {
+		for _, s := range secs {
+			out = append(out, &Packet{CaptureInfo: gopacket.CaptureInfo{Timestamp: time.Unix(s, 0)}})
+		}
+		return out
+	}
+	count := func(c *PacketChan) (n int) {
+		for _ = range c.Receive() {
+			n++
+		}
+		return n
+	}
+	out := VerifyOrdered(packetChanOf(nil, mk(1, 2, 2, 3)...))
+	if n := count(out); n != 4 || out.Err() != nil {
+		t.Errorf("ordered stream: got %d packets, error %v", n, out.Err())
+	}
+	out = VerifyOrdered(packetChanOf(nil, mk(1, 3, 2, 4)...))
+	if n := count(out); n != 2 || out.Err() == nil {
+		t.Errorf("misordered stream: got %d packets, error %v", n, out.Err())
+	}
+}
+
+func TestFilterChains(t *testing.T) {
+	var packets []*Packet
+	for i := 0; i < 10; i++ {
+		packets = append(packets, &Packet{Data: []byte{byte(i)}})
+	}
+	even := func(p *Packet) bool { return p.Data[0]%2 == 0 }
+	small := func(p *Packet) bool { return p.Data[0] < 5 }
+	calls := 0
+	counted := func(p *Packet) bool { calls++; return true }
+	collect := func(c *PacketChan) (out []byte) {
+		for p := range c.Receive() {
+			out = append(out, p.Data[0])
+		}
+		return out
+	}
+	for _, test := range []struct {
+		name string
+		out  *PacketChan
+		want []byte
+	}{
+		{"AND", FilterChainAND(packetChanOf(nil, packets...), even, small, counted), []byte{0, 2, 4}},
+		{"AND none", FilterChainAND(packetChanOf(nil, packets[:2]...)), []byte{0, 1}},
+		{"OR", FilterChainOR(packetChanOf(nil, packets...), even, small), []byte{0, 1, 2, 3, 4, 6, 8}},
+		{"OR none", FilterChainOR(packetChanOf(nil, packets...)), nil},
+	} {
+		if got := collect(test.out); !bytes.Equal(got, test.want) {
+			t.Errorf("%s: want %v got %v", test.name, test.want, got)
+		}
+	}
+	if calls != 3 {
+		t.Errorf("AND didn't short-circuit: last predicate called %d times, want 3", calls)
+	}
+}
+
+func TestRetrySource(t *testing.T) {
+	fail := errors.New("tap went away")
+	collect := func(c *PacketChan) (out []byte) {
+		for p := range c.Receive() {
+			out = append(out, p.Data[0])
+		}
+		return out
+	}
+
+	// Three failures, then a clean source.
+	calls := 0
+	src := func() (*PacketChan, error) {
+		calls++
+		switch calls {
+		case 1:
+			return packetChanOf(fail, &Packet{Data: []byte{1}}, &Packet{Data: []byte{2}}), nil
+		case 2:
+			return nil, fail
+		case 3:
+			return packetChanOf(fail, &Packet{Data: []byte{3}}), nil
+		}
+		return packetChanOf(nil, &Packet{Data: []byte{4}}), nil
+	}
+	out := RetrySource(src, 3, time.Millisecond)
+	if got := collect(out); !bytes.Equal(got, []byte{1, 2, 3, 4}) {
+		t.Errorf("wrong packets: want [1 2 3 4] got %v", got)
+	}
+	if err := out.Err(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// Sources sending packets reset the count of failures, so only failures
+	// in a row can exhaust the retries.
+	calls = 0
+	out = RetrySource(src, 2, time.Millisecond)
+	if got := collect(out); !bytes.Equal(got, []byte{1, 2, 3, 4}) {
+		t.Errorf("wrong packets: want [1 2 3 4] got %v", got)
+	}
+	if err := out.Err(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// Too many failures in a row.
+	calls = 0
+	failing := func() (*PacketChan, error) {
+		if calls++; calls == 1 {
+			return packetChanOf(fail, &Packet{Data: []byte{1}}), nil
+		}
+		return nil, fail
+	}
+	out = RetrySource(failing, 2, time.Millisecond)
+	if got := collect(out); !bytes.Equal(got, []byte{1}) {
+		t.Errorf("wrong packets: want [1] got %v", got)
+	}
+	if err := out.Err(); err != fail || calls != 3 {
+		t.Errorf("want %v after 3 sources, got %v after %d", fail, err, calls)
+	}
+}
+
+func TestRetrySourceCanceled(t *testing.T) {
+	// A source which never ends is released once the output's discarded.
+	src := NewPacketChan(0)
+	released := make(chan struct{})
+	go func() {
+		defer close(released)
+		for {
+			select {
+			case src.C <- &Packet{Data: []byte{1}}:
+			case <-src.Canceled():
+				src.Close(nil)
+				return
+			}
+		}
+	}()
+	out := RetrySource(func() (*PacketChan, error) { return src, nil }, 3, time.Millisecond)
+	<-out.Receive()
+	out.Discard()
+	for name, c := range map[string]<-chan struct{}{"source": released, "output": out.Done()} {
+		select {
+		case <-c:
+		case <-time.After(5 * time.Second):
+			t.Errorf("%s not released after discarding the output", name)
+		}
+	}
+
+	// As is one waiting to retry.
+	out = RetrySource(func() (*PacketChan, error) { return nil, errors.New("failed") }, 3, time.Hour)
+	out.Discard()
+	select {
+	case <-out.Done():
+	case <-time.After(5 * time.Second):
+		t.Error("output not closed while waiting to retry")
+	}
+}
+
+func TestTeePacketChan(t *testing.T) {
+	packets := []*Packet{{Data: []byte{1}}, {Data: []byte{2}}, {Data: []byte{3}}}
+	want := errors.New("input failed")
+	outs := TeePacketChan(packetChanOf(want, packets...), 2)
+	// Read the outputs one after the other, so each must buffer independently.
+	for i, out := range outs {
+		var got []*Packet
+		for p := range out.Receive() {
+			got = append(got, p)
+		}
+		if !reflect.DeepEqual(got, packets) {
+			t.Errorf("output %d: wrong packets %v", i, got)
+		}
+		if err := out.Err(); err != want {
+			t.Errorf("output %d: wrong error: want %v got %v", i, want, err)
+		}
+	}
+
+	// A discarded output doesn't hold up the other.
+	in := NewPacketChan(0)
+	go func() {
+		for i := 0; i < 1000; i++ {
+			in.Send(benchmarkPacket)
+		}
+		in.Close(nil)
+	}()
+	outs = TeePacketChan(in, 2)
+	outs[0].Discard()
+	count := 0
+	for _ = range outs[1].Receive() {
+		count++
+	}
+	if count != 1000 {
+		t.Errorf("wrong packet count: want 1000 got %d", count)
+	}
+
+	// Once all outputs are discarded, the input is canceled.
+	in = NewPacketChan(0)
+	outs = TeePacketChan(in, 2)
+	outs[0].Discard()
+	outs[1].Discard()
+	select {
+	case <-in.Canceled():
+	case <-time.After(time.Second):
+		t.Error("input not canceled")
+	}
+}
+
+func TestPipe(t *testing.T) {
+	var packets []*Packet
+	for i := 0; i < 6; i++ {
+		packets = append(packets, &Packet{Data: []byte{byte(i), 0xff}})
+	}
+	dropOdd := func(p *Packet) (*Packet, error) {
+		if p.Data[0]%2 == 1 {
+			return nil, nil
+		}
+		return p, nil
+	}
+	seen := 0
+	tag := func(p *Packet) (*Packet, error) {
+		seen++
+		p.SetTag("seen", "yes")
+		return p, nil
+	}
+	want := errors.New("input failed")
+	out := Pipe(packetChanOf(want, packets...), dropOdd, TruncateTransform(1), tag)
+	var got []byte
+	for p := range out.Receive() {
+		if len(p.Data) != 1 || p.Tags["seen"] != "yes" {
+			t.Errorf("packet %v not transformed: tags %v", p.Data, p.Tags)
+		}
+		got = append(got, p.Data[0])
+	}
+	if !bytes.Equal(got, []byte{0, 2, 4}) {
+		t.Errorf("wrong packets: want [0 2 4] got %v", got)
+	}
+	if seen != 3 {
+		t.Errorf("later stage saw %d packets, want 3", seen)
+	}
+	if err := out.Err(); err != want {
+		t.Errorf("wrong error: want %v got %v", want, err)
+	}
+
+	fail := errors.New("bad packet")
+	out = Pipe(packetChanOf(nil, packets...), func(p *Packet) (*Packet, error) {
+		if p.Data[0] == 2 {
+			return nil, fail
+		}
+		return p, nil
+	})
+	count := 0
+	for _ = range out.Receive() {
+		count++
+	}
+	if count != 2 || out.Err() != fail {
+		t.Errorf("failing stage: got %d packets, error %v", count, out.Err())
+	}
+
+	out = Pipe(packetChanOf(nil, packets...))
+	count = 0
+	for _ = range out.Receive() {
+		count++
+	}
+	if count != len(packets) {
+		t.Errorf("no stages: want %d packets got %d", len(packets), count)
+	}
+}
+
+func TestDedupWindowChan(t *testing.T) {
+	mk := func(ms int64, b byte) *Packet {
+		return &Packet{Data: []byte{b}, CaptureInfo: gopacket.CaptureInfo{Timestamp: time.Unix(0, ms*int64(time.Millisecond))}}
+	}
+	packets := []*Packet{
+		mk(0, 1), mk(1, 1), // Duplicate within the window
+		mk(2, 2),
+		mk(3, 1),             // Still within 5ms of the first copy
+		mk(10, 1), mk(10, 2), // Window expired, so these pass
+		mk(12, 2),
+	}
+	want := errors.New("input failed")
+	out, stats := DedupWindowChan(packetChanOf(want, packets...), 5*time.Millisecond)
+	var got []*Packet
+	for p := range out.Receive() {
+		got = append(got, p)
+	}
+	if wantPkts := []*Packet{packets[0], packets[2], packets[4], packets[5]}; !reflect.DeepEqual(got, wantPkts) {
+		t.Errorf("wrong packets: want %v got %v", wantPkts, got)
+	}
+	if n := stats.Suppressed(); n != 3 {
+		t.Errorf("wrong suppressed count: want 3 got %d", n)
+	}
+	if err := out.Err(); err != want {
+		t.Errorf("wrong error: want %v got %v", want, err)
+	}
+}
+
+func TestTimeRangeChan(t *testing.T) {
+	packets := packetsAt(1, 2, 3, 4, 5)
+	for _, test := range []struct {
+		start, end int64 // 0 for unbounded
+		want       []int64
+	}{
+		{0, 0, []int64{1, 2, 3, 4, 5}},
+		{2, 0, []int64{2, 3, 4, 5}},
+		{0, 4, []int64{1, 2, 3}},
+		{2, 4, []int64{2, 3}},
+		{6, 0, nil},
+	} {
+		var start, end time.Time
+		if test.start != 0 {
+			start = time.Unix(test.start, 0)
+		}
+		if test.end != 0 {
+			end = time.Unix(test.end, 0)
+		}
+		if got := secondsOf(TimeRangeChan(packetChanOf(nil, packets...), start, end)); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("[%d, %d): want %v got %v", test.start, test.end, test.want, got)
+		}
+	}
+}
+
+func TestLengthRangeChan(t *testing.T) {
+	var packets []*Packet
+	for _, length := range []int{60, 100, 1500, 9000} {
+		packets = append(packets, &Packet{CaptureInfo: gopacket.CaptureInfo{Length: length, Timestamp: time.Unix(int64(length), 0)}})
+	}
+	for _, test := range []struct {
+		min, max int // 0 max for unbounded
+		want     []int64
+	}{
+		{0, 0, []int64{60, 100, 1500, 9000}},
+		{101, 0, []int64{1500, 9000}},
+		{0, 1500, []int64{60, 100, 1500}},
+		{100, 1500, []int64{100, 1500}},
+		{9001, 0, nil},
+	} {
+		if got := secondsOf(LengthRangeChan(packetChanOf(nil, packets...), test.min, test.max)); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("[%d, %d]: want %v got %v", test.min, test.max, test.want, got)
+		}
+	}
+}
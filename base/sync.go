@@ -0,0 +1,91 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	"github.com/google/stenographer/stats"
+)
+
+var (
+	filesSynced = stats.S.Get("files_synced")
+	dirsSynced  = stats.S.Get("dirs_synced")
+)
+
+// Sync policies say how the blockfiles and indexes stenographer writes reach
+// disk, trading throughput against what survives a crash or power loss.
+//
+// SyncClose, the default, syncs each file once it's written, before it's
+// moved into place.  A crash can lose files moved into place but not yet in
+// their directories on disk, which stenographer cleans up as unpaired, but
+// never leaves a file visible with only some of its data.
+//
+// SyncNone never syncs, leaving data to reach disk when the kernel writes it
+// back.  With a battery-backed write cache, this costs nothing in safety and
+// saves waiting on each write.
+//
+// SyncStrict acts like SyncClose, and also syncs each directory a file is
+// moved into, blockfiles first, so an index becomes visible only once the
+// data it points into is durable.
+const (
+	SyncClose  = ""
+	SyncNone   = "none"
+	SyncStrict = "strict"
+)
+
+// KnownSyncPolicy returns true if name is a supported sync policy.
+func KnownSyncPolicy(name string) bool {
+	return name == SyncClose || name == SyncNone || name == SyncStrict
+}
+
+var syncPolicy atomic.Value // string
+
+// SetSyncPolicy sets the sync policy used by SyncFile and SyncDir.
+func SetSyncPolicy(policy string) {
+	syncPolicy.Store(policy)
+}
+
+// GetSyncPolicy returns the current sync policy.
+func GetSyncPolicy() string {
+	policy, _ := syncPolicy.Load().(string)
+	return policy
+}
+
+// SyncFile syncs a file that's been written, unless the policy is SyncNone.
+func SyncFile(f *os.File) error {
+	if GetSyncPolicy() == SyncNone {
+		return nil
+	}
+	filesSynced.Increment()
+	return f.Sync()
+}
+
+// SyncDir syncs the directory holding path, which has just been renamed or
+// linked into it, if the policy is SyncStrict.
+func SyncDir(path string) error {
+	if GetSyncPolicy() != SyncStrict {
+		return nil
+	}
+	d, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	dirsSynced.Increment()
+	return d.Sync()
+}
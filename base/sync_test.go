@@ -0,0 +1,64 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSyncPolicy(t *testing.T) {
+	defer SetSyncPolicy(GetSyncPolicy())
+	dir, err := ioutil.TempDir("", "sync_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	f, err := os.Create(filepath.Join(dir, "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for _, policy := range []string{SyncClose, SyncNone, SyncStrict} {
+		if !KnownSyncPolicy(policy) {
+			t.Errorf("policy %q unknown", policy)
+		}
+		SetSyncPolicy(policy)
+		if got := GetSyncPolicy(); got != policy {
+			t.Errorf("set policy %q, got %q", policy, got)
+		}
+		if err := SyncFile(f); err != nil {
+			t.Errorf("%q: SyncFile: %v", policy, err)
+		}
+		if err := SyncDir(f.Name()); err != nil {
+			t.Errorf("%q: SyncDir: %v", policy, err)
+		}
+	}
+	// Strict syncs directories, so notices ones that are gone; the others
+	// don't look.
+	SetSyncPolicy(SyncStrict)
+	if err := SyncDir(filepath.Join(dir, "missing", "file")); err == nil {
+		t.Error("synced a missing directory")
+	}
+	SetSyncPolicy(SyncClose)
+	if err := SyncDir(filepath.Join(dir, "missing", "file")); err != nil {
+		t.Errorf("default policy synced a directory: %v", err)
+	}
+	if KnownSyncPolicy("sometimes") {
+		t.Error("bogus policy known")
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/stenographer/stats"
+)
+
+// ChanTelemetry counts what's been sent on an instrumented PacketChan: how
+// many packets and bytes, how long senders spent blocked because the
+// channel was full, and how long the first packet took to arrive.  A
+// producer which is often blocked has a slow consumer; a late first packet
+// points upstream, at index lookups or disk reads.
+type ChanTelemetry struct {
+	stage   string
+	start   time.Time
+	packets int64
+	bytes   int64
+	blocked int64 // Nanoseconds
+	first   int64 // Nanoseconds after start, -1 until the first packet
+}
+
+// ChanSnapshot is a point-in-time copy of a ChanTelemetry's counters.
+type ChanSnapshot struct {
+	Packets, Bytes int64
+	Blocked        time.Duration
+	FirstPacket    time.Duration // -1 if no packet has been sent
+}
+
+func (s ChanSnapshot) String() string {
+	first := "none"
+	if s.FirstPacket >= 0 {
+		first = s.FirstPacket.String()
+	}
+	return fmt.Sprintf("%d packets, %d bytes, first packet %s, blocked %v", s.Packets, s.Bytes, first, s.Blocked)
+}
+
+// Instrument starts counting packets sent on p, returning the telemetry to
+// read them from.  Time to first packet is measured from this call, and
+// packets sent before it aren't counted, so instrument a channel before
+// handing it to its producer where possible.  If stage is non-empty, the
+// totals are also added to the stats registry as "<stage>_packets",
+// "<stage>_bytes", "<stage>_blocked_nanos" and "<stage>_first_packet_nanos"
+// when p is closed, along with a "<stage>_channels" count to average them
+// over.  Instrumenting a channel twice returns its existing telemetry.
+func (p *PacketChan) Instrument(stage string) *ChanTelemetry {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if t := p.telemetryOrNil(); t != nil {
+		return t
+	}
+	t := &ChanTelemetry{stage: stage, start: time.Now(), first: -1}
+	p.telemetry.Store(t)
+	return t
+}
+
+// InstrumentChan passes packets from 'in' through to the returned PacketChan,
+// instrumented as Instrument does before any are sent, for channels whose
+// producer is already running.  The output is closed with in's error.
+func InstrumentChan(in *PacketChan, stage string) (*PacketChan, *ChanTelemetry) {
+	out := NewPacketChan(100)
+	t := out.Instrument(stage)
+	go func() {
+		defer in.Discard()
+		buf := make([]*Packet, 0, 100)
+		for {
+			var ok bool
+			if buf, ok = in.ReceiveBatch(buf[:0]); !ok {
+				break
+			}
+			if out.SendBatch(buf) < len(buf) {
+				break
+			}
+		}
+		out.Close(in.Err())
+	}()
+	return out, t
+}
+
+// telemetryOrNil returns p's telemetry, or nil if it isn't instrumented.
+func (p *PacketChan) telemetryOrNil() *ChanTelemetry {
+	t, _ := p.telemetry.Load().(*ChanTelemetry)
+	return t
+}
+
+// Snapshot returns the current counts.  They're final once the channel has
+// closed.
+func (t *ChanTelemetry) Snapshot() ChanSnapshot {
+	return ChanSnapshot{
+		Packets:     atomic.LoadInt64(&t.packets),
+		Bytes:       atomic.LoadInt64(&t.bytes),
+		Blocked:     time.Duration(atomic.LoadInt64(&t.blocked)),
+		FirstPacket: time.Duration(atomic.LoadInt64(&t.first)),
+	}
+}
+
+// sent counts a packet sent on the channel.
+func (t *ChanTelemetry) sent(pkt *Packet) {
+	if atomic.AddInt64(&t.packets, 1) == 1 {
+		atomic.StoreInt64(&t.first, int64(time.Since(t.start)))
+	}
+	atomic.AddInt64(&t.bytes, int64(len(pkt.Data)))
+}
+
+// blockedSince counts time a sender has been blocked since 'start'.
+func (t *ChanTelemetry) blockedSince(start time.Time) {
+	atomic.AddInt64(&t.blocked, int64(time.Since(start)))
+}
+
+// publish adds the final counts to the stats registry.
+func (t *ChanTelemetry) publish() {
+	if t.stage == "" {
+		return
+	}
+	s := t.Snapshot()
+	stats.S.Get(t.stage + "_channels").Increment()
+	stats.S.Get(t.stage + "_packets").IncrementBy(s.Packets)
+	stats.S.Get(t.stage + "_bytes").IncrementBy(s.Bytes)
+	stats.S.Get(t.stage + "_blocked_nanos").IncrementBy(int64(s.Blocked))
+	if s.FirstPacket >= 0 {
+		stats.S.Get(t.stage + "_first_packet_nanos").IncrementBy(int64(s.FirstPacket))
+	}
+}
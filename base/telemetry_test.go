@@ -0,0 +1,102 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/stenographer/stats"
+)
+
+// statValue returns the value of the named stat, as stats.S serves it.
+func statValue(t *testing.T, name string) int64 {
+	w := httptest.NewRecorder()
+	stats.S.ServeHTTP(w, nil)
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		if fields := strings.Split(line, "\t"); len(fields) == 2 && fields[0] == name {
+			v, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				t.Fatalf("stat %q: %v", name, err)
+			}
+			return v
+		}
+	}
+	return 0
+}
+
+func TestInstrument(t *testing.T) {
+	// Stats are global, so only their changes are checked, for -count > 1.
+	want := map[string]int64{"test_instrument_channels": 1, "test_instrument_packets": 3, "test_instrument_bytes": 60}
+	before := map[string]int64{}
+	for name := range want {
+		before[name] = statValue(t, name)
+	}
+	c := NewPacketChan(0)
+	tel := c.Instrument("test_instrument")
+	if c.Instrument("other") != tel {
+		t.Error("second Instrument returned new telemetry")
+	}
+	if s := tel.Snapshot(); s.Packets != 0 || s.FirstPacket != -1 {
+		t.Errorf("before sending: got %+v", s)
+	}
+	const wait = 20 * time.Millisecond
+	go func() {
+		c.Send(&Packet{Data: make([]byte, 10)})
+		c.SendBatch([]*Packet{{Data: make([]byte, 20)}, {Data: make([]byte, 30)}})
+		c.Close(nil)
+	}()
+	time.Sleep(wait) // The first Send blocks, since c is unbuffered.
+	for range c.Receive() {
+	}
+	s := tel.Snapshot()
+	if s.Packets != 3 || s.Bytes != 60 {
+		t.Errorf("want 3 packets, 60 bytes, got %+v", s)
+	}
+	if s.Blocked < wait {
+		t.Errorf("want blocked at least %v, got %v", wait, s.Blocked)
+	}
+	if s.FirstPacket < wait {
+		t.Errorf("want first packet after at least %v, got %v", wait, s.FirstPacket)
+	}
+	for name, delta := range want {
+		if got := statValue(t, name) - before[name]; got != delta {
+			t.Errorf("stat %q grew by %d, want %d", name, got, delta)
+		}
+	}
+}
+
+func TestInstrumentChan(t *testing.T) {
+	// Packets and errors sent before the channel is instrumented count.
+	in := NewPacketChan(10)
+	in.Send(&Packet{Data: make([]byte, 10)})
+	in.Send(&Packet{Data: make([]byte, 20)})
+	in.Close(errors.New("failed"))
+	out, tel := InstrumentChan(in, "")
+	n := 0
+	for range out.Receive() {
+		n++
+	}
+	if s := tel.Snapshot(); n != 2 || s.Packets != 2 || s.Bytes != 30 || s.FirstPacket < 0 {
+		t.Errorf("want 2 packets, 30 bytes counted, got %d, %+v", n, s)
+	}
+	if err := out.Err(); err == nil || err.Error() != "failed" {
+		t.Errorf("want input's error, got %v", err)
+	}
+}
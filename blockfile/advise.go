@@ -0,0 +1,249 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blockfile
+
+import (
+	"io"
+	"os"
+	"time"
+
+	"github.com/google/stenographer/base"
+	"github.com/google/stenographer/filecache"
+	"github.com/google/stenographer/stats"
+	"golang.org/x/net/context"
+)
+
+// Access patterns name the read-ahead hints a lookup gives the kernel about
+// how it'll read a blockfile.
+//
+// AccessAuto, the default, picks one from the positions a query matched:
+// AccessSequential if they touch at least half the file's blocks (or are all
+// of its packets), otherwise AccessWillNeed.
+//
+// AccessNormal gives no hints, leaving the kernel's usual readahead.
+//
+// AccessRandom turns readahead off, so reads of sparse packets don't pull in
+// their unwanted neighbors.
+//
+// AccessSequential doubles readahead, for reads of most of the file.
+//
+// AccessWillNeed turns readahead off like AccessRandom, but asks the kernel
+// to start reading the next willNeedWindow packets before they're needed, so
+// their reads overlap.
+//
+// Readahead is set per open file, and the file cache shares blockfiles' open
+// files between lookups, so lookups changing it read through a descriptor of
+// their own.  Compressed, encrypted and mapped files are read through shared
+// state which can't be duplicated cheaply, so they only get AccessWillNeed's
+// requests for upcoming data, which leave other readers alone.
+const (
+	AccessAuto       = ""
+	AccessNormal     = "normal"
+	AccessRandom     = "random"
+	AccessSequential = "sequential"
+	AccessWillNeed   = "willneed"
+	// willNeedWindow is how many upcoming packets AccessWillNeed asks for.
+	willNeedWindow = 64
+)
+
+// KnownAccess returns true if name is a supported access pattern, or empty
+// for AccessAuto.
+func KnownAccess(name string) bool {
+	switch name {
+	case AccessAuto, AccessNormal, AccessRandom, AccessSequential, AccessWillNeed:
+		return true
+	}
+	return false
+}
+
+// accessChosen counts the lookups using each access pattern.
+var accessChosen = map[string]*stats.Stat{
+	AccessNormal:     stats.S.Get("blockfile_access_normal"),
+	AccessRandom:     stats.S.Get("blockfile_access_random"),
+	AccessSequential: stats.S.Get("blockfile_access_sequential"),
+	AccessWillNeed:   stats.S.Get("blockfile_access_willneed"),
+}
+
+type accessKey struct{}
+
+// WithAccess returns a context making the lookups done for it use the given
+// access pattern, rather than picking their own.
+func WithAccess(ctx context.Context, access string) context.Context {
+	return context.WithValue(ctx, accessKey{}, access)
+}
+
+// accessFromContext returns the access pattern set by WithAccess, or
+// AccessAuto if there is none.
+func accessFromContext(ctx context.Context) string {
+	access, _ := ctx.Value(accessKey{}).(string)
+	return access
+}
+
+// chooseAccess picks the access pattern for reading the given positions.
+func (b *BlockFile) chooseAccess(positions base.Positions) string {
+	if positions.IsAllPositions() {
+		return AccessSequential
+	} else if len(positions) == 0 {
+		return AccessNormal // Nothing will be read.
+	}
+	blocks := (b.valid + blockSize - 1) / blockSize
+	touched, last := int64(0), int64(-1)
+	for _, pos := range positions {
+		if blk := pos / blockSize; blk != last {
+			touched, last = touched+1, blk
+		}
+	}
+	if touched*2 >= blocks {
+		return AccessSequential
+	}
+	return AccessWillNeed
+}
+
+// advisor gives the kernel a lookup's read-ahead hints.
+type advisor struct {
+	b      *BlockFile
+	access string
+	// data is what the lookup reads the blockfile's data through: through
+	// f, if readahead's set for the lookup alone, otherwise b.data.
+	data io.ReaderAt
+	f    *os.File
+	// offset is where the data's blocks start on disk, if direct is set.
+	// Otherwise they're compressed or encrypted, so packet positions can't
+	// be found on disk, and only hints for the whole file are given.
+	offset     int64
+	direct     bool
+	start, end time.Time // Of the lookup, to skip positions in unread blocks
+	advised    int       // Positions before this index have been asked for
+}
+
+// newAdvisor gives the hints for the whole file for a lookup of packets in
+// [start, end) using access.  b.mu must be read-locked until done is called.
+func (b *BlockFile) newAdvisor(access string, start, end time.Time) *advisor {
+	a := &advisor{b: b, access: access, start: start, end: end, data: b.data}
+	a.offset, a.direct = b.diskOffset()
+	if c := accessChosen[access]; c != nil {
+		c.Increment()
+	}
+	advice := filecache.AdviseRandom
+	switch access {
+	case AccessNormal:
+		return a
+	case AccessSequential:
+		advice = filecache.AdviseSequential
+	}
+	if a.direct && b.mapped == nil && a.open() {
+		if err := filecache.Fadvise(a.f, 0, 0, advice); err != nil {
+			v(2, "Blockfile %q read-ahead hint %d failed: %v", b.name, advice, err)
+		}
+	}
+	return a
+}
+
+// open opens a descriptor of the blockfile for the lookup alone, returning
+// false if it can't.
+func (a *advisor) open() bool {
+	f, err := os.Open(a.b.name)
+	if err != nil {
+		v(2, "Blockfile %q could not be opened for read-ahead hints: %v", a.b.name, err)
+		return false
+	}
+	// The file at b's path may have been replaced since b opened it.
+	if s, err := f.Stat(); err != nil || !a.b.f.SameFile(s) {
+		f.Close()
+		return false
+	}
+	a.f, a.data = f, f
+	if v2, ok := a.b.data.(*v2Reader); ok {
+		r := *v2
+		r.r = f
+		a.data = &r
+	}
+	return true
+}
+
+// all is called before reading every packet in the file.  With
+// AccessWillNeed, it asks for all of them.
+func (a *advisor) all() {
+	if a.access != AccessWillNeed {
+		return
+	} else if a.direct {
+		a.b.advise(a.offset, a.b.valid, filecache.AdviseWillNeed)
+	} else {
+		a.b.advise(0, 0, filecache.AdviseWillNeed)
+	}
+}
+
+// ahead is called before reading positions[i].  With AccessWillNeed, it asks
+// for the packets up to willNeedWindow positions on that haven't been asked
+// for yet, once half of those already asked for have been read, so the
+// kernel is kept ahead of the lookup.
+func (a *advisor) ahead(positions base.Positions, i int) {
+	if a.access != AccessWillNeed || !a.direct || i+willNeedWindow/2 < a.advised {
+		return
+	}
+	from, to := a.advised, i+willNeedWindow
+	if from < i {
+		from = i
+	}
+	if to > len(positions) {
+		to = len(positions)
+	}
+	a.advised = to
+	// Nearby packets are asked for together.
+	var off, end int64 = 0, -1
+	for _, pos := range positions[from:to] {
+		if pos >= a.b.valid || a.b.skipBlock(pos, a.start, a.end) {
+			continue
+		}
+		last := pos + packetReadSize
+		if blk := pos - pos%blockSize + blockSize; last > blk {
+			last = blk
+		}
+		if pos > end {
+			if end >= 0 {
+				a.b.advise(a.offset+off, end-off, filecache.AdviseWillNeed)
+			}
+			off = pos
+		}
+		end = last
+	}
+	if end >= 0 {
+		a.b.advise(a.offset+off, end-off, filecache.AdviseWillNeed)
+	}
+}
+
+// done closes the lookup's own descriptor, if it has one, once the lookup's
+// finished.
+func (a *advisor) done() {
+	if a.f != nil {
+		a.f.Close()
+	}
+}
+
+// advise passes advice on reading length bytes (0 for the rest of the file)
+// at off in the file on disk to the kernel, through the file's shared
+// descriptor or mapping, so may only be filecache.AdviseWillNeed.  Hints are
+// only hints, so failures are logged, not returned.
+func (b *BlockFile) advise(off, length int64, advice int) {
+	var err error
+	if b.mapped != nil {
+		err = b.mapped.Advise(off, length, advice)
+	} else if b.f != nil {
+		err = b.f.Advise(off, length, advice)
+	}
+	if err != nil {
+		v(2, "Blockfile %q read-ahead hint %d failed: %v", b.name, advice, err)
+	}
+}
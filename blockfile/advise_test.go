@@ -0,0 +1,166 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blockfile
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/stenographer/base"
+	"github.com/google/stenographer/filecache"
+	"github.com/google/stenographer/query"
+)
+
+func TestChooseAccess(t *testing.T) {
+	blk := testBlockFile(t, filename)
+	defer blk.Close()
+	for _, test := range []struct {
+		positions base.Positions
+		want      string
+	}{
+		{base.AllPositions, AccessSequential},
+		{nil, AccessNormal},
+		{base.Positions{1048624, 1049024, 1049448, 1049848}, AccessWillNeed},
+		{base.Positions{0, blockSize + 48, 2*blockSize + 48}, AccessSequential},
+	} {
+		if got := blk.chooseAccess(test.positions); got != test.want {
+			t.Errorf("chooseAccess(%v) = %q, want %q", test.positions, got, test.want)
+		}
+	}
+}
+
+func TestAccessPatterns(t *testing.T) {
+	q, err := query.NewQuery("port 67")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, reader := range []string{ReaderPread, ReaderMmap} {
+		for _, path := range []string{filename, compressedCopy(t, "dhcp")} {
+			blk, err := NewBlockFileWithOptions(path, filecache.NewCache(10), Options{Reader: reader})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer blk.Close()
+			var want []*base.Packet
+			for _, access := range []string{AccessAuto, AccessNormal, AccessRandom, AccessSequential, AccessWillNeed} {
+				out := base.NewPacketChan(100)
+				go blk.Lookup(WithAccess(ctx, access), q, out)
+				got := allPackets(t, out)
+				if len(got) != 4 {
+					t.Errorf("%s %s %q: got %d packets, want 4", reader, path, access, len(got))
+				}
+				if want == nil {
+					want = got
+				} else if !reflect.DeepEqual(got, want) {
+					t.Errorf("%s %s %q: packets differ", reader, path, access)
+				}
+			}
+		}
+	}
+	if KnownAccess("bogus") {
+		t.Error("bogus access pattern known")
+	}
+}
+
+func TestAdvisorDescriptors(t *testing.T) {
+	// Lookups changing readahead read through descriptors of their own,
+	// leaving the file cache's shared one alone.
+	blk := testBlockFile(t, filename)
+	defer blk.Close()
+	blk.mu.RLock()
+	for _, access := range []string{AccessRandom, AccessSequential, AccessWillNeed} {
+		a := blk.newAdvisor(access, time.Time{}, time.Time{})
+		if a.f == nil || a.data != io.ReaderAt(a.f) {
+			t.Errorf("%q: want the lookup's own descriptor", access)
+		}
+		a.done()
+	}
+	if a := blk.newAdvisor(AccessNormal, time.Time{}, time.Time{}); a.f != nil || a.data != blk.data {
+		t.Errorf("%q: want the shared descriptor", AccessNormal)
+	}
+	blk.mu.RUnlock()
+
+	// Compressed files' data can't be read through another descriptor.
+	zipped := testBlockFile(t, compressedCopy(t, "dhcp"))
+	defer zipped.Close()
+	zipped.mu.RLock()
+	if a := zipped.newAdvisor(AccessRandom, time.Time{}, time.Time{}); a.f != nil || a.data != zipped.data {
+		t.Error("compressed: want the shared descriptor")
+	}
+	zipped.mu.RUnlock()
+
+	// Nor can files since replaced by another.  The compressed copy is
+	// overwritten, to have an uncompressed file beside its index.
+	path := compressedCopy(t, "dhcp")
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	replaced := testBlockFile(t, path)
+	defer replaced.Close()
+	if err := os.Rename(path, path+".old"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	replaced.mu.RLock()
+	if a := replaced.newAdvisor(AccessRandom, time.Time{}, time.Time{}); a.f != nil {
+		t.Error("replaced: want the shared descriptor")
+		a.done()
+	}
+	replaced.mu.RUnlock()
+}
+
+// BenchmarkAccess compares access patterns on queries against blockfiles
+// dropped from the page cache, as BenchmarkReader does for readers.
+func BenchmarkAccess(b *testing.B) {
+	for _, access := range []string{AccessNormal, AccessRandom, AccessSequential, AccessWillNeed} {
+		for _, qs := range []string{"port 67", "ip proto 17"} {
+			b.Run(access+"/"+qs, func(b *testing.B) {
+				q, err := query.NewQuery(qs)
+				if err != nil {
+					b.Fatal(err)
+				}
+				fc := filecache.NewCache(10)
+				for i := 0; i < b.N; i++ {
+					b.StopTimer()
+					dropCache(b, filename)
+					b.StartTimer()
+					blk, err := NewBlockFile(filename, fc)
+					if err != nil {
+						b.Fatal(err)
+					}
+					c := base.NewPacketChan(100)
+					go blk.Lookup(WithAccess(ctx, access), q, c)
+					for p := range c.Receive() {
+						p.Release()
+					}
+					if err := c.Err(); err != nil {
+						b.Fatal(err)
+					}
+					blk.Close()
+				}
+			})
+		}
+	}
+}
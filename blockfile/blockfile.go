@@ -17,15 +17,18 @@
 package blockfile
 
 import (
-	"errors"
 	"fmt"
 	"io"
+	"os"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 	"unsafe"
 
 	"github.com/google/gopacket"
 	"github.com/google/stenographer/base"
+	"github.com/google/stenographer/cryptfile"
 	"github.com/google/stenographer/filecache"
 	"github.com/google/stenographer/indexfile"
 	"github.com/google/stenographer/query"
@@ -43,6 +46,13 @@ var (
 	packetsRead      = stats.S.Get("packets_read")
 	packetsScanned   = stats.S.Get("packets_scanned")
 	packetBlocksRead = stats.S.Get("packets_blocks_read")
+	blocksSkipped    = stats.S.Get("blockfile_blocks_skipped")
+	// packetsScannedForIndex counts packets read to answer queries their
+	// index couldn't.
+	packetsScannedForIndex = stats.S.Get("blockfile_packets_scanned_for_index")
+	// lookupsSliced counts lookups too broad for their memory budget, so
+	// answered a slice of the file at a time.
+	lookupsSliced = stats.S.Get("blockfile_lookups_sliced")
 )
 
 // BlockFile provides an interface to a single stenotype file on disk and its
@@ -50,17 +60,77 @@ var (
 type BlockFile struct {
 	name string
 	f    *filecache.CachedFile
-	i    *indexfile.IndexFile
-	mu   sync.RWMutex // Stops Close() from invalidating a file before a current query is done with it.
-	done chan struct{}
-	size int64
+	data io.ReaderAt // Uncompressed packet data: f itself, unless compressed
+	// mapped is the mapping data is read through, for ReaderMmap.
+	mapped *mmapReader
+	i      *indexfile.IndexFile
+	// filter is i's indexfile.IPFilter, read without mu, so lookups it rules
+	// out don't wait on the file.
+	filter atomic.Value
+	mu     sync.RWMutex // Stops Close() from invalidating a file before a current query is done with it.
+	done   chan struct{}
+	size   int64
+	// valid is the length of the uncompressed data holding complete blocks,
+	// which is all of it unless the file is truncated.
+	valid     int64
+	truncated bool
+	// header and blocks describe v2 blockfiles, and are nil for v1.
+	header     *Header
+	blocks     []BlockMeta
+	blockBytes bool // Whether blocks record their captured bytes
+	// stats caches the result of Stats, guarded by statsMu.
+	statsMu sync.Mutex
+	stats   *FileStats
+	// source is copied into the metadata of each packet read.
+	source base.PacketMetadata
+	// fc and keys are what the blockfile was opened with, for reopening its
+	// index.
+	fc   *filecache.Cache
+	keys *cryptfile.Keyring
+	// expireMu stops Expire running more than once at a time.
+	expireMu sync.Mutex
+	// shared is set by Options.Shared.  ids identify the blockfile and index
+	// opened, for Replaced.
+	shared bool
+	ids    [2]os.FileInfo
 }
 
 // NewBlockFile opens up a named block file (and its index), returning a handle
 // which can be used to look up packets.
 func NewBlockFile(filename string, fc *filecache.Cache) (*BlockFile, error) {
+	return NewBlockFileWithKeys(filename, fc, nil)
+}
+
+// NewBlockFileWithKeys acts like NewBlockFile, but can also open blockfiles
+// and indexes encrypted by cryptfile, getting their keys from 'keys'.
+func NewBlockFileWithKeys(filename string, fc *filecache.Cache, keys *cryptfile.Keyring) (*BlockFile, error) {
+	return NewBlockFileWithOptions(filename, fc, Options{Keys: keys})
+}
+
+// Options configure how a blockfile is opened.
+type Options struct {
+	// Keys, if set, supplies the keys of blockfiles and indexes encrypted by
+	// cryptfile.
+	Keys *cryptfile.Keyring
+	// Reader names how data is read from disk, ReaderPread by default.
+	Reader string
+	// Shared, if set, means other processes (possibly on other hosts, over a
+	// network filesystem) may be using the same directories at once, so
+	// reads take shared FileLocks, and changes to the file take exclusive
+	// ones.  Shared files can't be read with ReaderMmap, as a file removed
+	// by another host would crash reads of its mapping.
+	Shared bool
+}
+
+// NewBlockFileWithOptions acts like NewBlockFile, with the given options.
+func NewBlockFileWithOptions(filename string, fc *filecache.Cache, opts Options) (*BlockFile, error) {
 	v(1, "Blockfile opening: %q", filename)
-	i, err := indexfile.NewIndexFile(indexfile.IndexPathFromBlockfilePath(filename), fc)
+	if !KnownReader(opts.Reader) {
+		return nil, fmt.Errorf("unknown blockfile reader %q", opts.Reader)
+	} else if opts.Shared && opts.Reader == ReaderMmap {
+		return nil, fmt.Errorf("shared blockfile %q can't be mapped", filename)
+	}
+	i, err := indexfile.NewIndexFileWithKeys(indexfile.IndexPathFromBlockfilePath(filename), fc, opts.Keys)
 	if err != nil {
 		return nil, fmt.Errorf("could not open index for %q: %v", filename, err)
 	}
@@ -68,15 +138,159 @@ func NewBlockFile(filename string, fc *filecache.Cache) (*BlockFile, error) {
 	s, err := f.Stat()
 	if err != nil {
 		f.Close()
+		i.Close()
 		return nil, fmt.Errorf("could not stat file %q: %v", filename, err)
 	}
-	return &BlockFile{
-		f:    f,
-		i:    i,
-		name: filename,
-		done: make(chan struct{}),
-		size: s.Size(),
-	}, nil
+	var file io.ReaderAt = f
+	var mapped *mmapReader
+	if opts.Reader == ReaderMmap {
+		if mapped, err = newMmapReader(filename, s.Size()); err != nil {
+			f.Close()
+			i.Close()
+			return nil, err
+		}
+		file = mapped
+	}
+	data, err := openData(file, s.Size(), opts.Keys)
+	if err != nil {
+		if mapped != nil {
+			mapped.Close()
+		}
+		f.Close()
+		i.Close()
+		return nil, fmt.Errorf("could not read blockfile %q: %v", filename, err)
+	}
+	valid, truncated, err := salvageLength(data, dataSize(data, s.Size()))
+	if err != nil {
+		if mapped != nil {
+			mapped.Close()
+		}
+		f.Close()
+		i.Close()
+		return nil, fmt.Errorf("could not check blockfile %q for truncation: %v", filename, err)
+	}
+	if truncated {
+		v(0, "Blockfile %q is truncated, salvaging its first %d bytes", filename, valid)
+	}
+	b := &BlockFile{
+		f:         f,
+		data:      data,
+		mapped:    mapped,
+		i:         i,
+		name:      filename,
+		done:      make(chan struct{}),
+		size:      s.Size(),
+		valid:     valid,
+		truncated: truncated,
+		fc:        fc,
+		keys:      opts.Keys,
+		shared:    opts.Shared,
+	}
+	b.filter.Store(i.IPFilter())
+	b.ids[0] = s
+	if b.ids[1], err = os.Stat(i.Name()); err != nil {
+		b.Close()
+		return nil, fmt.Errorf("could not stat index for %q: %v", filename, err)
+	}
+	if v2, ok := data.(*v2Reader); ok {
+		b.header, b.blocks, b.blockBytes = &v2.header, v2.blocks, v2.blockBytes
+		b.source.Provenance = v2.header.Provenance()
+	}
+	return b, nil
+}
+
+// openData returns a reader of the uncompressed, unencrypted blocks of a
+// blockfile, given the file itself and its size on disk.  Encryption is the
+// outermost layer, since files are compressed before they're encrypted, and
+// the v2 format the innermost.
+func openData(f io.ReaderAt, size int64, keys *cryptfile.Keyring) (io.ReaderAt, error) {
+	if encrypted, err := cryptfile.IsEncrypted(f); err != nil {
+		return nil, err
+	} else if encrypted {
+		r, err := cryptfile.NewReader(f, size, keys)
+		if err != nil {
+			return nil, err
+		}
+		f, size = r, r.Size()
+	}
+	if compressed, err := isCompressed(f); err != nil {
+		return nil, err
+	} else if compressed {
+		c, err := newCompressedReader(f, size)
+		if err != nil {
+			return nil, err
+		} else if !c.v2 {
+			return c, nil
+		}
+		return newV2Reader(c, c.size)
+	}
+	if v2, err := isV2(f); err != nil {
+		return nil, err
+	} else if v2 {
+		return newV2Reader(f, size)
+	}
+	return f, nil
+}
+
+// Format returns the blockfile's format version, FormatV1 or FormatV2.
+func (b *BlockFile) Format() int {
+	if b.header != nil {
+		return FormatV2
+	}
+	return FormatV1
+}
+
+// Header returns the header of a v2 blockfile.  It returns false for v1
+// blockfiles, which have none.
+func (b *BlockFile) Header() (Header, bool) {
+	if b.header == nil {
+		return Header{}, false
+	}
+	return *b.header, true
+}
+
+// skipBlock returns true if the block at 'off' can't hold packets in [start,
+// end).  Only v2 blockfiles record what their blocks hold, so no v1 block is
+// skipped.
+func (b *BlockFile) skipBlock(off int64, start, end time.Time) bool {
+	i := int(off / blockSize)
+	return i < len(b.blocks) && !b.blocks[i].overlaps(start, end)
+}
+
+// skipFile returns true if none of the blockfile's blocks can hold packets in
+// [start, end), so a lookup needn't read its index.  As with skipBlock, only
+// v2 blockfiles can be skipped.
+func (b *BlockFile) skipFile(start, end time.Time) bool {
+	if len(b.blocks) == 0 {
+		return false
+	}
+	for _, blk := range b.blocks {
+		if blk.overlaps(start, end) {
+			return false
+		}
+	}
+	return true
+}
+
+// pruneBlocks drops the positions in blocks skipBlock says can't hold packets
+// in [start, end), a block at a time, returning those left.  Positions must
+// be sorted, as index lookups return them, and are pruned in place.
+func (b *BlockFile) pruneBlocks(positions base.Positions, start, end time.Time) base.Positions {
+	if len(b.blocks) == 0 || start.IsZero() && end.IsZero() {
+		return positions
+	}
+	kept := positions[:0]
+	for i := 0; i < len(positions); {
+		next := (positions[i]/blockSize + 1) * blockSize
+		j := i + sort.Search(len(positions)-i, func(k int) bool { return positions[i+k] >= next })
+		if b.skipBlock(positions[i], start, end) {
+			blocksSkipped.Increment()
+		} else {
+			kept = append(kept, positions[i:j]...)
+		}
+		i = j
+	}
+	return kept
 }
 
 // Name returns the name of the file underlying this blockfile.
@@ -84,33 +298,86 @@ func (b *BlockFile) Name() string {
 	return b.name
 }
 
-// Size returns the size of the blockfile in bytes.
+// SetCaptureSource records the interface and stenotype thread which captured
+// this blockfile's packets, to be included in their metadata alongside any
+// provenance its header records.  It must be called before any packets are
+// read.
+func (b *BlockFile) SetCaptureSource(iface string, thread int) {
+	b.source = base.PacketMetadata{Interface: iface, Thread: thread, Provenance: b.source.Provenance}
+}
+
+// metadata returns the metadata for a packet with the given header.
+func (b *BlockFile) metadata(pkt *C.struct_tpacket3_hdr) base.PacketMetadata {
+	m := b.source
+	// hv1 sits in an anonymous union, which cgo exposes only as bytes.
+	hv1 := (*C.struct_tpacket_hdr_variant1)(unsafe.Pointer(&pkt.anon0[0]))
+	if pkt.tp_status&C.TP_STATUS_VLAN_VALID != 0 {
+		m.VLANValid = true
+		m.VLAN = uint16(hv1.tp_vlan_tci)
+		if pkt.tp_status&C.TP_STATUS_VLAN_TPID_VALID != 0 {
+			m.VLANTPID = uint16(hv1.tp_vlan_tpid)
+		}
+	}
+	return m
+}
+
+// Size returns the size of the blockfile on disk in bytes, which for a
+// compressed blockfile is its compressed size.
 func (b *BlockFile) Size() int64 {
 	return b.size
 }
 
-// readPacket reads a single packet from the file at the given position.
-// It updates the passed in CaptureInfo with information on the packet.
-func (b *BlockFile) readPacket(pos int64, ci *gopacket.CaptureInfo) ([]byte, error) {
-	// 28 bytes actually isn't the entire packet header, but it's all the fields
-	// that we care about.
+// readPacket reads a single packet from the file's data, read through r, at
+// the given position.  It updates the passed in CaptureInfo and metadata with
+// information on the packet.
+func (b *BlockFile) readPacket(r io.ReaderAt, pos int64, ci *gopacket.CaptureInfo, meta *base.PacketMetadata) ([]byte, error) {
 	packetsRead.Increment()
 	defer packetReadNanos.NanoTimer()()
-	var dataBuf [28]byte
-	_, err := b.f.ReadAt(dataBuf[:], pos)
-	if err != nil {
+	// One read gets the header and, usually, the whole packet.  It stops at
+	// the end of the packet's block, so damage to the next can't affect it.
+	size := packetReadSize
+	if rest := blockSize - int(pos%blockSize); rest < size {
+		size = rest
+	}
+	dataBuf := base.GetBuffer(size)
+	defer base.PutBuffer(dataBuf)
+	// 40 bytes actually isn't the entire packet header, but it's all the fields
+	// that we care about, up through the VLAN auxdata.
+	n, err := r.ReadAt(dataBuf, pos)
+	if err != nil && err != io.EOF {
 		return nil, err
+	} else if n < 40 {
+		return nil, fmt.Errorf("packet header at %d truncated", pos)
 	}
 	pkt := (*C.struct_tpacket3_hdr)(unsafe.Pointer(&dataBuf[0]))
+	// TPACKET_V3 headers, which stenotype writes to disk as-is, carry
+	// nanosecond timestamps, so blockfiles need no separate high-precision
+	// format.
 	*ci = gopacket.CaptureInfo{
-		Timestamp:     time.Unix(int64(pkt.tp_sec), int64(pkt.tp_nsec)),
+		Timestamp:     time.Unix(int64(pkt.tp_sec), int64(pkt.tp_nsec)).UTC(),
 		Length:        int(pkt.tp_len),
 		CaptureLength: int(pkt.tp_snaplen),
 	}
-	out := make([]byte, ci.CaptureLength)
-	pos += int64(pkt.tp_mac)
-	_, err = b.f.ReadAt(out, pos)
-	return out, err
+	*meta = b.metadata(pkt)
+	out := base.GetBuffer(ci.CaptureLength)
+	start, got := int(pkt.tp_mac), 0
+	if start < n {
+		got = copy(out, dataBuf[start:n])
+	}
+	if got < len(out) {
+		if _, err = r.ReadAt(out[got:], pos+int64(start+got)); err != nil {
+			base.PutBuffer(out)
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// newPacket returns a pooled packet around a buffer from readPacket.
+func (b *BlockFile) newPacket(buffer []byte, ci gopacket.CaptureInfo, meta base.PacketMetadata) *base.Packet {
+	p := base.NewPooledPacket(buffer, ci)
+	p.Meta = meta
+	return p
 }
 
 // Close cleans up this blockfile.
@@ -120,90 +387,38 @@ func (b *BlockFile) Close() (err error) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 	v(3, "Blockfile closing file descriptors: %q", b.name)
-	if e := b.i.Close(); e != nil {
-		err = e
+	if b.i != nil { // Expire drops an index it couldn't replace.
+		if e := b.i.Close(); e != nil {
+			err = e
+		}
 	}
 	if e := b.f.Close(); e != nil {
 		err = e
 	}
-	b.i, b.f = nil, nil
-	return
-}
-
-// allPacketsIter implements Iter.
-type allPacketsIter struct {
-	*BlockFile
-	blockData        []byte
-	block            *C.struct_tpacket_hdr_v1
-	pkt              *C.struct_tpacket3_hdr
-	blockPacketsRead int
-	blockOffset      int64
-	packetOffset     int // offset of packet in block
-	err              error
-	done             bool
-}
-
-func (a *allPacketsIter) Next() bool {
-	defer packetScanNanos.NanoTimer()()
-	if a.err != nil || a.done {
-		return false
-	}
-	for a.block == nil || a.blockPacketsRead == int(a.block.num_pkts) {
-		packetBlocksRead.Increment()
-		a.blockData = make([]byte, 1<<20)
-		_, err := a.f.ReadAt(a.blockData[:], a.blockOffset)
-		if err == io.EOF {
-			a.done = true
-			return false
-		} else if err != nil {
-			a.err = fmt.Errorf("could not read block at %v: %v", a.blockOffset, err)
-			return false
+	if b.mapped != nil {
+		if e := b.mapped.Close(); e != nil {
+			err = e
 		}
-		baseHdr := (*C.struct_tpacket_block_desc)(unsafe.Pointer(&a.blockData[0]))
-		a.block = (*C.struct_tpacket_hdr_v1)(unsafe.Pointer(&baseHdr.hdr[0]))
-		a.blockOffset += 1 << 20
-		a.blockPacketsRead = 0
-		a.pkt = nil
-	}
-	a.blockPacketsRead++
-	if a.pkt == nil {
-		a.packetOffset = int(a.block.offset_to_first_pkt)
-	} else if a.pkt.tp_next_offset != 0 {
-		a.packetOffset += int(a.pkt.tp_next_offset)
-	} else {
-		a.err = errors.New("block format currently not supported")
-		return false
 	}
-	a.pkt = (*C.struct_tpacket3_hdr)(unsafe.Pointer(&a.blockData[a.packetOffset]))
-	packetsScanned.Increment()
-	return true
-}
-
-func (a *allPacketsIter) Packet() *base.Packet {
-	start := a.packetOffset + int(a.pkt.tp_mac)
-	buf := a.blockData[start : start+int(a.pkt.tp_snaplen)]
-	p := &base.Packet{Data: buf}
-	p.CaptureInfo.Timestamp = time.Unix(int64(a.pkt.tp_sec), int64(a.pkt.tp_nsec))
-	p.CaptureInfo.Length = int(a.pkt.tp_len)
-	p.CaptureInfo.CaptureLength = int(a.pkt.tp_snaplen)
-	return p
-}
-
-func (a *allPacketsIter) Err() error {
-	return a.err
+	b.i, b.f, b.data, b.mapped = nil, nil, nil, nil
+	return
 }
 
 // AllPackets returns a packet channel to which all packets in the blockfile are
 // sent.
 func (b *BlockFile) AllPackets() *base.PacketChan {
-	b.mu.RLock()
+	pkts := b.Iterate()
 	c := base.NewPacketChan(100)
 	go func() {
-		defer b.mu.RUnlock()
-		pkts := &allPacketsIter{BlockFile: b}
+		defer pkts.Close()
+		batch := make([]*base.Packet, 0, 64)
 		for pkts.Next() {
-			c.Send(pkts.Packet())
+			if batch = append(batch, pkts.Packet()); len(batch) == cap(batch) {
+				c.SendBatch(batch)
+				batch = batch[:0]
+			}
 		}
+		c.SendBatch(batch)
 		c.Close(pkts.Err())
 	}()
 	return c
@@ -224,64 +439,292 @@ func (b *BlockFile) positionsLocked(ctx context.Context, q query.Query) (base.Po
 		// If we're closed, just return nothing.
 		return nil, nil
 	}
-	return q.LookupIn(ctx, b.i)
+	return query.Lookup(ctx, q, b.i, func(candidates base.Positions, keys *indexfile.ScanKeys) (*indexfile.IndexFile, error) {
+		return b.scan(ctx, candidates, keys)
+	})
+}
+
+// scanReserveBytes is how much memory scan reserves at a time for the
+// positions it indexes, each charged at scanPositionBytes, which covers the
+// position, its share of its key, and its copy in the table written.
+const (
+	scanReserveBytes  = 1 << 20
+	scanPositionBytes = 16
+)
+
+// scan indexes the packets at 'candidates', which may be AllPositions, by the
+// key types in keys, for queries needing keys the blockfile's index doesn't
+// hold.  The memory the index holds is reserved from the budget ctx carries
+// as it grows, failing the scan once it doesn't fit.  Damaged blocks are
+// skipped.  b.mu must be locked.
+func (b *BlockFile) scan(ctx context.Context, candidates base.Positions, keys *indexfile.ScanKeys) (*indexfile.IndexFile, error) {
+	index := indexfile.NewScanBuilder(keys)
+	budget := base.MemoryBudgetFromContext(ctx)
+	var scanned, reserved int64
+	// reserve makes sure the memory the index holds is reserved, returning
+	// false, with budgetErr set, if it can't be.
+	var budgetErr error
+	reserve := func() bool {
+		for budgetErr == nil && index.Positions()*scanPositionBytes > reserved {
+			if budgetErr = budget.Reserve(scanReserveBytes); budgetErr == nil {
+				reserved += scanReserveBytes
+			}
+		}
+		return budgetErr == nil
+	}
+	if candidates.IsAllPositions() {
+		it := b.iterator(time.Time{}, time.Time{})
+		defer it.Close()
+		for it.NextBlock() && !base.ContextDone(ctx) && reserve() {
+			if it.BlockErr() != nil {
+				continue
+			}
+			forEachPacket(it.block, func(offset int, _ time.Time, length int, pkt []byte) {
+				index.AddPacketLength(pkt, length, it.BlockOffset()+int64(offset))
+				scanned++
+			})
+		}
+		if err := it.Err(); err != nil {
+			return nil, err
+		}
+	} else {
+		var ci gopacket.CaptureInfo
+		var meta base.PacketMetadata
+		for _, pos := range candidates {
+			if pos >= b.valid || base.ContextDone(ctx) || !reserve() {
+				break
+			}
+			buffer, err := b.readPacket(b.data, pos, &ci, &meta)
+			if err != nil {
+				return nil, fmt.Errorf("could not read packet at %d: %v", pos, err)
+			}
+			index.AddPacketLength(buffer, ci.Length, pos)
+			base.PutBuffer(buffer)
+			scanned++
+		}
+	}
+	packetsScannedForIndex.IncrementBy(scanned)
+	if !reserve() {
+		return nil, budgetErr
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return index.Open(b.i.Name())
 }
 
 // Lookup returns all packets in the blockfile matched by the passed-in query.
 func (b *BlockFile) Lookup(ctx context.Context, q query.Query, out *base.PacketChan) {
+	// The file lock comes first, as Expire takes it before b.mu.
+	lock, err := b.lockShared()
+	if os.IsNotExist(err) {
+		v(2, "Blockfile %q removed, skipping", b.name)
+		out.Close(nil)
+		return
+	} else if err != nil {
+		out.Close(err)
+		return
+	}
+	defer lock.Unlock()
 	b.mu.RLock()
 	defer b.mu.RUnlock()
 
-	var ci gopacket.CaptureInfo
 	v(2, "Blockfile %q looking up query %q", b.name, q.String())
-	start := time.Now()
+	// Positions are held until this lookup's done reading them.
+	budget := base.NewMemoryBudget(0, base.MemoryBudgetFromContext(ctx))
+	defer budget.ReleaseAll()
+	ctx = base.WithMemoryBudget(ctx, budget)
+	began := time.Now()
+	start, end := query.TimeRange(q)
+	if b.skipFile(start, end) {
+		v(2, "Blockfile %q has no blocks in the query's time range", b.name)
+		blocksSkipped.IncrementBy(int64(len(b.blocks)))
+		out.Close(ctx.Err())
+		return
+	}
 	positions, err := b.positionsLocked(ctx, q)
-	if err != nil {
+	if _, ok := err.(*base.BudgetError); ok {
+		// Too broad to hold all its positions at once, so it's answered a
+		// slice of the file at a time instead, reading every packet.
+		budget.ReleaseAll()
+		lookupsSliced.Increment()
+		v(2, "Blockfile %q lookup over budget, scanning a slice at a time", b.name)
+		adv := b.newAdvisor(AccessSequential, start, end)
+		defer adv.done()
+		if err := b.lookupSlices(ctx, q, start, end, adv, out); err != nil {
+			out.Close(err)
+			return
+		}
+		v(2, "Blockfile %q finished scanning all packets in %v", b.name, time.Since(began))
+		out.Close(ctx.Err())
+		return
+	} else if err != nil {
 		out.Close(fmt.Errorf("index lookup failure: %v", err))
 		return
 	}
+	if !positions.IsAllPositions() {
+		positions = b.pruneBlocks(positions, start, end)
+	}
+	access := accessFromContext(ctx)
+	if access == AccessAuto {
+		access = b.chooseAccess(positions)
+	}
+	adv := b.newAdvisor(access, start, end)
+	defer adv.done()
 	if positions.IsAllPositions() {
 		v(2, "Blockfile %q reading all packets", b.name)
-		iter := &allPacketsIter{BlockFile: b}
-	all_packets_loop:
-		for iter.Next() {
-			select {
-			case <-ctx.Done():
-				v(2, "Blockfile %q canceling packet read", b.name)
-				break all_packets_loop
-			case <-b.done:
-				v(2, "Blockfile %q closing, breaking out of query", b.name)
-				break all_packets_loop
-			case out.C <- iter.Packet():
-			}
-		}
-		if iter.Err() != nil {
-			out.Close(fmt.Errorf("error reading all packets from %q: %v", b.name, iter.Err()))
+		adv.all()
+		iter := b.iterator(start, end)
+		iter.data = adv.data
+		defer iter.Close()
+		if err := iter.Send(ctx, out); err != nil {
+			out.Close(fmt.Errorf("error reading all packets from %q: %v", b.name, err))
 			return
 		}
 	} else {
-		v(2, "Blockfile %q reading %v packets", b.name, len(positions))
-	query_packets_loop:
-		for _, pos := range positions {
-			buffer, err := b.readPacket(pos, &ci)
-			if err != nil {
-				v(2, "Blockfile %q error reading packet: %v", b.name, err)
-				out.Close(fmt.Errorf("error reading packets from %q @ %v: %v", b.name, pos, err))
-				return
+		v(2, "Blockfile %q reading %v packets, %s access", b.name, len(positions), access)
+		if _, err := b.sendPackets(ctx, positions, adv, out); err != nil {
+			out.Close(err)
+			return
+		}
+	}
+	v(2, "Blockfile %q finished reading all packets in %v", b.name, time.Since(began))
+	out.Close(ctx.Err())
+}
+
+// sendPackets sends the packets at positions to out, returning false if the
+// lookup was stopped first.
+func (b *BlockFile) sendPackets(ctx context.Context, positions base.Positions, adv *advisor, out *base.PacketChan) (bool, error) {
+	var ci gopacket.CaptureInfo
+	var meta base.PacketMetadata
+	for i, pos := range positions {
+		if pos >= b.valid {
+			// Positions increase, so the rest are lost to truncation too.
+			salvagedPositionsSkipped.IncrementBy(int64(len(positions) - i))
+			v(2, "Blockfile %q skipping %d packets past its truncation", b.name, len(positions)-i)
+			break
+		}
+		adv.ahead(positions, i)
+		buffer, err := b.readPacket(adv.data, pos, &ci, &meta)
+		if err != nil {
+			v(2, "Blockfile %q error reading packet: %v", b.name, err)
+			return false, fmt.Errorf("error reading packets from %q @ %v: %v", b.name, pos, err)
+		}
+		select {
+		case <-ctx.Done():
+			v(2, "Blockfile %q canceling packet read", b.name)
+			return false, nil
+		case <-b.done:
+			v(2, "Blockfile %q closing, breaking out of query", b.name)
+			return false, nil
+		case <-out.Canceled():
+			v(2, "Blockfile %q output canceled, stopping packet read", b.name)
+			return false, nil
+		case out.C <- b.newPacket(buffer, ci, meta):
+		}
+	}
+	return true, nil
+}
+
+// lookupSliceBlocks is how many blocks lookupSlices scans at a time.
+const lookupSliceBlocks = 16
+
+// lookupSlices sends the packets in [start, end) matching q to out, for
+// lookups whose positions don't fit in their memory budget.  It scans the
+// blockfile lookupSliceBlocks at a time, indexing each slice's packets in
+// memory by the key types q needs, and looking q up in that, so only a
+// slice's positions are held at once.  It fails only if one slice's don't
+// fit either.  b.mu must be locked.
+func (b *BlockFile) lookupSlices(ctx context.Context, q query.Query, start, end time.Time, adv *advisor, out *base.PacketChan) error {
+	if b.i == nil || b.f == nil {
+		return nil
+	}
+	// An index holding no key types makes query.Lookup record all those q
+	// needs, and scan the slice for them.
+	empty, err := indexfile.NewScanBuilder(&indexfile.ScanKeys{}).Open(b.i.Name())
+	if err != nil {
+		return err
+	}
+	defer empty.Close()
+	it := b.iterator(start, end)
+	it.data = adv.data
+	defer it.Close()
+	for more := true; more && !base.ContextDone(ctx); {
+		var slice base.Positions
+		for n := 0; n < lookupSliceBlocks; n++ {
+			if more = it.NextBlock(); !more {
+				break
+			} else if it.BlockErr() != nil {
+				continue
 			}
-			select {
-			case <-ctx.Done():
-				v(2, "Blockfile %q canceling packet read", b.name)
-				break query_packets_loop
-			case <-b.done:
-				v(2, "Blockfile %q closing, breaking out of query", b.name)
-				break query_packets_loop
-			case out.C <- &base.Packet{Data: buffer, CaptureInfo: ci}:
+			forEachPacket(it.block, func(offset int, _ time.Time, _ int, _ []byte) {
+				slice = append(slice, it.BlockOffset()+int64(offset))
+			})
+		}
+		if err := it.Err(); err != nil {
+			return err
+		} else if len(slice) == 0 {
+			continue
+		}
+		budget := base.NewMemoryBudget(0, base.MemoryBudgetFromContext(ctx))
+		sliceCtx := base.WithMemoryBudget(ctx, budget)
+		positions, err := query.Lookup(sliceCtx, q, empty, func(_ base.Positions, keys *indexfile.ScanKeys) (*indexfile.IndexFile, error) {
+			return b.scan(sliceCtx, slice, keys)
+		})
+		if err == nil && positions.IsAllPositions() {
+			positions = slice // q needs no keys, like a time-only query.
+		}
+		if err == nil {
+			var sent bool
+			if sent, err = b.sendPackets(ctx, positions, adv, out); err == nil && !sent {
+				more = false
 			}
 		}
+		budget.ReleaseAll()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MayMatch returns false if the IP filter of the blockfile's index rules out q
+// matching any of its packets (see query.MayMatch).  The filter is held in
+// memory, so it reads nothing, and doesn't wait for other lookups.
+func (b *BlockFile) MayMatch(q query.Query) bool {
+	f, _ := b.filter.Load().(indexfile.IPFilter)
+	return query.MayMatch(q, f)
+}
+
+// IndexOutdated returns whether rebuilding the blockfile's index with opts
+// would let it answer more queries itself (see indexfile.IndexFile.Outdated).
+func (b *BlockFile) IndexOutdated(opts indexfile.BuilderOptions) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.i != nil && b.i.Outdated(opts)
+}
+
+// IndexWriter returns the software which wrote the blockfile's index, as
+// indexfile.IndexFile.Writer does, or "" if it has none.
+func (b *BlockFile) IndexWriter() string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.i == nil {
+		return ""
+	}
+	return b.i.Writer()
+}
+
+// SetIndexCacheSize keeps the positions of recent lookups in the blockfile's
+// index in memory, up to about 'bytes' of them, or with zero, stops, as
+// indexfile.IndexFile.SetCacheSize does.  Indexes replaced by Expire start
+// without a cache.
+func (b *BlockFile) SetIndexCacheSize(bytes int64) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.i != nil {
+		b.i.SetCacheSize(bytes)
 	}
-	v(2, "Blockfile %q finished reading all packets in %v", b.name, time.Since(start))
-	out.Close(ctx.Err())
 }
 
 // DumpIndex dumps out a "human-readable" debug version of the blockfile's index
@@ -16,7 +16,9 @@ package blockfile
 
 import (
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"golang.org/x/net/context"
 
@@ -50,6 +52,14 @@ func TestPositions(t *testing.T) {
 		// tests
 		{"port 67", base.Positions{1048624, 1049024, 1049448, 1049848}},
 		{"port 69", nil},
+		{"portrange 60-70", base.Positions{1048624, 1049024, 1049448, 1049848}},
+		// The testdata's index holds neither MACs nor lengths, so these are
+		// found by reading packets.
+		{"ether host 00:08:74:ad:f1:9b", base.Positions{1049024, 1049848}},
+		{"port 67 and ether host ff:ff:ff:ff:ff:ff", base.Positions{1048624, 1049448}},
+		{"len > 320 or host ff02::2", base.Positions{48, 200, 1049024, 1049848}},
+		{"len > 320 or ether host ff:ff:ff:ff:ff:ff", base.Positions{1048624, 1049024, 1049448, 1049848}},
+		{"port 69 and ether host ff:ff:ff:ff:ff:ff", nil},
 	} {
 		// code to run single test
 		if q, err := query.NewQuery(test.query); err != nil {
@@ -61,3 +71,93 @@ func TestPositions(t *testing.T) {
 		}
 	}
 }
+
+func TestPositionsScanBudget(t *testing.T) {
+	blk := testBlockFile(t, filename)
+	defer blk.Close()
+	q, err := query.NewQuery("ether host 00:08:74:ad:f1:9b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Reading packets to find their MACs holds the positions indexed
+	// against the lookup's budget.
+	budget := base.NewMemoryBudget(1<<10, nil)
+	if _, err := blk.Positions(base.WithMemoryBudget(ctx, budget), q); err == nil {
+		t.Error("scan fit in a 1KB budget")
+	} else if !strings.Contains(err.Error(), "query too broad") {
+		t.Errorf("want a budget error, got %v", err)
+	}
+	budget = base.NewMemoryBudget(4*scanReserveBytes, nil)
+	if got, err := blk.Positions(base.WithMemoryBudget(ctx, budget), q); err != nil || len(got) == 0 {
+		t.Errorf("scan within budget: got %v, %v", got, err)
+	} else if budget.Used() < scanReserveBytes {
+		t.Errorf("scan reserved %d bytes, want at least %d", budget.Used(), scanReserveBytes)
+	}
+}
+
+func TestLookupSlices(t *testing.T) {
+	blk := testBlockFile(t, filename)
+	defer blk.Close()
+	collect := func(c *base.PacketChan) (out []string) {
+		for p := range c.Receive() {
+			out = append(out, string(p.Data))
+		}
+		return out
+	}
+	for _, qs := range []string{"port 67", "port 69", "ether host 00:08:74:ad:f1:9b", "len > 320 or host ff02::2", "port 67 and ether host ff:ff:ff:ff:ff:ff"} {
+		q, err := query.NewQuery(qs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := base.NewPacketChan(100)
+		go blk.Lookup(ctx, q, c)
+		want := collect(c)
+		sliced := base.NewPacketChan(100)
+		go func() {
+			blk.mu.RLock()
+			defer blk.mu.RUnlock()
+			sliced.Close(blk.lookupSlices(ctx, q, time.Time{}, time.Time{}, blk.newAdvisor(AccessNormal, time.Time{}, time.Time{}), sliced))
+		}()
+		if got := collect(sliced); !reflect.DeepEqual(got, want) {
+			t.Errorf("%q: sliced lookup got %d packets, want %d", qs, len(got), len(want))
+		} else if err := sliced.Err(); err != nil {
+			t.Errorf("%q: %v", qs, err)
+		}
+	}
+	// Lookups over budget fall back to scanning slices, which fail only if
+	// a slice doesn't fit either.
+	q, err := query.NewQuery("port 67")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := base.NewPacketChan(100)
+	go blk.Lookup(base.WithMemoryBudget(ctx, base.NewMemoryBudget(16, nil)), q, c)
+	collect(c)
+	if err := c.Err(); err == nil || !strings.Contains(err.Error(), "could not scan packets") {
+		t.Errorf("want slice scan over budget, got %v", err)
+	}
+}
+
+func TestPacketMetadata(t *testing.T) {
+	blk := testBlockFile(t, filename)
+	defer blk.Close()
+	blk.SetCaptureSource("eth3", 2)
+	q, err := query.NewQuery("port 67")
+	if err != nil {
+		t.Fatal(err)
+	}
+	looked := base.NewPacketChan(100)
+	go blk.Lookup(ctx, q, looked)
+	for name, c := range map[string]*base.PacketChan{"lookup": looked, "all": blk.AllPackets()} {
+		count := 0
+		for p := range c.Receive() {
+			count++
+			if p.Meta.Interface != "eth3" || p.Meta.Thread != 2 {
+				t.Errorf("%s: wrong metadata %+v", name, p.Meta)
+			}
+		}
+		if count == 0 {
+			t.Errorf("%s: no packets", name)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blockfile
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/google/stenographer/cryptfile"
+)
+
+// Compressed and encrypted blockfiles check their own blocks.  Uncompressed
+// ones, as stenotype writes them, can have each block's CRC32C recorded in a
+// checksum file beside them, hidden and named for the blockfile (see
+// ChecksumPath), so Verify catches any change to their packets too:
+//
+//	magic "STENOC01", uncompressed size uint64, then each block's CRC32C uint32
+//
+// All integers are little-endian.  The size ties the checksums to their
+// blockfile, so those left over from a file since replaced by one of another
+// size are ignored.  Blocks freed by Expire are rewritten empty, so empty
+// blocks aren't checked.  Packets are read without checking the checksums,
+// which would mean reading a whole block per packet.
+const (
+	checksumMagic      = "STENOC01"
+	checksumHeaderSize = 16
+)
+
+// ChecksumPath returns the path of the checksum file of the named blockfile.
+func ChecksumPath(filename string) string {
+	return filepath.Join(filepath.Dir(filename), "."+filepath.Base(filename)+".crc")
+}
+
+// hasOwnChecksums returns true if data, as returned by openData, checks its
+// blocks itself, being compressed or encrypted.
+func hasOwnChecksums(data io.ReaderAt) bool {
+	switch d := data.(type) {
+	case *os.File:
+		return false
+	case *v2Reader:
+		return hasOwnChecksums(d.r)
+	}
+	return true
+}
+
+// WriteChecksums records the CRC32C of each block of the named uncompressed,
+// unencrypted blockfile in its checksum file, unless one matching its size is
+// already there.  Compressed and encrypted blockfiles are left alone.
+func WriteChecksums(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	s, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if encrypted, err := cryptfile.IsEncrypted(f); err != nil || encrypted {
+		return err
+	}
+	data, err := openData(f, s.Size(), nil)
+	if err != nil {
+		return err
+	} else if hasOwnChecksums(data) {
+		return nil
+	}
+	size := dataSize(data, s.Size())
+	if readChecksums(filename, size) != nil {
+		return nil
+	}
+	out := make([]byte, checksumHeaderSize, checksumHeaderSize+(size+blockSize-1)/blockSize*4)
+	copy(out, checksumMagic)
+	binary.LittleEndian.PutUint64(out[8:], uint64(size))
+	block := make([]byte, blockSize)
+	var crc [4]byte
+	for off := int64(0); off < size; off += blockSize {
+		n, err := data.ReadAt(block, off)
+		if err != nil && !(err == io.EOF && n > 0) {
+			return err
+		}
+		binary.LittleEndian.PutUint32(crc[:], crc32.Checksum(block[:n], castagnoli))
+		out = append(out, crc[:]...)
+	}
+	path := ChecksumPath(filename)
+	tmp := path + ".writing"
+	defer os.Remove(tmp) // Renamed away on success.
+	if err := ioutil.WriteFile(tmp, out, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// readChecksums returns the block checksums recorded for the named blockfile,
+// whose data is 'size' bytes, or nil if it has none, or they're for another
+// size.
+func readChecksums(filename string, size int64) []uint32 {
+	buf, err := ioutil.ReadFile(ChecksumPath(filename))
+	if err != nil || len(buf) < checksumHeaderSize || string(buf[:8]) != checksumMagic ||
+		int64(binary.LittleEndian.Uint64(buf[8:])) != size ||
+		int64(len(buf)-checksumHeaderSize) != (size+blockSize-1)/blockSize*4 {
+		return nil
+	}
+	crcs := make([]uint32, 0, (len(buf)-checksumHeaderSize)/4)
+	for b := buf[checksumHeaderSize:]; len(b) > 0; b = b[4:] {
+		crcs = append(crcs, binary.LittleEndian.Uint32(b))
+	}
+	return crcs
+}
@@ -0,0 +1,85 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blockfile
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestChecksums(t *testing.T) {
+	raw := filepath.Join(t.TempDir(), "dhcp")
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(raw, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteChecksums(raw); err != nil {
+		t.Fatal(err)
+	}
+	if bad, err := Verify(raw); err != nil || len(bad) != 0 {
+		t.Fatalf("want no corruption, got %v, %v", bad, err)
+	}
+
+	// The last byte of block 1 lies past its packets, so only its checksum
+	// covers it.
+	corrupt(t, raw, 2*blockSize-1)
+	bad, err := Verify(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bad) != 1 || bad[0].Offset != blockSize || !strings.Contains(bad[0].Err.Error(), "checksum") {
+		t.Errorf("want block 1 to fail its checksum, got %v", bad)
+	}
+	// Existing checksums are kept, so rewriting them doesn't hide damage.
+	if err := WriteChecksums(raw); err != nil {
+		t.Fatal(err)
+	}
+	if bad, err := Verify(raw); err != nil || len(bad) != 1 {
+		t.Errorf("want block 1 still corrupt, got %v, %v", bad, err)
+	}
+	// Without checksums, the change goes unnoticed.
+	if err := os.Remove(ChecksumPath(raw)); err != nil {
+		t.Fatal(err)
+	}
+	if bad, err := Verify(raw); err != nil || len(bad) != 0 {
+		t.Errorf("want no corruption found without checksums, got %v, %v", bad, err)
+	}
+
+	// Those of another file of the same name are ignored.
+	if err := WriteChecksums(raw); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(raw, data[:3*blockSize], 0600); err != nil {
+		t.Fatal(err)
+	}
+	if bad, err := Verify(raw); err != nil || len(bad) != 0 {
+		t.Errorf("want checksums of another size ignored, got %v, %v", bad, err)
+	}
+
+	// Compressed files check their own blocks.
+	path := compressedCopy(t, "dhcp")
+	if err := WriteChecksums(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(ChecksumPath(path)); !os.IsNotExist(err) {
+		t.Errorf("want no checksum file for a compressed file, got %v", err)
+	}
+}
@@ -0,0 +1,390 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blockfile
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/google/stenographer/base"
+	"github.com/google/stenographer/stats"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compressed blockfiles hold the same TPACKET_V3 blocks stenotype writes, but
+// each block is compressed separately, so reading a packet at a given
+// position (as recorded in the index) only decompresses its block.  Layout:
+//
+//	header:  magic, codec uint16, flags uint16, block size uint32
+//	frames:  one compressed frame per block
+//	table:   per block, frame offset uint64, frame length uint32, and
+//	         CRC32C of the uncompressed block uint32
+//	trailer: table offset uint64, block count uint64, uncompressed size
+//	         uint64, magic
+//
+// All integers are little-endian.  Uncompressed blockfiles start with a
+// TPACKET block descriptor, whose version field is never the magic's first
+// four bytes, so the two formats can be told apart.  Files with the original
+// "STENOZ01" magic have no checksums in their block table, and are still
+// readable.  The only flag, compressedV2, marks files holding a compressed v2
+// blockfile, so opening one needn't read (and trust) its first block to learn
+// its format.  Frames are zstd, or for files written before zstd was
+// supported, snappy, which is still read but no longer written.
+const (
+	compressedMagic       = "STENOZ02"
+	compressedMagicV1     = "STENOZ01"
+	compressedHeaderSize  = 16
+	compressedTrailerSize = 32
+	compressedEntrySize   = 16
+	compressedEntrySizeV1 = 12
+	blockSize             = 1 << 20
+	compressedV2          = 1 << 0
+	// decompressedCacheBlocks is how many decompressed blocks each compressed
+	// blockfile keeps.  Queries read positions in order, so most reads hit
+	// the block the previous read did.
+	decompressedCacheBlocks = 4
+)
+
+// Compression names a block compression codec, as set in a thread's config.
+const (
+	CompressionNone = ""
+	CompressionZstd = "zstd"
+)
+
+// codecs maps compression names to the IDs recorded in file headers.
+// codecSnappy is no longer configurable, so only tests write it.
+var codecs = map[string]uint16{CompressionZstd: codecZstd}
+
+const (
+	codecSnappy = 1
+	codecZstd   = 2
+)
+
+var (
+	// zstdEncoder and zstdDecoder compress and decompress whole blocks,
+	// which they may do concurrently.  Frames decompressing to more than a
+	// block are rejected.
+	zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+	zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0), zstd.WithDecoderMaxMemory(blockSize))
+)
+
+var (
+	blocksDecompressed    = stats.S.Get("blockfile_blocks_decompressed")
+	blockDecompressNanos  = stats.S.Get("blockfile_block_decompress_nanos")
+	blockfilesCompressed  = stats.S.Get("blockfiles_compressed")
+	compressedInputBytes  = stats.S.Get("blockfile_compressed_input_bytes")
+	compressedOutputBytes = stats.S.Get("blockfile_compressed_output_bytes")
+	checksumFailures      = stats.S.Get("blockfile_checksum_failures")
+)
+
+// KnownCompression returns true if name is a supported compression codec, or
+// CompressionNone.
+func KnownCompression(name string) bool {
+	_, ok := codecs[name]
+	return ok || name == CompressionNone
+}
+
+// IsCompressed returns true if the named blockfile is compressed.
+func IsCompressed(filename string) (bool, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	return isCompressed(f)
+}
+
+func isCompressed(r io.ReaderAt) (bool, error) {
+	var magic [len(compressedMagic)]byte
+	if _, err := r.ReadAt(magic[:], 0); err == io.EOF {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return string(magic[:]) == compressedMagic || string(magic[:]) == compressedMagicV1, nil
+}
+
+// castagnoli is the CRC32C table, for block checksums.
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// CompressFile writes a compressed copy of the uncompressed blockfile src to
+// dst, using the named codec.  Packet positions are unchanged, so src's index
+// serves dst too.
+func CompressFile(src, dst, codec string) error {
+	id, ok := codecs[codec]
+	if !ok {
+		return fmt.Errorf("unknown compression codec %q", codec)
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if compressed, err := isCompressed(in); err != nil {
+		return err
+	} else if compressed {
+		return fmt.Errorf("%q is already compressed", src)
+	}
+	var flags uint16
+	if v2, err := isV2(in); err != nil {
+		return err
+	} else if v2 {
+		flags |= compressedV2
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if err := compress(in, out, id, flags); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return fmt.Errorf("could not compress %q: %v", src, err)
+	}
+	if err := base.SyncFile(out); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	return out.Close()
+}
+
+// compress writes the compressed form of the blocks read from in to out.
+func compress(in io.Reader, out io.Writer, codec, flags uint16) error {
+	w := &countingWriter{w: out}
+	header := make([]byte, compressedHeaderSize)
+	copy(header, compressedMagic)
+	binary.LittleEndian.PutUint16(header[8:], codec)
+	binary.LittleEndian.PutUint16(header[10:], flags)
+	binary.LittleEndian.PutUint32(header[12:], blockSize)
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	var table []byte
+	var size int64
+	block := make([]byte, blockSize)
+	var frame []byte
+	for {
+		n, err := io.ReadFull(in, block)
+		if err == io.EOF {
+			break
+		} else if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		size += int64(n)
+		if codec == codecSnappy {
+			frame = snappy.Encode(frame[:cap(frame)], block[:n])
+		} else {
+			frame = zstdEncoder.EncodeAll(block[:n], frame[:0])
+		}
+		var entry [compressedEntrySize]byte
+		binary.LittleEndian.PutUint64(entry[:], uint64(w.n))
+		binary.LittleEndian.PutUint32(entry[8:], uint32(len(frame)))
+		binary.LittleEndian.PutUint32(entry[12:], crc32.Checksum(block[:n], castagnoli))
+		table = append(table, entry[:]...)
+		if _, err := w.Write(frame); err != nil {
+			return err
+		}
+		if n < blockSize {
+			break
+		}
+	}
+	trailer := make([]byte, compressedTrailerSize)
+	binary.LittleEndian.PutUint64(trailer, uint64(w.n))
+	binary.LittleEndian.PutUint64(trailer[8:], uint64(len(table)/compressedEntrySize))
+	binary.LittleEndian.PutUint64(trailer[16:], uint64(size))
+	copy(trailer[24:], compressedMagic)
+	if _, err := w.Write(append(table, trailer...)); err != nil {
+		return err
+	}
+	compressedInputBytes.IncrementBy(size)
+	compressedOutputBytes.IncrementBy(w.n)
+	blockfilesCompressed.Increment()
+	return nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// frame locates one compressed block.
+type frame struct {
+	off int64
+	n   int
+	crc uint32 // Of the uncompressed block
+}
+
+// decompressedBlock is a cached, decompressed block.
+type decompressedBlock struct {
+	index int
+	data  []byte
+}
+
+// compressedReader reads a compressed blockfile as if it were uncompressed.
+type compressedReader struct {
+	f      io.ReaderAt
+	codec  uint16
+	size   int64 // Uncompressed size
+	frames []frame
+	crcs   bool // False for files written before frames had checksums
+	v2     bool // Holds a v2 blockfile
+	mu     sync.Mutex
+	cache  []decompressedBlock // Most recently used first
+}
+
+// newCompressedReader reads the block table of the compressed blockfile f,
+// which is fileSize bytes long.
+func newCompressedReader(f io.ReaderAt, fileSize int64) (*compressedReader, error) {
+	if fileSize < compressedHeaderSize+compressedTrailerSize {
+		return nil, fmt.Errorf("compressed blockfile too short")
+	}
+	header := make([]byte, compressedHeaderSize)
+	if _, err := f.ReadAt(header, 0); err != nil {
+		return nil, err
+	}
+	codec := binary.LittleEndian.Uint16(header[8:])
+	if codec != codecSnappy && codec != codecZstd {
+		return nil, fmt.Errorf("unknown compression codec %d", codec)
+	}
+	if bs := binary.LittleEndian.Uint32(header[12:]); bs != blockSize {
+		return nil, fmt.Errorf("unsupported block size %d", bs)
+	}
+	trailer := make([]byte, compressedTrailerSize)
+	if _, err := f.ReadAt(trailer, fileSize-compressedTrailerSize); err != nil {
+		return nil, err
+	}
+	magic := string(header[:len(compressedMagic)])
+	if string(trailer[24:]) != magic {
+		return nil, fmt.Errorf("compressed blockfile trailer missing, file may be truncated")
+	}
+	entrySize := int64(compressedEntrySize)
+	if magic == compressedMagicV1 {
+		entrySize = compressedEntrySizeV1
+	}
+	tableOff := int64(binary.LittleEndian.Uint64(trailer))
+	count := int64(binary.LittleEndian.Uint64(trailer[8:]))
+	if tableOff < compressedHeaderSize || tableOff+count*entrySize != fileSize-compressedTrailerSize {
+		return nil, fmt.Errorf("compressed blockfile has a corrupt block table")
+	}
+	table := make([]byte, count*entrySize)
+	if _, err := f.ReadAt(table, tableOff); err != nil {
+		return nil, err
+	}
+	r := &compressedReader{
+		f:     f,
+		codec: codec,
+		size:  int64(binary.LittleEndian.Uint64(trailer[16:])),
+		crcs:  magic == compressedMagic,
+		v2:    binary.LittleEndian.Uint16(header[10:])&compressedV2 != 0,
+	}
+	for i := int64(0); i < count; i++ {
+		e := table[i*entrySize:]
+		fr := frame{off: int64(binary.LittleEndian.Uint64(e)), n: int(binary.LittleEndian.Uint32(e[8:]))}
+		if r.crcs {
+			fr.crc = binary.LittleEndian.Uint32(e[12:])
+		}
+		if fr.off < compressedHeaderSize || fr.off+int64(fr.n) > tableOff {
+			return nil, fmt.Errorf("compressed block %d out of bounds", i)
+		}
+		r.frames = append(r.frames, fr)
+	}
+	if r.size > count*blockSize || count > 0 && r.size <= (count-1)*blockSize {
+		return nil, fmt.Errorf("compressed blockfile size %d doesn't match its %d blocks", r.size, count)
+	}
+	return r, nil
+}
+
+// copyBlock copies block i, from offset 'start' within it, into p,
+// decompressing it unless it's cached.
+func (r *compressedReader) copyBlock(i int, p []byte, start int) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	data, err := r.block(i)
+	if err != nil {
+		return 0, err
+	}
+	if start >= len(data) {
+		return 0, io.ErrUnexpectedEOF
+	}
+	return copy(p, data[start:]), nil
+}
+
+// block returns the decompressed data of block i.  r.mu must be held while
+// the result is in use, since it may be reused once evicted.
+func (r *compressedReader) block(i int) ([]byte, error) {
+	for j, b := range r.cache {
+		if b.index == i {
+			copy(r.cache[1:j+1], r.cache[:j])
+			r.cache[0] = b
+			return b.data, nil
+		}
+	}
+	defer blockDecompressNanos.NanoTimer()()
+	blocksDecompressed.Increment()
+	fr := r.frames[i]
+	compressed := make([]byte, fr.n)
+	if _, err := r.f.ReadAt(compressed, fr.off); err != nil {
+		return nil, fmt.Errorf("could not read compressed block %d: %v", i, err)
+	}
+	var buf []byte
+	if last := len(r.cache) - 1; last+1 == decompressedCacheBlocks {
+		buf = r.cache[last].data[:cap(r.cache[last].data)]
+		r.cache = r.cache[:last]
+	}
+	var data []byte
+	var err error
+	if r.codec == codecSnappy {
+		data, err = snappy.Decode(buf, compressed)
+	} else {
+		data, err = zstdDecoder.DecodeAll(compressed, buf[:0])
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not decompress block %d: %v", i, err)
+	}
+	if r.crcs && crc32.Checksum(data, castagnoli) != fr.crc {
+		checksumFailures.Increment()
+		return nil, fmt.Errorf("block %d failed its checksum", i)
+	}
+	r.cache = append([]decompressedBlock{{i, data}}, r.cache...)
+	return data, nil
+}
+
+// ReadAt reads uncompressed data, as an uncompressed blockfile's ReadAt would.
+func (r *compressedReader) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) {
+		if off >= r.size {
+			return n, io.EOF
+		}
+		c, err := r.copyBlock(int(off/blockSize), p[n:], int(off%blockSize))
+		if err != nil {
+			return n, err
+		}
+		n += c
+		off += int64(c)
+	}
+	return n, nil
+}
@@ -0,0 +1,133 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blockfile
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/google/stenographer/base"
+	"github.com/google/stenographer/query"
+)
+
+// compressedCopy compresses the named test blockfile into a temporary
+// directory, alongside a copy of its index, returning the compressed path.
+func compressedCopy(t *testing.T, name string) string {
+	dir := t.TempDir()
+	for _, sub := range []string{"PKT0", "IDX0"} {
+		if err := os.Mkdir(filepath.Join(dir, sub), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	index, err := ioutil.ReadFile("../testdata/IDX0/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "IDX0", name), index, 0600); err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(dir, "PKT0", name)
+	if err := CompressFile("../testdata/PKT0/"+name, out, CompressionZstd); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestCompressedBlockFile(t *testing.T) {
+	path := compressedCopy(t, "dhcp")
+	if compressed, err := IsCompressed(path); err != nil || !compressed {
+		t.Fatalf("want compressed, got %v, %v", compressed, err)
+	}
+	if compressed, err := IsCompressed(filename); err != nil || compressed {
+		t.Fatalf("want uncompressed, got %v, %v", compressed, err)
+	}
+	raw, zipped := testBlockFile(t, filename), testBlockFile(t, path)
+	defer raw.Close()
+	defer zipped.Close()
+	if zipped.Size() >= raw.Size() {
+		t.Errorf("compressed size %d not smaller than %d", zipped.Size(), raw.Size())
+	}
+	q, err := query.NewQuery("port 67")
+	if err != nil {
+		t.Fatal(err)
+	}
+	collect := func(c *base.PacketChan) (out [][]byte) {
+		for p := range c.Receive() {
+			out = append(out, append([]byte(nil), p.Data...))
+		}
+		if err := c.Err(); err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+	lookup := func(b *BlockFile) [][]byte {
+		c := base.NewPacketChan(100)
+		go b.Lookup(ctx, q, c)
+		return collect(c)
+	}
+	if want, got := lookup(raw), lookup(zipped); len(want) != 4 || !reflect.DeepEqual(want, got) {
+		t.Errorf("lookup mismatch: want %d packets, got %d", len(want), len(got))
+	}
+	if want, got := collect(raw.AllPackets()), collect(zipped.AllPackets()); len(want) == 0 || !reflect.DeepEqual(want, got) {
+		t.Errorf("all packets mismatch: want %d packets, got %d", len(want), len(got))
+	}
+	if err := CompressFile(path, path+".again", CompressionZstd); err == nil {
+		t.Error("want error compressing a compressed file")
+	}
+}
+
+func TestCompressedReaderReadAt(t *testing.T) {
+	want, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Files written with snappy, before zstd was supported, are still read.
+	for _, codec := range []uint16{codecZstd, codecSnappy} {
+		var buf bytes.Buffer
+		if err := compress(bytes.NewReader(want), &buf, codec, 0); err != nil {
+			t.Fatal(err)
+		}
+		r, err := newCompressedReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rng := rand.New(rand.NewSource(1))
+		for i := 0; i < 100; i++ {
+			// Reads span block boundaries, and overrun the end.
+			off := rng.Int63n(int64(len(want)))
+			got := make([]byte, rng.Intn(3*blockSize))
+			n, err := r.ReadAt(got, off)
+			wantN := len(got)
+			if rest := len(want) - int(off); rest < wantN {
+				wantN = rest
+			}
+			if n != wantN || (n < len(got)) != (err != nil) {
+				t.Fatalf("codec %d: ReadAt(%d bytes, %d): got %d, %v; want %d bytes", codec, len(got), off, n, err, wantN)
+			}
+			if !bytes.Equal(got[:n], want[off:off+int64(n)]) {
+				t.Fatalf("codec %d: ReadAt(%d bytes, %d): wrong data", codec, len(got), off)
+			}
+		}
+		truncated := buf.Bytes()[:buf.Len()-1]
+		if _, err := newCompressedReader(bytes.NewReader(truncated), int64(len(truncated))); err == nil {
+			t.Errorf("codec %d: want error for truncated file", codec)
+		}
+	}
+}
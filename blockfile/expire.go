@@ -0,0 +1,241 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blockfile
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/google/stenographer/base"
+	"github.com/google/stenographer/indexfile"
+	"github.com/google/stenographer/stats"
+	"golang.org/x/net/context"
+)
+
+// #include <linux/falloc.h>
+// #include <linux/if_packet.h>
+import "C"
+
+// Expiring packets frees the space of whole blocks in place: each expired
+// block is rewritten as an empty block, and all but the page holding its
+// block descriptor is punched out of the file, so the filesystem frees it.
+// The file keeps its size and layout, so every block stays where it was, and
+// readers just see empty blocks.
+
+// expiredPageSize is how much of each expired block is kept, holding its
+// empty block descriptor.  Blocks start on page boundaries, so the rest of
+// the block is whole pages, which the filesystem can free.
+const expiredPageSize = 4096
+
+// ErrNotExpirable is returned by Expire for blockfiles it can't free space in:
+// those which are compressed or encrypted, whose blocks aren't stored as
+// they're read.
+var ErrNotExpirable = errors.New("compressed and encrypted blockfiles can't be expired in place")
+
+var (
+	blocksExpired  = stats.S.Get("blockfile_blocks_expired")
+	packetsExpired = stats.S.Get("blockfile_packets_expired")
+)
+
+// Expired describes what Expire freed from a blockfile.
+type Expired struct {
+	Blocks, Packets int // Freed
+	Remaining       int // Packets left in the file
+}
+
+// expiredBlock is a block for Expire to free.
+type expiredBlock struct {
+	offset int64 // In the uncompressed data
+	desc   []byte
+}
+
+// Expire frees the blocks of the blockfile all of whose packets are older
+// than 'before', unless they hold a packet at one of the positions in
+// 'pinned', and removes their packets from the index.  If pinned is
+// AllPositions, nothing is freed.  The index is replaced before any block is
+// freed, so a crash part way through leaves packets unindexed, never indexed
+// packets missing.  Queries continue while the new index is written, and wait
+// while blocks are freed, which is quick.
+func (b *BlockFile) Expire(ctx context.Context, before time.Time, pinned base.Positions) (Expired, error) {
+	b.expireMu.Lock()
+	defer b.expireMu.Unlock()
+	var ex Expired
+	diskOffset, ok := b.diskOffset()
+	if !ok || b.keys != nil {
+		return ex, ErrNotExpirable
+	}
+	if pinned.IsAllPositions() {
+		return ex, nil
+	}
+	b.mu.RLock()
+	var blocks []expiredBlock
+	err := errClosed
+	if b.i != nil {
+		blocks, ex, err = b.expiredBlocks(before, pinned)
+	}
+	if err != nil || len(blocks) == 0 {
+		b.mu.RUnlock()
+		return ex, err
+	}
+	idx := b.i.Name()
+	tmp := filepath.Join(filepath.Dir(idx), "."+filepath.Base(idx)+".expiring")
+	os.Remove(tmp)       // Left over if we crashed while expiring.
+	defer os.Remove(tmp) // Renamed away on success.
+	err = b.i.WriteFiltered(ctx, tmp, func(pos int64) bool {
+		i := sort.Search(len(blocks), func(i int) bool { return blocks[i].offset+blockSize > pos })
+		return i == len(blocks) || pos < blocks[i].offset
+	})
+	b.mu.RUnlock()
+	if err != nil {
+		return Expired{}, err
+	}
+	f, err := os.OpenFile(b.name, os.O_WRONLY, 0)
+	if err != nil {
+		return Expired{}, err
+	}
+	defer f.Close()
+	if b.shared {
+		// Readers elsewhere mustn't see blocks vanish mid-read, so if they're
+		// busy, expiry waits for the next pass.  The file lock is taken
+		// before b.mu, as readers take it.
+		lock, err := LockExclusive(b.name)
+		if err != nil {
+			return Expired{}, err
+		}
+		defer lock.Unlock()
+	}
+
+	b.mu.Lock()
+	defer func() {
+		b.mu.Unlock()
+		b.statsMu.Lock()
+		b.stats = nil
+		b.statsMu.Unlock()
+	}()
+	if b.i == nil {
+		return Expired{}, errClosed
+	}
+	if err := os.Rename(tmp, idx); err != nil {
+		return Expired{}, err
+	} else if err := base.SyncDir(idx); err != nil {
+		return Expired{}, err
+	}
+	i, err := indexfile.NewIndexFile(idx, b.fc)
+	if err != nil {
+		// The old index can't be trusted to read the new file, so queries
+		// return nothing until the blockfile is reopened.
+		b.i.Close()
+		b.i = nil
+		b.filter.Store(indexfile.IPFilter{})
+		return Expired{}, fmt.Errorf("could not reopen index %q: %v", idx, err)
+	}
+	b.i.Close()
+	b.i = i
+	b.filter.Store(i.IPFilter())
+	if s, err := os.Stat(idx); err == nil {
+		b.ids[1] = s
+	}
+	for _, blk := range blocks {
+		if err := b.freeBlock(f, diskOffset, blk); err != nil {
+			return Expired{}, fmt.Errorf("could not free block at %d: %v", blk.offset, err)
+		}
+	}
+	if err := base.SyncFile(f); err != nil {
+		return Expired{}, err
+	}
+	blocksExpired.IncrementBy(int64(ex.Blocks))
+	packetsExpired.IncrementBy(int64(ex.Packets))
+	v(1, "Blockfile %q expired %d packets in %d blocks", b.name, ex.Packets, ex.Blocks)
+	return ex, nil
+}
+
+// diskOffset returns the offset in the file on disk at which the blocks of
+// its uncompressed data start, or false if they aren't stored as they're
+// read.
+func (b *BlockFile) diskOffset() (int64, bool) {
+	data, offset := b.data, int64(0)
+	if v2, ok := data.(*v2Reader); ok {
+		data, offset = v2.r, v2.offset
+	}
+	return offset, data == io.ReaderAt(b.f) || b.mapped != nil && data == io.ReaderAt(b.mapped)
+}
+
+// expiredBlocks returns the blocks Expire should free, in order, counting
+// their packets and those left.  Only block descriptors are read, since they
+// record the time of their blocks' last packets.  b.mu must be locked.
+func (b *BlockFile) expiredBlocks(before time.Time, pinned base.Positions) (blocks []expiredBlock, ex Expired, _ error) {
+	for off := int64(0); off < b.valid; off += blockSize {
+		desc := make([]byte, C.sizeof_struct_tpacket_block_desc)
+		if _, err := b.data.ReadAt(desc, off); err != nil {
+			return nil, ex, fmt.Errorf("could not read block descriptor at %d: %v", off, err)
+		}
+		bd := (*C.struct_tpacket_block_desc)(unsafe.Pointer(&desc[0]))
+		hdr := (*C.struct_tpacket_hdr_v1)(unsafe.Pointer(&bd.hdr[0]))
+		packets := int(hdr.num_pkts)
+		if packets == 0 {
+			continue
+		}
+		last := blockTimestamp(&hdr.ts_last_pkt)
+		i := sort.Search(len(pinned), func(i int) bool { return pinned[i] >= off })
+		if !last.Before(before) || i < len(pinned) && pinned[i] < off+blockSize {
+			ex.Remaining += packets
+			continue
+		}
+		blocks = append(blocks, expiredBlock{offset: off, desc: desc})
+		ex.Blocks++
+		ex.Packets += packets
+	}
+	return blocks, ex, nil
+}
+
+// blockTimestamp returns a block descriptor timestamp, as set by
+// setBlockTimestamp.
+func blockTimestamp(bts *C.struct_tpacket_bd_ts) time.Time {
+	return time.Unix(int64(bts.ts_sec), int64(*(*C.uint)(unsafe.Pointer(&bts.anon0[0])))).UTC()
+}
+
+// freeBlock rewrites a block as an empty one, then punches out all of it but
+// its first page.  b.mu must be locked.
+func (b *BlockFile) freeBlock(f *os.File, diskOffset int64, blk expiredBlock) error {
+	page := make([]byte, expiredPageSize)
+	copy(page, blk.desc)
+	desc := (*C.struct_tpacket_block_desc)(unsafe.Pointer(&page[0]))
+	hdr := (*C.struct_tpacket_hdr_v1)(unsafe.Pointer(&desc.hdr[0]))
+	hdr.num_pkts = 0
+	hdr.blk_len = hdr.offset_to_first_pkt
+	hdr.ts_first_pkt, hdr.ts_last_pkt = C.struct_tpacket_bd_ts{}, C.struct_tpacket_bd_ts{}
+	off := diskOffset + blk.offset
+	if _, err := f.WriteAt(page, off); err != nil {
+		return err
+	}
+	if i := int(blk.offset / blockSize); i < len(b.blocks) {
+		// Mark the block empty in the v2 block table too, which follows the
+		// blocks.
+		entry := make([]byte, v2TableEntrySize)
+		tableOff := diskOffset + int64(len(b.blocks))*blockSize
+		if _, err := f.WriteAt(entry, tableOff+int64(i)*v2TableEntrySize); err != nil {
+			return err
+		}
+		b.blocks[i] = BlockMeta{}
+	}
+	return syscall.Fallocate(int(f.Fd()), C.FALLOC_FL_PUNCH_HOLE|C.FALLOC_FL_KEEP_SIZE, off+expiredPageSize, blockSize-expiredPageSize)
+}
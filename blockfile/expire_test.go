@@ -0,0 +1,117 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blockfile
+
+import (
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/google/stenographer/base"
+)
+
+// allocated returns the bytes the named file takes up on disk.
+func allocated(t *testing.T, path string) int64 {
+	s, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s.Sys().(*syscall.Stat_t).Blocks * 512
+}
+
+func TestExpire(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		path func() string
+	}{
+		{"v1", func() string { return damagedCopy(t, "dhcp", 6<<20, 6<<20) }},
+		{"v2", func() string { return convertedCopy(t, "dhcp", "dhcp", Header{}) }},
+	} {
+		path := test.path()
+		blk := testBlockFile(t, path)
+		size, used := blk.Size(), allocated(t, path)
+		pinned, err := blk.Positions(ctx, mustQuery(t, "port 67"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Block 0 holds two packets, neither on port 67; block 1 the rest.
+		if ex, err := blk.Expire(ctx, time.Unix(1423704315, 0), nil); err != nil || ex != (Expired{Blocks: 1, Packets: 2, Remaining: 4}) {
+			t.Errorf("%v: expiring to block 1 got %+v, %v", test.name, ex, err)
+		}
+		if ex, err := blk.Expire(ctx, time.Now(), pinned); err != nil || ex != (Expired{Remaining: 4}) {
+			t.Errorf("%v: expiring pinned got %+v, %v", test.name, ex, err)
+		}
+		if got := countPackets(t, blk, "port 67"); got != 4 {
+			t.Errorf("%v: got %d pinned packets, want 4", test.name, got)
+		}
+		if got := len(allPackets(t, blk.AllPackets())); got != 4 {
+			t.Errorf("%v: got %d packets, want 4", test.name, got)
+		}
+		if s, err := blk.Stats(ctx); err != nil || s.Packets != 4 {
+			t.Errorf("%v: got stats %+v, %v, want 4 packets", test.name, s, err)
+		}
+		if ex, err := blk.Expire(ctx, time.Now(), nil); err != nil || ex != (Expired{Blocks: 1, Packets: 4}) {
+			t.Errorf("%v: expiring all got %+v, %v", test.name, ex, err)
+		}
+		if got := countPackets(t, blk, "port 67"); got != 0 {
+			t.Errorf("%v: got %d packets after expiry", test.name, got)
+		}
+		blk.Close()
+
+		// The file keeps its size and layout, just with empty blocks.
+		if corrupt, err := Verify(path); err != nil || len(corrupt) > 0 {
+			t.Errorf("%v: expired file corrupt: %v, %v", test.name, corrupt, err)
+		}
+		blk = testBlockFile(t, path)
+		if blk.Size() != size || blk.Truncated() {
+			t.Errorf("%v: expired file is %d bytes, truncated %v, was %d bytes", test.name, blk.Size(), blk.Truncated(), size)
+		}
+		for _, m := range blk.blocks {
+			if m.Packets != 0 {
+				t.Errorf("%v: block table not cleared: %+v", test.name, blk.blocks)
+			}
+		}
+		if got := len(allPackets(t, blk.AllPackets())); got != 0 {
+			t.Errorf("%v: got %d packets after reopening", test.name, got)
+		}
+		if got := countPackets(t, blk, "udp"); got != 0 {
+			t.Errorf("%v: index still has %d packets after reopening", test.name, got)
+		}
+		blk.Close()
+		if got := allocated(t, path); got > used-2*(blockSize-expiredPageSize) {
+			t.Errorf("%v: file uses %d bytes after expiry, %d before", test.name, got, used)
+		}
+	}
+}
+
+func TestExpireKeeps(t *testing.T) {
+	blk := testBlockFile(t, damagedCopy(t, "dhcp", 6<<20, 6<<20))
+	defer blk.Close()
+	if ex, err := blk.Expire(ctx, time.Unix(1423704299, 0), nil); err != nil || ex != (Expired{Remaining: 6}) {
+		t.Errorf("expiring nothing got %+v, %v", ex, err)
+	}
+	if ex, err := blk.Expire(ctx, time.Now(), base.AllPositions); err != nil || ex != (Expired{}) {
+		t.Errorf("expiring with everything pinned got %+v, %v", ex, err)
+	}
+	if got := countPackets(t, blk, "udp or ip proto 58"); got != 6 {
+		t.Errorf("got %d packets, want 6", got)
+	}
+	compressed := testBlockFile(t, compressedCopy(t, "dhcp"))
+	defer compressed.Close()
+	if _, err := compressed.Expire(ctx, time.Now(), nil); err != ErrNotExpirable {
+		t.Errorf("expiring a compressed file got %v", err)
+	}
+}
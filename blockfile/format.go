@@ -0,0 +1,359 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blockfile
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/google/stenographer/base"
+)
+
+// Blockfile format versions.  Stenotype writes v1 files, which are nothing
+// but TPACKET_V3 blocks.  V2 files hold the same blocks, but start with a
+// header describing the capture and end with a table summarizing each block,
+// so queries can skip blocks outside their time range without reading them.
+// Layout:
+//
+//	header:   magic, version uint16, host length uint16, interface length
+//	          uint16, flags uint16, snaplen uint32, timestamp resolution
+//	          uint32 (in nanoseconds), data offset uint64, block count
+//	          uint64, table offset uint64, created uint64 (Unix nanoseconds),
+//	          host, interface, then with v2Provenance, version length uint16,
+//	          filter length uint16, version, filter; the whole padded to
+//	          v2HeaderSize
+//	blocks:   as in v1
+//	table:    per block, first and last packet timestamps int64 (Unix
+//	          nanoseconds), packet count uint32, and captured bytes of
+//	          packet data uint32
+//
+// All integers are little-endian.  Flags mark optional parts: v2BlockBytes,
+// tables recording each block's captured bytes, which are reserved, and zero,
+// without it; v2Provenance, headers recording the capturing software and
+// filter.  The header is a whole page, so blocks stay aligned.  Index
+// positions are offsets into the blocks, as in v1, so converting a file
+// doesn't change its index.
+const (
+	FormatV1 = 1
+	FormatV2 = 2
+
+	v2Magic          = "STENOB02"
+	v2HeaderSize     = 4096
+	v2FixedSize      = 56
+	v2TableEntrySize = 24
+	v2BlockBytes     = 1 << 0
+	v2Provenance     = 1 << 1
+)
+
+// Header describes the capture a v2 blockfile's packets came from.
+type Header struct {
+	Host, Interface string
+	// SnapLen is the most bytes of each packet captured, or 0 if not known.
+	// Stenotype doesn't truncate packets itself.
+	SnapLen uint32
+	// TimestampResolution is the precision of packet timestamps.
+	TimestampResolution time.Duration
+	// Created is when the file was written in v2 format.
+	Created time.Time
+	// Version names the capturing software and their versions: stenographer,
+	// and the stenotype which wrote the file, with its index's format, like
+	// "stenographer 1.2.3, stenotype 1.2.3 (index format 2.5)".
+	Version string
+	// Filter is stenotype's capture filter, compiled BPF as passed to its
+	// --filter flag, or "" if it captured everything.
+	Filter string
+}
+
+// Provenance returns where the header says its packets came from.
+func (h Header) Provenance() *base.Provenance {
+	return &base.Provenance{Host: h.Host, Interface: h.Interface, Version: h.Version, Filter: h.Filter}
+}
+
+// headerStrings returns the variable-length strings of a header, in order.
+func (h Header) headerStrings() []string {
+	return []string{h.Host, h.Interface, h.Version, h.Filter}
+}
+
+// BlockMeta summarizes a block of a v2 blockfile.
+type BlockMeta struct {
+	First, Last time.Time // Earliest and latest packet timestamps, if any
+	Packets     int
+	Bytes       int // Captured bytes of the packets, if the table records them
+}
+
+// overlaps returns true if the block may hold packets in [start, end), either
+// of which may be zero to leave that side unbounded.
+func (m BlockMeta) overlaps(start, end time.Time) bool {
+	if m.Packets == 0 {
+		return false
+	}
+	return (start.IsZero() || !m.Last.Before(start)) && (end.IsZero() || m.First.Before(end))
+}
+
+// v2Reader reads the blocks of a v2 blockfile, as if they were a v1 file.
+type v2Reader struct {
+	r      io.ReaderAt
+	header Header
+	offset int64 // Of the first block
+	blocks []BlockMeta
+	// blockBytes is set if the block table records captured bytes.
+	blockBytes bool
+}
+
+func isV2(r io.ReaderAt) (bool, error) {
+	var magic [len(v2Magic)]byte
+	if _, err := r.ReadAt(magic[:], 0); err == io.EOF {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return string(magic[:]) == v2Magic, nil
+}
+
+// newV2Reader reads the header and block table of the v2 blockfile r, which is
+// size bytes long.
+func newV2Reader(r io.ReaderAt, size int64) (*v2Reader, error) {
+	buf := make([]byte, v2HeaderSize)
+	if _, err := r.ReadAt(buf, 0); err != nil {
+		return nil, fmt.Errorf("could not read v2 header: %v", err)
+	}
+	if version := binary.LittleEndian.Uint16(buf[8:]); version != FormatV2 {
+		return nil, fmt.Errorf("unsupported blockfile format version %d", version)
+	}
+	flags := binary.LittleEndian.Uint16(buf[14:])
+	v := &v2Reader{
+		r:          r,
+		offset:     int64(binary.LittleEndian.Uint64(buf[24:])),
+		blockBytes: flags&v2BlockBytes != 0,
+		header: Header{
+			SnapLen:             binary.LittleEndian.Uint32(buf[16:]),
+			TimestampResolution: time.Duration(binary.LittleEndian.Uint32(buf[20:])),
+			Created:             time.Unix(0, int64(binary.LittleEndian.Uint64(buf[48:]))).UTC(),
+		},
+	}
+	rest := buf[v2FixedSize:]
+	next := func(n int) (string, error) {
+		if n > len(rest) {
+			return "", fmt.Errorf("v2 header strings too long")
+		}
+		s := string(rest[:n])
+		rest = rest[n:]
+		return s, nil
+	}
+	var err error
+	if v.header.Host, err = next(int(binary.LittleEndian.Uint16(buf[10:]))); err != nil {
+		return nil, err
+	}
+	if v.header.Interface, err = next(int(binary.LittleEndian.Uint16(buf[12:]))); err != nil {
+		return nil, err
+	}
+	if flags&v2Provenance != 0 {
+		if len(rest) < 4 {
+			return nil, fmt.Errorf("v2 header strings too long")
+		}
+		versionLen, filterLen := int(binary.LittleEndian.Uint16(rest)), int(binary.LittleEndian.Uint16(rest[2:]))
+		rest = rest[4:]
+		if v.header.Version, err = next(versionLen); err != nil {
+			return nil, err
+		}
+		if v.header.Filter, err = next(filterLen); err != nil {
+			return nil, err
+		}
+	}
+	count := int64(binary.LittleEndian.Uint64(buf[32:]))
+	tableOff := int64(binary.LittleEndian.Uint64(buf[40:]))
+	if v.offset < v2HeaderSize || tableOff != v.offset+count*blockSize || tableOff+count*v2TableEntrySize != size {
+		return nil, fmt.Errorf("v2 blockfile has a corrupt block table, file may be truncated")
+	}
+	table := make([]byte, count*v2TableEntrySize)
+	if _, err := r.ReadAt(table, tableOff); err != nil {
+		return nil, fmt.Errorf("could not read v2 block table: %v", err)
+	}
+	for i := int64(0); i < count; i++ {
+		e := table[i*v2TableEntrySize:]
+		var meta BlockMeta
+		if meta.Packets = int(binary.LittleEndian.Uint32(e[16:])); meta.Packets > 0 {
+			meta.First = time.Unix(0, int64(binary.LittleEndian.Uint64(e))).UTC()
+			meta.Last = time.Unix(0, int64(binary.LittleEndian.Uint64(e[8:]))).UTC()
+			meta.Bytes = int(binary.LittleEndian.Uint32(e[20:]))
+		}
+		v.blocks = append(v.blocks, meta)
+	}
+	return v, nil
+}
+
+// Size returns the size of the blocks.
+func (v *v2Reader) Size() int64 {
+	return int64(len(v.blocks)) * blockSize
+}
+
+func (v *v2Reader) ReadAt(p []byte, off int64) (int, error) {
+	size := v.Size()
+	if off >= size {
+		return 0, io.EOF
+	}
+	short := false
+	if int64(len(p)) > size-off {
+		p, short = p[:size-off], true
+	}
+	n, err := v.r.ReadAt(p, v.offset+off)
+	if err == nil && short {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// FileFormat returns the format version of the named blockfile, which may be
+// compressed but not encrypted.
+func FileFormat(filename string) (int, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	s, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	data, err := openData(f, s.Size(), nil)
+	if err != nil {
+		return 0, err
+	}
+	if _, ok := data.(*v2Reader); ok {
+		return FormatV2, nil
+	}
+	return FormatV1, nil
+}
+
+// ConvertFile writes a v2 copy of the uncompressed v1 blockfile src to dst,
+// with the given header, summarizing each of its blocks.  Created and
+// TimestampResolution are filled in if unset.  Packet positions are
+// unchanged, so src's index serves dst too.
+func ConvertFile(src, dst string, h Header) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	for _, check := range []func(io.ReaderAt) (bool, error){isCompressed, isV2} {
+		if not, err := check(in); err != nil {
+			return err
+		} else if not {
+			return fmt.Errorf("%q is not an uncompressed v1 blockfile", src)
+		}
+	}
+	n := 4 // Version and filter lengths
+	for _, s := range h.headerStrings() {
+		if len(s) > 0xffff {
+			return fmt.Errorf("header string of %d bytes too long", len(s))
+		}
+		n += len(s)
+	}
+	if n > v2HeaderSize-v2FixedSize {
+		return fmt.Errorf("header strings too long, %d bytes", n)
+	}
+	if h.Created.IsZero() {
+		h.Created = time.Now()
+	}
+	if h.TimestampResolution == 0 {
+		// TPACKET_V3 headers carry nanosecond timestamps.
+		h.TimestampResolution = time.Nanosecond
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if err := convert(in, out, h); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return fmt.Errorf("could not convert %q: %v", src, err)
+	}
+	if err := base.SyncFile(out); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	return out.Close()
+}
+
+// convert writes the v2 form of the v1 blocks read from in to out.
+func convert(in io.Reader, out io.WriterAt, h Header) error {
+	var table []byte
+	block := make([]byte, blockSize)
+	offset := int64(v2HeaderSize)
+	for {
+		if _, err := io.ReadFull(in, block); err == io.EOF {
+			break
+		} else if err == io.ErrUnexpectedEOF {
+			return fmt.Errorf("truncated block at %d", offset-v2HeaderSize)
+		} else if err != nil {
+			return err
+		}
+		var meta BlockMeta
+		if err := checkBlock(block); err != nil {
+			return fmt.Errorf("block at %d: %v", offset-v2HeaderSize, err)
+		}
+		forEachPacket(block, func(_ int, ts time.Time, _ int, data []byte) {
+			meta.Bytes += len(data)
+			if meta.Packets == 0 || ts.Before(meta.First) {
+				meta.First = ts
+			}
+			if meta.Packets == 0 || ts.After(meta.Last) {
+				meta.Last = ts
+			}
+			meta.Packets++
+		})
+		var entry [v2TableEntrySize]byte
+		if meta.Packets > 0 {
+			binary.LittleEndian.PutUint64(entry[:], uint64(meta.First.UnixNano()))
+			binary.LittleEndian.PutUint64(entry[8:], uint64(meta.Last.UnixNano()))
+			binary.LittleEndian.PutUint32(entry[16:], uint32(meta.Packets))
+			binary.LittleEndian.PutUint32(entry[20:], uint32(meta.Bytes))
+		}
+		table = append(table, entry[:]...)
+		if _, err := out.WriteAt(block, offset); err != nil {
+			return err
+		}
+		offset += blockSize
+	}
+	if _, err := out.WriteAt(table, offset); err != nil {
+		return err
+	}
+	header := make([]byte, v2HeaderSize)
+	copy(header, v2Magic)
+	binary.LittleEndian.PutUint16(header[8:], FormatV2)
+	binary.LittleEndian.PutUint16(header[10:], uint16(len(h.Host)))
+	binary.LittleEndian.PutUint16(header[12:], uint16(len(h.Interface)))
+	binary.LittleEndian.PutUint16(header[14:], v2BlockBytes|v2Provenance)
+	binary.LittleEndian.PutUint32(header[16:], h.SnapLen)
+	binary.LittleEndian.PutUint32(header[20:], uint32(h.TimestampResolution))
+	binary.LittleEndian.PutUint64(header[24:], v2HeaderSize)
+	binary.LittleEndian.PutUint64(header[32:], uint64(len(table)/v2TableEntrySize))
+	binary.LittleEndian.PutUint64(header[40:], uint64(offset))
+	binary.LittleEndian.PutUint64(header[48:], uint64(h.Created.UnixNano()))
+	rest := header[v2FixedSize:]
+	rest = rest[copy(rest, h.Host):]
+	rest = rest[copy(rest, h.Interface):]
+	binary.LittleEndian.PutUint16(rest, uint16(len(h.Version)))
+	binary.LittleEndian.PutUint16(rest[2:], uint16(len(h.Filter)))
+	rest = rest[4:]
+	rest = rest[copy(rest, h.Version):]
+	copy(rest, h.Filter)
+	_, err := out.WriteAt(header, 0)
+	return err
+}
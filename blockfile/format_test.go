@@ -0,0 +1,174 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blockfile
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/stenographer/base"
+	"github.com/google/stenographer/query"
+)
+
+// convertedCopy converts the named test blockfile to v2 in a temporary
+// directory, under the given name, alongside a copy of its index.
+func convertedCopy(t *testing.T, name, as string, h Header) string {
+	dir := t.TempDir()
+	for _, sub := range []string{"PKT0", "IDX0"} {
+		if err := os.Mkdir(filepath.Join(dir, sub), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	index, err := ioutil.ReadFile("../testdata/IDX0/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "IDX0", as), index, 0600); err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(dir, "PKT0", as)
+	if err := ConvertFile("../testdata/PKT0/"+name, out, h); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func allPackets(t *testing.T, c *base.PacketChan) (out []*base.Packet) {
+	for p := range c.Receive() {
+		out = append(out, p)
+	}
+	if err := c.Err(); err != nil {
+		t.Error(err)
+	}
+	return out
+}
+
+func TestConvertFile(t *testing.T) {
+	created := time.Unix(1500000000, 0).UTC()
+	path := convertedCopy(t, "dhcp", "dhcp", Header{Host: "sensor1", Interface: "eth3", Created: created, Version: "stenographer 1.2.3", Filter: "0123abcd"})
+	if format, err := FileFormat(path); err != nil || format != FormatV2 {
+		t.Fatalf("want v2, got %v, %v", format, err)
+	}
+	if format, err := FileFormat(filename); err != nil || format != FormatV1 {
+		t.Fatalf("want v1, got %v, %v", format, err)
+	}
+	if err := ConvertFile(path, path+".again", Header{}); err == nil {
+		t.Error("converted a v2 file")
+	}
+	if err := ConvertFile(filename, path+".long", Header{Filter: strings.Repeat("0", v2HeaderSize)}); err == nil {
+		t.Error("converted with an oversized header")
+	}
+
+	v1, v2 := testBlockFile(t, filename), testBlockFile(t, path)
+	defer v1.Close()
+	defer v2.Close()
+	if _, ok := v1.Header(); ok || v1.Format() != FormatV1 {
+		t.Errorf("v1 file has a header")
+	}
+	want := Header{Host: "sensor1", Interface: "eth3", TimestampResolution: time.Nanosecond, Created: created, Version: "stenographer 1.2.3", Filter: "0123abcd"}
+	if h, ok := v2.Header(); !ok || v2.Format() != FormatV2 || h != want {
+		t.Errorf("wrong header: want %+v, got %+v", want, h)
+	}
+	first := time.Unix(1423704315, 61032208).UTC()
+	if len(v2.blocks) != 6 || v2.blocks[1] != (BlockMeta{First: first, Last: first.Add(27438 * time.Nanosecond), Packets: 4, Bytes: 1312}) {
+		t.Errorf("wrong block metadata %+v", v2.blocks)
+	}
+	prov := want.Provenance()
+	for _, c := range []func(*BlockFile) *base.PacketChan{
+		func(b *BlockFile) *base.PacketChan { return b.AllPackets() },
+		func(b *BlockFile) *base.PacketChan {
+			q, err := query.NewQuery("port 67")
+			if err != nil {
+				t.Fatal(err)
+			}
+			out := base.NewPacketChan(100)
+			go b.Lookup(ctx, q, out)
+			return out
+		},
+	} {
+		want, got := allPackets(t, c(v1)), allPackets(t, c(v2))
+		if len(got) == 0 || len(got) != len(want) {
+			t.Fatalf("want %d packets, got %d", len(want), len(got))
+		}
+		for i := range want {
+			if !reflect.DeepEqual(want[i].Data, got[i].Data) || !reflect.DeepEqual(want[i].CaptureInfo, got[i].CaptureInfo) {
+				t.Errorf("packet %d differs", i)
+			}
+			if want[i].Meta.Provenance != nil || !reflect.DeepEqual(got[i].Meta.Provenance, prov) {
+				t.Errorf("packet %d has provenance %+v from v1, %+v from v2", i, want[i].Meta.Provenance, got[i].Meta.Provenance)
+			}
+		}
+	}
+}
+
+func TestTimeRangeSkipsBlocks(t *testing.T) {
+	// Time queries need blockfiles named by their start time.
+	path := convertedCopy(t, "dhcp", "1423704299000000", Header{})
+	blk := testBlockFile(t, path)
+	defer blk.Close()
+	for _, test := range []struct {
+		query string
+		want  int
+	}{
+		{"after 2015-02-12T01:25:10Z", 4},              // Skips block 0
+		{"before 2015-02-12T01:25:10Z", 2},             // Skips block 1
+		{"port 67 and before 2015-02-12T01:25:10Z", 0}, // Port 67 is all in block 1
+		{"port 67 and after 2015-02-12T01:25:10Z", 4},
+		{"port 67 and before 2015-02-12T01:00:00Z", 0}, // Before every block
+		{"port 67 and after 2015-02-12T02:00:00Z", 0},  // After every block
+	} {
+		q, err := query.NewQuery(test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := base.NewPacketChan(100)
+		go blk.Lookup(ctx, q, out)
+		if got := len(allPackets(t, out)); got != test.want {
+			t.Errorf("%q: want %d packets, got %d", test.query, test.want, got)
+		}
+	}
+}
+
+func TestPruneBlocks(t *testing.T) {
+	path := convertedCopy(t, "dhcp", "1423704299000000", Header{})
+	blk := testBlockFile(t, path)
+	defer blk.Close()
+	split := time.Date(2015, 2, 12, 1, 25, 10, 0, time.UTC)
+	all := base.Positions{48, 448, blockSize + 48, blockSize + 448}
+	for _, test := range []struct {
+		start, end time.Time
+		want       base.Positions
+	}{
+		{time.Time{}, time.Time{}, all},
+		{split, time.Time{}, all[2:]},
+		{time.Time{}, split, all[:2]},
+	} {
+		positions := append(base.Positions{}, all...)
+		if got := blk.pruneBlocks(positions, test.start, test.end); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("pruneBlocks(%v, %v) = %v, want %v", test.start, test.end, got, test.want)
+		}
+	}
+	if blk.skipFile(split, time.Time{}) {
+		t.Error("skipped a file with packets after the split")
+	}
+	if !blk.skipFile(split.Add(time.Hour), time.Time{}) {
+		t.Error("didn't skip a file with no packets in range")
+	}
+}
@@ -0,0 +1,455 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blockfile
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+	"unsafe"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/google/stenographer/base"
+	"github.com/google/stenographer/indexfile"
+	"github.com/google/stenographer/stats"
+)
+
+// #include <linux/if_packet.h>
+import "C"
+
+// Imported blockfiles are split so each spans less than importFileSpan, much
+// as stenotype starts a new file every minute: time queries select whole
+// files by the start time in their names, and allow a minute's slack.  They
+// also stay within MaxBlocks.
+const (
+	importFileSpan = time.Minute
+	// blockHeaderSize is the size of a TPACKET_V3 block descriptor, after
+	// which the first packet starts.
+	blockHeaderSize = C.sizeof_struct_tpacket_block_desc
+	// packetAlign is TPACKET_ALIGNMENT, to which packets are aligned.
+	packetAlign = C.TPACKET_ALIGNMENT
+)
+
+var (
+	packetsImported    = stats.S.Get("blockfile_packets_imported")
+	blockfilesImported = stats.S.Get("blockfiles_imported")
+)
+
+// ImportedFile describes a blockfile written by Import.
+type ImportedFile struct {
+	Name        string // Base name, as for stenotype's files
+	Packets     int
+	First, Last time.Time
+}
+
+// Import converts a PCAP or pcapng stream of ethernet packets into blockfiles
+// in packetDir, with indexes in indexDir, named as stenotype would name them
+// for the time of their earliest packet.  Each blockfile is written under a
+// hidden name and linked into place, then its index the same way, so a thread
+// watching indexDir only finds complete pairs.  Packets are stored in the
+// order read, and indexed with opts.  Files written before an error are left
+// in place, and returned.
+//
+// Packets are indexed in batches by a goroutine per file, and each file is
+// finished (synced, its index written, and linked into place) in the
+// background while the next is filled, so neither holds up reading.
+func Import(r io.Reader, packetDir, indexDir string, opts indexfile.BuilderOptions) ([]ImportedFile, error) {
+	packets, err := newPcapSource(r)
+	if err != nil {
+		return nil, err
+	}
+	files := &importedFiles{indexDir: indexDir}
+	w := &importWriter{dir: packetDir, opts: opts}
+	defer func() { w.abort() }()
+	for {
+		data, ci, err := packets.ReadPacketData()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			if err := files.wait(); err != nil {
+				return files.out, err
+			}
+			return files.out, fmt.Errorf("could not read packet %d: %v", importedCount(files.out, w), err)
+		}
+		if !w.fits(ci.Timestamp, len(data)) {
+			if err := files.finish(w); err != nil {
+				return files.out, err
+			}
+			w = &importWriter{dir: packetDir, opts: opts}
+		}
+		if err := w.add(data, ci); err != nil {
+			return files.result(err)
+		}
+	}
+	if w.packets > 0 {
+		if err := files.finish(w); err != nil {
+			return files.out, err
+		}
+		w = &importWriter{dir: packetDir, opts: opts}
+	}
+	return files.result(nil)
+}
+
+// importedFiles finishes Import's blockfiles, one at a time, each in the
+// background while the next is filled.
+type importedFiles struct {
+	indexDir  string
+	out       []ImportedFile      // Those finished so far
+	finishing chan finishedImport // Of the file being finished, if any
+}
+
+type finishedImport struct {
+	f   ImportedFile
+	err error
+}
+
+// finish waits for the last file to be finished, then starts finishing w.
+func (i *importedFiles) finish(w *importWriter) error {
+	if err := i.wait(); err != nil {
+		return err
+	}
+	finishing := make(chan finishedImport, 1)
+	go func() {
+		f, err := w.finish(i.indexDir)
+		finishing <- finishedImport{f, err}
+	}()
+	i.finishing = finishing
+	return nil
+}
+
+// wait waits for the file being finished, if any, adding it to out, or
+// returning the error finishing it.
+func (i *importedFiles) wait() error {
+	if i.finishing == nil {
+		return nil
+	}
+	done := <-i.finishing
+	i.finishing = nil
+	if done.err != nil {
+		return done.err
+	}
+	i.out = append(i.out, done.f)
+	return nil
+}
+
+// result waits for the file being finished, and returns Import's result:
+// the files finished, and the error finishing the last of them, if any, or
+// else err.
+func (i *importedFiles) result(err error) ([]ImportedFile, error) {
+	if werr := i.wait(); werr != nil {
+		return i.out, werr
+	}
+	return i.out, err
+}
+
+// importedCount returns how many packets Import has read.
+func importedCount(files []ImportedFile, w *importWriter) int {
+	n := w.packets
+	for _, f := range files {
+		n += f.Packets
+	}
+	return n
+}
+
+// newPcapSource returns a reader of the PCAP or pcapng stream r, telling
+// them apart by their first four bytes.
+func newPcapSource(r io.Reader) (gopacket.PacketDataSource, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(4)
+	if err != nil {
+		return nil, fmt.Errorf("could not read capture header: %v", err)
+	}
+	var link layers.LinkType
+	var src gopacket.PacketDataSource
+	if binary.LittleEndian.Uint32(magic) == pcapngSectionHeader {
+		ng, err := pcapgo.NewNgReader(br, pcapgo.DefaultNgReaderOptions)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pcapng: %v", err)
+		}
+		link, src = ng.LinkType(), ng
+	} else {
+		p, err := pcapgo.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("invalid PCAP: %v", err)
+		}
+		link, src = p.LinkType(), p
+	}
+	if link != layers.LinkTypeEthernet {
+		return nil, fmt.Errorf("can only import ethernet captures, not %v", link)
+	}
+	return src, nil
+}
+
+// pcapngSectionHeader is the block type starting every pcapng file, which
+// reads the same in either byte order.
+const pcapngSectionHeader = 0x0a0d0d0a
+
+// importWriter writes one blockfile, building its index in memory.
+type importWriter struct {
+	dir          string   // For the blockfile
+	out          *os.File // Hidden, until finished
+	opts         indexfile.BuilderOptions
+	blocks       int
+	block        []byte // The block being filled, written when full
+	offset       int    // Of the next packet in block
+	last         int    // Offset of the last packet in block, or 0 if none
+	index        *batchIndexer
+	packets      int
+	first, ended time.Time // Earliest and latest packet timestamps
+}
+
+// packetHeaderSize is the space before each packet's data.
+const packetHeaderSize = (C.sizeof_struct_tpacket3_hdr + packetAlign - 1) &^ (packetAlign - 1)
+
+// full returns true if a packet of n bytes needs a new block.
+func (w *importWriter) full(n int) bool {
+	return w.block == nil || w.offset > blockHeaderSize && w.offset+packetHeaderSize+n > blockSize
+}
+
+// fits returns true if a packet of n bytes with the given timestamp belongs
+// in this file.
+func (w *importWriter) fits(ts time.Time, n int) bool {
+	if w.packets == 0 {
+		return true
+	}
+	first, last := w.first, w.ended
+	if ts.Before(first) {
+		first = ts
+	} else if ts.After(last) {
+		last = ts
+	}
+	return last.Sub(first) < importFileSpan && !(w.full(n) && w.blocks == MaxBlocks)
+}
+
+// add appends a packet, truncating it if larger than a block can hold.
+func (w *importWriter) add(data []byte, ci gopacket.CaptureInfo) error {
+	if w.full(len(data)) {
+		if err := w.newBlock(); err != nil {
+			return err
+		}
+	}
+	if max := blockSize - w.offset - packetHeaderSize; len(data) > max {
+		data = data[:max]
+	}
+	desc := (*C.struct_tpacket_block_desc)(unsafe.Pointer(&w.block[0]))
+	hdr := (*C.struct_tpacket_hdr_v1)(unsafe.Pointer(&desc.hdr[0]))
+	if w.last != 0 {
+		prev := (*C.struct_tpacket3_hdr)(unsafe.Pointer(&w.block[w.last]))
+		prev.tp_next_offset = C.__u32(w.offset - w.last)
+	}
+	pkt := (*C.struct_tpacket3_hdr)(unsafe.Pointer(&w.block[w.offset]))
+	ts := ci.Timestamp
+	pkt.tp_sec = C.__u32(ts.Unix())
+	pkt.tp_nsec = C.__u32(ts.Nanosecond())
+	pkt.tp_snaplen = C.__u32(len(data))
+	pkt.tp_len = C.__u32(ci.Length)
+	if ci.Length < len(data) {
+		pkt.tp_len = C.__u32(len(data))
+	}
+	pkt.tp_mac = packetHeaderSize
+	pkt.tp_net = packetHeaderSize + 14 // Past the ethernet header
+	copy(w.block[w.offset+packetHeaderSize:], data)
+	w.index.add(data, int(pkt.tp_len), int64(w.blocks-1)*blockSize+int64(w.offset))
+
+	if hdr.num_pkts == 0 {
+		setBlockTimestamp(&hdr.ts_first_pkt, ts)
+	}
+	setBlockTimestamp(&hdr.ts_last_pkt, ts)
+	hdr.num_pkts++
+	w.last = w.offset
+	w.offset += (packetHeaderSize + len(data) + packetAlign - 1) &^ (packetAlign - 1)
+	if w.offset > blockSize {
+		w.offset = blockSize
+	}
+	hdr.blk_len = C.__u32(w.offset)
+	if w.packets == 0 || ts.Before(w.first) {
+		w.first = ts
+	}
+	if w.packets == 0 || ts.After(w.ended) {
+		w.ended = ts
+	}
+	w.packets++
+	return nil
+}
+
+// setBlockTimestamp sets a block descriptor timestamp, whose nanoseconds sit
+// in an anonymous union, which cgo exposes only as bytes.
+func setBlockTimestamp(bts *C.struct_tpacket_bd_ts, ts time.Time) {
+	bts.ts_sec = C.uint(ts.Unix())
+	*(*C.uint)(unsafe.Pointer(&bts.anon0[0])) = C.uint(ts.Nanosecond())
+}
+
+// newBlock writes out the current block, if any, and starts a new one.
+func (w *importWriter) newBlock() error {
+	if w.block == nil {
+		out, err := ioutil.TempFile(w.dir, ".importing")
+		if err != nil {
+			return err
+		}
+		w.out, w.index = out, newBatchIndexer(w.opts)
+		w.block = make([]byte, blockSize)
+	} else {
+		if _, err := w.out.Write(w.block); err != nil {
+			return err
+		}
+		for i := range w.block {
+			w.block[i] = 0
+		}
+	}
+	desc := (*C.struct_tpacket_block_desc)(unsafe.Pointer(&w.block[0]))
+	desc.version = C.TPACKET_V3
+	desc.offset_to_priv = blockHeaderSize
+	hdr := (*C.struct_tpacket_hdr_v1)(unsafe.Pointer(&desc.hdr[0]))
+	hdr.block_status = C.TP_STATUS_USER
+	hdr.offset_to_first_pkt = blockHeaderSize
+	hdr.blk_len = blockHeaderSize
+	hdr.seq_num = C.__u64(w.blocks)
+	w.blocks++
+	w.offset, w.last = blockHeaderSize, 0
+	return nil
+}
+
+// abort removes the hidden blockfile, if it wasn't finished.
+func (w *importWriter) abort() {
+	if w.index != nil {
+		w.index.wait()
+	}
+	if w.out != nil {
+		w.out.Close()
+		os.Remove(w.out.Name())
+		w.out = nil
+	}
+}
+
+// finish writes out the blockfile and its index, named for the earliest
+// packet's time in microseconds, or the next free microsecond after it.
+func (w *importWriter) finish(indexDir string) (ImportedFile, error) {
+	f := ImportedFile{Packets: w.packets, First: w.first, Last: w.ended}
+	defer w.abort()
+	if _, err := w.out.Write(w.block); err != nil {
+		return f, err
+	}
+	if err := base.SyncFile(w.out); err != nil {
+		return f, err
+	}
+	idxTmp := filepath.Join(indexDir, filepath.Base(w.out.Name()))
+	if err := w.index.wait().WriteFile(idxTmp); err != nil {
+		return f, err
+	}
+	defer os.Remove(idxTmp)
+	// Link rather than rename, so we never replace an existing file.
+	for micros := w.first.UnixNano() / 1000; ; micros++ {
+		f.Name = strconv.FormatInt(micros, 10)
+		if err := os.Link(w.out.Name(), filepath.Join(w.dir, f.Name)); os.IsExist(err) {
+			continue
+		} else if err != nil {
+			return f, err
+		}
+		break
+	}
+	if err := base.SyncDir(w.out.Name()); err != nil {
+		os.Remove(filepath.Join(w.dir, f.Name))
+		return f, err
+	}
+	if err := os.Link(idxTmp, filepath.Join(indexDir, f.Name)); err != nil {
+		os.Remove(filepath.Join(w.dir, f.Name))
+		return f, err
+	} else if err := base.SyncDir(idxTmp); err != nil {
+		return f, err
+	}
+	packetsImported.IncrementBy(int64(w.packets))
+	blockfilesImported.Increment()
+	return f, nil
+}
+
+// indexBatchSize is how many packets a batchIndexer hands its goroutine at
+// once, and indexBatchesQueued how many batches it queues before add blocks.
+const (
+	indexBatchSize     = 256
+	indexBatchesQueued = 4
+)
+
+// indexedPacket is a packet waiting to be indexed.
+type indexedPacket struct {
+	data   []byte
+	length int
+	pos    int64
+}
+
+// batchIndexer builds an index in a goroutine of its own, from packets
+// passed to it in batches, so decoding and indexing them overlaps with
+// writing them out.  Packets' data is held until they're indexed, rather than
+// copied: pcapgo's readers return a new slice for each packet.
+type batchIndexer struct {
+	batch   []indexedPacket
+	batches chan []indexedPacket // Closed by wait
+	done    chan struct{}        // Closed once all batches are indexed
+	index   *indexfile.Builder
+}
+
+func newBatchIndexer(opts indexfile.BuilderOptions) *batchIndexer {
+	b := &batchIndexer{
+		batches: make(chan []indexedPacket, indexBatchesQueued),
+		done:    make(chan struct{}),
+		index:   indexfile.NewBuilder(opts),
+	}
+	// The goroutine ranges over its own copy of the channel, as wait clears
+	// the field, maybe before it starts.
+	batches := b.batches
+	go func() {
+		defer close(b.done)
+		for batch := range batches {
+			for _, p := range batch {
+				b.index.AddPacketLength(p.data, p.length, p.pos)
+			}
+		}
+	}()
+	return b
+}
+
+// add queues a packet to be indexed, as by Builder.AddPacketLength.
+func (b *batchIndexer) add(data []byte, length int, pos int64) {
+	if b.batch == nil {
+		b.batch = make([]indexedPacket, 0, indexBatchSize)
+	}
+	b.batch = append(b.batch, indexedPacket{data, length, pos})
+	if len(b.batch) == indexBatchSize {
+		b.batches <- b.batch
+		b.batch = nil
+	}
+}
+
+// wait indexes the packets still queued, stops the goroutine, and returns
+// the index.  Nothing can be added afterwards, but wait can be called again.
+func (b *batchIndexer) wait() *indexfile.Builder {
+	if b.batches != nil {
+		if len(b.batch) > 0 {
+			b.batches <- b.batch
+			b.batch = nil
+		}
+		close(b.batches)
+		b.batches = nil
+	}
+	<-b.done
+	return b.index
+}
@@ -0,0 +1,203 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blockfile
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/google/stenographer/base"
+	"github.com/google/stenographer/indexfile"
+)
+
+// importDirs returns packet and index directories to import into.
+func importDirs(t *testing.T) (string, string) {
+	dir := t.TempDir()
+	for _, sub := range []string{"PKT0", "IDX0"} {
+		if err := os.Mkdir(filepath.Join(dir, sub), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return filepath.Join(dir, "PKT0"), filepath.Join(dir, "IDX0")
+}
+
+// asPcap writes packets out as a PCAP file.
+func asPcap(t *testing.T, pkts []*base.Packet) *bytes.Buffer {
+	var buf bytes.Buffer
+	w := pcapgo.NewWriterNanos(&buf)
+	if err := w.WriteFileHeader(65536, layers.LinkTypeEthernet); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range pkts {
+		if err := w.WritePacket(p.CaptureInfo, p.Data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &buf
+}
+
+// stripped returns packets without their metadata and ancillary data, which
+// captures don't carry.
+func stripped(pkts []*base.Packet) []*base.Packet {
+	for _, p := range pkts {
+		p.Meta = base.PacketMetadata{}
+		p.AncillaryData = nil
+	}
+	return pkts
+}
+
+func TestImport(t *testing.T) {
+	blk := testBlockFile(t, filename)
+	defer blk.Close()
+	want := stripped(allPackets(t, blk.AllPackets()))
+	wantPort := stripped(allPackets(t, lookup(t, blk, "port 67")))
+
+	var pcapng bytes.Buffer
+	w, err := base.NewPcapngWriter(&pcapng, base.PcapngSection{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range want {
+		if _, err := w.WritePacket(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, in := range map[string]*bytes.Buffer{"pcap": asPcap(t, want), "pcapng": &pcapng} {
+		pktDir, idxDir := importDirs(t)
+		files, err := Import(in, pktDir, idxDir, indexfile.BuilderOptions{})
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		first, last := want[0].Timestamp, want[len(want)-1].Timestamp
+		if len(files) != 1 || files[0].Packets != len(want) || !files[0].First.Equal(first) || !files[0].Last.Equal(last) {
+			t.Fatalf("%s: got files %+v", name, files)
+		}
+		if wantName := "1423704299710994"; files[0].Name != wantName {
+			t.Errorf("%s: got name %q, want %q", name, files[0].Name, wantName)
+		}
+		path := filepath.Join(pktDir, files[0].Name)
+		if corrupt, err := Verify(path); err != nil || len(corrupt) > 0 {
+			t.Errorf("%s: verify got %v, %v", name, corrupt, err)
+		}
+		got := testBlockFile(t, path)
+		defer got.Close()
+		if pkts := stripped(allPackets(t, got.AllPackets())); !reflect.DeepEqual(pkts, want) {
+			t.Errorf("%s: imported packets differ", name)
+		}
+		if pkts := stripped(allPackets(t, lookup(t, got, "port 67"))); !reflect.DeepEqual(pkts, wantPort) {
+			t.Errorf("%s: got %d packets on port 67 from the index, want %d", name, len(pkts), len(wantPort))
+		}
+		hidden, _ := filepath.Glob(filepath.Join(pktDir, ".*"))
+		hiddenIdx, _ := filepath.Glob(filepath.Join(idxDir, ".*"))
+		if len(hidden)+len(hiddenIdx) > 0 {
+			t.Errorf("%s: temporary files left behind: %v %v", name, hidden, hiddenIdx)
+		}
+	}
+}
+
+func TestImportSplitsFiles(t *testing.T) {
+	blk := testBlockFile(t, filename)
+	defer blk.Close()
+	pkts := stripped(allPackets(t, blk.AllPackets()))
+	// Spread the packets a minute and a half apart, with the last pair
+	// sharing a start time with the first, so its name is taken.
+	for i, p := range pkts {
+		p.Timestamp = pkts[0].Timestamp.Add(time.Duration(i) * 90 * time.Second)
+	}
+	pkts = append(pkts, pkts[0], pkts[0])
+	pktDir, idxDir := importDirs(t)
+	files, err := Import(asPcap(t, pkts), pktDir, idxDir, indexfile.BuilderOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 7 {
+		t.Fatalf("got %d files, want 7: %+v", len(files), files)
+	}
+	if files[0].Name == files[6].Name {
+		t.Errorf("files share name %q", files[0].Name)
+	}
+	for _, f := range files {
+		for _, dir := range []string{pktDir, idxDir} {
+			if _, err := os.Stat(filepath.Join(dir, f.Name)); err != nil {
+				t.Error(err)
+			}
+		}
+	}
+	if files[6].Packets != 2 {
+		t.Errorf("last file got %d packets, want 2", files[6].Packets)
+	}
+}
+
+func TestImportIndexesBatches(t *testing.T) {
+	blk := testBlockFile(t, filename)
+	defer blk.Close()
+	orig := stripped(allPackets(t, blk.AllPackets()))
+	wantPort := len(allPackets(t, lookup(t, blk, "port 67")))
+	// Enough copies to fill several index batches per file, and several
+	// files, each still being finished as the next is filled.
+	var pkts []*base.Packet
+	copies := 4000/len(orig) + 1
+	for i := 0; i < copies; i++ {
+		for _, p := range orig {
+			c := *p
+			c.Timestamp = orig[0].Timestamp.Add(time.Duration(len(pkts)) * 50 * time.Millisecond)
+			pkts = append(pkts, &c)
+		}
+	}
+	pktDir, idxDir := importDirs(t)
+	files, err := Import(asPcap(t, pkts), pktDir, idxDir, indexfile.BuilderOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) < 3 {
+		t.Fatalf("got %d files, want at least 3", len(files))
+	}
+	var packets, port int
+	for i, f := range files {
+		if i > 0 && !f.First.After(files[i-1].Last) {
+			t.Errorf("file %d starts at %v, before the last ended at %v", i, f.First, files[i-1].Last)
+		}
+		got := testBlockFile(t, filepath.Join(pktDir, f.Name))
+		packets += len(allPackets(t, got.AllPackets()))
+		port += len(allPackets(t, lookup(t, got, "port 67")))
+		got.Close()
+	}
+	if packets != len(pkts) || port != copies*wantPort {
+		t.Errorf("got %d packets, %d on port 67; want %d, %d", packets, port, len(pkts), copies*wantPort)
+	}
+}
+
+func TestImportRejects(t *testing.T) {
+	var raw bytes.Buffer
+	if err := pcapgo.NewWriter(&raw).WriteFileHeader(65536, layers.LinkTypeRaw); err != nil {
+		t.Fatal(err)
+	}
+	for name, in := range map[string]*bytes.Buffer{
+		"empty":    {},
+		"garbage":  bytes.NewBufferString("not a capture file"),
+		"raw link": &raw,
+	} {
+		pktDir, idxDir := importDirs(t)
+		if files, err := Import(in, pktDir, idxDir, indexfile.BuilderOptions{}); err == nil || len(files) > 0 {
+			t.Errorf("%s: got %v, %v, want an error", name, files, err)
+		}
+	}
+}
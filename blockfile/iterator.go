@@ -0,0 +1,233 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blockfile
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+	"unsafe"
+
+	"github.com/google/stenographer/base"
+	"github.com/google/stenographer/filecache"
+	"golang.org/x/net/context"
+)
+
+// #include <linux/if_packet.h>
+import "C"
+
+// errClosed is returned by an Iterator whose blockfile is being closed.
+var errClosed = errors.New("blockfile closed")
+
+// Iterator walks a blockfile in order, block by block and then packet by
+// packet within each block, reading each block from disk in one go.  Unlike
+// Lookup, it needs no index and builds no list of positions, so it suits
+// tools which want every packet, like reindexing, scrubbing and export.
+//
+// NextBlock and NextPacket give control over each block: a damaged block
+// doesn't end iteration, it just yields no packets, and BlockErr says what's
+// wrong with it.  Next instead walks straight through the packets, stopping
+// at the first damaged block.  Packets remain valid after the iterator
+// moves on.  The blockfile can't finish closing until the iterator's closed.
+type Iterator struct {
+	b          *BlockFile
+	data       io.ReaderAt         // b.data, or a lookup's own view of it
+	locked     bool                // Whether Close should release b.mu
+	flock      *filecache.FileLock // Held while iterating a shared blockfile
+	start, end time.Time           // Blocks entirely outside this range are skipped
+	next       int64               // Offset of the next block
+	block      []byte              // The current block, nil before the first
+	offset     int64               // Offset of the current block
+	blockErr   error
+	hdr        *C.struct_tpacket_hdr_v1 // Nil if the block is damaged
+	read       int                      // Packets returned from the block so far
+	pkt        *C.struct_tpacket3_hdr
+	pktOffset  int // Offset of pkt in block
+	err        error
+	closed     bool
+}
+
+// Iterate returns an Iterator over the blockfile, positioned before its first
+// block.  It must be closed once done with.
+func (b *BlockFile) Iterate() *Iterator {
+	lock, err := b.lockShared()
+	if err != nil {
+		it := b.iterator(time.Time{}, time.Time{})
+		if it.err = err; os.IsNotExist(err) {
+			it.err = errClosed // Removed by another process.
+		}
+		return it
+	}
+	b.mu.RLock()
+	it := b.iterator(time.Time{}, time.Time{})
+	it.locked, it.flock = true, lock
+	return it
+}
+
+// iterator returns an Iterator skipping blocks which can't hold packets in
+// [start, end), leaving the caller to lock b.mu.
+func (b *BlockFile) iterator(start, end time.Time) *Iterator {
+	return &Iterator{b: b, data: b.data, start: start, end: end}
+}
+
+// NextBlock moves to the next block, returning false once there are none
+// left, or on failing to read one.  Blocks lost to truncation aren't visited.
+func (it *Iterator) NextBlock() bool {
+	if it.err != nil || it.closed {
+		return false
+	}
+	for ; it.next < it.b.valid; it.next += blockSize {
+		select {
+		case <-it.b.done:
+			it.err = errClosed
+			return false
+		default:
+		}
+		if it.b.skipBlock(it.next, it.start, it.end) {
+			blocksSkipped.Increment()
+			continue
+		}
+		packetBlocksRead.Increment()
+		block := make([]byte, blockSize)
+		n, err := it.data.ReadAt(block, it.next)
+		if err != nil && err != io.EOF {
+			it.err = fmt.Errorf("could not read block at %v: %v", it.next, err)
+			return false
+		}
+		it.block, it.offset, it.read, it.pkt, it.hdr = block[:n], it.next, 0, nil, nil
+		if it.blockErr = checkBlock(it.block); it.blockErr == nil {
+			desc := (*C.struct_tpacket_block_desc)(unsafe.Pointer(&it.block[0]))
+			it.hdr = (*C.struct_tpacket_hdr_v1)(unsafe.Pointer(&desc.hdr[0]))
+		}
+		it.next += blockSize
+		return true
+	}
+	it.block, it.hdr = nil, nil
+	return false
+}
+
+// BlockOffset returns the offset of the current block in the uncompressed
+// blockfile.
+func (it *Iterator) BlockOffset() int64 {
+	return it.offset
+}
+
+// BlockErr returns why the current block is damaged, or nil if it's intact.
+func (it *Iterator) BlockErr() error {
+	return it.blockErr
+}
+
+// BlockPackets returns the number of packets in the current block, or 0 if
+// it's damaged.
+func (it *Iterator) BlockPackets() int {
+	if it.hdr == nil {
+		return 0
+	}
+	return int(it.hdr.num_pkts)
+}
+
+// NextPacket moves to the current block's next packet, returning false once
+// there are none left.
+func (it *Iterator) NextPacket() bool {
+	if it.hdr == nil || it.read == int(it.hdr.num_pkts) {
+		return false
+	}
+	if it.pkt == nil {
+		it.pktOffset = int(it.hdr.offset_to_first_pkt)
+	} else {
+		it.pktOffset += int(it.pkt.tp_next_offset)
+	}
+	it.pkt = (*C.struct_tpacket3_hdr)(unsafe.Pointer(&it.block[it.pktOffset]))
+	it.read++
+	packetsScanned.Increment()
+	return true
+}
+
+// Next moves to the next packet, going on to later blocks as needed.  It
+// returns false once there are none left, or on reaching a damaged block.
+func (it *Iterator) Next() bool {
+	defer packetScanNanos.NanoTimer()()
+	for !it.NextPacket() {
+		if !it.NextBlock() {
+			return false
+		}
+		if it.blockErr != nil {
+			it.err = fmt.Errorf("block at %v damaged: %v", it.offset, it.blockErr)
+			return false
+		}
+	}
+	return true
+}
+
+// Packet returns the current packet.
+func (it *Iterator) Packet() *base.Packet {
+	start := it.pktOffset + int(it.pkt.tp_mac)
+	p := &base.Packet{Data: it.block[start : start+int(it.pkt.tp_snaplen)]}
+	p.CaptureInfo.Timestamp = time.Unix(int64(it.pkt.tp_sec), int64(it.pkt.tp_nsec)).UTC()
+	p.CaptureInfo.Length = int(it.pkt.tp_len)
+	p.CaptureInfo.CaptureLength = int(it.pkt.tp_snaplen)
+	p.Meta = it.b.metadata(it.pkt)
+	return p
+}
+
+// Position returns the current packet's position, as the index records it.
+func (it *Iterator) Position() int64 {
+	return it.offset + int64(it.pktOffset)
+}
+
+// Err returns the error which stopped iteration, if any.
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// Close releases the iterator, letting its blockfile close.
+func (it *Iterator) Close() {
+	if it.closed {
+		return
+	}
+	it.closed = true
+	it.block, it.hdr, it.pkt = nil, nil, nil
+	if it.locked {
+		it.b.mu.RUnlock()
+	}
+	it.flock.Unlock()
+}
+
+// Send sends the iterator's remaining packets to out, as Next walks them,
+// until they run out, ctx or out is canceled, or the blockfile is closed.  It
+// returns the iterator's error, leaving out open.
+func (it *Iterator) Send(ctx context.Context, out *base.PacketChan) error {
+	for it.Next() {
+		select {
+		case <-ctx.Done():
+			v(2, "Blockfile %q canceling packet read", it.b.name)
+			return nil
+		case <-it.b.done:
+			v(2, "Blockfile %q closing, breaking out of query", it.b.name)
+			return nil
+		case <-out.Canceled():
+			v(2, "Blockfile %q output canceled, stopping packet read", it.b.name)
+			return nil
+		case out.C <- it.Packet():
+		}
+	}
+	if it.err == errClosed {
+		v(2, "Blockfile %q closing, breaking out of query", it.b.name)
+		return nil
+	}
+	return it.err
+}
@@ -0,0 +1,132 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blockfile
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/google/stenographer/base"
+)
+
+func TestIterator(t *testing.T) {
+	blk := testBlockFile(t, filename)
+	defer blk.Close()
+	want := stripped(allPackets(t, lookup(t, blk, "port 67")))
+	it := blk.Iterate()
+	defer it.Close()
+	var counts []int
+	var positions []int64
+	var got []*base.Packet
+	for it.NextBlock() {
+		if err := it.BlockErr(); err != nil {
+			t.Fatalf("block at %d: %v", it.BlockOffset(), err)
+		}
+		counts = append(counts, it.BlockPackets())
+		for it.NextPacket() {
+			if it.BlockOffset() == blockSize {
+				positions = append(positions, it.Position())
+				got = append(got, it.Packet())
+			}
+		}
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if wantCounts := []int{2, 4, 0, 0, 0, 0}; !reflect.DeepEqual(counts, wantCounts) {
+		t.Errorf("got block packet counts %v, want %v", counts, wantCounts)
+	}
+	if wantPositions := []int64{1048624, 1049024, 1049448, 1049848}; !reflect.DeepEqual(positions, wantPositions) {
+		t.Errorf("got positions %v, want %v", positions, wantPositions)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("iterated %d packets of block 1, looked up %d", len(got), len(want))
+	}
+	for i, p := range stripped(got) {
+		if !reflect.DeepEqual(p.Data, want[i].Data) || !reflect.DeepEqual(p.CaptureInfo, want[i].CaptureInfo) {
+			t.Errorf("iterated packet %d differs from that looked up", i)
+		}
+	}
+}
+
+func TestIteratorDamagedBlock(t *testing.T) {
+	s, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := damagedCopy(t, "dhcp", s.Size(), s.Size())
+	corrupt(t, path, blockSize+0x30+15) // High byte of packet 0's tp_snaplen.
+	blk := testBlockFile(t, path)
+	defer blk.Close()
+
+	// Walking blocks carries on past the damage.
+	it := blk.Iterate()
+	blocks, packets := 0, 0
+	for it.NextBlock() {
+		blocks++
+		if it.BlockErr() != nil != (it.BlockOffset() == blockSize) {
+			t.Errorf("block at %d: got error %v", it.BlockOffset(), it.BlockErr())
+		}
+		for it.NextPacket() {
+			packets++
+		}
+	}
+	it.Close()
+	if blocks != 6 || packets != 2 {
+		t.Errorf("got %d blocks with %d packets, want 6 with 2", blocks, packets)
+	}
+
+	// Walking packets stops at it.
+	c := blk.AllPackets()
+	if n := len(allPacketsUnchecked(c)); n != 2 || c.Err() == nil {
+		t.Errorf("got %d packets and error %v, want 2 and an error", n, c.Err())
+	}
+}
+
+// allPacketsUnchecked reads every packet from c, without checking its error.
+func allPacketsUnchecked(c *base.PacketChan) (out []*base.Packet) {
+	for p := range c.Receive() {
+		out = append(out, p)
+	}
+	return out
+}
+
+func TestIteratorClose(t *testing.T) {
+	blk := testBlockFile(t, filename)
+	it := blk.Iterate()
+	if !it.NextBlock() {
+		t.Fatal(it.Err())
+	}
+	closed := make(chan struct{})
+	go func() {
+		blk.Close()
+		close(closed)
+	}()
+	// The blockfile waits for the iterator, which stops at the next block.
+	<-blk.done
+	for it.NextBlock() {
+	}
+	if it.Err() != errClosed {
+		t.Errorf("got error %v, want %v", it.Err(), errClosed)
+	}
+	select {
+	case <-closed:
+		t.Fatal("blockfile closed under an open iterator")
+	default:
+	}
+	it.Close()
+	<-closed
+}
@@ -0,0 +1,158 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blockfile
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/google/stenographer/base"
+	"github.com/google/stenographer/indexfile"
+	"github.com/google/stenographer/stats"
+	"golang.org/x/net/context"
+)
+
+// MaxBlocks is the most blocks a blockfile can hold, as index positions are
+// 32 bits.
+const MaxBlocks = 4095
+
+var (
+	blockfilesMerged    = stats.S.Get("blockfiles_merged")
+	emptyBlocksDropped  = stats.S.Get("blockfile_merge_empty_blocks_dropped")
+	blockfileMergeNanos = stats.S.Get("blockfile_merge_nanos")
+	indexesMerged       = stats.S.Get("blockfile_merge_indexes_merged")
+	blockfilesReindexed = stats.S.Get("blockfile_merge_blockfiles_reindexed")
+)
+
+// DataSize returns the size of the blockfile's packet data: its complete
+// blocks, uncompressed.
+func (b *BlockFile) DataSize() int64 {
+	return b.valid
+}
+
+// Merge writes the blocks of srcs, in order, to a new uncompressed blockfile
+// dst, and merges their indexes into a new index with the path stenotype would
+// have used.  Indexes are merged key by key, with their positions moved along
+// with their blocks, so packets aren't decoded again, and keep whatever keys
+// they were indexed under; files without an open index have their packets
+// indexed again instead, with the keys opts asks for.  The index records the merged file's time range (see
+// indexfile.Builder.SetTimeRange), so time queries find it even though its
+// name only gives its start.  Empty blocks are dropped, except from the first
+// file, whose packets keep their positions, so its original index still works
+// with the merged file.  Merge fails on reaching a damaged block, or if the
+// merged file would hold more than MaxBlocks blocks, leaving nothing behind.
+func Merge(dst string, srcs []*BlockFile, opts indexfile.BuilderOptions) error {
+	defer blockfileMergeNanos.NanoTimer()()
+	idx := indexfile.IndexPathFromBlockfilePath(dst)
+	if idx == dst {
+		return fmt.Errorf("no index path for %q, which isn't under a PKT directory", dst)
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if err := mergeBlocks(out, idx, srcs, opts); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	if err := base.SyncFile(out); err != nil {
+		out.Close()
+		os.Remove(dst)
+		os.Remove(idx)
+		return err
+	}
+	blockfilesMerged.IncrementBy(int64(len(srcs)))
+	return out.Close()
+}
+
+// mergeBlocks copies the blocks of srcs to out, then writes their index to
+// idx.
+func mergeBlocks(out *os.File, idx string, srcs []*BlockFile, opts indexfile.BuilderOptions) error {
+	index := indexfile.NewBuilder(opts)
+	var first, last time.Time
+	var written int64
+	for i, src := range srcs {
+		src.mu.RLock()
+		reindex := src.i == nil
+		src.mu.RUnlock()
+		// moved maps the offsets of src's blocks to where they're written.
+		moved := map[int64]int64{}
+		it := src.Iterate()
+		for it.NextBlock() {
+			if err := it.BlockErr(); err != nil {
+				it.Close()
+				return fmt.Errorf("%q block at %d damaged: %v", src.Name(), it.BlockOffset(), err)
+			}
+			if i > 0 && it.BlockPackets() == 0 {
+				emptyBlocksDropped.Increment()
+				continue
+			}
+			if written == MaxBlocks*blockSize {
+				it.Close()
+				return fmt.Errorf("merged blockfile would exceed %d blocks", MaxBlocks)
+			}
+			moved[it.BlockOffset()] = written
+			forEachPacket(it.block, func(offset int, ts time.Time, length int, pkt []byte) {
+				if reindex {
+					index.AddPacketLength(pkt, length, written+int64(offset))
+				}
+				if first.IsZero() || ts.Before(first) {
+					first = ts
+				}
+				if ts.After(last) {
+					last = ts
+				}
+			})
+			if _, err := out.Write(it.block); err != nil {
+				it.Close()
+				return err
+			}
+			written += blockSize
+		}
+		it.Close()
+		if err := it.Err(); err != nil {
+			return fmt.Errorf("could not read %q: %v", src.Name(), err)
+		}
+		if reindex {
+			blockfilesReindexed.Increment()
+		} else if err := src.addIndexTo(index, moved); err != nil {
+			return fmt.Errorf("could not merge index of %q: %v", src.Name(), err)
+		}
+	}
+	index.SetTimeRange(first, last)
+	return index.WriteFile(idx)
+}
+
+// addIndexTo adds the blockfile's index to 'index', moving the positions in
+// each block to the offset 'moved' maps the block to.  Positions in blocks
+// which weren't moved, being empty, are dropped.
+func (b *BlockFile) addIndexTo(index *indexfile.Builder, moved map[int64]int64) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.i == nil {
+		return errClosed
+	}
+	err := index.AddIndex(context.Background(), b.i, func(pos int64) (int64, bool) {
+		block := pos - pos%blockSize
+		to, ok := moved[block]
+		return to + pos - block, ok
+	})
+	if err == nil {
+		indexesMerged.Increment()
+	}
+	return err
+}
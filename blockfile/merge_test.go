@@ -0,0 +1,144 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blockfile
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/stenographer/filecache"
+	"github.com/google/stenographer/indexfile"
+	"github.com/google/stenographer/query"
+)
+
+func TestMerge(t *testing.T) {
+	dhcp, vlan := testBlockFile(t, filename), testBlockFile(t, "../testdata/PKT0/vlan")
+	defer dhcp.Close()
+	defer vlan.Close()
+	dir := filepath.Join(t.TempDir(), "PKT0")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(filepath.Dir(dir), "IDX0"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "merged")
+	if err := Merge(path, []*BlockFile{dhcp, vlan, dhcp}, indexfile.BuilderOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if corrupt, err := Verify(path); err != nil || len(corrupt) > 0 {
+		t.Errorf("verify got %v, %v", corrupt, err)
+	}
+	merged := testBlockFile(t, path)
+	defer merged.Close()
+
+	// The first file keeps its packets' positions; later files lose their
+	// empty blocks.
+	want, err := dhcp.Positions(ctx, mustQuery(t, "port 67"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := merged.Positions(ctx, mustQuery(t, "port 67"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2*len(want) || !reflect.DeepEqual(got[:len(want)], want) {
+		t.Errorf("got port 67 positions %v, want %v then another copy", got, want)
+	}
+	vlanBlocks := 0
+	it := vlan.Iterate()
+	for it.NextBlock() {
+		if it.BlockPackets() > 0 {
+			vlanBlocks++
+		}
+	}
+	it.Close()
+	if wantSize := int64(6+vlanBlocks+2) * blockSize; merged.DataSize() != wantSize {
+		t.Errorf("got %d bytes of blocks, want %d", merged.DataSize(), wantSize)
+	}
+	counts := map[*BlockFile]int{}
+	for _, blk := range []*BlockFile{dhcp, vlan, merged} {
+		counts[blk] = len(allPackets(t, blk.AllPackets()))
+	}
+	if counts[merged] != 2*counts[dhcp]+counts[vlan] {
+		t.Errorf("merged file has %d packets, want %d", counts[merged], 2*counts[dhcp]+counts[vlan])
+	}
+
+	// Time queries find the merged file by the range its index records,
+	// though its name isn't a time at all.
+	idx, err := indexfile.NewIndexFile(indexfile.IndexPathFromBlockfilePath(path), filecache.NewCache(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+	first, last, ok, err := idx.TimeRange()
+	if err != nil || !ok {
+		t.Fatalf("got no time range: %v", err)
+	}
+	all := allPackets(t, merged.AllPackets())
+	for _, p := range all {
+		if p.Timestamp.Before(first) || p.Timestamp.After(last) {
+			t.Errorf("packet at %v outside time range [%v, %v]", p.Timestamp, first, last)
+		}
+	}
+	for q, want := range map[string]bool{
+		"after " + first.Add(-time.Hour).Format(time.RFC3339):  true,
+		"after " + last.Add(time.Second).Format(time.RFC3339):  false,
+		"before " + first.Format(time.RFC3339):                 false,
+		"before " + last.Add(time.Second).Format(time.RFC3339): true,
+	} {
+		positions, err := merged.Positions(ctx, mustQuery(t, q))
+		if err != nil {
+			t.Fatalf("%s: %v", q, err)
+		}
+		if positions.IsAllPositions() != want {
+			t.Errorf("%s: got all positions %v, want %v", q, positions.IsAllPositions(), want)
+		}
+	}
+}
+
+func TestMergeFails(t *testing.T) {
+	s, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := damagedCopy(t, "dhcp", s.Size(), s.Size())
+	corrupt(t, path, blockSize+0x30+15) // High byte of packet 0's tp_snaplen.
+	damaged := testBlockFile(t, path)
+	defer damaged.Close()
+	dst := filepath.Join(filepath.Dir(path), "merged")
+	if err := Merge(dst, []*BlockFile{damaged}, indexfile.BuilderOptions{}); err == nil {
+		t.Error("merged a damaged blockfile")
+	}
+	for _, p := range []string{dst, indexfile.IndexPathFromBlockfilePath(dst)} {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Errorf("%q left behind: %v", p, err)
+		}
+	}
+	if err := Merge(filepath.Join(t.TempDir(), "merged"), nil, indexfile.BuilderOptions{}); err == nil {
+		t.Error("merged into a file with no index path")
+	}
+}
+
+func mustQuery(t *testing.T, q string) query.Query {
+	qry, err := query.NewQuery(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return qry
+}
@@ -0,0 +1,111 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blockfile
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+)
+
+// Readers name the ways a blockfile's data can be read from disk, as set in a
+// thread's config.
+//
+// ReaderPread, the default, reads with positional reads through the file
+// cache.  Each packet costs one read of packetReadSize bytes, enough for a
+// typical packet and its header, plus a second read for larger packets.
+// Reads block only the goroutine making them, and leave the page cache to
+// the kernel's usual readahead and eviction.
+//
+// ReaderMmap maps each blockfile into memory and copies packets out of the
+// mapping.  Reads of cached pages are cheaper, but a page fault blocks the
+// OS thread running the faulting goroutine, and mappings of many large
+// blockfiles churn the page cache, so latency suffers on cold queries.
+const (
+	ReaderPread = "pread"
+	ReaderMmap  = "mmap"
+	// packetReadSize covers the TPACKET_V3 header and most packets on
+	// links with a standard MTU.
+	packetReadSize = 2048
+)
+
+// KnownReader returns true if name is a supported reader, or empty for the
+// default.
+func KnownReader(name string) bool {
+	return name == "" || name == ReaderPread || name == ReaderMmap
+}
+
+// mmapReader reads a file through a read-only memory mapping of it.
+type mmapReader struct {
+	data []byte
+}
+
+// newMmapReader maps the named file, which is size bytes long.
+func newMmapReader(filename string, size int64) (*mmapReader, error) {
+	if size == 0 {
+		return &mmapReader{}, nil // Zero-length mappings are invalid.
+	}
+	if int64(int(size)) != size {
+		return nil, fmt.Errorf("%q too large to map", filename)
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close() // The mapping outlives the descriptor.
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, fmt.Errorf("could not map %q: %v", filename, err)
+	}
+	return &mmapReader{data: data}, nil
+}
+
+func (m *mmapReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	} else if off >= int64(len(m.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, m.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Advise passes advice (a filecache.Advise value, which match madvise's) on
+// reading the given range to the kernel, as filecache.CachedFile.Advise does.
+func (m *mmapReader) Advise(off, length int64, advice int) error {
+	if off < 0 || off >= int64(len(m.data)) {
+		return nil
+	}
+	end := int64(len(m.data))
+	if length > 0 && off+length < end {
+		end = off + length
+	}
+	off &^= int64(os.Getpagesize() - 1) // Ranges must start on a page.
+	return syscall.Madvise(m.data[off:end], advice)
+}
+
+// Close unmaps the file.  No reads may be in progress.
+func (m *mmapReader) Close() error {
+	if m.data == nil {
+		return nil
+	}
+	data := m.data
+	m.data = nil
+	return syscall.Munmap(data)
+}
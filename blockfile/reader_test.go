@@ -0,0 +1,137 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blockfile
+
+import (
+	"io"
+	"os"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"github.com/google/stenographer/base"
+	"github.com/google/stenographer/filecache"
+	"github.com/google/stenographer/query"
+)
+
+func lookup(t testing.TB, blk *BlockFile, q string) *base.PacketChan {
+	qry, err := query.NewQuery(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := base.NewPacketChan(100)
+	go blk.Lookup(ctx, qry, out)
+	return out
+}
+
+func TestReaders(t *testing.T) {
+	opened := map[string]*BlockFile{}
+	for _, reader := range []string{"", ReaderPread, ReaderMmap} {
+		for _, path := range []string{filename, compressedCopy(t, "dhcp")} {
+			blk, err := NewBlockFileWithOptions(path, filecache.NewCache(10), Options{Reader: reader})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer blk.Close()
+			opened[reader+" "+path] = blk
+		}
+	}
+	var want [][]*base.Packet
+	for name, blk := range opened {
+		got := [][]*base.Packet{allPackets(t, lookup(t, blk, "port 67")), allPackets(t, blk.AllPackets())}
+		if len(got[0]) != 4 || len(got[1]) != 6 {
+			t.Errorf("%s: want 4 and 6 packets, got %d and %d", name, len(got[0]), len(got[1]))
+		}
+		for _, pkts := range got {
+			for _, p := range pkts {
+				p.Meta = base.PacketMetadata{}
+			}
+		}
+		if want == nil {
+			want = got
+		} else if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: packets differ", name)
+		}
+	}
+	if _, err := NewBlockFileWithOptions(filename, filecache.NewCache(10), Options{Reader: "bogus"}); err == nil {
+		t.Error("opened with an unknown reader")
+	}
+}
+
+func TestMmapReaderReadAt(t *testing.T) {
+	want, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := newMmapReader(filename, int64(len(want)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	buf := make([]byte, 100)
+	if n, err := m.ReadAt(buf, 1000); n != 100 || err != nil || !reflect.DeepEqual(buf, want[1000:1100]) {
+		t.Errorf("ReadAt(1000) = %d, %v", n, err)
+	}
+	if n, err := m.ReadAt(buf, int64(len(want))-10); n != 10 || err != io.EOF {
+		t.Errorf("ReadAt at end = %d, %v, want 10, EOF", n, err)
+	}
+	if n, err := m.ReadAt(buf, int64(len(want))); n != 0 || err != io.EOF {
+		t.Errorf("ReadAt past end = %d, %v, want 0, EOF", n, err)
+	}
+}
+
+// dropCache asks the kernel to drop the named file from the page cache.  It
+// has no effect on filesystems, like tmpfs, with no backing store.
+func dropCache(b *testing.B, path string) {
+	f, err := os.Open(path)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer f.Close()
+	const fadvDontNeed = 4
+	if _, _, errno := syscall.Syscall6(syscall.SYS_FADVISE64, f.Fd(), 0, 0, fadvDontNeed, 0, 0); errno != 0 {
+		b.Fatal(errno)
+	}
+}
+
+// BenchmarkReader compares readers on queries against blockfiles dropped
+// from the page cache, as most queries of older packets are.  Each iteration
+// opens the blockfile, reads the packets, and closes it.
+func BenchmarkReader(b *testing.B) {
+	for _, reader := range []string{ReaderPread, ReaderMmap} {
+		for _, q := range []string{"port 67", "ip proto 17"} {
+			b.Run(reader+"/"+q, func(b *testing.B) {
+				fc := filecache.NewCache(10)
+				for i := 0; i < b.N; i++ {
+					b.StopTimer()
+					dropCache(b, filename)
+					b.StartTimer()
+					blk, err := NewBlockFileWithOptions(filename, fc, Options{Reader: reader})
+					if err != nil {
+						b.Fatal(err)
+					}
+					c := lookup(b, blk, q)
+					for p := range c.Receive() {
+						p.Release()
+					}
+					if err := c.Err(); err != nil {
+						b.Fatal(err)
+					}
+					blk.Close()
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blockfile
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/google/stenographer/cryptfile"
+	"github.com/google/stenographer/indexfile"
+	"github.com/google/stenographer/stats"
+)
+
+var (
+	reindexNanos     = stats.S.Get("blockfile_reindex_nanos")
+	packetsReindexed = stats.S.Get("blockfile_reindex_packets")
+)
+
+// errTruncated describes the end of a blockfile left damaged by a crash.
+var errTruncated = errors.New("truncated by a crash")
+
+// Reindexed describes what Reindex indexed.
+type Reindexed struct {
+	Blocks, Packets int             // Indexed
+	Damaged         []CorruptRegion // Left unindexed, with adjacent regions merged
+}
+
+// Reindex writes a new index for the blockfile src to idx, built from its
+// packets as stenotype would have, for blockfiles whose index is missing or
+// damaged.  Unlike Repair, it leaves the blockfile itself alone, so its packets
+// keep their positions: src may be compressed, or encrypted with keys from
+// 'keys', and damaged blocks, including those lost to truncation, are just
+// left unindexed.  The index records the packets' time range (see
+// indexfile.Builder.SetTimeRange), so merged files are still found by time
+// queries.  The index is written unencrypted, with the keys opts asks for.
+// If bytesPerSec is positive, src is read no faster than that, to leave the
+// disk to capture and queries.
+func Reindex(src, idx string, keys *cryptfile.Keyring, opts indexfile.BuilderOptions, bytesPerSec int64) (Reindexed, error) {
+	defer reindexNanos.NanoTimer()()
+	var r Reindexed
+	in, err := os.Open(src)
+	if err != nil {
+		return r, err
+	}
+	defer in.Close()
+	s, err := in.Stat()
+	if err != nil {
+		return r, err
+	}
+	data, err := openData(in, s.Size(), keys)
+	if err != nil {
+		return r, fmt.Errorf("could not read blockfile %q: %v", src, err)
+	}
+	size := dataSize(data, s.Size())
+	valid, _, err := salvageLength(data, size)
+	if err != nil {
+		return r, fmt.Errorf("could not check blockfile %q for truncation: %v", src, err)
+	}
+	if err := r.indexBlocks(data, valid, idx, opts, bytesPerSec); err != nil {
+		return r, fmt.Errorf("could not reindex %q: %v", src, err)
+	}
+	if valid < size {
+		r.Damaged = addRegion(r.Damaged, valid, size-valid, errTruncated)
+	}
+	packetsReindexed.IncrementBy(int64(r.Packets))
+	return r, nil
+}
+
+// indexBlocks indexes the intact blocks among the first 'size' bytes of
+// 'data', reading them at up to bytesPerSec if it's positive, then writes
+// their index to 'idx'.
+func (r *Reindexed) indexBlocks(data io.ReaderAt, size int64, idx string, opts indexfile.BuilderOptions, bytesPerSec int64) error {
+	index := indexfile.NewBuilder(opts)
+	var first, last time.Time
+	block := make([]byte, blockSize)
+	start := time.Now()
+	for off := int64(0); off < size; off += blockSize {
+		if bytesPerSec > 0 {
+			due := time.Duration(float64(off) / float64(bytesPerSec) * float64(time.Second))
+			if wait := due - time.Since(start); wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+		n, err := data.ReadAt(block, off)
+		if err == nil || (err == io.EOF && n > 0) {
+			err = checkBlock(block[:n])
+		}
+		if err != nil {
+			r.Damaged = addRegion(r.Damaged, off, blockSize, err)
+			continue
+		}
+		forEachPacket(block, func(offset int, ts time.Time, length int, pkt []byte) {
+			index.AddPacketLength(pkt, length, off+int64(offset))
+			if first.IsZero() || ts.Before(first) {
+				first = ts
+			}
+			if ts.After(last) {
+				last = ts
+			}
+			r.Packets++
+		})
+		r.Blocks++
+	}
+	index.SetTimeRange(first, last)
+	return index.WriteFile(idx)
+}
@@ -0,0 +1,95 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blockfile
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/stenographer/indexfile"
+)
+
+func TestReindex(t *testing.T) {
+	// Reindexing undamaged files reproduces stenotype's index.
+	for _, name := range []string{"dhcp", "mpls", "vlan"} {
+		idx := filepath.Join(t.TempDir(), name)
+		r, err := Reindex("../testdata/PKT0/"+name, idx, nil, indexfile.BuilderOptions{}, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(r.Damaged) != 0 || r.Blocks != 6 {
+			t.Errorf("%s: want 6 blocks indexed, none damaged, got %+v", name, r)
+		}
+		wantIndex := readIndex(t, "../testdata/IDX0/"+name)
+		gotIndex := readIndex(t, idx)
+		// As in TestRepair, the testdata predates some keys, and records no
+		// time range.
+		for k := range gotIndex {
+			if k[0] == 7 || k[0] == 14 || k[0] == 24 || k[0] == 25 || k[0] == 28 || k[0] == 29 {
+				delete(gotIndex, k)
+			}
+		}
+		gotIndex["\x00"] = wantIndex["\x00"]
+		for k, v := range wantIndex {
+			if gotIndex[k] != v {
+				t.Errorf("%s: key %x: want %x, got %x", name, k, v, gotIndex[k])
+			}
+		}
+		for k := range gotIndex {
+			if _, ok := wantIndex[k]; !ok {
+				t.Errorf("%s: unexpected key %x", name, k)
+			}
+		}
+	}
+
+	// A crashed file whose index was lost is indexed up to the damage, with
+	// its packets where they were.
+	src := damagedCopy(t, "dhcp", 2*blockSize+100, 6*blockSize)
+	idx := indexfile.IndexPathFromBlockfilePath(src)
+	if err := os.Remove(idx); err != nil {
+		t.Fatal(err)
+	}
+	r, err := Reindex(src, idx, nil, indexfile.BuilderOptions{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Blocks != 3 || r.Packets != 6 || len(r.Damaged) != 1 || r.Damaged[0].Offset != 3*blockSize || r.Damaged[0].Length != 3*blockSize {
+		t.Errorf("want 3 blocks indexed and the rest damaged, got %+v", r)
+	}
+	blk := testBlockFile(t, src)
+	defer blk.Close()
+	if got := countPackets(t, blk, "port 67"); got != 4 {
+		t.Errorf("want 4 packets from reindexed file, got %d", got)
+	}
+
+	if _, err := Reindex(src, idx, nil, indexfile.BuilderOptions{}, 0); err == nil {
+		t.Error("reindexed over an existing index")
+	}
+}
+
+func TestReindexPaced(t *testing.T) {
+	// The last of dhcp's 6 blocks can't be read until 5 blocks' worth of
+	// time has passed.
+	start := time.Now()
+	idx := filepath.Join(t.TempDir(), "dhcp")
+	if _, err := Reindex("../testdata/PKT0/dhcp", idx, nil, indexfile.BuilderOptions{}, 20*blockSize); err != nil {
+		t.Fatal(err)
+	}
+	if took := time.Since(start); took < 250*time.Millisecond {
+		t.Errorf("reindexing at 20 blocks a second took %v", took)
+	}
+}
@@ -0,0 +1,205 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blockfile
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+	"unsafe"
+
+	"github.com/google/stenographer/base"
+	"github.com/google/stenographer/indexfile"
+	"github.com/google/stenographer/stats"
+)
+
+// #include <linux/if_packet.h>
+import "C"
+
+// When stenotype crashes or its host loses power, the blockfile it was writing
+// is left damaged: stenotype preallocates its files, so they end in zeroed
+// space stenotype never wrote, and the last block written may be torn.  Such
+// files are opened in salvage mode, serving only the complete blocks before
+// the damage; Repair rewrites them as clean files with fresh indexes.
+
+var salvagedPositionsSkipped = stats.S.Get("blockfile_salvaged_positions_skipped")
+
+// dataSize returns the size of the uncompressed, unencrypted data read by
+// openData, given the size of the file on disk.
+func dataSize(data io.ReaderAt, size int64) int64 {
+	switch d := data.(type) {
+	case *compressedReader:
+		return d.size
+	case interface{ Size() int64 }:
+		return d.Size()
+	}
+	return size
+}
+
+// validBlockHeader returns true if the block at 'off' has a TPACKET_V3 block
+// descriptor, which unwritten, zeroed space doesn't.
+func validBlockHeader(data io.ReaderAt, off int64) (bool, error) {
+	var buf [C.sizeof_struct_tpacket_block_desc]byte
+	if _, err := data.ReadAt(buf[:], off); err != nil {
+		return false, err
+	}
+	desc := (*C.struct_tpacket_block_desc)(unsafe.Pointer(&buf[0]))
+	hdr := (*C.struct_tpacket_hdr_v1)(unsafe.Pointer(&desc.hdr[0]))
+	return desc.version == C.TPACKET_V3 && hdr.blk_len <= blockSize, nil
+}
+
+// salvageLength returns the length of the prefix of a blockfile's data which
+// holds complete blocks, and whether that's less than all of it.  Only the
+// last block's header is read for undamaged files.
+func salvageLength(data io.ReaderAt, size int64) (valid int64, truncated bool, _ error) {
+	valid = size - size%blockSize
+	truncated = valid != size
+	for valid > 0 {
+		ok, err := validBlockHeader(data, valid-blockSize)
+		if err != nil {
+			return 0, false, err
+		} else if ok {
+			break
+		}
+		valid -= blockSize
+		truncated = true
+	}
+	if truncated && valid > 0 {
+		// The last block written before a crash may be only partly there.
+		block := make([]byte, blockSize)
+		if _, err := data.ReadAt(block, valid-blockSize); err != nil {
+			return 0, false, err
+		}
+		if checkBlock(block) != nil {
+			valid -= blockSize
+		}
+	}
+	return valid, truncated, nil
+}
+
+// Truncated returns true if the blockfile is damaged at its end, as left by a
+// crash, so only its complete blocks are read.  Packets the index places
+// beyond them are skipped.
+func (b *BlockFile) Truncated() bool {
+	return b.truncated
+}
+
+// Repaired describes what Repair salvaged from a damaged blockfile.
+type Repaired struct {
+	Blocks, Packets int             // Copied to the repaired file
+	Dropped         []CorruptRegion // Left out, with adjacent regions merged
+}
+
+// Repair writes the intact blocks of the blockfile src (which may be
+// compressed, but not encrypted) to a new, uncompressed blockfile dst, and
+// builds a new index for it, with the path stenotype would have used, from
+// the packets themselves.  Damaged blocks are left out rather than failing
+// the repair, so it also recovers blockfiles whose index is missing, as when
+// stenotype crashed before writing it.  The index holds the keys opts asks
+// for.  Packet positions in dst differ from those in src wherever blocks were
+// dropped.
+func Repair(src, dst string, opts indexfile.BuilderOptions) (Repaired, error) {
+	var r Repaired
+	idx := indexfile.IndexPathFromBlockfilePath(dst)
+	if idx == dst {
+		return r, fmt.Errorf("no index path for %q, which isn't under a PKT directory", dst)
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return r, err
+	}
+	defer in.Close()
+	s, err := in.Stat()
+	if err != nil {
+		return r, err
+	}
+	data, err := openData(in, s.Size(), nil)
+	if err != nil {
+		return r, fmt.Errorf("could not read blockfile %q: %v", src, err)
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return r, err
+	}
+	if err := r.copyBlocks(data, dataSize(data, s.Size()), out, idx, opts); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return r, fmt.Errorf("could not repair %q: %v", src, err)
+	}
+	if err := base.SyncFile(out); err != nil {
+		out.Close()
+		os.Remove(dst)
+		os.Remove(idx)
+		return r, err
+	}
+	return r, out.Close()
+}
+
+// copyBlocks copies the intact blocks of 'data' to 'out', then writes their
+// index to 'idx'.
+func (r *Repaired) copyBlocks(data io.ReaderAt, size int64, out io.Writer, idx string, opts indexfile.BuilderOptions) error {
+	index := indexfile.NewBuilder(opts)
+	block := make([]byte, blockSize)
+	var written int64
+	for off := int64(0); off < size; off += blockSize {
+		n, err := data.ReadAt(block, off)
+		if err == nil || (err == io.EOF && n > 0) {
+			err = checkBlock(block[:n])
+		}
+		if err != nil {
+			length := size - off
+			if length > blockSize {
+				length = blockSize
+			}
+			r.Dropped = addRegion(r.Dropped, off, length, err)
+			continue
+		}
+		forEachPacket(block, func(offset int, _ time.Time, length int, pkt []byte) {
+			index.AddPacketLength(pkt, length, written+int64(offset))
+			r.Packets++
+		})
+		if _, err := out.Write(block); err != nil {
+			return err
+		}
+		written += blockSize
+		r.Blocks++
+	}
+	return index.WriteFile(idx)
+}
+
+// addRegion adds the n-byte block at 'off' to 'regions', merging it with the
+// last region if they're adjacent.
+func addRegion(regions []CorruptRegion, off, n int64, err error) []CorruptRegion {
+	if last := len(regions) - 1; last >= 0 && regions[last].Offset+regions[last].Length == off {
+		regions[last].Length += n
+		return regions
+	}
+	return append(regions, CorruptRegion{Offset: off, Length: n, Err: err})
+}
+
+// forEachPacket calls fn with the offset, timestamp, length on the wire, and
+// captured data of each packet in a block which has passed checkBlock.
+func forEachPacket(block []byte, fn func(offset int, ts time.Time, length int, data []byte)) {
+	desc := (*C.struct_tpacket_block_desc)(unsafe.Pointer(&block[0]))
+	hdr := (*C.struct_tpacket_hdr_v1)(unsafe.Pointer(&desc.hdr[0]))
+	offset := int(hdr.offset_to_first_pkt)
+	for i := 0; i < int(hdr.num_pkts); i++ {
+		pkt := (*C.struct_tpacket3_hdr)(unsafe.Pointer(&block[offset]))
+		start := offset + int(pkt.tp_mac)
+		fn(offset, time.Unix(int64(pkt.tp_sec), int64(pkt.tp_nsec)).UTC(), int(pkt.tp_len), block[start:start+int(pkt.tp_snaplen)])
+		offset += int(pkt.tp_next_offset)
+	}
+}
@@ -0,0 +1,206 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blockfile
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/stenographer/base"
+	"github.com/google/stenographer/indexfile"
+	"github.com/google/stenographer/indextable"
+	"github.com/google/stenographer/query"
+)
+
+// damagedCopy copies the named test blockfile and its index into a temporary
+// directory, keeping the blockfile's first 'keep' bytes and zeroing the rest
+// of its first 'size', as a crash would leave it.
+func damagedCopy(t *testing.T, name string, keep, size int64) string {
+	dir := t.TempDir()
+	for _, sub := range []string{"PKT0", "IDX0"} {
+		if err := os.Mkdir(filepath.Join(dir, sub), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	index, err := ioutil.ReadFile("../testdata/IDX0/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "IDX0", name), index, 0600); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile("../testdata/PKT0/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	damaged := make([]byte, size)
+	copy(damaged, data[:keep])
+	out := filepath.Join(dir, "PKT0", name)
+	if err := ioutil.WriteFile(out, damaged, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func countPackets(t *testing.T, blk *BlockFile, q string) int {
+	qry, err := query.NewQuery(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := base.NewPacketChan(100)
+	go blk.Lookup(ctx, qry, c)
+	n := 0
+	for range c.Receive() {
+		n++
+	}
+	if err := c.Err(); err != nil {
+		t.Errorf("%q: %v", q, err)
+	}
+	return n
+}
+
+func TestSalvage(t *testing.T) {
+	blk := testBlockFile(t, filename)
+	if blk.Truncated() {
+		t.Error("undamaged blockfile reported truncated")
+	}
+	all := countPackets(t, blk, "port 67")
+	blk.Close()
+
+	for _, test := range []struct {
+		desc       string
+		keep, size int64
+		want       int // Packets matching port 67, all of which are in block 1
+	}{
+		{"torn mid-block", blockSize + 500, blockSize + 500, 0},
+		{"torn block within preallocation", blockSize + 500, 6 * blockSize, 0},
+		{"zeroed preallocation", 2 * blockSize, 6 * blockSize, all},
+		{"partial trailing block", 2*blockSize + 100, 2*blockSize + 100, all},
+	} {
+		blk := testBlockFile(t, damagedCopy(t, "dhcp", test.keep, test.size))
+		if !blk.Truncated() {
+			t.Errorf("%s: not reported truncated", test.desc)
+		}
+		if got := countPackets(t, blk, "port 67"); got != test.want {
+			t.Errorf("%s: want %d packets, got %d", test.desc, test.want, got)
+		}
+		c := blk.AllPackets()
+		for range c.Receive() {
+		}
+		if err := c.Err(); err != nil {
+			t.Errorf("%s: reading all packets: %v", test.desc, err)
+		}
+		blk.Close()
+	}
+}
+
+// readIndex returns all of an index's keys and values.
+func readIndex(t *testing.T, path string) map[string]string {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss, err := indextable.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ss.Close()
+	out := map[string]string{}
+	iter := ss.Find(nil)
+	for iter.Next() {
+		out[string(iter.Key())] = string(iter.Value())
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestRepair(t *testing.T) {
+	// Repairing undamaged files reproduces them and stenotype's index.
+	for _, name := range []string{"dhcp", "mpls", "vlan"} {
+		dst := filepath.Join(t.TempDir(), "PKT0", name)
+		if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.MkdirAll(filepath.Join(filepath.Dir(dst), "..", "IDX0"), 0700); err != nil {
+			t.Fatal(err)
+		}
+		r, err := Repair("../testdata/PKT0/"+name, dst, indexfile.BuilderOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(r.Dropped) != 0 || r.Blocks != 6 {
+			t.Errorf("%s: want 6 blocks copied, none dropped, got %+v", name, r)
+		}
+		want, err := ioutil.ReadFile("../testdata/PKT0/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := ioutil.ReadFile(dst); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(got, want) {
+			t.Errorf("%s: repaired blockfile differs", name)
+		}
+		wantIndex := readIndex(t, "../testdata/IDX0/"+name)
+		gotIndex := readIndex(t, indexfile.IndexPathFromBlockfilePath(dst))
+		// The testdata predates protocol+port keys, IP filters, and key type
+		// and stats records, which indexfile's tests check, and so has an
+		// older minor version.
+		for k := range gotIndex {
+			if k[0] == 14 || k[0] == 24 || k[0] == 25 || k[0] == 28 || k[0] == 29 {
+				delete(gotIndex, k)
+			}
+		}
+		gotIndex["\x00"] = wantIndex["\x00"]
+		for k, v := range wantIndex {
+			if gotIndex[k] != v {
+				t.Errorf("%s: key %x: want %x, got %x", name, k, v, gotIndex[k])
+			}
+		}
+		for k := range gotIndex {
+			if _, ok := wantIndex[k]; !ok {
+				t.Errorf("%s: unexpected key %x", name, k)
+			}
+		}
+	}
+
+	// Repairing a crashed file keeps its complete blocks.  Block 2 holds no
+	// packets, so its first 100 bytes are all of it.
+	src := damagedCopy(t, "dhcp", 2*blockSize+100, 6*blockSize)
+	dst := filepath.Join(filepath.Dir(src), "repaired")
+	r, err := Repair(src, dst, indexfile.BuilderOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Blocks != 3 || r.Packets != 6 || len(r.Dropped) != 1 || r.Dropped[0].Offset != 3*blockSize || r.Dropped[0].Length != 3*blockSize {
+		t.Errorf("want 3 blocks copied and the rest dropped, got %+v", r)
+	}
+	blk := testBlockFile(t, dst)
+	defer blk.Close()
+	if blk.Truncated() {
+		t.Error("repaired blockfile reported truncated")
+	}
+	if got := countPackets(t, blk, "port 67"); got != 4 {
+		t.Errorf("want 4 packets from repaired file, got %d", got)
+	}
+
+	if _, err := Repair(src, filepath.Join(t.TempDir(), "elsewhere"), indexfile.BuilderOptions{}); err == nil {
+		t.Error("repaired to a path with no index path")
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blockfile
+
+import (
+	"fmt"
+
+	"github.com/google/stenographer/base"
+	"golang.org/x/net/context"
+)
+
+// Scrubbed is what Scrub finds wrong with a blockfile.
+type Scrubbed struct {
+	// Corrupt lists damaged blocks, as found by Verify.
+	Corrupt []CorruptRegion
+	// BadPositions counts index positions, outside corrupt blocks, which
+	// aren't the start of a packet, so queries matching them would read
+	// garbage.
+	BadPositions int
+}
+
+// OK returns true if nothing was found wrong.
+func (s Scrubbed) OK() bool {
+	return len(s.Corrupt) == 0 && s.BadPositions == 0
+}
+
+func (s Scrubbed) String() string {
+	return fmt.Sprintf("%d corrupt blocks, %d bad index positions", len(s.Corrupt), s.BadPositions)
+}
+
+// Scrub checks a whole blockfile and its index for damage, so corruption can
+// be found before a query trips over it.  Blocks are checked with Verify,
+// then every position in the index is checked against the packets actually
+// in the file.  Positions lost to truncation aren't counted, as queries skip
+// those anyway.  An error is returned only if the check couldn't be done.
+func (b *BlockFile) Scrub(ctx context.Context) (s Scrubbed, _ error) {
+	var err error
+	if s.Corrupt, err = VerifyWithKeys(b.name, b.keys); err != nil {
+		return s, err
+	}
+	b.mu.RLock()
+	var positions []int64
+	err = errClosed
+	if b.i != nil {
+		positions, err = b.i.IndexedPositions(ctx)
+	}
+	b.mu.RUnlock()
+	if err != nil {
+		return s, err
+	}
+	it := b.Iterate()
+	defer it.Close()
+	next := 0
+	// bad counts the positions before 'end' as bad.
+	bad := func(end int64) {
+		for ; next < len(positions) && positions[next] < end; next++ {
+			s.BadPositions++
+		}
+	}
+	for it.NextBlock() && !base.ContextDone(ctx) {
+		start := it.BlockOffset()
+		bad(start)
+		if it.BlockErr() != nil {
+			for next < len(positions) && positions[next] < start+blockSize {
+				next++ // Counted in Corrupt.
+			}
+			continue
+		}
+		for it.NextPacket() {
+			pos := it.Position()
+			bad(pos)
+			if next < len(positions) && positions[next] == pos {
+				next++
+			}
+		}
+	}
+	if err := it.Err(); err != nil {
+		if len(s.Corrupt) > 0 {
+			return s, nil // Verify has already caught what stopped us.
+		}
+		return s, err
+	}
+	if err := ctx.Err(); err != nil {
+		return s, err
+	}
+	bad(b.valid)
+	return s, nil
+}
@@ -0,0 +1,68 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blockfile
+
+import (
+	"os"
+	"testing"
+
+	"github.com/google/stenographer/indexfile"
+)
+
+func TestScrub(t *testing.T) {
+	path := damagedCopy(t, "dhcp", 6<<20, 6<<20)
+	blk := testBlockFile(t, path)
+	if s, err := blk.Scrub(ctx); err != nil || !s.OK() {
+		t.Errorf("intact file scrubbed: %v, %v", s, err)
+	}
+
+	// Reindex with the first packet's position off by one.
+	b := indexfile.NewBuilder(indexfile.BuilderOptions{})
+	it := blk.Iterate()
+	for first := true; it.Next(); first = false {
+		pos := it.Position()
+		if first {
+			pos++
+		}
+		b.AddPacket(it.Packet().Data, pos)
+	}
+	it.Close()
+	blk.Close()
+	idx := indexfile.IndexPathFromBlockfilePath(path)
+	os.Remove(idx)
+	if err := b.WriteFile(idx); err != nil {
+		t.Fatal(err)
+	}
+	blk = testBlockFile(t, path)
+	if s, err := blk.Scrub(ctx); err != nil || s.BadPositions != 1 || len(s.Corrupt) != 0 {
+		t.Errorf("misindexed file scrubbed: %v, %v", s, err)
+	}
+	blk.Close()
+
+	// Positions in a corrupt block are reported with it, not counted as bad.
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte{0xff}, blockSize); err != nil { // Its version
+		t.Fatal(err)
+	}
+	f.Close()
+	blk = testBlockFile(t, path)
+	defer blk.Close()
+	if s, err := blk.Scrub(ctx); err != nil || s.BadPositions != 1 || len(s.Corrupt) != 1 {
+		t.Errorf("corrupt file scrubbed: %v, %v", s, err)
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blockfile
+
+import (
+	"os"
+	"time"
+
+	"github.com/google/stenographer/filecache"
+	"github.com/google/stenographer/indexfile"
+)
+
+// SharedLockWait is how long changes to a shared blockfile wait for readers
+// in other processes to finish with it.
+var SharedLockWait = time.Minute
+
+// lockShared takes a shared lock on a shared blockfile for the duration of a
+// read, returning a nil lock otherwise.  A blockfile's lock covers its index
+// too.
+func (b *BlockFile) lockShared() (*filecache.FileLock, error) {
+	if !b.shared {
+		return nil, nil
+	}
+	return filecache.LockShared(b.name)
+}
+
+// LockExclusive takes an exclusive lock on the named blockfile, as must be
+// done before replacing or rewriting a shared blockfile or its index, waiting
+// up to SharedLockWait for readers.  It returns filecache.ErrLocked if readers
+// are still using the file.
+func LockExclusive(filename string) (*filecache.FileLock, error) {
+	return filecache.LockExclusive(filename, SharedLockWait)
+}
+
+// Replaced returns true if the blockfile or its index has been removed or
+// replaced on disk since it was opened, as may be done by another process
+// sharing its directory.  It should then be closed, and reopened if it's
+// still there.
+func (b *BlockFile) Replaced() bool {
+	for i, name := range []string{b.name, indexfile.IndexPathFromBlockfilePath(b.name)} {
+		if s, err := os.Stat(name); err != nil || !os.SameFile(s, b.ids[i]) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,198 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blockfile
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/stenographer/cryptfile"
+	"github.com/google/stenographer/filecache"
+	"github.com/google/stenographer/indexfile"
+	"golang.org/x/net/context"
+)
+
+// FileStats summarizes the packets held in a blockfile.
+type FileStats struct {
+	Packets     int64
+	Bytes       int64     // Captured, which for truncated packets is less than their length
+	First, Last time.Time // Earliest and latest packet timestamps, zero if there are none
+	// Protocols counts packets by IP protocol, as indexed.  Packets which
+	// aren't IP aren't counted.
+	Protocols map[byte]int64
+}
+
+// add counts a packet of n captured bytes with timestamp ts.
+func (s *FileStats) add(ts time.Time, n int) {
+	s.addBlock(BlockMeta{First: ts, Last: ts, Packets: 1, Bytes: n})
+}
+
+// addBlock counts the packets of a block.
+func (s *FileStats) addBlock(m BlockMeta) {
+	if m.Packets == 0 {
+		return
+	}
+	if s.Packets == 0 || m.First.Before(s.First) {
+		s.First = m.First
+	}
+	if s.Packets == 0 || m.Last.After(s.Last) {
+		s.Last = m.Last
+	}
+	s.Packets += int64(m.Packets)
+	s.Bytes += int64(m.Bytes)
+}
+
+// Stats returns statistics on the blockfile's packets.  V2 blockfiles which
+// record what each block holds need only their block table read; others are
+// scanned in full, once, as the result is cached.  Protocol counts always
+// come from the index.
+func (b *BlockFile) Stats(ctx context.Context) (FileStats, error) {
+	b.statsMu.Lock()
+	defer b.statsMu.Unlock()
+	if b.stats == nil {
+		b.mu.RLock()
+		s, err := b.computeStats(ctx)
+		b.mu.RUnlock()
+		if err != nil {
+			return FileStats{}, fmt.Errorf("could not get stats of %q: %v", b.name, err)
+		}
+		b.stats = &s
+	}
+	out := *b.stats
+	out.Protocols = map[byte]int64{}
+	for proto, n := range b.stats.Protocols {
+		out.Protocols[proto] = n
+	}
+	return out, nil
+}
+
+// IndexStats returns statistics on the keys of the blockfile's index, as
+// indexfile.IndexFile.Stats does.  Reading them also lets queries order their
+// intersections by cost.
+func (b *BlockFile) IndexStats(ctx context.Context) (indexfile.Stats, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.i == nil {
+		return indexfile.Stats{}, errClosed
+	}
+	return b.i.Stats(ctx)
+}
+
+// ReadIndexStats reads the stats of the blockfile's index, as IndexStats
+// does, unless they're known already (see indexfile.IndexFile.KnownStats),
+// so queries can order their intersections by cost.
+func (b *BlockFile) ReadIndexStats(ctx context.Context) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.i == nil {
+		return errClosed
+	}
+	if _, ok := b.i.KnownStats(); ok {
+		return nil
+	}
+	_, err := b.i.Stats(ctx)
+	return err
+}
+
+// computeStats works out Stats.  b.mu must be locked.
+func (b *BlockFile) computeStats(ctx context.Context) (FileStats, error) {
+	if b.i == nil {
+		return FileStats{}, errClosed
+	}
+	s := FileStats{Protocols: map[byte]int64{}}
+	protocols, err := b.i.ProtocolCounts(ctx)
+	if err != nil {
+		return s, fmt.Errorf("could not count protocols: %v", err)
+	}
+	for proto, n := range protocols {
+		s.Protocols[proto] = int64(n)
+	}
+	if b.blockBytes {
+		for _, m := range b.blocks {
+			s.addBlock(m)
+		}
+		return s, nil
+	}
+	it := b.iterator(time.Time{}, time.Time{})
+	defer it.Close()
+	for it.NextBlock() {
+		if err := ctx.Err(); err != nil {
+			return s, err
+		}
+		if err := it.BlockErr(); err != nil {
+			return s, fmt.Errorf("block at %v damaged: %v", it.BlockOffset(), err)
+		}
+		for it.NextPacket() {
+			p := it.Packet()
+			s.add(p.Timestamp, len(p.Data))
+		}
+	}
+	return s, it.Err()
+}
+
+// statsCacheSize is how many files' stats Stats remembers.
+const statsCacheSize = 10000
+
+// statsCache holds the results of Stats, by path.
+var statsCache = struct {
+	sync.Mutex
+	files map[string]cachedStats
+}{files: map[string]cachedStats{}}
+
+// cachedStats are the stats of a file, as it was when they were computed.
+type cachedStats struct {
+	size    int64
+	modTime time.Time
+	stats   FileStats
+}
+
+// Stats returns statistics on the packets in the named blockfile, much as
+// BlockFile.Stats does.  Results are cached until the file changes.
+func Stats(filename string) (FileStats, error) {
+	return StatsWithKeys(filename, nil)
+}
+
+// StatsWithKeys acts like Stats, but can also read encrypted blockfiles,
+// getting their keys from 'keys'.
+func StatsWithKeys(filename string, keys *cryptfile.Keyring) (FileStats, error) {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return FileStats{}, err
+	}
+	statsCache.Lock()
+	c, ok := statsCache.files[filename]
+	statsCache.Unlock()
+	if ok && c.size == info.Size() && c.modTime.Equal(info.ModTime()) {
+		return c.stats, nil
+	}
+	blk, err := NewBlockFileWithKeys(filename, filecache.NewCache(2), keys)
+	if err != nil {
+		return FileStats{}, err
+	}
+	defer blk.Close()
+	s, err := blk.Stats(context.Background())
+	if err != nil {
+		return FileStats{}, err
+	}
+	statsCache.Lock()
+	if len(statsCache.files) >= statsCacheSize {
+		statsCache.files = map[string]cachedStats{}
+	}
+	statsCache.files[filename] = cachedStats{size: info.Size(), modTime: info.ModTime(), stats: s}
+	statsCache.Unlock()
+	return s, nil
+}
@@ -0,0 +1,93 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blockfile
+
+import (
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// wantStats works out the stats of a blockfile from its packets.
+func wantStats(t *testing.T, blk *BlockFile) FileStats {
+	want := FileStats{Protocols: map[byte]int64{}}
+	for _, p := range allPackets(t, blk.AllPackets()) {
+		want.add(p.Timestamp, len(p.Data))
+		pkt := gopacket.NewPacket(p.Data, layers.LayerTypeEthernet, gopacket.Default)
+		if ip, ok := pkt.Layer(layers.LayerTypeIPv4).(*layers.IPv4); ok {
+			want.Protocols[byte(ip.Protocol)]++
+		} else if ip, ok := pkt.Layer(layers.LayerTypeIPv6).(*layers.IPv6); ok {
+			want.Protocols[byte(ip.NextHeader)]++
+		}
+	}
+	return want
+}
+
+func TestStats(t *testing.T) {
+	v1 := testBlockFile(t, filename)
+	defer v1.Close()
+	want := wantStats(t, v1)
+	if want.Packets != 6 || want.Bytes == 0 || want.Protocols[byte(layers.IPProtocolUDP)] == 0 {
+		t.Fatalf("unexpected test data: %+v", want)
+	}
+	v2 := testBlockFile(t, convertedCopy(t, "dhcp", "dhcp", Header{}))
+	defer v2.Close()
+	if !v2.blockBytes {
+		t.Error("converted file doesn't record block bytes")
+	}
+	compressed := testBlockFile(t, compressedCopy(t, "dhcp"))
+	defer compressed.Close()
+	for _, blk := range []*BlockFile{v1, v2, compressed} {
+		for i := 0; i < 2; i++ { // Again, from the cache.
+			if got, err := blk.Stats(ctx); err != nil {
+				t.Errorf("%v: %v", blk.Name(), err)
+			} else if !reflect.DeepEqual(got, want) {
+				t.Errorf("%v: got %+v, want %+v", blk.Name(), got, want)
+			}
+		}
+	}
+	// Callers may change what they're given.
+	s, _ := v1.Stats(ctx)
+	s.Protocols[0]++
+	if s, _ := v1.Stats(ctx); !reflect.DeepEqual(s, want) {
+		t.Errorf("cached stats changed: %+v", s)
+	}
+	if got, err := Stats(filename); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, %v, want %+v", got, err, want)
+	}
+	if _, err := Stats(filename + ".missing"); err == nil {
+		t.Error("got stats of a missing file")
+	}
+}
+
+func TestStatsOfChangedFile(t *testing.T) {
+	path := damagedCopy(t, "dhcp", 1<<20, 1<<20)
+	if s, err := Stats(path); err != nil || s.Packets != 2 {
+		t.Fatalf("got %+v, %v, want 2 packets", s, err)
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if s, err := Stats(path); err != nil || s.Packets != 6 {
+		t.Errorf("got %+v, %v, want 6 packets", s, err)
+	}
+}
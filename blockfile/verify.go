@@ -0,0 +1,138 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blockfile
+
+import (
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"unsafe"
+
+	"github.com/google/stenographer/cryptfile"
+)
+
+// #include <linux/if_packet.h>
+import "C"
+
+// CorruptRegion is a damaged block found by Verify.  Offsets are into the
+// uncompressed blockfile, like index positions, so packets whose positions
+// fall within the region can't be trusted.
+type CorruptRegion struct {
+	Offset, Length int64
+	Err            error
+}
+
+func (c CorruptRegion) String() string {
+	return fmt.Sprintf("[%d, %d): %v", c.Offset, c.Offset+c.Length, c.Err)
+}
+
+// Verify scans every block of the named blockfile, returning those which are
+// damaged.  Compressed blockfiles record a CRC32C checksum of each block, as
+// do the checksum files WriteChecksums writes for uncompressed ones, so any
+// change to a block's data is caught.  For blockfiles without checksums, like
+// those stenotype writes, Verify can only check that each block's structure
+// is intact: that its packet headers chain together and their data lies
+// within the block.  An error is returned only if the file couldn't be
+// scanned at all.
+func Verify(filename string) ([]CorruptRegion, error) {
+	return VerifyWithKeys(filename, nil)
+}
+
+// VerifyWithKeys acts like Verify, but can also verify encrypted blockfiles,
+// getting their keys from 'keys'.  Encryption authenticates every chunk, so
+// any change to an encrypted file is caught, compressed or not.
+func VerifyWithKeys(filename string, keys *cryptfile.Keyring) ([]CorruptRegion, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	s, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	// All formats are read through their uncompressed, unencrypted view, one
+	// block at a time.
+	data, err := openData(f, s.Size(), keys)
+	if err != nil {
+		return nil, err
+	}
+	size := dataSize(data, s.Size())
+	var crcs []uint32
+	if !hasOwnChecksums(data) {
+		crcs = readChecksums(filename, size)
+	}
+	var corrupt []CorruptRegion
+	block := make([]byte, blockSize)
+	for off := int64(0); off < size; off += blockSize {
+		n, err := data.ReadAt(block, off)
+		if err == nil || (err == io.EOF && n > 0) {
+			err = checkBlock(block[:n])
+		}
+		if i := off / blockSize; err == nil && crcs != nil && !emptyBlock(block[:n]) && crc32.Checksum(block[:n], castagnoli) != crcs[i] {
+			checksumFailures.Increment()
+			err = fmt.Errorf("block %d failed its checksum", i)
+		}
+		if err != nil {
+			length := size - off
+			if length > blockSize {
+				length = blockSize
+			}
+			corrupt = append(corrupt, CorruptRegion{Offset: off, Length: length, Err: err})
+		}
+	}
+	return corrupt, nil
+}
+
+// emptyBlock returns true if the TPACKET_V3 block holds no packets, as those
+// freed by Expire don't.  checkBlock must have passed it.
+func emptyBlock(data []byte) bool {
+	desc := (*C.struct_tpacket_block_desc)(unsafe.Pointer(&data[0]))
+	return (*C.struct_tpacket_hdr_v1)(unsafe.Pointer(&desc.hdr[0])).num_pkts == 0
+}
+
+// checkBlock checks the structure of a single TPACKET_V3 block.
+func checkBlock(data []byte) error {
+	if len(data) < blockSize {
+		return fmt.Errorf("truncated block of %d bytes", len(data))
+	}
+	desc := (*C.struct_tpacket_block_desc)(unsafe.Pointer(&data[0]))
+	if desc.version != C.TPACKET_V3 {
+		return fmt.Errorf("block version %d, want %d", desc.version, C.TPACKET_V3)
+	}
+	hdr := (*C.struct_tpacket_hdr_v1)(unsafe.Pointer(&desc.hdr[0]))
+	length := int(hdr.blk_len)
+	if length > len(data) {
+		return fmt.Errorf("block length %d too long", length)
+	}
+	offset := int(hdr.offset_to_first_pkt)
+	for i := 0; i < int(hdr.num_pkts); i++ {
+		if offset+C.sizeof_struct_tpacket3_hdr > length {
+			return fmt.Errorf("packet %d header at %d beyond block length %d", i, offset, length)
+		}
+		pkt := (*C.struct_tpacket3_hdr)(unsafe.Pointer(&data[offset]))
+		if end := offset + int(pkt.tp_mac) + int(pkt.tp_snaplen); end > length {
+			return fmt.Errorf("packet %d data ends at %d, beyond block length %d", i, end, length)
+		}
+		if i < int(hdr.num_pkts)-1 {
+			if pkt.tp_next_offset == 0 {
+				return fmt.Errorf("packet %d of %d has no next packet", i, hdr.num_pkts)
+			}
+			offset += int(pkt.tp_next_offset)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blockfile
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// corrupt overwrites the byte at 'off' in the named file.
+func corrupt(t *testing.T, path string, off int64) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	b := []byte{0}
+	if _, err := f.ReadAt(b, off); err != nil {
+		t.Fatal(err)
+	}
+	b[0] ^= 0xff
+	if _, err := f.WriteAt(b, off); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	for _, name := range []string{"dhcp", "mpls", "vlan"} {
+		if bad, err := Verify("../testdata/PKT0/" + name); err != nil || len(bad) != 0 {
+			t.Errorf("%s: want no corruption, got %v, %v", name, bad, err)
+		}
+	}
+
+	// Pushing a packet's data past the end of block 1 of an uncompressed file.
+	raw := filepath.Join(t.TempDir(), "dhcp")
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(raw, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	corrupt(t, raw, blockSize+0x30+15) // High byte of packet 0's tp_snaplen.
+	bad, err := Verify(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bad) != 1 || bad[0].Offset != blockSize || bad[0].Length != blockSize {
+		t.Errorf("want block 1 corrupt, got %v", bad)
+	}
+
+	// Flipping any packet byte of a compressed file fails its checksum.
+	path := compressedCopy(t, "dhcp")
+	corrupt(t, path, compressedHeaderSize+10)
+	if bad, err = Verify(path); err != nil {
+		t.Fatal(err)
+	}
+	if len(bad) != 1 || bad[0].Offset != 0 {
+		t.Fatalf("want block 0 corrupt, got %v", bad)
+	}
+	if msg := bad[0].Err.Error(); !strings.Contains(msg, "checksum") && !strings.Contains(msg, "decompress") {
+		t.Errorf("unexpected error %q", msg)
+	}
+
+	// Reads of the damaged block fail too, rather than returning bad data.
+	blk := testBlockFile(t, path)
+	defer blk.Close()
+	c := blk.AllPackets()
+	for range c.Receive() {
+	}
+	if c.Err() == nil {
+		t.Error("want error reading corrupt block")
+	}
+}
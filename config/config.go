@@ -45,6 +45,70 @@ type ThreadConfig struct {
 	IndexDirectory     string
 	DiskFreePercentage int `json:",omitempty"`
 	MaxDirectoryFiles  int `json:",omitempty"`
+	// Compression, if set, names the codec used to compress this thread's
+	// blockfiles once stenotype has finished writing them.
+	Compression string `json:",omitempty"`
+	// Format, if 2, converts this thread's blockfiles to blockfile format v2
+	// once stenotype has finished writing them, before any compression.
+	Format int `json:",omitempty"`
+	// ChecksumFiles, if set, records the checksum of each block of this
+	// thread's blockfiles which are left uncompressed and unencrypted, once
+	// stenotype has finished writing them, so scrubbing catches any change.
+	ChecksumFiles bool `json:",omitempty"`
+	// Reader, if set, names how this thread's blockfiles are read from disk:
+	// "pread" (the default) or "mmap".
+	Reader string `json:",omitempty"`
+	// ReadConcurrency is how many of this thread's blockfiles each query
+	// reads at once, by default 10.
+	ReadConcurrency int `json:",omitempty"`
+	// CompactBelowMB, if set, merges runs of adjacent blockfiles each
+	// smaller than this many megabytes on disk into single files of at
+	// least that size.  Merged files hold at most CompactToMB megabytes of
+	// uncompressed packet data, by default (and at most) 4095.
+	CompactBelowMB int `json:",omitempty"`
+	CompactToMB    int `json:",omitempty"`
+	// ExpireAfterHours, if set, frees the space of packets older than this
+	// many hours, a block at a time, keeping blocks which hold packets
+	// matching PinQuery.  Blockfiles left empty are deleted.  Compressed and
+	// encrypted files can't be expired, so it can't be set with either.
+	ExpireAfterHours int    `json:",omitempty"`
+	PinQuery         string `json:",omitempty"`
+	// SharedFilesystem, if set, means this thread's directories are shared
+	// with other stenographer processes, perhaps on other hosts over NFS or
+	// CephFS.  Files are locked while read, and while replaced or rewritten,
+	// and files replaced or removed by others are reopened or dropped.
+	SharedFilesystem bool `json:",omitempty"`
+	// ScrubEveryHours, if set, checks each of this thread's blockfiles and
+	// indexes for damage once this often, reading slowly in the background.
+	// Damaged files are reported in logs and stats, and with
+	// QuarantineCorrupt set, moved aside into "quarantine" subdirectories
+	// where queries don't see them and nothing deletes them.
+	ScrubEveryHours   int  `json:",omitempty"`
+	QuarantineCorrupt bool `json:",omitempty"`
+	// MigrateIndexes, if set, rebuilds this thread's outdated indexes in the
+	// background: those written by older versions of stenographer, or
+	// without key types the config now has indexed, which queries otherwise
+	// answer by reading packets.
+	MigrateIndexes bool `json:",omitempty"`
+	// IndexCacheFiles, if set, keeps the positions found by recent lookups
+	// in this many of this thread's newest indexes in memory, sharing
+	// IndexCacheMB megabytes between them, by default 256.
+	IndexCacheFiles int `json:",omitempty"`
+	IndexCacheMB    int `json:",omitempty"`
+}
+
+// EncryptionConfig configures at-rest encryption of blockfiles and indexes.
+// Keys are 128, 192 or 256-bit AES keys, hex-encoded, found by ID either in
+// KeyDirectory or by running KeyCommand.
+type EncryptionConfig struct {
+	// KeyID names the key new files are encrypted with.  To rotate keys,
+	// change it, keeping older keys available to read older files.
+	KeyID string
+	// KeyDirectory holds one file per key, named by its ID.
+	KeyDirectory string `json:",omitempty"`
+	// KeyCommand is run with a key ID as its only argument, and prints the
+	// key.
+	KeyCommand string `json:",omitempty"`
 }
 
 // RpcConfig is a json-decoded configuration for running the gRPC server.
@@ -70,6 +134,46 @@ type Config struct {
 	Host          string // Location to listen.
 	CertPath      string // Directory where client and server certs are stored.
 	MaxOpenFiles  int    // Max number of file descriptors opened at once
+	// NanosecondTimestamps makes query responses use nanosecond-resolution
+	// PCAP files instead of the classic microsecond format.
+	NanosecondTimestamps bool `json:",omitempty"`
+	// Encryption, if set, encrypts blockfiles and indexes once stenotype has
+	// finished writing them.
+	Encryption *EncryptionConfig `json:",omitempty"`
+	// QueryMemoryMB, if set, caps the megabytes of packet positions a query
+	// may hold.  Lookups in a file that would exceed it read the file's
+	// packets a slice at a time instead, failing as "too broad" only if a
+	// slice doesn't fit either.  TotalQueryMemoryMB does the same for all
+	// queries running at once.
+	QueryMemoryMB      int `json:",omitempty"`
+	TotalQueryMemoryMB int `json:",omitempty"`
+	// MaxImportMB caps the megabytes of a capture POSTed to /import, by
+	// default 4096.
+	MaxImportMB int `json:",omitempty"`
+	// ReadOnly serves queries from directories written by another
+	// stenographer, typically on another host sharing them with
+	// SharedFilesystem set.  Stenotype isn't run, and no files are changed or
+	// deleted.
+	ReadOnly bool `json:",omitempty"`
+	// Sync is the policy for syncing written blockfiles and indexes to disk,
+	// one of the base.Sync* policies: "" (sync each file once written),
+	// "none" or "strict".
+	Sync string `json:",omitempty"`
+	// The rest choose optional keys to index packets by, in files indexed
+	// from then on (see indexfile.BuilderOptions), so the queries noted
+	// can be answered from indexes.  Files indexed without them have their
+	// packets read instead.  LengthBuckets lists the smallest length of
+	// each bucket after the first, in increasing order, like [65, 513,
+	// 1501].  CustomIndexers names custom indexers compiled in, like
+	// "sip", which stenotype doesn't run, so its new files are reindexed
+	// with them.
+	IndexMACs         bool     `json:",omitempty"` // "ether host"
+	IndexTCPFlags     bool     `json:",omitempty"` // "tcpflags"
+	IndexDNSAnswers   bool     `json:",omitempty"` // "dns.resolved"
+	IndexHTTPRequests bool     `json:",omitempty"` // "http.method", "http.path"
+	IndexCommunityIDs bool     `json:",omitempty"` // "community_id"
+	LengthBuckets     []int    `json:",omitempty"` // "len"
+	CustomIndexers    []string `json:",omitempty"` // "key"
 }
 
 // ReadConfigFile reads in the given JSON encoded configuration file and returns
@@ -110,6 +214,31 @@ func (c Config) Validate() error {
 		}
 	}
 
+	if e := c.Encryption; e != nil {
+		if e.KeyID == "" {
+			return fmt.Errorf("No encryption KeyID specified in configuration")
+		}
+		if (e.KeyDirectory == "") == (e.KeyCommand == "") {
+			return fmt.Errorf("Exactly one of encryption KeyDirectory and KeyCommand must be specified in configuration")
+		}
+		// Expiry skips encrypted files, so would never free anything.
+		for n, thread := range c.Threads {
+			if thread.ExpireAfterHours > 0 {
+				return fmt.Errorf("ExpireAfterHours can't be used with encryption, but is set for thread %d in configuration", n)
+			}
+		}
+	}
+
+	if c.QueryMemoryMB < 0 || c.TotalQueryMemoryMB < 0 {
+		return fmt.Errorf("Query memory limits must not be negative")
+	}
+	if c.MaxImportMB < 0 {
+		return fmt.Errorf("MaxImportMB must not be negative")
+	}
+	if !base.KnownSyncPolicy(c.Sync) {
+		return fmt.Errorf("Unknown sync policy %q", c.Sync)
+	}
+
 	if host := net.ParseIP(c.Host); host == nil {
 		return fmt.Errorf("invalid listening location %q in configuration", c.Host)
 	}
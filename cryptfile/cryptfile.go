@@ -0,0 +1,423 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cryptfile encrypts blockfiles and indexfiles at rest, while still
+// allowing random access to their contents.
+//
+// A file is encrypted in fixed-size chunks, each sealed separately with
+// AES-GCM under a random nonce, so reading at an offset decrypts only the
+// chunks covering it.  Layout:
+//
+//	header: magic, chunk size uint32, key ID length uint16, key ID
+//	chunks: per chunk, nonce then sealed data (plaintext plus GCM tag)
+//
+// All chunks but the last hold exactly chunk size bytes of plaintext, so
+// chunk offsets follow from the chunk size.  Each chunk's additional data is
+// the header, the chunk's index, and whether it's the last chunk, so chunks
+// can't be reordered, moved between files, or truncated away unnoticed.
+//
+// The header names the ID of the key a file was encrypted with.  Keys are
+// looked up by ID when reading, so the key used for new files can be rotated
+// while older files stay readable, as long as their keys remain available.
+package cryptfile
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/google/stenographer/base"
+	"github.com/google/stenographer/stats"
+)
+
+const (
+	magic      = "STENOE01"
+	nonceSize  = 12
+	tagSize    = 16
+	maxKeyID   = 255
+	cacheSlots = 4 // Decrypted chunks each Reader keeps
+	// maxChunkSize bounds the chunk size a file's header may give, since a
+	// chunk is read whole into memory.
+	maxChunkSize = 16 << 20
+)
+
+// Chunk sizes for the files stenographer encrypts.  Blockfile reads are
+// block-sized, while index reads are small and scattered.
+const (
+	BlockfileChunkSize = 1 << 20
+	IndexChunkSize     = 64 << 10
+)
+
+var (
+	chunksDecrypted  = stats.S.Get("cryptfile_chunks_decrypted")
+	decryptFailures  = stats.S.Get("cryptfile_decrypt_failures")
+	filesEncrypted   = stats.S.Get("cryptfile_files_encrypted")
+	chunkDecryptNano = stats.S.Get("cryptfile_chunk_decrypt_nanos")
+)
+
+// KeyProvider supplies encryption keys by ID.
+type KeyProvider interface {
+	Key(id string) ([]byte, error)
+}
+
+// KeyDirectory provides keys from files in a directory, each named by its key
+// ID and holding the hex-encoded key.
+type KeyDirectory string
+
+// Key implements KeyProvider.
+func (d KeyDirectory) Key(id string) ([]byte, error) {
+	if id == "" || strings.ContainsAny(id, `/\`) || id[0] == '.' {
+		return nil, fmt.Errorf("invalid key ID %q", id)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(string(d), id))
+	if err != nil {
+		return nil, err
+	}
+	return decodeKey(data)
+}
+
+// KeyCommand provides keys by running a command, with the key ID as its only
+// argument, which prints the hex-encoded key.  This lets keys live in an
+// external key management system.
+type KeyCommand string
+
+// Key implements KeyProvider.
+func (c KeyCommand) Key(id string) ([]byte, error) {
+	out, err := exec.Command(string(c), id).Output()
+	if err != nil {
+		return nil, fmt.Errorf("key command %q failed for key %q: %v", string(c), id, err)
+	}
+	return decodeKey(out)
+}
+
+func decodeKey(data []byte) ([]byte, error) {
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("key is not hex-encoded: %v", err)
+	}
+	switch len(key) {
+	case 16, 24, 32:
+		return key, nil
+	}
+	return nil, fmt.Errorf("key is %d bytes, want 16, 24 or 32", len(key))
+}
+
+// Keyring caches keys from a KeyProvider, and names the key new files are
+// encrypted with.
+type Keyring struct {
+	current  string
+	provider KeyProvider
+	mu       sync.Mutex
+	aeads    map[string]cipher.AEAD
+}
+
+// NewKeyring returns a Keyring encrypting new files with the key with ID
+// 'current', and looking up all keys with 'provider'.
+func NewKeyring(current string, provider KeyProvider) (*Keyring, error) {
+	if len(current) > maxKeyID {
+		return nil, fmt.Errorf("key ID %q too long", current)
+	}
+	k := &Keyring{current: current, provider: provider, aeads: map[string]cipher.AEAD{}}
+	// Fail now, rather than on the first file, if the current key is bad.
+	if _, err := k.aead(current); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Current returns the ID of the key new files are encrypted with.
+func (k *Keyring) Current() string {
+	return k.current
+}
+
+// aead returns the cipher for the given key ID.
+func (k *Keyring) aead(id string) (cipher.AEAD, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if a := k.aeads[id]; a != nil {
+		return a, nil
+	}
+	key, err := k.provider.Key(id)
+	if err != nil {
+		return nil, fmt.Errorf("could not get key %q: %v", id, err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	a, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	k.aeads[id] = a
+	return a, nil
+}
+
+// IsEncrypted returns true if the data in r is encrypted.
+func IsEncrypted(r io.ReaderAt) (bool, error) {
+	var m [len(magic)]byte
+	if _, err := r.ReadAt(m[:], 0); err == io.EOF {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return string(m[:]) == magic, nil
+}
+
+// IsEncryptedFile returns true if the named file is encrypted.
+func IsEncryptedFile(filename string) (bool, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	return IsEncrypted(f)
+}
+
+// header returns the header for a file with the given chunk size and key.
+func header(chunkSize int, keyID string) []byte {
+	h := make([]byte, len(magic)+6, len(magic)+6+len(keyID))
+	copy(h, magic)
+	binary.LittleEndian.PutUint32(h[len(magic):], uint32(chunkSize))
+	binary.LittleEndian.PutUint16(h[len(magic)+4:], uint16(len(keyID)))
+	return append(h, keyID...)
+}
+
+// additionalData returns the GCM additional data for a chunk.
+func additionalData(header []byte, index int64, last bool) []byte {
+	ad := make([]byte, len(header)+9)
+	copy(ad, header)
+	binary.LittleEndian.PutUint64(ad[len(header):], uint64(index))
+	if last {
+		ad[len(ad)-1] = 1
+	}
+	return ad
+}
+
+// EncryptFile writes an encrypted copy of src to dst, with the keyring's
+// current key, in chunks of the given size.
+func EncryptFile(src, dst string, keys *Keyring, chunkSize int) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if encrypted, err := IsEncrypted(in); err != nil {
+		return err
+	} else if encrypted {
+		return fmt.Errorf("%q is already encrypted", src)
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if err := Encrypt(in, out, keys, chunkSize); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return fmt.Errorf("could not encrypt %q: %v", src, err)
+	}
+	if err := base.SyncFile(out); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	return out.Close()
+}
+
+// Encrypt encrypts everything read from in to out, with the keyring's
+// current key, in chunks of the given size.
+func Encrypt(in io.Reader, out io.Writer, keys *Keyring, chunkSize int) error {
+	if chunkSize <= 0 || chunkSize > maxChunkSize {
+		return fmt.Errorf("invalid chunk size %d", chunkSize)
+	}
+	a, err := keys.aead(keys.current)
+	if err != nil {
+		return err
+	}
+	h := header(chunkSize, keys.current)
+	if _, err := out.Write(h); err != nil {
+		return err
+	}
+	// Read a chunk ahead, so we know which chunk is the last.
+	cur, next := make([]byte, chunkSize), make([]byte, chunkSize)
+	n, err := io.ReadFull(in, cur)
+	sealed := make([]byte, 0, nonceSize+chunkSize+tagSize)
+	for index := int64(0); ; index++ {
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		last := err != nil
+		var nextN int
+		var nextErr error
+		if !last {
+			if nextN, nextErr = io.ReadFull(in, next); nextErr == io.EOF {
+				last = true
+			}
+		}
+		sealed = sealed[:nonceSize]
+		if _, err := io.ReadFull(rand.Reader, sealed); err != nil {
+			return err
+		}
+		sealed = a.Seal(sealed, sealed[:nonceSize], cur[:n], additionalData(h, index, last))
+		if _, err := out.Write(sealed); err != nil {
+			return err
+		}
+		if last {
+			break
+		}
+		cur, next, n, err = next, cur, nextN, nextErr
+	}
+	filesEncrypted.Increment()
+	return nil
+}
+
+// chunk is a cached, decrypted chunk.
+type chunk struct {
+	index int64
+	data  []byte
+}
+
+// Reader reads the plaintext of an encrypted file.
+type Reader struct {
+	f         io.ReaderAt
+	header    []byte
+	aead      cipher.AEAD
+	chunkSize int64
+	chunks    int64
+	size      int64 // Plaintext size
+	mu        sync.Mutex
+	cache     []chunk // Most recently used first
+}
+
+// NewReader returns a Reader for the encrypted data in f, which is fileSize
+// bytes long, getting its key from 'keys'.
+func NewReader(f io.ReaderAt, fileSize int64, keys *Keyring) (*Reader, error) {
+	fixed := make([]byte, len(magic)+6)
+	if _, err := f.ReadAt(fixed, 0); err != nil {
+		return nil, fmt.Errorf("could not read header: %v", err)
+	}
+	if string(fixed[:len(magic)]) != magic {
+		return nil, fmt.Errorf("not an encrypted file")
+	}
+	chunkSize := int64(binary.LittleEndian.Uint32(fixed[len(magic):]))
+	if chunkSize == 0 || chunkSize > maxChunkSize {
+		return nil, fmt.Errorf("invalid chunk size %d", chunkSize)
+	}
+	keyID := make([]byte, binary.LittleEndian.Uint16(fixed[len(magic)+4:]))
+	if _, err := f.ReadAt(keyID, int64(len(fixed))); err != nil {
+		return nil, fmt.Errorf("could not read key ID: %v", err)
+	}
+	if keys == nil {
+		return nil, fmt.Errorf("encrypted with key %q, but no keys are configured", keyID)
+	}
+	a, err := keys.aead(string(keyID))
+	if err != nil {
+		return nil, err
+	}
+	r := &Reader{f: f, header: append(fixed, keyID...), aead: a, chunkSize: chunkSize}
+	stride := nonceSize + chunkSize + tagSize
+	body := fileSize - int64(len(r.header))
+	if body < nonceSize+tagSize {
+		return nil, fmt.Errorf("encrypted file truncated")
+	}
+	r.chunks = (body + stride - 1) / stride
+	lastLen := body - (r.chunks-1)*stride
+	if lastLen < nonceSize+tagSize {
+		return nil, fmt.Errorf("encrypted file truncated")
+	}
+	r.size = (r.chunks-1)*chunkSize + lastLen - nonceSize - tagSize
+	// Decrypting the last chunk checks that it really is the last, so
+	// truncation at a chunk boundary is caught now.
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, err := r.chunk(r.chunks - 1); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Size returns the plaintext size.
+func (r *Reader) Size() int64 {
+	return r.size
+}
+
+// KeyID returns the ID of the key the file was encrypted with.
+func (r *Reader) KeyID() string {
+	return string(r.header[len(magic)+6:])
+}
+
+// chunk returns the plaintext of chunk i.  r.mu must be held while the result
+// is in use, since its buffer is reused once evicted.
+func (r *Reader) chunk(i int64) ([]byte, error) {
+	for j, c := range r.cache {
+		if c.index == i {
+			copy(r.cache[1:j+1], r.cache[:j])
+			r.cache[0] = c
+			return c.data, nil
+		}
+	}
+	defer chunkDecryptNano.NanoTimer()()
+	chunksDecrypted.Increment()
+	stride := nonceSize + r.chunkSize + tagSize
+	n := stride
+	if i == r.chunks-1 {
+		n = r.size - i*r.chunkSize + nonceSize + tagSize
+	}
+	sealed := make([]byte, n)
+	if _, err := r.f.ReadAt(sealed, int64(len(r.header))+i*stride); err != nil {
+		return nil, fmt.Errorf("could not read encrypted chunk %d: %v", i, err)
+	}
+	var buf []byte
+	if last := len(r.cache) - 1; last+1 == cacheSlots {
+		buf = r.cache[last].data[:0]
+		r.cache = r.cache[:last]
+	}
+	data, err := r.aead.Open(buf, sealed[:nonceSize], sealed[nonceSize:], additionalData(r.header, i, i == r.chunks-1))
+	if err != nil {
+		decryptFailures.Increment()
+		return nil, fmt.Errorf("could not decrypt chunk %d: %v", i, err)
+	}
+	r.cache = append([]chunk{{i, data}}, r.cache...)
+	return data, nil
+}
+
+// ReadAt implements io.ReaderAt over the plaintext.
+func (r *Reader) ReadAt(p []byte, off int64) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := 0
+	for n < len(p) {
+		if off >= r.size {
+			return n, io.EOF
+		}
+		data, err := r.chunk(off / r.chunkSize)
+		if err != nil {
+			return n, err
+		}
+		c := copy(p[n:], data[off%r.chunkSize:])
+		n += c
+		off += int64(c)
+	}
+	return n, nil
+}
@@ -0,0 +1,168 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cryptfile
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"testing"
+)
+
+// testKeys provides fixed keys, each 32 bytes of its ID's first byte.
+type testKeys map[string]bool
+
+func (k testKeys) Key(id string) ([]byte, error) {
+	if !k[id] {
+		return nil, fmt.Errorf("no key %q", id)
+	}
+	return bytes.Repeat([]byte{id[0]}, 32), nil
+}
+
+func testKeyring(t *testing.T, current string) *Keyring {
+	k, err := NewKeyring(current, testKeys{"old": true, "new": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func encrypt(t *testing.T, data []byte, keys *Keyring, chunkSize int) []byte {
+	var buf bytes.Buffer
+	if err := Encrypt(bytes.NewReader(data), &buf, keys, chunkSize); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestRoundTrip(t *testing.T) {
+	const chunk = 100
+	keys := testKeyring(t, "new")
+	rng := rand.New(rand.NewSource(1))
+	for _, size := range []int{0, 1, chunk - 1, chunk, chunk + 1, 3*chunk + 7} {
+		want := make([]byte, size)
+		rng.Read(want)
+		sealed := encrypt(t, want, keys, chunk)
+		if encrypted, err := IsEncrypted(bytes.NewReader(sealed)); err != nil || !encrypted {
+			t.Fatalf("size %d: not detected as encrypted", size)
+		}
+		if bytes.Contains(sealed, want[:size/2]) && size > 8 {
+			t.Errorf("size %d: plaintext visible", size)
+		}
+		r, err := NewReader(bytes.NewReader(sealed), int64(len(sealed)), keys)
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if r.Size() != int64(size) || r.KeyID() != "new" {
+			t.Fatalf("size %d: got size %d, key %q", size, r.Size(), r.KeyID())
+		}
+		got := make([]byte, size)
+		if _, err := r.ReadAt(got, 0); err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("size %d: wrong plaintext", size)
+		}
+		for i := 0; i < 20 && size > 0; i++ {
+			off := rng.Intn(size)
+			buf := make([]byte, rng.Intn(2*chunk))
+			n, err := r.ReadAt(buf, int64(off))
+			if !bytes.Equal(buf[:n], want[off:off+n]) || (n < len(buf)) != (err == io.EOF) {
+				t.Fatalf("size %d: ReadAt(%d, %d) got %d, %v", size, len(buf), off, n, err)
+			}
+		}
+	}
+}
+
+func TestTampering(t *testing.T) {
+	const chunk = 100
+	keys := testKeyring(t, "new")
+	data := bytes.Repeat([]byte("packets!"), 50)
+	sealed := encrypt(t, data, keys, chunk)
+	open := func(b []byte) (*Reader, error) { return NewReader(bytes.NewReader(b), int64(len(b)), keys) }
+
+	flipped := append([]byte(nil), sealed...)
+	flipped[len(flipped)/2] ^= 1
+	if r, err := open(flipped); err != nil {
+		t.Fatal(err) // Only the last chunk is checked on open.
+	} else if _, err := r.ReadAt(make([]byte, len(data)), 0); err == nil {
+		t.Error("want error reading modified chunk")
+	}
+	header := len(header(chunk, "new"))
+	stride := nonceSize + chunk + tagSize
+	if _, err := open(sealed[:header+2*stride]); err == nil {
+		t.Error("want error opening file truncated at a chunk boundary")
+	}
+	if _, err := open(sealed[:len(sealed)-1]); err == nil {
+		t.Error("want error opening file truncated mid-chunk")
+	}
+	if _, err := NewReader(bytes.NewReader(sealed), int64(len(sealed)), nil); err == nil {
+		t.Error("want error opening without keys")
+	}
+	// A damaged header can't make reads allocate gigabytes.
+	huge := append([]byte(nil), sealed...)
+	copy(huge[len(magic):], []byte{0xff, 0xff, 0xff, 0xff})
+	if _, err := open(huge); err == nil {
+		t.Error("want error opening file with huge chunk size")
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	data := []byte("captured traffic")
+	old := encrypt(t, data, testKeyring(t, "old"), IndexChunkSize)
+	// After rotating, files written with the old key still read.
+	keys := testKeyring(t, "new")
+	r, err := NewReader(bytes.NewReader(old), int64(len(old)), keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(data))
+	if _, err := r.ReadAt(got, 0); err != nil || !bytes.Equal(got, data) || r.KeyID() != "old" {
+		t.Errorf("got %q, %v from key %q", got, err, r.KeyID())
+	}
+	// Without the old key, they don't.
+	newOnly, err := NewKeyring("new", testKeys{"new": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewReader(bytes.NewReader(old), int64(len(old)), newOnly); err == nil {
+		t.Error("want error reading without the old key")
+	}
+	if _, err := NewKeyring("missing", testKeys{}); err == nil {
+		t.Error("want error for missing current key")
+	}
+}
+
+func TestKeyDirectory(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "k1"), []byte("00112233445566778899aabbccddeeff\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "short"), []byte("0011"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	keys := KeyDirectory(dir)
+	if key, err := keys.Key("k1"); err != nil || len(key) != 16 {
+		t.Errorf("k1: got %x, %v", key, err)
+	}
+	for _, id := range []string{"short", "missing", "../k1", ""} {
+		if _, err := keys.Key(id); err == nil {
+			t.Errorf("%q: want error", id)
+		}
+	}
+}
@@ -27,14 +27,18 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/google/stenographer/base"
+	"github.com/google/stenographer/blockfile"
 	"github.com/google/stenographer/certs"
 	"github.com/google/stenographer/config"
+	"github.com/google/stenographer/cryptfile"
 	"github.com/google/stenographer/filecache"
 	"github.com/google/stenographer/httputil"
+	"github.com/google/stenographer/indexfile"
 	"github.com/google/stenographer/query"
 	"github.com/google/stenographer/stats"
 	"github.com/google/stenographer/thread"
@@ -49,6 +53,17 @@ var (
 
 const (
 	fileSyncFrequency = 15 * time.Second
+	// How often to look for small files to compact.
+	fileCompactFrequency = time.Minute
+	// How often to look for packets to expire.
+	fileExpireFrequency = time.Minute
+	// How often to look for files due a scrub.
+	fileScrubFrequency = time.Minute
+	// How often to look for outdated indexes to migrate.
+	fileMigrateFrequency = time.Minute
+
+	// defaultMaxImportMB caps imports when Config.MaxImportMB isn't set.
+	defaultMaxImportMB = 4096
 
 	// These files will be read from Config.CertPath.
 	// Use stenokeys.sh to generate them.
@@ -70,6 +85,9 @@ func (e *Env) Serve() error {
 		TLSConfig: tlsConfig,
 	}
 	http.HandleFunc("/query", e.handleQuery)
+	http.HandleFunc("/import", e.handleImport)
+	http.HandleFunc("/export", e.handleExport)
+	http.HandleFunc("/reindex", e.handleReindex)
 	http.Handle("/debug/stats", stats.S)
 	return server.ListenAndServeTLS(
 		filepath.Join(e.conf.CertPath, serverCertFilename),
@@ -85,6 +103,28 @@ func (e *Env) handleQuery(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid Limit Headers", http.StatusBadRequest)
 		return
 	}
+	rate, err := base.RateFromValues(r.URL.Query())
+	if err != nil {
+		http.Error(w, "Invalid rate parameters", http.StatusBadRequest)
+		return
+	}
+	filter, err := base.BPFFromValues(r.URL.Query())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid BPF filter: %v", err), http.StatusBadRequest)
+		return
+	}
+	access := r.URL.Query().Get("access")
+	if !blockfile.KnownAccess(access) {
+		http.Error(w, "Invalid access pattern", http.StatusBadRequest)
+		return
+	}
+	var dedupWindow time.Duration
+	if d := r.URL.Query().Get("dedup"); d != "" {
+		if dedupWindow, err = time.ParseDuration(d); err != nil {
+			http.Error(w, "Invalid dedup window", http.StatusBadRequest)
+			return
+		}
+	}
 
 	queryBytes, err := ioutil.ReadAll(r.Body)
 	if err != nil {
@@ -98,9 +138,200 @@ func (e *Env) handleQuery(w http.ResponseWriter, r *http.Request) {
 	}
 	ctx := httputil.Context(w, r, time.Minute*15)
 	defer ctx.Cancel()
-	packets := e.Lookup(ctx, q)
-	w.Header().Set("Content-Type", "application/octet-stream")
-	base.PacketsToFile(packets, w, limit)
+	lookupCtx := blockfile.WithAccess(ctx, access)
+	var packets, merged *base.PacketChan
+	var merge *base.MergeErrors
+	if partial, _ := strconv.ParseBool(r.URL.Query().Get("partial")); partial {
+		// Blockfiles failing mid-query cost us their packets, not the whole
+		// query.  Failures are reported in a trailer once the packets are out.
+		packets, merge = e.LookupTolerant(lookupCtx, q)
+		merged = packets
+		w.Header().Set("Trailer", mergeErrorsTrailer)
+	} else {
+		packets = e.Lookup(lookupCtx, q)
+	}
+	if filter != nil {
+		if packets, err = base.BPFFilterChan(packets, filter); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid BPF filter: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	if dedupWindow > 0 {
+		var dedup *base.DedupStats
+		packets, dedup = base.DedupWindowChan(packets, dedupWindow)
+		defer func() { log.Printf("Query %q suppressed %d duplicate packets", q, dedup.Suppressed()) }()
+	}
+	packets = base.RateLimitChan(packets, rate)
+	// Time blocked sending output means we were waiting on the client.
+	packets, output := base.InstrumentChan(packets, "query_output")
+	defer func() { log.Printf("Query %q output: %v", q, output.Snapshot()) }()
+	e.writePackets(w, r, packets, limit)
+	if merge != nil {
+		// Output may have stopped at a limit with the merge still running,
+		// and its failures are only all known once it's done.
+		packets.Discard()
+		<-merged.Done()
+		if err := merge.Err(); err != nil {
+			log.Printf("Query %q returned partial results: %v", q, err)
+			w.Header().Set(mergeErrorsTrailer, err.Error())
+		}
+	}
+}
+
+// writePackets writes packets out as the request asks: pcapng if it opts in,
+// otherwise PCAP with the configured timestamp precision.
+func (e *Env) writePackets(w http.ResponseWriter, r *http.Request, packets *base.PacketChan, limit base.Limit) {
+	switch {
+	case wantsPcapng(r):
+		w.Header().Set("Content-Type", pcapngContentType)
+		hostname, _ := os.Hostname()
+		base.PacketsToPcapng(packets, w, limit, base.PcapngSection{Hostname: hostname})
+	case e.conf.NanosecondTimestamps:
+		w.Header().Set("Content-Type", "application/octet-stream")
+		base.PacketsToFileNanos(packets, w, limit)
+	default:
+		w.Header().Set("Content-Type", "application/octet-stream")
+		base.PacketsToFile(packets, w, limit)
+	}
+}
+
+// handleExport exports whole blockfiles, without a query: either every packet
+// between the "start" and "end" URL parameters (RFC3339 times, either of which
+// may be left out), or one blockfile, given by the "thread" and "name"
+// parameters.  Packets are streamed as they're read, in the same formats as
+// query results.
+func (e *Env) handleExport(w http.ResponseWriter, r *http.Request) {
+	w = httputil.Log(w, r, true)
+	defer log.Print(w)
+
+	limit, err := base.LimitFromHeaders(r.Header)
+	if err != nil {
+		http.Error(w, "Invalid Limit Headers", http.StatusBadRequest)
+		return
+	}
+	values := r.URL.Query()
+	rate, err := base.RateFromValues(values)
+	if err != nil {
+		http.Error(w, "Invalid rate parameters", http.StatusBadRequest)
+		return
+	}
+	ctx := httputil.Context(w, r, time.Minute*15)
+	defer ctx.Cancel()
+	var packets *base.PacketChan
+	var what string
+	if name := values.Get("name"); name != "" {
+		id, err := strconv.Atoi(values.Get("thread"))
+		if err != nil {
+			http.Error(w, "Invalid thread", http.StatusBadRequest)
+			return
+		}
+		if packets, err = e.ExportFile(ctx, id, name); err != nil {
+			http.Error(w, fmt.Sprintf("could not export: %v", err), http.StatusNotFound)
+			return
+		}
+		what = fmt.Sprintf("thread %d file %q", id, name)
+	} else {
+		var start, end time.Time
+		for _, t := range []struct {
+			param string
+			time  *time.Time
+		}{{"start", &start}, {"end", &end}} {
+			if s := values.Get(t.param); s != "" {
+				if *t.time, err = time.Parse(time.RFC3339Nano, s); err != nil {
+					http.Error(w, fmt.Sprintf("Invalid %s time", t.param), http.StatusBadRequest)
+					return
+				}
+			}
+		}
+		if start.IsZero() && end.IsZero() {
+			http.Error(w, "export needs a start or end time, or a file name", http.StatusBadRequest)
+			return
+		}
+		packets = e.Export(ctx, start, end)
+		what = query.NewTimeRangeQuery(start, end).String()
+	}
+	packets = base.RateLimitChan(packets, rate)
+	packets, output := base.InstrumentChan(packets, "export_output")
+	defer func() { log.Printf("Export of %v output: %v", what, output.Snapshot()) }()
+	e.writePackets(w, r, packets, limit)
+}
+
+// handleImport imports the PCAP or pcapng capture in the request body into the
+// thread given by the "thread" URL parameter, listing the blockfiles written.
+func (e *Env) handleImport(w http.ResponseWriter, r *http.Request) {
+	w = httputil.Log(w, r, false)
+	defer log.Print(w)
+
+	if r.Method != "POST" {
+		http.Error(w, "import requires POST", http.StatusMethodNotAllowed)
+		return
+	}
+	maxMB := e.conf.MaxImportMB
+	if maxMB == 0 {
+		maxMB = defaultMaxImportMB
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, int64(maxMB)<<20)
+	id, err := strconv.Atoi(r.URL.Query().Get("thread"))
+	if err != nil || id < 0 || id >= len(e.threads) {
+		http.Error(w, "Invalid thread", http.StatusBadRequest)
+		return
+	}
+	files, err := e.Import(id, r.Body)
+	if err != nil {
+		log.Printf("Import into thread %d failed after %d files: %v", id, len(files), err)
+		http.Error(w, fmt.Sprintf("could not import: %v", err), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	for _, f := range files {
+		fmt.Fprintf(w, "%s\t%d packets\t%v\t%v\n", f.Name, f.Packets,
+			f.First.UTC().Format(time.RFC3339Nano), f.Last.UTC().Format(time.RFC3339Nano))
+	}
+}
+
+// handleReindex rebuilds the index of the blockfile given by the "thread" and
+// "name" URL parameters from its packets, describing what was indexed.
+func (e *Env) handleReindex(w http.ResponseWriter, r *http.Request) {
+	w = httputil.Log(w, r, true)
+	defer log.Print(w)
+
+	if r.Method != "POST" {
+		http.Error(w, "reindex requires POST", http.StatusMethodNotAllowed)
+		return
+	}
+	values := r.URL.Query()
+	id, err := strconv.Atoi(values.Get("thread"))
+	if err != nil || id < 0 || id >= len(e.threads) {
+		http.Error(w, "Invalid thread", http.StatusBadRequest)
+		return
+	}
+	name := values.Get("name")
+	ri, err := e.Reindex(id, name)
+	if err != nil {
+		log.Printf("Reindex of thread %d file %q failed: %v", id, name, err)
+		http.Error(w, fmt.Sprintf("could not reindex: %v", err), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintf(w, "%s\t%d packets\t%d blocks\n", name, ri.Packets, ri.Blocks)
+	for _, d := range ri.Damaged {
+		fmt.Fprintf(w, "damaged\t%v\n", d)
+	}
+}
+
+// mergeErrorsTrailer is the HTTP trailer describing failed threads, sent with
+// partial query results.
+const mergeErrorsTrailer = "Steno-Merge-Errors"
+
+// pcapngContentType is the media type clients can Accept to receive query
+// results as pcapng.
+const pcapngContentType = "application/x-pcapng"
+
+// wantsPcapng returns true if a query request opts into pcapng output, either
+// with the "format=pcapng" URL parameter or by accepting pcapngContentType.
+func wantsPcapng(r *http.Request) bool {
+	return r.URL.Query().Get("format") == "pcapng" ||
+		strings.Contains(r.Header.Get("Accept"), pcapngContentType)
 }
 
 // New returns a new Env for use in running Stenotype.
@@ -118,26 +349,108 @@ func New(c config.Config) (_ *Env, returnedErr error) {
 			os.RemoveAll(dirname)
 		}
 	}()
+	base.SetSyncPolicy(c.Sync)
+	indexOpts := indexfile.BuilderOptions{
+		IndexMACs:         c.IndexMACs,
+		IndexTCPFlags:     c.IndexTCPFlags,
+		IndexDNSAnswers:   c.IndexDNSAnswers,
+		IndexHTTPRequests: c.IndexHTTPRequests,
+		IndexCommunityIDs: c.IndexCommunityIDs,
+		LengthBuckets:     c.LengthBuckets,
+		CustomIndexers:    c.CustomIndexers,
+	}
+	if err := indexOpts.Validate(); err != nil {
+		return nil, err
+	}
 	threads, err := thread.Threads(c.Threads, dirname, filecache.NewCache(c.MaxOpenFiles))
 	if err != nil {
 		return nil, err
 	}
+	var keys *cryptfile.Keyring
+	if e := c.Encryption; e != nil {
+		var provider cryptfile.KeyProvider = cryptfile.KeyDirectory(e.KeyDirectory)
+		if e.KeyCommand != "" {
+			provider = cryptfile.KeyCommand(e.KeyCommand)
+		}
+		if keys, err = cryptfile.NewKeyring(e.KeyID, provider); err != nil {
+			return nil, fmt.Errorf("could not load encryption keys: %v", err)
+		}
+	}
+	for _, t := range threads {
+		t.SetInterface(c.Interface)
+		t.SetCaptureFilter(captureFilter(c.Flags))
+		t.SetKeyring(keys)
+		t.SetIndexOptions(indexOpts)
+		if c.ReadOnly {
+			t.SetReadOnly()
+		}
+	}
 	d := &Env{
 		conf:    c,
 		name:    dirname,
 		threads: threads,
 		done:    make(chan bool),
 	}
+	if c.TotalQueryMemoryMB > 0 {
+		d.budget = base.NewSharedMemoryBudget(int64(c.TotalQueryMemoryMB) << 20)
+	}
 	go d.callEvery(d.syncFiles, fileSyncFrequency)
+	go d.callEvery(d.compactFiles, fileCompactFrequency)
+	go d.callEvery(d.expireFiles, fileExpireFrequency)
+	go d.callEvery(d.scrubFiles, fileScrubFrequency)
+	go d.callEvery(d.migrateIndexes, fileMigrateFrequency)
 	return d, nil
 }
 
+// captureFilter returns the compiled BPF filter given to stenotype by its
+// flags, or "" if there's none.
+func captureFilter(flags []string) string {
+	filter := ""
+	for i, flag := range flags {
+		if strings.HasPrefix(flag, "--filter=") {
+			filter = strings.TrimPrefix(flag, "--filter=")
+		} else if flag == "--filter" && i+1 < len(flags) {
+			filter = flags[i+1]
+		}
+	}
+	return filter
+}
+
 // args is the set of command line arguments to pass to stentype.
 func (d *Env) args() []string {
-	return append(d.conf.Flags,
+	args := append(d.conf.Flags,
 		fmt.Sprintf("--threads=%d", len(d.conf.Threads)),
 		fmt.Sprintf("--iface=%s", d.conf.Interface),
 		fmt.Sprintf("--dir=%s", d.Path()))
+	switch d.conf.Sync {
+	case base.SyncNone:
+		args = append(args, "--no_dsync")
+	case base.SyncStrict:
+		args = append(args, "--sync_index")
+	}
+	if d.conf.IndexMACs {
+		args = append(args, "--index_macs")
+	}
+	if d.conf.IndexTCPFlags {
+		args = append(args, "--index_tcp_flags")
+	}
+	if d.conf.IndexDNSAnswers {
+		args = append(args, "--index_dns_answers")
+	}
+	if d.conf.IndexHTTPRequests {
+		args = append(args, "--index_http_requests")
+	}
+	if d.conf.IndexCommunityIDs {
+		args = append(args, "--index_community_ids")
+	}
+	if len(d.conf.LengthBuckets) > 0 {
+		buckets := make([]string, len(d.conf.LengthBuckets))
+		for i, b := range d.conf.LengthBuckets {
+			buckets[i] = strconv.Itoa(b)
+		}
+		args = append(args, "--length_buckets="+strings.Join(buckets, ","))
+	}
+	return args
 }
 
 // stenotype returns a exec.Cmd which runs the stenotype binary with all of
@@ -156,6 +469,7 @@ type Env struct {
 	threads []*thread.Thread
 	done    chan bool
 	fc      *filecache.Cache
+	budget  *base.MemoryBudget // Shared by all queries
 	// StenotypeOutput is the writer that stenotype STDOUT/STDERR will be
 	// redirected to.
 	StenotypeOutput io.Writer
@@ -261,19 +575,117 @@ func (d *Env) syncFiles() {
 	}
 }
 
+func (d *Env) compactFiles() {
+	for _, t := range d.threads {
+		t.Compact()
+	}
+}
+
+func (d *Env) expireFiles() {
+	for _, t := range d.threads {
+		t.Expire()
+	}
+}
+
+func (d *Env) scrubFiles() {
+	for _, t := range d.threads {
+		t.Scrub()
+	}
+}
+
+func (d *Env) migrateIndexes() {
+	for _, t := range d.threads {
+		t.MigrateIndexes()
+	}
+}
+
 // Path returns the underlying directory path for the given Env.
 func (d *Env) Path() string {
 	return d.name
 }
 
 // Lookup looks up the given query in all blockfiles currently known in this
-// Env.
+// Env.  Packets outside the query's time or length bounds are dropped, even if
+// they're in blockfiles or length buckets the query selected.  Queries whose
+// packet positions don't fit the configured memory limits fail as too broad.
 func (d *Env) Lookup(ctx context.Context, q query.Query) *base.PacketChan {
+	ctx = d.withBudget(ctx)
+	return bounded(base.MergePacketChans(ctx, d.lookupThreads(ctx, q, false)), q)
+}
+
+// LookupTolerant acts like Lookup, but keeps going when a thread's lookup, or
+// the lookup of any of its blockfiles, fails, instead returning the failures
+// (indexed by the thread's position in the config's Threads) alongside the
+// rest of the results.
+func (d *Env) LookupTolerant(ctx context.Context, q query.Query) (*base.PacketChan, *base.MergeErrors) {
+	ctx = d.withBudget(ctx)
+	merged, errs := base.MergePacketChansTolerant(ctx, d.lookupThreads(ctx, q, true))
+	return bounded(merged, q), errs
+}
+
+// bounded drops the packets from 'in' outside q's time and length bounds.
+func bounded(in *base.PacketChan, q query.Query) *base.PacketChan {
+	start, end := query.TimeRange(q)
+	min, max := query.LengthRange(q)
+	return base.LengthRangeChan(base.TimeRangeChan(in, start, end), min, max)
+}
+
+// withBudget returns a context giving a query its own memory budget for
+// packet positions, drawing on the budget shared by all queries.
+func (d *Env) withBudget(ctx context.Context) context.Context {
+	if d.conf.QueryMemoryMB == 0 && d.budget == nil {
+		return ctx
+	}
+	return base.WithMemoryBudget(ctx, base.NewMemoryBudget(int64(d.conf.QueryMemoryMB)<<20, d.budget))
+}
+
+// Export returns every packet in [start, end) across all threads, merged by
+// time.  Either bound may be zero to leave that side open.  Blockfiles are
+// picked by their time ranges and read whole, without index lookups.
+func (d *Env) Export(ctx context.Context, start, end time.Time) *base.PacketChan {
+	return d.Lookup(ctx, query.NewTimeRangeQuery(start, end))
+}
+
+// ExportFile returns every packet in the named blockfile of the given thread
+// (indexed by its position in the config's Threads), as with
+// thread.ExportFile.
+func (d *Env) ExportFile(ctx context.Context, thread int, name string) (*base.PacketChan, error) {
+	if thread < 0 || thread >= len(d.threads) {
+		return nil, fmt.Errorf("no thread %d", thread)
+	}
+	return d.threads[thread].ExportFile(ctx, name)
+}
+
+// Import imports a PCAP or pcapng capture into the given thread (indexed by
+// its position in the config's Threads), as with thread.Import.
+func (d *Env) Import(thread int, r io.Reader) ([]blockfile.ImportedFile, error) {
+	if thread < 0 || thread >= len(d.threads) {
+		return nil, fmt.Errorf("no thread %d", thread)
+	}
+	return d.threads[thread].Import(r)
+}
+
+// Reindex rebuilds the index of the named blockfile of the given thread
+// (indexed by its position in the config's Threads), as with thread.Reindex.
+func (d *Env) Reindex(thread int, name string) (blockfile.Reindexed, error) {
+	if thread < 0 || thread >= len(d.threads) {
+		return blockfile.Reindexed{}, fmt.Errorf("no thread %d", thread)
+	}
+	return d.threads[thread].Reindex(name)
+}
+
+// lookupThreads starts looking up q in each thread, in thread order, with
+// thread.LookupTolerant if 'tolerant' is set.
+func (d *Env) lookupThreads(ctx context.Context, q query.Query, tolerant bool) []*base.PacketChan {
 	var inputs []*base.PacketChan
 	for _, thread := range d.threads {
-		inputs = append(inputs, thread.Lookup(ctx, q))
+		if tolerant {
+			inputs = append(inputs, thread.LookupTolerant(ctx, q))
+		} else {
+			inputs = append(inputs, thread.Lookup(ctx, q))
+		}
 	}
-	return base.MergePacketChans(ctx, inputs)
+	return inputs
 }
 
 // ExportDebugHandlers exports a few debugging handlers to an HTTP ServeMux.
@@ -366,8 +778,12 @@ func (d *Env) runStenotypeOnce() error {
 }
 
 // RunStenotype keeps the stenotype binary running, restarting it if necessary
-// but trying not to allow crash loops.
+// but trying not to allow crash loops.  In a read-only Env, it does nothing.
 func (d *Env) RunStenotype() {
+	if d.conf.ReadOnly {
+		log.Printf("Read-only, so not running stenotype")
+		return
+	}
 	for {
 		start := time.Now()
 		v(1, "Running Stenotype")
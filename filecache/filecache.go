@@ -17,12 +17,15 @@
 package filecache
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/google/stenographer/base"
+	"golang.org/x/sys/unix"
 )
 
 var v = base.V
@@ -38,8 +41,16 @@ type CachedFile struct {
 	// protected by mu
 	filename string
 	f        *os.File
+	// id identifies the file first opened, so a reopen after eviction can
+	// tell if filename has since been replaced by another file.
+	id os.FileInfo
 }
 
+// ErrReplaced is returned when a cached file is reopened, but its name now
+// refers to a different file, renamed over it since it was first opened.
+// Reading on would mix data from the two.
+var ErrReplaced = errors.New("file replaced since it was first opened")
+
 func NewCache(maxOpened int) *Cache {
 	if maxOpened < 1 {
 		panic("maxOpened must be > 0")
@@ -105,16 +116,31 @@ func (cf *CachedFile) ReadAt(p []byte, off int64) (int, error) {
 	if err := cf.readLockedFile(); err != nil {
 		return 0, err
 	}
-	defer cf.mu.RUnlock()
-	return cf.f.ReadAt(p, off)
+	n, err := cf.f.ReadAt(p, off)
+	cf.mu.RUnlock()
+	cf.closeIfStale(err)
+	return n, err
 }
 
 func (cf *CachedFile) Read(p []byte) (int, error) {
 	if err := cf.readLockedFile(); err != nil {
 		return 0, err
 	}
-	defer cf.mu.RUnlock()
-	return cf.f.Read(p)
+	n, err := cf.f.Read(p)
+	cf.mu.RUnlock()
+	cf.closeIfStale(err)
+	return n, err
+}
+
+// closeIfStale closes the file if err says it was removed by another host on
+// a network filesystem, so the next read reopens it by name, finding either
+// that it's gone or that it's been replaced, instead of failing the same way
+// forever.
+func (cf *CachedFile) closeIfStale(err error) {
+	if pe, ok := err.(*os.PathError); ok && pe.Err == syscall.ESTALE {
+		v(1, "Cached file %q is stale, closing", cf.filename)
+		cf.Close()
+	}
 }
 
 func (cf *CachedFile) Stat() (os.FileInfo, error) {
@@ -125,6 +151,40 @@ func (cf *CachedFile) Stat() (os.FileInfo, error) {
 	return cf.f.Stat()
 }
 
+// SameFile returns whether s describes the file cf opened, if it's been
+// opened.
+func (cf *CachedFile) SameFile(s os.FileInfo) bool {
+	cf.mu.RLock()
+	defer cf.mu.RUnlock()
+	return cf.id != nil && os.SameFile(cf.id, s)
+}
+
+// Advice for Advise, as for posix_fadvise, whose values match madvise's.
+const (
+	AdviseNormal     = 0 // POSIX_FADV_NORMAL
+	AdviseRandom     = 1 // POSIX_FADV_RANDOM
+	AdviseSequential = 2 // POSIX_FADV_SEQUENTIAL
+	AdviseWillNeed   = 3 // POSIX_FADV_WILLNEED
+)
+
+// Advise tells the kernel how the given range of the file will be read, so it
+// can tune readahead (Random, Sequential, Normal) or start reading pages now
+// (WillNeed).  A length of 0 means to the end of the file.  Random, Sequential
+// and Normal apply to the open file as a whole, so affect all its readers.
+func (cf *CachedFile) Advise(off, length int64, advice int) error {
+	if err := cf.readLockedFile(); err != nil {
+		return err
+	}
+	defer cf.mu.RUnlock()
+	return Fadvise(cf.f, off, length, advice)
+}
+
+// Fadvise passes advice on reading the given range of f to the kernel, as
+// Advise does.
+func Fadvise(f *os.File, off, length int64, advice int) error {
+	return unix.Fadvise(int(f.Fd()), off, length, advice)
+}
+
 func (cf *CachedFile) Write(p []byte) (int, error) {
 	return 0, fmt.Errorf("cached file not writable")
 }
@@ -147,6 +207,16 @@ func (cf *CachedFile) openFile() error {
 		v(1, "Open of %q failed: %v", cf.filename, err)
 		return err
 	}
+	if s, err := newF.Stat(); err != nil {
+		newF.Close()
+		return err
+	} else if cf.id == nil {
+		cf.id = s
+	} else if !os.SameFile(cf.id, s) {
+		newF.Close()
+		v(1, "Reopen of %q found a different file", cf.filename)
+		return ErrReplaced
+	}
 	cf.f = newF
 	cf.moveToFront()
 	cf.cache.opened++
@@ -19,7 +19,9 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestCache(t *testing.T) {
@@ -49,3 +51,72 @@ func TestCache(t *testing.T) {
 		}
 	}
 }
+
+func TestReopenReplaced(t *testing.T) {
+	d := t.TempDir()
+	a, b := filepath.Join(d, "a"), filepath.Join(d, "b")
+	for _, p := range []string{a, b} {
+		if err := ioutil.WriteFile(p, []byte(p), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := NewCache(1)
+	var buf [1]byte
+	f := c.Open(a)
+	if _, err := f.ReadAt(buf[:], 0); err != nil {
+		t.Fatal(err)
+	}
+	// Reading b evicts a, and replacing a means it can't be reopened.
+	if _, err := c.Open(b).ReadAt(buf[:], 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(b, a); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.ReadAt(buf[:], 0); err == nil || !strings.Contains(err.Error(), ErrReplaced.Error()) {
+		t.Errorf("reading replaced file: want %v, got %v", ErrReplaced, err)
+	}
+}
+
+func TestFileLock(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "f")
+	if err := ioutil.WriteFile(p, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	r1, err := LockShared(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r2, err := LockShared(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LockExclusive(p, 0); err != ErrLocked {
+		t.Errorf("exclusive lock with readers: want %v, got %v", ErrLocked, err)
+	}
+	r1.Unlock()
+	r2.Unlock()
+	w, err := LockExclusive(p, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Readers wait for the writer.
+	locked := make(chan error)
+	go func() {
+		r, err := LockShared(p)
+		r.Unlock()
+		locked <- err
+	}()
+	select {
+	case err := <-locked:
+		t.Fatalf("shared lock taken during exclusive lock: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	w.Unlock()
+	if err := <-locked; err != nil {
+		t.Error(err)
+	}
+	if _, err := LockShared(filepath.Join(t.TempDir(), "missing")); !os.IsNotExist(err) {
+		t.Errorf("locking missing file: got %v", err)
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filecache
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+	"time"
+)
+
+// Open file description locks, which unlike classic POSIX record locks
+// belong to the open file rather than the process, so two descriptors in one
+// process can conflict, and closing one doesn't drop the other's lock.  The
+// syscall package doesn't name them.
+const (
+	fOFDSetLock     = 37 // F_OFD_SETLK
+	fOFDSetLockWait = 38 // F_OFD_SETLKW
+)
+
+// ErrLocked is returned by LockExclusive if the file stayed locked by others.
+var ErrLocked = errors.New("file locked by another reader")
+
+// FileLock is an advisory lock on a whole file, held until Unlock.  Locks
+// coordinate processes sharing a directory, even on different hosts: NFS and
+// CephFS pass them on to the server, which arbitrates between clients.
+// Readers share a lock while reading a file, and anything replacing or
+// rewriting a file in place takes it exclusively first, so readers never see
+// a file change underneath them.  Being advisory, they don't stop anything
+// which doesn't ask for them, like stenotype.
+type FileLock struct {
+	f *os.File
+}
+
+// LockShared takes a shared lock on the named file, waiting while it's locked
+// exclusively.
+func LockShared(filename string) (*FileLock, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	if err := fcntlLock(f, fOFDSetLockWait, syscall.F_RDLCK); err != nil {
+		f.Close()
+		return nil, &os.PathError{Op: "lock", Path: filename, Err: err}
+	}
+	return &FileLock{f: f}, nil
+}
+
+// lockPoll is how often LockExclusive retries a lock held by others.
+const lockPoll = 100 * time.Millisecond
+
+// LockExclusive takes an exclusive lock on the named file, waiting up to
+// 'wait' for others to release theirs before giving up with ErrLocked.  It
+// polls rather than queuing for the lock, so readers arriving meanwhile aren't
+// held up behind it.
+func LockExclusive(filename string, wait time.Duration) (*FileLock, error) {
+	f, err := os.OpenFile(filename, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(wait)
+	for {
+		err := fcntlLock(f, fOFDSetLock, syscall.F_WRLCK)
+		if err == nil {
+			return &FileLock{f: f}, nil
+		} else if err != syscall.EAGAIN && err != syscall.EACCES {
+			f.Close()
+			return nil, &os.PathError{Op: "lock", Path: filename, Err: err}
+		} else if time.Now().After(deadline) {
+			f.Close()
+			return nil, ErrLocked
+		}
+		time.Sleep(lockPoll)
+	}
+}
+
+func fcntlLock(f *os.File, cmd int, typ int16) error {
+	lk := syscall.Flock_t{Type: typ, Whence: int16(io.SeekStart)} // Zero length covers the whole file.
+	for {
+		if err := syscall.FcntlFlock(f.Fd(), cmd, &lk); err != syscall.EINTR {
+			return err
+		}
+	}
+}
+
+// Unlock releases the lock.  It's safe to call on a nil *FileLock.
+func (l *FileLock) Unlock() error {
+	if l == nil {
+		return nil
+	}
+	return l.f.Close()
+}
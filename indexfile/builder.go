@@ -0,0 +1,832 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package indexfile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/golang/leveldb/db"
+	"github.com/google/stenographer/base"
+	"github.com/google/stenographer/indextable"
+	"golang.org/x/net/context"
+)
+
+// Index key types, the first byte of each key.  These match stenotype's.
+// keyMAC, keyTCPFlags, keyLength, keyDNSAnswer, keyHTTPMethod, keyHTTPPath
+// and keyCommunityID are optional, only indexed as BuilderOptions or
+// stenotype's flags say.
+const (
+	keyVersion  = 0
+	keyProtocol = 1
+	keyPort     = 2
+	keyVLAN     = 3
+	keyIPv4     = 4
+	keyMPLS     = 5
+	keyIPv6     = 6
+	// keyTimeRange holds the first and last packet times of a file spanning
+	// more than stenotype's usual minute, as nanoseconds since the epoch.
+	// Stenotype never writes it.
+	keyTimeRange = 7
+	// keyMAC holds ethernet addresses.
+	keyMAC = 8
+	// keyInnerIPv4, keyInnerIPv6 and keyInnerPort hold the addresses and
+	// ports of packets tunneled within others, like keyIPv4, keyIPv6 and
+	// keyPort hold the outermost ones.
+	keyInnerIPv4 = 9
+	keyInnerIPv6 = 10
+	keyInnerPort = 11
+	// keyTCPFlags holds the flags byte of TCP headers.
+	keyTCPFlags = 12
+	// keyLength holds the bounds of a packet length bucket.  Keys give
+	// both bounds, as big endian uint16s, so readers needn't know the
+	// buckets a file was indexed with.
+	keyLength = 13
+	// keyProtoPort holds an IP protocol and a port of its packets, so
+	// queries for both needn't intersect the protocol's huge set of
+	// positions with the port's.  Indexes of minor version 1 on have them.
+	keyProtoPort = 14
+	// keyDNSName holds the question names of DNS messages to and from port
+	// 53, in the form dnsName gives.  Indexes of minor version 2 on have
+	// them.
+	keyDNSName = 15
+	// keyDNSAnswer holds a question name of a DNS response, then a zero
+	// byte, then an IPv4 or IPv6 address it answered with.
+	keyDNSAnswer = 16
+	// keyTLSServerName holds the host names TLS ClientHellos ask for, in the
+	// form dnsName gives, and keyJA3 and keyJA3S the MD5 hashes of
+	// ClientHellos' JA3 and ServerHellos' JA3S fingerprints.  Indexes of
+	// minor version 3 on have them.
+	keyTLSServerName = 17
+	keyJA3           = 18
+	keyJA3S          = 19
+	// keyHTTPHost holds the hosts plaintext HTTP requests are for, in the
+	// form dnsName gives, from minor version 4 on.  keyHTTPMethod and
+	// keyHTTPPath hold their methods and paths.
+	keyHTTPHost   = 20
+	keyHTTPMethod = 21
+	keyHTTPPath   = 22
+	// keyCommunityID holds the SHA-1 hashes of packets' Community IDs, the
+	// flow hashes Zeek and Suricata log.
+	keyCommunityID = 23
+	// keyIPFilter holds the index's IP filter (see filter.go), and sorts
+	// after all the keys holding positions.
+	keyIPFilter = 24
+	// keyKeyTypes lists the key types the index was written to hold (see
+	// keytypes.go), one byte apiece, from minor version 5 on.
+	keyKeyTypes = 25
+	// keyCustom holds the keys of custom Indexers (see custom.go), and
+	// keyCustomTypes lists the custom key types the index holds, if any.
+	keyCustom      = 26
+	keyCustomTypes = 27
+	// keyStats records how many keys of each type the index holds, and
+	// their positions (see stats.go), so queries can plan by them without
+	// reading the whole index.
+	keyStats = 28
+	// keyWriter names the software which wrote the index, and its version,
+	// like "stenotype 1.2.3".
+	keyWriter = 29
+)
+
+// BuilderOptions are the optional keys a Builder indexes packets by, on top
+// of those it always does.  They're set from the config fields of the same
+// names, which also give stenotype the matching flags, like --index_macs.
+type BuilderOptions struct {
+	IndexMACs         bool // Ethernet addresses
+	IndexTCPFlags     bool // TCP headers' flags
+	IndexDNSAnswers   bool // The addresses DNS responses give for names
+	IndexHTTPRequests bool // HTTP requests' methods and paths
+	IndexCommunityIDs bool // The Community IDs of packets' flows
+	// LengthBuckets holds the smallest length of each bucket after the
+	// first, which starts at zero, in increasing order; the last bucket
+	// holds all longer packets.  If set, the bucket each packet's length
+	// falls in is indexed.
+	LengthBuckets []int
+	// CustomIndexers names the registered Indexers packets are given to.
+	CustomIndexers []string
+}
+
+// Validate checks that the options' length buckets increase within the
+// lengths a bucket can record, and that their custom Indexers are registered.
+func (o BuilderOptions) Validate() error {
+	for i, b := range o.LengthBuckets {
+		if b < 1 || b > MaxLength || (i > 0 && b <= o.LengthBuckets[i-1]) {
+			return fmt.Errorf("LengthBuckets must increase from 1 to %d, got %v", MaxLength, o.LengthBuckets)
+		}
+	}
+	for _, name := range o.CustomIndexers {
+		if registeredIndexers[name] == nil {
+			return fmt.Errorf("no custom indexer %q", name)
+		}
+	}
+	return nil
+}
+
+// MaxLength is the longest packet length a bucket can record.  Longer packets
+// fall in the last bucket.
+const MaxLength = 0xffff
+
+// minorVersionNumber is the minor file format version Builder writes.
+// Version 1 added keyProtoPort, 2 keyDNSName, 3 the TLS keys, 4
+// keyHTTPHost, and 5 keyKeyTypes.
+const minorVersionNumber = 5
+
+// Builder builds an index file holding the same keys stenotype writes, though
+// in stenographer's own table format (see indextable), for blockfiles whose
+// index is missing or can't be trusted.  Packets are added with AddPacket,
+// which indexes exactly the fields stenotype does, or whole indexes with
+// AddIndex.
+type Builder struct {
+	keys        map[string]base.Positions
+	first, last time.Time  // Recorded by SetTimeRange
+	minor       uint32     // The minor version written, lowered by AddIndex
+	keyTypes    keyTypeSet // The key types written, narrowed by AddIndex
+	opts        BuilderOptions
+	// indexers are the custom Indexers packets are indexed with, and
+	// customTypes the custom key types written, narrowed by AddIndex.
+	indexers    []*customIndexer
+	customTypes map[string]bool
+	// want, if set, limits the keys added to those of its types, for scan
+	// Builders (see NewScanBuilder).
+	want      *keyTypeSet
+	positions int64 // Added by add
+}
+
+// NewBuilder returns an empty Builder, indexing the optional keys opts asks
+// for, whose custom Indexers must be registered (see Validate).
+func NewBuilder(opts BuilderOptions) *Builder {
+	var indexers []*customIndexer
+	for _, name := range opts.CustomIndexers {
+		if idx := registeredIndexers[name]; idx != nil {
+			indexers = append(indexers, idx)
+		}
+	}
+	sort.Slice(indexers, func(i, j int) bool { return indexers[i].name < indexers[j].name })
+	return newBuilder(opts, indexers)
+}
+
+func newBuilder(opts BuilderOptions, indexers []*customIndexer) *Builder {
+	b := &Builder{
+		keys:     map[string]base.Positions{},
+		minor:    minorVersionNumber,
+		opts:     opts,
+		indexers: indexers,
+	}
+	b.keyTypes = b.builderKeyTypes()
+	b.customTypes = b.builderCustomTypes()
+	return b
+}
+
+// add records that the packet at 'pos' has the given key.  Packets must be
+// added in position order.
+func (b *Builder) add(key []byte, pos int64) {
+	if b.want != nil && !b.want.has(key[0]) {
+		return
+	}
+	k := string(key)
+	if p := b.keys[k]; len(p) == 0 || p[len(p)-1] != pos {
+		b.keys[k] = append(p, pos)
+		b.positions++
+	}
+}
+
+// Positions returns how many positions have been added to the Builder's keys
+// by AddPacket, so its callers can account for the memory they hold.
+func (b *Builder) Positions() int64 {
+	return b.positions
+}
+
+func (b *Builder) add16(typ byte, x uint16, pos int64) {
+	var buf [3]byte
+	buf[0] = typ
+	binary.BigEndian.PutUint16(buf[1:], x)
+	b.add(buf[:], pos)
+}
+
+func (b *Builder) addProtoPort(protocol byte, port uint16, pos int64) {
+	var buf [4]byte
+	buf[0], buf[1] = keyProtoPort, protocol
+	binary.BigEndian.PutUint16(buf[2:], port)
+	b.add(buf[:], pos)
+}
+
+func (b *Builder) add32(typ byte, x uint32, pos int64) {
+	var buf [5]byte
+	buf[0] = typ
+	binary.BigEndian.PutUint32(buf[1:], x)
+	b.add(buf[:], pos)
+}
+
+// SetTimeRange records the times of the earliest and latest packets in the
+// index's blockfile.  Time queries normally pick blockfiles by the time in
+// their names, assuming each spans at most a minute; those which span more,
+// like merged blockfiles, record their range so they're still found.
+func (b *Builder) SetTimeRange(first, last time.Time) {
+	b.first, b.last = first, last
+}
+
+// AddIndex adds the keys of another index, moving each of its positions to
+// where 'move' says the packet there now is, or dropping it if 'move' returns
+// false.  It's for merging the indexes of blockfiles whose packets have been
+// copied into one, without decoding every packet again.  Indexes and packets
+// must be added in the order of the positions they're moved to.  The index
+// written has the lowest minor version of any added, and only the key types
+// all of them hold, so queries don't expect keys some of its packets weren't
+// indexed under.  Any time range the index records isn't copied; see
+// SetTimeRange.
+func (b *Builder) AddIndex(ctx context.Context, i *IndexFile, move func(pos int64) (int64, bool)) error {
+	if i.minor < b.minor {
+		b.minor = i.minor
+	}
+	b.keyTypes = b.keyTypes.intersect(i.heldKeyTypes())
+	held := i.heldCustomTypes()
+	for typ := range b.customTypes {
+		if !held[typ] {
+			delete(b.customTypes, typ)
+		}
+	}
+	iter := i.ss.Find([]byte{})
+	for iter.Next() && !base.ContextDone(ctx) {
+		key := iter.Key()
+		if !holdsPositions(key) {
+			continue
+		}
+		positions, err := base.ReadIndexPositions(bytes.NewReader(iter.Value()))
+		if err != nil {
+			iter.Close()
+			return fmt.Errorf("invalid positions for key %x in %q: %v", key, i.name, err)
+		}
+		k := string(key)
+		p := b.keys[k]
+		for _, pos := range positions {
+			if moved, ok := move(pos); ok && (len(p) == 0 || p[len(p)-1] != moved) {
+				p = append(p, moved)
+			}
+		}
+		if len(p) > 0 {
+			b.keys[k] = p
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+	return ctx.Err()
+}
+
+// addLength indexes the bucket holding a packet of the given length, if the
+// Builder indexes lengths.
+func (b *Builder) addLength(length int, pos int64) {
+	if len(b.opts.LengthBuckets) == 0 {
+		return
+	}
+	i := sort.SearchInts(b.opts.LengthBuckets, length+1) // The first bucket starting past it.
+	lo, hi := 0, MaxLength
+	if i > 0 {
+		lo = b.opts.LengthBuckets[i-1]
+	}
+	if i < len(b.opts.LengthBuckets) {
+		hi = b.opts.LengthBuckets[i] - 1
+	}
+	var buf [5]byte
+	buf[0] = keyLength
+	binary.BigEndian.PutUint16(buf[1:], uint16(lo))
+	binary.BigEndian.PutUint16(buf[3:], uint16(hi))
+	b.add(buf[:], pos)
+}
+
+// addMACs indexes the addresses of the ethernet header at the start of data,
+// if the Builder indexes MACs.
+func (b *Builder) addMACs(data []byte, pos int64) {
+	if b.opts.IndexMACs {
+		b.add(append([]byte{keyMAC}, data[6:12]...), pos) // Source
+		b.add(append([]byte{keyMAC}, data[:6]...), pos)   // Destination
+	}
+}
+
+// Ethernet types and IP protocols AddPacket decodes.
+const (
+	ethIPv4    = 0x0800
+	ethIPv6    = 0x86dd
+	ethMPLSUC  = 0x8847
+	ethMPLSMC  = 0x8848
+	eth8021Q   = 0x8100
+	eth8021AD  = 0x88a8
+	ethQinQ1   = 0x9100
+	ethQinQ2   = 0x9200
+	ethQinQ3   = 0x9300
+	ethTEB     = 0x6558 // Transparent ethernet bridging, over GRE or Geneve
+	ipHopOpts  = 0
+	ipIPIP     = 4 // IPv4 within IP
+	ipTCP      = 6
+	ipUDP      = 17
+	ipIPv6     = 41 // IPv6 within IP
+	ipRouting  = 43
+	ipFragment = 44
+	ipGRE      = 47
+	ipDstOpts  = 60
+	ipMH       = 135
+	portVXLAN  = 4789
+	portGeneve = 6081
+)
+
+// GRE header flags.
+const (
+	greChecksum = 0x8000
+	greRouting  = 0x4000
+	greKey      = 0x2000
+	greSequence = 0x1000
+	greVersion  = 0x0007
+)
+
+// AddPacket indexes the ethernet packet 'data' found at blockfile position
+// 'pos', stripping VLAN and MPLS headers and IPv6 extension headers to get at
+// its addresses, protocol, and ports.  Packets tunneled by GRE, VXLAN, Geneve
+// or IP-in-IP also have their inner addresses and ports indexed, DNS messages
+// their question names, TLS hellos their server names and fingerprints, and
+// HTTP requests their hosts, and any custom Indexers are given the packet.
+// Packets must be added in position order.  The packet is taken to be as long
+// as data; see AddPacketLength for packets truncated when captured.
+func (b *Builder) AddPacket(data []byte, pos int64) {
+	b.AddPacketLength(data, len(data), pos)
+}
+
+// AddPacketLength is like AddPacket, for a packet 'length' bytes long on the
+// wire, of which 'data' was captured.
+func (b *Builder) AddPacketLength(data []byte, length int, pos int64) {
+	b.addLength(length, pos)
+	// Custom Indexers get the packet once it's decoded as far as it goes.
+	var custom *CustomPacket
+	if len(b.indexers) > 0 {
+		custom = &CustomPacket{Data: data}
+		defer b.addCustom(custom, pos)
+	}
+	if len(data) < 14 {
+		return
+	}
+	b.addMACs(data, pos)
+	typ := binary.BigEndian.Uint16(data[12:])
+	data = data[14:]
+encapsulation:
+	for {
+		switch typ {
+		case eth8021Q, eth8021AD, ethQinQ1, ethQinQ2, ethQinQ3:
+			if len(data) < 4 {
+				return
+			}
+			b.add16(keyVLAN, binary.BigEndian.Uint16(data)&0x0fff, pos)
+			typ = binary.BigEndian.Uint16(data[2:])
+			data = data[4:]
+		case ethMPLSUC, ethMPLSMC:
+			for {
+				// The first nibble after the last label gives the next layer.
+				if len(data) < 5 {
+					return
+				}
+				label := binary.BigEndian.Uint32(data)
+				b.add32(keyMPLS, label>>12, pos)
+				data = data[4:]
+				if label&(1<<8) != 0 {
+					break
+				}
+			}
+			switch data[0] >> 4 {
+			case 0: // RFC 4385 pseudowire control word, then ethernet.
+				if len(data) < 4+14 {
+					return
+				}
+				b.addMACs(data[4:], pos)
+				typ = binary.BigEndian.Uint16(data[4+12:])
+				data = data[4+14:]
+			case 4:
+				typ = ethIPv4
+			case 6:
+				typ = ethIPv6
+			default:
+				return
+			}
+		default:
+			break encapsulation
+		}
+	}
+	ip := data
+	protocol, data, first, ok := b.addIP(outer, typ, data, pos)
+	if !ok {
+		return
+	}
+	b.addCommunityID(typ, ip, protocol, data, first, pos)
+	b.add([]byte{keyProtocol, protocol}, pos)
+	if custom != nil {
+		custom.Protocol = protocol
+	}
+	switch protocol {
+	case ipTCP, ipUDP:
+		dst, ok := b.addPorts(outer, protocol, data, pos)
+		if ok && first && custom != nil {
+			custom.setPorts(protocol, data)
+		}
+		if ok {
+			b.addProtoPort(protocol, binary.BigEndian.Uint16(data), pos)
+			b.addProtoPort(protocol, dst, pos)
+		}
+		if ok && b.opts.IndexTCPFlags && protocol == ipTCP {
+			b.add([]byte{keyTCPFlags, data[13]}, pos)
+		}
+		if ok && first && (dst == portDNS || binary.BigEndian.Uint16(data) == portDNS) && b.wants(keyDNSName, keyDNSAnswer) {
+			b.addDNS(protocol, data, pos)
+		}
+		if ok && first && protocol == ipTCP {
+			if b.wants(keyTLSServerName, keyJA3, keyJA3S) {
+				b.addTLS(data, pos)
+			}
+			if b.wants(keyHTTPHost, keyHTTPMethod, keyHTTPPath) {
+				b.addHTTP(data, pos)
+			}
+		}
+		if !ok || !first || protocol != ipUDP {
+			return
+		}
+		switch dst {
+		case portVXLAN:
+			// An 8-byte header, its I flag marking a valid VNI, then
+			// ethernet.
+			if len(data) < 8+8 || data[8]&0x08 == 0 {
+				return
+			}
+			b.addInner(ethTEB, data[8+8:], pos)
+		case portGeneve:
+			if len(data) < 8+8 || data[8]>>6 != 0 {
+				return
+			}
+			skip := 8 + 8 + int(data[8]&0x3f)*4 // Options are 4-byte words.
+			if skip > len(data) {
+				return
+			}
+			b.addInner(binary.BigEndian.Uint16(data[8+2:]), data[skip:], pos)
+		}
+	case ipIPIP:
+		if first {
+			b.addInner(ethIPv4, data, pos)
+		}
+	case ipIPv6:
+		if first {
+			b.addInner(ethIPv6, data, pos)
+		}
+	case ipGRE:
+		if first {
+			b.addGRE(data, pos)
+		}
+	}
+}
+
+// header holds the key types the fields of an IP header and the transport
+// header after it are indexed under.
+type header struct {
+	ipv4, ipv6, port byte
+}
+
+var (
+	// outer is the outermost IP header, which is all stenotype indexed
+	// before learning of tunnels.
+	outer = header{keyIPv4, keyIPv6, keyPort}
+	// inner is the IP header a tunnel carries.
+	inner = header{keyInnerIPv4, keyInnerIPv6, keyInnerPort}
+)
+
+// addIP indexes the addresses of the IP header of type 'typ' at the start of
+// data under h's keys, stripping IPv6 extension headers to get at its
+// protocol and payload.  'first' is false for fragments other than the first,
+// whose payloads don't start with a transport header.  'ok' is false if data
+// isn't a whole IP header.
+func (b *Builder) addIP(h header, typ uint16, data []byte, pos int64) (protocol byte, payload []byte, first, ok bool) {
+	switch typ {
+	case ethIPv4:
+		if len(data) < 20 {
+			return 0, nil, false, false
+		}
+		b.add(append([]byte{h.ipv4}, data[12:16]...), pos)
+		b.add(append([]byte{h.ipv4}, data[16:20]...), pos)
+		ihl := int(data[0]&0x0f) * 4
+		if ihl < 20 {
+			return 0, nil, false, false
+		}
+		protocol = data[9]
+		// Stenotype indexes later fragments' "ports" too, so only tunnels
+		// care about the offset.
+		first = binary.BigEndian.Uint16(data[6:])&0x1fff == 0
+		if ihl > len(data) {
+			ihl = len(data)
+		}
+		return protocol, data[ihl:], first, true
+	case ethIPv6:
+		if len(data) < 40 {
+			return 0, nil, false, false
+		}
+		protocol = data[6]
+		b.add(append([]byte{h.ipv6}, data[8:24]...), pos)
+		b.add(append([]byte{h.ipv6}, data[24:40]...), pos)
+		data = data[40:]
+		for {
+			switch protocol {
+			case ipFragment:
+				if len(data) < 8 {
+					return 0, nil, false, false
+				}
+				if binary.BigEndian.Uint16(data[2:])&0xfff8 != 0 {
+					// Not the first fragment, so there's no transport header.
+					return protocol, data, false, true
+				}
+				fallthrough
+			case ipHopOpts, ipRouting, ipDstOpts, ipMH:
+				if len(data) < 2 {
+					return 0, nil, false, false
+				}
+				protocol = data[0]
+				skip := (int(data[1]) + 1) * 8
+				if skip > len(data) {
+					skip = len(data)
+				}
+				data = data[skip:]
+			default:
+				return protocol, data, true, true
+			}
+		}
+	}
+	return 0, nil, false, false
+}
+
+// addPorts indexes the ports of the TCP or UDP header at the start of data
+// under h's port key, returning the destination port.  'ok' is false if data
+// is too short to hold the header.
+func (b *Builder) addPorts(h header, protocol byte, data []byte, pos int64) (dst uint16, ok bool) {
+	switch protocol {
+	case ipTCP:
+		if len(data) < 20 {
+			return 0, false
+		}
+	case ipUDP:
+		if len(data) < 8 {
+			return 0, false
+		}
+	default:
+		return 0, false
+	}
+	dst = binary.BigEndian.Uint16(data[2:])
+	b.add16(h.port, binary.BigEndian.Uint16(data), pos)
+	b.add16(h.port, dst, pos)
+	return dst, true
+}
+
+// addGRE indexes the packet carried by the GRE header at the start of data.
+func (b *Builder) addGRE(data []byte, pos int64) {
+	if len(data) < 4 {
+		return
+	}
+	flags := binary.BigEndian.Uint16(data)
+	if flags&(greRouting|greVersion) != 0 {
+		// Source routed, or PPTP's enhanced GRE, neither of which carry
+		// anything we decode.
+		return
+	}
+	skip := 4
+	for _, flag := range []uint16{greChecksum, greKey, greSequence} {
+		if flags&flag != 0 {
+			skip += 4
+		}
+	}
+	if skip > len(data) {
+		return
+	}
+	b.addInner(binary.BigEndian.Uint16(data[2:]), data[skip:], pos)
+}
+
+// addInner indexes the addresses and ports of a packet of type 'typ' carried
+// by a tunnel, found at the start of data, under inner keys.  Ethernet frames
+// have their VLAN tags stripped, but neither those nor their MACs are indexed.
+// Tunnels within tunnels aren't decoded.
+func (b *Builder) addInner(typ uint16, data []byte, pos int64) {
+	if typ == ethTEB {
+		if len(data) < 14 {
+			return
+		}
+		typ = binary.BigEndian.Uint16(data[12:])
+		data = data[14:]
+	}
+	for typ == eth8021Q || typ == eth8021AD || typ == ethQinQ1 || typ == ethQinQ2 || typ == ethQinQ3 {
+		if len(data) < 4 {
+			return
+		}
+		typ = binary.BigEndian.Uint16(data[2:])
+		data = data[4:]
+	}
+	protocol, data, first, ok := b.addIP(inner, typ, data, pos)
+	if ok && first {
+		b.addPorts(inner, protocol, data, pos)
+	}
+}
+
+// WriteFile writes the index to a new file with the given name.
+func (b *Builder) WriteFile(filename string) error {
+	f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if err := b.write(syncOnClose{f}); err != nil {
+		os.Remove(filename)
+		return fmt.Errorf("could not write index %q: %v", filename, err)
+	}
+	return nil
+}
+
+// ConvertFile writes the index in the file src, if it's a leveldb table as
+// stenotype writes them, to a new file dst in stenographer's own table format,
+// which reads faster.  It returns false, writing nothing, if src is in that
+// format already.
+func ConvertFile(src, dst string) (bool, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return false, err
+	}
+	r, err := indextable.NewReader(in)
+	if err != nil {
+		in.Close()
+		return false, fmt.Errorf("invalid index file %q: %v", src, err)
+	}
+	defer r.Close()
+	if !indextable.IsLegacy(r) {
+		return false, nil
+	}
+	f, err := os.OpenFile(dst, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return false, err
+	}
+	w := indextable.NewWriter(syncOnClose{f})
+	iter := r.Find(nil)
+	for iter.Next() && err == nil {
+		err = w.Set(iter.Key(), iter.Value())
+	}
+	if ierr := iter.Close(); err == nil {
+		err = ierr
+	}
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dst)
+		return false, fmt.Errorf("could not convert index %q: %v", src, err)
+	}
+	return true, nil
+}
+
+// Open returns the index, held in memory rather than written to disk, as an
+// IndexFile with the given name.
+func (b *Builder) Open(name string) (*IndexFile, error) {
+	f := &memFile{}
+	if err := b.write(f); err != nil {
+		return nil, fmt.Errorf("could not write index %q: %v", name, err)
+	}
+	return newIndexFile(name, f)
+}
+
+// memFile holds a table in memory, written then read.
+type memFile struct {
+	bytes.Buffer
+}
+
+func (m *memFile) ReadAt(p []byte, off int64) (int, error) {
+	return bytes.NewReader(m.Bytes()).ReadAt(p, off)
+}
+
+func (m *memFile) Stat() (os.FileInfo, error) {
+	return plaintextInfo{nil, int64(m.Len())}, nil
+}
+
+func (m *memFile) Sync() error  { return nil }
+func (m *memFile) Close() error { return nil }
+
+// syncOnClose syncs a file before closing it, as the sync policy says, since
+// the table writer closes the file it's given once it's done.
+type syncOnClose struct {
+	*os.File
+}
+
+func (s syncOnClose) Close() error {
+	if err := base.SyncFile(s.File); err != nil {
+		s.File.Close()
+		return err
+	}
+	return s.File.Close()
+}
+
+// write writes the index table to f, then closes it.
+func (b *Builder) write(f db.File) error {
+	keys := make([][]byte, 0, len(b.keys))
+	for k := range b.keys {
+		keys = append(keys, []byte(k))
+	}
+	sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i], keys[j]) < 0 })
+	w := indextable.NewWriter(f)
+	var version [8]byte
+	binary.BigEndian.PutUint32(version[:], majorVersionNumber)
+	binary.BigEndian.PutUint32(version[4:], b.minor)
+	if err := w.Set([]byte{keyVersion}, version[:]); err != nil {
+		w.Close()
+		return err
+	}
+	// The time range is written in its place among the other keys, which
+	// the table needs in order, as are the IP filter and key types records,
+	// which sort before any custom keys.
+	timeRange := !b.first.IsZero()
+	var ips [][]byte
+	for _, k := range keys {
+		if filtered(k[0]) {
+			ips = append(ips, k)
+		}
+	}
+	records := true
+	var value bytes.Buffer
+	for _, k := range keys {
+		if timeRange && k[0] > keyTimeRange {
+			if err := b.writeTimeRange(w); err != nil {
+				w.Close()
+				return err
+			}
+			timeRange = false
+		}
+		if records && k[0] > keyKeyTypes {
+			if err := b.writeRecords(w, ips); err != nil {
+				w.Close()
+				return err
+			}
+			records = false
+		}
+		value.Reset()
+		if err := base.WriteIndexPositions(&value, b.keys[string(k)]); err != nil {
+			w.Close()
+			return fmt.Errorf("key %x: %v", k, err)
+		}
+		if err := w.Set(k, value.Bytes()); err != nil {
+			w.Close()
+			return err
+		}
+	}
+	if timeRange {
+		if err := b.writeTimeRange(w); err != nil {
+			w.Close()
+			return err
+		}
+	}
+	if records {
+		if err := b.writeRecords(w, ips); err != nil {
+			w.Close()
+			return err
+		}
+	}
+	if len(b.customTypes) > 0 {
+		if err := w.Set([]byte{keyCustomTypes}, customTypesRecord(b.customTypes)); err != nil {
+			w.Close()
+			return err
+		}
+	}
+	if err := w.Set([]byte{keyStats}, b.statsRecord()); err != nil {
+		w.Close()
+		return err
+	}
+	if err := w.Set([]byte{keyWriter}, []byte("stenographer "+base.Version)); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// writeRecords writes the IP filter of the given IP keys, and the key types
+// record.
+func (b *Builder) writeRecords(w *indextable.Writer, ips [][]byte) error {
+	if err := w.Set([]byte{keyIPFilter}, newIPFilter(ips)); err != nil {
+		return err
+	}
+	return w.Set([]byte{keyKeyTypes}, b.keyTypes.record())
+}
+
+// writeTimeRange writes the time range record set by SetTimeRange.
+func (b *Builder) writeTimeRange(w *indextable.Writer) error {
+	var times [16]byte
+	binary.BigEndian.PutUint64(times[:], uint64(b.first.UnixNano()))
+	binary.BigEndian.PutUint64(times[8:], uint64(b.last.UnixNano()))
+	return w.Set([]byte{keyTimeRange}, times[:])
+}
@@ -0,0 +1,961 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package indexfile
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/stenographer/base"
+	"github.com/google/stenographer/filecache"
+)
+
+func mustHex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestBuilder(t *testing.T) {
+	b := NewBuilder(BuilderOptions{})
+	// VLAN 5, then IPv4 10.0.0.1 -> 10.0.0.2, TCP 1234 -> 80.
+	b.AddPacket(mustHex(t, "000000000002000000000001"+"8100"+"0005"+"0800"+
+		"4500002800000000400600000a0000010a000002"+
+		"04d20050"+"0000000000000000"+"5002"+"000000000000"), 100)
+	// IPv6 ::1 -> ::2 behind a hop-by-hop options header, UDP 53 -> 53.
+	b.AddPacket(mustHex(t, "000000000002000000000001"+"86dd"+
+		"6000000000100000"+"00000000000000000000000000000001"+"00000000000000000000000000000002"+
+		"1100000000000000"+"0035003500080000"), 200)
+	// Truncated IPv4: addresses are indexed, but nothing after them.
+	b.AddPacket(mustHex(t, "000000000002000000000001"+"0800"+
+		"4f000028000000004006"+"00000a0000010a000003"), 300)
+	path := filepath.Join(t.TempDir(), "index")
+	if err := b.WriteFile(path); err != nil {
+		t.Fatal(err)
+	}
+	idx := testIndexFile(t, path)
+	defer idx.Close()
+	for _, test := range []struct {
+		name string
+		get  func() (base.Positions, error)
+		want base.Positions
+	}{
+		{"vlan 5", func() (base.Positions, error) { return idx.VLANPositions(ctx, 5) }, base.Positions{100}},
+		{"host 10.0.0.1", func() (base.Positions, error) {
+			return idx.IPPositions(ctx, parseIP("10.0.0.1"), parseIP("10.0.0.1"))
+		}, base.Positions{100, 300}},
+		{"net 10.0.0.2/31", func() (base.Positions, error) {
+			return idx.IPPositions(ctx, parseIP("10.0.0.2"), parseIP("10.0.0.3"))
+		}, base.Positions{100, 300}},
+		{"host ::2", func() (base.Positions, error) {
+			return idx.IPPositions(ctx, net.ParseIP("::2"), net.ParseIP("::2"))
+		}, base.Positions{200}},
+		{"tcp", func() (base.Positions, error) { return idx.ProtoPositions(ctx, 6) }, base.Positions{100, 300}},
+		{"ip proto 15", func() (base.Positions, error) { return idx.ProtoPositions(ctx, 15) }, nil},
+		{"udp", func() (base.Positions, error) { return idx.ProtoPositions(ctx, 17) }, base.Positions{200}},
+		{"port 80", func() (base.Positions, error) { return idx.PortPositions(ctx, 80) }, base.Positions{100}},
+		{"port 53", func() (base.Positions, error) { return idx.PortPositions(ctx, 53) }, base.Positions{200}},
+		{"tcp and port 80", func() (base.Positions, error) { return idx.ProtoPortRangePositions(ctx, 6, 80, 80) }, base.Positions{100}},
+		{"udp and port 80", func() (base.Positions, error) { return idx.ProtoPortRangePositions(ctx, 17, 80, 80) }, nil},
+		{"udp and portrange 1-100", func() (base.Positions, error) {
+			return idx.ProtoPortRangePositions(ctx, 17, 1, 100)
+		}, base.Positions{200}},
+	} {
+		if got, err := test.get(); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: want %v, got %v", test.name, test.want, got)
+		}
+	}
+	if err := b.WriteFile(path); err == nil {
+		t.Error("overwrote an existing index")
+	}
+}
+
+func TestBuilderMACs(t *testing.T) {
+	// 00:00:00:00:00:01 -> 00:00:00:00:00:02, then an MPLS pseudowire
+	// carrying 00:00:00:00:00:03 -> 00:00:00:00:00:04.
+	pkts := []string{
+		"000000000002000000000001" + "0800" + "4500001400000000400600000a0000010a000002",
+		"000000000002000000000001" + "8847" + "00001100" + "00000000" +
+			"000000000004000000000003" + "0800" + "4500001400000000400600000a0000010a000002",
+	}
+	b := NewBuilder(BuilderOptions{IndexMACs: true})
+	for i, pkt := range pkts {
+		b.AddPacket(mustHex(t, pkt), int64(i+1)*100)
+	}
+	path := filepath.Join(t.TempDir(), "index")
+	if err := b.WriteFile(path); err != nil {
+		t.Fatal(err)
+	}
+	idx := testIndexFile(t, path)
+	defer idx.Close()
+	for _, test := range []struct {
+		mac  string
+		want base.Positions
+	}{
+		{"00:00:00:00:00:01", base.Positions{100, 200}},
+		{"00:00:00:00:00:02", base.Positions{100, 200}},
+		{"00:00:00:00:00:04", base.Positions{200}},
+		{"00:00:00:00:00:05", nil},
+	} {
+		mac, err := net.ParseMAC(test.mac)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := idx.MACPositions(ctx, mac); err != nil {
+			t.Errorf("%v: %v", test.mac, err)
+		} else if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ether host %v: want %v, got %v", test.mac, test.want, got)
+		}
+	}
+}
+
+func TestBuilderTCPFlags(t *testing.T) {
+	const ip = "000000000002000000000001" + "0800" + "4500002800000000400600000a0000010a000002"
+	tcp := func(flags string) string {
+		return ip + "04d20050" + "0000000000000000" + "50" + flags + "000000000000"
+	}
+	pkts := []string{
+		tcp("02"), // SYN
+		tcp("12"), // SYN, ACK
+		tcp("04"), // RST
+		tcp("10"), // ACK
+		"000000000002000000000001" + "0800" + "4500002800000000401100000a0000010a000002" + "0035003500080000",
+	}
+	b := NewBuilder(BuilderOptions{IndexTCPFlags: true})
+	for i, pkt := range pkts {
+		b.AddPacket(mustHex(t, pkt), int64(i+1)*100)
+	}
+	path := filepath.Join(t.TempDir(), "index")
+	if err := b.WriteFile(path); err != nil {
+		t.Fatal(err)
+	}
+	idx := testIndexFile(t, path)
+	defer idx.Close()
+	for _, test := range []struct {
+		set, clear byte
+		want       base.Positions
+	}{
+		{0x02, 0x10, base.Positions{100}},
+		{0x02, 0, base.Positions{100, 200}},
+		{0x04, 0, base.Positions{300}},
+		{0, 0x02, base.Positions{300, 400}},
+		{0, 0, base.Positions{100, 200, 300, 400}},
+		{0x01, 0, nil},
+	} {
+		if got, err := idx.TCPFlagsPositions(ctx, test.set, test.clear); err != nil {
+			t.Errorf("%#x/%#x: %v", test.set, test.clear, err)
+		} else if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("flags set %#x, clear %#x: want %v, got %v", test.set, test.clear, test.want, got)
+		}
+	}
+	if _, err := idx.TCPFlagsPositions(ctx, 0x02, 0x02); err == nil {
+		t.Error("flag both set and clear didn't fail")
+	}
+}
+
+func TestBuilderDNS(t *testing.T) {
+	const eth = "000000000002000000000001" + "0800"
+	const question = "03777777" + "074578616d706c65" + "03636f6d00" + "00010001" // www.Example.com, A, IN
+	pkts := []string{
+		// A query from 10.0.0.1:1234 over UDP.
+		eth + "4500002800000000401100000a0000010a000002" + "04d2003500000000" +
+			"123401000001000000000000" + question,
+		// Its response: a CNAME with a compressed name, then an A and an AAAA.
+		eth + "4500002800000000401100000a0000020a000001" + "003504d200000000" +
+			"123481800001000300000000" + question +
+			"c00c" + "00050001" + "0000003c" + "0006" + "03636466c010" +
+			"c02d" + "00010001" + "0000003c" + "0004" + "5db8d822" +
+			"c02d" + "001c0001" + "0000003c" + "0010" + "20010db8000000000000000000000001",
+		// TCP to the A record's address.
+		eth + "450000280000000040060000" + "0a000001" + "5db8d822" + "04d301bb" + "0000000000000000" + "5010" + "000000000000",
+		// A query over TCP, after its length.
+		eth + "4500002800000000400600000a0000010a000002" + "04d50035" + "0000000000000000" + "5018" + "000000000000" +
+			"0021" + "123401000001000000000000" + question,
+		// A name compressed into a loop.
+		eth + "4500002800000000401100000a0000010a000002" + "04d2003500000000" +
+			"123401000001000000000000" + "c00c" + "00010001",
+	}
+	b := NewBuilder(BuilderOptions{IndexDNSAnswers: true})
+	for i, pkt := range pkts {
+		b.AddPacket(mustHex(t, pkt), int64(i+1)*100)
+	}
+	path := filepath.Join(t.TempDir(), "index")
+	if err := b.WriteFile(path); err != nil {
+		t.Fatal(err)
+	}
+	idx := testIndexFile(t, path)
+	defer idx.Close()
+	for _, test := range []struct {
+		name       string
+		subdomains bool
+		want       base.Positions
+	}{
+		{"www.example.com", false, base.Positions{100, 200, 400}},
+		{"WWW.EXAMPLE.COM.", false, base.Positions{100, 200, 400}},
+		{"example.com", false, nil},
+		{"example.com", true, base.Positions{100, 200, 400}},
+		{"ample.com", true, nil},
+		{"cdn.example.com", false, nil},
+	} {
+		if got, err := idx.DNSNamePositions(ctx, test.name, test.subdomains); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("dns name %q (subdomains %v): want %v, got %v", test.name, test.subdomains, test.want, got)
+		}
+	}
+	for _, test := range []struct {
+		name       string
+		subdomains bool
+		want       []net.IP
+	}{
+		{"www.example.com", false, []net.IP{net.ParseIP("2001:db8::1"), parseIP("93.184.216.34")}},
+		{"example.com", true, []net.IP{net.ParseIP("2001:db8::1"), parseIP("93.184.216.34")}},
+		{"example.com", false, nil},
+	} {
+		if got, err := idx.DNSAnswers(ctx, test.name, test.subdomains); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("dns answers for %q (subdomains %v): want %v, got %v", test.name, test.subdomains, test.want, got)
+		}
+	}
+}
+
+func TestBuilderTLS(t *testing.T) {
+	const tcp = "000000000002000000000001" + "0800" + "4500002800000000400600000a0000010a000002" +
+		"04d201bb" + "0000000000000000" + "5018" + "000000000000"
+	random := strings.Repeat("00", 32)
+	clientHello := "160301" + "0061" + "01" + "00005d" + "0303" + random + "00" +
+		"0006" + "0a0a13011302" + // Ciphers, after a GREASE value
+		"0100" + // Compression methods
+		"002e" + "1a1a0000" + // Extensions, starting with GREASE
+		"0000" + "0014" + "0012" + "00" + "000f" + hex.EncodeToString([]byte("Www.Example.com")) +
+		"000a" + "0008" + "0006" + "2a2a001d0017" + // Supported groups
+		"000b" + "0002" + "0100" // EC point formats
+	serverHello := "160303" + "0032" + "02" + "00002e" + "0303" + random + "00" +
+		"1301" + "00" + "0006" + "002b00020304"
+	b := NewBuilder(BuilderOptions{})
+	for i, pkt := range []string{
+		tcp + clientHello,
+		tcp + serverHello,
+		tcp + clientHello[:len(clientHello)-8], // Truncated
+		tcp + hex.EncodeToString([]byte("GET / HTTP/1.1\r\n")),
+	} {
+		b.AddPacket(mustHex(t, pkt), int64(i+1)*100)
+	}
+	path := filepath.Join(t.TempDir(), "index")
+	if err := b.WriteFile(path); err != nil {
+		t.Fatal(err)
+	}
+	idx := testIndexFile(t, path)
+	defer idx.Close()
+	for _, test := range []struct {
+		name string
+		get  func() (base.Positions, error)
+		want base.Positions
+	}{
+		{"tls.sni www.example.com", func() (base.Positions, error) {
+			return idx.TLSServerNamePositions(ctx, "www.example.com", false)
+		}, base.Positions{100}},
+		{"tls.sni *.example.com", func() (base.Positions, error) {
+			return idx.TLSServerNamePositions(ctx, "example.com", true)
+		}, base.Positions{100}},
+		{"dns.name www.example.com", func() (base.Positions, error) {
+			return idx.DNSNamePositions(ctx, "www.example.com", false)
+		}, nil},
+		{"ja3", func() (base.Positions, error) {
+			return idx.JA3Positions(ctx, md5.Sum([]byte("771,4865-4866,0-10-11,29-23,0")))
+		}, base.Positions{100}},
+		{"ja3s", func() (base.Positions, error) {
+			return idx.JA3SPositions(ctx, md5.Sum([]byte("771,4865,43")))
+		}, base.Positions{200}},
+		{"ja3s of the client", func() (base.Positions, error) {
+			return idx.JA3SPositions(ctx, md5.Sum([]byte("771,4865-4866,0-10-11,29-23,0")))
+		}, nil},
+	} {
+		if got, err := test.get(); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: want %v, got %v", test.name, test.want, got)
+		}
+	}
+}
+
+func TestBuilderHTTP(t *testing.T) {
+	const tcp = "000000000002000000000001" + "0800" + "4500002800000000400600000a0000010a000002" +
+		"04d20050" + "0000000000000000" + "5018" + "000000000000"
+	pkts := []string{
+		"GET /index.html?q=1 HTTP/1.1\r\nUser-Agent: x\r\nHost: WWW.Example.com:8080\r\n\r\n",
+		"POST http://proxy.example.org/login HTTP/1.1\r\nAccept: */*\r\n\r\n",
+		"CONNECT secure.example.com:443 HTTP/1.1\r\n\r\n",
+		"HTTP/1.1 200 OK\r\nHost: www.example.com\r\n\r\n",
+		"GET /admin/users HTTP/1.1\r\nHost: [::1]:80\r\n",
+		"GET / HTTP/1.1", // Truncated
+	}
+	b := NewBuilder(BuilderOptions{IndexHTTPRequests: true})
+	for i, pkt := range pkts {
+		b.AddPacket(mustHex(t, tcp+hex.EncodeToString([]byte(pkt))), int64(i+1)*100)
+	}
+	path := filepath.Join(t.TempDir(), "index")
+	if err := b.WriteFile(path); err != nil {
+		t.Fatal(err)
+	}
+	idx := testIndexFile(t, path)
+	defer idx.Close()
+	for _, test := range []struct {
+		name string
+		get  func() (base.Positions, error)
+		want base.Positions
+	}{
+		{"http.host www.example.com", func() (base.Positions, error) {
+			return idx.HTTPHostPositions(ctx, "www.example.com", false)
+		}, base.Positions{100}},
+		{"http.host *.example.com", func() (base.Positions, error) {
+			return idx.HTTPHostPositions(ctx, "example.com", true)
+		}, base.Positions{100, 300}},
+		{"http.host proxy.example.org", func() (base.Positions, error) {
+			return idx.HTTPHostPositions(ctx, "proxy.example.org", false)
+		}, base.Positions{200}},
+		{"http.method GET", func() (base.Positions, error) {
+			return idx.HTTPMethodPositions(ctx, "GET")
+		}, base.Positions{100, 500}},
+		{"http.method CONNECT", func() (base.Positions, error) {
+			return idx.HTTPMethodPositions(ctx, "CONNECT")
+		}, base.Positions{300}},
+		{"http.path /index.html", func() (base.Positions, error) {
+			return idx.HTTPPathPositions(ctx, "/index.html", false)
+		}, base.Positions{100}},
+		{"http.path /login", func() (base.Positions, error) {
+			return idx.HTTPPathPositions(ctx, "/login", false)
+		}, base.Positions{200}},
+		{"http.path /admin*", func() (base.Positions, error) {
+			return idx.HTTPPathPositions(ctx, "/admin", true)
+		}, base.Positions{500}},
+		{"http.path /*", func() (base.Positions, error) {
+			return idx.HTTPPathPositions(ctx, "/", true)
+		}, base.Positions{100, 200, 500}},
+		{"http.path /", func() (base.Positions, error) {
+			return idx.HTTPPathPositions(ctx, "/", false)
+		}, nil},
+	} {
+		if got, err := test.get(); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: want %v, got %v", test.name, test.want, got)
+		}
+	}
+}
+
+func TestParseHTTPNonRequests(t *testing.T) {
+	payload := bytes.Repeat([]byte("x"), 1000)
+	payload[999] = '\n'
+	if n := testing.AllocsPerRun(100, func() { parseHTTP(payload) }); n != 0 {
+		t.Errorf("want no allocations for a payload not starting with a method, got %v", n)
+	}
+	for _, p := range []string{"GETS / HTTP/1.1\r\n", "get / HTTP/1.1\r\n", "OPTIONSX / HTTP/1.1\r\n"} {
+		if method, _, _ := parseHTTP([]byte(p)); method != "" {
+			t.Errorf("%q: want no request, got method %q", p, method)
+		}
+	}
+}
+
+func TestBuilderCommunityIDs(t *testing.T) {
+	const eth = "000000000002000000000001" + "0800"
+	pkts := []string{
+		eth + "4500002800000000400600" + "0080e86e784223facc" + "88270050" + "0000000000000000" + "5002000000000000",
+		eth + "4500002800000000400600" + "004223facc80e86e78" + "00508827" + "0000000000000000" + "5012000000000000", // Reply
+		eth + "4500001c00000000401100" + "00c0a8013408080808" + "d539003500080000",
+		eth + "4500001c00000000400100" + "00c0a80059c0a80001" + "0800000000000000",                                   // Echo
+		eth + "4500001c00000000400100" + "00c0a80001c0a80059" + "0000000000000000",                                   // Echo reply
+		eth + "4500002800000010400600" + "0080e86e784223facc" + "88270050" + "0000000000000000" + "5002000000000000", // Later fragment
+		"000000000002000000000001" + "86dd" + "6000000000083aff" + "fe80000000000000020086fffe0580da" + "fe80000000000000026097fffe0769ea" + "8700000000000000",
+	}
+	b := NewBuilder(BuilderOptions{IndexCommunityIDs: true})
+	for i, pkt := range pkts {
+		b.AddPacket(mustHex(t, pkt), int64(i+1)*100)
+	}
+	path := filepath.Join(t.TempDir(), "index")
+	if err := b.WriteFile(path); err != nil {
+		t.Fatal(err)
+	}
+	idx := testIndexFile(t, path)
+	defer idx.Close()
+	for _, test := range []struct {
+		id   string
+		want base.Positions
+	}{
+		{"LQU9qZlK+B5F3KDmev6m5PMibrg=", base.Positions{100, 200}},
+		{"d/FP5EW3wiY1vCndhwleRRKHowQ=", base.Positions{300}},
+		{"X0snYXpgwiv9TZtqg64sgzUn6Dk=", base.Positions{400, 500}},
+		{"dGHyGvjMfljg6Bppwm3bg0LO8TY=", base.Positions{700}},
+	} {
+		var hash [sha1.Size]byte
+		raw, err := base64.StdEncoding.DecodeString(test.id)
+		if err != nil || len(raw) != sha1.Size {
+			t.Fatalf("bad test id %q", test.id)
+		}
+		copy(hash[:], raw)
+		if got, err := idx.CommunityIDPositions(ctx, hash); err != nil {
+			t.Errorf("%s: %v", test.id, err)
+		} else if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("community_id 1:%s: want %v, got %v", test.id, test.want, got)
+		}
+	}
+}
+
+func TestBuilderLengths(t *testing.T) {
+	const pkt = "000000000002000000000001" + "0800" + "4500002800000000400600000a0000010a000002"
+	lengths := []int{60, 64, 65, 512, 1500, 9000, 70000}
+	b := NewBuilder(BuilderOptions{LengthBuckets: []int{65, 513, 1501}})
+	for i, length := range lengths {
+		b.AddPacketLength(mustHex(t, pkt), length, int64(i+1)*100)
+	}
+	path := filepath.Join(t.TempDir(), "index")
+	if err := b.WriteFile(path); err != nil {
+		t.Fatal(err)
+	}
+	idx := testIndexFile(t, path)
+	defer idx.Close()
+	for _, test := range []struct {
+		min, max int
+		want     base.Positions
+	}{
+		// The buckets overlapping the range, not just the packets in it.
+		{0, 64, base.Positions{100, 200}},
+		{0, 65, base.Positions{100, 200, 300, 400}},
+		{1000, MaxLength, base.Positions{500, 600, 700}},
+		{1501, 100000, base.Positions{600, 700}},
+		{100000, 100000, base.Positions{600, 700}},
+		{MaxLength + 1, MaxLength, base.Positions{600, 700}}, // len > 65535
+		{0, MaxLength, base.Positions{100, 200, 300, 400, 500, 600, 700}},
+	} {
+		if got, err := idx.LengthPositions(ctx, test.min, test.max); err != nil {
+			t.Errorf("[%d, %d]: %v", test.min, test.max, err)
+		} else if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("lengths [%d, %d]: want %v, got %v", test.min, test.max, test.want, got)
+		}
+	}
+}
+
+func TestBuilderTunnels(t *testing.T) {
+	const (
+		eth = "000000000002000000000001"
+		// Outer IPv4 10.0.0.1 -> 10.0.0.2, missing its protocol and
+		// addresses.
+		ip4 = "4500000000000000" + "40"
+		src = "0a000001" + "0a000002"
+		tcp = "04d20050" + "00000000000000005002000000000000" // 1234 -> 80
+		udp = "0035003500080000"                              // 53 -> 53
+	)
+	pkts := []string{
+		// GRE with a key, carrying IPv4 192.168.0.1 -> 192.168.0.2, TCP.
+		eth + "0800" + ip4 + "2f0000" + src + "2000080000000001" +
+			"450000000000000040060000c0a80001c0a80002" + tcp,
+		// VXLAN, carrying ethernet, then IPv4 192.168.0.3 -> 192.168.0.4, UDP.
+		eth + "0800" + ip4 + "110000" + src + "c00012b500000000" + "0800000000000100" +
+			"000000000004000000000003" + "0800" + "450000000000000040110000c0a80003c0a80004" + udp,
+		// Geneve with an option, carrying ethernet with a VLAN tag, then IPv6
+		// ::3 -> ::4, TCP.
+		eth + "0800" + ip4 + "110000" + src + "c00017c100000000" + "0100655800000100" + "00000000" +
+			"000000000004000000000003" + "8100" + "0007" + "86dd" + "6000000000000600" +
+			"00000000000000000000000000000003" + "00000000000000000000000000000004" + tcp,
+		// IPv4 192.168.0.5 -> 192.168.0.6 within IPv4, UDP.
+		eth + "0800" + ip4 + "040000" + src + "450000000000000040110000c0a80005c0a80006" + udp,
+		// IPv6 ::5 -> ::6 within IPv4, truncated after its addresses.
+		eth + "0800" + ip4 + "290000" + src + "6000000000001100" +
+			"00000000000000000000000000000005" + "00000000000000000000000000000006",
+		// A later fragment of GRE, whose payload can't be decoded.
+		eth + "0800" + "4500000000000001" + "40" + "2f0000" + src + "0000080000000000" +
+			"450000000000000040060000c0a80007c0a80008" + tcp,
+	}
+	b := NewBuilder(BuilderOptions{})
+	for i, pkt := range pkts {
+		b.AddPacket(mustHex(t, pkt), int64(i+1)*100)
+	}
+	// Inner keys sort after the time range, which has to be written between
+	// them and the outer ones.
+	b.SetTimeRange(time.Unix(1423704299, 0), time.Unix(1423704399, 0))
+	path := filepath.Join(t.TempDir(), "index")
+	if err := b.WriteFile(path); err != nil {
+		t.Fatal(err)
+	}
+	idx := testIndexFile(t, path)
+	defer idx.Close()
+	if _, _, ok, err := idx.TimeRange(); !ok || err != nil {
+		t.Errorf("got time range %v, %v", ok, err)
+	}
+	_, net24, _ := net.ParseCIDR("192.168.0.0/24")
+	host := func(ip string) (base.Positions, error) {
+		return idx.InnerIPPositions(ctx, parseIP(ip), parseIP(ip))
+	}
+	for _, test := range []struct {
+		name string
+		get  func() (base.Positions, error)
+		want base.Positions
+	}{
+		{"inner host 192.168.0.1", func() (base.Positions, error) { return host("192.168.0.1") }, base.Positions{100}},
+		{"inner host 192.168.0.4", func() (base.Positions, error) { return host("192.168.0.4") }, base.Positions{200}},
+		{"inner host ::3", func() (base.Positions, error) { return host("::3") }, base.Positions{300}},
+		{"inner host 192.168.0.5", func() (base.Positions, error) { return host("192.168.0.5") }, base.Positions{400}},
+		{"inner host ::6", func() (base.Positions, error) { return host("::6") }, base.Positions{500}},
+		{"inner host 192.168.0.7", func() (base.Positions, error) { return host("192.168.0.7") }, nil},
+		{"inner host 10.0.0.1", func() (base.Positions, error) { return host("10.0.0.1") }, nil},
+		{"inner net 192.168.0.0/24", func() (base.Positions, error) {
+			return idx.InnerIPNetPositions(ctx, net24)
+		}, base.Positions{100, 200, 400}},
+		{"inner port 80", func() (base.Positions, error) { return idx.InnerPortPositions(ctx, 80) }, base.Positions{100, 300}},
+		{"inner portrange 50-80", func() (base.Positions, error) {
+			return idx.InnerPortRangePositions(ctx, 50, 80)
+		}, base.Positions{100, 200, 300, 400}},
+		{"host 10.0.0.1", func() (base.Positions, error) {
+			return idx.IPPositions(ctx, parseIP("10.0.0.1"), parseIP("10.0.0.1"))
+		}, base.Positions{100, 200, 300, 400, 500, 600}},
+		{"host 192.168.0.1", func() (base.Positions, error) {
+			return idx.IPPositions(ctx, parseIP("192.168.0.1"), parseIP("192.168.0.1"))
+		}, nil},
+		{"port 4789", func() (base.Positions, error) { return idx.PortPositions(ctx, 4789) }, base.Positions{200}},
+		{"port 80", func() (base.Positions, error) { return idx.PortPositions(ctx, 80) }, nil},
+		{"ip proto 47", func() (base.Positions, error) { return idx.ProtoPositions(ctx, 47) }, base.Positions{100, 600}},
+	} {
+		if got, err := test.get(); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: want %v, got %v", test.name, test.want, got)
+		}
+	}
+}
+
+func TestBuilderAddIndex(t *testing.T) {
+	src := testIndexFile(t, "../testdata/IDX0/dhcp")
+	defer src.Close()
+	want, err := src.PortPositions(ctx, 67)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A second copy of the file follows the first, without its first block.
+	const shift = 100 << 20
+	for _, pos := range want {
+		if pos >= 1<<20 {
+			want = append(want, pos+shift)
+		}
+	}
+	b := NewBuilder(BuilderOptions{})
+	if err := b.AddIndex(ctx, src, func(pos int64) (int64, bool) { return pos, true }); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.AddIndex(ctx, src, func(pos int64) (int64, bool) { return pos + shift, pos >= 1<<20 }); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "index")
+	if err := b.WriteFile(path); err != nil {
+		t.Fatal(err)
+	}
+	idx := testIndexFile(t, path)
+	defer idx.Close()
+	if got, err := idx.PortPositions(ctx, 67); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(got, want) {
+		t.Errorf("got port 67 positions %v, want %v", got, want)
+	}
+	// The source predates protocol+port keys, so the merged index mustn't
+	// claim to have them.
+	if idx.minor != src.minor {
+		t.Errorf("got minor version %d, want %d", idx.minor, src.minor)
+	}
+}
+
+func TestBuilderIPFilter(t *testing.T) {
+	b := NewBuilder(BuilderOptions{})
+	b.AddPacket(mustHex(t, "000000000002000000000001"+"0800"+
+		"4500002800000000400600000a0000010a000002"+
+		"04d20050"+"0000000000000000"+"5002000000000000"), 100)
+	path := filepath.Join(t.TempDir(), "index")
+	if err := b.WriteFile(path); err != nil {
+		t.Fatal(err)
+	}
+	idx := testIndexFile(t, path)
+	defer idx.Close()
+	if idx.filter == nil {
+		t.Fatal("index has no IP filter")
+	}
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2"} {
+		if got, err := idx.IPPositions(ctx, parseIP(ip), parseIP(ip)); err != nil || !reflect.DeepEqual(got, base.Positions{100}) {
+			t.Errorf("host %s: got %v, %v", ip, got, err)
+		}
+	}
+	matches := 0
+	for i := 0; i < 1000; i++ {
+		ip := net.IPv4(10, 1, byte(i>>8), byte(i)).To4()
+		if idx.filter.mayHold(append([]byte{keyIPv4}, ip...)) {
+			matches++
+		}
+		if got, err := idx.IPPositions(ctx, ip, ip); err != nil || got != nil {
+			t.Fatalf("host %v: got %v, %v", ip, got, err)
+		}
+	}
+	// The smallest filter holds 64 bits, so two keys set about a fifth.
+	if matches > 20 {
+		t.Errorf("IP filter matched %d of 1000 missing IPs", matches)
+	}
+	// Lookups can be ruled out without the index, ranges included.
+	f := idx.IPFilter()
+	for _, test := range []struct {
+		from, to string
+		tunneled bool
+		want     bool
+	}{
+		{"10.0.0.1", "10.0.0.1", false, true},
+		{"10.0.0.0", "10.0.0.255", false, true},
+		{"10.1.2.0", "10.1.2.15", false, false},
+		{"10.0.0.1", "10.0.0.1", true, false},
+		{"10.0.0.0", "10.255.255.255", false, true}, // Too many to check
+	} {
+		if got := f.MayHoldIPs(parseIP(test.from), parseIP(test.to), test.tunneled); got != test.want {
+			t.Errorf("%s-%s (tunneled %v): want %v, got %v", test.from, test.to, test.tunneled, test.want, got)
+		}
+	}
+	// Old indexes without a filter are probed as usual.
+	old := testIndexFile(t, "../testdata/IDX0/dhcp")
+	defer old.Close()
+	if old.filter != nil {
+		t.Error("testdata index has an IP filter")
+	}
+	if !old.IPFilter().MayHoldIPs(parseIP("10.1.2.3"), parseIP("10.1.2.3"), false) {
+		t.Error("testdata index ruled out an IP")
+	}
+}
+
+func TestFilterHash(t *testing.T) {
+	// As stenotype's FilterHash returns them, so both write the same filters.
+	for _, test := range []struct {
+		key    string
+		h1, h2 uint32
+	}{
+		{"", 0xba992926, 0xefd01f61},
+		{"040a000001", 0xe47255f7, 0xd4bdad33},
+		{"04c0a801fe", 0x0a487d2e, 0xb35e1097},
+		{"0620010db8000000000000000000000001", 0x85be058b, 0x2252eec1},
+		{"097f000001", 0x23eda8f9, 0x406b588f},
+	} {
+		if h1, h2 := filterHash(mustHex(t, test.key)); h1 != test.h1 || h2 != test.h2 {
+			t.Errorf("%s: want %#x, %#x, got %#x, %#x", test.key, test.h1, test.h2, h1, h2)
+		}
+	}
+}
+
+func TestBuilderEmpty(t *testing.T) {
+	// An index of no packets still has version and writer records.
+	path := filepath.Join(t.TempDir(), "index")
+	if err := NewBuilder(BuilderOptions{}).WriteFile(path); err != nil {
+		t.Fatal(err)
+	}
+	idx, err := NewIndexFile(path, filecache.NewCache(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+	if want := fmt.Sprintf("stenographer %s (index format %d.%d)", base.Version, majorVersionNumber, minorVersionNumber); idx.Writer() != want {
+		t.Errorf("want writer %q, got %q", want, idx.Writer())
+	}
+}
+
+func TestBuilderTimeRange(t *testing.T) {
+	first, last := time.Unix(1423704299, 710994000), time.Unix(1423704315, 61059646)
+	// The time range record sorts between ports and MACs, so is written
+	// among the keys when MACs, or anything after them, are indexed too.
+	for _, opts := range []BuilderOptions{{}, {IndexMACs: true, IndexTCPFlags: true}} {
+		b := NewBuilder(opts)
+		b.AddPacket(mustHex(t, "000000000002000000000001"+"0800"+
+			"4500002800000000400600000a0000010a000002"+
+			"04d20050"+"0000000000000000"+"5002"+"000000000000"), 100)
+		b.SetTimeRange(first, last)
+		path := filepath.Join(t.TempDir(), "index")
+		if err := b.WriteFile(path); err != nil {
+			t.Fatalf("%+v: %v", opts, err)
+		}
+		idx := testIndexFile(t, path)
+		defer idx.Close()
+		if f, l, ok, err := idx.TimeRange(); err != nil || !ok || !f.Equal(first) || !l.Equal(last) {
+			t.Errorf("%+v: got time range %v, %v, %v, %v, want %v, %v", opts, f, l, ok, err, first, last)
+		}
+		if got, err := idx.PortPositions(ctx, 80); err != nil || !reflect.DeepEqual(got, base.Positions{100}) {
+			t.Errorf("%+v: port 80: got %v, %v", opts, got, err)
+		}
+		if !opts.IndexMACs {
+			continue
+		}
+		mac, _ := net.ParseMAC("00:00:00:00:00:01")
+		if got, err := idx.MACPositions(ctx, mac); err != nil || !reflect.DeepEqual(got, base.Positions{100}) {
+			t.Errorf("%+v: ether host: got %v, %v", opts, got, err)
+		}
+		if got, err := idx.TCPFlagsPositions(ctx, 0x02, 0); err != nil || !reflect.DeepEqual(got, base.Positions{100}) {
+			t.Errorf("%+v: tcp-syn: got %v, %v", opts, got, err)
+		}
+	}
+
+	// Stenotype's indexes have no time range.
+	stenotype := testIndexFile(t, "../testdata/IDX0/dhcp")
+	defer stenotype.Close()
+	if _, _, ok, err := stenotype.TimeRange(); ok || err != nil {
+		t.Errorf("got time range %v, %v from stenotype's index", ok, err)
+	}
+}
+
+func TestBuilderKeyTypes(t *testing.T) {
+	pkt := mustHex(t, "000000000002000000000001"+"0800"+
+		"4500002800000000400600000a0000010a000002"+
+		"04d20050"+"0000000000000000"+"5002000000000000")
+	mac, err := net.ParseMAC("00:00:00:00:00:01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := NewBuilder(BuilderOptions{})
+	b.AddPacket(pkt, 100)
+	path := filepath.Join(t.TempDir(), "index")
+	if err := b.WriteFile(path); err != nil {
+		t.Fatal(err)
+	}
+	idx := testIndexFile(t, path)
+	defer idx.Close()
+	if idx.Outdated(BuilderOptions{}) {
+		t.Error("new index outdated")
+	}
+
+	// Indexes from before key types were recorded hold those of their
+	// minor version, and optional ones they have keys of.
+	old := testIndexFile(t, "../testdata/IDX0/dhcp")
+	defer old.Close()
+	if !old.Outdated(BuilderOptions{}) {
+		t.Error("testdata index not outdated")
+	}
+	for typ, want := range map[byte]bool{keyPort: true, keyIPv6: true, keyProtoPort: false, keyDNSName: false, keyMAC: false, keyInnerPort: false} {
+		if got := old.holds(typ); got != want {
+			t.Errorf("testdata index holds key type %d: got %v, want %v", typ, got, want)
+		}
+	}
+
+	// Merged indexes hold only the key types all their sources do.
+	merged := NewBuilder(BuilderOptions{IndexMACs: true})
+	merged.AddPacket(pkt, 100)
+	if err := merged.AddIndex(ctx, old, func(pos int64) (int64, bool) { return pos + 1000, true }); err != nil {
+		t.Fatal(err)
+	}
+	path = filepath.Join(t.TempDir(), "merged")
+	if err := merged.WriteFile(path); err != nil {
+		t.Fatal(err)
+	}
+	idx = testIndexFile(t, path)
+	defer idx.Close()
+	if idx.holds(keyMAC) || idx.holds(keyDNSName) || !idx.holds(keyPort) {
+		t.Errorf("merged index holds key types %v", idx.heldKeyTypes().record())
+	}
+
+	// Scan builders index just the key types lookups were missing, exactly,
+	// in memory.
+	keys := &ScanKeys{}
+	scanCtx := WithScanKeys(ctx, keys)
+	if _, err := old.MACPositions(scanCtx, mac); err != ErrNotIndexed {
+		t.Errorf("testdata ether host: want ErrNotIndexed, got %v", err)
+	}
+	if _, err := old.LengthPositions(scanCtx, 60, 60); err != ErrNotIndexed {
+		t.Errorf("testdata lengths: want ErrNotIndexed, got %v", err)
+	}
+	if _, err := old.PortPositions(scanCtx, 80); err != nil {
+		t.Errorf("testdata port 80: %v", err)
+	}
+	scan := NewScanBuilder(keys)
+	scan.AddPacketLength(pkt, 60, 100)
+	if got := scan.Positions(); got != 3 {
+		t.Errorf("scan builder added %d positions, want 3 for its MACs and length", got)
+	}
+	idx, err = scan.Open("scanned")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+	if got, err := idx.MACPositions(ctx, mac); err != nil || !reflect.DeepEqual(got, base.Positions{100}) {
+		t.Errorf("scanned ether host: got %v, %v", got, err)
+	}
+	for _, r := range [][2]int{{60, 60}, {61, MaxLength}} {
+		want := base.Positions{100}
+		if r[0] > 60 {
+			want = nil
+		}
+		if got, err := idx.LengthPositions(ctx, r[0], r[1]); err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("scanned lengths %v: got %v, %v, want %v", r, got, err, want)
+		}
+	}
+	if _, err := idx.PortPositions(ctx, 80); err != ErrNotIndexed {
+		t.Errorf("scanned port 80: want ErrNotIndexed, got %v", err)
+	}
+}
+
+func TestBuilderCustom(t *testing.T) {
+	const udp = "000000000002000000000001" + "0800" + "4500001c00000000401100000a0000010a000002" + "13c413c400000000"
+	const tcp = "000000000002000000000001" + "0800" + "4500002800000000400600000a0000010a000002" +
+		"04d213c4" + "0000000000000000" + "5018" + "000000000000"
+	pkts := []string{
+		udp + hex.EncodeToString([]byte("INVITE sip:bob@example.com SIP/2.0\r\nVia: SIP/2.0/UDP 10.0.0.1\r\nCall-ID: a84b4c76e66710@10.0.0.1\r\n\r\n")),
+		udp + hex.EncodeToString([]byte("SIP/2.0 200 OK\r\ni: a84b4c76e66710@10.0.0.1\r\n\r\n")),
+		tcp + hex.EncodeToString([]byte("BYE sip:bob@example.com SIP/2.0\r\nCall-ID : a84b4c76e66710@10.0.0.1\r\n\r\n")),
+		udp + hex.EncodeToString([]byte("OPTIONS sip:bob@example.com SIP/2.0\r\nCall-ID: other\r\n\r\n")),
+		udp + hex.EncodeToString([]byte("GET / HTTP/1.1\r\nCall-ID: notsip\r\n\r\n")),
+	}
+	b := NewBuilder(BuilderOptions{CustomIndexers: []string{"sip"}})
+	for i, pkt := range pkts {
+		b.AddPacket(mustHex(t, pkt), int64(i+1)*100)
+	}
+	path := filepath.Join(t.TempDir(), "index")
+	if err := b.WriteFile(path); err != nil {
+		t.Fatal(err)
+	}
+	idx := testIndexFile(t, path)
+	defer idx.Close()
+	for _, test := range []struct {
+		key  string
+		want base.Positions
+	}{
+		{"a84b4c76e66710@10.0.0.1", base.Positions{100, 200, 300}},
+		{"other", base.Positions{400}},
+		{"notsip", nil},
+	} {
+		if got, err := idx.CustomKeyPositions(ctx, "sip.callid", []byte(test.key)); err != nil {
+			t.Errorf("key sip.callid=%s: %v", test.key, err)
+		} else if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("key sip.callid=%s: want %v, got %v", test.key, test.want, got)
+		}
+	}
+	// Records sorting before the custom keys are still found.
+	if got, err := idx.PortPositions(ctx, 5060); err != nil || len(got) != len(pkts) {
+		t.Errorf("port 5060: got %v, %v", got, err)
+	}
+	if !idx.holds(keyPort) {
+		t.Error("index with sip enabled lost its key types")
+	}
+	s, err := idx.Stats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := s.KeyTypes["sip.callid"]; got.Keys != 2 || got.Positions != 4 || got.Hottest[0] != (KeyCount{"a84b4c76e66710@10.0.0.1", 3}) {
+		t.Errorf("sip.callid stats: got %+v", got)
+	}
+}
+
+// TestBuilderOptions checks that each option has its keys indexed, and that
+// indexes written without it say they don't hold them, so are outdated once
+// it's set.
+func TestBuilderOptions(t *testing.T) {
+	// 00:00:00:00:00:01 -> 00:00:00:00:00:02, 10.0.0.1:1234 -> 10.0.0.2:80,
+	// a SYN carrying an HTTP request, then a SIP message over UDP.
+	const eth = "000000000002000000000001" + "0800"
+	pkts := []string{
+		eth + "4500002800000000400600000a0000010a000002" + "04d20050" + "0000000000000000" + "5002" + "000000000000" +
+			hex.EncodeToString([]byte("GET /index.html HTTP/1.1\r\nHost: www.example.com\r\n\r\n")),
+		eth + "4500001c00000000401100000a0000010a000002" + "13c413c400000000" +
+			hex.EncodeToString([]byte("OPTIONS sip:bob@example.com SIP/2.0\r\nCall-ID: abc\r\n\r\n")),
+	}
+	mac, err := net.ParseMAC("00:00:00:00:00:01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name string
+		opts BuilderOptions
+		get  func(idx *IndexFile) (base.Positions, error)
+		want base.Positions
+	}{
+		{"IndexMACs", BuilderOptions{IndexMACs: true}, func(idx *IndexFile) (base.Positions, error) {
+			return idx.MACPositions(ctx, mac)
+		}, base.Positions{100, 200}},
+		{"IndexTCPFlags", BuilderOptions{IndexTCPFlags: true}, func(idx *IndexFile) (base.Positions, error) {
+			return idx.TCPFlagsPositions(ctx, 0x02, 0)
+		}, base.Positions{100}},
+		{"IndexDNSAnswers", BuilderOptions{IndexDNSAnswers: true}, func(idx *IndexFile) (base.Positions, error) {
+			// Answers are listed rather than looked up, so check the
+			// index holds them instead.
+			if !idx.holds(keyDNSAnswer) {
+				return nil, ErrNotIndexed
+			}
+			return nil, nil
+		}, nil},
+		{"IndexHTTPRequests", BuilderOptions{IndexHTTPRequests: true}, func(idx *IndexFile) (base.Positions, error) {
+			return idx.HTTPPathPositions(ctx, "/index.html", false)
+		}, base.Positions{100}},
+		{"IndexCommunityIDs", BuilderOptions{IndexCommunityIDs: true}, func(idx *IndexFile) (base.Positions, error) {
+			return idx.CommunityIDPositions(ctx, [20]byte{})
+		}, nil},
+		{"LengthBuckets", BuilderOptions{LengthBuckets: []int{100}}, func(idx *IndexFile) (base.Positions, error) {
+			return idx.LengthPositions(ctx, 0, 99)
+		}, base.Positions{100, 200}},
+		{"CustomIndexers", BuilderOptions{CustomIndexers: []string{"sip"}}, func(idx *IndexFile) (base.Positions, error) {
+			return idx.CustomKeyPositions(ctx, "sip.callid", []byte("abc"))
+		}, base.Positions{200}},
+	} {
+		if err := test.opts.Validate(); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		for _, set := range []bool{false, true} {
+			var opts BuilderOptions
+			if set {
+				opts = test.opts
+			}
+			b := NewBuilder(opts)
+			for i, pkt := range pkts {
+				b.AddPacketLength(mustHex(t, pkt), 90, int64(i+1)*100)
+			}
+			path := filepath.Join(t.TempDir(), "index")
+			if err := b.WriteFile(path); err != nil {
+				t.Fatal(err)
+			}
+			idx := testIndexFile(t, path)
+			defer idx.Close()
+			want, wantErr := test.want, error(nil)
+			if !set {
+				want, wantErr = nil, ErrNotIndexed
+			}
+			if got, err := test.get(idx); err != wantErr {
+				t.Errorf("%s set %v: want error %v, got %v", test.name, set, wantErr, err)
+			} else if !reflect.DeepEqual(got, want) {
+				t.Errorf("%s set %v: want %v, got %v", test.name, set, want, got)
+			}
+			if got := idx.Outdated(test.opts); got == set {
+				t.Errorf("%s set %v: outdated %v with it set", test.name, set, got)
+			}
+		}
+	}
+	for _, opts := range []BuilderOptions{
+		{LengthBuckets: []int{0, 100}},
+		{LengthBuckets: []int{100, 100}},
+		{LengthBuckets: []int{MaxLength + 1}},
+		{CustomIndexers: []string{"nonexistent"}},
+	} {
+		if err := opts.Validate(); err == nil {
+			t.Errorf("invalid options %+v validated", opts)
+		}
+	}
+}
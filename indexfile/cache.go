@@ -0,0 +1,135 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package indexfile
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/google/stenographer/base"
+	"github.com/google/stenographer/stats"
+)
+
+var (
+	indexCacheHits   = stats.S.Get("indexfile_cache_hits")
+	indexCacheMisses = stats.S.Get("indexfile_cache_misses")
+	indexCacheBytes  = stats.S.Get("indexfile_cache_bytes")
+)
+
+// postingsCache holds the decoded positions of an index's recent lookups, by
+// the range of keys looked up, evicting the least recently used to stay
+// within its size.  Recent files are queried far more than old ones, so
+// threads cache the indexes of their newest files (see SetCacheSize), and
+// lookups repeated against them needn't read or decode the table again.
+type postingsCache struct {
+	mu      sync.Mutex
+	max     int64 // Bytes of positions and keys held at most
+	size    int64
+	lru     *list.List // Of *cachedPostings, most recently used first
+	entries map[string]*list.Element
+}
+
+// cachedPostings are the positions found for the keys in a range.
+type cachedPostings struct {
+	keys      string // The range's bounds, which are always the same length
+	positions base.Positions
+}
+
+func (c *cachedPostings) size() int64 {
+	return int64(len(c.keys)) + int64(len(c.positions))*positionSize
+}
+
+// get returns a copy of the positions cached for the keys from 'from' to
+// 'to', if there are any, as callers may change what they're given.
+func (p *postingsCache) get(from, to []byte) (base.Positions, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e := p.entries[string(from)+string(to)]
+	if e == nil {
+		indexCacheMisses.Increment()
+		return nil, false
+	}
+	indexCacheHits.Increment()
+	p.lru.MoveToFront(e)
+	cached := e.Value.(*cachedPostings).positions
+	if cached == nil {
+		return nil, true
+	}
+	return append(base.Positions(nil), cached...), true
+}
+
+// put caches a copy of the positions found for the keys from 'from' to 'to',
+// unless they'd take more than the whole cache, or it's been dropped.
+func (p *postingsCache) put(from, to []byte, positions base.Positions) {
+	c := &cachedPostings{keys: string(from) + string(to)}
+	if positions != nil {
+		c.positions = append(base.Positions(nil), positions...)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if c.size() > p.max || p.entries[c.keys] != nil {
+		// Too big, or dropped, or cached by another lookup meanwhile.
+		return
+	}
+	p.entries[c.keys] = p.lru.PushFront(c)
+	p.size += c.size()
+	indexCacheBytes.IncrementBy(c.size())
+	p.evict(p.max)
+}
+
+// evict drops the least recently used positions until the cache holds at
+// most max bytes.  p.mu must be held.
+func (p *postingsCache) evict(max int64) {
+	for p.size > max {
+		c := p.lru.Remove(p.lru.Back()).(*cachedPostings)
+		delete(p.entries, c.keys)
+		p.size -= c.size()
+		indexCacheBytes.IncrementBy(-c.size())
+	}
+}
+
+// SetCacheSize keeps the positions of the index's recent lookups in memory,
+// up to about 'bytes' of them, so repeating them reads nothing from disk.  A
+// size of zero stops caching, and frees those already cached, as does
+// closing the index.  Lookups with extra conditions on the keys they read,
+// like TCPFlagsPositions, aren't cached.
+func (i *IndexFile) SetCacheSize(bytes int64) {
+	i.cacheMu.Lock()
+	defer i.cacheMu.Unlock()
+	if bytes <= 0 {
+		if i.cache != nil {
+			i.cache.mu.Lock()
+			i.cache.max = 0
+			i.cache.evict(0)
+			i.cache.mu.Unlock()
+			i.cache = nil
+		}
+		return
+	}
+	if i.cache == nil {
+		i.cache = &postingsCache{lru: list.New(), entries: map[string]*list.Element{}}
+	}
+	i.cache.mu.Lock()
+	i.cache.max = bytes
+	i.cache.evict(bytes)
+	i.cache.mu.Unlock()
+}
+
+// lookupCache returns the index's cache, or nil if it has none.
+func (i *IndexFile) lookupCache() *postingsCache {
+	i.cacheMu.Lock()
+	defer i.cacheMu.Unlock()
+	return i.cache
+}
@@ -0,0 +1,117 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package indexfile
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+)
+
+// IP protocols, besides TCP and UDP, whose Community IDs cover ports.
+const (
+	ipICMP   = 1
+	ipSCTP   = 132
+	ipICMPv6 = 58
+)
+
+// icmpPairs and icmpv6Pairs map the types of ICMP requests to those of their
+// replies and back, which Community IDs treat like a flow's two ports.
+var (
+	icmpPairs = map[byte]byte{
+		8: 0, 0: 8, // Echo
+		13: 14, 14: 13, // Timestamp
+		15: 16, 16: 15, // Information
+		10: 9, 9: 10, // Router solicitation and advertisement
+		17: 18, 18: 17, // Address mask
+	}
+	icmpv6Pairs = map[byte]byte{
+		128: 129, 129: 128, // Echo
+		130: 131, 131: 130, // Multicast listener query and report
+		133: 134, 134: 133, // Router solicitation and advertisement
+		135: 136, 136: 135, // Neighbor solicitation and advertisement
+		139: 140, 140: 139, // Node information query and response
+		144: 145, 145: 144, // Home agent address discovery
+	}
+)
+
+// addCommunityID indexes the Community ID (version 1, with a seed of zero)
+// of the flow a packet belongs to, if the Builder indexes Community IDs.  ip
+// is the packet's IP header, of type 'typ', and payload what follows its
+// extension headers.  Fragments other than the first are skipped, since they
+// don't show their flow's ports, or for IPv6, even its protocol.
+func (b *Builder) addCommunityID(typ uint16, ip []byte, protocol byte, payload []byte, first bool, pos int64) {
+	if !b.opts.IndexCommunityIDs || !first {
+		return
+	}
+	if id, ok := communityID(typ, ip, protocol, payload); ok {
+		b.add(append([]byte{keyCommunityID}, id[:]...), pos)
+	}
+}
+
+// communityID returns the SHA-1 hash a packet's Community ID encodes.  'ok'
+// is false if the packet's ports, or ICMP type and code, aren't there.
+func communityID(typ uint16, ip []byte, protocol byte, payload []byte) (id [sha1.Size]byte, ok bool) {
+	var src, dst []byte
+	if typ == ethIPv4 {
+		src, dst = ip[12:16], ip[16:20]
+	} else {
+		src, dst = ip[8:24], ip[24:40]
+	}
+	var sport, dport uint16
+	ports, oneWay := false, false
+	switch {
+	case protocol == ipTCP || protocol == ipUDP || protocol == ipSCTP:
+		if len(payload) < 4 {
+			return id, false
+		}
+		sport, dport = binary.BigEndian.Uint16(payload), binary.BigEndian.Uint16(payload[2:])
+		ports = true
+	case protocol == ipICMP && typ == ethIPv4, protocol == ipICMPv6 && typ == ethIPv6:
+		if len(payload) < 2 {
+			return id, false
+		}
+		pairs := icmpPairs
+		if protocol == ipICMPv6 {
+			pairs = icmpv6Pairs
+		}
+		// The type is the flow's source "port", and its pair, or lacking one
+		// the code, the destination.
+		reply, paired := pairs[payload[0]]
+		if !paired {
+			reply = payload[1]
+		}
+		sport, dport = uint16(payload[0]), uint16(reply)
+		ports, oneWay = true, !paired
+	}
+	// Both directions of a flow hash the same, ordered from the lower
+	// address and port, unless the ICMP message has no reply.
+	if c := bytes.Compare(src, dst); !oneWay && (c > 0 || c == 0 && sport > dport) {
+		src, dst, sport, dport = dst, src, dport, sport
+	}
+	h := sha1.New()
+	h.Write([]byte{0, 0}) // The seed
+	h.Write(src)
+	h.Write(dst)
+	h.Write([]byte{protocol, 0})
+	if ports {
+		var buf [4]byte
+		binary.BigEndian.PutUint16(buf[:], sport)
+		binary.BigEndian.PutUint16(buf[2:], dport)
+		h.Write(buf[:])
+	}
+	copy(id[:], h.Sum(nil))
+	return id, true
+}
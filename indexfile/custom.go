@@ -0,0 +1,216 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package indexfile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/google/stenographer/base"
+	"golang.org/x/net/context"
+)
+
+// Custom indexers index packets by key types of their own, for protocols
+// stenographer doesn't decode itself, like SIP or GTP.  They're compiled in,
+// registering with RegisterIndexer, and enabled by name in the config (see
+// BuilderOptions).  Their keys are stored under keyCustom, each holding the
+// length of its key type's name, the name, then the key, so a type's keys are
+// a contiguous run.  Indexes list the custom key types they hold under
+// keyCustomTypes.  Stenotype knows nothing of them, so its indexes hold none
+// until stenographer rebuilds them, and queries for them read packets instead
+// (see ErrNotIndexed).
+
+// CustomPacket is what an Indexer is given of each packet, decoded as far as
+// Builder decodes it.
+type CustomPacket struct {
+	Data     []byte // The whole packet, from its ethernet header
+	Protocol byte   // Of its outermost IP header, or zero if it isn't IP
+	// SrcPort and DstPort are the ports of TCP and UDP packets, and
+	// Payload what follows their headers, if the packet is the first
+	// fragment of its datagram.  Other packets leave them zero.
+	SrcPort, DstPort uint16
+	Payload          []byte
+}
+
+// CustomKey is a key an Indexer indexes a packet under.
+type CustomKey struct {
+	Type string // One of the key types the Indexer registered
+	Key  []byte // As queries give it, like "key sip.callid=<Key>"
+}
+
+// An Indexer finds keys of its own to index packets under.
+type Indexer interface {
+	// Keys returns the keys to index the packet under, if any.  It's
+	// called concurrently, for packets of different files.
+	Keys(p *CustomPacket) []CustomKey
+}
+
+// customIndexer is a registered Indexer.
+type customIndexer struct {
+	name     string
+	keyTypes []string
+	Indexer
+}
+
+var (
+	// registeredIndexers holds the registered Indexers by name, and
+	// customKeyTypes the key types they return.
+	registeredIndexers = map[string]*customIndexer{}
+	customKeyTypes     = map[string]bool{}
+)
+
+// RegisterIndexer makes an Indexer available to Builders under the given
+// name, returning keys of the given types.  Key type names are used in
+// queries, like "key sip.callid=...", so must be unique, and hold a dot and
+// no spaces, parentheses or '='.  It panics if they don't, and should be
+// called from an init function.
+func RegisterIndexer(name string, keyTypes []string, idx Indexer) {
+	if registeredIndexers[name] != nil {
+		panic(fmt.Sprintf("indexer %q registered twice", name))
+	}
+	for _, typ := range keyTypes {
+		if customKeyTypes[typ] || !strings.Contains(typ, ".") || len(typ) > 255 || strings.ContainsAny(typ, " \t\n()=") {
+			panic(fmt.Sprintf("indexer %q has invalid or duplicate key type %q", name, typ))
+		}
+		customKeyTypes[typ] = true
+	}
+	registeredIndexers[name] = &customIndexer{name, keyTypes, idx}
+}
+
+// IsCustomKeyType returns whether a registered Indexer returns keys of the
+// named type.  Queries may look up any of them, whether or not their Indexer
+// is enabled, since packets not indexed by them are read instead.
+func IsCustomKeyType(typ string) bool {
+	return customKeyTypes[typ]
+}
+
+// allIndexers returns every registered Indexer, in name order.
+func allIndexers() []*customIndexer {
+	var out []*customIndexer
+	for _, idx := range registeredIndexers {
+		out = append(out, idx)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].name < out[j].name })
+	return out
+}
+
+// customKeyPrefix returns the start of the keys of the named custom type.
+func customKeyPrefix(typ string) []byte {
+	return append([]byte{keyCustom, byte(len(typ))}, typ...)
+}
+
+// customKeyType returns the custom type of a keyCustom key, and its key, or
+// false if it's malformed.
+func customKeyType(key []byte) (typ string, value []byte, ok bool) {
+	if len(key) < 2 || len(key) < 2+int(key[1]) {
+		return "", nil, false
+	}
+	n := 2 + int(key[1])
+	return string(key[2:n]), key[n:], true
+}
+
+// setPorts sets the ports and payload of p from the TCP or UDP header at the
+// start of data, whose length the caller has checked.
+func (p *CustomPacket) setPorts(protocol byte, data []byte) {
+	p.SrcPort = binary.BigEndian.Uint16(data)
+	p.DstPort = binary.BigEndian.Uint16(data[2:])
+	skip := 8
+	if protocol == ipTCP {
+		if skip = int(data[12]>>4) * 4; skip < 20 {
+			return
+		}
+	}
+	if skip <= len(data) {
+		p.Payload = data[skip:]
+	}
+}
+
+// builderCustomTypes returns the custom key types a Builder indexes packets
+// by.
+func (b *Builder) builderCustomTypes() map[string]bool {
+	s := map[string]bool{}
+	for _, idx := range b.indexers {
+		for _, typ := range idx.keyTypes {
+			s[typ] = true
+		}
+	}
+	return s
+}
+
+// addCustom indexes p with the Builder's custom Indexers.
+func (b *Builder) addCustom(p *CustomPacket, pos int64) {
+	for _, idx := range b.indexers {
+		for _, k := range idx.Keys(p) {
+			if b.customTypes[k.Type] {
+				b.add(append(customKeyPrefix(k.Type), k.Key...), pos)
+			}
+		}
+	}
+}
+
+// customTypesRecord returns the value of the keyCustomTypes record listing
+// the custom key types in s, each followed by a newline, in order.
+func customTypesRecord(s map[string]bool) []byte {
+	var typs []string
+	for typ := range s {
+		typs = append(typs, typ)
+	}
+	sort.Strings(typs)
+	var out bytes.Buffer
+	for _, typ := range typs {
+		out.WriteString(typ)
+		out.WriteByte('\n')
+	}
+	return out.Bytes()
+}
+
+// parseCustomTypes returns the custom key types listed in a keyCustomTypes
+// record.
+func parseCustomTypes(record []byte) map[string]bool {
+	s := map[string]bool{}
+	for _, typ := range strings.Split(string(record), "\n") {
+		if typ != "" {
+			s[typ] = true
+		}
+	}
+	return s
+}
+
+// heldCustomTypes returns the custom key types the index holds, reading them
+// with its other key types.
+func (i *IndexFile) heldCustomTypes() map[string]bool {
+	i.heldKeyTypes()
+	return i.customTypes
+}
+
+// holdsCustom returns whether the index was written to hold keys of the named
+// custom type.
+func (i *IndexFile) holdsCustom(typ string) bool {
+	return i.heldCustomTypes()[typ]
+}
+
+// CustomKeyPositions returns the positions in the block file of all packets
+// an Indexer indexed under 'key', of the named custom key type.  Indexes
+// written without the type's Indexer enabled, including stenotype's, return
+// ErrNotIndexed.
+func (i *IndexFile) CustomKeyPositions(ctx context.Context, typ string, key []byte) (base.Positions, error) {
+	if !i.holdsCustom(typ) {
+		return nil, customNotIndexed(ctx, typ)
+	}
+	return i.positionsSingleKey(ctx, append(customKeyPrefix(typ), key...))
+}
@@ -0,0 +1,194 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package indexfile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+)
+
+// DNS message fields addDNS decodes.
+const (
+	portDNS       = 53
+	dnsHeaderLen  = 12
+	dnsResponse   = 0x8000 // The QR flag
+	dnsOpcode     = 0x7800
+	dnsRcode      = 0x000f
+	dnsTypeA      = 1
+	dnsTypeAAAA   = 28
+	dnsClassIN    = 1
+	dnsMaxNameLen = 255 // In wire format, including length bytes
+)
+
+// addDNS indexes the question names of the DNS message carried by the TCP or
+// UDP header at the start of data, and if the Builder indexes DNS answers,
+// which addresses a response gave for them.
+func (b *Builder) addDNS(protocol byte, data []byte, pos int64) {
+	switch protocol {
+	case ipUDP:
+		data = data[8:]
+	case ipTCP:
+		// Messages over TCP follow a 2-byte length.  Only those starting a
+		// segment are found.
+		off := int(data[12]>>4) * 4
+		if off < 20 || off+2 > len(data) {
+			return
+		}
+		data = data[off+2:]
+	default:
+		return
+	}
+	names, ips := parseDNS(data, b.opts.IndexDNSAnswers)
+	for _, name := range names {
+		b.add(append([]byte{keyDNSName}, name...), pos)
+		for _, ip := range ips {
+			b.add(dnsAnswerKey(name, ip), pos)
+		}
+	}
+}
+
+// dnsAnswerKey returns the key recording that a response for 'name', in index
+// form, answered with 'ip'.  Index names never hold a zero byte, so one
+// separates the two.
+func dnsAnswerKey(name, ip []byte) []byte {
+	key := make([]byte, 0, 1+len(name)+1+len(ip))
+	key = append(key, keyDNSAnswer)
+	key = append(key, name...)
+	key = append(key, 0)
+	return append(key, ip...)
+}
+
+// parseDNS returns the question names of the DNS query or response 'msg', in
+// index form (see dnsName).  If 'answers' is set and msg is a successful
+// response, it also returns the IPv4 and IPv6 addresses of its A and AAAA
+// answers, which may be for the questions' CNAMEs rather than the questions.
+// Only standard queries are decoded, and only as far as they're intact.
+func parseDNS(msg []byte, answers bool) (names, ips [][]byte) {
+	if len(msg) < dnsHeaderLen {
+		return nil, nil
+	}
+	flags := binary.BigEndian.Uint16(msg[2:])
+	if flags&dnsOpcode != 0 {
+		return nil, nil
+	}
+	questions := int(binary.BigEndian.Uint16(msg[4:]))
+	records := int(binary.BigEndian.Uint16(msg[6:]))
+	off := dnsHeaderLen
+	for ; questions > 0; questions-- {
+		name, next, ok := dnsName(msg, off)
+		if next == 0 || next+4 > len(msg) {
+			return names, nil
+		}
+		if ok {
+			names = append(names, name)
+		}
+		off = next + 4 // Type and class
+	}
+	if !answers || flags&dnsResponse == 0 || flags&dnsRcode != 0 || len(names) == 0 {
+		return names, nil
+	}
+	for ; records > 0; records-- {
+		_, next, _ := dnsName(msg, off)
+		if next == 0 || next+10 > len(msg) {
+			break
+		}
+		typ := binary.BigEndian.Uint16(msg[next:])
+		class := binary.BigEndian.Uint16(msg[next+2:])
+		rdata := next + 10 // After type, class, TTL and length.
+		rdlen := int(binary.BigEndian.Uint16(msg[next+8:]))
+		if rdata+rdlen > len(msg) {
+			break
+		}
+		if class == dnsClassIN && (typ == dnsTypeA && rdlen == 4 || typ == dnsTypeAAAA && rdlen == 16) {
+			ips = append(ips, msg[rdata:rdata+rdlen])
+		}
+		off = rdata + rdlen
+	}
+	return names, ips
+}
+
+// dnsName decodes the possibly compressed domain name at msg[off:] into the
+// form it's indexed in: lowercased, with its labels in reverse order, so a
+// name's subdomains all start with it.  "www.Example.com" becomes
+// "com.example.www".  'next' is the offset just past the name, or zero if
+// it's malformed.  'ok' is false if the name isn't indexed: the root, or any
+// with a label holding a dot or a byte other than printable ASCII.
+func dnsName(msg []byte, off int) (name []byte, next int, ok bool) {
+	var labels [][]byte
+	ok = true
+	// Compression pointers must point before the labels they're found
+	// after, so following them can't loop.
+	limit, size := off, 0
+	for {
+		if off >= len(msg) {
+			return nil, 0, false
+		}
+		n := int(msg[off])
+		switch {
+		case n == 0:
+			if next == 0 {
+				next = off + 1
+			}
+			if len(labels) == 0 || !ok {
+				return nil, next, false
+			}
+			var buf bytes.Buffer
+			for i := len(labels) - 1; i >= 0; i-- {
+				buf.Write(labels[i])
+				if i > 0 {
+					buf.WriteByte('.')
+				}
+			}
+			return bytes.ToLower(buf.Bytes()), next, true
+		case n&0xc0 == 0xc0:
+			if off+2 > len(msg) {
+				return nil, 0, false
+			}
+			ptr := int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+			if ptr >= limit {
+				return nil, 0, false
+			}
+			if next == 0 {
+				next = off + 2
+			}
+			off, limit = ptr, ptr
+		case n&0xc0 != 0:
+			return nil, 0, false // Reserved label types
+		default:
+			if size += n + 1; size > dnsMaxNameLen || off+1+n > len(msg) {
+				return nil, 0, false
+			}
+			label := msg[off+1 : off+1+n]
+			for _, c := range label {
+				if c <= ' ' || c > '~' || c == '.' {
+					ok = false
+				}
+			}
+			labels = append(labels, label)
+			off += 1 + n
+		}
+	}
+}
+
+// dnsIndexName returns 'name', a dotted domain name, in the form dnsName
+// indexes names in.
+func dnsIndexName(name string) []byte {
+	labels := strings.Split(strings.ToLower(strings.TrimSuffix(name, ".")), ".")
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+	return []byte(strings.Join(labels, "."))
+}
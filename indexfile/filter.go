@@ -0,0 +1,165 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package indexfile
+
+import (
+	"bytes"
+	"net"
+)
+
+// An index's IP filter is a Bloom filter of its IP keys, so lookups of single
+// IPs can skip indexes which can't hold them without reading the table.  Its
+// value is the number of bits set per key, then the filter's bits, the lowest
+// first in each byte.  The bits set for a key are derived, by double hashing,
+// from the two halves of a 64-bit hash of the whole key, its type byte
+// included: FNV-1a, mixed by MurmurHash3's finalizer.  Stenotype writes the
+// same filter.
+
+// filterBitsPerKey and filterHashes size IP filters for a false positive rate
+// of about 1%.
+const (
+	filterBitsPerKey = 10
+	filterHashes     = 7
+)
+
+// filterMinBytes is the size of the smallest filter written, so those of
+// indexes with few IPs don't match everything.
+const filterMinBytes = 8
+
+// filtered returns whether keys of the given type are in IP filters.
+func filtered(typ byte) bool {
+	switch typ {
+	case keyIPv4, keyIPv6, keyInnerIPv4, keyInnerIPv6:
+		return true
+	}
+	return false
+}
+
+// filterHash returns the two hashes of key that filter bits are derived from.
+// The second is odd, so a key's bits don't repeat in small filters.
+func filterHash(key []byte) (h1, h2 uint32) {
+	h := uint64(14695981039346656037)
+	for _, c := range key {
+		h ^= uint64(c)
+		h *= 1099511628211
+	}
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return uint32(h), uint32(h>>32) | 1
+}
+
+// newIPFilter returns the IP filter holding keys.
+func newIPFilter(keys [][]byte) []byte {
+	size := (len(keys)*filterBitsPerKey + 7) / 8
+	if size < filterMinBytes {
+		size = filterMinBytes
+	}
+	filter := make([]byte, 1+size)
+	filter[0] = filterHashes
+	bits := uint32(size * 8)
+	for _, key := range keys {
+		h1, h2 := filterHash(key)
+		for i := uint32(0); i < filterHashes; i++ {
+			bit := (h1 + i*h2) % bits
+			filter[1+bit/8] |= 1 << (bit % 8)
+		}
+	}
+	return filter
+}
+
+// filterMaxRange is the most IPs in a range checked against IP filters, each
+// in turn.
+const filterMaxRange = 256
+
+// IPFilter is an index's IP filter, with the key types the index holds, so it
+// can rule out lookups without the index (see MayHoldIPs).  The zero IPFilter
+// rules out nothing.
+type IPFilter struct {
+	filter   ipFilter
+	keyTypes keyTypeSet
+}
+
+// IPFilter returns the index's IP filter, which is held in memory.
+func (i *IndexFile) IPFilter() IPFilter {
+	return IPFilter{i.filter, i.heldKeyTypes()}
+}
+
+// MayHoldIPs returns false if the filter rules out its index holding any IP
+// from 'from' to 'to', or if tunneled is set, any such inner IP, so looking
+// them up would find nothing.  Ranges of over filterMaxRange IPs aren't
+// checked.
+func (f IPFilter) MayHoldIPs(from, to net.IP, tunneled bool) bool {
+	h := outer
+	if tunneled {
+		h = inner
+	}
+	if from4, to4 := from.To4(), to.To4(); from4 != nil && to4 != nil {
+		from, to = from4, to4
+	}
+	switch {
+	case len(from) != len(to) || bytes.Compare(from, to) > 0:
+		return true
+	case len(from) == net.IPv4len:
+		return !f.keyTypes.has(h.ipv4) || f.filter.mayHoldRange(h.ipv4, from, to)
+	case len(from) == net.IPv6len:
+		return !f.keyTypes.has(h.ipv6) || f.filter.mayHoldRange(h.ipv6, from, to)
+	}
+	return true
+}
+
+// ipFilter is the IP filter read from an index.
+type ipFilter []byte
+
+// mayHold returns false if the index can't hold key.  Filters which aren't
+// recognized, and those of indexes without one, may hold anything.
+func (f ipFilter) mayHold(key []byte) bool {
+	if len(f) < 2 || len(key) == 0 || !filtered(key[0]) {
+		return true
+	}
+	bits := uint32(len(f)-1) * 8
+	h1, h2 := filterHash(key)
+	for i := uint32(0); i < uint32(f[0]); i++ {
+		bit := (h1 + i*h2) % bits
+		if f[1+bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// mayHoldRange returns false if the index can't hold any key of type typ for
+// an IP from 'from' to 'to', of the same length.  Ranges of over
+// filterMaxRange IPs may hold anything.
+func (f ipFilter) mayHoldRange(typ byte, from, to net.IP) bool {
+	key := append([]byte{typ}, from...)
+	for n := 0; n < filterMaxRange; n++ {
+		if f.mayHold(key) {
+			return true
+		}
+		if bytes.Equal(key[1:], to) {
+			return false
+		}
+		// Increment the IP, carrying.
+		for j := len(key) - 1; j > 0; j-- {
+			if key[j]++; key[j] != 0 {
+				break
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,146 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package indexfile
+
+import (
+	"bytes"
+	"strings"
+)
+
+// httpMethods are the request methods addHTTP recognizes requests by.
+var httpMethods = map[string]bool{
+	"GET": true, "POST": true, "PUT": true, "HEAD": true, "DELETE": true,
+	"OPTIONS": true, "PATCH": true, "CONNECT": true, "TRACE": true,
+}
+
+const (
+	// httpMaxPathLen is the longest request path indexed.
+	httpMaxPathLen = 255
+	// httpMaxMethodLen is the length of the longest of httpMethods.
+	httpMaxMethodLen = 7
+)
+
+// addHTTP indexes the host a plaintext HTTP request is for, and if the Builder
+// indexes HTTP requests, its method and path.  The request must start the
+// payload of the TCP header at the start of data, and only the headers within
+// that segment are read.
+func (b *Builder) addHTTP(data []byte, pos int64) {
+	off := int(data[12]>>4) * 4
+	if off < 20 || off > len(data) {
+		return
+	}
+	method, path, host := parseHTTP(data[off:])
+	if method == "" {
+		return
+	}
+	if host != nil {
+		b.add(append([]byte{keyHTTPHost}, host...), pos)
+	}
+	if !b.opts.IndexHTTPRequests {
+		return
+	}
+	b.add(append([]byte{keyHTTPMethod}, method...), pos)
+	if path != "" && len(path) <= httpMaxPathLen && printable(path) {
+		b.add(append([]byte{keyHTTPPath}, path...), pos)
+	}
+}
+
+// parseHTTP decodes the HTTP/1 request at the start of payload, returning its
+// method, the path it targets, without any query or fragment, and the host it's
+// for, in the form dnsName indexes names in.  The host is that of its Host
+// header or, lacking one, the authority of an absolute or CONNECT target.
+// The method is empty if payload doesn't start with a request line.
+func parseHTTP(payload []byte) (method, path string, host []byte) {
+	// Most payloads aren't requests, so look for a method before copying
+	// anything.
+	start := payload
+	if len(start) > httpMaxMethodLen+1 {
+		start = start[:httpMaxMethodLen+1]
+	}
+	if sp := bytes.IndexByte(start, ' '); sp < 0 || !httpMethods[string(start[:sp])] {
+		return "", "", nil
+	}
+	line, rest, ok := httpLine(payload)
+	if !ok {
+		return "", "", nil
+	}
+	parts := strings.Split(line, " ")
+	if len(parts) != 3 || !httpMethods[parts[0]] || !strings.HasPrefix(parts[2], "HTTP/1.") {
+		return "", "", nil
+	}
+	method, target := parts[0], parts[1]
+	var authority string
+	switch {
+	case method == "CONNECT":
+		authority = target
+	case strings.HasPrefix(target, "/"):
+		path = target
+	case len(target) > 7 && strings.EqualFold(target[:7], "http://"):
+		authority = target[7:]
+		path = "/"
+		if i := strings.IndexByte(authority, '/'); i >= 0 {
+			authority, path = authority[:i], authority[i:]
+		}
+	}
+	if i := strings.IndexAny(path, "?#"); i >= 0 {
+		path = path[:i]
+	}
+	for {
+		if line, rest, ok = httpLine(rest); !ok || line == "" {
+			break
+		}
+		if i := strings.IndexByte(line, ':'); i > 0 && strings.EqualFold(line[:i], "host") {
+			authority = strings.Trim(line[i+1:], " \t")
+			break
+		}
+	}
+	return method, path, httpHost(authority)
+}
+
+// httpLine returns the line at the start of data, without its line ending, and
+// what follows it.  'ok' is false if data holds no whole line.
+func httpLine(data []byte) (line string, rest []byte, ok bool) {
+	i := bytes.IndexByte(data, '\n')
+	if i < 0 {
+		return "", nil, false
+	}
+	return strings.TrimSuffix(string(data[:i]), "\r"), data[i+1:], true
+}
+
+// httpHost returns the host of an authority, without its port, in the form
+// dnsName indexes names in, or nil if it isn't a valid host name.  IPv6
+// addresses aren't indexed.
+func httpHost(authority string) []byte {
+	if i := strings.LastIndexByte(authority, ':'); i >= 0 {
+		authority = authority[:i]
+	}
+	if authority == "" || len(authority) > dnsMaxNameLen || authority[0] == '[' || !printable(authority) {
+		return nil
+	}
+	if host := dnsIndexName(authority); len(host) > 0 {
+		return host
+	}
+	return nil
+}
+
+// printable returns whether s is all printable ASCII, without spaces.
+func printable(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] <= ' ' || s[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
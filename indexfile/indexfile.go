@@ -18,16 +18,25 @@ package indexfile
 
 import (
 	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/golang/leveldb/table"
+	"github.com/golang/leveldb/db"
 	"github.com/google/stenographer/base"
+	"github.com/google/stenographer/cryptfile"
 	"github.com/google/stenographer/filecache"
+	"github.com/google/stenographer/indextable"
 	"github.com/google/stenographer/stats"
 	"golang.org/x/net/context"
 )
@@ -37,6 +46,7 @@ var (
 	indexReadNanos    = stats.S.Get("indexfile_read_nanos")
 	indexReads        = stats.S.Get("indexfile_reads")
 	indexCurrentReads = stats.S.Get("indexfile_current_reads")
+	indexFilterSkips  = stats.S.Get("indexfile_ip_filter_skips")
 )
 
 // Major version number of the file format that we support.
@@ -44,8 +54,25 @@ const majorVersionNumber = 2
 
 // IndexFile wraps a stenotype index, allowing it to be queried.
 type IndexFile struct {
-	name string
-	ss   *table.Reader
+	name   string
+	ss     indextable.Reader
+	minor  uint32   // Minor file format version
+	filter ipFilter // Nil if the index has none
+	// keyTypes and customTypes are the key types the index holds, read by
+	// heldKeyTypes.
+	keyTypesOnce sync.Once
+	keyTypes     keyTypeSet
+	customTypes  map[string]bool
+	// stats holds a *Stats once Stats has read them, while statsMu is held
+	// reading them.  recorded holds those the index recorded, if any, read
+	// by recordedStats.
+	statsMu      sync.Mutex
+	stats        atomic.Value
+	recordedOnce sync.Once
+	recorded     *Stats
+	// cache, if set by SetCacheSize, holds recent lookups' positions.
+	cacheMu sync.Mutex
+	cache   *postingsCache
 }
 
 // IndexPathFromBlockfilePath returns the path to an index file based on the path to a
@@ -62,9 +89,29 @@ func BlockfilePathFromIndexPath(p string) string {
 
 // NewIndexFile returns a new handle to the named index file.
 func NewIndexFile(filename string, fc *filecache.Cache) (*IndexFile, error) {
+	return NewIndexFileWithKeys(filename, fc, nil)
+}
+
+// NewIndexFileWithKeys acts like NewIndexFile, but can also open index files
+// encrypted by cryptfile, getting their keys from 'keys'.
+func NewIndexFileWithKeys(filename string, fc *filecache.Cache, keys *cryptfile.Keyring) (*IndexFile, error) {
 	v(1, "opening index %q", filename)
-	ss := table.NewReader(fc.Open(filename), nil)
-	if versions, err := ss.Get([]byte{0}, nil); err != nil {
+	f, err := openIndex(filename, fc, keys)
+	if err != nil {
+		return nil, fmt.Errorf("could not open index file %q: %v", filename, err)
+	}
+	return newIndexFile(filename, f)
+}
+
+// newIndexFile returns a handle to the index table in f, named 'filename'.
+func newIndexFile(filename string, f db.File) (*IndexFile, error) {
+	ss, err := indextable.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("invalid index file %q: %v", filename, err)
+	}
+	var minorVersion uint32
+	if versions, err := ss.Get([]byte{0}); err != nil {
 		return nil, fmt.Errorf("invalid index file %q missing versions record: %v", filename, err)
 	} else if len(versions) != 8 {
 		return nil, fmt.Errorf("invalid index file %q invalid versions record: %v", filename, versions)
@@ -72,45 +119,169 @@ func NewIndexFile(filename string, fc *filecache.Cache) (*IndexFile, error) {
 		return nil, fmt.Errorf("invalid index file %q: version mismatch, want %d got %d", filename, majorVersionNumber, major)
 	} else {
 		v(3, "index file %q has file format version %d:%d", filename, major, minor)
+		minorVersion = minor
 	}
 	if *base.VerboseLogging >= 10 {
-		iter := ss.Find([]byte{}, nil)
+		iter := ss.Find([]byte{})
 		v(4, "=== %q ===", filename)
 		for iter.Next() {
 			v(4, "  %v", iter.Key())
 		}
 		v(4, "  ERR: %v", iter.Close())
 	}
-	index := &IndexFile{ss: ss, name: filename}
+	index := &IndexFile{ss: ss, name: filename, minor: minorVersion}
+	// Kept in memory, so lookups it rules out never touch the table.
+	if filter, err := ss.Get([]byte{keyIPFilter}); err == nil {
+		index.filter = append(ipFilter(nil), filter...)
+	} else if err != indextable.ErrNotFound {
+		return nil, fmt.Errorf("invalid index file %q: could not read IP filter: %v", filename, err)
+	}
 	return index, nil
 }
 
+// openIndex opens the named index file, decrypting it if necessary.
+func openIndex(filename string, fc *filecache.Cache, keys *cryptfile.Keyring) (db.File, error) {
+	f := fc.Open(filename)
+	encrypted, err := cryptfile.IsEncrypted(f)
+	if err != nil || !encrypted {
+		if err != nil {
+			f.Close()
+		}
+		return f, err
+	}
+	s, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	r, err := cryptfile.NewReader(f, s.Size(), keys)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &decryptedFile{CachedFile: f, r: r}, nil
+}
+
+// decryptedFile presents the plaintext of an encrypted index to the table
+// reader, which only needs ReadAt and Stat.
+type decryptedFile struct {
+	*filecache.CachedFile
+	r *cryptfile.Reader
+}
+
+func (d *decryptedFile) ReadAt(p []byte, off int64) (int, error) {
+	return d.r.ReadAt(p, off)
+}
+
+func (d *decryptedFile) Read(p []byte) (int, error) {
+	return 0, errors.New("encrypted index files only support ReadAt")
+}
+
+func (d *decryptedFile) Stat() (os.FileInfo, error) {
+	s, err := d.CachedFile.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return plaintextInfo{s, d.r.Size()}, nil
+}
+
+// plaintextInfo reports an encrypted file's plaintext size, or the size of a
+// memFile.
+type plaintextInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (p plaintextInfo) Size() int64 { return p.size }
+
 // Name returns the name of the file underlying this index.
 func (i *IndexFile) Name() string {
 	return i.name
 }
 
+// Writer returns the software which wrote the index, and the index's format
+// version, like "stenotype 1.2.3 (index format 2.5)".  Indexes written before
+// writers were recorded were all stenotype's.
+func (i *IndexFile) Writer() string {
+	writer, err := i.ss.Get([]byte{keyWriter})
+	if err != nil {
+		writer = []byte("stenotype")
+	}
+	return fmt.Sprintf("%s (index format %d.%d)", writer, majorVersionNumber, i.minor)
+}
+
 // IPPositions returns the positions in the block file of all packets with IPs
 // between the given ranges.  Both IPs must be 4 or 16 bytes long, both must be
 // the same length, and from must be <= to.
 func (i *IndexFile) IPPositions(ctx context.Context, from, to net.IP) (base.Positions, error) {
-	var version byte
+	return i.ipPositions(ctx, outer, from, to)
+}
+
+// InnerIPPositions is like IPPositions, but finds packets tunneled within
+// others (by GRE, VXLAN, Geneve or IP-in-IP) with inner IPs between the given
+// ranges.  Indexes written before tunnels were decoded may not hold inner
+// IPs, and return ErrNotIndexed.
+func (i *IndexFile) InnerIPPositions(ctx context.Context, from, to net.IP) (base.Positions, error) {
+	return i.ipPositions(ctx, inner, from, to)
+}
+
+func (i *IndexFile) ipPositions(ctx context.Context, h header, from, to net.IP) (base.Positions, error) {
+	var key byte
 	switch {
 	case len(from) != len(to):
 		return nil, fmt.Errorf("IP length mismatch")
 	case bytes.Compare(from, to) > 0:
 		return nil, fmt.Errorf("from IP greater than to IP")
 	case len(from) == 16:
-		version = 6
+		key = h.ipv6
 	case len(from) == 4:
-		version = 4
+		key = h.ipv4
 	default:
 		return nil, fmt.Errorf("Invalid IP length")
 	}
+	if !i.holds(key) {
+		return nil, notIndexed(ctx, key)
+	}
+	if !i.filter.mayHoldRange(key, from, to) {
+		indexFilterSkips.Increment()
+		return nil, nil
+	}
 	return i.positions(
 		ctx,
-		append([]byte{version}, []byte(from)...),
-		append([]byte{version}, []byte(to)...))
+		append([]byte{key}, []byte(from)...),
+		append([]byte{key}, []byte(to)...))
+}
+
+// IPNetPositions returns the positions in the block file of all packets with
+// IPs in the given network, IPv4 or IPv6.  Since index keys sort by IP, the
+// network's addresses are a contiguous run of keys, read in a single scan.
+// The network's mask must be a prefix, as CIDR notation gives.
+func (i *IndexFile) IPNetPositions(ctx context.Context, n *net.IPNet) (base.Positions, error) {
+	return i.ipNetPositions(ctx, outer, n)
+}
+
+// InnerIPNetPositions is like IPNetPositions, but for the inner IPs of
+// tunneled packets, as InnerIPPositions.
+func (i *IndexFile) InnerIPNetPositions(ctx context.Context, n *net.IPNet) (base.Positions, error) {
+	return i.ipNetPositions(ctx, inner, n)
+}
+
+func (i *IndexFile) ipNetPositions(ctx context.Context, h header, n *net.IPNet) (base.Positions, error) {
+	ip := n.IP
+	if ip4 := ip.To4(); ip4 != nil && len(n.Mask) == net.IPv4len {
+		ip = ip4
+	}
+	if len(ip) != len(n.Mask) {
+		return nil, fmt.Errorf("IP %v doesn't match mask %v", n.IP, n.Mask)
+	} else if _, bits := n.Mask.Size(); bits == 0 {
+		return nil, fmt.Errorf("mask %v isn't a prefix", n.Mask)
+	}
+	from, to := make(net.IP, len(ip)), make(net.IP, len(ip))
+	for j := range ip {
+		from[j] = ip[j] & n.Mask[j]
+		to[j] = ip[j] | ^n.Mask[j]
+	}
+	return i.ipPositions(ctx, h, from, to)
 }
 
 // ProtoPositions returns the positions in the block file of all packets with
@@ -122,10 +293,64 @@ func (i *IndexFile) ProtoPositions(ctx context.Context, proto byte) (base.Positi
 // PortPositions returns the positions in the block file of all packets with
 // the give port number (TCP or UDP).
 func (i *IndexFile) PortPositions(ctx context.Context, port uint16) (base.Positions, error) {
-	var buf [3]byte
-	binary.BigEndian.PutUint16(buf[1:], port)
-	buf[0] = 2
-	return i.positionsSingleKey(ctx, buf[:])
+	return i.portRangePositions(ctx, outer, port, port)
+}
+
+// InnerPortPositions is like PortPositions, but for the inner ports of
+// tunneled packets, as InnerIPPositions.
+func (i *IndexFile) InnerPortPositions(ctx context.Context, port uint16) (base.Positions, error) {
+	return i.portRangePositions(ctx, inner, port, port)
+}
+
+// PortRangePositions returns the positions in the block file of all packets
+// with a port number (TCP or UDP) in [from, to], read in a single scan over
+// the index's port keys.
+func (i *IndexFile) PortRangePositions(ctx context.Context, from, to uint16) (base.Positions, error) {
+	return i.portRangePositions(ctx, outer, from, to)
+}
+
+// InnerPortRangePositions is like PortRangePositions, but for the inner ports
+// of tunneled packets, as InnerIPPositions.
+func (i *IndexFile) InnerPortRangePositions(ctx context.Context, from, to uint16) (base.Positions, error) {
+	return i.portRangePositions(ctx, inner, from, to)
+}
+
+func (i *IndexFile) portRangePositions(ctx context.Context, h header, from, to uint16) (base.Positions, error) {
+	if from > to {
+		return nil, fmt.Errorf("from port greater than to port")
+	}
+	var start, end [3]byte
+	binary.BigEndian.PutUint16(start[1:], from)
+	binary.BigEndian.PutUint16(end[1:], to)
+	start[0], end[0] = h.port, h.port
+	return i.positions(ctx, start[:], end[:])
+}
+
+// ProtoPortRangePositions returns the positions in the block file of all
+// packets with the given IP protocol (TCP or UDP) and a port number in [from,
+// to].  Indexes with protocol+port keys read them in a single scan; older ones
+// intersect the protocol's positions with those of the ports.
+func (i *IndexFile) ProtoPortRangePositions(ctx context.Context, proto byte, from, to uint16) (base.Positions, error) {
+	if from > to {
+		return nil, fmt.Errorf("from port greater than to port")
+	}
+	if !i.holds(keyProtoPort) {
+		protos, err := i.ProtoPositions(ctx, proto)
+		if err != nil || len(protos) == 0 {
+			return nil, err
+		}
+		ports, err := i.PortRangePositions(ctx, from, to)
+		if err != nil {
+			return nil, err
+		}
+		return protos.Intersect(ports), nil
+	}
+	var start, end [4]byte
+	start[0], start[1] = keyProtoPort, proto
+	end[0], end[1] = keyProtoPort, proto
+	binary.BigEndian.PutUint16(start[2:], from)
+	binary.BigEndian.PutUint16(end[2:], to)
+	return i.positions(ctx, start[:], end[:])
 }
 
 // VLANPositions returns the positions in the block file of all packets with
@@ -137,6 +362,12 @@ func (i *IndexFile) VLANPositions(ctx context.Context, port uint16) (base.Positi
 	return i.positionsSingleKey(ctx, buf[:])
 }
 
+// TaggedPositions returns the positions in the block file of all packets with
+// any VLAN tag, read in a single scan over the index's VLAN keys.
+func (i *IndexFile) TaggedPositions(ctx context.Context) (base.Positions, error) {
+	return i.positions(ctx, []byte{keyVLAN, 0, 0}, []byte{keyVLAN, 0xff, 0xff})
+}
+
 // MPLSPositions returns the positions in the block file of all packets with
 // the given MPLS number.
 func (i *IndexFile) MPLSPositions(ctx context.Context, mpls uint32) (base.Positions, error) {
@@ -146,53 +377,416 @@ func (i *IndexFile) MPLSPositions(ctx context.Context, mpls uint32) (base.Positi
 	return i.positionsSingleKey(ctx, buf[:])
 }
 
+// MACPositions returns the positions in the block file of all packets with
+// the given ethernet source or destination address.  Only indexes written
+// with MACs indexed (see BuilderOptions) hold them, so others return
+// ErrNotIndexed.
+func (i *IndexFile) MACPositions(ctx context.Context, mac net.HardwareAddr) (base.Positions, error) {
+	if len(mac) != 6 {
+		return nil, fmt.Errorf("invalid MAC length")
+	}
+	return i.positionsSingleKey(ctx, append([]byte{keyMAC}, mac...))
+}
+
+// TCPFlagsPositions returns the positions in the block file of all TCP
+// packets with every flag in 'set' set and every flag in 'clear' clear, like
+// SYN set and ACK clear for connection attempts.  Flags are the bits of the
+// TCP header's 14th byte (FIN is 0x01, SYN 0x02, and so on).  Only indexes
+// written with TCP flags indexed (see BuilderOptions) hold them, so others
+// return ErrNotIndexed.
+func (i *IndexFile) TCPFlagsPositions(ctx context.Context, set, clear byte) (base.Positions, error) {
+	if set&clear != 0 {
+		return nil, fmt.Errorf("flags %#02x both set and clear", set&clear)
+	}
+	// Every combination of flags is its own key, so read all those that
+	// match in a single scan.
+	return i.positionsMatching(ctx, []byte{keyTCPFlags, 0}, []byte{keyTCPFlags, 0xff}, func(key []byte) bool {
+		return key[1]&set == set && key[1]&clear == 0
+	})
+}
+
+// LengthPositions returns the positions in the block file of all packets in
+// length buckets overlapping [min, max], so they include all packets with
+// lengths in that range, and maybe others in the buckets at either end, which
+// should be filtered out by their actual lengths.  Only indexes written with
+// lengths indexed (see BuilderOptions) hold them, so others return
+// ErrNotIndexed.
+func (i *IndexFile) LengthPositions(ctx context.Context, min, max int) (base.Positions, error) {
+	// Longer packets are in the last bucket, which ends at MaxLength, so
+	// bounds past it are clamped first: "len > 65535" wants that bucket.
+	if min > MaxLength {
+		min = MaxLength
+	}
+	if max > MaxLength {
+		max = MaxLength
+	}
+	if min > max {
+		return nil, fmt.Errorf("min length greater than max length")
+	}
+	// Keys sort by their buckets' lower bounds, so the scan stops at the
+	// first bucket starting past max.
+	to := []byte{keyLength, byte(max >> 8), byte(max), 0xff, 0xff}
+	return i.positionsMatching(ctx, []byte{keyLength, 0, 0, 0, 0}, to, func(key []byte) bool {
+		return len(key) == 5 && int(binary.BigEndian.Uint16(key[3:])) >= min
+	})
+}
+
+// DNSNamePositions returns the positions in the block file of all DNS
+// messages asking about 'name', a dotted domain name, or if subdomains is set,
+// about any name under it instead.  Names are matched regardless of case.
+// Only indexes of minor version 2 on hold names, so others return
+// ErrNotIndexed.
+func (i *IndexFile) DNSNamePositions(ctx context.Context, name string, subdomains bool) (base.Positions, error) {
+	return i.namePositions(ctx, keyDNSName, name, subdomains)
+}
+
+// TLSServerNamePositions returns the positions in the block file of all TLS
+// ClientHellos asking for the server 'name', or any name under it if
+// subdomains is set, matched like DNSNamePositions matches names.  Only
+// indexes of minor version 3 on hold server names, so others return
+// ErrNotIndexed.
+func (i *IndexFile) TLSServerNamePositions(ctx context.Context, name string, subdomains bool) (base.Positions, error) {
+	return i.namePositions(ctx, keyTLSServerName, name, subdomains)
+}
+
+// HTTPHostPositions returns the positions in the block file of all plaintext
+// HTTP requests for the host 'name', or any name under it if subdomains is
+// set, matched like DNSNamePositions matches names.  Only indexes of minor
+// version 4 on hold hosts, so others return ErrNotIndexed.
+func (i *IndexFile) HTTPHostPositions(ctx context.Context, name string, subdomains bool) (base.Positions, error) {
+	return i.namePositions(ctx, keyHTTPHost, name, subdomains)
+}
+
+// HTTPMethodPositions returns the positions in the block file of all
+// plaintext HTTP requests with the given method, like "POST".  Only indexes
+// written with HTTP requests indexed (see BuilderOptions) hold them, so
+// others return ErrNotIndexed.
+func (i *IndexFile) HTTPMethodPositions(ctx context.Context, method string) (base.Positions, error) {
+	return i.positionsSingleKey(ctx, append([]byte{keyHTTPMethod}, method...))
+}
+
+// HTTPPathPositions returns the positions in the block file of all plaintext
+// HTTP requests for 'path', without any query, or if prefix is set, for any
+// path starting with it.  Like HTTPMethodPositions, only some indexes hold
+// them.
+func (i *IndexFile) HTTPPathPositions(ctx context.Context, path string, prefix bool) (base.Positions, error) {
+	key := append([]byte{keyHTTPPath}, path...)
+	exact, err := i.positionsSingleKey(ctx, key)
+	if err != nil || !prefix {
+		return exact, err
+	}
+	// Indexed paths are printable ASCII, so all the longer ones starting
+	// with path sort between these.
+	from := append(append([]byte{}, key...), 0)
+	to := append(append([]byte{}, key...), 0xff)
+	longer, err := i.positions(ctx, from, to)
+	if err != nil {
+		return nil, err
+	}
+	return exact.Union(longer), nil
+}
+
+// CommunityIDPositions returns the positions in the block file of all packets
+// of the flow whose Community ID encodes the given SHA-1 hash.  Only indexes
+// written with Community IDs indexed (see BuilderOptions) hold them, so
+// others return ErrNotIndexed.
+func (i *IndexFile) CommunityIDPositions(ctx context.Context, hash [sha1.Size]byte) (base.Positions, error) {
+	return i.positionsSingleKey(ctx, append([]byte{keyCommunityID}, hash[:]...))
+}
+
+// namePositions returns the positions of the packets with the given type of
+// key holding 'name', or if subdomains is set, any name under it.
+func (i *IndexFile) namePositions(ctx context.Context, typ byte, name string, subdomains bool) (base.Positions, error) {
+	key := append([]byte{typ}, dnsIndexName(name)...)
+	if !subdomains {
+		return i.positionsSingleKey(ctx, key)
+	}
+	from, to := subdomainRange(key)
+	return i.positions(ctx, from, to)
+}
+
+// JA3Positions returns the positions in the block file of all TLS
+// ClientHellos whose JA3 fingerprint has the given MD5 hash.  Only indexes of
+// minor version 3 on hold them, so others return ErrNotIndexed.
+func (i *IndexFile) JA3Positions(ctx context.Context, hash [md5.Size]byte) (base.Positions, error) {
+	return i.positionsSingleKey(ctx, append([]byte{keyJA3}, hash[:]...))
+}
+
+// JA3SPositions is like JA3Positions, for ServerHellos and their JA3S
+// fingerprints.
+func (i *IndexFile) JA3SPositions(ctx context.Context, hash [md5.Size]byte) (base.Positions, error) {
+	return i.positionsSingleKey(ctx, append([]byte{keyJA3S}, hash[:]...))
+}
+
+// DNSAnswers returns the addresses DNS responses gave for the names
+// DNSNamePositions would match.  Only indexes written with DNS answers indexed
+// (see BuilderOptions) hold them, so others return none.
+func (i *IndexFile) DNSAnswers(ctx context.Context, name string, subdomains bool) ([]net.IP, error) {
+	key := append([]byte{keyDNSAnswer}, dnsIndexName(name)...)
+	from, to := subdomainRange(key)
+	if !subdomains {
+		// The name is followed by a zero byte, then each address.
+		from[len(key)], to[len(key)] = 0, 1
+	}
+	var out []net.IP
+	iter := i.ss.Find(from)
+	for iter.Next() && !base.ContextDone(ctx) {
+		key := iter.Key()
+		if bytes.Compare(key, to) >= 0 {
+			break
+		}
+		if sep := bytes.IndexByte(key, 0); sep > 0 {
+			if ip := key[sep+1:]; len(ip) == 4 || len(ip) == 16 {
+				out = append(out, append(net.IP{}, ip...))
+			}
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return out, ctx.Err()
+}
+
+// subdomainRange returns the range of keys holding the subdomains of the name
+// in 'key', which all follow it with a dot.
+func subdomainRange(key []byte) (from, to []byte) {
+	from = append(append([]byte{}, key...), '.')
+	to = append(append([]byte{}, key...), '.'+1)
+	return from, to
+}
+
+// LabeledPositions returns the positions in the block file of all packets with
+// any MPLS label, read in a single scan over the index's MPLS keys.
+func (i *IndexFile) LabeledPositions(ctx context.Context) (base.Positions, error) {
+	return i.positions(ctx, []byte{keyMPLS, 0, 0, 0, 0}, []byte{keyMPLS, 0xff, 0xff, 0xff, 0xff})
+}
+
+// ProtocolCounts returns how many packets the index holds of each IP
+// protocol.  Packets which aren't IP aren't counted.
+func (i *IndexFile) ProtocolCounts(ctx context.Context) (map[byte]int, error) {
+	out := map[byte]int{}
+	iter := i.ss.Find([]byte{keyProtocol})
+	for iter.Next() && !base.ContextDone(ctx) {
+		key := iter.Key()
+		if len(key) != 2 || key[0] != keyProtocol {
+			break
+		}
+		// Positions are packed 4 bytes apiece.
+		out[key[1]] = len(iter.Value()) / 4
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return out, ctx.Err()
+}
+
+// holdsPositions returns whether the value of key is a list of positions,
+// rather than a record about the whole index.
+func holdsPositions(key []byte) bool {
+	return len(key) > 0 && key[0] != keyVersion && key[0] != keyTimeRange && key[0] != keyIPFilter && key[0] != keyKeyTypes && key[0] != keyCustomTypes && key[0] != keyStats && key[0] != keyWriter
+}
+
+// IndexedPositions returns the positions of every packet the index refers
+// to, under any key, failing if any key's positions can't be decoded.
+func (i *IndexFile) IndexedPositions(ctx context.Context) (base.Positions, error) {
+	set := &base.PositionSet{}
+	iter := i.ss.Find([]byte{})
+	for iter.Next() && !base.ContextDone(ctx) {
+		key := iter.Key()
+		if !holdsPositions(key) {
+			continue
+		}
+		current, err := base.ReadIndexPositions(bytes.NewReader(iter.Value()))
+		if err != nil {
+			iter.Close()
+			return nil, fmt.Errorf("invalid positions for key %x: %v", key, err)
+		}
+		set.Union(base.NewPositionSet(current))
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return set.Positions(), nil
+}
+
+// TimeRange returns the times of the earliest and latest packets in the
+// index's blockfile, if the index records them (see Builder.SetTimeRange).
+func (i *IndexFile) TimeRange() (first, last time.Time, ok bool, _ error) {
+	times, err := i.ss.Get([]byte{keyTimeRange})
+	if err == indextable.ErrNotFound {
+		return first, last, false, nil
+	} else if err != nil {
+		return first, last, false, err
+	} else if len(times) != 16 {
+		return first, last, false, fmt.Errorf("invalid time range record %x", times)
+	}
+	first = time.Unix(0, int64(binary.BigEndian.Uint64(times)))
+	last = time.Unix(0, int64(binary.BigEndian.Uint64(times[8:])))
+	return first, last, true, nil
+}
+
+// WriteFiltered writes a copy of the index to a new file with the given name,
+// keeping only the positions for which 'keep' returns true.  Keys left with
+// no positions are dropped.  The version and time range are copied as they
+// are, so the time range may end up wider than the packets left.
+func (i *IndexFile) WriteFiltered(ctx context.Context, filename string, keep func(pos int64) bool) error {
+	f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if err := i.writeFiltered(ctx, syncOnClose{f}, keep); err != nil {
+		os.Remove(filename)
+		return fmt.Errorf("could not write filtered index %q: %v", filename, err)
+	}
+	return nil
+}
+
+// writeFiltered writes the filtered index table to f, then closes it.
+func (i *IndexFile) writeFiltered(ctx context.Context, f db.File, keep func(pos int64) bool) error {
+	w := indextable.NewWriter(f)
+	var value bytes.Buffer
+	iter := i.ss.Find([]byte{})
+	for iter.Next() && !base.ContextDone(ctx) {
+		key, val := iter.Key(), iter.Value()
+		if holdsPositions(key) {
+			positions, err := base.ReadIndexPositions(bytes.NewReader(val))
+			if err != nil {
+				iter.Close()
+				w.Close()
+				return fmt.Errorf("invalid positions for key %x: %v", key, err)
+			}
+			kept := positions[:0]
+			for _, pos := range positions {
+				if keep(pos) {
+					kept = append(kept, pos)
+				}
+			}
+			if len(kept) == 0 {
+				continue
+			}
+			value.Reset()
+			if err := base.WriteIndexPositions(&value, kept); err != nil {
+				iter.Close()
+				w.Close()
+				return fmt.Errorf("key %x: %v", key, err)
+			}
+			val = value.Bytes()
+		}
+		if err := w.Set(key, val); err != nil {
+			iter.Close()
+			w.Close()
+			return err
+		}
+	}
+	if err := iter.Close(); err != nil {
+		w.Close()
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
 // Dump writes out a debug version of the entire index to the given writer.
 func (i *IndexFile) Dump(out io.Writer, start, finish []byte) {
-	for iter := i.ss.Find(start, nil); iter.Next() && bytes.Compare(iter.Key(), finish) <= 0; {
+	for iter := i.ss.Find(start); iter.Next() && bytes.Compare(iter.Key(), finish) <= 0; {
 		fmt.Fprintf(out, "%v\n", hex.EncodeToString(iter.Key()))
 	}
 }
 
+// positionSize is the memory used by each position in base.Positions.
+const positionSize = 8
+
 // positions returns a set of positions to look for packets, based on a
 // lookup of all blockfile positions stored between (inclusively) index
 // keys 'from' and 'to'.
-func (i *IndexFile) positions(ctx context.Context, from, to []byte) (out base.Positions, _ error) {
+func (i *IndexFile) positions(ctx context.Context, from, to []byte) (base.Positions, error) {
+	return i.positionsMatching(ctx, from, to, nil)
+}
+
+// positionsMatching is like positions, but only reads the positions of the
+// keys for which 'match' returns true, if it's non-nil.  Keys of types the
+// index doesn't hold can't be looked up, and give ErrNotIndexed.  Custom keys'
+// types are checked by CustomKeyPositions instead.
+func (i *IndexFile) positionsMatching(ctx context.Context, from, to []byte, match func(key []byte) bool) (out base.Positions, _ error) {
+	if len(from) > 0 && from[0] != keyCustom && !i.holds(from[0]) {
+		return nil, notIndexed(ctx, from[0])
+	}
 	v(4, "%q multi key iterator %v:%v start", i.name, from, to)
 	if len(from) != len(to) {
 		return nil, fmt.Errorf("invalid from/to lengths don't match: %v %v", from, to)
 	}
+	// Positions count against the lookup's memory budget before they're
+	// read, so a lookup too broad to fit fails before it's built.
+	budget := base.MemoryBudgetFromContext(ctx)
+	cache := i.lookupCache()
+	if match != nil {
+		cache = nil
+	} else if cache != nil {
+		if cached, ok := cache.get(from, to); ok {
+			v(4, "%q multi key iterator %v:%v cached, got %d", i.name, from, to, len(cached))
+			if err := budget.Reserve(int64(len(cached)) * positionSize); err != nil {
+				return nil, err
+			}
+			return cached, nil
+		}
+	}
 	indexCurrentReads.Increment()
 	defer func() {
 		indexCurrentReads.IncrementBy(-1)
 		indexReads.Increment()
 	}()
 	defer indexReadNanos.NanoTimer()()
-	iter := i.ss.Find(from, nil)
+	// Accumulate in a PositionSet, so broad ranges covering many keys don't
+	// allocate a new merged slice for every key.
+	var set *base.PositionSet
+	iter := i.ss.Find(from)
 	for iter.Next() && !base.ContextDone(ctx) {
 		if to != nil && bytes.Compare(iter.Key(), to) > 0 {
 			v(4, "%q multi key iterator %v:%v hit limit with %v", i.name, from, to, iter.Key())
 			break
 		}
-		current := make(base.Positions, len(iter.Value())/4)
-		for i := 0; i < len(iter.Value()); i += 4 {
-			current[i/4] = int64(binary.BigEndian.Uint32(iter.Value()[i : i+4]))
+		if match != nil && !match(iter.Key()) {
+			continue
+		}
+		// Each position is stored in 4 bytes, so they're reserved before
+		// they're decoded.
+		if err := budget.Reserve(int64(len(iter.Value())/4) * positionSize); err != nil {
+			iter.Close()
+			return nil, err
+		}
+		current, err := base.ReadIndexPositions(bytes.NewReader(iter.Value()))
+		if err != nil {
+			iter.Close()
+			return nil, fmt.Errorf("invalid positions for key %v: %v", iter.Key(), err)
 		}
 		v(4, "%q multi key iterator got in-iter union of length %d for %v", i.name, len(current), iter.Key())
-		if out == nil {
-			out = current
+		if set == nil {
+			set = base.NewPositionSet(current)
 		} else {
-			out = out.Union(current)
+			set.Union(base.NewPositionSet(current))
 		}
 	}
 	if err := ctx.Err(); err != nil {
 		v(4, "%q multi key iterator context err: %v", i.name, err)
 		return nil, err
 	}
+	if set != nil {
+		out = set.Positions()
+	}
 	v(4, "%q multi key iterator done, got %d", i.name, len(out))
 	if err := iter.Close(); err != nil {
 		v(4, "%q multi key iterator err=%v", i.name, err)
 		return nil, err
 	}
+	if cache != nil {
+		cache.put(from, to, out)
+	}
 	return out, nil
 }
 func (i *IndexFile) positionsSingleKey(ctx context.Context, key []byte) (base.Positions, error) {
@@ -212,5 +806,6 @@ func parseIP(in string) net.IP {
 
 // Close the indexfile.
 func (i *IndexFile) Close() error {
+	i.SetCacheSize(0)
 	return i.ss.Close()
 }
@@ -17,6 +17,8 @@ package indexfile
 import (
 	"bytes"
 	"encoding/hex"
+	"net"
+	"path/filepath"
 	"reflect"
 	"testing"
 
@@ -55,6 +57,35 @@ func TestIPPositions(t *testing.T) {
 	}
 }
 
+func TestIPNetPositions(t *testing.T) {
+	idx := testIndexFile(t, "../testdata/IDX0/dhcp")
+	defer idx.Close()
+	for _, test := range []struct {
+		cidr string
+		want base.Positions
+	}{
+		{"192.168.0.0/24", base.Positions{1049024, 1049848}},
+		{"192.168.0.0/16", base.Positions{1049024, 1049848}},
+		{"10.0.0.0/8", nil},
+		{"fe80::/10", base.Positions{48, 200}}, // The ICMPv6 packets
+		{"2001:db8::/32", nil},
+	} {
+		_, n, err := net.ParseCIDR(test.cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := idx.IPNetPositions(ctx, n); err != nil {
+			t.Fatal(err)
+		} else if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("wrong positions for %v.\nwant: %v\n got: %v\n", test.cidr, test.want, got)
+		}
+	}
+	bad := &net.IPNet{IP: parseIP("192.168.0.0"), Mask: net.IPv4Mask(255, 0, 255, 0)}
+	if _, err := idx.IPNetPositions(ctx, bad); err == nil {
+		t.Error("looked up a network with a non-prefix mask")
+	}
+}
+
 func TestMPLSPositions(t *testing.T) {
 	idx := testIndexFile(t, "../testdata/IDX0/mpls")
 	defer idx.Close()
@@ -73,6 +104,50 @@ func TestMPLSPositions(t *testing.T) {
 	}
 }
 
+func TestProtoPortRangePositions(t *testing.T) {
+	// Written before protocol+port keys, so these intersect protocols and ports.
+	idx := testIndexFile(t, "../testdata/IDX0/dhcp")
+	defer idx.Close()
+	for _, test := range []struct {
+		proto    byte
+		from, to uint16
+		want     base.Positions
+	}{
+		{17, 67, 67, base.Positions{1048624, 1049024, 1049448, 1049848}},
+		{17, 60, 70, base.Positions{1048624, 1049024, 1049448, 1049848}},
+		{6, 67, 67, nil},
+		{17, 80, 80, nil},
+	} {
+		if got, err := idx.ProtoPortRangePositions(ctx, test.proto, test.from, test.to); err != nil {
+			t.Fatal(err)
+		} else if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("wrong positions for proto %d ports %d-%d.\nwant: %v\n got: %v\n", test.proto, test.from, test.to, test.want, got)
+		}
+	}
+}
+
+func TestLabeledPositions(t *testing.T) {
+	idx := testIndexFile(t, "../testdata/IDX0/mpls")
+	defer idx.Close()
+	got, err := idx.LabeledPositions(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	label29, err := idx.MPLSPositions(ctx, 29)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every labeled packet in the file has label 29.
+	if !reflect.DeepEqual(got, label29) {
+		t.Errorf("wrong labeled positions.\nwant: %v\n got: %v\n", label29, got)
+	}
+	unlabeled := testIndexFile(t, "../testdata/IDX0/dhcp")
+	defer unlabeled.Close()
+	if got, err := unlabeled.LabeledPositions(ctx); err != nil || got != nil {
+		t.Errorf("unlabeled file: got %v, %v, want no positions", got, err)
+	}
+}
+
 func TestVLANPositions(t *testing.T) {
 	idx := testIndexFile(t, "../testdata/IDX0/vlan")
 	defer idx.Close()
@@ -91,6 +166,30 @@ func TestVLANPositions(t *testing.T) {
 	}
 }
 
+func TestTaggedPositions(t *testing.T) {
+	idx := testIndexFile(t, "../testdata/IDX0/vlan")
+	defer idx.Close()
+	got, err := idx.TaggedPositions(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vlan7, err := idx.VLANPositions(ctx, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 389 {
+		t.Errorf("want 389 tagged packets, got %d", len(got))
+	}
+	if !reflect.DeepEqual(got.Intersect(vlan7), vlan7) {
+		t.Errorf("tagged positions %v missing some of VLAN 7's %v", got, vlan7)
+	}
+	untagged := testIndexFile(t, "../testdata/IDX0/dhcp")
+	defer untagged.Close()
+	if got, err := untagged.TaggedPositions(ctx); err != nil || got != nil {
+		t.Errorf("untagged file: got %v, %v, want no positions", got, err)
+	}
+}
+
 func TestProtoPositions(t *testing.T) {
 	idx := testIndexFile(t, "../testdata/IDX0/dhcp")
 	defer idx.Close()
@@ -109,6 +208,17 @@ func TestProtoPositions(t *testing.T) {
 	}
 }
 
+func TestProtocolCounts(t *testing.T) {
+	idx := testIndexFile(t, "../testdata/IDX0/dhcp")
+	defer idx.Close()
+	want := map[byte]int{'\x11': 4, '\x3a': 2}
+	if got, err := idx.ProtocolCounts(ctx); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(got, want) {
+		t.Errorf("wrong protocol counts.\nwant: %v\n got: %v\n", want, got)
+	}
+}
+
 func TestPortPositions(t *testing.T) {
 	idx := testIndexFile(t, "../testdata/IDX0/dhcp")
 	defer idx.Close()
@@ -127,6 +237,57 @@ func TestPortPositions(t *testing.T) {
 	}
 }
 
+func TestPortRangePositions(t *testing.T) {
+	idx := testIndexFile(t, "../testdata/IDX0/dhcp")
+	defer idx.Close()
+	dhcp := base.Positions{1048624, 1049024, 1049448, 1049848}
+	for _, test := range []struct {
+		from, to uint16
+		want     base.Positions
+	}{
+		{60, 70, dhcp}, // Both 67 and 68
+		{67, 67, dhcp},
+		{69, 100, nil},
+		{0, 65535, dhcp},
+	} {
+		if got, err := idx.PortRangePositions(ctx, test.from, test.to); err != nil {
+			t.Fatal(err)
+		} else if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("wrong positions for ports %d-%d.\nwant: %v\n got: %v\n", test.from, test.to, test.want, got)
+		}
+	}
+	if _, err := idx.PortRangePositions(ctx, 70, 60); err == nil {
+		t.Error("looked up a backwards port range")
+	}
+}
+
+func TestIndexPositionsFormat(t *testing.T) {
+	idx := testIndexFile(t, "../testdata/IDX0/dhcp")
+	defer idx.Close()
+	raw, err := idx.ss.Get([]byte{2, 0, 67})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := base.ReadIndexPositions(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := idx.PortPositions(ctx, 67)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("wrong positions read from raw index value.\nwant: %v\n got: %v\n", want, got)
+	}
+	var buf bytes.Buffer
+	if err := base.WriteIndexPositions(&buf, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), raw) {
+		t.Errorf("written positions don't match index.\nwant: %x\n got: %x\n", raw, buf.Bytes())
+	}
+}
+
 func TestDump(t *testing.T) {
 	idx := testIndexFile(t, "../testdata/IDX0/dhcp")
 	want := "00\n0111\n013a\n"
@@ -139,3 +300,160 @@ func TestDump(t *testing.T) {
 		t.Fatalf("invalid dump.\nwant %q\n got: %q\n", want, got)
 	}
 }
+
+func TestWriteFiltered(t *testing.T) {
+	idx := testIndexFile(t, "../testdata/IDX0/dhcp")
+	defer idx.Close()
+	path := filepath.Join(t.TempDir(), "index")
+	// Keep the first block's packets, two ICMPv6 packets.
+	if err := idx.WriteFiltered(ctx, path, func(pos int64) bool { return pos < 1<<20 }); err != nil {
+		t.Fatal(err)
+	}
+	if err := idx.WriteFiltered(ctx, path, func(int64) bool { return true }); err == nil {
+		t.Error("overwrote an existing index")
+	}
+	filtered := testIndexFile(t, path)
+	defer filtered.Close()
+	if got, err := filtered.PortPositions(ctx, 67); err != nil || len(got) != 0 {
+		t.Errorf("port 67: got %v, %v", got, err)
+	}
+	var got bytes.Buffer
+	filtered.Dump(&got, []byte{0}, []byte{0xff})
+	if want := "00\n013a\n06fe800000000000003070b6fffe116f27\n06ff020000000000000000000000000002\n"; got.String() != want {
+		t.Errorf("wrong keys.\nwant: %v\n got: %v\n", want, got.String())
+	}
+}
+
+func TestPositionsMemoryBudget(t *testing.T) {
+	idx := testIndexFile(t, "../testdata/IDX0/dhcp")
+	defer idx.Close()
+	// Port 67 matches 4 packets, at 8 bytes a position.
+	budget := base.NewMemoryBudget(32, nil)
+	if _, err := idx.PortPositions(base.WithMemoryBudget(ctx, budget), 67); err != nil {
+		t.Fatal(err)
+	}
+	if got := budget.Used(); got != 32 {
+		t.Errorf("reserved %d bytes, want 32", got)
+	}
+	budget.ReleaseAll()
+	budget = base.NewMemoryBudget(31, nil)
+	if _, err := idx.PortPositions(base.WithMemoryBudget(ctx, budget), 67); err == nil {
+		t.Error("want error exceeding memory budget")
+	} else if _, ok := err.(*base.BudgetError); !ok {
+		t.Errorf("want *base.BudgetError, got %v", err)
+	}
+}
+
+func TestStats(t *testing.T) {
+	idx := testIndexFile(t, "../testdata/IDX0/dhcp")
+	defer idx.Close()
+	if _, ok := idx.KnownStats(); ok {
+		t.Fatal("stats known before they were read")
+	}
+	s, err := idx.Stats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	protos := s.KeyTypes["protocol"]
+	want := []KeyCount{{"17", 4}, {"58", 2}}
+	if protos.Keys != 2 || protos.Positions != 6 || !reflect.DeepEqual(protos.Hottest, want) {
+		t.Errorf("wrong protocol stats.\nwant: %v\n got: %+v\n", want, protos)
+	}
+	if ports := s.KeyTypes["port"]; s.DistinctPorts != ports.Keys || ports.Keys != 2 ||
+		!reflect.DeepEqual(ports.Hottest, []KeyCount{{"67", 4}, {"68", 4}}) {
+		t.Errorf("wrong port stats: %d distinct, %+v", s.DistinctPorts, ports)
+	}
+	if s.DistinctIPs == 0 || s.DistinctIPs != s.KeyTypes["ipv4"].Keys+s.KeyTypes["ipv6"].Keys {
+		t.Errorf("wrong distinct IPs: %d, %+v", s.DistinctIPs, s.KeyTypes)
+	}
+	if _, ok := s.KeyTypes["mac"]; ok {
+		t.Errorf("stats for a key type with no keys: %+v", s.KeyTypes["mac"])
+	}
+	if got := s.Estimate("port", true); got != 4 {
+		t.Errorf("estimated %d positions for a port, want 4", got)
+	}
+	if got := s.Estimate("protocol", false); got != 6 {
+		t.Errorf("estimated %d positions for all protocols, want 6", got)
+	}
+	// Callers may change what they're given.
+	s.KeyTypes["protocol"].Hottest[0].Positions++
+	delete(s.KeyTypes, "port")
+	if known, ok := idx.KnownStats(); !ok {
+		t.Error("stats not known after they were read")
+	} else if known.KeyTypes["protocol"].Hottest[0].Positions != 4 || known.KeyTypes["port"].Keys != 2 {
+		t.Errorf("cached stats changed: %+v", known)
+	}
+}
+
+func TestCache(t *testing.T) {
+	idx := testIndexFile(t, "../testdata/IDX0/dhcp")
+	defer idx.Close()
+	dhcp := base.Positions{1048624, 1049024, 1049448, 1049848}
+	idx.SetCacheSize(1 << 20)
+	for i := 0; i < 2; i++ { // Again, from the cache.
+		if got, err := idx.PortPositions(ctx, 67); err != nil {
+			t.Fatal(err)
+		} else if !reflect.DeepEqual(got, dhcp) {
+			t.Errorf("wrong positions.\nwant: %v\n got: %v\n", dhcp, got)
+		} else {
+			got[0]++ // Callers may change what they're given.
+		}
+	}
+	if _, err := idx.PortPositions(ctx, 69); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := idx.cache.lru.Len(), 2; got != want {
+		t.Errorf("%d lookups cached, want %d", got, want)
+	}
+	// Lookups of keys matching extra conditions aren't cached.
+	if _, err := idx.positionsMatching(ctx, []byte{keyPort, 0, 0}, []byte{keyPort, 0xff, 0xff}, func([]byte) bool { return true }); err != nil {
+		t.Fatal(err)
+	}
+	if got := idx.cache.lru.Len(); got != 2 {
+		t.Errorf("%d lookups cached, want 2", got)
+	}
+	// Shrinking the cache evicts the least recently used: port 67's
+	// positions, leaving port 69's, which are none.
+	idx.SetCacheSize(idx.cache.size - 1)
+	if got := idx.cache.lru.Len(); got != 1 {
+		t.Errorf("%d lookups cached after shrinking, want 1", got)
+	}
+	if got, err := idx.PortPositions(ctx, 67); err != nil || !reflect.DeepEqual(got, dhcp) {
+		t.Errorf("got %v, %v after eviction, want %v", got, err, dhcp)
+	}
+	idx.SetCacheSize(0)
+	if idx.cache != nil {
+		t.Error("cache kept after it was turned off")
+	}
+}
+
+func TestRecordedStats(t *testing.T) {
+	// Indexes written by Builder record their stats, bar the hottest keys,
+	// so they're known without reading them.
+	stenotype := testIndexFile(t, "../testdata/IDX0/dhcp")
+	defer stenotype.Close()
+	b := NewBuilder(BuilderOptions{})
+	if err := b.AddIndex(ctx, stenotype, func(pos int64) (int64, bool) { return pos, true }); err != nil {
+		t.Fatal(err)
+	}
+	idx, err := b.Open("dhcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+	known, ok := idx.KnownStats()
+	if !ok {
+		t.Fatal("recorded stats not known")
+	}
+	s, err := idx.Stats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, kt := range s.KeyTypes {
+		kt.Hottest = nil
+		s.KeyTypes[name] = kt
+	}
+	if !reflect.DeepEqual(known, s) {
+		t.Errorf("recorded stats differ from those read.\nrecorded: %+v\n    read: %+v", known, s)
+	}
+}
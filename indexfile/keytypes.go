@@ -0,0 +1,185 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package indexfile
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/google/stenographer/indextable"
+)
+
+// Indexes record which key types they were written to hold, so a lookup
+// finding no keys of a type can tell whether no packet had one or packets
+// weren't indexed by it, as with keys added to stenographer since the index
+// was written or left out of its config.  Lookups needing keys an index
+// doesn't hold return ErrNotIndexed, and queries then find their packets by
+// reading them instead (see query.Lookup).
+
+// ErrNotIndexed is returned by lookups in indexes which weren't written to
+// hold the keys they need, and so can't say which packets match.
+var ErrNotIndexed = errors.New("index doesn't hold the keys needed")
+
+// keyTypeSet is a set of key types.
+type keyTypeSet [4]uint64
+
+func (s *keyTypeSet) add(typs ...byte) {
+	for _, typ := range typs {
+		s[typ/64] |= 1 << (typ % 64)
+	}
+}
+
+func (s keyTypeSet) has(typ byte) bool {
+	return s[typ/64]&(1<<(typ%64)) != 0
+}
+
+func (s keyTypeSet) intersect(o keyTypeSet) keyTypeSet {
+	for i := range s {
+		s[i] &= o[i]
+	}
+	return s
+}
+
+// contains returns whether s holds every key type in o.
+func (s keyTypeSet) contains(o keyTypeSet) bool {
+	return s.intersect(o) == o
+}
+
+// record returns the value of the keyKeyTypes record listing the set.
+func (s keyTypeSet) record() []byte {
+	var out []byte
+	for typ := 0; typ < 256; typ++ {
+		if s.has(byte(typ)) {
+			out = append(out, byte(typ))
+		}
+	}
+	return out
+}
+
+// builderKeyTypes returns the key types a Builder indexes packets by.
+func (b *Builder) builderKeyTypes() keyTypeSet {
+	var s keyTypeSet
+	s.add(keyProtocol, keyPort, keyVLAN, keyIPv4, keyMPLS, keyIPv6,
+		keyInnerIPv4, keyInnerIPv6, keyInnerPort, keyProtoPort, keyDNSName,
+		keyTLSServerName, keyJA3, keyJA3S, keyHTTPHost)
+	if b.opts.IndexMACs {
+		s.add(keyMAC)
+	}
+	if b.opts.IndexTCPFlags {
+		s.add(keyTCPFlags)
+	}
+	if len(b.opts.LengthBuckets) > 0 {
+		s.add(keyLength)
+	}
+	if b.opts.IndexDNSAnswers {
+		s.add(keyDNSAnswer)
+	}
+	if b.opts.IndexHTTPRequests {
+		s.add(keyHTTPMethod, keyHTTPPath)
+	}
+	if b.opts.IndexCommunityIDs {
+		s.add(keyCommunityID)
+	}
+	return s
+}
+
+// minorKeyTypes are the key types indexes have held since each minor
+// version before keyKeyTypes was added, whatever stenotype's flags.
+var minorKeyTypes = [][]byte{
+	{keyProtocol, keyPort, keyVLAN, keyIPv4, keyMPLS, keyIPv6},
+	{keyProtoPort},
+	{keyDNSName},
+	{keyTLSServerName, keyJA3, keyJA3S},
+	{keyHTTPHost},
+}
+
+// optionalKeyTypes are the key types older indexes may or may not hold, by
+// stenotype's flags or its version.
+var optionalKeyTypes = []byte{keyMAC, keyInnerIPv4, keyInnerIPv6, keyInnerPort, keyTCPFlags, keyLength, keyDNSAnswer, keyHTTPMethod, keyHTTPPath, keyCommunityID}
+
+// readKeyTypes returns the key types the index holds, from its keyKeyTypes
+// record.  Indexes from before the record are taken to hold the key types of
+// their minor version, and those optional ones they have any keys of.
+func (i *IndexFile) readKeyTypes() (keyTypeSet, error) {
+	var s keyTypeSet
+	if typs, err := i.ss.Get([]byte{keyKeyTypes}); err == nil {
+		s.add(typs...)
+		return s, nil
+	} else if err != indextable.ErrNotFound {
+		return s, fmt.Errorf("could not read key types: %v", err)
+	}
+	for minor, typs := range minorKeyTypes {
+		if uint32(minor) <= i.minor {
+			s.add(typs...)
+		}
+	}
+	for _, typ := range optionalKeyTypes {
+		iter := i.ss.Find([]byte{typ})
+		if iter.Next() && iter.Key()[0] == typ {
+			s.add(typ)
+		}
+		if err := iter.Close(); err != nil {
+			return s, err
+		}
+	}
+	return s, nil
+}
+
+// heldKeyTypes returns the key types the index holds, reading them the first
+// time they're needed, as they're only needed by some queries.  If they can't
+// be read, the index is taken to hold every type, so lookups fail as they
+// would have when it's read.  Custom key types are read along with them, but
+// if they can't be, the index is taken to hold none, and their packets are
+// read instead.
+func (i *IndexFile) heldKeyTypes() keyTypeSet {
+	i.keyTypesOnce.Do(func() {
+		var err error
+		if i.keyTypes, err = i.readKeyTypes(); err != nil {
+			v(1, "index %q: %v", i.name, err)
+			for j := range i.keyTypes {
+				i.keyTypes[j] = ^uint64(0)
+			}
+		}
+		i.customTypes = map[string]bool{}
+		if typs, err := i.ss.Get([]byte{keyCustomTypes}); err == nil {
+			i.customTypes = parseCustomTypes(typs)
+		} else if err != indextable.ErrNotFound {
+			v(1, "index %q: could not read custom key types: %v", i.name, err)
+		}
+	})
+	return i.keyTypes
+}
+
+// holds returns whether the index was written to hold keys of the given type.
+func (i *IndexFile) holds(typ byte) bool {
+	return i.heldKeyTypes().has(typ)
+}
+
+// Outdated returns whether an index written now, with the given options,
+// would hold key types this one doesn't, custom ones included, or has a newer
+// minor version, so rebuilding it would let more queries be answered from it.
+func (i *IndexFile) Outdated(opts BuilderOptions) bool {
+	b := NewBuilder(opts)
+	if i.minor < minorVersionNumber || !i.heldKeyTypes().contains(b.builderKeyTypes()) {
+		return true
+	}
+	held := i.heldCustomTypes()
+	for typ := range b.customTypes {
+		if !held[typ] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,138 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package indexfile
+
+import (
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// Queries needing keys an index doesn't hold read the packets which could
+// match instead, indexing them in memory with a scan Builder (see
+// query.Lookup).  Lookups record the key types they were missing in the
+// ScanKeys their context carries, so the scan decodes and indexes just those,
+// rather than every key type of every packet.
+
+// ScanKeys collects the key types lookups needed which their indexes didn't
+// hold.  It's safe for concurrent use.
+type ScanKeys struct {
+	mu     sync.Mutex
+	types  keyTypeSet
+	custom map[string]bool
+}
+
+// Empty returns whether no lookup has been missing keys.
+func (s *ScanKeys) Empty() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.types == keyTypeSet{} && len(s.custom) == 0
+}
+
+type scanKeysKey struct{}
+
+// WithScanKeys returns a context whose lookups record the key types they
+// need but their index doesn't hold in keys.
+func WithScanKeys(ctx context.Context, keys *ScanKeys) context.Context {
+	return context.WithValue(ctx, scanKeysKey{}, keys)
+}
+
+// notIndexed records that a lookup needed keys of type typ which its index
+// doesn't hold, in the ScanKeys ctx carries, if any, and returns
+// ErrNotIndexed.
+func notIndexed(ctx context.Context, typ byte) error {
+	if s, _ := ctx.Value(scanKeysKey{}).(*ScanKeys); s != nil {
+		s.mu.Lock()
+		s.types.add(typ)
+		s.mu.Unlock()
+	}
+	return ErrNotIndexed
+}
+
+// customNotIndexed is like notIndexed, for the named custom key type.
+func customNotIndexed(ctx context.Context, typ string) error {
+	if s, _ := ctx.Value(scanKeysKey{}).(*ScanKeys); s != nil {
+		s.mu.Lock()
+		if s.custom == nil {
+			s.custom = map[string]bool{}
+		}
+		s.custom[typ] = true
+		s.mu.Unlock()
+	}
+	return ErrNotIndexed
+}
+
+// everyLength gives each packet length its own bucket.
+var everyLength = func() []int {
+	lengths := make([]int, MaxLength)
+	for i := range lengths {
+		lengths[i] = i + 1
+	}
+	return lengths
+}()
+
+// NewScanBuilder returns an empty Builder indexing just the key types in
+// keys, exactly: lengths each get a bucket of their own.  Parts of packets
+// no such key is found in aren't decoded.  It's for indexing packets read to
+// answer queries their own index can't, with Open.
+func NewScanBuilder(keys *ScanKeys) *Builder {
+	keys.mu.Lock()
+	defer keys.mu.Unlock()
+	want := keys.types
+	opts := BuilderOptions{
+		IndexMACs:         want.has(keyMAC),
+		IndexTCPFlags:     want.has(keyTCPFlags),
+		IndexDNSAnswers:   want.has(keyDNSAnswer),
+		IndexHTTPRequests: want.has(keyHTTPMethod) || want.has(keyHTTPPath),
+		IndexCommunityIDs: want.has(keyCommunityID),
+	}
+	if want.has(keyLength) {
+		opts.LengthBuckets = everyLength
+	}
+	var indexers []*customIndexer
+	for _, idx := range allIndexers() {
+		for _, typ := range idx.keyTypes {
+			if keys.custom[typ] {
+				indexers = append(indexers, idx)
+				break
+			}
+		}
+	}
+	b := newBuilder(opts, indexers)
+	b.keyTypes = want
+	for typ := range b.customTypes {
+		if !keys.custom[typ] {
+			delete(b.customTypes, typ)
+		}
+	}
+	if len(indexers) > 0 {
+		want.add(keyCustom)
+	}
+	b.want = &want
+	return b
+}
+
+// wants returns whether the Builder indexes any of the given key types.
+func (b *Builder) wants(typs ...byte) bool {
+	if b.want == nil {
+		return true
+	}
+	for _, typ := range typs {
+		if b.want.has(typ) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,69 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package indexfile
+
+import (
+	"strings"
+)
+
+// portSIP is the port SIP is carried on unencrypted, over UDP or TCP.
+const portSIP = 5060
+
+// sipMaxCallIDLen is the longest Call-ID indexed.
+const sipMaxCallIDLen = 255
+
+// sipIndexer is the "sip" custom Indexer, indexing SIP messages by their
+// Call-ID, under "sip.callid", so all of a call's signalling can be found.
+type sipIndexer struct{}
+
+func init() {
+	RegisterIndexer("sip", []string{"sip.callid"}, sipIndexer{})
+}
+
+func (sipIndexer) Keys(p *CustomPacket) []CustomKey {
+	if p.SrcPort != portSIP && p.DstPort != portSIP {
+		return nil
+	}
+	if id := sipCallID(p.Payload); id != "" {
+		return []CustomKey{{"sip.callid", []byte(id)}}
+	}
+	return nil
+}
+
+// sipCallID returns the Call-ID of the SIP message at the start of payload,
+// from its Call-ID header or its compact form, or "" if it has none within
+// the payload.  Only the first message of a TCP segment is read.
+func sipCallID(payload []byte) string {
+	line, rest, ok := httpLine(payload)
+	if !ok || !strings.Contains(line, "SIP/2.0") {
+		return ""
+	}
+	for {
+		if line, rest, ok = httpLine(rest); !ok || line == "" {
+			return ""
+		}
+		i := strings.IndexByte(line, ':')
+		if i <= 0 {
+			continue
+		}
+		if name := strings.TrimRight(line[:i], " \t"); strings.EqualFold(name, "call-id") || strings.EqualFold(name, "i") {
+			id := strings.Trim(line[i+1:], " \t")
+			if len(id) > sipMaxCallIDLen || !printable(id) {
+				return ""
+			}
+			return id
+		}
+	}
+}
@@ -0,0 +1,337 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package indexfile
+
+import (
+	"bytes"
+	"container/heap"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/google/stenographer/base"
+	"github.com/google/stenographer/indextable"
+	"golang.org/x/net/context"
+)
+
+// keyTypeNames name the key types which hold positions, for Stats.
+var keyTypeNames = map[byte]string{
+	keyProtocol:      "protocol",
+	keyPort:          "port",
+	keyVLAN:          "vlan",
+	keyIPv4:          "ipv4",
+	keyMPLS:          "mpls",
+	keyIPv6:          "ipv6",
+	keyMAC:           "mac",
+	keyInnerIPv4:     "inner_ipv4",
+	keyInnerIPv6:     "inner_ipv6",
+	keyInnerPort:     "inner_port",
+	keyTCPFlags:      "tcp_flags",
+	keyLength:        "length",
+	keyProtoPort:     "proto_port",
+	keyDNSName:       "dns_name",
+	keyDNSAnswer:     "dns_answer",
+	keyTLSServerName: "tls_server_name",
+	keyJA3:           "ja3",
+	keyJA3S:          "ja3s",
+	keyHTTPHost:      "http_host",
+	keyHTTPMethod:    "http_method",
+	keyHTTPPath:      "http_path",
+	keyCommunityID:   "community_id",
+}
+
+// hottestKeys is how many keys of each type Stats lists as hottest.
+const hottestKeys = 10
+
+// Stats summarizes the keys an index holds.
+type Stats struct {
+	DistinctIPs   int // IPv4 and IPv6 keys, not counting tunneled packets' inner IPs
+	DistinctPorts int // Port keys, likewise
+	// KeyTypes holds the stats of each key type with any keys, by name:
+	// "ipv4", "port", "dns_name" and so on, and custom key types by theirs.
+	KeyTypes map[string]KeyTypeStats
+}
+
+// KeyTypeStats summarizes the keys of one type.
+type KeyTypeStats struct {
+	Keys      int
+	Positions int64 // Summed over the keys, so packets may be counted more than once
+	Bytes     int64 // Taken by the keys and their positions, uncompressed
+	// Hottest lists the keys with the most positions, most first.
+	Hottest []KeyCount
+}
+
+// KeyCount is a key, in readable form, and its number of positions.
+type KeyCount struct {
+	Key       string
+	Positions int
+}
+
+// Estimate returns roughly how many positions a lookup of keys of the named
+// type would read: the mean per key for a single key, or else all of them.
+func (s *Stats) Estimate(keyType string, single bool) int64 {
+	t := s.KeyTypes[keyType]
+	if !single || t.Keys == 0 {
+		return t.Positions
+	}
+	return (t.Positions + int64(t.Keys) - 1) / int64(t.Keys)
+}
+
+// Stats returns statistics on the index's keys.  They're read by scanning the
+// whole index, once, as the result is cached.
+func (i *IndexFile) Stats(ctx context.Context) (Stats, error) {
+	i.statsMu.Lock()
+	defer i.statsMu.Unlock()
+	if s, _ := i.stats.Load().(*Stats); s != nil {
+		return s.copy(), nil
+	}
+	s, err := i.computeStats(ctx)
+	if err != nil {
+		return Stats{}, fmt.Errorf("could not get stats of %q: %v", i.name, err)
+	}
+	i.stats.Store(&s)
+	return s.copy(), nil
+}
+
+// KnownStats returns the index's stats if they're known without reading the
+// whole index, so callers which only want them if they're cheap, like query
+// planning, never wait for a scan: if Stats has already read them, or else
+// if the index recorded them when it was written by Builder, though those
+// list no hottest keys.  Stenotype's indexes record none.
+func (i *IndexFile) KnownStats() (Stats, bool) {
+	s, _ := i.stats.Load().(*Stats)
+	if s == nil {
+		if s = i.recordedStats(); s == nil {
+			return Stats{}, false
+		}
+	}
+	return s.copy(), true
+}
+
+// recordedStats returns the stats recorded in the index's keyStats record,
+// reading it once, or nil if it has none.
+func (i *IndexFile) recordedStats() *Stats {
+	i.recordedOnce.Do(func() {
+		record, err := i.ss.Get([]byte{keyStats})
+		if err != nil {
+			if err != indextable.ErrNotFound {
+				v(1, "index %q: could not read stats: %v", i.name, err)
+			}
+			return
+		}
+		s, err := parseStatsRecord(record)
+		if err != nil {
+			v(1, "index %q: %v", i.name, err)
+			return
+		}
+		i.recorded = &s
+	})
+	return i.recorded
+}
+
+// statsRecord returns the value of the keyStats record of the Builder's keys:
+// a line per key type, in order, holding its name and its keys, positions
+// and bytes.
+func (b *Builder) statsRecord() []byte {
+	types := map[string]KeyTypeStats{}
+	for k, positions := range b.keys {
+		name, ok := keyTypeName([]byte(k))
+		if !ok {
+			continue
+		}
+		t := types[name]
+		t.Keys++
+		t.Positions += int64(len(positions))
+		t.Bytes += int64(len(k) + 4*len(positions))
+		types[name] = t
+	}
+	var names []string
+	for name := range types {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var out bytes.Buffer
+	for _, name := range names {
+		t := types[name]
+		fmt.Fprintf(&out, "%s %d %d %d\n", name, t.Keys, t.Positions, t.Bytes)
+	}
+	return out.Bytes()
+}
+
+// parseStatsRecord returns the Stats a keyStats record holds.
+func parseStatsRecord(record []byte) (Stats, error) {
+	s := Stats{KeyTypes: map[string]KeyTypeStats{}}
+	for _, line := range strings.Split(string(record), "\n") {
+		if line == "" {
+			continue
+		}
+		var name string
+		var t KeyTypeStats
+		if _, err := fmt.Sscan(line, &name, &t.Keys, &t.Positions, &t.Bytes); err != nil {
+			return Stats{}, fmt.Errorf("invalid stats record line %q: %v", line, err)
+		}
+		s.KeyTypes[name] = t
+	}
+	s.DistinctIPs = s.KeyTypes["ipv4"].Keys + s.KeyTypes["ipv6"].Keys
+	s.DistinctPorts = s.KeyTypes["port"].Keys
+	return s, nil
+}
+
+// copy returns a copy of s, which callers may change.
+func (s *Stats) copy() Stats {
+	out := *s
+	out.KeyTypes = make(map[string]KeyTypeStats, len(s.KeyTypes))
+	for name, t := range s.KeyTypes {
+		t.Hottest = append([]KeyCount(nil), t.Hottest...)
+		out.KeyTypes[name] = t
+	}
+	return out
+}
+
+// computeStats works out Stats.
+func (i *IndexFile) computeStats(ctx context.Context) (Stats, error) {
+	s := Stats{KeyTypes: map[string]KeyTypeStats{}}
+	hottest := map[string]*keyHeap{}
+	iter := i.ss.Find([]byte{})
+	for iter.Next() && !base.ContextDone(ctx) {
+		key, val := iter.Key(), iter.Value()
+		name, ok := keyTypeName(key)
+		if !ok || !holdsPositions(key) {
+			continue
+		}
+		// Positions are packed 4 bytes apiece.
+		n := len(val) / 4
+		t := s.KeyTypes[name]
+		t.Keys++
+		t.Positions += int64(n)
+		t.Bytes += int64(len(key) + len(val))
+		s.KeyTypes[name] = t
+		h := hottest[name]
+		if h == nil {
+			h = &keyHeap{}
+			hottest[name] = h
+		}
+		if h.Len() < hottestKeys {
+			heap.Push(h, heapKey{append([]byte(nil), key...), n})
+		} else if n > (*h)[0].n {
+			(*h)[0] = heapKey{append([]byte(nil), key...), n}
+			heap.Fix(h, 0)
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return s, err
+	}
+	if err := ctx.Err(); err != nil {
+		return s, err
+	}
+	for name, h := range hottest {
+		// The heap puts the coldest first, so pop them off into place
+		// from the end.
+		keys := make([]KeyCount, h.Len())
+		for j := len(keys) - 1; j >= 0; j-- {
+			k := heap.Pop(h).(heapKey)
+			keys[j] = KeyCount{keyString(k.key), k.n}
+		}
+		t := s.KeyTypes[name]
+		t.Hottest = keys
+		s.KeyTypes[name] = t
+	}
+	s.DistinctIPs = s.KeyTypes["ipv4"].Keys + s.KeyTypes["ipv6"].Keys
+	s.DistinctPorts = s.KeyTypes["port"].Keys
+	return s, nil
+}
+
+// heapKey is a key with n positions.
+type heapKey struct {
+	key []byte
+	n   int
+}
+
+// keyHeap is a min-heap of keys by their number of positions, ties broken so
+// keys earlier in the index are kept.
+type keyHeap []heapKey
+
+func (h keyHeap) Len() int { return len(h) }
+func (h keyHeap) Less(i, j int) bool {
+	if h[i].n != h[j].n {
+		return h[i].n < h[j].n
+	}
+	return string(h[i].key) > string(h[j].key)
+}
+func (h keyHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *keyHeap) Push(x interface{}) { *h = append(*h, x.(heapKey)) }
+func (h *keyHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// keyTypeName returns the name of key's type, or false if it hasn't one.
+func keyTypeName(key []byte) (string, bool) {
+	if key[0] == keyCustom {
+		typ, _, ok := customKeyType(key)
+		return typ, ok
+	}
+	name, ok := keyTypeNames[key[0]]
+	return name, ok
+}
+
+// keyString returns the value of a key, without its type, in readable form,
+// like a query would give it.  Keys it doesn't recognize, and custom keys
+// which aren't printable, are given in hex.
+func keyString(key []byte) string {
+	val := key[1:]
+	switch typ := key[0]; {
+	case typ == keyProtocol && len(val) == 1:
+		return fmt.Sprint(val[0])
+	case (typ == keyPort || typ == keyInnerPort || typ == keyVLAN) && len(val) == 2:
+		return fmt.Sprint(binary.BigEndian.Uint16(val))
+	case typ == keyMPLS && len(val) == 4:
+		return fmt.Sprint(binary.BigEndian.Uint32(val))
+	case (typ == keyIPv4 || typ == keyInnerIPv4) && len(val) == 4,
+		(typ == keyIPv6 || typ == keyInnerIPv6) && len(val) == 16:
+		return net.IP(val).String()
+	case typ == keyMAC && len(val) == 6:
+		return net.HardwareAddr(val).String()
+	case typ == keyTCPFlags && len(val) == 1:
+		return fmt.Sprintf("%#02x", val[0])
+	case typ == keyLength && len(val) == 4:
+		return fmt.Sprintf("%d-%d", binary.BigEndian.Uint16(val), binary.BigEndian.Uint16(val[2:]))
+	case typ == keyProtoPort && len(val) == 3:
+		return fmt.Sprintf("%d/%d", val[0], binary.BigEndian.Uint16(val[1:]))
+	case typ == keyDNSName || typ == keyTLSServerName || typ == keyHTTPHost:
+		// Reversing the labels again gives the name as it's written.
+		return string(dnsIndexName(string(val)))
+	case typ == keyDNSAnswer:
+		if sep := bytes.IndexByte(val, 0); sep > 0 {
+			if ip := val[sep+1:]; len(ip) == 4 || len(ip) == 16 {
+				return string(dnsIndexName(string(val[:sep]))) + " " + net.IP(ip).String()
+			}
+		}
+	case typ == keyHTTPMethod || typ == keyHTTPPath:
+		return string(val)
+	case typ == keyCustom:
+		if _, custom, ok := customKeyType(key); ok && printable(string(custom)) {
+			return string(custom)
+		} else if ok {
+			return hex.EncodeToString(custom)
+		}
+	}
+	return hex.EncodeToString(val)
+}
@@ -0,0 +1,236 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package indexfile
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"strconv"
+	"strings"
+)
+
+// TLS record, handshake and extension types addTLS decodes.
+const (
+	tlsHandshake          = 22
+	tlsClientHello        = 1
+	tlsServerHello        = 2
+	tlsExtServerName      = 0
+	tlsExtSupportedGroups = 10
+	tlsExtECPointFormats  = 11
+	tlsHostName           = 0 // The server name type of host names
+)
+
+// tlsGREASE returns whether v is one of the values (RFC 8701) clients send to
+// keep servers tolerant of unknown ones, which JA3 ignores.
+func tlsGREASE(v int) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// tlsReader reads the fields of a TLS handshake message.  Once a field would
+// run past the end, ok is false and all reads return nothing.
+type tlsReader struct {
+	data []byte
+	ok   bool
+}
+
+func (r *tlsReader) bytes(n int) []byte {
+	if !r.ok || n > len(r.data) {
+		r.ok = false
+		return nil
+	}
+	out := r.data[:n]
+	r.data = r.data[n:]
+	return out
+}
+
+func (r *tlsReader) u8() int {
+	if b := r.bytes(1); b != nil {
+		return int(b[0])
+	}
+	return 0
+}
+
+func (r *tlsReader) u16() int {
+	if b := r.bytes(2); b != nil {
+		return int(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+// vec8 and vec16 read a field holding a 1 or 2 byte length, then that many
+// bytes, returning a reader for the bytes.
+func (r *tlsReader) vec8() tlsReader {
+	data := r.bytes(r.u8())
+	return tlsReader{data, r.ok}
+}
+
+func (r *tlsReader) vec16() tlsReader {
+	data := r.bytes(r.u16())
+	return tlsReader{data, r.ok}
+}
+
+// more returns whether there's anything left to read.
+func (r *tlsReader) more() bool {
+	return r.ok && len(r.data) > 0
+}
+
+// addTLS indexes the server name and JA3 fingerprint of a TLS ClientHello, or
+// the JA3S fingerprint of a ServerHello, at the start of the payload of the
+// TCP header at the start of data.  Only hellos starting a record in a
+// segment, and wholly within it, are found.
+func (b *Builder) addTLS(data []byte, pos int64) {
+	off := int(data[12]>>4) * 4
+	if off < 20 || off+5+4 > len(data) {
+		return
+	}
+	record := data[off:]
+	if record[0] != tlsHandshake || record[1] != 3 {
+		return
+	}
+	msg := record[5:]
+	length := int(msg[1])<<16 | int(msg[2])<<8 | int(msg[3])
+	if 4+length > len(msg) {
+		return
+	}
+	body := &tlsReader{msg[4 : 4+length], true}
+	switch msg[0] {
+	case tlsClientHello:
+		sni, ja3, ok := clientHello(body)
+		if !ok {
+			return
+		}
+		hash := md5.Sum([]byte(ja3))
+		b.add(append([]byte{keyJA3}, hash[:]...), pos)
+		if sni != nil {
+			b.add(append([]byte{keyTLSServerName}, sni...), pos)
+		}
+	case tlsServerHello:
+		if ja3s, ok := serverHello(body); ok {
+			hash := md5.Sum([]byte(ja3s))
+			b.add(append([]byte{keyJA3S}, hash[:]...), pos)
+		}
+	}
+}
+
+// clientHello decodes the body of a ClientHello, returning its JA3 string and
+// the host name it gives in its server name extension, if any, in the form
+// dnsName indexes names in.
+func clientHello(r *tlsReader) (sni []byte, ja3 string, ok bool) {
+	version := r.u16()
+	r.bytes(32) // Random
+	r.vec8()    // Session ID
+	ciphers := r.vec16()
+	r.vec8() // Compression methods
+	// Extensions may be left out entirely.
+	exts := tlsReader{ok: true}
+	if r.more() {
+		exts = r.vec16()
+	}
+	if !r.ok {
+		return nil, "", false
+	}
+	var extensions, groups, formats []string
+	for exts.more() {
+		typ := exts.u16()
+		ext := exts.vec16()
+		if !exts.ok || tlsGREASE(typ) {
+			continue
+		}
+		extensions = append(extensions, strconv.Itoa(typ))
+		switch typ {
+		case tlsExtServerName:
+			names := ext.vec16()
+			for names.more() {
+				nameType, name := names.u8(), names.vec16()
+				if names.ok && nameType == tlsHostName && sni == nil {
+					sni = tlsServerName(name.data)
+				}
+			}
+		case tlsExtSupportedGroups:
+			groups = tlsList(ext.vec16(), 2)
+		case tlsExtECPointFormats:
+			formats = tlsList(ext.vec8(), 1)
+		}
+	}
+	if !exts.ok {
+		return nil, "", false
+	}
+	return sni, strings.Join([]string{
+		strconv.Itoa(version),
+		strings.Join(tlsList(ciphers, 2), "-"),
+		strings.Join(extensions, "-"),
+		strings.Join(groups, "-"),
+		strings.Join(formats, "-"),
+	}, ","), true
+}
+
+// serverHello decodes the body of a ServerHello, returning its JA3S string.
+func serverHello(r *tlsReader) (ja3s string, ok bool) {
+	version := r.u16()
+	r.bytes(32) // Random
+	r.vec8()    // Session ID
+	cipher := r.u16()
+	r.u8() // Compression method
+	// Extensions may be left out entirely.
+	exts := tlsReader{ok: true}
+	if r.more() {
+		exts = r.vec16()
+	}
+	var extensions []string
+	for exts.more() {
+		typ := exts.u16()
+		exts.vec16()
+		if exts.ok && !tlsGREASE(typ) {
+			extensions = append(extensions, strconv.Itoa(typ))
+		}
+	}
+	if !r.ok || !exts.ok {
+		return "", false
+	}
+	return strings.Join([]string{
+		strconv.Itoa(version),
+		strconv.Itoa(cipher),
+		strings.Join(extensions, "-"),
+	}, ","), true
+}
+
+// tlsList returns the decimal values of the size-byte integers r holds,
+// leaving out GREASE values.
+func tlsList(r tlsReader, size int) []string {
+	var out []string
+	for len(r.data) >= size {
+		v := r.u8()
+		if size == 2 {
+			v = v<<8 | r.u8()
+		}
+		if !tlsGREASE(v) {
+			out = append(out, strconv.Itoa(v))
+		}
+	}
+	return out
+}
+
+// tlsServerName returns a server name extension's host name in the form
+// dnsName indexes names in, or nil if it holds bytes other than printable
+// ASCII.
+func tlsServerName(name []byte) []byte {
+	if len(name) == 0 || len(name) > dnsMaxNameLen || !printable(string(name)) {
+		return nil
+	}
+	if out := dnsIndexName(string(name)); len(out) > 0 {
+		return out
+	}
+	return nil
+}
@@ -0,0 +1,350 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package indextable reads and writes the immutable sorted tables of keys and
+// values indexes are stored in.
+//
+// Stenotype writes leveldb SSTables, which are still read, through the
+// leveldb package.  Tables written by stenographer itself use a simpler
+// format, built for how indexes are read:  lookups of single keys or short
+// ranges, against files that are never changed once written.  Layout:
+//
+//	blocks: per block, entries then a CRC-32C of them
+//	index:  per block, its last key's length and key, offset and length,
+//	        then a CRC-32C of them
+//	footer: index offset uint64, index length uint64, magic
+//
+// Each entry holds, as uvarints, the length of the prefix its key shares with
+// the previous key in its block, the length of the rest of the key, and the
+// length of its value, followed by the rest of the key and the value.  Blocks
+// hold about 4KB of entries, or a single larger one.  Lengths in the index
+// don't count blocks' CRCs, and all integers outside entries are big-endian.
+//
+// The index is decoded into memory when a table is opened, so finding a key
+// is a binary search of its blocks' last keys, then reading the one block
+// which may hold it.  Leveldb keeps its index block in memory too, but still
+// encoded, decoding entries from a restart point on every lookup, and reads
+// one block at a time.  Iterators here reading on past their first block read
+// the blocks after it in growing runs, so range scans make fewer, larger
+// reads.
+package indextable
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"sort"
+
+	"github.com/golang/leveldb/db"
+	"github.com/golang/leveldb/table"
+	"github.com/google/stenographer/stats"
+)
+
+const (
+	magic     = "STENOI01"
+	footerLen = 8 + 8 + 8 // Index offset and length, then magic
+	// legacyMagic ends leveldb tables, whose footers are legacyFooterLen
+	// bytes.
+	legacyMagic     = "\x57\xfb\x80\x8b\x24\x75\x47\xdb"
+	legacyFooterLen = 48
+	crcLen    = 4
+	// blockSize is the size blocks are cut at, once their entries reach it.
+	blockSize = 4 << 10
+	// readAhead is the most an iterator reads at once, once it's read on
+	// well past the first block it found.
+	readAhead = 256 << 10
+)
+
+var (
+	tableReads     = stats.S.Get("indextable_reads")
+	tableBytesRead = stats.S.Get("indextable_bytes_read")
+	legacyOpens    = stats.S.Get("indextable_legacy_opens")
+)
+
+// ErrNotFound is returned by Get for keys a table doesn't hold.  It's the
+// same error leveldb tables return.
+var ErrNotFound = db.ErrNotFound
+
+// crcTable is the Castagnoli polynomial, as leveldb uses.
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Reader reads a table.
+type Reader interface {
+	// Get returns the value of a key, or ErrNotFound.
+	Get(key []byte) ([]byte, error)
+	// Find returns an iterator over the keys from 'key' on, in order.
+	Find(key []byte) Iterator
+	// Close closes the table's file.
+	Close() error
+}
+
+// Iterator iterates over the keys and values of a table.  Like leveldb's, it
+// starts before the first key, and Key and Value are only valid until the
+// following call to Next.
+type Iterator interface {
+	Next() bool
+	Key() []byte
+	Value() []byte
+	// Close returns any error reading the table.
+	Close() error
+}
+
+// ErrCorrupt is returned by NewReader for files ending in neither format's
+// footer, like tables cut short by a crash.
+var ErrCorrupt = errors.New("table truncated or corrupt: no footer")
+
+// NewReader returns a Reader of the table in f, in either format, which
+// closes f once it's closed.
+func NewReader(f db.File) (Reader, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := fi.Size()
+	if size < footerLen {
+		return nil, ErrCorrupt
+	}
+	var footer [footerLen]byte
+	if _, err := f.ReadAt(footer[:], size-footerLen); err != nil {
+		return nil, fmt.Errorf("could not read table footer: %v", err)
+	}
+	if string(footer[16:]) != magic {
+		if size < legacyFooterLen || string(footer[16:]) != legacyMagic {
+			return nil, ErrCorrupt
+		}
+		return newLegacyReader(f), nil
+	}
+	off, n := binary.BigEndian.Uint64(footer[:]), binary.BigEndian.Uint64(footer[8:])
+	if off > uint64(size) || n > uint64(size)-off || off+n+crcLen != uint64(size-footerLen) {
+		return nil, errors.New("invalid table footer")
+	}
+	index := make([]byte, n+crcLen)
+	if _, err := f.ReadAt(index, int64(off)); err != nil {
+		return nil, fmt.Errorf("could not read table index: %v", err)
+	}
+	if index, err = checkCRC(index); err != nil {
+		return nil, fmt.Errorf("invalid table index: %v", err)
+	}
+	t := &reader{f: f}
+	for len(index) > 0 {
+		var b block
+		var ok bool
+		if b.last, index, ok = readBytes(index); !ok {
+			return nil, errors.New("invalid table index entry")
+		}
+		var boff, bn uint64
+		if boff, index, ok = readUvarint(index); !ok {
+			return nil, errors.New("invalid table index entry")
+		}
+		if bn, index, ok = readUvarint(index); !ok {
+			return nil, errors.New("invalid table index entry")
+		}
+		// Blocks follow one another, from the start of the file up to
+		// the index.
+		if want := t.end(); boff != uint64(want) || bn+crcLen > off-boff {
+			return nil, fmt.Errorf("table block %d misplaced", len(t.blocks))
+		}
+		b.off, b.n = int64(boff), int64(bn)
+		t.blocks = append(t.blocks, b)
+	}
+	if t.end() != int64(off) {
+		return nil, errors.New("table blocks don't reach its index")
+	}
+	return t, nil
+}
+
+// legacyReader reads a leveldb table.
+type legacyReader struct {
+	*table.Reader
+}
+
+// IsLegacy returns whether r reads a leveldb table, as stenotype writes.
+func IsLegacy(r Reader) bool {
+	_, ok := r.(legacyReader)
+	return ok
+}
+
+func newLegacyReader(f db.File) Reader {
+	legacyOpens.Increment()
+	return legacyReader{table.NewReader(f, nil)}
+}
+
+func (l legacyReader) Get(key []byte) ([]byte, error) { return l.Reader.Get(key, nil) }
+func (l legacyReader) Find(key []byte) Iterator       { return l.Reader.Find(key, nil) }
+
+// block is where a block lies in a table, and its last key.
+type block struct {
+	last []byte
+	off  int64
+	n    int64 // Not counting its CRC
+}
+
+// end returns the offset just past the block and its CRC.
+func (b block) end() int64 { return b.off + b.n + crcLen }
+
+// reader reads a table in stenographer's format.
+type reader struct {
+	f      db.File
+	blocks []block
+}
+
+// end returns the offset just past the table's last block.
+func (t *reader) end() int64 {
+	if len(t.blocks) == 0 {
+		return 0
+	}
+	return t.blocks[len(t.blocks)-1].end()
+}
+
+func (t *reader) Get(key []byte) ([]byte, error) {
+	iter := t.Find(key)
+	if iter.Next() && bytes.Equal(iter.Key(), key) {
+		val := iter.Value()
+		return val, iter.Close()
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return nil, ErrNotFound
+}
+
+func (t *reader) Find(key []byte) Iterator {
+	// The first block ending at or after the key is the only one which may
+	// hold it.
+	i := sort.Search(len(t.blocks), func(i int) bool { return bytes.Compare(t.blocks[i].last, key) >= 0 })
+	return &iterator{t: t, next: i, start: key}
+}
+
+func (t *reader) Close() error {
+	return t.f.Close()
+}
+
+// iterator iterates over a table in stenographer's format.
+type iterator struct {
+	t          *reader
+	next       int    // The next block to read
+	reads      int    // Reads of the table so far
+	blocks     []byte // Read but not yet iterated over, with their CRCs
+	entries    []byte // The rest of the current block
+	key, value []byte
+	start      []byte // Keys before it are skipped; nil once it's reached
+	err        error
+}
+
+func (it *iterator) Next() bool {
+	for it.err == nil {
+		if len(it.entries) == 0 && !it.nextBlock() {
+			return false
+		}
+		shared, rest, ok := readUvarint(it.entries)
+		var unshared, n uint64
+		if ok {
+			unshared, rest, ok = readUvarint(rest)
+		}
+		if ok {
+			n, rest, ok = readUvarint(rest)
+		}
+		if !ok || shared > uint64(len(it.key)) || unshared > uint64(len(rest)) || n > uint64(len(rest))-unshared {
+			it.err = errors.New("invalid table entry")
+			return false
+		}
+		it.key = append(it.key[:shared], rest[:unshared]...)
+		it.value = rest[unshared : unshared+n]
+		it.entries = rest[unshared+n:]
+		if it.start != nil && bytes.Compare(it.key, it.start) < 0 {
+			continue
+		}
+		it.start = nil
+		return true
+	}
+	return false
+}
+
+// nextBlock moves on to the next block, reading it and some of those after
+// it, unless they're already read.  It returns false at the end of the
+// table, or on error.
+func (it *iterator) nextBlock() bool {
+	if it.next >= len(it.t.blocks) {
+		return false
+	}
+	b := it.t.blocks[it.next]
+	if len(it.blocks) == 0 {
+		// Each read takes up to twice as much as the last, so short
+		// scans don't read much past their end.
+		ahead := int64(readAhead)
+		if it.reads < 6 {
+			ahead = blockSize << uint(it.reads)
+		}
+		last := it.next
+		for last+1 < len(it.t.blocks) && it.t.blocks[last+1].end()-b.off <= ahead {
+			last++
+		}
+		it.blocks = make([]byte, it.t.blocks[last].end()-b.off)
+		if n, err := it.t.f.ReadAt(it.blocks, b.off); n < len(it.blocks) {
+			it.err = fmt.Errorf("could not read table block %d: %v", it.next, err)
+			return false
+		}
+		it.reads++
+		tableReads.Increment()
+		tableBytesRead.IncrementBy(int64(len(it.blocks)))
+	}
+	entries, err := checkCRC(it.blocks[:b.n+crcLen])
+	if err != nil {
+		it.err = fmt.Errorf("invalid table block %d: %v", it.next, err)
+		return false
+	}
+	it.blocks = it.blocks[b.n+crcLen:]
+	it.entries = entries
+	it.key = it.key[:0]
+	it.next++
+	return true
+}
+
+func (it *iterator) Key() []byte   { return it.key }
+func (it *iterator) Value() []byte { return it.value }
+func (it *iterator) Close() error  { return it.err }
+
+// checkCRC returns data without the CRC-32C ending it, if it matches.
+func checkCRC(data []byte) ([]byte, error) {
+	if len(data) < crcLen {
+		return nil, errors.New("missing checksum")
+	}
+	body := data[:len(data)-crcLen]
+	if crc32.Checksum(body, crcTable) != binary.BigEndian.Uint32(data[len(body):]) {
+		return nil, errors.New("checksum mismatch")
+	}
+	return body, nil
+}
+
+// readUvarint reads a uvarint from the start of data, returning what follows
+// it.
+func readUvarint(data []byte) (x uint64, rest []byte, ok bool) {
+	x, n := binary.Uvarint(data)
+	if n <= 0 {
+		return 0, nil, false
+	}
+	return x, data[n:], true
+}
+
+// readBytes reads a uvarint length, then that many bytes, from the start of
+// data, returning what follows them.
+func readBytes(data []byte) (b, rest []byte, ok bool) {
+	n, rest, ok := readUvarint(data)
+	if !ok || n > uint64(len(rest)) {
+		return nil, nil, false
+	}
+	return rest[:n], rest[n:], true
+}
@@ -0,0 +1,321 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package indextable
+
+import (
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/golang/leveldb/db"
+	"github.com/golang/leveldb/table"
+)
+
+// testEntries returns n keys, shaped like index keys of IPv4 addresses, and
+// their values, mostly short lists of positions but with some far longer than
+// a block.
+func testEntries(n int) (keys, values [][]byte) {
+	for i := 0; i < n; i++ {
+		key := make([]byte, 5)
+		key[0] = 4
+		binary.BigEndian.PutUint32(key[1:], uint32(i)*7)
+		positions := 1 + i%13
+		if i%1000 == 999 {
+			positions = 5000
+		}
+		value := make([]byte, positions*4)
+		for j := 0; j < positions; j++ {
+			binary.BigEndian.PutUint32(value[j*4:], uint32(i+j*64))
+		}
+		keys, values = append(keys, key), append(values, value)
+	}
+	return keys, values
+}
+
+// writeTable writes a table of the given entries to a new file, in leveldb's
+// format if 'legacy' is set, returning the file's path.
+func writeTable(tb testing.TB, legacy bool, keys, values [][]byte) string {
+	path := filepath.Join(tb.TempDir(), "table")
+	f, err := os.Create(path)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	var set func(key, value []byte) error
+	var closer func() error
+	if legacy {
+		// As stenotype writes them.
+		w := table.NewWriter(f, &db.Options{Compression: db.NoCompression})
+		set = func(key, value []byte) error { return w.Set(key, value, nil) }
+		closer = w.Close
+	} else {
+		w := NewWriter(f)
+		set, closer = w.Set, w.Close
+	}
+	for i := range keys {
+		if err := set(keys[i], values[i]); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	if err := closer(); err != nil {
+		tb.Fatal(err)
+	}
+	return path
+}
+
+// openTable opens the table at path.
+func openTable(tb testing.TB, path string) Reader {
+	f, err := os.Open(path)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	r, err := NewReader(f)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return r
+}
+
+func TestReader(t *testing.T) {
+	keys, values := testEntries(20000)
+	for _, legacy := range []bool{false, true} {
+		r := openTable(t, writeTable(t, legacy, keys, values))
+		defer r.Close()
+		if _, ok := r.(legacyReader); ok != legacy {
+			t.Errorf("legacy %v: opened as legacy %v", legacy, ok)
+		}
+		// Scans see every key, in order.
+		iter := r.Find(nil)
+		i := 0
+		for ; iter.Next(); i++ {
+			if i >= len(keys) || !bytes.Equal(iter.Key(), keys[i]) || !bytes.Equal(iter.Value(), values[i]) {
+				t.Fatalf("legacy %v: entry %d: got key %x", legacy, i, iter.Key())
+			}
+		}
+		if err := iter.Close(); err != nil || i != len(keys) {
+			t.Errorf("legacy %v: scanned %d of %d keys, then %v", legacy, i, len(keys), err)
+		}
+		for i := 0; i < len(keys); i += 97 {
+			if got, err := r.Get(keys[i]); err != nil || !bytes.Equal(got, values[i]) {
+				t.Errorf("legacy %v: get %x: got %d bytes, %v", legacy, keys[i], len(got), err)
+			}
+			// Keys between those set find the next one.
+			after := append(append([]byte(nil), keys[i]...), 0)
+			if _, err := r.Get(after); err != ErrNotFound {
+				t.Errorf("legacy %v: get %x: want ErrNotFound, got %v", legacy, after, err)
+			}
+			iter := r.Find(after)
+			if i+1 < len(keys) && (!iter.Next() || !bytes.Equal(iter.Key(), keys[i+1])) {
+				t.Errorf("legacy %v: find %x: got %x", legacy, after, iter.Key())
+			}
+			if err := iter.Close(); err != nil {
+				t.Errorf("legacy %v: find %x: %v", legacy, after, err)
+			}
+		}
+		iter = r.Find([]byte{5})
+		if iter.Next() {
+			t.Errorf("legacy %v: found %x past the last key", legacy, iter.Key())
+		}
+		iter.Close()
+	}
+}
+
+func TestReaderTestdata(t *testing.T) {
+	// Stenotype's indexes are read as leveldb tables.
+	r := openTable(t, "../testdata/IDX0/dhcp")
+	defer r.Close()
+	if _, ok := r.(legacyReader); !ok {
+		t.Error("stenotype's index not opened as a leveldb table")
+	}
+	if _, err := r.Get([]byte{2, 0, 67}); err != nil {
+		t.Errorf("port 67: %v", err)
+	}
+}
+
+func TestReaderEmpty(t *testing.T) {
+	r := openTable(t, writeTable(t, false, nil, nil))
+	defer r.Close()
+	if _, err := r.Get([]byte{0}); err != ErrNotFound {
+		t.Errorf("get from empty table: want ErrNotFound, got %v", err)
+	}
+}
+
+func TestReaderCorrupt(t *testing.T) {
+	keys, values := testEntries(2000)
+	path := writeTable(t, false, keys, values)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		desc   string
+		off    int // Of the byte changed, from the end if negative
+		opened bool
+	}{
+		{"block", 100, true},
+		{"index", -footerLen - 20, false},
+		{"footer", -footerLen, false},
+	} {
+		corrupt := append([]byte(nil), data...)
+		off := test.off
+		if off < 0 {
+			off += len(corrupt)
+		}
+		corrupt[off] ^= 0x40
+		path := filepath.Join(t.TempDir(), "corrupt")
+		if err := os.WriteFile(path, corrupt, 0600); err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := NewReader(f)
+		if (err == nil) != test.opened {
+			t.Errorf("%s: opening got %v", test.desc, err)
+		}
+		if err != nil {
+			f.Close()
+			continue
+		}
+		iter := r.Find(nil)
+		for iter.Next() {
+		}
+		if err := iter.Close(); err == nil {
+			t.Errorf("%s: read corrupt table without error", test.desc)
+		}
+		r.Close()
+	}
+}
+
+func TestReaderTruncated(t *testing.T) {
+	keys, values := testEntries(2000)
+	for _, legacy := range []bool{false, true} {
+		data, err := os.ReadFile(writeTable(t, legacy, keys, values))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, n := range []int{0, 10, len(data) / 2, len(data) - 1} {
+			path := filepath.Join(t.TempDir(), "truncated")
+			if err := os.WriteFile(path, data[:n], 0600); err != nil {
+				t.Fatal(err)
+			}
+			f, err := os.Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r, err := NewReader(f); err != ErrCorrupt {
+				t.Errorf("legacy %v: truncated to %d bytes: want ErrCorrupt, got %v", legacy, n, err)
+				if err == nil {
+					r.Close()
+				}
+			}
+			f.Close()
+		}
+	}
+}
+
+func TestWriterOrder(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "table"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWriter(f)
+	if err := w.Set([]byte{2}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Set([]byte{1}, nil); err == nil {
+		t.Error("set keys out of order")
+	}
+	if err := w.Close(); err == nil {
+		t.Error("closed table with keys out of order")
+	}
+}
+
+// stenotypeIndex is an index stenotype wrote, whose entries the benchmarks
+// also use, so the formats are compared on the keys of real traffic.  The
+// testdata's is small; pass one from a live capture for a fair comparison.
+var stenotypeIndex = flag.String("stenotype_index", "../testdata/IDX0/vlan", "stenotype index to benchmark on")
+
+// stenotypeEntries returns the keys and values of stenotypeIndex.
+func stenotypeEntries(tb testing.TB) (keys, values [][]byte) {
+	r := openTable(tb, *stenotypeIndex)
+	defer r.Close()
+	iter := r.Find(nil)
+	for iter.Next() {
+		keys = append(keys, append([]byte(nil), iter.Key()...))
+		values = append(values, append([]byte(nil), iter.Value()...))
+	}
+	if err := iter.Close(); err != nil {
+		tb.Fatalf("could not read %q: %v", *stenotypeIndex, err)
+	}
+	return keys, values
+}
+
+// benchmarkTables runs f against tables of synthetic entries in each format,
+// then against stenotypeIndex and a copy of it in stenographer's format.
+func benchmarkTables(b *testing.B, f func(b *testing.B, r Reader, keys [][]byte)) {
+	run := func(name, path string, keys [][]byte) {
+		b.Run(name, func(b *testing.B) {
+			r := openTable(b, path)
+			defer r.Close()
+			b.ResetTimer()
+			f(b, r, keys)
+		})
+	}
+	keys, values := testEntries(200000)
+	run("synthetic/leveldb", writeTable(b, true, keys, values), keys)
+	run("synthetic/indextable", writeTable(b, false, keys, values), keys)
+	keys, values = stenotypeEntries(b)
+	run("stenotype/leveldb", *stenotypeIndex, keys)
+	run("stenotype/indextable", writeTable(b, false, keys, values), keys)
+}
+
+// BenchmarkGet looks up single keys, as queries for a host or port do.
+func BenchmarkGet(b *testing.B) {
+	benchmarkTables(b, func(b *testing.B, r Reader, keys [][]byte) {
+		for i := 0; i < b.N; i++ {
+			key := keys[(i*7919)%len(keys)]
+			if _, err := r.Get(key); err != nil {
+				b.Fatalf("get %x: %v", key, err)
+			}
+		}
+	})
+}
+
+// BenchmarkScan reads ranges of keys, as queries for a net or port range do.
+func BenchmarkScan(b *testing.B) {
+	for _, n := range []int{100, 10000} {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			benchmarkTables(b, func(b *testing.B, r Reader, keys [][]byte) {
+				if len(keys) <= n {
+					b.Skipf("table holds only %d keys", len(keys))
+				}
+				for i := 0; i < b.N; i++ {
+					from := keys[(i*7919)%(len(keys)-n)]
+					iter := r.Find(from)
+					for j := 0; j < n && iter.Next(); j++ {
+					}
+					if err := iter.Close(); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		})
+	}
+}
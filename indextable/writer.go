@@ -0,0 +1,132 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package indextable
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+
+	"github.com/golang/leveldb/db"
+)
+
+// Writer writes a table in stenographer's format.
+type Writer struct {
+	f       db.File
+	w       *bufio.Writer
+	off     int64        // Of the block being built
+	block   bytes.Buffer // Entries of the block being built
+	index   bytes.Buffer
+	prev    []byte // The last key set
+	started bool   // Whether any key has been set
+	err     error
+}
+
+// NewWriter returns a Writer of a table to f, which it closes once the table
+// is written.
+func NewWriter(f db.File) *Writer {
+	return &Writer{f: f, w: bufio.NewWriterSize(f, 64<<10)}
+}
+
+// Set adds a key and its value to the table.  Keys must be set in increasing
+// order.
+func (w *Writer) Set(key, value []byte) error {
+	if w.err != nil {
+		return w.err
+	}
+	if w.started && bytes.Compare(key, w.prev) <= 0 {
+		w.err = fmt.Errorf("table key %x set after %x", key, w.prev)
+		return w.err
+	}
+	shared := 0
+	if w.block.Len() > 0 {
+		for shared < len(key) && shared < len(w.prev) && key[shared] == w.prev[shared] {
+			shared++
+		}
+	}
+	putUvarint(&w.block, uint64(shared))
+	putUvarint(&w.block, uint64(len(key)-shared))
+	putUvarint(&w.block, uint64(len(value)))
+	w.block.Write(key[shared:])
+	w.block.Write(value)
+	w.prev = append(w.prev[:0], key...)
+	w.started = true
+	if w.block.Len() >= blockSize {
+		w.err = w.flush()
+	}
+	return w.err
+}
+
+// flush writes out the block being built, and adds it to the index.
+func (w *Writer) flush() error {
+	if w.block.Len() == 0 {
+		return nil
+	}
+	n := int64(w.block.Len())
+	if err := writeWithCRC(w.w, w.block.Bytes()); err != nil {
+		return err
+	}
+	putUvarint(&w.index, uint64(len(w.prev)))
+	w.index.Write(w.prev)
+	putUvarint(&w.index, uint64(w.off))
+	putUvarint(&w.index, uint64(n))
+	w.off += n + crcLen
+	w.block.Reset()
+	return nil
+}
+
+// Close writes out the rest of the table, then closes its file, returning the
+// first error writing it.
+func (w *Writer) Close() error {
+	err := w.err
+	if err == nil {
+		err = w.flush()
+	}
+	if err == nil {
+		err = writeWithCRC(w.w, w.index.Bytes())
+	}
+	if err == nil {
+		var footer [footerLen]byte
+		binary.BigEndian.PutUint64(footer[:], uint64(w.off))
+		binary.BigEndian.PutUint64(footer[8:], uint64(w.index.Len()))
+		copy(footer[16:], magic)
+		_, err = w.w.Write(footer[:])
+	}
+	if err == nil {
+		err = w.w.Flush()
+	}
+	if cerr := w.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// writeWithCRC writes data, then its CRC-32C.
+func writeWithCRC(w *bufio.Writer, data []byte) error {
+	var crc [crcLen]byte
+	binary.BigEndian.PutUint32(crc[:], crc32.Checksum(data, crcTable))
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	_, err := w.Write(crc[:])
+	return err
+}
+
+func putUvarint(b *bytes.Buffer, x uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	b.Write(buf[:binary.PutUvarint(buf[:], x)])
+}
@@ -30,12 +30,18 @@
 package query
 
 import (
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"net"
 	"strconv"
 	"strings"
 	"time"
 	"unicode"
+
+	"github.com/google/stenographer/indexfile"
 )
 
 %}
@@ -43,18 +49,23 @@ import (
 %union {
 	num int
 	ip net.IP
+	mac net.HardwareAddr
 	str string
 	query Query
+	flags [2]byte
 	dur time.Duration
 	time time.Time
 }
 
 %type	<query>	top expr expr2
 %type <time> timestamp
+%type <flags> tcpflags
 
-%token <str> HOST PORT PROTO AND OR NET MASK TCP UDP ICMP BEFORE AFTER IPP AGO VLAN MPLS
+%token <str> HOST PORT PORTRANGE PROTO AND OR NET MASK TCP UDP ICMP BEFORE AFTER IPP AGO VLAN MPLS ETHER INNER OUTER TCPFLAGS LEN GE LE DNSNAME DNSRESOLVED TLSSNI TLSJA3 TLSJA3S HTTPHOST HTTPMETHOD HTTPPATH COMMUNITYID KEY
+%token <str> NAME
 %token <ip> IP
-%token <num> NUM
+%token <mac> MAC
+%token <num> NUM FLAG
 %token <dur> DURATION
 %token <time> TIME
 
@@ -82,6 +93,10 @@ expr2:
 {
 	$$ = ipQuery{$2, $2}
 }
+|   ETHER HOST MAC
+{
+	$$ = macQuery($3)
+}
 |   PORT NUM
 {
 	if $2 < 0 || $2 >= 65536 {
@@ -89,13 +104,24 @@ expr2:
 	}
 	$$ = portQuery($2)
 }
+|   PORTRANGE NUM '-' NUM
+{
+	if $2 < 0 || $4 >= 65536 || $2 > $4 {
+		parserlex.Error(fmt.Sprintf("invalid port range %v-%v", $2, $4))
+	}
+	$$ = portRangeQuery{uint16($2), uint16($4)}
+}
 |   VLAN NUM
 {
-	if $2 < 0 || $2 >= 65536 {
+	if $2 < 0 || $2 >= 4096 { // Tags hold 12-bit IDs.
 		parserlex.Error(fmt.Sprintf("invalid vlan %v", $2))
 	}
 	$$ = vlanQuery($2)
 }
+|   VLAN
+{
+	$$ = taggedQuery{}
+}
 |   MPLS NUM
 {
 	if $2 < 0 || $2 >= (1 << 20) {
@@ -103,6 +129,10 @@ expr2:
 	}
 	$$ = mplsQuery($2)
 }
+|   MPLS
+{
+	$$ = labeledQuery{}
+}
 |   IPP PROTO NUM
 {
 	if $3 < 0 || $3 >= 256 {
@@ -116,24 +146,40 @@ expr2:
 		if mask == nil {
 			parserlex.Error(fmt.Sprintf("bad cidr: %v/%v", $2, $4))
 		}
-		from, to, err := ipsFromNet($2, mask)
+		q, err := newNetQuery($2, mask)
 		if err != nil {
 			parserlex.Error(err.Error())
 		}
-		$$ = ipQuery{from, to}
+		$$ = q
 }
 |   NET IP MASK IP
 {
-		from, to, err := ipsFromNet($2, net.IPMask($4))
+		q, err := newNetQuery($2, net.IPMask($4))
 		if err != nil {
 			parserlex.Error(err.Error())
 		}
-		$$ = ipQuery{from, to}
+		$$ = q
 }
 |   '(' expr ')'
 {
 	$$ = $2
 }
+|   INNER expr2
+{
+	q, err := newHeaderQuery($2, true)
+	if err != nil {
+		parserlex.Error(err.Error())
+	}
+	$$ = q
+}
+|   OUTER expr2
+{
+	q, err := newHeaderQuery($2, false)
+	if err != nil {
+		parserlex.Error(err.Error())
+	}
+	$$ = q
+}
 |   TCP
 {
 	$$ = protocolQuery(6)
@@ -146,6 +192,116 @@ expr2:
 {
 	$$ = protocolQuery(1)
 }
+|   TCPFLAGS tcpflags
+{
+	$$ = tcpFlagsQuery($2)
+}
+|   LEN '>' NUM
+{
+	$$ = lengthQuery{$3 + 1, 0}
+}
+|   LEN GE NUM
+{
+	if $3 < 1 {
+		parserlex.Error(fmt.Sprintf("invalid length %v", $3))
+	}
+	$$ = lengthQuery{$3, 0}
+}
+|   LEN '<' NUM
+{
+	if $3 < 2 {
+		parserlex.Error(fmt.Sprintf("no packet is shorter than %v", $3))
+	}
+	$$ = lengthQuery{0, $3 - 1}
+}
+|   LEN LE NUM
+{
+	if $3 < 1 {
+		parserlex.Error(fmt.Sprintf("no packet is shorter than %v", $3))
+	}
+	$$ = lengthQuery{0, $3}
+}
+|   DNSNAME NAME
+{
+	q, err := newDNSNameQuery($2)
+	if err != nil {
+		parserlex.Error(err.Error())
+	}
+	$$ = q
+}
+|   DNSRESOLVED NAME
+{
+	q, err := newDNSNameQuery($2)
+	if err != nil {
+		parserlex.Error(err.Error())
+	}
+	$$ = dnsResolvedQuery(q)
+}
+|   TLSSNI NAME
+{
+	q, err := newDNSNameQuery($2)
+	if err != nil {
+		parserlex.Error(err.Error())
+	}
+	$$ = tlsServerNameQuery(q)
+}
+|   COMMUNITYID NAME
+{
+	hash, err := parseCommunityID($2)
+	if err != nil {
+		parserlex.Error(err.Error())
+	}
+	$$ = communityIDQuery(hash)
+}
+|   TLSJA3 NAME
+{
+	hash, err := parseMD5($2)
+	if err != nil {
+		parserlex.Error(err.Error())
+	}
+	$$ = ja3Query(hash)
+}
+|   TLSJA3S NAME
+{
+	hash, err := parseMD5($2)
+	if err != nil {
+		parserlex.Error(err.Error())
+	}
+	$$ = ja3sQuery(hash)
+}
+|   HTTPHOST NAME
+{
+	q, err := newDNSNameQuery($2)
+	if err != nil {
+		parserlex.Error(err.Error())
+	}
+	$$ = httpHostQuery(q)
+}
+|   HTTPMETHOD NAME
+{
+	method := strings.ToUpper($2)
+	if method == "" || strings.IndexFunc(method, func(c rune) bool { return c < 'A' || c > 'Z' }) >= 0 {
+		parserlex.Error(fmt.Sprintf("bad http method %q", $2))
+	}
+	$$ = httpMethodQuery(method)
+}
+|   KEY NAME
+{
+	q, err := newCustomKeyQuery($2)
+	if err != nil {
+		parserlex.Error(err.Error())
+	}
+	$$ = q
+}
+|   HTTPPATH NAME
+{
+	q := httpPathQuery{path: strings.TrimSuffix($2, "*")}
+	q.prefix = q.path != $2
+	if !strings.HasPrefix(q.path, "/") || strings.ContainsAny(q.path, "*?#") {
+		parserlex.Error(fmt.Sprintf("bad http path %q", $2))
+	}
+	$$ = q
+}
 |   BEFORE timestamp
 {
 	var t timeQuery
@@ -159,6 +315,32 @@ expr2:
 	$$ = t
 }
 
+tcpflags:
+    FLAG
+{
+	$$ = [2]byte{byte($1), 0}
+}
+|   '!' FLAG
+{
+	$$ = [2]byte{0, byte($2)}
+}
+|   tcpflags FLAG
+{
+	if $1[1]&byte($2) != 0 {
+		parserlex.Error("tcp flag both set and clear")
+	}
+	$$ = $1
+	$$[0] |= byte($2)
+}
+|   tcpflags '!' FLAG
+{
+	if $1[0]&byte($3) != 0 {
+		parserlex.Error("tcp flag both set and clear")
+	}
+	$$ = $1
+	$$[1] |= byte($3)
+}
+
 timestamp:
     TIME
 {
@@ -171,17 +353,122 @@ timestamp:
 
 %%
 
-func ipsFromNet(ip net.IP, mask net.IPMask) (from, to net.IP, _ error) {
+// newNetQuery returns a query for the network holding ip, whose mask must be
+// a prefix of the same length, since only those networks are a single range
+// of IPs.
+func newNetQuery(ip net.IP, mask net.IPMask) (*netQuery, error) {
 	if len(ip) != len(mask) || (len(ip) != 4 && len(ip) != 16) {
-		return nil, nil, fmt.Errorf("bad IP or mask: %v %v", ip, mask)
+		return nil, fmt.Errorf("bad IP or mask: %v %v", ip, mask)
+	} else if _, bits := mask.Size(); bits == 0 {
+		return nil, fmt.Errorf("mask %v isn't a prefix", mask)
+	}
+	return &netQuery{IP: ip.Mask(mask), Mask: mask}, nil
+}
+
+// newHeaderQuery returns q matching the inner headers of tunneled packets if
+// inner is set, or the outermost headers (as q already does) if not.  Only
+// addresses and ports are indexed for both, so q may only be made of host,
+// net, port and portrange queries.
+func newHeaderQuery(q Query, inner bool) (Query, error) {
+	switch q := q.(type) {
+	case intersectQuery:
+		out := make(intersectQuery, len(q))
+		for i, sub := range q {
+			var err error
+			if out[i], err = newHeaderQuery(sub, inner); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	case unionQuery:
+		out := make(unionQuery, len(q))
+		for i, sub := range q {
+			var err error
+			if out[i], err = newHeaderQuery(sub, inner); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	case ipQuery:
+		if inner {
+			return innerIPQuery(q), nil
+		}
+		return q, nil
+	case *netQuery:
+		if inner {
+			return (*innerNetQuery)(q), nil
+		}
+		return q, nil
+	case portQuery:
+		if inner {
+			return innerPortQuery(q), nil
+		}
+		return q, nil
+	case portRangeQuery:
+		if inner {
+			return innerPortRangeQuery(q), nil
+		}
+		return q, nil
+	}
+	return nil, fmt.Errorf("inner and outer only apply to host, net, port and portrange, not %q", q)
+}
+
+// newDNSNameQuery returns a query for DNS messages asking about 'name', in
+// any case, or if it starts with "*.", about any name under the rest.
+func newDNSNameQuery(name string) (dnsNameQuery, error) {
+	q := dnsNameQuery{name: strings.ToLower(strings.TrimSuffix(name, "."))}
+	if strings.HasPrefix(q.name, "*.") {
+		q.name, q.subdomains = q.name[2:], true
 	}
-	from = make(net.IP, len(ip))
-	to = make(net.IP, len(ip))
-	for i := 0; i < len(ip); i++ {
-		from[i] = ip[i] & mask[i]
-		to[i] = ip[i] | ^mask[i]
+	if len(q.name) > 253 {
+		return q, fmt.Errorf("dns name %q too long", name)
 	}
-	return
+	for _, label := range strings.Split(q.name, ".") {
+		if label == "" || len(label) > 63 {
+			return q, fmt.Errorf("bad dns name %q", name)
+		}
+		for _, c := range label {
+			if c <= ' ' || c > '~' || c == '*' {
+				return q, fmt.Errorf("bad dns name %q", name)
+			}
+		}
+	}
+	return q, nil
+}
+
+// parseMD5 parses an MD5 hash, like a JA3 fingerprint, given in hex.
+func parseMD5(in string) (hash [md5.Size]byte, _ error) {
+	b, err := hex.DecodeString(in)
+	if err != nil || len(b) != md5.Size {
+		return hash, fmt.Errorf("bad md5 hash %q", in)
+	}
+	copy(hash[:], b)
+	return hash, nil
+}
+
+// parseCommunityID returns the SHA-1 hash a version 1 Community ID, like
+// "1:LQU9qZlK+B5F3KDmev6m5PMibrg=", encodes.
+func parseCommunityID(in string) (hash [sha1.Size]byte, _ error) {
+	b, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(in, "1:"))
+	if err != nil || len(b) != sha1.Size || !strings.HasPrefix(in, "1:") {
+		return hash, fmt.Errorf("bad community id %q", in)
+	}
+	copy(hash[:], b)
+	return hash, nil
+}
+
+// newCustomKeyQuery returns a query for packets a custom indexer indexed
+// under a key, given like "sip.callid=abc".
+func newCustomKeyQuery(in string) (customKeyQuery, error) {
+	i := strings.IndexByte(in, '=')
+	if i < 0 || i == len(in)-1 {
+		return customKeyQuery{}, fmt.Errorf("bad key %q, want <type>=<key>", in)
+	}
+	q := customKeyQuery{typ: in[:i], key: in[i+1:]}
+	if !indexfile.IsCustomKeyType(q.typ) {
+		return q, fmt.Errorf("no custom key type %q", q.typ)
+	}
+	return q, nil
 }
 
 // parserLex is used by the parser as a lexer.
@@ -193,6 +480,7 @@ type parserLex struct {
 	pos int
 	out Query
 	err error
+	name bool  // The next token is a NAME, like a domain name or hash
 }
 
 // tokens provides a simple map for adding new keywords and mapping them
@@ -203,18 +491,36 @@ var tokens = map[string]int{
  "&&": AND,
  "and": AND,
  "before": BEFORE,
+ "community_id": COMMUNITYID,
+ "dns.name": DNSNAME,
+ "dns.resolved": DNSRESOLVED,
+ "ether": ETHER,
  "host": HOST,
+ "http.host": HTTPHOST,
+ "http.method": HTTPMETHOD,
+ "http.path": HTTPPATH,
  "icmp": ICMP,
+ "inner": INNER,
  "ip": IPP,
+ "key": KEY,
+ "len": LEN,
+ ">=": GE,
+ "<=": LE,
  "mask": MASK,
  "net": NET,
  "||": OR,
  "or": OR,
+ "outer": OUTER,
  "port": PORT,
+ "portrange": PORTRANGE,
  "vlan": VLAN,
  "mpls": MPLS,
  "proto": PROTO,
  "tcp": TCP,
+ "tcpflags": TCPFLAGS,
+ "tls.ja3": TLSJA3,
+ "tls.ja3s": TLSJA3S,
+ "tls.sni": TLSSNI,
  "udp": UDP,
 }
 
@@ -227,12 +533,48 @@ func (x *parserLex) Lex(yylval *parserSymType) (ret int) {
 	for x.pos < len(x.in) && unicode.IsSpace(rune(x.in[x.pos])) {
 		x.pos++
 	}
-	for t, i := range tokens {
-		if strings.HasPrefix(x.in[x.pos:], t) {
-			x.pos += len(t)
-			return i
+	if x.name {
+		// Names are anything up to the next space or paren, validated by
+		// the parser.
+		x.name = false
+		s := x.pos
+		for x.pos < len(x.in) && !unicode.IsSpace(rune(x.in[x.pos])) && x.in[x.pos] != '(' && x.in[x.pos] != ')' {
+			x.pos++
+		}
+		yylval.str = x.in[s:x.pos]
+		return NAME
+	}
+	// The longest keyword matching wins, so "portrange" isn't lexed as
+	// "port".
+	var keyword string
+	for t := range tokens {
+		if strings.HasPrefix(x.in[x.pos:], t) && len(t) > len(keyword) {
+			keyword = t
+		}
+	}
+	for _, f := range tcpFlagNames {
+		if strings.HasPrefix(x.in[x.pos:], f.name) && len(f.name) > len(keyword) {
+			keyword = f.name
+			yylval.num = int(f.flag)
 		}
 	}
+	if keyword != "" {
+		x.pos += len(keyword)
+		if tok, ok := tokens[keyword]; ok {
+			switch tok {
+			case DNSNAME, DNSRESOLVED, TLSSNI, TLSJA3, TLSJA3S, HTTPHOST, HTTPMETHOD, HTTPPATH, COMMUNITYID, KEY:
+				x.name = true
+			}
+			return tok
+		}
+		return FLAG
+	}
+	if x.pos < len(x.in) && x.in[x.pos] == '-' {
+		// Separates the ends of a port range.  Times hold '-', but never
+		// start with it.
+		x.pos++
+		return '-'
+	}
 	s := x.pos
 	var isIP, isDuration, isTime bool
 L:
@@ -241,7 +583,8 @@ L:
 		case ':', '.':
 			isIP = true
 			x.pos++
-		case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9', 'a', 'b', 'c', 'd', 'e', 'f':
+		case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9', 'a', 'b', 'c', 'd', 'e', 'f',
+			'A', 'B', 'C', 'D', 'E', 'F':
 			x.pos++
 		case 'm', 'h':
 			x.pos++
@@ -255,6 +598,11 @@ L:
 		}
 	}
 	part := x.in[s:x.pos]
+	if i := strings.IndexByte(part, '-'); isTime && !isIP && i > 0 && isDigits(part[:i]) && isDigits(part[i+1:]) {
+		// A range of numbers, not a time: lex the first number alone.
+		x.pos, part = s+i, part[:i]
+		isTime = false
+	}
 	switch {
 	case isTime:
 		t, err := time.Parse(time.RFC3339, part)
@@ -264,6 +612,10 @@ L:
 		yylval.time = t
 		return TIME
 	case isIP:
+		if mac, err := net.ParseMAC(part); err == nil && len(mac) == 6 {
+			yylval.mac = mac
+			return MAC
+		}
 		yylval.ip = net.ParseIP(part)
 		if yylval.ip == nil {
 			x.Error(fmt.Sprintf("bad IP %q", part))
@@ -289,13 +641,23 @@ L:
 		return 0
 	}
 	switch c := x.in[x.pos]; c {
-	case ':', '.', '(', ')', '/':
+	case ':', '.', '(', ')', '/', '!', '<', '>':
 		x.pos++
 		return int(c)
 	}
 	return -1
 }
 
+// isDigits returns true if s is a non-empty string of decimal digits.
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
 // Error is called by the parser on a parse error.
 func (x *parserLex) Error(s string) {
 	if x.err == nil {
@@ -12,16 +12,22 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-//go:generate go tool yacc -p parser parser.y
+//go:generate goyacc -p parser -o y.go parser.y
 //go:generate go fmt y.go
 
 // Package query provides objects for specifying a query against stenographer.
 package query
 
 import (
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
+	"math"
 	"net"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -40,6 +46,7 @@ var (
 	indexSetLookupsStarted   = stats.S.Get("index_set_lookups_started")
 	indexSetLookupsFinished  = stats.S.Get("index_set_lookups_finished")
 	indexSetLookupNanos      = stats.S.Get("index_set_lookup_nanos")
+	indexScannedLookups      = stats.S.Get("index_scanned_lookups")
 )
 
 // Query encodes the set of packets a requester wants to get from stenographer.
@@ -85,6 +92,24 @@ func (q portQuery) LookupIn(ctx context.Context, index *indexfile.IndexFile) (bp
 func (q portQuery) String() string { return fmt.Sprintf("port %d", q) }
 func (q portQuery) base() bool     { return true }
 
+type portRangeQuery [2]uint16
+
+func (q portRangeQuery) LookupIn(ctx context.Context, index *indexfile.IndexFile) (bp base.Positions, err error) {
+	defer log(q, index, &bp, &err)()
+	return index.PortRangePositions(ctx, q[0], q[1])
+}
+func (q portRangeQuery) String() string { return fmt.Sprintf("portrange %d-%d", q[0], q[1]) }
+func (q portRangeQuery) base() bool     { return true }
+
+type macQuery net.HardwareAddr
+
+func (q macQuery) LookupIn(ctx context.Context, index *indexfile.IndexFile) (bp base.Positions, err error) {
+	defer log(q, index, &bp, &err)()
+	return index.MACPositions(ctx, net.HardwareAddr(q))
+}
+func (q macQuery) String() string { return fmt.Sprintf("ether host %v", net.HardwareAddr(q)) }
+func (q macQuery) base() bool     { return true }
+
 type vlanQuery uint16
 
 func (q vlanQuery) LookupIn(ctx context.Context, index *indexfile.IndexFile) (bp base.Positions, err error) {
@@ -94,6 +119,16 @@ func (q vlanQuery) LookupIn(ctx context.Context, index *indexfile.IndexFile) (bp
 func (q vlanQuery) String() string { return fmt.Sprintf("vlan %d", q) }
 func (q vlanQuery) base() bool     { return true }
 
+// taggedQuery matches packets with any VLAN tag.
+type taggedQuery struct{}
+
+func (q taggedQuery) LookupIn(ctx context.Context, index *indexfile.IndexFile) (bp base.Positions, err error) {
+	defer log(q, index, &bp, &err)()
+	return index.TaggedPositions(ctx)
+}
+func (q taggedQuery) String() string { return "vlan" }
+func (q taggedQuery) base() bool     { return true }
+
 type mplsQuery uint32
 
 func (q mplsQuery) LookupIn(ctx context.Context, index *indexfile.IndexFile) (bp base.Positions, err error) {
@@ -103,6 +138,16 @@ func (q mplsQuery) LookupIn(ctx context.Context, index *indexfile.IndexFile) (bp
 func (q mplsQuery) String() string { return fmt.Sprintf("mpls %d", q) }
 func (q mplsQuery) base() bool     { return true }
 
+// labeledQuery matches packets with any MPLS label.
+type labeledQuery struct{}
+
+func (q labeledQuery) LookupIn(ctx context.Context, index *indexfile.IndexFile) (bp base.Positions, err error) {
+	defer log(q, index, &bp, &err)()
+	return index.LabeledPositions(ctx)
+}
+func (q labeledQuery) String() string { return "mpls" }
+func (q labeledQuery) base() bool     { return true }
+
 type protocolQuery byte
 
 func (q protocolQuery) LookupIn(ctx context.Context, index *indexfile.IndexFile) (bp base.Positions, err error) {
@@ -112,6 +157,86 @@ func (q protocolQuery) LookupIn(ctx context.Context, index *indexfile.IndexFile)
 func (q protocolQuery) String() string { return fmt.Sprintf("ip proto %d", q) }
 func (q protocolQuery) base() bool     { return true }
 
+// tcpFlagsQuery matches TCP packets with all the flags in q[0] set and all
+// those in q[1] clear.
+type tcpFlagsQuery [2]byte
+
+func (q tcpFlagsQuery) LookupIn(ctx context.Context, index *indexfile.IndexFile) (bp base.Positions, err error) {
+	defer log(q, index, &bp, &err)()
+	return index.TCPFlagsPositions(ctx, q[0], q[1])
+}
+func (q tcpFlagsQuery) String() string {
+	out := "tcpflags"
+	for _, f := range tcpFlagNames {
+		switch {
+		case q[0]&f.flag != 0:
+			out += " " + f.name
+		case q[1]&f.flag != 0:
+			out += " !" + f.name
+		}
+	}
+	return out
+}
+func (q tcpFlagsQuery) base() bool { return true }
+
+// tcpFlagNames are the TCP flags queries can name, in header order.
+var tcpFlagNames = []struct {
+	name string
+	flag byte
+}{
+	{"fin", 0x01},
+	{"syn", 0x02},
+	{"rst", 0x04},
+	{"psh", 0x08},
+	{"ack", 0x10},
+	{"urg", 0x20},
+}
+
+// lengthQuery matches packets with lengths in [q[0], q[1]], where a zero
+// q[1] leaves the range unbounded above.  Lengths are indexed in buckets, so
+// it also matches other packets in the buckets holding its bounds, and its
+// results should be filtered to its range (see LengthRange).
+type lengthQuery [2]int
+
+func (q lengthQuery) LookupIn(ctx context.Context, index *indexfile.IndexFile) (bp base.Positions, err error) {
+	defer log(q, index, &bp, &err)()
+	max := q[1]
+	if max == 0 {
+		max = indexfile.MaxLength
+	}
+	return index.LengthPositions(ctx, q[0], max)
+}
+func (q lengthQuery) String() string {
+	switch {
+	case q[1] == 0:
+		return fmt.Sprintf("len > %d", q[0]-1)
+	case q[0] == 0:
+		return fmt.Sprintf("len < %d", q[1]+1)
+	}
+	return fmt.Sprintf("(len > %d and len < %d)", q[0]-1, q[1]+1)
+}
+func (q lengthQuery) base() bool { return true }
+
+// protoPortQuery matches packets of a protocol, TCP or UDP, with a port in
+// a range: the intersection of a protocolQuery with a portQuery or
+// portRangeQuery, which plan replaces with it.
+type protoPortQuery struct {
+	proto protocolQuery
+	ports portRangeQuery
+}
+
+func (q protoPortQuery) LookupIn(ctx context.Context, index *indexfile.IndexFile) (bp base.Positions, err error) {
+	defer log(q, index, &bp, &err)()
+	return index.ProtoPortRangePositions(ctx, byte(q.proto), q.ports[0], q.ports[1])
+}
+func (q protoPortQuery) String() string {
+	if q.ports[0] == q.ports[1] {
+		return fmt.Sprintf("(%v and %v)", q.proto, portQuery(q.ports[0]))
+	}
+	return fmt.Sprintf("(%v and %v)", q.proto, q.ports)
+}
+func (q protoPortQuery) base() bool { return true }
+
 type ipQuery [2]net.IP
 
 func (q ipQuery) LookupIn(ctx context.Context, index *indexfile.IndexFile) (bp base.Positions, err error) {
@@ -121,22 +246,214 @@ func (q ipQuery) LookupIn(ctx context.Context, index *indexfile.IndexFile) (bp b
 func (q ipQuery) String() string { return fmt.Sprintf("host %v-%v", q[0], q[1]) }
 func (q ipQuery) base() bool     { return true }
 
+type netQuery net.IPNet
+
+func (q *netQuery) LookupIn(ctx context.Context, index *indexfile.IndexFile) (bp base.Positions, err error) {
+	defer log(q, index, &bp, &err)()
+	return index.IPNetPositions(ctx, (*net.IPNet)(q))
+}
+func (q *netQuery) String() string { return "net " + (*net.IPNet)(q).String() }
+func (q *netQuery) base() bool     { return true }
+
+// innerIPQuery, innerNetQuery, innerPortQuery and innerPortRangeQuery are
+// like ipQuery, netQuery, portQuery and portRangeQuery, but match the headers
+// of packets tunneled within others.
+type innerIPQuery [2]net.IP
+
+func (q innerIPQuery) LookupIn(ctx context.Context, index *indexfile.IndexFile) (bp base.Positions, err error) {
+	defer log(q, index, &bp, &err)()
+	return index.InnerIPPositions(ctx, q[0], q[1])
+}
+func (q innerIPQuery) String() string { return "inner " + ipQuery(q).String() }
+func (q innerIPQuery) base() bool     { return true }
+
+type innerNetQuery net.IPNet
+
+func (q *innerNetQuery) LookupIn(ctx context.Context, index *indexfile.IndexFile) (bp base.Positions, err error) {
+	defer log(q, index, &bp, &err)()
+	return index.InnerIPNetPositions(ctx, (*net.IPNet)(q))
+}
+func (q *innerNetQuery) String() string { return "inner " + (*netQuery)(q).String() }
+func (q *innerNetQuery) base() bool     { return true }
+
+type innerPortQuery uint16
+
+func (q innerPortQuery) LookupIn(ctx context.Context, index *indexfile.IndexFile) (bp base.Positions, err error) {
+	defer log(q, index, &bp, &err)()
+	return index.InnerPortPositions(ctx, uint16(q))
+}
+func (q innerPortQuery) String() string { return "inner " + portQuery(q).String() }
+func (q innerPortQuery) base() bool     { return true }
+
+type innerPortRangeQuery [2]uint16
+
+func (q innerPortRangeQuery) LookupIn(ctx context.Context, index *indexfile.IndexFile) (bp base.Positions, err error) {
+	defer log(q, index, &bp, &err)()
+	return index.InnerPortRangePositions(ctx, q[0], q[1])
+}
+func (q innerPortRangeQuery) String() string { return "inner " + portRangeQuery(q).String() }
+func (q innerPortRangeQuery) base() bool     { return true }
+
+// dnsNameQuery matches DNS messages asking about a name, or if subdomains is
+// set, about any name under it.
+type dnsNameQuery struct {
+	name       string // Lowercased, without a trailing dot
+	subdomains bool
+}
+
+func (q dnsNameQuery) LookupIn(ctx context.Context, index *indexfile.IndexFile) (bp base.Positions, err error) {
+	defer log(q, index, &bp, &err)()
+	return index.DNSNamePositions(ctx, q.name, q.subdomains)
+}
+func (q dnsNameQuery) String() string { return "dns.name " + q.pattern() }
+func (q dnsNameQuery) base() bool     { return true }
+
+// pattern returns the names q matches, as a query gives them.
+func (q dnsNameQuery) pattern() string {
+	if q.subdomains {
+		return "*." + q.name
+	}
+	return q.name
+}
+
+// dnsResolvedQuery matches packets to or from the addresses DNS responses gave
+// for the names a dnsNameQuery would match.  Only responses indexed in the
+// same file count, and answers must be indexed (see
+// indexfile.BuilderOptions).
+type dnsResolvedQuery dnsNameQuery
+
+func (q dnsResolvedQuery) LookupIn(ctx context.Context, index *indexfile.IndexFile) (bp base.Positions, err error) {
+	defer log(q, index, &bp, &err)()
+	ips, err := index.DNSAnswers(ctx, q.name, q.subdomains)
+	if err != nil {
+		return nil, err
+	}
+	positions := &base.PositionSet{}
+	for _, ip := range ips {
+		pos, err := index.IPPositions(ctx, ip, ip)
+		if err != nil {
+			return nil, err
+		}
+		positions.Union(base.NewPositionSet(pos))
+	}
+	return positions.Positions(), nil
+}
+func (q dnsResolvedQuery) String() string { return "dns.resolved " + dnsNameQuery(q).pattern() }
+func (q dnsResolvedQuery) base() bool     { return true }
+
+// tlsServerNameQuery matches TLS ClientHellos asking for a server name, or
+// any under it, as dnsNameQuery matches DNS messages.
+type tlsServerNameQuery dnsNameQuery
+
+func (q tlsServerNameQuery) LookupIn(ctx context.Context, index *indexfile.IndexFile) (bp base.Positions, err error) {
+	defer log(q, index, &bp, &err)()
+	return index.TLSServerNamePositions(ctx, q.name, q.subdomains)
+}
+func (q tlsServerNameQuery) String() string { return "tls.sni " + dnsNameQuery(q).pattern() }
+func (q tlsServerNameQuery) base() bool     { return true }
+
+// ja3Query matches TLS ClientHellos whose JA3 fingerprint has an MD5 hash.
+type ja3Query [md5.Size]byte
+
+func (q ja3Query) LookupIn(ctx context.Context, index *indexfile.IndexFile) (bp base.Positions, err error) {
+	defer log(q, index, &bp, &err)()
+	return index.JA3Positions(ctx, q)
+}
+func (q ja3Query) String() string { return "tls.ja3 " + hex.EncodeToString(q[:]) }
+func (q ja3Query) base() bool     { return true }
+
+// ja3sQuery matches TLS ServerHellos whose JA3S fingerprint has an MD5 hash.
+type ja3sQuery [md5.Size]byte
+
+func (q ja3sQuery) LookupIn(ctx context.Context, index *indexfile.IndexFile) (bp base.Positions, err error) {
+	defer log(q, index, &bp, &err)()
+	return index.JA3SPositions(ctx, q)
+}
+func (q ja3sQuery) String() string { return "tls.ja3s " + hex.EncodeToString(q[:]) }
+func (q ja3sQuery) base() bool     { return true }
+
+// httpHostQuery matches plaintext HTTP requests for a host, or any under it,
+// as dnsNameQuery matches DNS messages.
+type httpHostQuery dnsNameQuery
+
+func (q httpHostQuery) LookupIn(ctx context.Context, index *indexfile.IndexFile) (bp base.Positions, err error) {
+	defer log(q, index, &bp, &err)()
+	return index.HTTPHostPositions(ctx, q.name, q.subdomains)
+}
+func (q httpHostQuery) String() string { return "http.host " + dnsNameQuery(q).pattern() }
+func (q httpHostQuery) base() bool     { return true }
+
+// httpMethodQuery matches plaintext HTTP requests with a method.
+type httpMethodQuery string
+
+func (q httpMethodQuery) LookupIn(ctx context.Context, index *indexfile.IndexFile) (bp base.Positions, err error) {
+	defer log(q, index, &bp, &err)()
+	return index.HTTPMethodPositions(ctx, string(q))
+}
+func (q httpMethodQuery) String() string { return "http.method " + string(q) }
+func (q httpMethodQuery) base() bool     { return true }
+
+// httpPathQuery matches plaintext HTTP requests for a path, or if prefix is
+// set, for any path starting with it.
+type httpPathQuery struct {
+	path   string
+	prefix bool
+}
+
+func (q httpPathQuery) LookupIn(ctx context.Context, index *indexfile.IndexFile) (bp base.Positions, err error) {
+	defer log(q, index, &bp, &err)()
+	return index.HTTPPathPositions(ctx, q.path, q.prefix)
+}
+func (q httpPathQuery) String() string {
+	if q.prefix {
+		return "http.path " + q.path + "*"
+	}
+	return "http.path " + q.path
+}
+func (q httpPathQuery) base() bool { return true }
+
+// communityIDQuery matches the packets of a flow, by the SHA-1 hash its
+// version 1 Community ID encodes.
+type communityIDQuery [sha1.Size]byte
+
+func (q communityIDQuery) LookupIn(ctx context.Context, index *indexfile.IndexFile) (bp base.Positions, err error) {
+	defer log(q, index, &bp, &err)()
+	return index.CommunityIDPositions(ctx, q)
+}
+func (q communityIDQuery) String() string {
+	return "community_id 1:" + base64.StdEncoding.EncodeToString(q[:])
+}
+func (q communityIDQuery) base() bool { return true }
+
+// customKeyQuery matches packets a custom indexer indexed under a key of one
+// of its types (see indexfile.Indexer).
+type customKeyQuery struct {
+	typ, key string
+}
+
+func (q customKeyQuery) LookupIn(ctx context.Context, index *indexfile.IndexFile) (bp base.Positions, err error) {
+	defer log(q, index, &bp, &err)()
+	return index.CustomKeyPositions(ctx, q.typ, []byte(q.key))
+}
+func (q customKeyQuery) String() string { return "key " + q.typ + "=" + q.key }
+func (q customKeyQuery) base() bool     { return true }
+
 type unionQuery []Query
 
 func (a unionQuery) LookupIn(ctx context.Context, index *indexfile.IndexFile) (bp base.Positions, err error) {
 	defer log(a, index, &bp, &err)()
-	var positions base.Positions
+	positions := &base.PositionSet{}
 	for _, query := range a {
 		pos, err := query.LookupIn(ctx, index)
 		if err != nil {
 			return nil, err
 		}
-		positions = positions.Union(pos)
-		if positions.IsAllPositions() {
+		positions.Union(base.NewPositionSet(pos))
+		if positions.IsAll() {
 			break
 		}
 	}
-	return positions, nil
+	return positions.Positions(), nil
 }
 func (a unionQuery) String() string {
 	all := make([]string, len(a))
@@ -151,18 +468,18 @@ type intersectQuery []Query
 
 func (a intersectQuery) LookupIn(ctx context.Context, index *indexfile.IndexFile) (bp base.Positions, err error) {
 	defer log(a, index, &bp, &err)()
-	positions := base.AllPositions
-	for _, query := range a {
+	positions := base.NewPositionSet(base.AllPositions)
+	for _, query := range a.byCost(index) {
 		pos, err := query.LookupIn(ctx, index)
 		if err != nil {
 			return nil, err
 		}
-		positions = positions.Intersect(pos)
+		positions.Intersect(base.NewPositionSet(pos))
 		if positions.Len() == 0 {
 			break
 		}
 	}
-	return positions, nil
+	return positions.Positions(), nil
 }
 func (a intersectQuery) String() string {
 	all := make([]string, len(a))
@@ -177,6 +494,18 @@ type timeQuery [2]time.Time
 
 func (a timeQuery) LookupIn(ctx context.Context, index *indexfile.IndexFile) (bp base.Positions, err error) {
 	defer log(a, index, &bp, &err)()
+	// Files spanning more than a minute record their packets' times, which
+	// select them exactly.
+	if first, last, ok, err := index.TimeRange(); err != nil {
+		return nil, fmt.Errorf("could not read time range: %v", err)
+	} else if ok {
+		if !a[0].IsZero() && last.Before(a[0]) || !a[1].IsZero() && !first.Before(a[1]) {
+			v(2, "time query skipping %q", index.Name())
+			return base.NoPositions, nil
+		}
+		v(2, "time query using %q", index.Name())
+		return base.AllPositions, nil
+	}
 	last := filepath.Base(index.Name())
 	intval, err := strconv.ParseInt(last, 10, 64)
 	if err != nil {
@@ -198,13 +527,428 @@ func (a timeQuery) LookupIn(ctx context.Context, index *indexfile.IndexFile) (bp
 	return base.AllPositions, nil
 }
 func (a timeQuery) String() string {
-	if a[0].IsZero() {
-		return fmt.Sprintf("before %v", a[1].Format(time.RFC3339))
+	switch {
+	case a[0].IsZero():
+		return fmt.Sprintf("before %v", a[1].Format(time.RFC3339Nano))
+	case a[1].IsZero():
+		return fmt.Sprintf("after %v", a[0].Format(time.RFC3339Nano))
 	}
-	return fmt.Sprintf("after %v", a[0].Format(time.RFC3339))
+	return fmt.Sprintf("(after %v and before %v)", a[0].Format(time.RFC3339Nano), a[1].Format(time.RFC3339Nano))
 }
 func (a timeQuery) base() bool { return true }
 
+// NewTimeRangeQuery returns a query matching every packet in [start, end),
+// either of which may be zero to leave that side unbounded.  Like "after" and
+// "before", it selects whole blockfiles without reading their indexes'
+// positions, so its results should be filtered to the range too (see
+// TimeRange).
+func NewTimeRangeQuery(start, end time.Time) Query {
+	return timeQuery{start, end}
+}
+
+// TimeRange returns the range [start, end) outside of which no packet can
+// match q, based on the time constraints ("after", "before") it contains.  A
+// zero start or end means that side is unbounded.  Time queries only select
+// whole blockfiles, so results should be filtered to this range (see
+// base.TimeRangeChan) to drop packets at the edges of those files.
+func TimeRange(q Query) (start, end time.Time) {
+	switch q := q.(type) {
+	case timeQuery:
+		return q[0], q[1]
+	case intersectQuery:
+		for _, sub := range q {
+			s, e := TimeRange(sub)
+			if s.After(start) {
+				start = s
+			}
+			if !e.IsZero() && (end.IsZero() || e.Before(end)) {
+				end = e
+			}
+		}
+		return start, end
+	case unionQuery:
+		for i, sub := range q {
+			s, e := TimeRange(sub)
+			if i == 0 {
+				start, end = s, e
+				continue
+			}
+			// The zero time is before all others, so an unbounded start
+			// wins naturally; an unbounded end has to be kept explicitly.
+			if s.Before(start) {
+				start = s
+			}
+			if e.IsZero() || end.IsZero() {
+				end = time.Time{}
+			} else if e.After(end) {
+				end = e
+			}
+		}
+		return start, end
+	}
+	return time.Time{}, time.Time{}
+}
+
+// LengthRange returns the range [min, max] of lengths outside of which no
+// packet can match q, based on the length constraints ("len >", "len <") it
+// contains.  A zero max means it's unbounded above.  Lengths are indexed in
+// buckets, so results should be filtered to this range (see
+// base.LengthRangeChan) to drop packets in the buckets at its edges.  Like
+// TimeRange, a union with unconstrained queries is unconstrained, so such
+// queries can still return packets of other lengths.
+func LengthRange(q Query) (min, max int) {
+	switch q := q.(type) {
+	case lengthQuery:
+		return q[0], q[1]
+	case intersectQuery:
+		for _, sub := range q {
+			n, x := LengthRange(sub)
+			if n > min {
+				min = n
+			}
+			if x != 0 && (max == 0 || x < max) {
+				max = x
+			}
+		}
+		return min, max
+	case unionQuery:
+		for i, sub := range q {
+			n, x := LengthRange(sub)
+			if i == 0 {
+				min, max = n, x
+				continue
+			}
+			if n < min {
+				min = n
+			}
+			if x == 0 || max == 0 {
+				max = 0
+			} else if x > max {
+				max = x
+			}
+		}
+		return min, max
+	}
+	return 0, 0
+}
+
+// MayMatch returns false if an index's IP filter rules out q matching any of
+// its packets, from the IPs q needs (see indexfile.IPFilter.MayHoldIPs), so
+// files it rules out needn't be opened.
+func MayMatch(q Query, f indexfile.IPFilter) bool {
+	switch q := q.(type) {
+	case ipQuery:
+		return f.MayHoldIPs(q[0], q[1], false)
+	case innerIPQuery:
+		return f.MayHoldIPs(q[0], q[1], true)
+	case *netQuery:
+		from, to := netRange((*net.IPNet)(q))
+		return f.MayHoldIPs(from, to, false)
+	case *innerNetQuery:
+		from, to := netRange((*net.IPNet)(q))
+		return f.MayHoldIPs(from, to, true)
+	case intersectQuery:
+		for _, sub := range q {
+			if !MayMatch(sub, f) {
+				return false
+			}
+		}
+		return true
+	case unionQuery:
+		for _, sub := range q {
+			if MayMatch(sub, f) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// netRange returns the first and last IPs of a network.
+func netRange(n *net.IPNet) (from, to net.IP) {
+	ip := n.IP
+	if ip4 := ip.To4(); ip4 != nil && len(n.Mask) == net.IPv4len {
+		ip = ip4
+	}
+	if len(ip) != len(n.Mask) {
+		return nil, nil // Never ruled out
+	}
+	from, to = make(net.IP, len(ip)), make(net.IP, len(ip))
+	for i := range ip {
+		from[i] = ip[i] & n.Mask[i]
+		to[i] = from[i] | ^n.Mask[i]
+	}
+	return from, to
+}
+
+// Lookup returns the positions in an index's blockfile of the packets
+// matching q.  Unlike q.LookupIn, it answers queries needing keys the index
+// doesn't hold (see indexfile.ErrNotIndexed), by looking up those parts of q
+// in an index of the packets which could match the rest, built by scan from
+// the packets themselves with indexfile.NewScanBuilder(keys), keys being
+// those the index was missing.  So files written before a key type was
+// added, or without it configured, return the same packets as files indexed
+// by it, only more slowly.  dns.resolved is the exception: it matches packets
+// by the answers of others, so it can't be answered from the packets it
+// matches, and finds none in indexes without DNS answers.
+func Lookup(ctx context.Context, q Query, index *indexfile.IndexFile, scan func(candidates base.Positions, keys *indexfile.ScanKeys) (*indexfile.IndexFile, error)) (base.Positions, error) {
+	keys := &indexfile.ScanKeys{}
+	positions, exact, err := lookup(indexfile.WithScanKeys(ctx, keys), q, index, nil)
+	if err != nil || exact {
+		return positions, err
+	}
+	indexScannedLookups.Increment()
+	v(2, "Query %q needs keys %q doesn't hold, scanning %d packets", q, index.Name(), len(positions))
+	scanned, err := scan(positions, keys)
+	if err != nil {
+		return nil, fmt.Errorf("could not scan packets: %v", err)
+	}
+	defer scanned.Close()
+	positions, _, err = lookup(ctx, q, index, scanned)
+	return positions, err
+}
+
+// lookup returns the positions of the packets in index matching q, and
+// whether they're exact.  Base queries the index can't answer are looked up
+// in scanned instead, or match every packet if it's nil, so the positions
+// returned are only candidates.  Since matching packets are among the
+// candidates, parts of q looked up in an index of just those packets still
+// match all they should.
+func lookup(ctx context.Context, q Query, index, scanned *indexfile.IndexFile) (_ base.Positions, exact bool, _ error) {
+	switch q := q.(type) {
+	case unionQuery:
+		positions, exact := &base.PositionSet{}, true
+		for _, sub := range q {
+			pos, ok, err := lookup(ctx, sub, index, scanned)
+			if err != nil {
+				return nil, false, err
+			}
+			exact = exact && ok
+			positions.Union(base.NewPositionSet(pos))
+			// Inexact results go on, so every key type the rest need
+			// is recorded for the scan.
+			if positions.IsAll() && exact {
+				break
+			}
+		}
+		return positions.Positions(), exact, nil
+	case intersectQuery:
+		positions, exact := base.NewPositionSet(base.AllPositions), true
+		for _, sub := range q.byCost(index) {
+			pos, ok, err := lookup(ctx, sub, index, scanned)
+			if err != nil {
+				return nil, false, err
+			}
+			exact = exact && ok
+			positions.Intersect(base.NewPositionSet(pos))
+			if positions.Len() == 0 {
+				return nil, true, nil
+			}
+		}
+		return positions.Positions(), exact, nil
+	}
+	positions, err := q.LookupIn(ctx, index)
+	if err != indexfile.ErrNotIndexed {
+		return positions, true, err
+	} else if scanned == nil {
+		return base.AllPositions, false, nil
+	}
+	positions, err = q.LookupIn(ctx, scanned)
+	return positions, true, err
+}
+
+// plan returns a query matching the same packets as q, which is cheaper to
+// look up.  Nested intersections are flattened, so all their subqueries are
+// considered together, and a TCP or UDP protocol intersected with ports is
+// replaced by protocol+port lookups, which read far fewer positions than the
+// protocol's alone.
+func plan(q Query) Query {
+	switch q := q.(type) {
+	case unionQuery:
+		out := make(unionQuery, len(q))
+		for i, sub := range q {
+			out[i] = plan(sub)
+		}
+		return out
+	case intersectQuery:
+		return planIntersect(flatten(nil, q))
+	}
+	return q
+}
+
+// flatten appends the subqueries of q to out, planned, replacing those which
+// are intersections with their own subqueries.
+func flatten(out, q intersectQuery) intersectQuery {
+	for _, sub := range q {
+		if in, ok := sub.(intersectQuery); ok {
+			out = flatten(out, in)
+		} else {
+			out = append(out, plan(sub))
+		}
+	}
+	return out
+}
+
+// planIntersect merges a flattened intersection's TCP or UDP protocol into
+// its ports, if it has one protocol and any ports.
+func planIntersect(q intersectQuery) Query {
+	var proto protocolQuery
+	ports := 0
+	for _, sub := range q {
+		switch sub := sub.(type) {
+		case protocolQuery:
+			if proto != 0 && proto != sub || (sub != 6 && sub != 17) {
+				return q
+			}
+			proto = sub
+		case portQuery, portRangeQuery:
+			ports++
+		}
+	}
+	if proto == 0 || ports == 0 {
+		return q
+	}
+	var out intersectQuery
+	for _, sub := range q {
+		switch sub := sub.(type) {
+		case protocolQuery:
+			// Each port carries it instead.
+		case portQuery:
+			out = append(out, protoPortQuery{proto, portRangeQuery{uint16(sub), uint16(sub)}})
+		case portRangeQuery:
+			out = append(out, protoPortQuery{proto, sub})
+		default:
+			out = append(out, sub)
+		}
+	}
+	if len(out) == 1 {
+		return out[0]
+	}
+	return out
+}
+
+// byCost returns a's subqueries, cheapest to look up in index first, if the
+// index's stats are known (see indexfile.IndexFile.Stats), or else as they
+// are.  Intersections stop once no positions are left, so the most selective
+// subqueries are best looked up first, and the broadest may never be.
+func (a intersectQuery) byCost(index *indexfile.IndexFile) intersectQuery {
+	s, ok := index.KnownStats()
+	if !ok || len(a) < 2 {
+		return a
+	}
+	type costed struct {
+		q    Query
+		cost int64
+	}
+	subs := make([]costed, len(a))
+	for i, sub := range a {
+		subs[i] = costed{sub, cost(sub, &s)}
+	}
+	sort.SliceStable(subs, func(i, j int) bool { return subs[i].cost < subs[j].cost })
+	order := make(intersectQuery, len(a))
+	for i, sub := range subs {
+		order[i] = sub.q
+	}
+	return order
+}
+
+// cost estimates how many positions looking up q reads, from an index's
+// stats.  Time queries read none, and queries whose keys the stats can't
+// tell about are taken to read everything.
+func cost(q Query, s *indexfile.Stats) int64 {
+	switch q := q.(type) {
+	case timeQuery:
+		return 0
+	case unionQuery:
+		var sum int64
+		for _, sub := range q {
+			c := cost(sub, s)
+			if c == math.MaxInt64 {
+				return c
+			}
+			sum += c
+		}
+		return sum
+	case intersectQuery:
+		min := int64(math.MaxInt64)
+		for _, sub := range q {
+			if c := cost(sub, s); c < min {
+				min = c
+			}
+		}
+		return min
+	case portQuery:
+		return s.Estimate("port", true)
+	case innerPortQuery:
+		return s.Estimate("inner_port", true)
+	case portRangeQuery:
+		return s.Estimate("port", q[0] == q[1])
+	case innerPortRangeQuery:
+		return s.Estimate("inner_port", q[0] == q[1])
+	case protoPortQuery:
+		if _, ok := s.KeyTypes["proto_port"]; !ok {
+			// Older indexes look up the protocol and ports instead.
+			return s.Estimate("protocol", true)
+		}
+		return s.Estimate("proto_port", q.ports[0] == q.ports[1])
+	case macQuery:
+		return s.Estimate("mac", true)
+	case vlanQuery:
+		return s.Estimate("vlan", true)
+	case mplsQuery:
+		return s.Estimate("mpls", true)
+	case protocolQuery:
+		return s.Estimate("protocol", true)
+	case taggedQuery:
+		return s.Estimate("vlan", false)
+	case labeledQuery:
+		return s.Estimate("mpls", false)
+	case tcpFlagsQuery:
+		return s.Estimate("tcp_flags", false)
+	case lengthQuery:
+		return s.Estimate("length", false)
+	case ipQuery:
+		return ipCost(q[0], q[1], "", s)
+	case innerIPQuery:
+		return ipCost(q[0], q[1], "inner_", s)
+	case *netQuery:
+		return ipCost(q.IP, nil, "", s)
+	case *innerNetQuery:
+		return ipCost(q.IP, nil, "inner_", s)
+	case dnsNameQuery:
+		return s.Estimate("dns_name", !q.subdomains)
+	case tlsServerNameQuery:
+		return s.Estimate("tls_server_name", !q.subdomains)
+	case httpHostQuery:
+		return s.Estimate("http_host", !q.subdomains)
+	case httpMethodQuery:
+		return s.Estimate("http_method", true)
+	case httpPathQuery:
+		return s.Estimate("http_path", !q.prefix)
+	case ja3Query:
+		return s.Estimate("ja3", true)
+	case ja3sQuery:
+		return s.Estimate("ja3s", true)
+	case communityIDQuery:
+		return s.Estimate("community_id", true)
+	case customKeyQuery:
+		return s.Estimate(q.typ, true)
+	}
+	return math.MaxInt64
+}
+
+// ipCost estimates the cost of looking up IPs from 'from' to 'to', or in a
+// network starting at 'from' if 'to' is nil, with key types named with
+// 'prefix'.
+func ipCost(from, to net.IP, prefix string, s *indexfile.Stats) int64 {
+	typ := prefix + "ipv6"
+	if from.To4() != nil {
+		typ = prefix + "ipv4"
+	}
+	return s.Estimate(typ, to != nil && from.Equal(to))
+}
+
 // NewQuery parses the given query arg and returns a query object.
 // This query can then be passed into a blockfile to get out the set of packets
 // which match it.
@@ -212,5 +956,9 @@ func (a timeQuery) base() bool { return true }
 // Currently, we support one simple method of parsing a query, detailed in the
 // README.md file.  Returns an error if the query string is invalid.
 func NewQuery(query string) (Query, error) {
-	return parse(query)
+	q, err := parse(query)
+	if err != nil {
+		return nil, err
+	}
+	return plan(q), nil
 }
@@ -15,16 +15,52 @@
 package query
 
 import (
+	"math"
+	"reflect"
 	"testing"
+	"time"
+
+	"github.com/google/stenographer/base"
+	"github.com/google/stenographer/indexfile"
+	"golang.org/x/net/context"
 )
 
 func TestParsingValidQueries(t *testing.T) {
 	for _, test := range []string{
 		"net 1.2.3.4/8",
 		"net 1.2.3.4 mask 255.255.254.0",
+		"net 2001:db8::/32",
+		"ether host 00:1b:21:3a:4f:5e",
+		"ether host de:ad:be:ef:00:01 and udp",
 		"host 1.2.3.4",
 		"port 80",
+		"portrange 6000-6063",
+		"portrange 80-80 and tcp",
 		"ip proto 6",
+		"vlan 120",
+		"vlan 120 and host 1.2.3.4 and port 80",
+		"vlan and udp",
+		"mpls 17",
+		"mpls and host 1.2.3.4",
+		"inner host 10.0.0.1 and host 192.168.1.1",
+		"inner (net 10.0.0.0/8 or port 80) and udp",
+		"dns.name example.com",
+		"dns.name *.Example.COM. and udp",
+		"(dns.name evil.example)",
+		"dns.resolved evil.example and port 443",
+		"tls.sni *.example.com and port 443",
+		"tls.ja3 e7d705a3286e19ea42f587b344ee6865",
+		"http.host *.example.com and http.method post",
+		"http.path /wp-login.php or http.path /admin/*",
+		"(http.path /)",
+		"community_id 1:LQU9qZlK+B5F3KDmev6m5PMibrg= or community_id 1:d/FP5EW3wiY1vCndhwleRRKHowQ=",
+		"key sip.callid=a84b4c76e66710@10.0.0.1 and udp",
+		"tls.ja3s E7D705A3286E19EA42F587B344EE6865 or tls.sni example.com",
+		"outer portrange 1-1023",
+		"tcpflags syn !ack and net 10.0.0.0/8 and after 3h ago",
+		"tcpflags rst",
+		"len > 1000 and host 1.2.3.4 and host 5.6.7.8",
+		"len >= 1 or len < 65 or len <= 64",
 		"tcp",
 		"udp",
 		"icmp",
@@ -50,8 +86,45 @@ func TestParsingInvalidQuery(t *testing.T) {
 	for _, test := range []string{
 		"host 1.2.3",
 		"net 1.2.3.4/44",
+		"net 1.2.3.4 mask 255.0.255.0",
 		"port 8 and port 77777",
 		"port 77777 and port 8",
+		"portrange 6063-6000",
+		"portrange 1-65536",
+		"portrange 80",
+		"ether host 1.2.3.4",
+		"vlan 4096",
+		"mpls 1048576",
+		"inner tcp",
+		"dns.name",
+		"dns.name a..b",
+		"dns.name *",
+		"dns.name *.*.example.com",
+		"inner dns.name example.com",
+		"tls.sni",
+		"http.method G3T",
+		"http.path login.php",
+		"http.path /a?b=c",
+		"http.path /a*b",
+		"community_id LQU9qZlK+B5F3KDmev6m5PMibrg=",
+		"community_id 1:LQU9qZlK+B5F3KDmev6m5PMib=",
+		"community_id 2:LQU9qZlK+B5F3KDmev6m5PMibrg=",
+		"key sip.callid",
+		"key sip.callid=",
+		"key nonexistent.type=abc",
+		"tls.ja3 e7d705a3",
+		"tls.ja3 e7d705a3286e19ea42f587b344ee686z",
+		"inner (port 80 and vlan 5)",
+		"outer after 3h ago",
+		"tcpflags",
+		"tcpflags syn !syn",
+		"tcpflags !ack ack",
+		"syn",
+		"len < 1",
+		"len <= 0",
+		"len = 5",
+		"len 10",
+		"ether host 00:1b:21:3a:4f",
 		"protocol -1",
 		"protocol 256",
 		"last 4",
@@ -63,3 +136,214 @@ func TestParsingInvalidQuery(t *testing.T) {
 		}
 	}
 }
+
+func TestQueryString(t *testing.T) {
+	for _, test := range []struct {
+		query, want string
+	}{
+		{"portrange 6000-6063", "portrange 6000-6063"},
+		{"net 10.1.2.3/8", "net 10.0.0.0/8"},
+		{"net 10.1.2.3 mask 255.255.0.0", "net 10.1.0.0/16"},
+		{"net 2001:db8::1/32", "net 2001:db8::/32"},
+		{"ether host 00:1B:21:3A:4F:5E", "ether host 00:1b:21:3a:4f:5e"},
+		{"vlan and vlan 120", "(vlan and vlan 120)"},
+		{"mpls or mpls 17", "(mpls or mpls 17)"},
+		{"inner host 10.0.0.1", "inner host 10.0.0.1-10.0.0.1"},
+		{"inner (net 10.1.2.3/8 or portrange 1-2) and port 4789",
+			"((inner net 10.0.0.0/8 or inner portrange 1-2) and port 4789)"},
+		{"inner port 80 or outer port 80", "(inner port 80 or port 80)"},
+		{"tcpflags !ack syn", "tcpflags syn !ack"},
+		{"tcpflags rst or tcpflags fin ack", "(tcpflags rst or tcpflags fin ack)"},
+		{"len >= 1000", "len > 999"},
+		{"dns.name WWW.Example.com.", "dns.name www.example.com"},
+		{"tls.sni *.Example.COM", "tls.sni *.example.com"},
+		{"http.method post or http.path /admin/*", "(http.method POST or http.path /admin/*)"},
+		{"community_id 1:LQU9qZlK+B5F3KDmev6m5PMibrg=", "community_id 1:LQU9qZlK+B5F3KDmev6m5PMibrg="},
+		{"key sip.callid=abc@host", "key sip.callid=abc@host"},
+		{"tls.ja3s E7D705A3286E19EA42F587B344EE6865", "tls.ja3s e7d705a3286e19ea42f587b344ee6865"},
+		{"dns.resolved *.example.com or dns.name x.org", "(dns.resolved *.example.com or dns.name x.org)"},
+		{"len<=64 and len>0", "(len < 65 and len > 0)"},
+		{"portrange 1-2 and after 2015-01-01T13:14:15Z", "(portrange 1-2 and after 2015-01-01T13:14:15Z)"},
+	} {
+		if q, err := NewQuery(test.query); err != nil {
+			t.Errorf("could not parse %q: %v", test.query, err)
+		} else if got := q.String(); got != test.want {
+			t.Errorf("%q parsed as %q, want %q", test.query, got, test.want)
+		}
+	}
+}
+
+func TestPlan(t *testing.T) {
+	for _, test := range []struct {
+		query string
+		want  Query
+	}{
+		{"tcp and port 80", protoPortQuery{6, portRangeQuery{80, 80}}},
+		{"tcp and tcp and port 1", protoPortQuery{6, portRangeQuery{1, 1}}},
+		{"udp and (portrange 1-2 and vlan 7)", intersectQuery{
+			protoPortQuery{17, portRangeQuery{1, 2}}, vlanQuery(7)}},
+		{"(port 53 and vlan 7) and (udp and port 54)", intersectQuery{
+			protoPortQuery{17, portRangeQuery{53, 53}}, vlanQuery(7),
+			protoPortQuery{17, portRangeQuery{54, 54}}}},
+		{"port 53 or (tcp and port 80)", unionQuery{
+			portQuery(53), protoPortQuery{6, portRangeQuery{80, 80}}}},
+		{"tcp and udp and port 80", intersectQuery{
+			protocolQuery(6), protocolQuery(17), portQuery(80)}},
+		{"icmp and port 80", intersectQuery{protocolQuery(1), portQuery(80)}},
+		{"udp and inner port 80", intersectQuery{protocolQuery(17), innerPortQuery(80)}},
+	} {
+		if q, err := NewQuery(test.query); err != nil {
+			t.Errorf("could not parse %q: %v", test.query, err)
+		} else if !reflect.DeepEqual(q, test.want) {
+			t.Errorf("%q planned as %#v, want %#v", test.query, q, test.want)
+		}
+	}
+}
+
+func TestCost(t *testing.T) {
+	s := &indexfile.Stats{KeyTypes: map[string]indexfile.KeyTypeStats{
+		"protocol":   {Keys: 2, Positions: 1000},
+		"port":       {Keys: 100, Positions: 2000},
+		"proto_port": {Keys: 100, Positions: 1000},
+		"ipv4":       {Keys: 1000, Positions: 4000},
+	}}
+	for _, test := range []struct {
+		query string
+		want  int64
+	}{
+		{"ip proto 6", 500},
+		{"port 80", 20},
+		{"portrange 1-1024", 2000},
+		{"tcp and port 80", 10},
+		{"host 1.2.3.4", 4},
+		{"net 1.2.0.0/16", 4000},
+		{"vlan 7", 0},
+		{"after 3h ago", 0},
+		{"port 80 or host 1.2.3.4", 24},
+		{"ip proto 6 and (port 80 or host 1.2.3.4)", 24},
+		{"dns.resolved example.com", math.MaxInt64},
+		{"port 80 or dns.resolved example.com", math.MaxInt64},
+	} {
+		q, err := NewQuery(test.query)
+		if err != nil {
+			t.Errorf("could not parse %q: %v", test.query, err)
+		} else if got := cost(q, s); got != test.want {
+			t.Errorf("%q costs %d, want %d", test.query, got, test.want)
+		}
+	}
+}
+
+func TestLookupByCost(t *testing.T) {
+	// 1000 TCP packets to port 80, each between IPs of their own, so a host
+	// holds a position on average, and port 80 all of them.
+	b := indexfile.NewBuilder(indexfile.BuilderOptions{})
+	for i := 0; i < 1000; i++ {
+		pkt := make([]byte, 54)
+		copy(pkt[12:], []byte{0x08, 0x00, 0x45, 0, 0, 40, 0, 0, 0, 0, 64, 6})
+		copy(pkt[26:], []byte{10, 1, byte(i >> 8), byte(i), 10, 2, byte(i >> 8), byte(i)})
+		copy(pkt[34:], []byte{0x04, 0xd2, 0, 80, 0, 0, 0, 0, 0, 0, 0, 0, 0x50, 0x02})
+		b.AddPacket(pkt, int64(i+1)*100)
+	}
+	index, err := b.Open("index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	// Reading port 80's positions takes more memory than the budget allows,
+	// so the intersection only succeeds if the index's recorded stats order
+	// the host, which matches nothing, first, without reading Stats.
+	ctx := base.WithMemoryBudget(context.Background(), base.NewMemoryBudget(4<<10, nil))
+	for _, test := range []struct {
+		query string
+		ok    bool
+	}{
+		{"port 80", false},
+		{"port 80 and host 10.9.9.9", true},
+		{"host 10.9.9.9 and port 80", true},
+	} {
+		q, err := NewQuery(test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := Lookup(ctx, q, index, nil)
+		if (err == nil) != test.ok || len(got) != 0 {
+			t.Errorf("%q: got %v, %v", test.query, got, err)
+		}
+	}
+}
+
+func TestTimeRange(t *testing.T) {
+	t1 := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	t2 := t1.Add(time.Hour)
+	var zero time.Time
+	for _, test := range []struct {
+		query      string
+		start, end time.Time
+	}{
+		{"port 80", zero, zero},
+		{"after 2015-01-01T00:00:00Z", t1, zero},
+		{"before 2015-01-01T01:00:00Z", zero, t2},
+		{"port 80 and after 2015-01-01T00:00:00Z and before 2015-01-01T01:00:00Z", t1, t2},
+		{"after 2015-01-01T00:00:00Z and after 2015-01-01T01:00:00Z", t2, zero},
+		{"(port 80 and after 2015-01-01T01:00:00Z) or (port 81 and after 2015-01-01T00:00:00Z)", t1, zero},
+		{"(port 80 and before 2015-01-01T01:00:00Z) or (port 81 and before 2015-01-01T00:00:00Z)", zero, t2},
+		{"after 2015-01-01T00:00:00Z or port 80", zero, zero},
+		{"before 2015-01-01T00:00:00Z or port 80", zero, zero},
+	} {
+		q, err := NewQuery(test.query)
+		if err != nil {
+			t.Fatalf("%q: %v", test.query, err)
+		}
+		if start, end := TimeRange(q); !start.Equal(test.start) || !end.Equal(test.end) {
+			t.Errorf("%q: want [%v, %v) got [%v, %v)", test.query, test.start, test.end, start, end)
+		}
+	}
+}
+
+func TestLengthRange(t *testing.T) {
+	for _, test := range []struct {
+		query    string
+		min, max int
+	}{
+		{"port 80", 0, 0},
+		{"len > 1000", 1001, 0},
+		{"len < 64", 0, 63},
+		{"len > 100 and port 80 and len <= 1500", 101, 1500},
+		{"len > 100 and len > 200", 201, 0},
+		{"len < 100 or len < 200", 0, 199},
+		{"len > 100 or len > 200", 101, 0},
+		{"len > 100 or port 80", 0, 0},
+		{"(len > 100 and len < 200) or (len > 300 and len < 400)", 101, 399},
+	} {
+		q, err := NewQuery(test.query)
+		if err != nil {
+			t.Fatalf("%q: %v", test.query, err)
+		}
+		if min, max := LengthRange(q); min != test.min || max != test.max {
+			t.Errorf("%q: want [%v, %v] got [%v, %v]", test.query, test.min, test.max, min, max)
+		}
+	}
+}
+
+func TestNewTimeRangeQuery(t *testing.T) {
+	t1 := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	t2 := t1.Add(time.Hour)
+	// Sub-second times survive the round trip too.
+	t3 := t1.Add(1500 * time.Millisecond)
+	t4 := t1.Add(time.Nanosecond)
+	var zero time.Time
+	for _, test := range [][2]time.Time{{t1, t2}, {t1, zero}, {zero, t2}, {t4, t3}, {t4, zero}, {zero, t3}} {
+		q := NewTimeRangeQuery(test[0], test[1])
+		if start, end := TimeRange(q); !start.Equal(test[0]) || !end.Equal(test[1]) {
+			t.Errorf("%v: got [%v, %v)", test, start, end)
+		}
+		// Its string form parses back to the same range.
+		parsed, err := NewQuery(q.String())
+		if err != nil {
+			t.Fatalf("%q: %v", q, err)
+		}
+		if start, end := TimeRange(parsed); !start.Equal(test[0]) || !end.Equal(test[1]) {
+			t.Errorf("%q: got [%v, %v)", q, start, end)
+		}
+	}
+}
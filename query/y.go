@@ -1,5 +1,6 @@
-//line parser.y:16
+// Code generated by goyacc -p parser -o y.go parser.y. DO NOT EDIT.
 
+//line parser.y:16
 // Copyright 2014 Google Inc. All rights reserved.
 //
 // Licensed under the Apache License, Version 2.0 (the "License");
@@ -19,50 +20,84 @@ package query
 import __yyfmt__ "fmt"
 
 //line parser.y:30
+
 import (
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"net"
 	"strconv"
 	"strings"
 	"time"
 	"unicode"
+
+	"github.com/google/stenographer/indexfile"
 )
 
-//line parser.y:43
+//line parser.y:49
 type parserSymType struct {
 	yys   int
 	num   int
 	ip    net.IP
+	mac   net.HardwareAddr
 	str   string
 	query Query
+	flags [2]byte
 	dur   time.Duration
 	time  time.Time
 }
 
 const HOST = 57346
 const PORT = 57347
-const PROTO = 57348
-const AND = 57349
-const OR = 57350
-const NET = 57351
-const MASK = 57352
-const TCP = 57353
-const UDP = 57354
-const ICMP = 57355
-const BEFORE = 57356
-const AFTER = 57357
-const IPP = 57358
-const AGO = 57359
-const VLAN = 57360
-const MPLS = 57361
-const IP = 57362
-const NUM = 57363
-const DURATION = 57364
-const TIME = 57365
-
-var parserToknames = []string{
+const PORTRANGE = 57348
+const PROTO = 57349
+const AND = 57350
+const OR = 57351
+const NET = 57352
+const MASK = 57353
+const TCP = 57354
+const UDP = 57355
+const ICMP = 57356
+const BEFORE = 57357
+const AFTER = 57358
+const IPP = 57359
+const AGO = 57360
+const VLAN = 57361
+const MPLS = 57362
+const ETHER = 57363
+const INNER = 57364
+const OUTER = 57365
+const TCPFLAGS = 57366
+const LEN = 57367
+const GE = 57368
+const LE = 57369
+const DNSNAME = 57370
+const DNSRESOLVED = 57371
+const TLSSNI = 57372
+const TLSJA3 = 57373
+const TLSJA3S = 57374
+const HTTPHOST = 57375
+const HTTPMETHOD = 57376
+const HTTPPATH = 57377
+const COMMUNITYID = 57378
+const KEY = 57379
+const NAME = 57380
+const IP = 57381
+const MAC = 57382
+const NUM = 57383
+const FLAG = 57384
+const DURATION = 57385
+const TIME = 57386
+
+var parserToknames = [...]string{
+	"$end",
+	"error",
+	"$unk",
 	"HOST",
 	"PORT",
+	"PORTRANGE",
 	"PROTO",
 	"AND",
 	"OR",
@@ -77,63 +112,216 @@ var parserToknames = []string{
 	"AGO",
 	"VLAN",
 	"MPLS",
+	"ETHER",
+	"INNER",
+	"OUTER",
+	"TCPFLAGS",
+	"LEN",
+	"GE",
+	"LE",
+	"DNSNAME",
+	"DNSRESOLVED",
+	"TLSSNI",
+	"TLSJA3",
+	"TLSJA3S",
+	"HTTPHOST",
+	"HTTPMETHOD",
+	"HTTPPATH",
+	"COMMUNITYID",
+	"KEY",
+	"NAME",
 	"IP",
+	"MAC",
 	"NUM",
+	"FLAG",
 	"DURATION",
 	"TIME",
+	"'-'",
+	"'/'",
+	"'('",
+	"')'",
+	"'>'",
+	"'<'",
+	"'!'",
 }
-var parserStatenames = []string{}
+
+var parserStatenames = [...]string{}
 
 const parserEofCode = 1
 const parserErrCode = 2
-const parserMaxDepth = 200
+const parserInitialStackSize = 16
+
+//line parser.y:354
 
-//line parser.y:172
-func ipsFromNet(ip net.IP, mask net.IPMask) (from, to net.IP, _ error) {
+// newNetQuery returns a query for the network holding ip, whose mask must be
+// a prefix of the same length, since only those networks are a single range
+// of IPs.
+func newNetQuery(ip net.IP, mask net.IPMask) (*netQuery, error) {
 	if len(ip) != len(mask) || (len(ip) != 4 && len(ip) != 16) {
-		return nil, nil, fmt.Errorf("bad IP or mask: %v %v", ip, mask)
+		return nil, fmt.Errorf("bad IP or mask: %v %v", ip, mask)
+	} else if _, bits := mask.Size(); bits == 0 {
+		return nil, fmt.Errorf("mask %v isn't a prefix", mask)
+	}
+	return &netQuery{IP: ip.Mask(mask), Mask: mask}, nil
+}
+
+// newHeaderQuery returns q matching the inner headers of tunneled packets if
+// inner is set, or the outermost headers (as q already does) if not.  Only
+// addresses and ports are indexed for both, so q may only be made of host,
+// net, port and portrange queries.
+func newHeaderQuery(q Query, inner bool) (Query, error) {
+	switch q := q.(type) {
+	case intersectQuery:
+		out := make(intersectQuery, len(q))
+		for i, sub := range q {
+			var err error
+			if out[i], err = newHeaderQuery(sub, inner); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	case unionQuery:
+		out := make(unionQuery, len(q))
+		for i, sub := range q {
+			var err error
+			if out[i], err = newHeaderQuery(sub, inner); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	case ipQuery:
+		if inner {
+			return innerIPQuery(q), nil
+		}
+		return q, nil
+	case *netQuery:
+		if inner {
+			return (*innerNetQuery)(q), nil
+		}
+		return q, nil
+	case portQuery:
+		if inner {
+			return innerPortQuery(q), nil
+		}
+		return q, nil
+	case portRangeQuery:
+		if inner {
+			return innerPortRangeQuery(q), nil
+		}
+		return q, nil
+	}
+	return nil, fmt.Errorf("inner and outer only apply to host, net, port and portrange, not %q", q)
+}
+
+// newDNSNameQuery returns a query for DNS messages asking about 'name', in
+// any case, or if it starts with "*.", about any name under the rest.
+func newDNSNameQuery(name string) (dnsNameQuery, error) {
+	q := dnsNameQuery{name: strings.ToLower(strings.TrimSuffix(name, "."))}
+	if strings.HasPrefix(q.name, "*.") {
+		q.name, q.subdomains = q.name[2:], true
+	}
+	if len(q.name) > 253 {
+		return q, fmt.Errorf("dns name %q too long", name)
+	}
+	for _, label := range strings.Split(q.name, ".") {
+		if label == "" || len(label) > 63 {
+			return q, fmt.Errorf("bad dns name %q", name)
+		}
+		for _, c := range label {
+			if c <= ' ' || c > '~' || c == '*' {
+				return q, fmt.Errorf("bad dns name %q", name)
+			}
+		}
 	}
-	from = make(net.IP, len(ip))
-	to = make(net.IP, len(ip))
-	for i := 0; i < len(ip); i++ {
-		from[i] = ip[i] & mask[i]
-		to[i] = ip[i] | ^mask[i]
+	return q, nil
+}
+
+// parseMD5 parses an MD5 hash, like a JA3 fingerprint, given in hex.
+func parseMD5(in string) (hash [md5.Size]byte, _ error) {
+	b, err := hex.DecodeString(in)
+	if err != nil || len(b) != md5.Size {
+		return hash, fmt.Errorf("bad md5 hash %q", in)
 	}
-	return
+	copy(hash[:], b)
+	return hash, nil
+}
+
+// parseCommunityID returns the SHA-1 hash a version 1 Community ID, like
+// "1:LQU9qZlK+B5F3KDmev6m5PMibrg=", encodes.
+func parseCommunityID(in string) (hash [sha1.Size]byte, _ error) {
+	b, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(in, "1:"))
+	if err != nil || len(b) != sha1.Size || !strings.HasPrefix(in, "1:") {
+		return hash, fmt.Errorf("bad community id %q", in)
+	}
+	copy(hash[:], b)
+	return hash, nil
+}
+
+// newCustomKeyQuery returns a query for packets a custom indexer indexed
+// under a key, given like "sip.callid=abc".
+func newCustomKeyQuery(in string) (customKeyQuery, error) {
+	i := strings.IndexByte(in, '=')
+	if i < 0 || i == len(in)-1 {
+		return customKeyQuery{}, fmt.Errorf("bad key %q, want <type>=<key>", in)
+	}
+	q := customKeyQuery{typ: in[:i], key: in[i+1:]}
+	if !indexfile.IsCustomKeyType(q.typ) {
+		return q, fmt.Errorf("no custom key type %q", q.typ)
+	}
+	return q, nil
 }
 
 // parserLex is used by the parser as a lexer.
 // It must be named <prefix>Lex (where prefix is passed into go tool yacc with
 // the -p flag).
 type parserLex struct {
-	now time.Time // guarantees consistent time differences
-	in  string
-	pos int
-	out Query
-	err error
+	now  time.Time // guarantees consistent time differences
+	in   string
+	pos  int
+	out  Query
+	err  error
+	name bool // The next token is a NAME, like a domain name or hash
 }
 
 // tokens provides a simple map for adding new keywords and mapping them
 // to token types.
 var tokens = map[string]int{
-	"after":  AFTER,
-	"ago":    AGO,
-	"&&":     AND,
-	"and":    AND,
-	"before": BEFORE,
-	"host":   HOST,
-	"icmp":   ICMP,
-	"ip":     IPP,
-	"mask":   MASK,
-	"net":    NET,
-	"||":     OR,
-	"or":     OR,
-	"port":   PORT,
-	"vlan":   VLAN,
-	"mpls":   MPLS,
-	"proto":  PROTO,
-	"tcp":    TCP,
-	"udp":    UDP,
+	"after":        AFTER,
+	"ago":          AGO,
+	"&&":           AND,
+	"and":          AND,
+	"before":       BEFORE,
+	"community_id": COMMUNITYID,
+	"dns.name":     DNSNAME,
+	"dns.resolved": DNSRESOLVED,
+	"ether":        ETHER,
+	"host":         HOST,
+	"http.host":    HTTPHOST,
+	"http.method":  HTTPMETHOD,
+	"http.path":    HTTPPATH,
+	"icmp":         ICMP,
+	"inner":        INNER,
+	"ip":           IPP,
+	"key":          KEY,
+	"len":          LEN,
+	">=":           GE,
+	"<=":           LE,
+	"mask":         MASK,
+	"net":          NET,
+	"||":           OR,
+	"or":           OR,
+	"outer":        OUTER,
+	"port":         PORT,
+	"portrange":    PORTRANGE,
+	"vlan":         VLAN,
+	"mpls":         MPLS,
+	"proto":        PROTO,
+	"tcp":          TCP,
+	"tcpflags":     TCPFLAGS,
+	"tls.ja3":      TLSJA3,
+	"tls.ja3s":     TLSJA3S,
+	"tls.sni":      TLSSNI,
+	"udp":          UDP,
 }
 
 // Lex is called by the parser to get each new token.  This implementation
@@ -145,11 +333,47 @@ func (x *parserLex) Lex(yylval *parserSymType) (ret int) {
 	for x.pos < len(x.in) && unicode.IsSpace(rune(x.in[x.pos])) {
 		x.pos++
 	}
-	for t, i := range tokens {
-		if strings.HasPrefix(x.in[x.pos:], t) {
-			x.pos += len(t)
-			return i
+	if x.name {
+		// Names are anything up to the next space or paren, validated by
+		// the parser.
+		x.name = false
+		s := x.pos
+		for x.pos < len(x.in) && !unicode.IsSpace(rune(x.in[x.pos])) && x.in[x.pos] != '(' && x.in[x.pos] != ')' {
+			x.pos++
+		}
+		yylval.str = x.in[s:x.pos]
+		return NAME
+	}
+	// The longest keyword matching wins, so "portrange" isn't lexed as
+	// "port".
+	var keyword string
+	for t := range tokens {
+		if strings.HasPrefix(x.in[x.pos:], t) && len(t) > len(keyword) {
+			keyword = t
+		}
+	}
+	for _, f := range tcpFlagNames {
+		if strings.HasPrefix(x.in[x.pos:], f.name) && len(f.name) > len(keyword) {
+			keyword = f.name
+			yylval.num = int(f.flag)
+		}
+	}
+	if keyword != "" {
+		x.pos += len(keyword)
+		if tok, ok := tokens[keyword]; ok {
+			switch tok {
+			case DNSNAME, DNSRESOLVED, TLSSNI, TLSJA3, TLSJA3S, HTTPHOST, HTTPMETHOD, HTTPPATH, COMMUNITYID, KEY:
+				x.name = true
+			}
+			return tok
 		}
+		return FLAG
+	}
+	if x.pos < len(x.in) && x.in[x.pos] == '-' {
+		// Separates the ends of a port range.  Times hold '-', but never
+		// start with it.
+		x.pos++
+		return '-'
 	}
 	s := x.pos
 	var isIP, isDuration, isTime bool
@@ -159,7 +383,8 @@ L:
 		case ':', '.':
 			isIP = true
 			x.pos++
-		case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9', 'a', 'b', 'c', 'd', 'e', 'f':
+		case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9', 'a', 'b', 'c', 'd', 'e', 'f',
+			'A', 'B', 'C', 'D', 'E', 'F':
 			x.pos++
 		case 'm', 'h':
 			x.pos++
@@ -173,6 +398,11 @@ L:
 		}
 	}
 	part := x.in[s:x.pos]
+	if i := strings.IndexByte(part, '-'); isTime && !isIP && i > 0 && isDigits(part[:i]) && isDigits(part[i+1:]) {
+		// A range of numbers, not a time: lex the first number alone.
+		x.pos, part = s+i, part[:i]
+		isTime = false
+	}
 	switch {
 	case isTime:
 		t, err := time.Parse(time.RFC3339, part)
@@ -182,6 +412,10 @@ L:
 		yylval.time = t
 		return TIME
 	case isIP:
+		if mac, err := net.ParseMAC(part); err == nil && len(mac) == 6 {
+			yylval.mac = mac
+			return MAC
+		}
 		yylval.ip = net.ParseIP(part)
 		if yylval.ip == nil {
 			x.Error(fmt.Sprintf("bad IP %q", part))
@@ -209,13 +443,23 @@ L:
 		return 0
 	}
 	switch c := x.in[x.pos]; c {
-	case ':', '.', '(', ')', '/':
+	case ':', '.', '(', ')', '/', '!', '<', '>':
 		x.pos++
 		return int(c)
 	}
 	return -1
 }
 
+// isDigits returns true if s is a non-empty string of decimal digits.
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
 // Error is called by the parser on a parse error.
 func (x *parserLex) Error(s string) {
 	if x.err == nil {
@@ -234,99 +478,153 @@ func parse(in string) (Query, error) {
 }
 
 //line yacctab:1
-var parserExca = []int{
+var parserExca = [...]int8{
 	-1, 1,
 	1, -1,
 	-2, 0,
 }
 
-const parserNprod = 20
 const parserPrivate = 57344
 
-var parserTokenNames []string
-var parserStates []string
-
-const parserLast = 46
+const parserLast = 107
 
-var parserAct = []int{
-
-	4, 5, 27, 26, 33, 9, 36, 11, 12, 13,
-	14, 15, 8, 31, 6, 7, 16, 17, 32, 21,
-	20, 10, 19, 37, 23, 18, 3, 35, 2, 25,
-	16, 17, 22, 1, 0, 34, 0, 0, 0, 24,
-	0, 0, 0, 29, 30, 28,
+var parserAct = [...]int8{
+	4, 6, 7, 72, 69, 74, 11, 85, 15, 16,
+	17, 30, 31, 10, 75, 8, 9, 5, 13, 14,
+	18, 19, 32, 33, 20, 21, 22, 24, 25, 26,
+	27, 29, 23, 28, 49, 51, 46, 76, 71, 83,
+	64, 63, 82, 12, 80, 47, 79, 78, 77, 62,
+	70, 39, 38, 37, 36, 68, 84, 48, 50, 41,
+	34, 61, 73, 60, 59, 58, 57, 56, 55, 54,
+	53, 52, 3, 81, 40, 2, 32, 33, 35, 45,
+	1, 65, 0, 0, 0, 0, 43, 44, 42, 0,
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 66, 67,
 }
-var parserPact = []int{
 
-	-4, -1000, 23, -1000, 5, 1, -1, -2, 26, 4,
-	-4, -1000, -1000, -1000, -20, -20, -4, -4, -1000, -1000,
-	-1000, -1000, -8, -6, 9, -1000, -1000, 10, -1000, -1000,
-	-1000, -1000, -15, 3, -1000, -1000, -1000, -1000,
+var parserPact = [...]int16{
+	-4, -32768, 68, -32768, 21, 74, 13, 12, 11, 10,
+	67, 20, -4, -4, -4, -32768, -32768, -32768, -6, 8,
+	33, 32, 31, 30, 29, 28, 27, 26, 25, 23,
+	-3, -3, -4, -4, -32768, 15, -32768, -41, -32768, -32768,
+	9, -8, 14, -32768, -32768, -37, -32768, -5, 7, 6,
+	5, 3, -32768, -32768, -32768, -32768, -32768, -32768, -32768, -32768,
+	-32768, -32768, -32768, -32768, 55, -32768, -32768, -32768, -32768, 1,
+	-32768, -2, 17, -32768, -32768, -35, -32768, -32768, -32768, -32768,
+	-32768, -32768, -32768, -32768, -32768, -32768,
 }
-var parserPgo = []int{
 
-	0, 33, 28, 26, 29,
+var parserPgo = [...]int8{
+	0, 80, 75, 72, 49, 79,
 }
-var parserR1 = []int{
 
+var parserR1 = [...]int8{
 	0, 1, 2, 2, 2, 3, 3, 3, 3, 3,
-	3, 3, 3, 3, 3, 3, 3, 3, 4, 4,
+	3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
+	3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
+	3, 3, 3, 3, 3, 3, 3, 3, 3, 5,
+	5, 5, 5, 4, 4,
 }
-var parserR2 = []int{
 
-	0, 1, 1, 3, 3, 2, 2, 2, 2, 3,
-	4, 4, 3, 1, 1, 1, 2, 2, 1, 2,
+var parserR2 = [...]int8{
+	0, 1, 1, 3, 3, 2, 3, 2, 4, 2,
+	1, 2, 1, 3, 4, 4, 3, 2, 2, 1,
+	1, 1, 2, 3, 3, 3, 3, 2, 2, 2,
+	2, 2, 2, 2, 2, 2, 2, 2, 2, 1,
+	2, 2, 3, 1, 2,
 }
-var parserChk = []int{
 
-	-1000, -1, -2, -3, 4, 5, 18, 19, 16, 9,
-	25, 11, 12, 13, 14, 15, 7, 8, 20, 21,
-	21, 21, 6, 20, -2, -4, 23, 22, -4, -3,
-	-3, 21, 24, 10, 26, 17, 21, 20,
+var parserChk = [...]int16{
+	-32768, -1, -2, -3, 4, 21, 5, 6, 19, 20,
+	17, 10, 47, 22, 23, 12, 13, 14, 24, 25,
+	28, 29, 30, 36, 31, 32, 33, 34, 37, 35,
+	15, 16, 8, 9, 39, 4, 41, 41, 41, 41,
+	7, 39, -2, -3, -3, -5, 42, 51, 49, 26,
+	50, 27, 38, 38, 38, 38, 38, 38, 38, 38,
+	38, 38, -4, 44, 43, -4, -3, -3, 40, 45,
+	41, 46, 11, 48, 42, 51, 42, 41, 41, 41,
+	41, 18, 41, 41, 39, 42,
 }
-var parserDef = []int{
 
-	0, -2, 1, 2, 0, 0, 0, 0, 0, 0,
-	0, 13, 14, 15, 0, 0, 0, 0, 5, 6,
-	7, 8, 0, 0, 0, 16, 18, 0, 17, 3,
-	4, 9, 0, 0, 12, 19, 10, 11,
+var parserDef = [...]int8{
+	0, -2, 1, 2, 0, 0, 0, 0, 10, 12,
+	0, 0, 0, 0, 0, 19, 20, 21, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 5, 0, 7, 0, 9, 11,
+	0, 0, 0, 17, 18, 22, 39, 0, 0, 0,
+	0, 0, 27, 28, 29, 30, 31, 32, 33, 34,
+	35, 36, 37, 43, 0, 38, 3, 4, 6, 0,
+	13, 0, 0, 16, 41, 0, 40, 23, 24, 25,
+	26, 44, 8, 14, 15, 42,
 }
-var parserTok1 = []int{
 
+var parserTok1 = [...]int8{
 	1, 3, 3, 3, 3, 3, 3, 3, 3, 3,
 	3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
 	3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
+	3, 3, 3, 51, 3, 3, 3, 3, 3, 3,
+	47, 48, 3, 3, 3, 45, 3, 46, 3, 3,
 	3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
-	25, 26, 3, 3, 3, 3, 3, 24,
+	50, 3, 49,
 }
-var parserTok2 = []int{
 
+var parserTok2 = [...]int8{
 	2, 3, 4, 5, 6, 7, 8, 9, 10, 11,
 	12, 13, 14, 15, 16, 17, 18, 19, 20, 21,
-	22, 23,
+	22, 23, 24, 25, 26, 27, 28, 29, 30, 31,
+	32, 33, 34, 35, 36, 37, 38, 39, 40, 41,
+	42, 43, 44,
 }
-var parserTok3 = []int{
+
+var parserTok3 = [...]int8{
 	0,
 }
 
+var parserErrorMessages = [...]struct {
+	state int
+	token int
+	msg   string
+}{}
+
 //line yaccpar:1
 
 /*	parser for yacc output	*/
 
-var parserDebug = 0
+var (
+	parserDebug        = 0
+	parserErrorVerbose = false
+)
 
 type parserLexer interface {
 	Lex(lval *parserSymType) int
 	Error(s string)
 }
 
-const parserFlag = -1000
+type parserParser interface {
+	Parse(parserLexer) int
+	Lookahead() int
+}
+
+type parserParserImpl struct {
+	lval  parserSymType
+	stack [parserInitialStackSize]parserSymType
+	char  int
+}
+
+func (p *parserParserImpl) Lookahead() int {
+	return p.char
+}
+
+func parserNewParser() parserParser {
+	return &parserParserImpl{}
+}
+
+const parserFlag = -32768
 
 func parserTokname(c int) string {
-	// 4 is TOKSTART above
-	if c >= 4 && c-4 < len(parserToknames) {
-		if parserToknames[c-4] != "" {
-			return parserToknames[c-4]
+	if c >= 1 && c-1 < len(parserToknames) {
+		if parserToknames[c-1] != "" {
+			return parserToknames[c-1]
 		}
 	}
 	return __yyfmt__.Sprintf("tok-%v", c)
@@ -341,51 +639,127 @@ func parserStatname(s int) string {
 	return __yyfmt__.Sprintf("state-%v", s)
 }
 
-func parserlex1(lex parserLexer, lval *parserSymType) int {
-	c := 0
-	char := lex.Lex(lval)
+func parserErrorMessage(state, lookAhead int) string {
+	const TOKSTART = 4
+
+	if !parserErrorVerbose {
+		return "syntax error"
+	}
+
+	for _, e := range parserErrorMessages {
+		if e.state == state && e.token == lookAhead {
+			return "syntax error: " + e.msg
+		}
+	}
+
+	res := "syntax error: unexpected " + parserTokname(lookAhead)
+
+	// To match Bison, suggest at most four expected tokens.
+	expected := make([]int, 0, 4)
+
+	// Look for shiftable tokens.
+	base := int(parserPact[state])
+	for tok := TOKSTART; tok-1 < len(parserToknames); tok++ {
+		if n := base + tok; n >= 0 && n < parserLast && int(parserChk[int(parserAct[n])]) == tok {
+			if len(expected) == cap(expected) {
+				return res
+			}
+			expected = append(expected, tok)
+		}
+	}
+
+	if parserDef[state] == -2 {
+		i := 0
+		for parserExca[i] != -1 || int(parserExca[i+1]) != state {
+			i += 2
+		}
+
+		// Look for tokens that we accept or reduce.
+		for i += 2; parserExca[i] >= 0; i += 2 {
+			tok := int(parserExca[i])
+			if tok < TOKSTART || parserExca[i+1] == 0 {
+				continue
+			}
+			if len(expected) == cap(expected) {
+				return res
+			}
+			expected = append(expected, tok)
+		}
+
+		// If the default action is to accept or reduce, give up.
+		if parserExca[i+1] != 0 {
+			return res
+		}
+	}
+
+	for i, tok := range expected {
+		if i == 0 {
+			res += ", expecting "
+		} else {
+			res += " or "
+		}
+		res += parserTokname(tok)
+	}
+	return res
+}
+
+func parserlex1(lex parserLexer, lval *parserSymType) (char, token int) {
+	token = 0
+	char = lex.Lex(lval)
 	if char <= 0 {
-		c = parserTok1[0]
+		token = int(parserTok1[0])
 		goto out
 	}
 	if char < len(parserTok1) {
-		c = parserTok1[char]
+		token = int(parserTok1[char])
 		goto out
 	}
 	if char >= parserPrivate {
 		if char < parserPrivate+len(parserTok2) {
-			c = parserTok2[char-parserPrivate]
+			token = int(parserTok2[char-parserPrivate])
 			goto out
 		}
 	}
 	for i := 0; i < len(parserTok3); i += 2 {
-		c = parserTok3[i+0]
-		if c == char {
-			c = parserTok3[i+1]
+		token = int(parserTok3[i+0])
+		if token == char {
+			token = int(parserTok3[i+1])
 			goto out
 		}
 	}
 
 out:
-	if c == 0 {
-		c = parserTok2[1] /* unknown char */
+	if token == 0 {
+		token = int(parserTok2[1]) /* unknown char */
 	}
 	if parserDebug >= 3 {
-		__yyfmt__.Printf("lex %s(%d)\n", parserTokname(c), uint(char))
+		__yyfmt__.Printf("lex %s(%d)\n", parserTokname(token), uint(char))
 	}
-	return c
+	return char, token
 }
 
 func parserParse(parserlex parserLexer) int {
+	return parserNewParser().Parse(parserlex)
+}
+
+func (parserrcvr *parserParserImpl) Parse(parserlex parserLexer) int {
 	var parsern int
-	var parserlval parserSymType
 	var parserVAL parserSymType
-	parserS := make([]parserSymType, parserMaxDepth)
+	var parserDollar []parserSymType
+	_ = parserDollar // silence set and not used
+	parserS := parserrcvr.stack[:]
 
 	Nerrs := 0   /* number of errors */
 	Errflag := 0 /* error recovery flag */
 	parserstate := 0
-	parserchar := -1
+	parserrcvr.char = -1
+	parsertoken := -1 // parserrcvr.char translated into internal numbering
+	defer func() {
+		// Make sure we report no lookahead when not parsing.
+		parserstate = -1
+		parserrcvr.char = -1
+		parsertoken = -1
+	}()
 	parserp := -1
 	goto parserstack
 
@@ -398,7 +772,7 @@ ret1:
 parserstack:
 	/* put a state and value onto the stack */
 	if parserDebug >= 4 {
-		__yyfmt__.Printf("char %v in %v\n", parserTokname(parserchar), parserStatname(parserstate))
+		__yyfmt__.Printf("char %v in %v\n", parserTokname(parsertoken), parserStatname(parserstate))
 	}
 
 	parserp++
@@ -411,21 +785,22 @@ parserstack:
 	parserS[parserp].yys = parserstate
 
 parsernewstate:
-	parsern = parserPact[parserstate]
+	parsern = int(parserPact[parserstate])
 	if parsern <= parserFlag {
 		goto parserdefault /* simple state */
 	}
-	if parserchar < 0 {
-		parserchar = parserlex1(parserlex, &parserlval)
+	if parserrcvr.char < 0 {
+		parserrcvr.char, parsertoken = parserlex1(parserlex, &parserrcvr.lval)
 	}
-	parsern += parserchar
+	parsern += parsertoken
 	if parsern < 0 || parsern >= parserLast {
 		goto parserdefault
 	}
-	parsern = parserAct[parsern]
-	if parserChk[parsern] == parserchar { /* valid shift */
-		parserchar = -1
-		parserVAL = parserlval
+	parsern = int(parserAct[parsern])
+	if int(parserChk[parsern]) == parsertoken { /* valid shift */
+		parserrcvr.char = -1
+		parsertoken = -1
+		parserVAL = parserrcvr.lval
 		parserstate = parsern
 		if Errflag > 0 {
 			Errflag--
@@ -435,27 +810,27 @@ parsernewstate:
 
 parserdefault:
 	/* default state action */
-	parsern = parserDef[parserstate]
+	parsern = int(parserDef[parserstate])
 	if parsern == -2 {
-		if parserchar < 0 {
-			parserchar = parserlex1(parserlex, &parserlval)
+		if parserrcvr.char < 0 {
+			parserrcvr.char, parsertoken = parserlex1(parserlex, &parserrcvr.lval)
 		}
 
 		/* look through exception table */
 		xi := 0
 		for {
-			if parserExca[xi+0] == -1 && parserExca[xi+1] == parserstate {
+			if parserExca[xi+0] == -1 && int(parserExca[xi+1]) == parserstate {
 				break
 			}
 			xi += 2
 		}
 		for xi += 2; ; xi += 2 {
-			parsern = parserExca[xi+0]
-			if parsern < 0 || parsern == parserchar {
+			parsern = int(parserExca[xi+0])
+			if parsern < 0 || parsern == parsertoken {
 				break
 			}
 		}
-		parsern = parserExca[xi+1]
+		parsern = int(parserExca[xi+1])
 		if parsern < 0 {
 			goto ret0
 		}
@@ -464,11 +839,11 @@ parserdefault:
 		/* error ... attempt to resume parsing */
 		switch Errflag {
 		case 0: /* brand new error */
-			parserlex.Error("syntax error")
+			parserlex.Error(parserErrorMessage(parserstate, parsertoken))
 			Nerrs++
 			if parserDebug >= 1 {
 				__yyfmt__.Printf("%s", parserStatname(parserstate))
-				__yyfmt__.Printf(" saw %s\n", parserTokname(parserchar))
+				__yyfmt__.Printf(" saw %s\n", parserTokname(parsertoken))
 			}
 			fallthrough
 
@@ -477,10 +852,10 @@ parserdefault:
 
 			/* find a state where "error" is a legal shift action */
 			for parserp >= 0 {
-				parsern = parserPact[parserS[parserp].yys] + parserErrCode
+				parsern = int(parserPact[parserS[parserp].yys]) + parserErrCode
 				if parsern >= 0 && parsern < parserLast {
-					parserstate = parserAct[parsern] /* simulate a shift of "error" */
-					if parserChk[parserstate] == parserErrCode {
+					parserstate = int(parserAct[parsern]) /* simulate a shift of "error" */
+					if int(parserChk[parserstate]) == parserErrCode {
 						goto parserstack
 					}
 				}
@@ -496,12 +871,13 @@ parserdefault:
 
 		case 3: /* no shift yet; clobber input char */
 			if parserDebug >= 2 {
-				__yyfmt__.Printf("error recovery discards %s\n", parserTokname(parserchar))
+				__yyfmt__.Printf("error recovery discards %s\n", parserTokname(parsertoken))
 			}
-			if parserchar == parserEofCode {
+			if parsertoken == parserEofCode {
 				goto ret1
 			}
-			parserchar = -1
+			parserrcvr.char = -1
+			parsertoken = -1
 			goto parsernewstate /* try again in the same state */
 		}
 	}
@@ -515,144 +891,386 @@ parserdefault:
 	parserpt := parserp
 	_ = parserpt // guard against "declared and not used"
 
-	parserp -= parserR2[parsern]
+	parserp -= int(parserR2[parsern])
+	// parserp is now the index of $0. Perform the default action. Iff the
+	// reduced production is ε, $1 is possibly out of range.
+	if parserp+1 >= len(parserS) {
+		nyys := make([]parserSymType, len(parserS)*2)
+		copy(nyys, parserS)
+		parserS = nyys
+	}
 	parserVAL = parserS[parserp+1]
 
 	/* consult goto table to find next state */
-	parsern = parserR1[parsern]
-	parserg := parserPgo[parsern]
+	parsern = int(parserR1[parsern])
+	parserg := int(parserPgo[parsern])
 	parserj := parserg + parserS[parserp].yys + 1
 
 	if parserj >= parserLast {
-		parserstate = parserAct[parserg]
+		parserstate = int(parserAct[parserg])
 	} else {
-		parserstate = parserAct[parserj]
-		if parserChk[parserstate] != -parsern {
-			parserstate = parserAct[parserg]
+		parserstate = int(parserAct[parserj])
+		if int(parserChk[parserstate]) != -parsern {
+			parserstate = int(parserAct[parserg])
 		}
 	}
 	// dummy call; replaced with literal code
 	switch parsernt {
 
 	case 1:
-		//line parser.y:65
+		parserDollar = parserS[parserpt-1 : parserpt+1]
+//line parser.y:76
 		{
-			parserlex.(*parserLex).out = parserS[parserpt-0].query
+			parserlex.(*parserLex).out = parserDollar[1].query
 		}
-	case 2:
-		parserVAL.query = parserS[parserpt-0].query
 	case 3:
-		//line parser.y:72
+		parserDollar = parserS[parserpt-3 : parserpt+1]
+//line parser.y:83
 		{
-			parserVAL.query = intersectQuery{parserS[parserpt-2].query, parserS[parserpt-0].query}
+			parserVAL.query = intersectQuery{parserDollar[1].query, parserDollar[3].query}
 		}
 	case 4:
-		//line parser.y:76
+		parserDollar = parserS[parserpt-3 : parserpt+1]
+//line parser.y:87
 		{
-			parserVAL.query = unionQuery{parserS[parserpt-2].query, parserS[parserpt-0].query}
+			parserVAL.query = unionQuery{parserDollar[1].query, parserDollar[3].query}
 		}
 	case 5:
-		//line parser.y:82
+		parserDollar = parserS[parserpt-2 : parserpt+1]
+//line parser.y:93
 		{
-			parserVAL.query = ipQuery{parserS[parserpt-0].ip, parserS[parserpt-0].ip}
+			parserVAL.query = ipQuery{parserDollar[2].ip, parserDollar[2].ip}
 		}
 	case 6:
-		//line parser.y:86
+		parserDollar = parserS[parserpt-3 : parserpt+1]
+//line parser.y:97
 		{
-			if parserS[parserpt-0].num < 0 || parserS[parserpt-0].num >= 65536 {
-				parserlex.Error(fmt.Sprintf("invalid port %v", parserS[parserpt-0].num))
-			}
-			parserVAL.query = portQuery(parserS[parserpt-0].num)
+			parserVAL.query = macQuery(parserDollar[3].mac)
 		}
 	case 7:
-		//line parser.y:93
+		parserDollar = parserS[parserpt-2 : parserpt+1]
+//line parser.y:101
 		{
-			if parserS[parserpt-0].num < 0 || parserS[parserpt-0].num >= 65536 {
-				parserlex.Error(fmt.Sprintf("invalid vlan %v", parserS[parserpt-0].num))
+			if parserDollar[2].num < 0 || parserDollar[2].num >= 65536 {
+				parserlex.Error(fmt.Sprintf("invalid port %v", parserDollar[2].num))
 			}
-			parserVAL.query = vlanQuery(parserS[parserpt-0].num)
+			parserVAL.query = portQuery(parserDollar[2].num)
 		}
 	case 8:
-		//line parser.y:100
+		parserDollar = parserS[parserpt-4 : parserpt+1]
+//line parser.y:108
 		{
-			if parserS[parserpt-0].num < 0 || parserS[parserpt-0].num >= (1<<20) {
-				parserlex.Error(fmt.Sprintf("invalid mpls %v", parserS[parserpt-0].num))
+			if parserDollar[2].num < 0 || parserDollar[4].num >= 65536 || parserDollar[2].num > parserDollar[4].num {
+				parserlex.Error(fmt.Sprintf("invalid port range %v-%v", parserDollar[2].num, parserDollar[4].num))
 			}
-			parserVAL.query = mplsQuery(parserS[parserpt-0].num)
+			parserVAL.query = portRangeQuery{uint16(parserDollar[2].num), uint16(parserDollar[4].num)}
 		}
 	case 9:
-		//line parser.y:107
+		parserDollar = parserS[parserpt-2 : parserpt+1]
+//line parser.y:115
 		{
-			if parserS[parserpt-0].num < 0 || parserS[parserpt-0].num >= 256 {
-				parserlex.Error(fmt.Sprintf("invalid proto %v", parserS[parserpt-0].num))
+			if parserDollar[2].num < 0 || parserDollar[2].num >= 4096 { // Tags hold 12-bit IDs.
+				parserlex.Error(fmt.Sprintf("invalid vlan %v", parserDollar[2].num))
 			}
-			parserVAL.query = protocolQuery(parserS[parserpt-0].num)
+			parserVAL.query = vlanQuery(parserDollar[2].num)
 		}
 	case 10:
-		//line parser.y:114
+		parserDollar = parserS[parserpt-1 : parserpt+1]
+//line parser.y:122
+		{
+			parserVAL.query = taggedQuery{}
+		}
+	case 11:
+		parserDollar = parserS[parserpt-2 : parserpt+1]
+//line parser.y:126
 		{
-			mask := net.CIDRMask(parserS[parserpt-0].num, len(parserS[parserpt-2].ip)*8)
+			if parserDollar[2].num < 0 || parserDollar[2].num >= (1<<20) {
+				parserlex.Error(fmt.Sprintf("invalid mpls %v", parserDollar[2].num))
+			}
+			parserVAL.query = mplsQuery(parserDollar[2].num)
+		}
+	case 12:
+		parserDollar = parserS[parserpt-1 : parserpt+1]
+//line parser.y:133
+		{
+			parserVAL.query = labeledQuery{}
+		}
+	case 13:
+		parserDollar = parserS[parserpt-3 : parserpt+1]
+//line parser.y:137
+		{
+			if parserDollar[3].num < 0 || parserDollar[3].num >= 256 {
+				parserlex.Error(fmt.Sprintf("invalid proto %v", parserDollar[3].num))
+			}
+			parserVAL.query = protocolQuery(parserDollar[3].num)
+		}
+	case 14:
+		parserDollar = parserS[parserpt-4 : parserpt+1]
+//line parser.y:144
+		{
+			mask := net.CIDRMask(parserDollar[4].num, len(parserDollar[2].ip)*8)
 			if mask == nil {
-				parserlex.Error(fmt.Sprintf("bad cidr: %v/%v", parserS[parserpt-2].ip, parserS[parserpt-0].num))
+				parserlex.Error(fmt.Sprintf("bad cidr: %v/%v", parserDollar[2].ip, parserDollar[4].num))
 			}
-			from, to, err := ipsFromNet(parserS[parserpt-2].ip, mask)
+			q, err := newNetQuery(parserDollar[2].ip, mask)
 			if err != nil {
 				parserlex.Error(err.Error())
 			}
-			parserVAL.query = ipQuery{from, to}
+			parserVAL.query = q
 		}
-	case 11:
-		//line parser.y:126
+	case 15:
+		parserDollar = parserS[parserpt-4 : parserpt+1]
+//line parser.y:156
 		{
-			from, to, err := ipsFromNet(parserS[parserpt-2].ip, net.IPMask(parserS[parserpt-0].ip))
+			q, err := newNetQuery(parserDollar[2].ip, net.IPMask(parserDollar[4].ip))
 			if err != nil {
 				parserlex.Error(err.Error())
 			}
-			parserVAL.query = ipQuery{from, to}
+			parserVAL.query = q
 		}
-	case 12:
-		//line parser.y:134
+	case 16:
+		parserDollar = parserS[parserpt-3 : parserpt+1]
+//line parser.y:164
 		{
-			parserVAL.query = parserS[parserpt-1].query
+			parserVAL.query = parserDollar[2].query
 		}
-	case 13:
-		//line parser.y:138
+	case 17:
+		parserDollar = parserS[parserpt-2 : parserpt+1]
+//line parser.y:168
+		{
+			q, err := newHeaderQuery(parserDollar[2].query, true)
+			if err != nil {
+				parserlex.Error(err.Error())
+			}
+			parserVAL.query = q
+		}
+	case 18:
+		parserDollar = parserS[parserpt-2 : parserpt+1]
+//line parser.y:176
+		{
+			q, err := newHeaderQuery(parserDollar[2].query, false)
+			if err != nil {
+				parserlex.Error(err.Error())
+			}
+			parserVAL.query = q
+		}
+	case 19:
+		parserDollar = parserS[parserpt-1 : parserpt+1]
+//line parser.y:184
 		{
 			parserVAL.query = protocolQuery(6)
 		}
-	case 14:
-		//line parser.y:142
+	case 20:
+		parserDollar = parserS[parserpt-1 : parserpt+1]
+//line parser.y:188
 		{
 			parserVAL.query = protocolQuery(17)
 		}
-	case 15:
-		//line parser.y:146
+	case 21:
+		parserDollar = parserS[parserpt-1 : parserpt+1]
+//line parser.y:192
 		{
 			parserVAL.query = protocolQuery(1)
 		}
-	case 16:
-		//line parser.y:150
+	case 22:
+		parserDollar = parserS[parserpt-2 : parserpt+1]
+//line parser.y:196
+		{
+			parserVAL.query = tcpFlagsQuery(parserDollar[2].flags)
+		}
+	case 23:
+		parserDollar = parserS[parserpt-3 : parserpt+1]
+//line parser.y:200
+		{
+			parserVAL.query = lengthQuery{parserDollar[3].num + 1, 0}
+		}
+	case 24:
+		parserDollar = parserS[parserpt-3 : parserpt+1]
+//line parser.y:204
+		{
+			if parserDollar[3].num < 1 {
+				parserlex.Error(fmt.Sprintf("invalid length %v", parserDollar[3].num))
+			}
+			parserVAL.query = lengthQuery{parserDollar[3].num, 0}
+		}
+	case 25:
+		parserDollar = parserS[parserpt-3 : parserpt+1]
+//line parser.y:211
+		{
+			if parserDollar[3].num < 2 {
+				parserlex.Error(fmt.Sprintf("no packet is shorter than %v", parserDollar[3].num))
+			}
+			parserVAL.query = lengthQuery{0, parserDollar[3].num - 1}
+		}
+	case 26:
+		parserDollar = parserS[parserpt-3 : parserpt+1]
+//line parser.y:218
+		{
+			if parserDollar[3].num < 1 {
+				parserlex.Error(fmt.Sprintf("no packet is shorter than %v", parserDollar[3].num))
+			}
+			parserVAL.query = lengthQuery{0, parserDollar[3].num}
+		}
+	case 27:
+		parserDollar = parserS[parserpt-2 : parserpt+1]
+//line parser.y:225
+		{
+			q, err := newDNSNameQuery(parserDollar[2].str)
+			if err != nil {
+				parserlex.Error(err.Error())
+			}
+			parserVAL.query = q
+		}
+	case 28:
+		parserDollar = parserS[parserpt-2 : parserpt+1]
+//line parser.y:233
+		{
+			q, err := newDNSNameQuery(parserDollar[2].str)
+			if err != nil {
+				parserlex.Error(err.Error())
+			}
+			parserVAL.query = dnsResolvedQuery(q)
+		}
+	case 29:
+		parserDollar = parserS[parserpt-2 : parserpt+1]
+//line parser.y:241
+		{
+			q, err := newDNSNameQuery(parserDollar[2].str)
+			if err != nil {
+				parserlex.Error(err.Error())
+			}
+			parserVAL.query = tlsServerNameQuery(q)
+		}
+	case 30:
+		parserDollar = parserS[parserpt-2 : parserpt+1]
+//line parser.y:249
+		{
+			hash, err := parseCommunityID(parserDollar[2].str)
+			if err != nil {
+				parserlex.Error(err.Error())
+			}
+			parserVAL.query = communityIDQuery(hash)
+		}
+	case 31:
+		parserDollar = parserS[parserpt-2 : parserpt+1]
+//line parser.y:257
+		{
+			hash, err := parseMD5(parserDollar[2].str)
+			if err != nil {
+				parserlex.Error(err.Error())
+			}
+			parserVAL.query = ja3Query(hash)
+		}
+	case 32:
+		parserDollar = parserS[parserpt-2 : parserpt+1]
+//line parser.y:265
+		{
+			hash, err := parseMD5(parserDollar[2].str)
+			if err != nil {
+				parserlex.Error(err.Error())
+			}
+			parserVAL.query = ja3sQuery(hash)
+		}
+	case 33:
+		parserDollar = parserS[parserpt-2 : parserpt+1]
+//line parser.y:273
+		{
+			q, err := newDNSNameQuery(parserDollar[2].str)
+			if err != nil {
+				parserlex.Error(err.Error())
+			}
+			parserVAL.query = httpHostQuery(q)
+		}
+	case 34:
+		parserDollar = parserS[parserpt-2 : parserpt+1]
+//line parser.y:281
+		{
+			method := strings.ToUpper(parserDollar[2].str)
+			if method == "" || strings.IndexFunc(method, func(c rune) bool { return c < 'A' || c > 'Z' }) >= 0 {
+				parserlex.Error(fmt.Sprintf("bad http method %q", parserDollar[2].str))
+			}
+			parserVAL.query = httpMethodQuery(method)
+		}
+	case 35:
+		parserDollar = parserS[parserpt-2 : parserpt+1]
+//line parser.y:289
+		{
+			q, err := newCustomKeyQuery(parserDollar[2].str)
+			if err != nil {
+				parserlex.Error(err.Error())
+			}
+			parserVAL.query = q
+		}
+	case 36:
+		parserDollar = parserS[parserpt-2 : parserpt+1]
+//line parser.y:297
+		{
+			q := httpPathQuery{path: strings.TrimSuffix(parserDollar[2].str, "*")}
+			q.prefix = q.path != parserDollar[2].str
+			if !strings.HasPrefix(q.path, "/") || strings.ContainsAny(q.path, "*?#") {
+				parserlex.Error(fmt.Sprintf("bad http path %q", parserDollar[2].str))
+			}
+			parserVAL.query = q
+		}
+	case 37:
+		parserDollar = parserS[parserpt-2 : parserpt+1]
+//line parser.y:306
 		{
 			var t timeQuery
-			t[1] = parserS[parserpt-0].time
+			t[1] = parserDollar[2].time
 			parserVAL.query = t
 		}
-	case 17:
-		//line parser.y:156
+	case 38:
+		parserDollar = parserS[parserpt-2 : parserpt+1]
+//line parser.y:312
 		{
 			var t timeQuery
-			t[0] = parserS[parserpt-0].time
+			t[0] = parserDollar[2].time
 			parserVAL.query = t
 		}
-	case 18:
-		//line parser.y:164
+	case 39:
+		parserDollar = parserS[parserpt-1 : parserpt+1]
+//line parser.y:320
 		{
-			parserVAL.time = parserS[parserpt-0].time
+			parserVAL.flags = [2]byte{byte(parserDollar[1].num), 0}
 		}
-	case 19:
-		//line parser.y:168
+	case 40:
+		parserDollar = parserS[parserpt-2 : parserpt+1]
+//line parser.y:324
+		{
+			parserVAL.flags = [2]byte{0, byte(parserDollar[2].num)}
+		}
+	case 41:
+		parserDollar = parserS[parserpt-2 : parserpt+1]
+//line parser.y:328
+		{
+			if parserDollar[1].flags[1]&byte(parserDollar[2].num) != 0 {
+				parserlex.Error("tcp flag both set and clear")
+			}
+			parserVAL.flags = parserDollar[1].flags
+			parserVAL.flags[0] |= byte(parserDollar[2].num)
+		}
+	case 42:
+		parserDollar = parserS[parserpt-3 : parserpt+1]
+//line parser.y:336
+		{
+			if parserDollar[1].flags[0]&byte(parserDollar[3].num) != 0 {
+				parserlex.Error("tcp flag both set and clear")
+			}
+			parserVAL.flags = parserDollar[1].flags
+			parserVAL.flags[1] |= byte(parserDollar[3].num)
+		}
+	case 43:
+		parserDollar = parserS[parserpt-1 : parserpt+1]
+//line parser.y:346
+		{
+			parserVAL.time = parserDollar[1].time
+		}
+	case 44:
+		parserDollar = parserS[parserpt-2 : parserpt+1]
+//line parser.y:350
 		{
-			parserVAL.time = parserlex.(*parserLex).now.Add(-parserS[parserpt-1].dur)
+			parserVAL.time = parserlex.(*parserLex).now.Add(-parserDollar[1].dur)
 		}
 	}
 	goto parserstack /* stack new state and value */
@@ -131,7 +131,8 @@ Error SingleFile::Close() {
 
 }  // namespace io
 
-Output::Output(int aiops) : ctx_(NULL), max_ops_(aiops), current_(NULL) {
+Output::Output(int aiops, int open_flags)
+    : ctx_(NULL), max_ops_(aiops), open_flags_(open_flags), current_(NULL) {
   CHECK_SUCCESS(SetUp());
 }
 
@@ -186,7 +187,7 @@ Error Output::Rotate(const std::string& dirname, int64_t micros,
     current_ = NULL;
   }
   std::string name = HiddenFile(dirname, micros);
-  int fd = open(name.c_str(), O_CREAT | O_WRONLY | O_DSYNC | O_DIRECT, 0600);
+  int fd = open(name.c_str(), open_flags_, 0600);
   LOG(INFO) << "Opening packet file " << name << ": " << fd;
   RETURN_IF_ERROR(Errno(fd), "open");
   if (initial_size > 0) {
@@ -42,8 +42,8 @@ class Output {
  public:
   // Create a new async IO queue with aiops slots for IO operations.
   // This class originally starts out with no file... an Open call must occur
-  // before any PWrites to open a file.
-  explicit Output(int aiops);
+  // before any PWrites to open a file.  Files are opened with open_flags.
+  Output(int aiops, int open_flags);
   // Flush all files on exit.
   virtual ~Output();
   // Open a new file.  Will fail if a file is already open.
@@ -71,6 +71,7 @@ class Output {
 
   io_context_t ctx_;
   int max_ops_;
+  int open_flags_;
   io::SingleFile* current_;
   std::set<io::SingleFile*> files_;
 
@@ -0,0 +1,163 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#include "hash.h"
+
+#include <stdint.h>
+
+namespace st {
+
+namespace {
+
+uint32_t RotateLeft(uint32_t x, int n) { return (x << n) | (x >> (32 - n)); }
+
+// Pad returns in padded to a whole number of 64-byte blocks, as MD5 and SHA-1
+// both pad it, with its length in bits appended in the given byte order.
+std::string Pad(const std::string& in, bool big_endian) {
+  uint64_t bits = uint64_t(in.size()) * 8;
+  std::string out = in;
+  out.push_back('\x80');
+  while (out.size() % 64 != 56) {
+    out.push_back('\0');
+  }
+  for (int i = 0; i < 8; i++) {
+    int shift = big_endian ? 56 - 8 * i : 8 * i;
+    out.push_back(char((bits >> shift) & 0xFF));
+  }
+  return out;
+}
+
+}  // namespace
+
+std::string MD5(const std::string& in) {
+  static const uint32_t kSines[64] = {
+      0xd76aa478, 0xe8c7b756, 0x242070db, 0xc1bdceee, 0xf57c0faf, 0x4787c62a,
+      0xa8304613, 0xfd469501, 0x698098d8, 0x8b44f7af, 0xffff5bb1, 0x895cd7be,
+      0x6b901122, 0xfd987193, 0xa679438e, 0x49b40821, 0xf61e2562, 0xc040b340,
+      0x265e5a51, 0xe9b6c7aa, 0xd62f105d, 0x02441453, 0xd8a1e681, 0xe7d3fbc8,
+      0x21e1cde6, 0xc33707d6, 0xf4d50d87, 0x455a14ed, 0xa9e3e905, 0xfcefa3f8,
+      0x676f02d9, 0x8d2a4c8a, 0xfffa3942, 0x8771f681, 0x6d9d6122, 0xfde5380c,
+      0xa4beea44, 0x4bdecfa9, 0xf6bb4b60, 0xbebfbc70, 0x289b7ec6, 0xeaa127fa,
+      0xd4ef3085, 0x04881d05, 0xd9d4d039, 0xe6db99e5, 0x1fa27cf8, 0xc4ac5665,
+      0xf4292244, 0x432aff97, 0xab9423a7, 0xfc93a039, 0x655b59c3, 0x8f0ccc92,
+      0xffeff47d, 0x85845dd1, 0x6fa87e4f, 0xfe2ce6e0, 0xa3014314, 0x4e0811a1,
+      0xf7537e82, 0xbd3af235, 0x2ad7d2bb, 0xeb86d391};
+  static const int kShifts[4][4] = {
+      {7, 12, 17, 22}, {5, 9, 14, 20}, {4, 11, 16, 23}, {6, 10, 15, 21}};
+  uint32_t h[4] = {0x67452301, 0xefcdab89, 0x98badcfe, 0x10325476};
+  std::string padded = Pad(in, false);
+  const unsigned char* p =
+      reinterpret_cast<const unsigned char*>(padded.data());
+  for (size_t off = 0; off < padded.size(); off += 64) {
+    uint32_t m[16];
+    for (int i = 0; i < 16; i++) {
+      const unsigned char* w = p + off + 4 * i;
+      m[i] = w[0] | (w[1] << 8) | (w[2] << 16) | (uint32_t(w[3]) << 24);
+    }
+    uint32_t a = h[0], b = h[1], c = h[2], d = h[3];
+    for (int i = 0; i < 64; i++) {
+      uint32_t f;
+      int g;
+      switch (i / 16) {
+        case 0:
+          f = (b & c) | (~b & d);
+          g = i;
+          break;
+        case 1:
+          f = (d & b) | (~d & c);
+          g = (5 * i + 1) % 16;
+          break;
+        case 2:
+          f = b ^ c ^ d;
+          g = (3 * i + 5) % 16;
+          break;
+        default:
+          f = c ^ (b | ~d);
+          g = (7 * i) % 16;
+          break;
+      }
+      uint32_t t = d;
+      d = c;
+      c = b;
+      b += RotateLeft(a + f + kSines[i] + m[g], kShifts[i / 16][i % 4]);
+      a = t;
+    }
+    h[0] += a;
+    h[1] += b;
+    h[2] += c;
+    h[3] += d;
+  }
+  std::string out;
+  for (uint32_t v : h) {
+    for (int i = 0; i < 4; i++) {
+      out.push_back(char((v >> (8 * i)) & 0xFF));
+    }
+  }
+  return out;
+}
+
+std::string SHA1(const std::string& in) {
+  uint32_t h[5] = {0x67452301, 0xefcdab89, 0x98badcfe, 0x10325476,
+                   0xc3d2e1f0};
+  std::string padded = Pad(in, true);
+  const unsigned char* p =
+      reinterpret_cast<const unsigned char*>(padded.data());
+  for (size_t off = 0; off < padded.size(); off += 64) {
+    uint32_t w[80];
+    for (int i = 0; i < 16; i++) {
+      const unsigned char* b = p + off + 4 * i;
+      w[i] = (uint32_t(b[0]) << 24) | (b[1] << 16) | (b[2] << 8) | b[3];
+    }
+    for (int i = 16; i < 80; i++) {
+      w[i] = RotateLeft(w[i - 3] ^ w[i - 8] ^ w[i - 14] ^ w[i - 16], 1);
+    }
+    uint32_t a = h[0], b = h[1], c = h[2], d = h[3], e = h[4];
+    for (int i = 0; i < 80; i++) {
+      uint32_t f, k;
+      if (i < 20) {
+        f = (b & c) | (~b & d);
+        k = 0x5a827999;
+      } else if (i < 40) {
+        f = b ^ c ^ d;
+        k = 0x6ed9eba1;
+      } else if (i < 60) {
+        f = (b & c) | (b & d) | (c & d);
+        k = 0x8f1bbcdc;
+      } else {
+        f = b ^ c ^ d;
+        k = 0xca62c1d6;
+      }
+      uint32_t t = RotateLeft(a, 5) + f + e + k + w[i];
+      e = d;
+      d = c;
+      c = RotateLeft(b, 30);
+      b = a;
+      a = t;
+    }
+    h[0] += a;
+    h[1] += b;
+    h[2] += c;
+    h[3] += d;
+    h[4] += e;
+  }
+  std::string out;
+  for (uint32_t v : h) {
+    for (int i = 3; i >= 0; i--) {
+      out.push_back(char((v >> (8 * i)) & 0xFF));
+    }
+  }
+  return out;
+}
+
+}  // namespace st
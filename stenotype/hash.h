@@ -0,0 +1,34 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#ifndef STENOGRAPHER_HASH_H_
+#define STENOGRAPHER_HASH_H_
+
+// Contains the message digests indexing needs, so stenotype needn't link a
+// crypto library for them.  Neither is used for anything needing security:
+// MD5 is how JA3 fingerprints are hashed, and SHA1 how Community IDs are.
+
+#include <string>
+
+namespace st {
+
+// MD5 returns the 16-byte MD5 hash of in (RFC 1321).
+std::string MD5(const std::string& in);
+
+// SHA1 returns the 20-byte SHA-1 hash of in (RFC 3174).
+std::string SHA1(const std::string& in);
+
+}  // namespace st
+
+#endif  // STENOGRAPHER_HASH_H_
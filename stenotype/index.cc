@@ -14,6 +14,9 @@
 
 #include "index.h"
 
+#include <algorithm>
+#include <cctype>
+#include <cstring>
 #include <memory>
 #include <string>
 
@@ -29,6 +32,8 @@
 #include <leveldb/status.h>
 #include <leveldb/table_builder.h>
 
+#include "hash.h"
+
 namespace leveldb {
 
 // Augment leveldb::Slice just slightly, so we can use it inside ordered
@@ -45,15 +50,581 @@ namespace st {
 // layer to decode is an ethernet header.
 const uint16_t kTypeEthernet = 0;
 const uint32_t kMPLSBottomOfStack = 1 << 8;
+const uint16_t kPortVXLAN = 4789;
+const uint16_t kPortGeneve = 6081;
+const uint16_t kPortDNS = 53;
+const uint16_t kDNSResponse = 0x8000;
+const uint16_t kDNSOpcode = 0x7800;
+const uint16_t kDNSRcode = 0x000F;
+const uint16_t kDNSTypeA = 1;
+const uint16_t kDNSTypeAAAA = 28;
+const uint16_t kDNSClassIN = 1;
+const size_t kDNSMaxNameLen = 255;  // In wire format, including length bytes
+const uint8_t kTLSHandshake = 22;
+const uint8_t kTLSClientHello = 1;
+const uint8_t kTLSServerHello = 2;
+const int kTLSExtServerName = 0;
+const int kTLSExtSupportedGroups = 10;
+const int kTLSExtECPointFormats = 11;
+const int kTLSHostName = 0;  // The server name type of host names
+const size_t kHTTPMaxPathLen = 255;
+const char* const kHTTPMethods[] = {"GET",     "POST",    "PUT",
+                                    "HEAD",    "DELETE",  "OPTIONS",
+                                    "PATCH",   "CONNECT", "TRACE"};
+const uint16_t kGREChecksum = 0x8000;
+const uint16_t kGRERouting = 0x4000;
+const uint16_t kGREKey = 0x2000;
+const uint16_t kGRESequence = 0x1000;
+const uint16_t kGREVersion = 0x0007;
+
+namespace {
+
+// StripIPv6Extensions skips the IPv6 extension headers at *start, leaving
+// *protocol as the type of the header after them.  Returns false if they're
+// truncated.  Fragments other than the first are left as IPPROTO_FRAGMENT,
+// since no transport header follows them.
+bool StripIPv6Extensions(uint8_t* protocol, const char** start,
+                         const char* limit) {
+  while (true) {
+    switch (*protocol) {
+      case IPPROTO_FRAGMENT: {
+        if (*start + sizeof(struct ip6_frag) > limit) {
+          return false;
+        }
+        auto ip6frag = reinterpret_cast<const struct ip6_frag*>(*start);
+        if (ntohs(ip6frag->ip6f_offlg) & 0xfff8) {
+          return true;
+        }
+        // otherwise, fall through to treating this like any other
+        // extention.
+      }
+#ifdef IPPROTO_MH
+      case IPPROTO_MH:
+#endif
+      case IPPROTO_HOPOPTS:
+      case IPPROTO_ROUTING:
+      case IPPROTO_DSTOPTS: {
+        if (*start + sizeof(struct ip6_ext) > limit) {
+          return false;
+        }
+        auto ip6ext = reinterpret_cast<const struct ip6_ext*>(*start);
+        *protocol = ip6ext->ip6e_nxt;
+        *start += (ip6ext->ip6e_len + 1) * 8;
+        break;
+      }
+      default:
+        return true;
+    }
+  }
+}
+
+// DNSName decodes the possibly compressed domain name at start, within the DNS
+// message between msg and limit, into the form it's indexed in: lowercased,
+// with its labels in reverse order, so a name's subdomains all start with it.
+// "www.Example.com" becomes "com.example.www".  *next is set just past the
+// name, or to NULL if it's malformed.  Returns false if the name isn't
+// indexed: the root, or any with a label holding a dot or a byte other than
+// printable ASCII.
+bool DNSName(const char* msg, const char* limit, const char* start,
+             std::string* name, const char** next) {
+  std::vector<std::string> labels;
+  bool ok = true;
+  // Compression pointers must point before the labels they're found after,
+  // so following them can't loop.
+  const char* bound = start;
+  size_t size = 0;
+  *next = NULL;
+  while (true) {
+    if (start >= limit) {
+      *next = NULL;
+      return false;
+    }
+    uint8_t n = *start;
+    if (n == 0) {
+      if (*next == NULL) {
+        *next = start + 1;
+      }
+      if (labels.empty() || !ok) {
+        return false;
+      }
+      name->clear();
+      for (auto label = labels.rbegin(); label != labels.rend(); ++label) {
+        if (!name->empty()) {
+          name->push_back('.');
+        }
+        name->append(*label);
+      }
+      return true;
+    } else if ((n & 0xC0) == 0xC0) {
+      if (start + 2 > limit) {
+        *next = NULL;
+        return false;
+      }
+      const char* ptr =
+          msg + (ntohs(*reinterpret_cast<const uint16_t*>(start)) & 0x3FFF);
+      if (ptr >= bound) {
+        *next = NULL;
+        return false;
+      }
+      if (*next == NULL) {
+        *next = start + 2;
+      }
+      start = bound = ptr;
+    } else if (n & 0xC0) {  // Reserved label types
+      *next = NULL;
+      return false;
+    } else {
+      size += n + 1;
+      if (size > kDNSMaxNameLen || start + 1 + n > limit) {
+        *next = NULL;
+        return false;
+      }
+      std::string label(start + 1, n);
+      for (auto& c : label) {
+        uint8_t u = c;
+        if (u <= ' ' || u > '~' || u == '.') {
+          ok = false;
+        }
+        c = tolower(u);
+      }
+      labels.push_back(label);
+      start += 1 + n;
+    }
+  }
+}
+
+// IndexName returns name, a dotted domain name, in the form DNSName gives.
+std::string IndexName(std::string name) {
+  if (!name.empty() && name.back() == '.') {
+    name.pop_back();
+  }
+  std::vector<std::string> labels;
+  for (size_t begin = 0;;) {
+    size_t dot = name.find('.', begin);
+    if (dot == std::string::npos) {
+      labels.push_back(name.substr(begin));
+      break;
+    }
+    labels.push_back(name.substr(begin, dot - begin));
+    begin = dot + 1;
+  }
+  std::string out;
+  for (auto label = labels.rbegin(); label != labels.rend(); ++label) {
+    if (label != labels.rbegin()) {
+      out.push_back('.');
+    }
+    out += *label;
+  }
+  for (auto& c : out) {
+    c = tolower(uint8_t(c));
+  }
+  return out;
+}
+
+// TLSReader reads the fields of a TLS handshake message.  Once a field would
+// run past the end, ok() is false and all reads return nothing.
+class TLSReader {
+ public:
+  TLSReader(const char* start, const char* limit)
+      : start_(start), limit_(limit), ok_(true) {}
+
+  bool ok() const { return ok_; }
+  // more returns whether there's anything left to read.
+  bool more() const { return ok_ && start_ < limit_; }
+  size_t left() const { return ok_ ? limit_ - start_ : 0; }
+
+  const char* Bytes(size_t n) {
+    if (!ok_ || n > size_t(limit_ - start_)) {
+      ok_ = false;
+      return NULL;
+    }
+    const char* out = start_;
+    start_ += n;
+    return out;
+  }
+  int U8() {
+    const char* b = Bytes(1);
+    return b ? uint8_t(b[0]) : 0;
+  }
+  int U16() {
+    const char* b = Bytes(2);
+    return b ? (uint8_t(b[0]) << 8) | uint8_t(b[1]) : 0;
+  }
+  // Vec8 and Vec16 read a field holding a 1 or 2 byte length, then that many
+  // bytes, returning a reader for the bytes.
+  TLSReader Vec8() { return Sub(U8()); }
+  TLSReader Vec16() { return Sub(U16()); }
+
+ private:
+  TLSReader Sub(size_t n) {
+    const char* b = Bytes(n);
+    TLSReader out(b, b ? b + n : NULL);
+    out.ok_ = ok_;
+    return out;
+  }
+
+  const char* start_;
+  const char* limit_;
+  bool ok_;
+};
+
+// TLSGREASE returns whether v is one of the values (RFC 8701) clients send to
+// keep servers tolerant of unknown ones, which JA3 ignores.
+bool TLSGREASE(int v) {
+  return (v & 0x0F0F) == 0x0A0A && (v >> 8) == (v & 0xFF);
+}
+
+// AppendDecimal appends v to the '-' separated list *out.
+void AppendDecimal(int v, std::string* out) {
+  if (!out->empty()) {
+    out->push_back('-');
+  }
+  *out += std::to_string(v);
+}
+
+// TLSList returns the decimal values of the size-byte integers r holds,
+// separated by '-', leaving out GREASE values.
+std::string TLSList(TLSReader r, size_t size) {
+  std::string out;
+  while (r.left() >= size) {
+    int v = r.U8();
+    if (size == 2) {
+      v = (v << 8) | r.U8();
+    }
+    if (!TLSGREASE(v)) {
+      AppendDecimal(v, &out);
+    }
+  }
+  return out;
+}
+
+// Printable returns whether s is all printable ASCII, without spaces.
+bool Printable(const std::string& s) {
+  for (uint8_t c : s) {
+    if (c <= ' ' || c > '~') {
+      return false;
+    }
+  }
+  return true;
+}
+
+// TLSServerName returns a server name extension's host name in the form
+// DNSName gives, or "" if it holds bytes other than printable ASCII.
+std::string TLSServerName(TLSReader name) {
+  size_t size = name.left();
+  const char* start = name.Bytes(size);
+  if (size == 0 || size > kDNSMaxNameLen) {
+    return "";
+  }
+  std::string host(start, size);
+  return Printable(host) ? IndexName(host) : "";
+}
+
+// EqualFold returns whether a and b are equal, ignoring ASCII case.
+bool EqualFold(const std::string& a, const std::string& b) {
+  if (a.size() != b.size()) {
+    return false;
+  }
+  for (size_t i = 0; i < a.size(); i++) {
+    if (tolower(uint8_t(a[i])) != tolower(uint8_t(b[i]))) {
+      return false;
+    }
+  }
+  return true;
+}
+
+// HTTPLine sets *line to the line starting at *start, without its line
+// ending, and moves *start past it.  It returns false if there's no whole line
+// before limit.
+bool HTTPLine(const char** start, const char* limit, std::string* line) {
+  const char* end = std::find(*start, limit, '\n');
+  if (end == limit) {
+    return false;
+  }
+  line->assign(*start, end);
+  if (!line->empty() && line->back() == '\r') {
+    line->pop_back();
+  }
+  *start = end + 1;
+  return true;
+}
+
+// HTTPMethodStart returns whether start begins with one of kHTTPMethods
+// followed by a space.
+bool HTTPMethodStart(const char* start, const char* limit) {
+  for (const char* m : kHTTPMethods) {
+    size_t len = strlen(m);
+    if (size_t(limit - start) > len && memcmp(start, m, len) == 0 &&
+        start[len] == ' ') {
+      return true;
+    }
+  }
+  return false;
+}
+
+// HTTPHost returns the host of an authority, without its port, in the form
+// DNSName gives, or "" if it isn't a valid host name.  IPv6 addresses aren't
+// indexed.
+std::string HTTPHost(std::string authority) {
+  size_t colon = authority.rfind(':');
+  if (colon != std::string::npos) {
+    authority.resize(colon);
+  }
+  if (authority.empty() || authority.size() > kDNSMaxNameLen ||
+      authority[0] == '[' || !Printable(authority)) {
+    return "";
+  }
+  return IndexName(authority);
+}
+
+// HTTPRequest decodes the HTTP/1 request line and headers between start and
+// limit, setting *method, *path to the path it targets, without any query or
+// fragment, and *host to the host it's for, in the form DNSName gives.  The
+// host is that of its Host header or, lacking one, the authority of an
+// absolute or CONNECT target.  It returns false if start doesn't begin a
+// request line.
+bool HTTPRequest(const char* start, const char* limit, std::string* method,
+                 std::string* path, std::string* host) {
+  // Most payloads aren't requests, so look for a method before copying
+  // anything.
+  if (!HTTPMethodStart(start, limit)) {
+    return false;
+  }
+  std::string line;
+  if (!HTTPLine(&start, limit, &line)) {
+    return false;
+  }
+  size_t space1 = line.find(' ');
+  size_t space2 =
+      space1 == std::string::npos ? space1 : line.find(' ', space1 + 1);
+  if (space2 == std::string::npos ||
+      line.find(' ', space2 + 1) != std::string::npos ||
+      line.compare(space2 + 1, 7, "HTTP/1.") != 0) {
+    return false;
+  }
+  *method = line.substr(0, space1);
+  if (std::find(std::begin(kHTTPMethods), std::end(kHTTPMethods), *method) ==
+      std::end(kHTTPMethods)) {
+    return false;
+  }
+  std::string target = line.substr(space1 + 1, space2 - space1 - 1);
+  std::string authority;
+  if (*method == "CONNECT") {
+    authority = target;
+  } else if (!target.empty() && target[0] == '/') {
+    *path = target;
+  } else if (target.size() > 7 && EqualFold(target.substr(0, 7), "http://")) {
+    size_t slash = target.find('/', 7);
+    if (slash == std::string::npos) {
+      authority = target.substr(7);
+      *path = "/";
+    } else {
+      authority = target.substr(7, slash - 7);
+      *path = target.substr(slash);
+    }
+  }
+  size_t query = path->find_first_of("?#");
+  if (query != std::string::npos) {
+    path->resize(query);
+  }
+  while (HTTPLine(&start, limit, &line) && !line.empty()) {
+    size_t colon = line.find(':');
+    if (colon != std::string::npos && colon > 0 &&
+        EqualFold(line.substr(0, colon), "host")) {
+      authority = line.substr(colon + 1);
+      authority.erase(0, authority.find_first_not_of(" \t"));
+      authority.erase(authority.find_last_not_of(" \t") + 1);
+      break;
+    }
+  }
+  *host = HTTPHost(authority);
+  return true;
+}
+
+// TLSClientHello decodes the body of a ClientHello, setting *ja3 to its JA3
+// string and *sni to the host name it gives in its server name extension, if
+// any, in the form DNSName gives.  Returns false if it's malformed.
+bool TLSClientHello(TLSReader r, std::string* sni, std::string* ja3) {
+  int version = r.U16();
+  r.Bytes(32);  // Random
+  r.Vec8();     // Session ID
+  TLSReader ciphers = r.Vec16();
+  r.Vec8();  // Compression methods
+  // Extensions may be left out entirely.
+  TLSReader exts(NULL, NULL);
+  if (r.more()) {
+    exts = r.Vec16();
+  }
+  if (!r.ok()) {
+    return false;
+  }
+  std::string extensions, groups, formats;
+  while (exts.more()) {
+    int type = exts.U16();
+    TLSReader ext = exts.Vec16();
+    if (!exts.ok() || TLSGREASE(type)) {
+      continue;
+    }
+    AppendDecimal(type, &extensions);
+    switch (type) {
+      case kTLSExtServerName: {
+        TLSReader names = ext.Vec16();
+        while (names.more()) {
+          int name_type = names.U8();
+          TLSReader name = names.Vec16();
+          if (names.ok() && name_type == kTLSHostName && sni->empty()) {
+            *sni = TLSServerName(name);
+          }
+        }
+        break;
+      }
+      case kTLSExtSupportedGroups:
+        groups = TLSList(ext.Vec16(), 2);
+        break;
+      case kTLSExtECPointFormats:
+        formats = TLSList(ext.Vec8(), 1);
+        break;
+    }
+  }
+  if (!exts.ok()) {
+    return false;
+  }
+  *ja3 = std::to_string(version) + "," + TLSList(ciphers, 2) + "," +
+         extensions + "," + groups + "," + formats;
+  return true;
+}
+
+// TLSServerHello decodes the body of a ServerHello, setting *ja3s to its JA3S
+// string.  Returns false if it's malformed.
+bool TLSServerHello(TLSReader r, std::string* ja3s) {
+  int version = r.U16();
+  r.Bytes(32);  // Random
+  r.Vec8();     // Session ID
+  int cipher = r.U16();
+  r.U8();  // Compression method
+  // Extensions may be left out entirely.
+  TLSReader exts(NULL, NULL);
+  if (r.more()) {
+    exts = r.Vec16();
+  }
+  std::string extensions;
+  while (exts.more()) {
+    int type = exts.U16();
+    exts.Vec16();
+    if (exts.ok() && !TLSGREASE(type)) {
+      AppendDecimal(type, &extensions);
+    }
+  }
+  if (!r.ok() || !exts.ok()) {
+    return false;
+  }
+  *ja3s = std::to_string(version) + "," + std::to_string(cipher) + "," +
+          extensions;
+  return true;
+}
+
+// ICMPReply returns the type of the replies to ICMP (or if v6 is set, ICMPv6)
+// messages of the given type, or of the requests they reply to, which
+// Community IDs treat like a flow's two ports.  Returns -1 for types which
+// don't come in pairs.
+int ICMPReply(uint8_t type, bool v6) {
+  static const uint8_t kPairs[][2] = {
+      {8, 0},    // Echo
+      {13, 14},  // Timestamp
+      {15, 16},  // Information
+      {10, 9},   // Router solicitation and advertisement
+      {17, 18},  // Address mask
+  };
+  static const uint8_t kPairs6[][2] = {
+      {128, 129},  // Echo
+      {130, 131},  // Multicast listener query and report
+      {133, 134},  // Router solicitation and advertisement
+      {135, 136},  // Neighbor solicitation and advertisement
+      {139, 140},  // Node information query and response
+      {144, 145},  // Home agent address discovery
+  };
+  const uint8_t(*begin)[2] = v6 ? std::begin(kPairs6) : std::begin(kPairs);
+  const uint8_t(*end)[2] = v6 ? std::end(kPairs6) : std::end(kPairs);
+  for (auto pair = begin; pair != end; ++pair) {
+    if ((*pair)[0] == type) {
+      return (*pair)[1];
+    }
+    if ((*pair)[1] == type) {
+      return (*pair)[0];
+    }
+  }
+  return -1;
+}
+
+// CommunityID returns the SHA-1 hash the version 1 Community ID, with a seed
+// of zero, of the flow between addresses src and dst encodes, for a packet
+// whose header of the given protocol is between payload and limit.  Returns
+// "" if its ports, or ICMP type and code, are truncated.
+std::string CommunityID(leveldb::Slice src, leveldb::Slice dst,
+                        uint8_t protocol, const char* payload,
+                        const char* limit) {
+  bool v6 = src.size() == 16;
+  bool ports = false, one_way = false;
+  uint16_t sport = 0, dport = 0;
+  if (protocol == IPPROTO_TCP || protocol == IPPROTO_UDP ||
+      protocol == IPPROTO_SCTP) {
+    if (payload + 4 > limit) {
+      return "";
+    }
+    sport = ntohs(*reinterpret_cast<const uint16_t*>(payload));
+    dport = ntohs(*reinterpret_cast<const uint16_t*>(payload + 2));
+    ports = true;
+  } else if ((protocol == IPPROTO_ICMP && !v6) ||
+             (protocol == IPPROTO_ICMPV6 && v6)) {
+    if (payload + 2 > limit) {
+      return "";
+    }
+    // The type is the flow's source "port", and its pair, or lacking one the
+    // code, the destination.
+    int reply = ICMPReply(payload[0], v6);
+    one_way = reply < 0;
+    sport = uint8_t(payload[0]);
+    dport = one_way ? uint8_t(payload[1]) : reply;
+    ports = true;
+  }
+  // Both directions of a flow hash the same, ordered from the lower address
+  // and port, unless the ICMP message has no reply.
+  int order = src.compare(dst);
+  if (!one_way && (order > 0 || (order == 0 && sport > dport))) {
+    std::swap(src, dst);
+    std::swap(sport, dport);
+  }
+  std::string in(2, '\0');  // The seed
+  in.append(src.data(), src.size());
+  in.append(dst.data(), dst.size());
+  in.push_back(protocol);
+  in.push_back('\0');
+  if (ports) {
+    in.push_back(sport >> 8);
+    in.push_back(sport & 0xFF);
+    in.push_back(dport >> 8);
+    in.push_back(dport & 0xFF);
+  }
+  return SHA1(in);
+}
+
+}  // namespace
 
 void Index::Process(const Packet& p, int64_t block_offset) {
   packets_++;
   int64_t packet_offset = block_offset + p.offset_in_block;
   CHECK(packet_offset < (int64_t(1) << 32));
+  if (!options_.length_buckets.empty()) {
+    AddLength(p.length, packet_offset);
+  }
   const char* start = p.data.data();
   const char* limit = start + p.data.size();
   uint16_t type = kTypeEthernet;
   uint8_t protocol = 0;
+  // Later IPv4 fragments still have their "ports" indexed, but mustn't be
+  // decoded as tunnels.
+  bool first_fragment = true;
+  leveldb::Slice src, dst;  // The outermost IP addresses
 
 // We use a goto loop within this switch statement to strip all pre-IP-header
 // layers off of the given packet.
@@ -64,6 +635,10 @@ pre_ip_encapsulation:
         return;
       }
       auto eth = reinterpret_cast<const struct ethhdr*>(start);
+      if (options_.macs) {
+        AddMAC(eth->h_source, packet_offset);
+        AddMAC(eth->h_dest, packet_offset);
+      }
       start += sizeof(struct ethhdr);
       type = ntohs(eth->h_proto);
       goto pre_ip_encapsulation;
@@ -124,10 +699,13 @@ pre_ip_encapsulation:
       auto ip4 = reinterpret_cast<const struct iphdr*>(start);
       AddIPv4(ntohl(ip4->saddr), packet_offset);
       AddIPv4(ntohl(ip4->daddr), packet_offset);
+      src = leveldb::Slice(reinterpret_cast<const char*>(&ip4->saddr), 4);
+      dst = leveldb::Slice(reinterpret_cast<const char*>(&ip4->daddr), 4);
       size_t len = ip4->ihl;
       len *= 4;
       if (len < 20) return;
       protocol = ip4->protocol;
+      first_fragment = !(ntohs(ip4->frag_off) & IP_OFFMASK);
       start += len;
       break;
     }
@@ -138,48 +716,28 @@ pre_ip_encapsulation:
       auto ip6 = reinterpret_cast<const struct ip6_hdr*>(start);
       protocol = ip6->ip6_ctlun.ip6_un1.ip6_un1_nxt;
       start += sizeof(struct ip6_hdr);
-      AddIPv6(leveldb::Slice(reinterpret_cast<const char*>(&ip6->ip6_src), 16),
-              packet_offset);
-      AddIPv6(leveldb::Slice(reinterpret_cast<const char*>(&ip6->ip6_dst), 16),
-              packet_offset);
+      src = leveldb::Slice(reinterpret_cast<const char*>(&ip6->ip6_src), 16);
+      dst = leveldb::Slice(reinterpret_cast<const char*>(&ip6->ip6_dst), 16);
+      AddIPv6(src, packet_offset);
+      AddIPv6(dst, packet_offset);
 
-    // Here, we use another goto loop to strip off all IPv6 extensions.
-    ip6_extensions:
-      switch (protocol) {
-        case IPPROTO_FRAGMENT: {
-          if (start + sizeof(struct ip6_frag) > limit) {
-            return;
-          }
-          auto ip6frag = reinterpret_cast<const struct ip6_frag*>(start);
-          if (ntohs(ip6frag->ip6f_offlg) & 0xfff8) {
-            // If we're not the first fragment, break out of the loop so we
-            // can store the IPs we have but recognize in the protocol switch
-            // later on that we don't know what this packet is.
-            break;
-          }
-          // otherwise, fall through to treating this like any other
-          // extention.
-        }
-#ifdef IPPROTO_MH
-        case IPPROTO_MH:
-#endif
-        case IPPROTO_HOPOPTS:
-        case IPPROTO_ROUTING:
-        case IPPROTO_DSTOPTS: {
-          if (start + sizeof(struct ip6_ext) > limit) {
-            return;
-          }
-          auto ip6ext = reinterpret_cast<const struct ip6_ext*>(start);
-          protocol = ip6ext->ip6e_nxt;
-          start += (ip6ext->ip6e_len + 1) * 8;
-          goto ip6_extensions;
-        }
+      if (!StripIPv6Extensions(&protocol, &start, limit)) {
+        return;
       }
+      first_fragment = protocol != IPPROTO_FRAGMENT;
       break;
     }
     default:
       return;
   }
+  if (options_.community_ids && first_fragment) {
+    // Later fragments don't show their flow's ports, or for IPv6, even its
+    // protocol.
+    std::string id = CommunityID(src, dst, protocol, start, limit);
+    if (!id.empty()) {
+      AddCommunityID(id, packet_offset);
+    }
+  }
   AddProtocol(protocol, packet_offset);
   switch (protocol) {
     case IPPROTO_TCP: {
@@ -189,6 +747,24 @@ pre_ip_encapsulation:
       auto tcp = reinterpret_cast<const struct tcphdr*>(start);
       AddPort(ntohs(tcp->source), packet_offset);
       AddPort(ntohs(tcp->dest), packet_offset);
+      AddProtoPort(protocol, ntohs(tcp->source), packet_offset);
+      AddProtoPort(protocol, ntohs(tcp->dest), packet_offset);
+      if (options_.tcp_flags) {
+        // The flags are the 14th byte, after the data offset.
+        AddTCPFlags(reinterpret_cast<const uint8_t*>(start)[13],
+                    packet_offset);
+      }
+      if (first_fragment && tcp->doff >= 5) {
+        const char* payload = start + tcp->doff * 4;
+        if ((ntohs(tcp->source) == kPortDNS || ntohs(tcp->dest) == kPortDNS) &&
+            payload + 2 <= limit) {
+          // Messages over TCP follow a 2-byte length.  Only those starting a
+          // segment are found.
+          ProcessDNS(payload + 2, limit, packet_offset);
+        }
+        ProcessTLS(payload, limit, packet_offset);
+        ProcessHTTP(payload, limit, packet_offset);
+      }
       break;
     }
     case IPPROTO_UDP: {
@@ -198,11 +774,260 @@ pre_ip_encapsulation:
       auto udp = reinterpret_cast<const struct udphdr*>(start);
       AddPort(ntohs(udp->source), packet_offset);
       AddPort(ntohs(udp->dest), packet_offset);
+      AddProtoPort(protocol, ntohs(udp->source), packet_offset);
+      AddProtoPort(protocol, ntohs(udp->dest), packet_offset);
+      if (!first_fragment) {
+        return;
+      }
+      start += sizeof(struct udphdr);
+      if (ntohs(udp->source) == kPortDNS || ntohs(udp->dest) == kPortDNS) {
+        ProcessDNS(start, limit, packet_offset);
+      }
+      switch (ntohs(udp->dest)) {
+        case kPortVXLAN:
+          // An 8-byte header, its I flag marking a valid VNI, then ethernet.
+          if (start + 8 > limit || !(start[0] & 0x08)) {
+            return;
+          }
+          ProcessInner(ETH_P_TEB, start + 8, limit, packet_offset);
+          break;
+        case kPortGeneve: {
+          if (start + 8 > limit || (uint8_t(start[0]) >> 6)) {
+            return;
+          }
+          // Options are counted in 4-byte words.
+          const char* payload = start + 8 + (start[0] & 0x3F) * 4;
+          if (payload > limit) {
+            return;
+          }
+          ProcessInner(ntohs(*reinterpret_cast<const uint16_t*>(start + 2)),
+                       payload, limit, packet_offset);
+          break;
+        }
+      }
+      break;
+    }
+    case IPPROTO_IPIP:
+      if (first_fragment) {
+        ProcessInner(ETH_P_IP, start, limit, packet_offset);
+      }
+      break;
+    case IPPROTO_IPV6:
+      if (first_fragment) {
+        ProcessInner(ETH_P_IPV6, start, limit, packet_offset);
+      }
+      break;
+    case IPPROTO_GRE: {
+      if (!first_fragment || start + 4 > limit) {
+        return;
+      }
+      uint16_t flags = ntohs(*reinterpret_cast<const uint16_t*>(start));
+      if (flags & (kGRERouting | kGREVersion)) {
+        // Source routed, or PPTP's enhanced GRE, neither of which carry
+        // anything we decode.
+        return;
+      }
+      const char* payload = start + 4;
+      if (flags & kGREChecksum) payload += 4;
+      if (flags & kGREKey) payload += 4;
+      if (flags & kGRESequence) payload += 4;
+      if (payload > limit) {
+        return;
+      }
+      ProcessInner(ntohs(*reinterpret_cast<const uint16_t*>(start + 2)),
+                   payload, limit, packet_offset);
+      break;
+    }
+    default:
+      return;
+  }
+}
+
+void Index::ProcessInner(uint16_t type, const char* start, const char* limit,
+                         uint32_t pos) {
+  if (type == ETH_P_TEB) {
+    if (start + sizeof(struct ethhdr) > limit) {
+      return;
+    }
+    type = ntohs(reinterpret_cast<const struct ethhdr*>(start)->h_proto);
+    start += sizeof(struct ethhdr);
+  }
+  while (type == ETH_P_8021Q || type == ETH_P_8021AD || type == ETH_P_QINQ1 ||
+         type == ETH_P_QINQ2 || type == ETH_P_QINQ3) {
+    if (start + 4 > limit) {
+      return;
+    }
+    type = ntohs(*reinterpret_cast<const uint16_t*>(start + 2));
+    start += 4;
+  }
+  uint8_t protocol = 0;
+  switch (type) {
+    case ETH_P_IP: {
+      if (start + sizeof(struct iphdr) > limit) {
+        return;
+      }
+      auto ip4 = reinterpret_cast<const struct iphdr*>(start);
+      AddInnerIPv4(ntohl(ip4->saddr), pos);
+      AddInnerIPv4(ntohl(ip4->daddr), pos);
+      size_t len = ip4->ihl;
+      len *= 4;
+      if (len < 20 || (ntohs(ip4->frag_off) & IP_OFFMASK)) return;
+      protocol = ip4->protocol;
+      start += len;
+      break;
+    }
+    case ETH_P_IPV6: {
+      if (start + sizeof(struct ip6_hdr) > limit) {
+        return;
+      }
+      auto ip6 = reinterpret_cast<const struct ip6_hdr*>(start);
+      protocol = ip6->ip6_ctlun.ip6_un1.ip6_un1_nxt;
+      start += sizeof(struct ip6_hdr);
+      AddInnerIPv6(
+          leveldb::Slice(reinterpret_cast<const char*>(&ip6->ip6_src), 16),
+          pos);
+      AddInnerIPv6(
+          leveldb::Slice(reinterpret_cast<const char*>(&ip6->ip6_dst), 16),
+          pos);
+      if (!StripIPv6Extensions(&protocol, &start, limit)) {
+        return;
+      }
       break;
     }
     default:
       return;
   }
+  switch (protocol) {
+    case IPPROTO_TCP: {
+      if (start + sizeof(struct tcphdr) > limit) {
+        return;
+      }
+      auto tcp = reinterpret_cast<const struct tcphdr*>(start);
+      AddInnerPort(ntohs(tcp->source), pos);
+      AddInnerPort(ntohs(tcp->dest), pos);
+      break;
+    }
+    case IPPROTO_UDP: {
+      if (start + sizeof(struct udphdr) > limit) {
+        return;
+      }
+      auto udp = reinterpret_cast<const struct udphdr*>(start);
+      AddInnerPort(ntohs(udp->source), pos);
+      AddInnerPort(ntohs(udp->dest), pos);
+      break;
+    }
+  }
+}
+
+void Index::ProcessDNS(const char* msg, const char* limit, uint32_t pos) {
+  if (msg + 12 > limit) {
+    return;
+  }
+  uint16_t flags = ntohs(*reinterpret_cast<const uint16_t*>(msg + 2));
+  if (flags & kDNSOpcode) {
+    return;  // Only standard queries are decoded.
+  }
+  int questions = ntohs(*reinterpret_cast<const uint16_t*>(msg + 4));
+  int records = ntohs(*reinterpret_cast<const uint16_t*>(msg + 6));
+  const char* start = msg + 12;
+  std::vector<std::string> names;
+  std::string name;
+  const char* next;
+  bool intact = true;
+  for (; questions > 0; questions--) {
+    bool ok = DNSName(msg, limit, start, &name, &next);
+    if (next == NULL || next + 4 > limit) {
+      intact = false;
+      break;
+    }
+    if (ok) {
+      names.push_back(name);
+    }
+    start = next + 4;  // Type and class
+  }
+  for (auto& n : names) {
+    AddDNSName(n, pos);
+  }
+  if (!options_.dns_answers || !intact || !(flags & kDNSResponse) ||
+      (flags & kDNSRcode) || names.empty()) {
+    return;
+  }
+  // Answers may be for the questions' CNAMEs rather than the questions, but
+  // count for the questions all the same.
+  for (; records > 0; records--) {
+    DNSName(msg, limit, start, &name, &next);
+    if (next == NULL || next + 10 > limit) {
+      return;
+    }
+    uint16_t type = ntohs(*reinterpret_cast<const uint16_t*>(next));
+    uint16_t cls = ntohs(*reinterpret_cast<const uint16_t*>(next + 2));
+    uint16_t rdlen = ntohs(*reinterpret_cast<const uint16_t*>(next + 8));
+    const char* rdata = next + 10;  // After type, class, TTL and length.
+    if (rdata + rdlen > limit) {
+      return;
+    }
+    if (cls == kDNSClassIN && ((type == kDNSTypeA && rdlen == 4) ||
+                               (type == kDNSTypeAAAA && rdlen == 16))) {
+      for (auto& n : names) {
+        AddDNSAnswer(n, leveldb::Slice(rdata, rdlen), pos);
+      }
+    }
+    start = rdata + rdlen;
+  }
+}
+
+void Index::ProcessTLS(const char* record, const char* limit, uint32_t pos) {
+  if (record + 5 + 4 > limit || uint8_t(record[0]) != kTLSHandshake ||
+      record[1] != 3) {
+    return;
+  }
+  const char* msg = record + 5;
+  size_t length =
+      (uint8_t(msg[1]) << 16) | (uint8_t(msg[2]) << 8) | uint8_t(msg[3]);
+  if (4 + length > size_t(limit - msg)) {
+    return;
+  }
+  TLSReader body(msg + 4, msg + 4 + length);
+  switch (uint8_t(msg[0])) {
+    case kTLSClientHello: {
+      std::string sni, ja3;
+      if (TLSClientHello(body, &sni, &ja3)) {
+        AddJA3(ja3, pos);
+        if (!sni.empty()) {
+          AddTLSServerName(sni, pos);
+        }
+      }
+      break;
+    }
+    case kTLSServerHello: {
+      std::string ja3s;
+      if (TLSServerHello(body, &ja3s)) {
+        AddJA3S(ja3s, pos);
+      }
+      break;
+    }
+  }
+}
+
+void Index::ProcessHTTP(const char* payload, const char* limit,
+                        uint32_t pos) {
+  if (payload > limit) {
+    return;
+  }
+  std::string method, path, host;
+  if (!HTTPRequest(payload, limit, &method, &path, &host)) {
+    return;
+  }
+  if (!host.empty()) {
+    AddHTTPHost(host, pos);
+  }
+  if (!options_.http_requests) {
+    return;
+  }
+  AddHTTPMethod(method, pos);
+  if (!path.empty() && path.size() <= kHTTPMaxPathLen && Printable(path)) {
+    AddHTTPPath(path, pos);
+  }
 }
 
 namespace {
@@ -239,10 +1064,66 @@ void WriteToIndex(char first, const char* start, int size,
   ss->Add(leveldb::Slice(buf, size + 1), ValueFromVector(val));
 }
 
+// WriteStringToIndex is WriteToIndex for values of any length, like names.
+void WriteStringToIndex(char first, const std::string& value,
+                        std::vector<uint32_t>& val, leveldb::TableBuilder* ss) {
+  std::string key(1, first);
+  key.append(value);
+  ss->Add(key, ValueFromVector(val));
+}
+
+// IP filters, Bloom filters of an index's IP keys (see indexfile/filter.go),
+// are sized for a false positive rate of about 1%.
+const size_t kFilterBitsPerKey = 10;
+const uint8_t kFilterHashes = 7;
+const size_t kFilterMinBytes = 8;
+
+// FilterHash sets *h1 and *h2 to the two hashes of key that a key's filter
+// bits are derived from: the halves of its FNV-1a hash, mixed by
+// MurmurHash3's finalizer.  *h2 is odd, so bits don't repeat in small filters.
+void FilterHash(const std::string& key, uint32_t* h1, uint32_t* h2) {
+  uint64_t h = 14695981039346656037ULL;
+  for (uint8_t c : key) {
+    h ^= c;
+    h *= 1099511628211ULL;
+  }
+  h ^= h >> 33;
+  h *= 0xff51afd7ed558ccdULL;
+  h ^= h >> 33;
+  h *= 0xc4ceb9fe1a85ec53ULL;
+  h ^= h >> 33;
+  *h1 = uint32_t(h);
+  *h2 = uint32_t(h >> 32) | 1;
+}
+
+// IPFilter returns the IP filter holding keys: the number of bits set per
+// key, then the filter's bits, lowest first in each byte.
+std::string IPFilter(const std::vector<std::string>& keys) {
+  size_t size =
+      std::max(kFilterMinBytes, (keys.size() * kFilterBitsPerKey + 7) / 8);
+  std::string filter(1 + size, '\0');
+  filter[0] = kFilterHashes;
+  uint32_t bits = size * 8;
+  for (auto& key : keys) {
+    uint32_t h1, h2;
+    FilterHash(key, &h1, &h2);
+    for (uint32_t i = 0; i < kFilterHashes; i++) {
+      uint32_t bit = (h1 + i * h2) % bits;
+      filter[1 + bit / 8] |= 1 << (bit % 8);
+    }
+  }
+  return filter;
+}
+
 // Should be incremented for backwards-incompatible changes.
 const uint16_t kIndexVersionNumberMajor = 2;
 // Should be incremented for backwards-compatible changes.
-const uint16_t kIndexVersionNumberMinor = 0;
+// 1: Added protocol+port keys.
+// 2: Added DNS question names.
+// 3: Added TLS server names and JA3/JA3S fingerprints.
+// 4: Added HTTP hosts.
+// 5: Added the key types record.
+const uint16_t kIndexVersionNumberMinor = 5;
 
 const char kIndexVersion = 0;
 const char kIndexProtocol = 1;
@@ -251,10 +1132,35 @@ const char kIndexVLAN = 3;
 const char kIndexIPv4 = 4;
 const char kIndexMPLS = 5;
 const char kIndexIPv6 = 6;
+const char kIndexMAC = 8;
+const char kIndexInnerIPv4 = 9;
+const char kIndexInnerIPv6 = 10;
+const char kIndexInnerPort = 11;
+const char kIndexTCPFlags = 12;
+const char kIndexLength = 13;
+const char kIndexProtoPort = 14;
+const char kIndexDNSName = 15;
+const char kIndexDNSAnswer = 16;
+const char kIndexTLSServerName = 17;
+const char kIndexJA3 = 18;
+const char kIndexJA3S = 19;
+const char kIndexHTTPHost = 20;
+const char kIndexHTTPMethod = 21;
+const char kIndexHTTPPath = 22;
+const char kIndexCommunityID = 23;
+const char kIndexIPFilter = 24;  // Sorts after all keys holding positions
+const char kIndexKeyTypes = 25;
+const char kIndexWriter = 29;
+
+// STENOTYPE_VERSION is recorded in the indexes stenotype writes.  Set it at
+// build time with "make VERSION=1.2.3".
+#ifndef STENOTYPE_VERSION
+#define STENOTYPE_VERSION "unknown"
+#endif
 
 }  // namespace
 
-Error Index::Flush() {
+Error Index::Flush(bool sync) {
   leveldb::WritableFile* file = NULL;
   std::string filename = HiddenFile(dirname_, micros_);
   auto status = leveldb::Env::Default()->NewWritableFile(filename, &file);
@@ -263,7 +1169,7 @@ Error Index::Flush() {
   }
   std::unique_ptr<leveldb::WritableFile> cleaner(file);
 
-  RETURN_IF_ERROR(WriteTo(file), "writing index " + filename);
+  RETURN_IF_ERROR(WriteTo(file, sync), "writing index " + filename);
 
   std::string unhidden = UnhiddenFile(dirname_, micros_);
   LOG(INFO) << "Wrote all index files for " << filename << ", moving to "
@@ -272,11 +1178,13 @@ Error Index::Flush() {
   VLOG(1) << "Stored " << packets_ << " with " << ip4_.size() << " IP4 "
           << ip6_.size() << " IP6 " << proto_.size() << " protos "
           << port_.size() << " ports " << vlan_.size() << " vlan "
-          << mpls_.size() << " mpls";
+          << mpls_.size() << " mpls " << inner_ip4_.size() << " inner IP4 "
+          << inner_ip6_.size() << " inner IP6 " << inner_port_.size()
+          << " inner ports " << dns_name_.size() << " DNS names";
   return SUCCESS;
 }
 
-Error Index::WriteTo(leveldb::WritableFile* file) {
+Error Index::WriteTo(leveldb::WritableFile* file, bool sync) {
   leveldb::Options options;
   options.compression = leveldb::kNoCompression;
   leveldb::TableBuilder index_ss(options, file);
@@ -290,6 +1198,24 @@ Error Index::WriteTo(leveldb::WritableFile* file) {
       htonl(kIndexVersionNumberMinor);
   index_ss.Add(leveldb::Slice(versionKeyBuf, 1), leveldb::Slice(versionBuf, 8));
 
+  std::vector<std::string> ip_keys;
+  for (auto& iter : ip4_) {
+    uint32_t ip4 = htonl(iter.first);
+    ip_keys.push_back(std::string(1, kIndexIPv4) +
+                      std::string(reinterpret_cast<const char*>(&ip4), 4));
+  }
+  for (auto& iter : ip6_) {
+    ip_keys.push_back(std::string(1, kIndexIPv6) + iter.first.ToString());
+  }
+  for (auto& iter : inner_ip4_) {
+    uint32_t ip4 = htonl(iter.first);
+    ip_keys.push_back(std::string(1, kIndexInnerIPv4) +
+                      std::string(reinterpret_cast<const char*>(&ip4), 4));
+  }
+  for (auto& iter : inner_ip6_) {
+    ip_keys.push_back(std::string(1, kIndexInnerIPv6) + iter.first.ToString());
+  }
+
 #define WRITE_TO_INDEX(name, convert, indextype, size)                    \
   do {                                                                    \
     for (auto iter : name##_) {                                           \
@@ -305,18 +1231,97 @@ Error Index::WriteTo(leveldb::WritableFile* file) {
   WRITE_TO_INDEX(ip4, htonl, kIndexIPv4, 4);
   WRITE_TO_INDEX(mpls, htonl, kIndexMPLS, 4);
 
-#undef WRITE_TO_INDEX
-
   for (auto iter : ip6_) {
     auto ip6 = iter.first.data();
     WriteToIndex(kIndexIPv6, ip6, 16, iter.second, &index_ss);
   }
 
+  for (auto iter : mac_) {
+    char mac[6];
+    for (int i = 0; i < 6; i++) {
+      mac[i] = iter.first >> (8 * (5 - i));
+    }
+    WriteToIndex(kIndexMAC, mac, 6, iter.second, &index_ss);
+  }
+
+  WRITE_TO_INDEX(inner_ip4, htonl, kIndexInnerIPv4, 4);
+  for (auto iter : inner_ip6_) {
+    auto ip6 = iter.first.data();
+    WriteToIndex(kIndexInnerIPv6, ip6, 16, iter.second, &index_ss);
+  }
+  WRITE_TO_INDEX(inner_port, htons, kIndexInnerPort, 2);
+  WRITE_TO_INDEX(tcp_flag, , kIndexTCPFlags, 1);
+  WRITE_TO_INDEX(length, htonl, kIndexLength, 4);
+  for (auto iter : proto_port_) {
+    // The low 3 bytes: protocol, then port.
+    char proto_port[3] = {char(iter.first >> 16), char(iter.first >> 8),
+                          char(iter.first)};
+    WriteToIndex(kIndexProtoPort, proto_port, 3, iter.second, &index_ss);
+  }
+  for (auto iter : dns_name_) {
+    WriteStringToIndex(kIndexDNSName, iter.first, iter.second, &index_ss);
+  }
+  for (auto iter : dns_answer_) {
+    WriteStringToIndex(kIndexDNSAnswer, iter.first, iter.second, &index_ss);
+  }
+  for (auto iter : tls_server_name_) {
+    WriteStringToIndex(kIndexTLSServerName, iter.first, iter.second,
+                       &index_ss);
+  }
+  for (auto iter : ja3_) {
+    WriteStringToIndex(kIndexJA3, iter.first, iter.second, &index_ss);
+  }
+  for (auto iter : ja3s_) {
+    WriteStringToIndex(kIndexJA3S, iter.first, iter.second, &index_ss);
+  }
+  for (auto iter : http_host_) {
+    WriteStringToIndex(kIndexHTTPHost, iter.first, iter.second, &index_ss);
+  }
+  for (auto iter : http_method_) {
+    WriteStringToIndex(kIndexHTTPMethod, iter.first, iter.second, &index_ss);
+  }
+  for (auto iter : http_path_) {
+    WriteStringToIndex(kIndexHTTPPath, iter.first, iter.second, &index_ss);
+  }
+  for (auto iter : community_id_) {
+    WriteStringToIndex(kIndexCommunityID, iter.first, iter.second, &index_ss);
+  }
+  index_ss.Add(leveldb::Slice(&kIndexIPFilter, 1), IPFilter(ip_keys));
+  // The key types record lists, in order, every key type this index was
+  // written to hold, so readers can tell a type with no keys from one that
+  // wasn't indexed.
+  std::string key_types = {kIndexProtocol, kIndexPort, kIndexVLAN,
+                           kIndexIPv4, kIndexMPLS, kIndexIPv6};
+  if (options_.macs) key_types += kIndexMAC;
+  key_types += {kIndexInnerIPv4, kIndexInnerIPv6, kIndexInnerPort};
+  if (options_.tcp_flags) key_types += kIndexTCPFlags;
+  if (!options_.length_buckets.empty()) key_types += kIndexLength;
+  key_types += {kIndexProtoPort, kIndexDNSName};
+  if (options_.dns_answers) key_types += kIndexDNSAnswer;
+  key_types += {kIndexTLSServerName, kIndexJA3, kIndexJA3S, kIndexHTTPHost};
+  if (options_.http_requests) {
+    key_types += {kIndexHTTPMethod, kIndexHTTPPath};
+  }
+  if (options_.community_ids) key_types += kIndexCommunityID;
+  index_ss.Add(leveldb::Slice(&kIndexKeyTypes, 1), key_types);
+  // The writer record names the stenotype that wrote the index, for
+  // stenographer to record with the blockfile.
+  index_ss.Add(leveldb::Slice(&kIndexWriter, 1),
+               "stenotype " STENOTYPE_VERSION);
+
+#undef WRITE_TO_INDEX
+
   auto finished = index_ss.Finish();
   if (!finished.ok()) {
     return ERROR("could not finish writing index table: " +
                  finished.ToString());
   }
+  if (sync) {
+    auto synced = file->Sync();
+    if (!synced.ok()) {
+      return ERROR("could not sync index table: " + synced.ToString());
+    }
+  }
   auto closed = file->Close();
   if (!closed.ok()) {
     return ERROR("could not close index table: " + closed.ToString());
@@ -334,6 +1339,16 @@ void Index::AddIPv6(leveldb::Slice ip, uint32_t pos) {
     finder->second.push_back(pos);
   }
 }
+void Index::AddInnerIPv6(leveldb::Slice ip, uint32_t pos) {
+  CHECK(ip.size() == 16);
+  auto finder = inner_ip6_.find(ip);
+  if (finder == inner_ip6_.end()) {
+    ip = ip_pieces_.Store(ip);
+    inner_ip6_[ip].push_back(pos);
+  } else {
+    finder->second.push_back(pos);
+  }
+}
 
 #define ADD_TO_INDEX(name, pos)   \
   do {                            \
@@ -347,6 +1362,83 @@ void Index::AddPort(uint16_t port, uint32_t pos) { ADD_TO_INDEX(port, pos); }
 void Index::AddVLAN(uint16_t vlan, uint32_t pos) { ADD_TO_INDEX(vlan, pos); }
 void Index::AddMPLS(uint32_t mpls, uint32_t pos) { ADD_TO_INDEX(mpls, pos); }
 void Index::AddIPv4(uint32_t ip4, uint32_t pos) { ADD_TO_INDEX(ip4, pos); }
+void Index::AddInnerIPv4(uint32_t inner_ip4, uint32_t pos) {
+  ADD_TO_INDEX(inner_ip4, pos);
+}
+void Index::AddInnerPort(uint16_t inner_port, uint32_t pos) {
+  ADD_TO_INDEX(inner_port, pos);
+}
+
+void Index::AddProtoPort(uint8_t proto, uint16_t port, uint32_t pos) {
+  uint32_t proto_port = (uint32_t(proto) << 16) | port;
+  ADD_TO_INDEX(proto_port, pos);
+}
+
+void Index::AddDNSName(const std::string& dns_name, uint32_t pos) {
+  ADD_TO_INDEX(dns_name, pos);
+}
+
+void Index::AddDNSAnswer(const std::string& name, leveldb::Slice ip,
+                         uint32_t pos) {
+  // Names never hold a zero byte, so one separates the two.
+  std::string dns_answer = name;
+  dns_answer.push_back('\0');
+  dns_answer.append(ip.data(), ip.size());
+  ADD_TO_INDEX(dns_answer, pos);
+}
+
+void Index::AddTLSServerName(const std::string& tls_server_name,
+                             uint32_t pos) {
+  ADD_TO_INDEX(tls_server_name, pos);
+}
+
+void Index::AddJA3(const std::string& fingerprint, uint32_t pos) {
+  std::string ja3 = MD5(fingerprint);
+  ADD_TO_INDEX(ja3, pos);
+}
+
+void Index::AddJA3S(const std::string& fingerprint, uint32_t pos) {
+  std::string ja3s = MD5(fingerprint);
+  ADD_TO_INDEX(ja3s, pos);
+}
+
+void Index::AddHTTPHost(const std::string& http_host, uint32_t pos) {
+  ADD_TO_INDEX(http_host, pos);
+}
+
+void Index::AddHTTPMethod(const std::string& http_method, uint32_t pos) {
+  ADD_TO_INDEX(http_method, pos);
+}
+
+void Index::AddHTTPPath(const std::string& http_path, uint32_t pos) {
+  ADD_TO_INDEX(http_path, pos);
+}
+
+void Index::AddCommunityID(const std::string& community_id, uint32_t pos) {
+  ADD_TO_INDEX(community_id, pos);
+}
+
+void Index::AddTCPFlags(uint8_t tcp_flag, uint32_t pos) {
+  ADD_TO_INDEX(tcp_flag, pos);
+}
+
+void Index::AddLength(int64_t packet_length, uint32_t pos) {
+  // The first bucket starting past the packet's length.
+  const std::vector<uint16_t>& buckets = options_.length_buckets;
+  auto next = std::upper_bound(buckets.begin(), buckets.end(), packet_length);
+  uint32_t lo = next == buckets.begin() ? 0 : *(next - 1);
+  uint32_t hi = next == buckets.end() ? 0xFFFF : *next - 1;
+  uint32_t length = (lo << 16) | hi;
+  ADD_TO_INDEX(length, pos);
+}
+
+void Index::AddMAC(const unsigned char* addr, uint32_t pos) {
+  uint64_t mac = 0;
+  for (int i = 0; i < 6; i++) {
+    mac = (mac << 8) | addr[i];
+  }
+  ADD_TO_INDEX(mac, pos);
+}
 
 #undef ADD_TO_INDEX
 
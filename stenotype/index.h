@@ -97,6 +97,19 @@ class SliceSet {
   size_t last_size_;
 };
 
+// IndexOptions are the optional keys an Index records, on top of those it
+// always does.
+struct IndexOptions {
+  bool macs = false;           // Ethernet addresses
+  bool tcp_flags = false;      // TCP headers' flags
+  bool dns_answers = false;    // Addresses DNS responses give for names
+  bool http_requests = false;  // HTTP requests' methods and paths
+  bool community_ids = false;  // Community IDs of packets' flows
+  // The smallest length of each bucket after the first, in increasing
+  // order, if the bucket each packet's length falls in is indexed.
+  std::vector<uint16_t> length_buckets;
+};
+
 // Index is a simple proof-of-concept for indexing packets seen by stenotype.
 // Its main purpose currently is to determine which indexes we want to use and
 // provide a proving ground for things like "how many IPs that we see are
@@ -104,35 +117,89 @@ class SliceSet {
 // write to disk.
 class Index {
  public:
-  explicit Index(const std::string& dirname, int64_t micros)
+  explicit Index(const std::string& dirname, int64_t micros,
+                 const IndexOptions& options = IndexOptions())
       : dirname_(dirname),
         micros_(micros),
+        options_(options),
         packets_(0),
         ip_pieces_(1 << 20) {}  // Start slice set off at 1MB.
   virtual ~Index() {}
 
   void Process(const Packet& p, int64_t block_offset);
-  Error Flush();
-  Error WriteTo(leveldb::WritableFile* file);
+  // Flush writes the index out and unhides it.  If sync is set, the index is
+  // synced to disk before it's made visible.
+  Error Flush(bool sync);
+  Error WriteTo(leveldb::WritableFile* file, bool sync = false);
 
  private:
   void AddIPv4(uint32_t ip, uint32_t pos);
   void AddIPv6(leveldb::Slice ip, uint32_t pos);
   void AddProtocol(uint8_t proto, uint32_t pos);
   void AddPort(uint16_t port, uint32_t pos);
+  void AddProtoPort(uint8_t proto, uint16_t port, uint32_t pos);
   void AddVLAN(uint16_t port, uint32_t pos);
   void AddMPLS(uint32_t mpls, uint32_t pos);
+  void AddMAC(const unsigned char* mac, uint32_t pos);
+  void AddTCPFlags(uint8_t flags, uint32_t pos);
+  void AddLength(int64_t length, uint32_t pos);
+  // ProcessInner indexes the addresses and ports of a packet of the given
+  // ethernet type carried by a tunnel, between start and limit.
+  void ProcessInner(uint16_t type, const char* start, const char* limit,
+                    uint32_t pos);
+  void AddInnerIPv4(uint32_t ip, uint32_t pos);
+  void AddInnerIPv6(leveldb::Slice ip, uint32_t pos);
+  void AddInnerPort(uint16_t port, uint32_t pos);
+  // ProcessDNS indexes the question names of the DNS message between msg and
+  // limit, and with the dns_answers option, the addresses a response gives
+  // for them.
+  void ProcessDNS(const char* msg, const char* limit, uint32_t pos);
+  void AddDNSName(const std::string& name, uint32_t pos);
+  void AddDNSAnswer(const std::string& name, leveldb::Slice ip, uint32_t pos);
+  // ProcessTLS indexes the server name and JA3 fingerprint of a TLS
+  // ClientHello, or the JA3S fingerprint of a ServerHello, in a record
+  // starting at record and wholly before limit.
+  void ProcessTLS(const char* record, const char* limit, uint32_t pos);
+  void AddTLSServerName(const std::string& name, uint32_t pos);
+  void AddJA3(const std::string& fingerprint, uint32_t pos);
+  void AddJA3S(const std::string& fingerprint, uint32_t pos);
+  // ProcessHTTP indexes the host of an HTTP request starting at payload and
+  // wholly before limit, and with the http_requests option, its method and
+  // path.
+  void ProcessHTTP(const char* payload, const char* limit, uint32_t pos);
+  void AddHTTPHost(const std::string& host, uint32_t pos);
+  void AddHTTPMethod(const std::string& method, uint32_t pos);
+  void AddHTTPPath(const std::string& path, uint32_t pos);
+  void AddCommunityID(const std::string& id, uint32_t pos);
 
   std::string dirname_;
   int64_t micros_;
+  IndexOptions options_;
   int64_t packets_;
   SliceSet ip_pieces_;
   std::map<uint32_t, std::vector<uint32_t>> ip4_;
   std::map<leveldb::Slice, std::vector<uint32_t>> ip6_;
   std::map<uint8_t, std::vector<uint32_t>> proto_;
   std::map<uint16_t, std::vector<uint32_t>> port_;
+  std::map<uint32_t, std::vector<uint32_t>> proto_port_;  // proto << 16 | port
   std::map<uint16_t, std::vector<uint32_t>> vlan_;
   std::map<uint32_t, std::vector<uint32_t>> mpls_;
+  std::map<uint64_t, std::vector<uint32_t>> mac_;  // Low 48 bits
+  std::map<uint32_t, std::vector<uint32_t>> inner_ip4_;
+  std::map<leveldb::Slice, std::vector<uint32_t>> inner_ip6_;
+  std::map<uint16_t, std::vector<uint32_t>> inner_port_;
+  std::map<uint8_t, std::vector<uint32_t>> tcp_flag_;
+  std::map<uint32_t, std::vector<uint32_t>> length_;  // Bucket bounds, lo:hi
+  // Names have their labels reversed, so subdomains sort together.
+  std::map<std::string, std::vector<uint32_t>> dns_name_;
+  std::map<std::string, std::vector<uint32_t>> dns_answer_;  // Name \0 IP
+  std::map<std::string, std::vector<uint32_t>> tls_server_name_;
+  std::map<std::string, std::vector<uint32_t>> ja3_;   // MD5 hashes
+  std::map<std::string, std::vector<uint32_t>> ja3s_;  // MD5 hashes
+  std::map<std::string, std::vector<uint32_t>> http_host_;  // Reversed, too
+  std::map<std::string, std::vector<uint32_t>> http_method_;
+  std::map<std::string, std::vector<uint32_t>> http_path_;
+  std::map<std::string, std::vector<uint32_t>> community_id_;  // SHA-1 hashes
 
   DISALLOW_COPY_AND_ASSIGN(Index);
 };
@@ -43,7 +43,8 @@
  * up all N, we block on a used one finishing, then reuse it.
  * The whole pipeline consists of:
  *   - kernel gives userspace a 1MB block of packets
- *   - userspace iterates over packets in block, updates any indexes
+ *   - userspace copies the block for its index thread, which indexes its
+ *     packets in batches, off this pipeline
  *   - userspace starts async IO operation to write block to disk
  *   - after N async IO operations are submitted, we synchronously wait for the
  *     least recent one to finish.
@@ -69,9 +70,11 @@
 #include <sys/syscall.h>      // syscall(), SYS_gettid
 #include <unistd.h>           // setuid(), setgid(), getpagesize()
 
+#include <algorithm>
 #include <string>
 #include <sstream>
 #include <thread>
+#include <vector>
 
 // Due to some weird interactions with <argp.h>, <string>, and --std=c++0x, this
 // header MUST be included AFTER <string>.
@@ -113,6 +116,10 @@ int flag_index_nicelevel = 0;
 int flag_preallocate_file_mb = 0;
 bool flag_watchdogs = true;
 bool flag_promisc = true;
+bool flag_dsync = true;
+bool flag_sync_index = false;
+int64_t flag_index_buffer_mb = 64;
+st::IndexOptions flag_index_options;
 std::string flag_testimony;
 
 int ParseOptions(int key, char* arg, struct argp_state* state) {
@@ -191,6 +198,44 @@ int ParseOptions(int key, char* arg, struct argp_state* state) {
     case 321:
       flag_promisc = false;
       break;
+    case 322:
+      flag_dsync = false;
+      break;
+    case 323:
+      flag_sync_index = true;
+      break;
+    case 324:
+      flag_index_options.macs = true;
+      break;
+    case 325:
+      flag_index_options.tcp_flags = true;
+      break;
+    case 327:
+      flag_index_options.dns_answers = true;
+      break;
+    case 328:
+      flag_index_options.http_requests = true;
+      break;
+    case 329:
+      flag_index_options.community_ids = true;
+      break;
+    case 330:
+      flag_index_buffer_mb = atoll(arg);
+      break;
+    case 326: {
+      std::stringstream buckets(arg);
+      std::string bucket;
+      while (std::getline(buckets, bucket, ',')) {
+        int length = atoi(bucket.c_str());
+        if (length < 1 || length > 0xFFFF ||
+            (!flag_index_options.length_buckets.empty() &&
+             length <= flag_index_options.length_buckets.back())) {
+          argp_error(state, "--length_buckets must increase from 1 to 65535");
+        }
+        flag_index_options.length_buckets.push_back(length);
+      }
+      break;
+    }
   }
   return 0;
 }
@@ -233,6 +278,24 @@ void ParseOptions(int argc, char** argv) {
       {"blockage_sec", 319, n, 0, "A block is written at least every N secs"},
       {"blocksize_kb", 320, n, 0, "Size of a block, in KB"},
       {"no_promisc", 321, 0, 0, "Don't set promiscuous mode"},
+      {"no_dsync", 322, 0, 0,
+       "Don't wait for each block to reach disk, for battery-backed caches"},
+      {"sync_index", 323, 0, 0,
+       "Sync each index to disk before moving it into place"},
+      {"index_macs", 324, 0, 0, "Index ethernet source/destination addresses"},
+      {"index_tcp_flags", 325, 0, 0, "Index the flags of TCP headers"},
+      {"length_buckets", 326, s, 0,
+       "Index packet lengths in buckets, given as a comma-separated list of "
+       "the smallest length of each bucket after the first, like 65,513,1501"},
+      {"index_dns_answers", 327, 0, 0,
+       "Index the addresses DNS responses give for the names asked about"},
+      {"index_http_requests", 328, 0, 0,
+       "Index the methods and paths of plaintext HTTP requests"},
+      {"index_community_ids", 329, 0, 0,
+       "Index the Community ID flow hashes of packets"},
+      {"index_buffer_mb", 330, n, 0,
+       "MB of packets each thread may copy ahead of its indexing thread, "
+       "before capture waits for it"},
       {0},
   };
   struct argp argp = {options, &ParseOptions};
@@ -281,6 +344,11 @@ void DropPrivileges() {
 #define SECCOMP_RULE_ADD(...) \
   CHECK_SUCCESS(NegErrno(seccomp_rule_add(__VA_ARGS__)))
 
+// PacketFileFlags returns the flags packet files are opened with.
+int PacketFileFlags() {
+  return O_WRONLY | O_CREAT | O_DIRECT | (flag_dsync ? O_DSYNC : 0);
+}
+
 void CommonPrivileges(scmp_filter_ctx ctx) {
   // Very common operations, including sleeping, logging, and getting time.
   SECCOMP_RULE_ADD(ctx, SCMP_ACT_ALLOW, SCMP_SYS(write), 0);
@@ -356,6 +424,9 @@ void DropIndexThreadPrivileges() {
                    SCMP_A1(SCMP_CMP_EQ, O_WRONLY | O_CREAT | O_TRUNC));
   SECCOMP_RULE_ADD(ctx, SCMP_ACT_ALLOW, SCMP_SYS(open), 1,
                    SCMP_A1(SCMP_CMP_EQ, O_RDWR | O_CREAT | O_TRUNC));
+  // For --sync_index.
+  SECCOMP_RULE_ADD(ctx, SCMP_ACT_ALLOW, SCMP_SYS(fsync), 0);
+  SECCOMP_RULE_ADD(ctx, SCMP_ACT_ALLOW, SCMP_SYS(fdatasync), 0);
   CHECK_SUCCESS(NegErrno(seccomp_load(ctx)));
   seccomp_release(ctx);
 }
@@ -372,7 +443,7 @@ void DropPacketThreadPrivileges() {
                    SCMP_A1(SCMP_CMP_EQ, POLLIN));
   SECCOMP_RULE_ADD(
       ctx, SCMP_ACT_ALLOW, SCMP_SYS(open), 2,
-      SCMP_A1(SCMP_CMP_EQ, O_WRONLY | O_CREAT | O_DSYNC | O_DIRECT),
+      SCMP_A1(SCMP_CMP_EQ, PacketFileFlags()),
       SCMP_A2(SCMP_CMP_EQ, 0600));
   SECCOMP_RULE_ADD(ctx, SCMP_ACT_ALLOW, SCMP_SYS(getsockopt), 0);
   SECCOMP_RULE_ADD(ctx, SCMP_ACT_ALLOW, SCMP_SYS(rename), 0);
@@ -395,6 +466,32 @@ Error SetAffinity(int cpu) {
   return Errno(sched_setaffinity(0, sizeof(cpus), &cpus));
 }
 
+// Packets are indexed by each thread's index thread, so indexing doesn't delay
+// capture or file rotation.  The capture thread copies each block it reads
+// into an IndexBatch, and passes batches of kIndexBatchBlocks blocks through
+// the write_index queue.  Once it rotates a file, a batch with flush set
+// follows the file's last, telling the index thread to write the index out.
+// The queue holds at most --index_buffer_mb of batches, so capture only waits
+// for indexing if it falls that far behind.
+const int kIndexBatchBlocks = 4;
+
+struct IndexBatch {
+  // BatchedPacket is a packet in the batch's copy of its blocks.
+  struct BatchedPacket {
+    size_t data_offset;  // Of the packet's data in IndexBatch::data
+    size_t data_size;
+    int64_t length;
+    int64_t timestamp_nsecs;
+    size_t offset_in_block;
+    int64_t block_offset;  // Of the packet's block in its file
+  };
+  IndexBatch(Index* i, bool f) : index(i), flush(f) {}
+  Index* index;
+  bool flush;
+  std::string data;
+  std::vector<BatchedPacket> packets;
+};
+
 void WriteIndexes(int thread, st::ProducerConsumerQueue* write_index) {
   VLOG(1) << "Starting WriteIndexes thread " << thread;
   Watchdog dog("WriteIndexes thread " + std::to_string(thread),
@@ -403,16 +500,30 @@ void WriteIndexes(int thread, st::ProducerConsumerQueue* write_index) {
   LOG_IF_ERROR(Errno(setpriority(PRIO_PROCESS, tid, flag_index_nicelevel)),
                "setpriority");
   DropIndexThreadPrivileges();
+  Packet p;
   while (true) {
-    VLOG(1) << "Waiting for index";
-    Index* i = reinterpret_cast<Index*>(write_index->Get());
-    VLOG(1) << "Got index " << int64_t(i);
-    if (i == NULL) {
+    VLOG(2) << "Waiting for index batch";
+    IndexBatch* batch = reinterpret_cast<IndexBatch*>(write_index->Get());
+    if (batch == NULL) {
       break;
     }
-    LOG_IF_ERROR(i->Flush(), "index flush");
-    VLOG(1) << "Wrote index " << int64_t(i);
-    delete i;
+    Index* i = batch->index;
+    if (batch->flush) {
+      VLOG(1) << "Got index " << int64_t(i);
+      LOG_IF_ERROR(i->Flush(flag_sync_index), "index flush");
+      VLOG(1) << "Wrote index " << int64_t(i);
+      delete i;
+    } else {
+      for (const auto& packet : batch->packets) {
+        p.data = leveldb::Slice(batch->data.data() + packet.data_offset,
+                                packet.data_size);
+        p.length = packet.length;
+        p.timestamp_nsecs = packet.timestamp_nsecs;
+        p.offset_in_block = packet.offset_in_block;
+        i->Process(p, packet.block_offset);
+      }
+    }
+    delete batch;
     dog.Feed();
   }
   VLOG(1) << "Exiting write index thread";
@@ -454,7 +565,7 @@ void RunThread(int thread, st::ProducerConsumerQueue* write_index,
   LOG(INFO) << "Thread " << thread << " starting to process packets";
 
   // Set up file writing, if requested.
-  Output output(flag_aiops);
+  Output output(flag_aiops, PacketFileFlags());
 
   // All dirnames are guaranteed to end with '/'.
   std::string file_dirname = flag_dir + "PKT" + std::to_string(thread) + "/";
@@ -466,10 +577,20 @@ void RunThread(int thread, st::ProducerConsumerQueue* write_index,
       output.Rotate(file_dirname, micros, flag_preallocate_file_mb << 20));
   Index* index = NULL;
   if (flag_index) {
-    index = new Index(index_dirname, micros);
+    index = new Index(index_dirname, micros, flag_index_options);
   } else {
     LOG(ERROR) << "Indexing turned off";
   }
+  // The blocks copied for the index thread since it was last sent a batch.
+  IndexBatch* batch = NULL;
+  int batch_blocks = 0;
+  auto send_batch = [&]() {
+    if (batch != NULL) {
+      write_index->Put(batch);
+      batch = NULL;
+      batch_blocks = 0;
+    }
+  };
 
   int64_t start = GetCurrentTimeMicros();
   int64_t lastlog = 0;
@@ -492,8 +613,9 @@ void RunThread(int thread, st::ProducerConsumerQueue* write_index,
       CHECK_SUCCESS(
           output.Rotate(file_dirname, micros, flag_preallocate_file_mb << 20));
       if (flag_index) {
-        write_index->Put(index);
-        index = new Index(index_dirname, micros);
+        send_batch();
+        write_index->Put(new IndexBatch(index, true));
+        index = new Index(index_dirname, micros, flag_index_options);
       }
     }
     // Read in a new block from AF_PACKET.
@@ -503,10 +625,25 @@ void RunThread(int thread, st::ProducerConsumerQueue* write_index,
       continue;
     }
 
-    // Index all packets if necessary.
+    // Copy the block for the index thread to index its packets, if
+    // necessary.
     if (flag_index) {
+      if (batch == NULL) {
+        batch = new IndexBatch(index, false);
+        batch->data.reserve(kIndexBatchBlocks * flag_blocksize_kb * 1024);
+      }
+      leveldb::Slice data = b.Data();
+      size_t copied = batch->data.size();
+      batch->data.append(data.data(), data.size());
       for (; remaining != 0 && b.Next(&p); remaining--) {
-        index->Process(p, block_offset * flag_blocksize_kb * 1024);
+        batch->packets.push_back({copied + (p.data.data() - data.data()),
+                                  p.data.size(), p.length, p.timestamp_nsecs,
+                                  p.offset_in_block,
+                                  block_offset * int64_t(flag_blocksize_kb) *
+                                      1024});
+      }
+      if (++batch_blocks == kIndexBatchBlocks) {
+        send_batch();
       }
     }
     blocks++;
@@ -537,7 +674,8 @@ void RunThread(int thread, st::ProducerConsumerQueue* write_index,
   VLOG(1) << "Finishing thread " << thread;
   // Write out the last index.
   if (flag_index) {
-    write_index->Put(index);
+    send_batch();
+    write_index->Put(new IndexBatch(index, true));
   }
   // Close last open file.
   CHECK_SUCCESS(output.Flush());
@@ -565,6 +703,7 @@ int Main(int argc, char** argv) {
   CHECK(flag_blockage_sec > 0);
   CHECK(flag_fileage_sec % flag_blockage_sec == 0);
   CHECK(flag_blocksize_kb >= 10);
+  CHECK(flag_index_buffer_mb > 0);
   CHECK(flag_blocksize_kb * 1024 >= (uint64_t)(getpagesize()));
   CHECK((flag_blocksize_kb * 1024) % (uint64_t)(getpagesize()) == 0);
   if (flag_dir[flag_dir.size() - 1] != '/') {
@@ -654,6 +793,11 @@ int Main(int argc, char** argv) {
   // Now, we can finally start the threads that read in packets, index them, and
   // write them to disk.
   auto write_indexes = new st::ProducerConsumerQueue[flag_threads];
+  for (int i = 0; i < flag_threads; i++) {
+    write_indexes[i].SetCapacity(std::max(
+        int64_t(1), flag_index_buffer_mb * 1024 /
+                        int64_t(kIndexBatchBlocks * flag_blocksize_kb)));
+  }
   VLOG(1) << "Starting writing threads";
   std::vector<std::thread*> threads;
   for (int i = 0; i < flag_threads; i++) {
@@ -662,9 +806,10 @@ int Main(int argc, char** argv) {
         new std::thread(&RunThread, i, &write_indexes[i], sockets[i]));
   }
 
-  // To avoid blocking on index writes, each writer thread has a secondary
-  // thread just for creating and writing the indexes.  We pass to-write
-  // indexes through to the writing thread via the write_index FIFO queue.
+  // To avoid blocking on indexing, each writer thread has a secondary thread
+  // just for indexing packets and writing the indexes.  We pass packets and
+  // to-write indexes through to it via the write_index FIFO queue (see
+  // IndexBatch).
   // TODO(gconnell):  Move index writing thread creation into RunThread.
   std::vector<std::thread*> index_threads;
   if (flag_index) {
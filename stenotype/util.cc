@@ -69,10 +69,18 @@ void Notification::Notify() {
   cond_.notify_all();
 }
 
+void ProducerConsumerQueue::SetCapacity(size_t capacity) {
+  std::unique_lock<std::mutex> lock(mu_);
+  capacity_ = capacity;
+}
+
 void ProducerConsumerQueue::Put(void* val) {
   CHECK(val != NULL);
   CHECK(!closed_);
   std::unique_lock<std::mutex> lock(mu_);
+  while (capacity_ != 0 && d_.size() >= capacity_) {
+    not_full_.wait(lock);
+  }
   d_.push_back(val);
   lock.unlock();
   cond_.notify_one();
@@ -88,6 +96,8 @@ void* ProducerConsumerQueue::Get() {
   }
   void* ret = d_.front();
   d_.pop_front();
+  lock.unlock();
+  not_full_.notify_one();
   return ret;
 }
 
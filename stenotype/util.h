@@ -281,9 +281,14 @@ class Notification {
 // ProducerConsumerQueue is a very simple thread-safe FIFO queue.
 class ProducerConsumerQueue {
  public:
-  ProducerConsumerQueue() : closed_(false) {}
+  ProducerConsumerQueue() : closed_(false), capacity_(0) {}
   ~ProducerConsumerQueue() {}
 
+  // SetCapacity makes Put wait while the queue holds this many values, so a
+  // producer can't run unboundedly ahead of its consumer.  Zero, the default,
+  // is unlimited.
+  void SetCapacity(size_t capacity);
+
   // Add value onto the queue.  Must not be NULL.
   void Put(void* val);
 
@@ -296,7 +301,9 @@ class ProducerConsumerQueue {
  private:
   std::mutex mu_;
   std::condition_variable cond_;
+  std::condition_variable not_full_;
   bool closed_;
+  size_t capacity_;
   std::deque<void*> d_;
   DISALLOW_COPY_AND_ASSIGN(ProducerConsumerQueue);
 };
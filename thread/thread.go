@@ -19,6 +19,7 @@ import (
 	"encoding/binary"
 	"encoding/hex"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
@@ -26,12 +27,14 @@ import (
 	"path/filepath"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/google/stenographer/base"
 	"github.com/google/stenographer/blockfile"
 	"github.com/google/stenographer/config"
+	"github.com/google/stenographer/cryptfile"
 	"github.com/google/stenographer/filecache"
 	"github.com/google/stenographer/httputil"
 	"github.com/google/stenographer/indexfile"
@@ -44,6 +47,13 @@ var (
 	v            = base.V // verbose logging
 	currentFiles = stats.S.Get("current_files")
 	agedFiles    = stats.S.Get("aged_files")
+	// Scrub counts files checked, found damaged, and quarantined.
+	filesScrubbed    = stats.S.Get("scrubbed_files")
+	filesCorrupt     = stats.S.Get("scrubbed_corrupt_files")
+	filesQuarantined = stats.S.Get("quarantined_files")
+	indexesMigrated  = stats.S.Get("migrated_indexes")
+	// filesRuledOut counts files lookups skipped by their IP filters.
+	filesRuledOut = stats.S.Get("lookup_files_ruled_out")
 )
 
 const (
@@ -65,12 +75,72 @@ type Thread struct {
 	mu           sync.RWMutex
 	fileLastSeen time.Time
 	fc           *filecache.Cache
+	iface        string // Capturing interface, recorded in packet metadata
+	filter       string // Stenotype's compiled capture filter, recorded in v2 headers
+	// keys, if set, encrypts finished files and decrypts them for queries.
+	keys *cryptfile.Keyring
+	// indexOpts are the optional keys of the indexes the thread builds.
+	indexOpts indexfile.BuilderOptions
+	// processing allows one finished blockfile at a time to be compressed
+	// and encrypted.
+	processing chan struct{}
+	// pin, if set, matches packets which Expire keeps.
+	pin query.Query
+	// readOnly stops the thread changing or deleting any files.
+	readOnly bool
+	// scrubbed holds when Scrub last checked each file, and is only used by
+	// Scrub, which runs one at a time.
+	scrubbed map[string]time.Time
+	// unmigrated holds the files MigrateIndexes failed to reindex, so it
+	// doesn't retry them until they're reopened, and is only used by
+	// MigrateIndexes, which runs one at a time.
+	unmigrated map[string]*blockfile.BlockFile
+	// synced is set once the thread has tracked the files on disk when it
+	// started, so those it tracks since are new.  t.mu must be held.
+	synced bool
 }
 
 // Threads creates a set of thread objects based on a set of ThreadConfigs.
 func Threads(configs []config.ThreadConfig, baseDir string, fc *filecache.Cache) ([]*Thread, error) {
 	threads := make([]*Thread, len(configs))
 	for i, conf := range configs {
+		if !blockfile.KnownCompression(conf.Compression) {
+			return nil, fmt.Errorf("thread %d has unknown compression %q", i, conf.Compression)
+		}
+		if conf.Format != 0 && conf.Format != blockfile.FormatV1 && conf.Format != blockfile.FormatV2 {
+			return nil, fmt.Errorf("thread %d has unknown blockfile format %d", i, conf.Format)
+		}
+		if !blockfile.KnownReader(conf.Reader) {
+			return nil, fmt.Errorf("thread %d has unknown blockfile reader %q", i, conf.Reader)
+		}
+		if conf.SharedFilesystem && conf.Reader == blockfile.ReaderMmap {
+			return nil, fmt.Errorf("thread %d can't map blockfiles on a shared filesystem", i)
+		}
+		if conf.ReadConcurrency < 0 {
+			return nil, fmt.Errorf("thread %d has negative read concurrency %d", i, conf.ReadConcurrency)
+		}
+		if conf.CompactBelowMB < 0 || conf.CompactToMB < 0 || conf.CompactToMB > blockfile.MaxBlocks {
+			return nil, fmt.Errorf("thread %d has invalid compaction sizes %dMB, %dMB", i, conf.CompactBelowMB, conf.CompactToMB)
+		}
+		if conf.ExpireAfterHours < 0 {
+			return nil, fmt.Errorf("thread %d has negative expiry %d hours", i, conf.ExpireAfterHours)
+		}
+		if conf.ExpireAfterHours > 0 && conf.Compression != blockfile.CompressionNone {
+			return nil, fmt.Errorf("thread %d can't expire packets from compressed files", i)
+		}
+		if conf.ScrubEveryHours < 0 {
+			return nil, fmt.Errorf("thread %d has negative scrub interval %d hours", i, conf.ScrubEveryHours)
+		}
+		if conf.IndexCacheFiles < 0 || conf.IndexCacheMB < 0 {
+			return nil, fmt.Errorf("thread %d has negative index cache size %d files, %dMB", i, conf.IndexCacheFiles, conf.IndexCacheMB)
+		}
+		var pin query.Query
+		if conf.PinQuery != "" {
+			var err error
+			if pin, err = query.NewQuery(conf.PinQuery); err != nil {
+				return nil, fmt.Errorf("thread %d has invalid pin query %q: %v", i, conf.PinQuery, err)
+			}
+		}
 		thread := &Thread{
 			id:           i,
 			conf:         conf,
@@ -79,6 +149,10 @@ func Threads(configs []config.ThreadConfig, baseDir string, fc *filecache.Cache)
 			files:        map[string]*blockfile.BlockFile{},
 			fileLastSeen: time.Now(),
 			fc:           fc,
+			processing:   make(chan struct{}, 1),
+			pin:          pin,
+			scrubbed:     map[string]time.Time{},
+			unmigrated:   map[string]*blockfile.BlockFile{},
 		}
 		if err := thread.createSymlinks(); err != nil {
 			return nil, err
@@ -88,6 +162,43 @@ func Threads(configs []config.ThreadConfig, baseDir string, fc *filecache.Cache)
 	return threads, nil
 }
 
+// SetInterface records the name of the interface this thread captures from,
+// so packets read from its blockfiles say where they came from.  It must be
+// called before the thread starts tracking files.
+func (t *Thread) SetInterface(iface string) {
+	t.iface = iface
+}
+
+// SetCaptureFilter records the compiled BPF filter stenotype captures with,
+// as passed to its --filter flag, so blockfiles converted to v2 say which
+// packets they could hold.  It must be called before the thread starts
+// tracking files.
+func (t *Thread) SetCaptureFilter(filter string) {
+	t.filter = filter
+}
+
+// SetReadOnly stops the thread changing or deleting files, leaving that to the
+// process writing them: it only tracks the files it finds.  It must be called
+// before the thread starts tracking files.
+func (t *Thread) SetReadOnly() {
+	t.readOnly = true
+}
+
+// SetKeyring makes this thread encrypt its blockfiles and indexes once
+// they're finished, with the keyring's current key, and decrypt them for
+// queries.  It must be called before the thread starts tracking files.
+func (t *Thread) SetKeyring(keys *cryptfile.Keyring) {
+	t.keys = keys
+}
+
+// SetIndexOptions sets the optional keys this thread indexes packets by when
+// it builds indexes itself, importing, compacting or reindexing files, and
+// which of its files' indexes MigrateIndexes rebuilds.  It must be called
+// before the thread starts tracking files.
+func (t *Thread) SetIndexOptions(opts indexfile.BuilderOptions) {
+	t.indexOpts = opts
+}
+
 func makeDirIfNecessary(dir string) error {
 	if stat, err := os.Stat(dir); os.IsNotExist(err) {
 		if err := os.MkdirAll(dir, 0700); err != nil {
@@ -131,7 +242,11 @@ func (t *Thread) syncFilesWithDisk() {
 	fido := base.Watchdog(time.Minute*5, "syncing files with disk") // 5 min for initial list of files
 	defer fido.Stop()
 	newFilesCnt := 0
-	for _, filename := range t.listPacketFilesOnDisk() {
+	onDisk := t.listPacketFilesOnDisk()
+	if t.conf.SharedFilesystem {
+		t.dropChangedFiles(onDisk)
+	}
+	for _, filename := range onDisk {
 		fido.Reset(time.Minute) // 1 minute for opening each new file
 		if t.files[filename] != nil {
 			continue
@@ -146,6 +261,24 @@ func (t *Thread) syncFilesWithDisk() {
 	if newFilesCnt > 0 {
 		v(0, "Thread %v found %d new blockfiles", t.id, newFilesCnt)
 	}
+	t.synced = true
+}
+
+// dropChangedFiles stops tracking files which another process sharing our
+// directories has removed or replaced since we opened them, given the files
+// now on disk.  Replaced files are then tracked anew.  t.mu must be held.
+func (t *Thread) dropChangedFiles(onDisk []string) {
+	present := map[string]bool{}
+	for _, name := range onDisk {
+		present[name] = true
+	}
+	for name, bf := range t.files {
+		if present[name] && !bf.Replaced() {
+			continue
+		}
+		v(1, "Thread %v found %q removed or replaced by another process", t.id, name)
+		t.untrackFile(name)
+	}
 }
 
 func (t *Thread) listPacketFilesOnDisk() (out []string) {
@@ -168,17 +301,609 @@ func (t *Thread) listPacketFilesOnDisk() (out []string) {
 
 // This method should only be called once the t.mu has been acquired!
 func (t *Thread) trackNewFile(filename string) error {
-	filepath := filepath.Join(t.packetPath, filename)
-	bf, err := blockfile.NewBlockFile(filepath, t.fc)
+	bf, err := t.openFile(filename)
 	if err != nil {
-		return fmt.Errorf("could not open blockfile %q: %v", filepath, err)
+		return err
 	}
-	v(1, "new blockfile %q", filepath)
+	v(1, "new blockfile %q", bf.Name())
 	t.files[filename] = bf
 	currentFiles.Increment()
+	// Reading the stats of every index found at startup would take too
+	// long, but new files are the ones most queried.
+	if t.processes() || t.synced {
+		go t.logProcessFile(filename, t.synced)
+	}
+	return nil
+}
+
+// processes returns true if processFile has work to do on new files.
+func (t *Thread) processes() bool {
+	return !t.readOnly && (t.conf.Format == blockfile.FormatV2 || t.conf.Compression != blockfile.CompressionNone || t.keys != nil || t.conf.ChecksumFiles)
+}
+
+// indexesCustom returns true if the named file's index lacks keys of the
+// thread's custom Indexers, as stenotype's do.
+func (t *Thread) indexesCustom(filename string) bool {
+	if t.readOnly || len(t.indexOpts.CustomIndexers) == 0 {
+		return false
+	}
+	t.mu.RLock()
+	bf := t.files[filename]
+	t.mu.RUnlock()
+	return bf != nil && bf.IndexOutdated(t.indexOpts)
+}
+
+// openFile opens the named blockfile in this thread's packet directory.
+func (t *Thread) openFile(filename string) (*blockfile.BlockFile, error) {
+	filepath := t.getPacketFilePath(filename)
+	bf, err := blockfile.NewBlockFileWithOptions(filepath, t.fc, blockfile.Options{Keys: t.keys, Reader: t.conf.Reader, Shared: t.conf.SharedFilesystem})
+	if err != nil {
+		return nil, fmt.Errorf("could not open blockfile %q: %v", filepath, err)
+	}
+	bf.SetCaptureSource(t.iface, t.id)
+	return bf, nil
+}
+
+// processFile converts, compresses, and encrypts a tracked blockfile, and
+// encrypts its index, as configured and if they aren't already, then swaps the
+// results in for the originals.  Blockfiles left uncompressed and unencrypted
+// have their block checksums written, if configured.  The work runs without
+// holding t.mu, so queries continue against the original files meanwhile.
+// Fresh files, which stenotype wrote since the thread started, also have
+// their index converted to stenographer's table format, which reads faster,
+// or rebuilt if there are custom Indexers, which stenotype doesn't run.  Then
+// the stats of their index are read, for queries to plan by, unless it
+// recorded them.  It returns the first step that failed, including swapping
+// in a result.
+func (t *Thread) processFile(filename string, fresh bool) error {
+	t.processing <- struct{}{}
+	defer func() { <-t.processing }()
+	if fresh {
+		defer t.readIndexStats(filename)
+	}
+	if t.readOnly || !(fresh || t.processes()) {
+		return nil
+	}
+	path, index := t.getPacketFilePath(filename), t.getIndexFilePath(filename)
+	replace := map[string]string{} // Original path to its processed temporary
+	var temps []string
+	defer func() {
+		for _, tmp := range temps {
+			os.Remove(tmp) // Renamed away on success.
+		}
+	}()
+	temp := func(path, step string) string {
+		tmp := filepath.Join(filepath.Dir(path), "."+filename+"."+step)
+		os.Remove(tmp) // Left over if we crashed while processing.
+		temps = append(temps, tmp)
+		return tmp
+	}
+	// Files are compressed before they're encrypted, since ciphertext doesn't
+	// compress, so an encrypted blockfile needs nothing more.
+	encrypted, err := cryptfile.IsEncryptedFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) { // Deleted since we tracked it.
+			return fmt.Errorf("could not read %q: %v", path, err)
+		}
+		return nil
+	}
+	src := path
+	compressed := false
+	if !encrypted {
+		if compressed, err = blockfile.IsCompressed(path); err != nil {
+			return fmt.Errorf("could not check compression of %q: %v", path, err)
+		}
+	}
+	// Only uncompressed files can be converted, so one compressed before
+	// Format was set stays v1.
+	if !encrypted && !compressed && t.conf.Format == blockfile.FormatV2 {
+		if format, err := blockfile.FileFormat(path); err != nil {
+			return fmt.Errorf("could not check format of %q: %v", path, err)
+		} else if format != blockfile.FormatV2 {
+			tmp := temp(path, "converting")
+			hostname, _ := os.Hostname()
+			h := blockfile.Header{Host: hostname, Interface: t.iface, Version: t.captureVersion(filename), Filter: t.filter}
+			if err := blockfile.ConvertFile(path, tmp, h); err != nil {
+				return fmt.Errorf("could not convert %q: %v", path, err)
+			}
+			replace[path], src = tmp, tmp
+		}
+	}
+	if !encrypted && !compressed && t.conf.Compression == blockfile.CompressionNone && t.keys == nil && t.conf.ChecksumFiles {
+		// Written beside the converted copy, if there is one, to be
+		// swapped in with it.
+		if src != path {
+			sums := blockfile.ChecksumPath(src)
+			os.Remove(sums) // Left over if we crashed while processing.
+			temps = append(temps, sums)
+			replace[blockfile.ChecksumPath(path)] = sums
+		}
+		if err := blockfile.WriteChecksums(src); err != nil {
+			return fmt.Errorf("could not checksum %q: %v", path, err)
+		}
+	}
+	if !encrypted && !compressed && t.conf.Compression != blockfile.CompressionNone {
+		tmp := temp(path, "compressing")
+		if err := blockfile.CompressFile(src, tmp, t.conf.Compression); err != nil {
+			return fmt.Errorf("could not compress %q: %v", path, err)
+		}
+		replace[path], src = tmp, tmp
+	}
+	if !encrypted && t.keys != nil {
+		tmp := temp(path, "encrypting")
+		if err := cryptfile.EncryptFile(src, tmp, t.keys, cryptfile.BlockfileChunkSize); err != nil {
+			return fmt.Errorf("could not encrypt %q: %v", path, err)
+		}
+		replace[path] = tmp
+	}
+	indexEncrypted, err := cryptfile.IsEncryptedFile(index)
+	if err != nil {
+		return fmt.Errorf("could not read %q: %v", index, err)
+	}
+	indexSrc := index
+	if fresh && t.indexesCustom(filename) {
+		// The original is read, since its packets are where its copies'
+		// are.
+		tmp := temp(index, "indexing")
+		if _, err := blockfile.Reindex(path, tmp, t.keys, t.indexOpts, 0); err != nil {
+			return fmt.Errorf("could not index %q with custom indexers: %v", path, err)
+		}
+		replace[index], indexSrc = tmp, tmp
+	} else if fresh && !indexEncrypted {
+		tmp := temp(index, "rewriting")
+		if converted, err := indexfile.ConvertFile(index, tmp); err != nil {
+			return fmt.Errorf("could not convert %q: %v", index, err)
+		} else if converted {
+			replace[index], indexSrc = tmp, tmp
+		}
+	}
+	if t.keys != nil && (indexSrc != index || !indexEncrypted) {
+		tmp := temp(index, "encrypting")
+		if err := cryptfile.EncryptFile(indexSrc, tmp, t.keys, cryptfile.IndexChunkSize); err != nil {
+			return fmt.Errorf("could not encrypt %q: %v", index, err)
+		}
+		replace[index] = tmp
+	}
+	if len(replace) == 0 {
+		return nil
+	}
+	if t.conf.SharedFilesystem {
+		lock, err := blockfile.LockExclusive(path)
+		if err != nil {
+			return fmt.Errorf("could not lock %q to replace it: %v", path, err)
+		}
+		defer lock.Unlock()
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	old := t.files[filename]
+	if old == nil {
+		return nil // Cleaned up while we were processing.
+	}
+	// Close waits for current queries on the file, and must happen before the
+	// renames, or the file cache could reopen a processed file as if it were
+	// the original.
+	old.Close()
+	// Two files can't be renamed at once, so the blockfile goes first: its
+	// packets stay where they were, so the original index still works with
+	// it, and under base.SyncStrict a replaced index is never visible before
+	// the data it points into.  The first failure stops the rest, leaving
+	// the file whatever was swapped in so far, which is reopened as usual
+	// and processed again on restart.
+	var renameErr error
+	for _, dst := range []string{path, blockfile.ChecksumPath(path), index} {
+		tmp, ok := replace[dst]
+		if !ok {
+			continue
+		}
+		if err := os.Rename(tmp, dst); err != nil {
+			renameErr = fmt.Errorf("could not replace %q with its processed copy: %v", dst, err)
+			break
+		} else if err := base.SyncDir(dst); err != nil {
+			renameErr = fmt.Errorf("could not sync the directory of %q: %v", dst, err)
+			break
+		}
+	}
+	if _, ok := replace[blockfile.ChecksumPath(path)]; !ok && replace[path] != "" && renameErr == nil {
+		os.Remove(blockfile.ChecksumPath(path)) // Those of the original, if any.
+	}
+	bf, err := t.openFile(filename)
+	if err != nil {
+		delete(t.files, filename)
+		currentFiles.IncrementBy(-1)
+		if renameErr != nil {
+			return renameErr
+		}
+		return fmt.Errorf("could not reopen %q: %v", path, err)
+	}
+	t.files[filename] = bf
+	if renameErr != nil {
+		return renameErr
+	}
+	v(1, "processed blockfile %q", path)
+	return nil
+}
+
+// captureVersion returns the Version to record in the named file's v2 header:
+// stenographer's, and that of the stenotype which wrote the file, as its index
+// records, since that decides the index's format.
+func (t *Thread) captureVersion(filename string) string {
+	version := "stenographer " + base.Version
+	t.mu.RLock()
+	bf := t.files[filename]
+	t.mu.RUnlock()
+	if bf != nil {
+		if writer := bf.IndexWriter(); writer != "" {
+			version += ", " + writer
+		}
+	}
+	return version
+}
+
+// logProcessFile runs processFile, logging its failure.
+func (t *Thread) logProcessFile(filename string, fresh bool) {
+	if err := t.processFile(filename, fresh); err != nil {
+		log.Printf("Thread %v could not process %q: %v", t.id, filename, err)
+	}
+}
+
+// readIndexStats reads the stats of the named file's index, unless they're
+// known already, so its queries can order their intersections by cost.  It's
+// called holding the processing token, so the file isn't replaced meanwhile.
+func (t *Thread) readIndexStats(filename string) {
+	t.mu.RLock()
+	bf := t.files[filename]
+	t.mu.RUnlock()
+	if bf == nil {
+		return // Cleaned up since.
+	}
+	if err := bf.ReadIndexStats(context.Background()); err != nil {
+		log.Printf("Thread %v could not read index stats of %q: %v", t.id, filename, err)
+	}
+}
+
+// Compact merges runs of adjacent blockfiles smaller than the thread's
+// CompactBelowMB into larger files, swapping each merged file in for its
+// originals while queries continue.
+func (t *Thread) Compact() {
+	if t.conf.CompactBelowMB <= 0 || t.readOnly {
+		return
+	}
+	// Holding the processing token stops processFile swapping files out from
+	// under a merge.
+	t.processing <- struct{}{}
+	defer func() { <-t.processing }()
+	for _, run := range t.compactionRuns() {
+		if err := t.compactRun(run); err != nil {
+			log.Printf("Thread %v could not compact %d files from %q: %v", t.id, len(run), run[0], err)
+		}
+	}
+}
+
+// compactionRuns returns the names of each run of files to merge.  A run ends
+// at a larger file, or once its files add up to CompactBelowMB, so merged
+// files are usually big enough to be left alone.  They can shrink, as merging
+// drops empty blocks, and if so are merged again later.  The newest run is
+// left to grow until it's big enough.
+func (t *Thread) compactionRuns() (runs [][]string) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	below := int64(t.conf.CompactBelowMB) << 20
+	limit := int64(t.conf.CompactToMB) << 20
+	if limit == 0 {
+		limit = blockfile.MaxBlocks << 20
+	}
+	var run []string
+	var size, data int64
+	end := func() {
+		if len(run) > 1 {
+			runs = append(runs, run)
+		}
+		run, size, data = nil, 0, 0
+	}
+	for _, name := range t.getSortedFiles() {
+		bf := t.files[name]
+		if bf.Size() >= below {
+			end()
+			continue
+		}
+		if data+bf.DataSize() > limit {
+			end()
+		}
+		run = append(run, name)
+		size += bf.Size()
+		data += bf.DataSize()
+		if size >= below {
+			end()
+		}
+	}
+	return runs
+}
+
+// compactRun merges the named files into the first of them.
+func (t *Thread) compactRun(names []string) error {
+	t.mu.RLock()
+	var srcs []*blockfile.BlockFile
+	for _, name := range names {
+		if t.files[name] == nil {
+			t.mu.RUnlock()
+			return nil // Cleaned up since we picked it.
+		}
+		srcs = append(srcs, t.files[name])
+	}
+	t.mu.RUnlock()
+	tmp := t.getPacketFilePath("." + names[0] + ".compacting")
+	tmpIndex := t.getIndexFilePath("." + names[0] + ".compacting")
+	os.Remove(tmp) // Left over if we crashed while compacting.
+	os.Remove(tmpIndex)
+	defer os.Remove(tmp) // Renamed away on success.
+	defer os.Remove(tmpIndex)
+	if err := blockfile.Merge(tmp, srcs, t.indexOpts); err != nil {
+		return err
+	}
+	if t.conf.SharedFilesystem {
+		for _, name := range names {
+			lock, err := blockfile.LockExclusive(t.getPacketFilePath(name))
+			if err != nil {
+				return fmt.Errorf("could not lock %q: %v", name, err)
+			}
+			defer lock.Unlock()
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i, name := range names {
+		if t.files[name] != srcs[i] {
+			return nil // Cleaned up while we were merging.
+		}
+	}
+	for _, bf := range srcs {
+		bf.Close()
+	}
+	// Merging kept the first file's packets where they were, so its old index
+	// still works with the merged file until the merged index replaces it.
+	// Crashing before the other files are gone duplicates their packets,
+	// rather than losing them.
+	if err := os.Rename(tmp, t.getPacketFilePath(names[0])); err != nil {
+		t.reopenFiles(names)
+		return err
+	} else if err := base.SyncDir(tmp); err != nil {
+		t.reopenFiles(names)
+		return err
+	}
+	if err := os.Rename(tmpIndex, t.getIndexFilePath(names[0])); err != nil {
+		t.reopenFiles(names)
+		return err
+	} else if err := base.SyncDir(tmpIndex); err != nil {
+		t.reopenFiles(names)
+		return err
+	}
+	for _, name := range names[1:] {
+		tryToDeleteFile(t.getIndexFilePath(name))
+		tryToDeletePacketFile(t.getPacketFilePath(name))
+		delete(t.files, name)
+		currentFiles.IncrementBy(-1)
+	}
+	v(1, "Thread %v compacted %d blockfiles into %q", t.id, len(names), names[0])
+	t.reopenFiles(names[:1])
+	if _, ok := t.files[names[0]]; ok && t.processes() {
+		go t.logProcessFile(names[0], false) // Merge records its stats.
+	}
 	return nil
 }
 
+// Expire frees the space of packets older than the thread's
+// ExpireAfterHours, a block at a time, keeping blocks which hold packets
+// matching its PinQuery, and deletes files left without packets.  Only files
+// whose names say they started before the cutoff are checked.
+func (t *Thread) Expire() {
+	if t.conf.ExpireAfterHours <= 0 || t.readOnly {
+		return
+	}
+	// Holding the processing token stops processFile or Compact rewriting a
+	// file, and so undoing its expiry, while we free its blocks.
+	t.processing <- struct{}{}
+	defer func() { <-t.processing }()
+	before := time.Now().Add(-time.Duration(t.conf.ExpireAfterHours) * time.Hour)
+	t.mu.RLock()
+	files := map[string]*blockfile.BlockFile{}
+	for _, name := range t.getSortedFiles() {
+		micros, err := strconv.ParseInt(name, 10, 64)
+		if err != nil || !time.Unix(0, micros*1000).Before(before) {
+			break
+		}
+		files[name] = t.files[name]
+	}
+	t.mu.RUnlock()
+	ctx := context.Background()
+	for name, bf := range files {
+		var pinned base.Positions
+		if t.pin != nil {
+			var err error
+			if pinned, err = bf.Positions(ctx, t.pin); err != nil {
+				log.Printf("Thread %v could not find pinned packets in %q: %v", t.id, name, err)
+				continue
+			}
+		}
+		ex, err := bf.Expire(ctx, before, pinned)
+		if err == blockfile.ErrNotExpirable {
+			v(2, "Thread %v can't expire packets from %q: %v", t.id, name, err)
+			continue
+		} else if err != nil {
+			log.Printf("Thread %v could not expire packets from %q: %v", t.id, name, err)
+			continue
+		}
+		if ex.Remaining > 0 {
+			continue
+		}
+		t.mu.Lock()
+		if t.files[name] == bf {
+			v(1, "Thread %v removing %q, which has no packets left", t.id, name)
+			tryToDeleteFile(t.getIndexFilePath(name))
+			tryToDeletePacketFile(t.getPacketFilePath(name))
+			if err := t.untrackFile(name); err != nil {
+				log.Printf("Thread %v could not untrack %q: %v", t.id, name, err)
+			}
+		}
+		t.mu.Unlock()
+	}
+}
+
+// scrubBytesPerSec caps how fast Scrub reads files, to keep it out of the way
+// of capture and queries.
+var scrubBytesPerSec int64 = 32 << 20
+
+// quarantineDir is the subdirectory of the thread's directories that Scrub
+// moves damaged files into.
+const quarantineDir = "quarantine"
+
+// Scrub checks each of the thread's files not checked within its
+// ScrubEveryHours for damage, oldest first, one at a time, logging damage
+// found and quarantining damaged files if configured.  Each file holds the
+// processing token while it's checked, so it can't be rewritten meanwhile,
+// and reads are paced to scrubBytesPerSec.
+func (t *Thread) Scrub() {
+	if t.conf.ScrubEveryHours <= 0 {
+		return
+	}
+	every := time.Duration(t.conf.ScrubEveryHours) * time.Hour
+	t.mu.RLock()
+	names := t.getSortedFiles()
+	files := map[string]*blockfile.BlockFile{}
+	for _, name := range names {
+		files[name] = t.files[name]
+	}
+	t.mu.RUnlock()
+	for name := range t.scrubbed {
+		if files[name] == nil {
+			delete(t.scrubbed, name) // Gone since.
+		}
+	}
+	for _, name := range names {
+		if last, ok := t.scrubbed[name]; ok && time.Since(last) < every {
+			continue
+		}
+		bf := files[name]
+		start := time.Now()
+		t.processing <- struct{}{}
+		t.mu.RLock()
+		current := t.files[name] == bf
+		t.mu.RUnlock()
+		var s blockfile.Scrubbed
+		var err error
+		if current {
+			s, err = bf.Scrub(context.Background())
+		}
+		<-t.processing
+		if !current {
+			continue // Replaced or removed while we waited.
+		}
+		t.scrubbed[name] = time.Now()
+		filesScrubbed.Increment()
+		if err != nil {
+			log.Printf("Thread %v could not scrub %q: %v", t.id, name, err)
+		} else if !s.OK() {
+			filesCorrupt.Increment()
+			log.Printf("Thread %v found %q damaged: %v", t.id, name, s)
+			for _, c := range s.Corrupt {
+				log.Printf("Thread %v %q corrupt region %v", t.id, name, c)
+			}
+			if t.conf.QuarantineCorrupt && !t.readOnly {
+				if err := t.quarantine(name, bf); err != nil {
+					log.Printf("Thread %v could not quarantine %q: %v", t.id, name, err)
+				}
+			}
+		}
+		if wait := time.Duration(bf.Size()*int64(time.Second)/scrubBytesPerSec) - time.Since(start); wait > 0 {
+			time.Sleep(wait)
+		}
+	}
+}
+
+// migrateBytesPerSec caps how fast MigrateIndexes reads files, like
+// scrubBytesPerSec.
+var migrateBytesPerSec int64 = 32 << 20
+
+// MigrateIndexes reindexes, like Reindex, each of the thread's files whose
+// index is outdated, oldest first, one at a time, if the thread's
+// MigrateIndexes is set.  Each file is read at up to migrateBytesPerSec.
+func (t *Thread) MigrateIndexes() {
+	if !t.conf.MigrateIndexes || t.readOnly {
+		return
+	}
+	t.mu.RLock()
+	names := t.getSortedFiles()
+	files := map[string]*blockfile.BlockFile{}
+	for _, name := range names {
+		files[name] = t.files[name]
+	}
+	t.mu.RUnlock()
+	for name, bf := range t.unmigrated {
+		if files[name] != bf {
+			delete(t.unmigrated, name) // Reopened or gone since.
+		}
+	}
+	for _, name := range names {
+		bf := files[name]
+		if t.unmigrated[name] == bf || !bf.IndexOutdated(t.indexOpts) {
+			continue
+		}
+		if _, err := t.reindex(name, migrateBytesPerSec); err != nil {
+			log.Printf("Thread %v could not migrate the index of %q: %v", t.id, name, err)
+			t.unmigrated[name] = bf
+		} else {
+			indexesMigrated.Increment()
+		}
+	}
+}
+
+// quarantine stops tracking a damaged file, and moves it and its index into
+// the quarantineDir subdirectories of the thread's directories.
+func (t *Thread) quarantine(name string, bf *blockfile.BlockFile) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.files[name] != bf {
+		return nil // Replaced or removed since it was scrubbed.
+	}
+	for _, dir := range []string{t.packetPath, t.indexPath} {
+		if err := makeDirIfNecessary(filepath.Join(dir, quarantineDir)); err != nil {
+			return err
+		}
+	}
+	bf.Close()
+	delete(t.files, name)
+	currentFiles.IncrementBy(-1)
+	// The blockfile goes first, as it's what's worth keeping: since unpaired
+	// files are removed at startup, crashing in between loses the index.
+	for _, path := range []string{t.getPacketFilePath(name), t.getIndexFilePath(name)} {
+		if err := os.Rename(path, filepath.Join(filepath.Dir(path), quarantineDir, name)); err != nil {
+			return err
+		}
+	}
+	// Its checksums, if it has any, show which blocks changed.
+	sums := blockfile.ChecksumPath(t.getPacketFilePath(name))
+	os.Rename(sums, filepath.Join(filepath.Dir(sums), quarantineDir, filepath.Base(sums)))
+	filesQuarantined.Increment()
+	log.Printf("Thread %v quarantined %q", t.id, name)
+	return nil
+}
+
+// reopenFiles reopens the named files, which have been closed, dropping any
+// which fail to open.  t.mu must be held.
+func (t *Thread) reopenFiles(names []string) {
+	for _, name := range names {
+		bf, err := t.openFile(name)
+		if err != nil {
+			log.Printf("Thread %v could not reopen %q: %v", t.id, name, err)
+			delete(t.files, name)
+			currentFiles.IncrementBy(-1)
+			continue
+		}
+		t.files[name] = bf
+	}
+}
+
 func (t *Thread) cleanUpOnLowDiskSpace() {
 	if len(t.files) == 0 {
 		return // cannot clean up files if we don't have any.
@@ -218,6 +943,12 @@ func tryToDeleteFile(filename string) {
 	}
 }
 
+// tryToDeletePacketFile deletes a blockfile, and its checksums if it has any.
+func tryToDeletePacketFile(filename string) {
+	tryToDeleteFile(filename)
+	os.Remove(blockfile.ChecksumPath(filename))
+}
+
 // pruneOldestThreadFiles deletes enough of the oldest files held by this
 // thread to free up bytes >= the size of the newest file.
 // It should only exceed the newest size by no more than the size of the last
@@ -261,7 +992,7 @@ func (t *Thread) deleteOldestThreadFiles(n int, files []string) {
 	for i := 0; i < n && i < len(files); i++ {
 		toDelete := files[i]
 		v(1, "Thread %v removing %q", t.id, toDelete)
-		go tryToDeleteFile(t.getPacketFilePath(toDelete))
+		go tryToDeletePacketFile(t.getPacketFilePath(toDelete))
 		go tryToDeleteFile(t.getIndexFilePath(toDelete))
 	}
 	for i := 0; i < n && i < len(files); i++ {
@@ -325,46 +1056,307 @@ func (t *Thread) FileLastSeen() time.Time {
 	return t.fileLastSeen
 }
 
-const concurrentBlockfileReadsPerThread = 10
+// defaultReadConcurrency is how many blockfiles each query reads at once per
+// thread, unless the thread's ReadConcurrency says otherwise.
+const defaultReadConcurrency = 10
 
 // Lookup looks up packets that match a given query within the files owned by a
-// single stenotype thread.
+// single stenotype thread.  Files are read in batches of the thread's read
+// concurrency, all files in a batch at once, merging their packets by time.
+// Files (and so batches) follow each other in time, so batches are output in
+// turn.  The next batch is set up while the current one is output, each of its
+// files starting to read once one of the current batch's is done, so disks
+// stay busy without a query ever reading more files at once than allowed.
 func (t *Thread) Lookup(ctx context.Context, q query.Query) *base.PacketChan {
+	return t.lookup(ctx, q, false)
+}
+
+// LookupTolerant acts like Lookup, but keeps going when a blockfile's lookup
+// fails.  Once every packet that could be read is out, the output fails with
+// an error naming each file which failed, if any did.
+func (t *Thread) LookupTolerant(ctx context.Context, q query.Query) *base.PacketChan {
+	return t.lookup(ctx, q, true)
+}
+
+func (t *Thread) lookup(ctx context.Context, q query.Query, tolerant bool) *base.PacketChan {
+	n := t.conf.ReadConcurrency
+	if n <= 0 {
+		n = defaultReadConcurrency
+	}
+	batches := make(chan *base.PacketChan, 1)
+	out := base.ConcatPacketChans(ctx, batches)
+	// No batch is sent until the goroutine below starts, so nothing's been
+	// sent yet.  Time to first packet covers index lookups and the first
+	// disk read.
+	out.Instrument("thread_lookup")
 	t.mu.RLock()
-	inputs := make(chan *base.PacketChan, concurrentBlockfileReadsPerThread)
-	out := base.ConcatPacketChans(ctx, inputs)
 	var files []*blockfile.BlockFile
 	for _, file := range t.getSortedFiles() {
-		files = append(files, t.files[file])
+		// Files' IP filters are held in memory, so those ruling out the
+		// query are skipped without being opened.
+		if bf := t.files[file]; bf.MayMatch(q) {
+			files = append(files, bf)
+		} else {
+			filesRuledOut.Increment()
+		}
 	}
 	t.mu.RUnlock()
+	reading := make(chan struct{}, n)
 	go func() {
+		// In tolerant lookups, each batch's merge records its files'
+		// failures.
+		var merges []batchMerge
 		defer func() {
-			close(inputs)
+			if tolerant {
+				// Failures are only known once the batches are out, so
+				// a last, empty batch reports them.
+				errs := base.NewPacketChan(0)
+				select {
+				case batches <- errs:
+					errs.Close(batchFailures(merges))
+				case <-ctx.Done():
+				}
+			}
+			close(batches)
 			<-out.Done()
 		}()
-		for _, file := range files {
-			packets := base.NewPacketChan(100)
+		for len(files) > 0 {
+			batch := files
+			if len(batch) > n {
+				batch = batch[:n]
+			}
+			files = files[len(batch):]
+			inputs := make([]*base.PacketChan, len(batch))
+			for i := range batch {
+				inputs[i] = base.NewPacketChan(100)
+			}
+			var merged *base.PacketChan
+			if tolerant {
+				var errs *base.MergeErrors
+				merged, errs = base.MergePacketChansTolerant(ctx, inputs)
+				merges = append(merges, batchMerge{merged, errs, batch})
+			} else {
+				merged = base.MergePacketChans(ctx, inputs)
+			}
 			select {
-			case inputs <- packets:
-				go file.Lookup(ctx, q, packets)
+			case batches <- merged:
 			case <-ctx.Done():
 				return
 			}
+			// Files take their turns to read in order, so those reading
+			// are always the earliest not yet done.  A later file filling
+			// its chan while an earlier one waits for a turn would
+			// otherwise stall the merge waiting on the earlier one.
+			for i, file := range batch {
+				select {
+				case reading <- struct{}{}:
+				case <-ctx.Done():
+					for _, in := range inputs[i:] {
+						in.Close(ctx.Err())
+					}
+					return
+				case <-inputs[i].Canceled():
+					inputs[i].Close(nil)
+					continue
+				}
+				go t.lookupFile(ctx, q, file, inputs[i], reading)
+			}
 		}
 	}()
 	return out
 }
 
+// batchMerge is the tolerant merge of a batch of blockfiles' lookups.
+type batchMerge struct {
+	out   *base.PacketChan
+	errs  *base.MergeErrors
+	files []*blockfile.BlockFile
+}
+
+// batchFailures waits for the merges to finish, then returns an error naming
+// each file whose lookup failed, or nil if none did.
+func batchFailures(merges []batchMerge) error {
+	var failed []string
+	for _, m := range merges {
+		<-m.out.Done()
+		errs := m.errs.Errors()
+		for i, file := range m.files {
+			if err := errs[i]; err != nil {
+				failed = append(failed, fmt.Sprintf("%s: %v", file.Name(), err))
+			}
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%d blockfiles failed: %s", len(failed), strings.Join(failed, "; "))
+}
+
+// lookupFile looks up q in a single blockfile, then gives up its turn in
+// 'reading'.
+func (t *Thread) lookupFile(ctx context.Context, q query.Query, file *blockfile.BlockFile, out *base.PacketChan, reading chan struct{}) {
+	defer func() { <-reading }()
+	file.Lookup(ctx, q, out)
+}
+
 // SyncFiles checks the disk to see if stenotype has created any new files, or
 // if old files should be deleted.
 func (t *Thread) SyncFiles() {
 	t.mu.Lock()
 	t.syncFilesWithDisk()
-	t.cleanUpOnLowDiskSpace()
+	if !t.readOnly {
+		t.cleanUpOnLowDiskSpace()
+	}
+	t.cacheNewestIndexes()
 	t.mu.Unlock()
 }
 
+// defaultIndexCacheMB is how many megabytes of positions a thread caches for
+// its newest indexes, unless its IndexCacheMB says otherwise.
+const defaultIndexCacheMB = 256
+
+// cacheNewestIndexes gives the thread's IndexCacheFiles newest files an index
+// cache, sharing IndexCacheMB between them, and takes the caches of any
+// others away, so the recent data most queries want is answered from memory.
+// Deleted files' caches go with them.  t.mu must be held.
+func (t *Thread) cacheNewestIndexes() {
+	n := t.conf.IndexCacheFiles
+	if n == 0 {
+		return
+	}
+	mb := t.conf.IndexCacheMB
+	if mb == 0 {
+		mb = defaultIndexCacheMB
+	}
+	files := t.getSortedFiles()
+	for i, name := range files {
+		var size int64
+		if i >= len(files)-n {
+			size = int64(mb) << 20 / int64(n)
+		}
+		t.files[name].SetIndexCacheSize(size)
+	}
+}
+
+// Import converts a PCAP or pcapng capture into blockfiles and indexes in this
+// thread's directories, then starts tracking them, so they're queryable like
+// anything stenotype captured.  The files are named for their packets' times,
+// so old captures are among the first removed when disk runs low.
+func (t *Thread) Import(r io.Reader) ([]blockfile.ImportedFile, error) {
+	if t.readOnly {
+		return nil, fmt.Errorf("thread %d is read-only", t.id)
+	}
+	files, err := blockfile.Import(r, t.packetPath, t.indexPath, t.indexOpts)
+	if len(files) > 0 {
+		t.SyncFiles()
+	}
+	return files, err
+}
+
+// ExportFile streams every packet in the named blockfile, in file order,
+// reading it block by block without consulting its index.
+func (t *Thread) ExportFile(ctx context.Context, name string) (*base.PacketChan, error) {
+	t.mu.RLock()
+	bf := t.files[name]
+	t.mu.RUnlock()
+	if bf == nil {
+		return nil, fmt.Errorf("thread %d has no file %q", t.id, name)
+	}
+	out := base.NewPacketChan(100)
+	go func() {
+		iter := bf.Iterate()
+		defer iter.Close()
+		out.Close(iter.Send(ctx, out))
+	}()
+	return out, nil
+}
+
+// Reindex rebuilds the index of the named blockfile from its packets, with
+// blockfile.Reindex, and swaps it in for the old one, then tracks the file if
+// it wasn't already, as when its index was lost.  Queries continue against
+// the old index while the new one is built, and the thread goes on processing
+// new files; if the blockfile is rewritten meanwhile, the new index is
+// dropped and an error returned.
+func (t *Thread) Reindex(name string) (blockfile.Reindexed, error) {
+	return t.reindex(name, 0)
+}
+
+// reindex is Reindex, reading the blockfile at up to bytesPerSec if it's
+// positive.
+func (t *Thread) reindex(name string, bytesPerSec int64) (blockfile.Reindexed, error) {
+	var r blockfile.Reindexed
+	if t.readOnly {
+		return r, fmt.Errorf("thread %d is read-only", t.id)
+	} else if name == "" || name[0] == '.' || filepath.Base(name) != name {
+		return r, fmt.Errorf("invalid file name %q", name)
+	}
+	path, index := t.getPacketFilePath(name), t.getIndexFilePath(name)
+	t.mu.RLock()
+	bf := t.files[name]
+	t.mu.RUnlock()
+	before, err := os.Stat(path)
+	if err != nil {
+		return r, fmt.Errorf("thread %d has no file %q: %v", t.id, name, err)
+	}
+	tmp := filepath.Join(t.indexPath, "."+name+".reindexing")
+	os.Remove(tmp)       // Left over if we crashed while reindexing.
+	defer os.Remove(tmp) // Renamed away on success.
+	r, err = blockfile.Reindex(path, tmp, t.keys, t.indexOpts, bytesPerSec)
+	if err != nil {
+		return r, err
+	}
+	if t.keys != nil {
+		encrypted := filepath.Join(t.indexPath, "."+name+".encrypting")
+		os.Remove(encrypted)
+		defer os.Remove(encrypted)
+		if err := cryptfile.EncryptFile(tmp, encrypted, t.keys, cryptfile.IndexChunkSize); err != nil {
+			return r, fmt.Errorf("could not encrypt index of %q: %v", name, err)
+		}
+		tmp = encrypted
+	}
+	// Holding processing stops processFile, Compact and Expire rewriting
+	// the blockfile while the new index is swapped in.  Those which did so
+	// while it was built left it a new file, or a new modification time.
+	t.processing <- struct{}{}
+	defer func() { <-t.processing }()
+	if t.conf.SharedFilesystem {
+		lock, err := blockfile.LockExclusive(path)
+		if err != nil {
+			return r, fmt.Errorf("could not lock %q: %v", name, err)
+		}
+		defer lock.Unlock()
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	old := t.files[name]
+	if after, err := os.Stat(path); err != nil || old != bf || !os.SameFile(before, after) || !after.ModTime().Equal(before.ModTime()) || after.Size() != before.Size() {
+		return r, fmt.Errorf("%q changed while it was reindexed", name)
+	}
+	if old != nil {
+		// Close waits for current queries on the file, and must happen
+		// before the rename, so the file cache doesn't serve the old index.
+		old.Close()
+	}
+	if err := os.Rename(tmp, index); err != nil {
+		if old != nil {
+			t.reopenFiles([]string{name})
+		}
+		return r, err
+	} else if err := base.SyncDir(index); err != nil {
+		log.Printf("Thread %v could not sync the directory of %q: %v", t.id, index, err)
+	}
+	v(0, "Thread %v reindexed %q: %d packets in %d blocks, %d damaged regions", t.id, name, r.Packets, r.Blocks, len(r.Damaged))
+	if old != nil {
+		t.reopenFiles([]string{name})
+		if t.files[name] == nil {
+			return r, fmt.Errorf("could not reopen %q", name)
+		}
+		return r, nil
+	}
+	return r, t.trackNewFile(name)
+}
+
 // ExportDebugHandlers exports a set of HTTP handlers on /debug/t<thread id> for
 // querying internal state from this thread.
 func (t *Thread) ExportDebugHandlers(mux *http.ServeMux) {
@@ -418,6 +1410,11 @@ func (t *Thread) ExportDebugHandlers(mux *http.ServeMux) {
 			http.Error(w, "Bad limit headers", http.StatusBadRequest)
 			return
 		}
+		rate, err := base.RateFromValues(r.URL.Query())
+		if err != nil {
+			http.Error(w, "Bad rate parameters", http.StatusBadRequest)
+			return
+		}
 		t.mu.RLock()
 		defer t.mu.RUnlock()
 		vals := r.URL.Query()
@@ -427,7 +1424,90 @@ func (t *Thread) ExportDebugHandlers(mux *http.ServeMux) {
 			return
 		}
 		w.Header().Set("Content-Type", "application/octet-stream")
-		base.PacketsToFile(file.AllPackets(), w, limit)
+		base.PacketsToFile(base.RateLimitChan(file.AllPackets(), rate), w, limit)
+	})
+	mux.HandleFunc(prefix+"/verify", func(w http.ResponseWriter, r *http.Request) {
+		w = httputil.Log(w, r, false)
+		defer log.Print(w)
+		t.mu.RLock()
+		file := t.files[r.URL.Query().Get("name")]
+		t.mu.RUnlock()
+		if file == nil {
+			http.Error(w, "file not found", http.StatusNotFound)
+			return
+		}
+		// Verify reads the file itself, so we needn't hold t.mu while it does.
+		corrupt, err := blockfile.VerifyWithKeys(file.Name(), t.keys)
+		w.Header().Set("Content-Type", "text/plain")
+		if err != nil {
+			fmt.Fprintf(w, "ERROR: %v", err)
+			return
+		}
+		fmt.Fprintf(w, "CORRUPT REGIONS: %d\n", len(corrupt))
+		for _, c := range corrupt {
+			fmt.Fprintf(w, "\t%v\n", c)
+		}
+	})
+	mux.HandleFunc(prefix+"/stats", func(w http.ResponseWriter, r *http.Request) {
+		w = httputil.Log(w, r, false)
+		defer log.Print(w)
+		t.mu.RLock()
+		file := t.files[r.URL.Query().Get("name")]
+		t.mu.RUnlock()
+		if file == nil {
+			http.Error(w, "file not found", http.StatusNotFound)
+			return
+		}
+		s, err := file.Stats(context.Background())
+		w.Header().Set("Content-Type", "text/plain")
+		if err != nil {
+			fmt.Fprintf(w, "ERROR: %v", err)
+			return
+		}
+		fmt.Fprintf(w, "PACKETS: %d\nBYTES: %d\n", s.Packets, s.Bytes)
+		if s.Packets > 0 {
+			fmt.Fprintf(w, "FIRST: %v\nLAST: %v\n", s.First.UTC().Format(time.RFC3339Nano), s.Last.UTC().Format(time.RFC3339Nano))
+		}
+		var protos []int
+		for proto := range s.Protocols {
+			protos = append(protos, int(proto))
+		}
+		sort.Ints(protos)
+		fmt.Fprintf(w, "PROTOCOLS:\n")
+		for _, proto := range protos {
+			fmt.Fprintf(w, "\t%d: %d\n", proto, s.Protocols[byte(proto)])
+		}
+	})
+	mux.HandleFunc(prefix+"/indexstats", func(w http.ResponseWriter, r *http.Request) {
+		w = httputil.Log(w, r, false)
+		defer log.Print(w)
+		t.mu.RLock()
+		file := t.files[r.URL.Query().Get("name")]
+		t.mu.RUnlock()
+		if file == nil {
+			http.Error(w, "file not found", http.StatusNotFound)
+			return
+		}
+		s, err := file.IndexStats(context.Background())
+		w.Header().Set("Content-Type", "text/plain")
+		if err != nil {
+			fmt.Fprintf(w, "ERROR: %v", err)
+			return
+		}
+		fmt.Fprintf(w, "DISTINCT IPS: %d\nDISTINCT PORTS: %d\n", s.DistinctIPs, s.DistinctPorts)
+		var names []string
+		for name := range s.KeyTypes {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		fmt.Fprintf(w, "KEY TYPES:\n")
+		for _, name := range names {
+			kt := s.KeyTypes[name]
+			fmt.Fprintf(w, "\t%s: %d keys, %d positions, %d bytes\n", name, kt.Keys, kt.Positions, kt.Bytes)
+			for _, k := range kt.Hottest {
+				fmt.Fprintf(w, "\t\t%s: %d\n", k.Key, k.Positions)
+			}
+		}
 	})
 	mux.HandleFunc(prefix+"/positions", func(w http.ResponseWriter, r *http.Request) {
 		w = httputil.Log(w, r, true)
@@ -15,17 +15,32 @@
 package thread
 
 import (
+	"bytes"
 	"encoding/hex"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/google/stenographer/base"
+	"github.com/google/stenographer/blockfile"
 	"github.com/google/stenographer/config"
+	"github.com/google/stenographer/cryptfile"
 	"github.com/google/stenographer/filecache"
+	"github.com/google/stenographer/indexfile"
+	"github.com/google/stenographer/indextable"
+	"github.com/google/stenographer/query"
+	"github.com/google/stenographer/stats"
+	"golang.org/x/net/context"
 )
 
 const (
@@ -37,10 +52,21 @@ const (
 )
 
 func createThreads(t *testing.T, tempDir string) []*Thread {
-	var tc = []config.ThreadConfig{
-		{tempDir + pktDir, tempDir + idxDir, 10, 10},
-	}
-	threads, err := Threads(tc, tempDir+baseDir, filecache.NewCache(10))
+	return createThreadsWithCompression(t, tempDir, "")
+}
+
+func createThreadsWithCompression(t *testing.T, tempDir, compression string) []*Thread {
+	return createThreadsWithConfig(t, tempDir, config.ThreadConfig{Compression: compression})
+}
+
+// createThreadsWithConfig creates a thread with the given config, filling in
+// its directories and limits.
+func createThreadsWithConfig(t *testing.T, tempDir string, conf config.ThreadConfig) []*Thread {
+	conf.PacketsDirectory = tempDir + pktDir
+	conf.IndexDirectory = tempDir + idxDir
+	conf.DiskFreePercentage = 10
+	conf.MaxDirectoryFiles = 10
+	threads, err := Threads([]config.ThreadConfig{conf}, tempDir+baseDir, filecache.NewCache(10))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -145,6 +171,15 @@ func TestExportDebugHandlers(t *testing.T) {
 			1572,
 			"d4c3b2a10200040000000000000000000000010001000000eb00dc5452d90a004600000046000000",
 		},
+		{
+			"GET",
+			"/debug/t0/stats?name=dhcp",
+			map[string]string{"Content-Type": "text/plain"},
+			"",
+			200,
+			123,
+			"PACKETS: 6\nBYTES: 1452\nFIRST: 2015-02-12T01:24:59.710994271Z\nLAST: 2015-02-12T01:25:15.061059646Z\nPROTOCOLS:\n\t17: 4\n\t58: 2\n",
+		},
 		{
 			"GET",
 			"/debug/t0/positions?name=dhcp",
@@ -177,3 +212,831 @@ func TestExportDebugHandlers(t *testing.T) {
 		}
 	}
 }
+
+func TestChecksumFiles(t *testing.T) {
+	tempDir := t.TempDir()
+	copyData(t, tempDir)
+	th := createThreadsWithConfig(t, tempDir, config.ThreadConfig{ChecksumFiles: true, Format: blockfile.FormatV2})[0]
+	th.SyncFiles()
+	path := th.getPacketFilePath("dhcp")
+	// The checksums are of the converted file, swapped in with it.
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		th.mu.Lock()
+		format := th.files["dhcp"].Format()
+		th.mu.Unlock()
+		if format == blockfile.FormatV2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("blockfile never converted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := os.Stat(blockfile.ChecksumPath(path)); err != nil {
+		t.Fatalf("no checksums written: %v", err)
+	}
+	if bad, err := blockfile.Verify(path); err != nil || len(bad) != 0 {
+		t.Errorf("want no corruption, got %v, %v", bad, err)
+	}
+	if _, err := os.Stat(blockfile.ChecksumPath(th.getPacketFilePath(".dhcp.converting"))); !os.IsNotExist(err) {
+		t.Errorf("temporary checksums left behind: %v", err)
+	}
+}
+
+func TestCompressFile(t *testing.T) {
+	tempDir := t.TempDir()
+	copyData(t, tempDir)
+	threads := createThreadsWithCompression(t, tempDir, blockfile.CompressionZstd)
+	th := threads[0]
+	th.SyncFiles()
+	path := th.getPacketFilePath("dhcp")
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		compressed, err := blockfile.IsCompressed(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The swap takes t.mu, so once we can take it after seeing the
+		// compressed file, the thread is using it.
+		th.mu.Lock()
+		th.mu.Unlock()
+		if compressed {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("blockfile never compressed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	q, err := query.NewQuery("port 67")
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	out := th.Lookup(context.Background(), q)
+	for range out.Receive() {
+		count++
+	}
+	if err := out.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if count != 4 {
+		t.Errorf("want 4 packets from compressed file, got %d", count)
+	}
+	if _, err := os.Stat(th.getPacketFilePath(".dhcp.compressing")); !os.IsNotExist(err) {
+		t.Errorf("temporary file left behind: %v", err)
+	}
+	if _, err := Threads([]config.ThreadConfig{{Compression: "bogus"}}, tempDir, nil); err == nil {
+		t.Error("want error for unknown compression")
+	}
+}
+
+func TestConvertFile(t *testing.T) {
+	tempDir := t.TempDir()
+	copyData(t, tempDir)
+	th := createThreadsWithConfig(t, tempDir, config.ThreadConfig{
+		Format:      blockfile.FormatV2,
+		Compression: blockfile.CompressionZstd,
+	})[0]
+	th.SetInterface("eth3")
+	th.SetCaptureFilter("0123abcd")
+	th.SyncFiles()
+	path := th.getPacketFilePath("dhcp")
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		// Conversion comes first, so a compressed file is converted too.
+		compressed, err := blockfile.IsCompressed(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		th.mu.Lock()
+		th.mu.Unlock()
+		if compressed {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("blockfile never processed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if format, err := blockfile.FileFormat(path); err != nil || format != blockfile.FormatV2 {
+		t.Fatalf("want v2 blockfile, got %v, %v", format, err)
+	}
+	th.mu.RLock()
+	h, ok := th.files["dhcp"].Header()
+	th.mu.RUnlock()
+	if !ok || h.Interface != "eth3" || h.Filter != "0123abcd" || h.Version != "stenographer "+base.Version+", stenotype (index format 2.0)" {
+		t.Errorf("wrong header %+v", h)
+	}
+	q, err := query.NewQuery("port 67")
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	out := th.Lookup(context.Background(), q)
+	for p := range out.Receive() {
+		if p.Meta.Provenance == nil || *p.Meta.Provenance != *h.Provenance() {
+			t.Errorf("packet %d has provenance %+v, want %+v", count, p.Meta.Provenance, h.Provenance())
+		}
+		count++
+	}
+	if err := out.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if count != 4 {
+		t.Errorf("want 4 packets from converted file, got %d", count)
+	}
+	if _, err := Threads([]config.ThreadConfig{{Format: 3}}, tempDir, nil); err == nil {
+		t.Error("want error for unknown format")
+	}
+}
+
+// testKeys provides a single key, "k1".
+type testKeys struct{}
+
+func (testKeys) Key(id string) ([]byte, error) {
+	if id != "k1" {
+		return nil, fmt.Errorf("no key %q", id)
+	}
+	return make([]byte, 32), nil
+}
+
+func TestEncryptFile(t *testing.T) {
+	tempDir := t.TempDir()
+	copyData(t, tempDir)
+	threads := createThreadsWithCompression(t, tempDir, blockfile.CompressionZstd)
+	th := threads[0]
+	keys, err := cryptfile.NewKeyring("k1", testKeys{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	th.SetKeyring(keys)
+	th.SyncFiles()
+	index := th.getIndexFilePath("dhcp")
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		encrypted, err := cryptfile.IsEncryptedFile(index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		th.mu.Lock()
+		th.mu.Unlock()
+		if encrypted {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("index never encrypted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if encrypted, err := cryptfile.IsEncryptedFile(th.getPacketFilePath("dhcp")); err != nil || !encrypted {
+		t.Fatalf("blockfile not encrypted: %v", err)
+	}
+	q, err := query.NewQuery("port 67")
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	out := th.Lookup(context.Background(), q)
+	for range out.Receive() {
+		count++
+	}
+	if err := out.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if count != 4 {
+		t.Errorf("want 4 packets from encrypted file, got %d", count)
+	}
+	corrupt, err := blockfile.VerifyWithKeys(th.getPacketFilePath("dhcp"), keys)
+	if err != nil || len(corrupt) != 0 {
+		t.Errorf("verify: got %v, %v", corrupt, err)
+	}
+}
+
+func TestImport(t *testing.T) {
+	tempDir := t.TempDir()
+	th := createThreads(t, tempDir)[0]
+	blk, err := blockfile.NewBlockFile(testBlockFile, filecache.NewCache(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blk.Close()
+	var capture bytes.Buffer
+	w := pcapgo.NewWriterNanos(&capture)
+	if err := w.WriteFileHeader(65536, layers.LinkTypeEthernet); err != nil {
+		t.Fatal(err)
+	}
+	packets := blk.AllPackets()
+	for p := range packets.Receive() {
+		if err := w.WritePacket(p.CaptureInfo, p.Data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := packets.Err(); err != nil {
+		t.Fatal(err)
+	}
+	files, err := th.Import(&capture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Packets != 6 {
+		t.Fatalf("want one file of 6 packets, got %+v", files)
+	}
+	th.mu.RLock()
+	tracked := th.files[files[0].Name] != nil
+	th.mu.RUnlock()
+	if !tracked {
+		t.Fatalf("imported file %q not tracked", files[0].Name)
+	}
+	q, err := query.NewQuery("port 67")
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	out := th.Lookup(context.Background(), q)
+	for range out.Receive() {
+		count++
+	}
+	if err := out.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if count != 4 {
+		t.Errorf("want 4 packets from imported file, got %d", count)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	tempDir := t.TempDir()
+	// Three 6MB copies of the test file, a minute apart.
+	names := []string{"1423704299000000", "1423704359000000", "1423704419000000"}
+	copyDataAs(t, tempDir, names)
+	th := createThreadsWithConfig(t, tempDir, config.ThreadConfig{CompactBelowMB: 10})[0]
+	th.SyncFiles()
+	count := func() int { return len(lookupAll(t, th, "port 67")) }
+	if n := count(); n != 12 {
+		t.Fatalf("want 12 packets before compaction, got %d", n)
+	}
+	// The first two files add up to 10MB, so are merged; the third waits
+	// for more to merge with.
+	th.Compact()
+	th.mu.RLock()
+	files := th.getSortedFiles()
+	th.mu.RUnlock()
+	if !reflect.DeepEqual(files, []string{names[0], names[2]}) {
+		t.Fatalf("got files %v after compaction", files)
+	}
+	for _, dir := range []string{pktDir, idxDir} {
+		if _, err := os.Stat(tempDir + dir + names[1]); !os.IsNotExist(err) {
+			t.Errorf("merged file %q left in %q: %v", names[1], dir, err)
+		}
+	}
+	if n := count(); n != 12 {
+		t.Errorf("want 12 packets after compaction, got %d", n)
+	}
+	// Dropping the second file's empty blocks left the merged one at 8MB,
+	// so now it's merged with the third.
+	th.Compact()
+	th.mu.RLock()
+	files = th.getSortedFiles()
+	th.mu.RUnlock()
+	if !reflect.DeepEqual(files, names[:1]) {
+		t.Errorf("got files %v after compacting again", files)
+	}
+	if n := count(); n != 12 {
+		t.Errorf("want 12 packets after compacting again, got %d", n)
+	}
+
+	if _, err := Threads([]config.ThreadConfig{{CompactToMB: 5000}}, tempDir, nil); err == nil {
+		t.Error("want error for oversized compaction")
+	}
+}
+
+func TestExpire(t *testing.T) {
+	tempDir := t.TempDir()
+	names := []string{"1423704299000000", "1423704359000000"}
+	copyDataAs(t, tempDir, names)
+	th := createThreadsWithConfig(t, tempDir, config.ThreadConfig{ExpireAfterHours: 1, PinQuery: "port 67 and host 192.168.0.1"})[0]
+	th.SyncFiles()
+	// Each file's first block holds two ICMPv6 packets, its second four DHCP
+	// packets, all kept as some are pinned.
+	th.Expire()
+	if n := len(lookupAll(t, th, "port 67")); n != 8 {
+		t.Errorf("want 8 pinned packets, got %d", n)
+	}
+	if n := len(lookupAll(t, th, "ip proto 58")); n != 0 {
+		t.Errorf("want ICMPv6 packets expired, got %d", n)
+	}
+
+	// Without the pin, every packet goes, and so do the files.
+	th.pin = nil
+	th.Expire()
+	th.mu.RLock()
+	files := th.getSortedFiles()
+	th.mu.RUnlock()
+	if len(files) != 0 {
+		t.Errorf("got files %v after expiring everything", files)
+	}
+	for _, dir := range []string{pktDir, idxDir} {
+		if _, err := os.Stat(tempDir + dir + names[0]); !os.IsNotExist(err) {
+			t.Errorf("expired file left in %q: %v", dir, err)
+		}
+	}
+
+	for _, conf := range []config.ThreadConfig{
+		{ExpireAfterHours: -1},
+		{ExpireAfterHours: 1, Compression: blockfile.CompressionZstd},
+		{ExpireAfterHours: 1, PinQuery: "port"},
+	} {
+		if _, err := Threads([]config.ThreadConfig{conf}, tempDir, nil); err == nil {
+			t.Errorf("want error for %+v", conf)
+		}
+	}
+}
+
+// copyDataAs copies the test blockfile and its index into a thread's
+// directories under each of the given names.
+func copyDataAs(t *testing.T, tempDir string, names []string) {
+	for _, dir := range []string{pktDir, idxDir} {
+		if err := os.MkdirAll(tempDir+dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range names {
+		for _, pair := range [][2]string{{testBlockFile, pktDir}, {testIndexFile, idxDir}} {
+			if err := exec.Command("cp", pair[0], tempDir+pair[1]+name).Run(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+// lookupAll returns every packet a thread's lookup of q returns.
+func lookupAll(t *testing.T, th *Thread, q string) (out []*base.Packet) {
+	c := th.Lookup(context.Background(), mustQuery(t, q))
+	for p := range c.Receive() {
+		out = append(out, p)
+	}
+	if err := c.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestLookupReadConcurrency(t *testing.T) {
+	var names []string
+	for i := 0; i < 5; i++ {
+		names = append(names, fmt.Sprintf("%d000000", 1423704299+60*i))
+	}
+	for _, n := range []int{0, 1, 2, 5} {
+		tempDir := t.TempDir()
+		copyDataAs(t, tempDir, names)
+		th := createThreadsWithConfig(t, tempDir, config.ThreadConfig{ReadConcurrency: n})[0]
+		th.SyncFiles()
+		pkts := lookupAll(t, th, "port 67")
+		if len(pkts) != 4*len(names) {
+			t.Errorf("concurrency %d: got %d packets, want %d", n, len(pkts), 4*len(names))
+		}
+		// Files hold the same packets, so merging a batch interleaves their
+		// copies by time, and then the next batch starts over.
+		batch := n
+		if batch == 0 {
+			batch = defaultReadConcurrency
+		}
+		for i := 1; i < len(pkts); i++ {
+			if pkts[i].Timestamp.Before(pkts[i-1].Timestamp) != (i%(4*batch) == 0) {
+				t.Errorf("concurrency %d: packet %d out of order", n, i)
+			}
+		}
+
+		// Abandoning a lookup part way through stops it.
+		c := th.Lookup(context.Background(), mustQuery(t, "port 67"))
+		<-c.Receive()
+		c.Discard()
+		select {
+		case <-c.Done():
+		case <-time.After(10 * time.Second):
+			t.Fatalf("concurrency %d: abandoned lookup never finished", n)
+		}
+	}
+	if _, err := Threads([]config.ThreadConfig{{ReadConcurrency: -1}}, t.TempDir(), nil); err == nil {
+		t.Error("want error for negative read concurrency")
+	}
+}
+
+// importCopies imports a capture of 'copies' copies of the test blockfile's
+// packets into a thread, starting at 'start' and a millisecond apart.
+func importCopies(t *testing.T, th *Thread, start time.Time, copies int) {
+	blk, err := blockfile.NewBlockFile(testBlockFile, filecache.NewCache(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blk.Close()
+	var pkts []*base.Packet
+	all := blk.AllPackets()
+	for p := range all.Receive() {
+		pkts = append(pkts, p)
+	}
+	if err := all.Err(); err != nil {
+		t.Fatal(err)
+	}
+	var capture bytes.Buffer
+	w := pcapgo.NewWriterNanos(&capture)
+	if err := w.WriteFileHeader(65536, layers.LinkTypeEthernet); err != nil {
+		t.Fatal(err)
+	}
+	ts := start
+	for i := 0; i < copies; i++ {
+		for _, p := range pkts {
+			ci := p.CaptureInfo
+			ci.Timestamp = ts
+			ts = ts.Add(time.Millisecond)
+			if err := w.WritePacket(ci, p.Data); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if _, err := th.Import(&capture); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLookupReadConcurrencyFullChans(t *testing.T) {
+	// Files matching more packets than fit in their chans, read one at a
+	// time, mustn't wait on one another.
+	tempDir := t.TempDir()
+	th := createThreadsWithConfig(t, tempDir, config.ThreadConfig{ReadConcurrency: 1})[0]
+	start := time.Unix(1423704299, 0)
+	for i := 0; i < 4; i++ {
+		importCopies(t, th, start.Add(time.Duration(i)*time.Minute), 50)
+	}
+	q := mustQuery(t, "port 67")
+	for i := 0; i < 20; i++ {
+		done := make(chan int)
+		go func() {
+			n := 0
+			c := th.Lookup(context.Background(), q)
+			for range c.Receive() {
+				n++
+			}
+			done <- n
+		}()
+		select {
+		case n := <-done:
+			if n != 4*50*4 {
+				t.Fatalf("lookup %d: got %d packets, want %d", i, n, 4*50*4)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("lookup %d never finished", i)
+		}
+	}
+}
+
+func TestLookupTolerant(t *testing.T) {
+	tempDir := t.TempDir()
+	names := []string{"1423704299000000", "1423704359000000", "1423704419000000"}
+	copyDataAs(t, tempDir, names)
+	th := createThreadsWithConfig(t, tempDir, config.ThreadConfig{ReadConcurrency: 2})[0]
+	th.SyncFiles()
+	// Packets past the end of the middle file can't be read.
+	if err := os.Truncate(tempDir+pktDir+names[1], 1<<10); err != nil {
+		t.Fatal(err)
+	}
+	c := th.Lookup(context.Background(), mustQuery(t, "port 67"))
+	for range c.Receive() {
+	}
+	if c.Err() == nil {
+		t.Error("lookup of a damaged file succeeded")
+	}
+	n := 0
+	c = th.LookupTolerant(context.Background(), mustQuery(t, "port 67"))
+	for range c.Receive() {
+		n++
+	}
+	if n != 8 {
+		t.Errorf("tolerant lookup got %d packets, want 8", n)
+	}
+	if err := c.Err(); err == nil || !strings.Contains(err.Error(), names[1]) {
+		t.Errorf("tolerant lookup got error %v, want one naming %q", err, names[1])
+	}
+}
+
+func mustQuery(t *testing.T, q string) query.Query {
+	qry, err := query.NewQuery(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return qry
+}
+
+func TestExportFile(t *testing.T) {
+	tempDir := t.TempDir()
+	copyData(t, tempDir)
+	th := createThreads(t, tempDir)[0]
+	th.SyncFiles()
+	out, err := th.ExportFile(context.Background(), "dhcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var bytes int
+	count := 0
+	for p := range out.Receive() {
+		bytes += len(p.Data)
+		count++
+	}
+	if err := out.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if count != 6 || bytes != 1452 {
+		t.Errorf("got %d packets of %d bytes, want 6 of 1452", count, bytes)
+	}
+	if _, err := th.ExportFile(context.Background(), "missing"); err == nil {
+		t.Error("want error exporting an untracked file")
+	}
+}
+
+func TestReindex(t *testing.T) {
+	tempDir := t.TempDir()
+	copyData(t, tempDir)
+	if err := os.Remove(tempDir + idxDir + "dhcp"); err != nil {
+		t.Fatal(err)
+	}
+	th := createThreads(t, tempDir)[0]
+	th.SyncFiles()
+	if got := len(lookupAll(t, th, "port 67")); got != 0 {
+		t.Fatalf("want no packets before reindexing, got %d", got)
+	}
+	r, err := th.Reindex("dhcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Packets != 6 {
+		t.Errorf("want 6 packets reindexed, got %+v", r)
+	}
+	if got := len(lookupAll(t, th, "port 67")); got != 4 {
+		t.Errorf("want 4 packets after reindexing, got %d", got)
+	}
+	// Tracked files have their index replaced.
+	if _, err := th.Reindex("dhcp"); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(lookupAll(t, th, "port 67")); got != 4 {
+		t.Errorf("want 4 packets after reindexing again, got %d", got)
+	}
+	for _, name := range []string{"missing", "../idx/dhcp", ".dhcp.reindexing"} {
+		if _, err := th.Reindex(name); err == nil {
+			t.Errorf("reindexed %q", name)
+		}
+	}
+}
+
+func TestLookupRuledOut(t *testing.T) {
+	tempDir := t.TempDir()
+	copyData(t, tempDir)
+	th := createThreads(t, tempDir)[0]
+	th.SyncFiles()
+	// The testdata's index predates IP filters.
+	if _, err := th.Reindex("dhcp"); err != nil {
+		t.Fatal(err)
+	}
+	filesRuledOut.Set(0)
+	if got := len(lookupAll(t, th, "host 10.99.99.99")); got != 0 {
+		t.Errorf("want no packets, got %d", got)
+	}
+	if got := len(lookupAll(t, th, "port 67")); got != 4 {
+		t.Errorf("want 4 packets, got %d", got)
+	}
+	w := httptest.NewRecorder()
+	stats.S.ServeHTTP(w, nil)
+	if want := "lookup_files_ruled_out\t1\n"; !strings.Contains(w.Body.String(), want) {
+		t.Errorf("stats missing %q", want)
+	}
+}
+
+func TestMigrateIndexes(t *testing.T) {
+	defer func(rate int64) { migrateBytesPerSec = rate }(migrateBytesPerSec)
+	migrateBytesPerSec = 1 << 40
+	tempDir := t.TempDir()
+	copyData(t, tempDir)
+	th := createThreadsWithConfig(t, tempDir, config.ThreadConfig{MigrateIndexes: true})[0]
+	th.SyncFiles()
+	outdated := func() bool {
+		th.mu.RLock()
+		defer th.mu.RUnlock()
+		return th.files["dhcp"].IndexOutdated(th.indexOpts)
+	}
+	// The testdata's index predates recorded key types.
+	if !outdated() {
+		t.Fatal("testdata index not outdated")
+	}
+	th.MigrateIndexes()
+	if outdated() {
+		t.Error("index still outdated after migrating")
+	}
+	if got := len(lookupAll(t, th, "port 67")); got != 4 {
+		t.Errorf("want 4 packets after migrating, got %d", got)
+	}
+}
+
+// addNewFile copies the testdata's blockfile and index into the thread's
+// directories under the given name, as if stenotype had just written them,
+// and has the thread pick them up.
+func addNewFile(t *testing.T, th *Thread, name string) {
+	for src, dst := range map[string]string{testBlockFile: th.getPacketFilePath(name), testIndexFile: th.getIndexFilePath(name)} {
+		if err := exec.Command("cp", src, dst).Run(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	th.SyncFiles()
+}
+
+func TestConvertIndexNewFiles(t *testing.T) {
+	tempDir := t.TempDir()
+	copyData(t, tempDir)
+	th := createThreads(t, tempDir)[0]
+	th.SyncFiles()
+	addNewFile(t, th, "new")
+	legacy := func(name string) bool {
+		f, err := os.Open(th.getIndexFilePath(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := indextable.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		return indextable.IsLegacy(r)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for legacy("new") {
+		if time.Now().After(deadline) {
+			t.Fatal("new file's index never converted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// Files found at startup are left alone.
+	if !legacy("dhcp") {
+		t.Error("index of file found at startup converted")
+	}
+	if got := len(lookupAll(t, th, "port 67")); got != 8 {
+		t.Errorf("want 8 packets, got %d", got)
+	}
+}
+
+func TestCustomIndexersNewFiles(t *testing.T) {
+	tempDir := t.TempDir()
+	copyData(t, tempDir)
+	th := createThreads(t, tempDir)[0]
+	th.SetIndexOptions(indexfile.BuilderOptions{CustomIndexers: []string{"sip"}})
+	th.SyncFiles()
+	addNewFile(t, th, "new")
+	outdated := func(name string) bool {
+		th.mu.RLock()
+		defer th.mu.RUnlock()
+		return th.files[name].IndexOutdated(th.indexOpts)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for outdated("new") {
+		if time.Now().After(deadline) {
+			t.Fatal("new file never indexed with custom indexers")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// Files found at startup are left to MigrateIndexes.
+	if !outdated("dhcp") {
+		t.Error("file found at startup reindexed")
+	}
+	if got := len(lookupAll(t, th, "port 67")); got != 8 {
+		t.Errorf("want 8 packets, got %d", got)
+	}
+}
+
+func TestSharedFilesystem(t *testing.T) {
+	tempDir := t.TempDir()
+	names := []string{"1423704299000000", "1423704359000000"}
+	copyDataAs(t, tempDir, names)
+	conf := config.ThreadConfig{SharedFilesystem: true}
+	writer := createThreadsWithConfig(t, tempDir, conf)[0]
+	conf.PacketsDirectory, conf.IndexDirectory = writer.conf.PacketsDirectory, writer.conf.IndexDirectory
+	readers, err := Threads([]config.ThreadConfig{conf}, t.TempDir(), filecache.NewCache(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := readers[0]
+	reader.SetReadOnly()
+	writer.SyncFiles()
+	reader.SyncFiles()
+	if got := len(lookupAll(t, reader, "port 67")); got != 8 {
+		t.Fatalf("reader got %d packets, want 8", got)
+	}
+
+	// A reader part way through a file keeps the writer from changing it.
+	defer func(wait time.Duration) { blockfile.SharedLockWait = wait }(blockfile.SharedLockWait)
+	blockfile.SharedLockWait = 0
+	path := writer.getPacketFilePath(names[0])
+	reader.mu.RLock()
+	iter := reader.files[names[0]].Iterate()
+	reader.mu.RUnlock()
+	if lock, err := blockfile.LockExclusive(path); err != filecache.ErrLocked {
+		lock.Unlock()
+		t.Errorf("locking file being read: want %v, got %v", filecache.ErrLocked, err)
+	}
+	iter.Close()
+	lock, err := blockfile.LockExclusive(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lock.Unlock()
+
+	// Files the writer replaces are reopened, and those it removes dropped.
+	reader.mu.RLock()
+	old := reader.files[names[1]]
+	reader.mu.RUnlock()
+	for _, pair := range [][2]string{{testBlockFile, writer.getPacketFilePath(names[1])}, {testIndexFile, writer.getIndexFilePath(names[1])}} {
+		tmp := filepath.Join(filepath.Dir(pair[1]), ".replacing")
+		if err := exec.Command("cp", pair[0], tmp).Run(); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(tmp, pair[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.Remove(writer.getIndexFilePath(names[0]))
+	os.Remove(path)
+	reader.SyncFiles()
+	reader.mu.RLock()
+	tracked, current := len(reader.files), reader.files[names[1]]
+	reader.mu.RUnlock()
+	if tracked != 1 || current == nil || current == old {
+		t.Errorf("after changes, reader tracks %d files, %q reopened: %v", tracked, names[1], current != old)
+	}
+	if got := len(lookupAll(t, reader, "port 67")); got != 4 {
+		t.Errorf("reader got %d packets after changes, want 4", got)
+	}
+	if _, err := reader.Import(strings.NewReader("")); err == nil {
+		t.Error("want error importing into a read-only thread")
+	}
+	if _, err := Threads([]config.ThreadConfig{{SharedFilesystem: true, Reader: blockfile.ReaderMmap}}, t.TempDir(), nil); err == nil {
+		t.Error("want error mapping shared blockfiles")
+	}
+}
+
+func TestScrub(t *testing.T) {
+	defer func(rate int64) { scrubBytesPerSec = rate }(scrubBytesPerSec)
+	scrubBytesPerSec = 1 << 40
+	tempDir := t.TempDir()
+	names := []string{"1423704299000000", "1423704359000000"}
+	copyDataAs(t, tempDir, names)
+	th := createThreadsWithConfig(t, tempDir, config.ThreadConfig{ScrubEveryHours: 1, QuarantineCorrupt: true})[0]
+	th.SyncFiles()
+	th.Scrub()
+	th.mu.RLock()
+	tracked := len(th.files)
+	th.mu.RUnlock()
+	if tracked != 2 || len(th.scrubbed) != 2 {
+		t.Fatalf("after scrubbing intact files, %d tracked and %d scrubbed", tracked, len(th.scrubbed))
+	}
+
+	// Damage the second file's first block.  It's not rechecked until it's
+	// due.
+	f, err := os.OpenFile(th.getPacketFilePath(names[1]), os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte{0xff}, 0); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	th.Scrub()
+	th.mu.RLock()
+	tracked = len(th.files)
+	th.mu.RUnlock()
+	if tracked != 2 {
+		t.Errorf("file scrubbed again before it was due")
+	}
+	th.scrubbed[names[1]] = time.Time{}
+	th.Scrub()
+	th.mu.RLock()
+	_, ok := th.files[names[1]]
+	th.mu.RUnlock()
+	if ok {
+		t.Errorf("corrupt file %q still tracked", names[1])
+	}
+	for _, path := range []string{th.getPacketFilePath(names[1]), th.getIndexFilePath(names[1])} {
+		if _, err := os.Stat(filepath.Join(filepath.Dir(path), quarantineDir, names[1])); err != nil {
+			t.Errorf("not quarantined: %v", err)
+		}
+	}
+	if got := len(lookupAll(t, th, "port 67")); got != 4 {
+		t.Errorf("got %d packets after quarantine, want 4", got)
+	}
+	// Quarantined files aren't found again.
+	th.SyncFiles()
+	th.mu.RLock()
+	tracked = len(th.files)
+	th.mu.RUnlock()
+	if tracked != 1 {
+		t.Errorf("tracking %d files after resync, want 1", tracked)
+	}
+}